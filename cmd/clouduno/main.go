@@ -9,14 +9,22 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/freshwebio/cloud-uno/internal/coresvc"
 	"github.com/freshwebio/cloud-uno/internal/gcloud/grpc"
 	"github.com/freshwebio/cloud-uno/internal/gcloud/httpapi"
 	"github.com/freshwebio/cloud-uno/internal/webserver"
+	"github.com/freshwebio/cloud-uno/pkg/certs"
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/proxy"
 	"github.com/freshwebio/cloud-uno/pkg/services"
 	"github.com/freshwebio/cloud-uno/pkg/types"
 	"github.com/gorilla/mux"
@@ -24,37 +32,135 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func httpServe(l net.Listener, resolver types.Resolver) error {
+func httpHandler(registry *types.Registry) (http.Handler, error) {
 	mux := mux.NewRouter()
-	httpapi.RegisterSecretManager(mux, resolver)
-	err := webserver.RegisterStatic(mux, resolver)
+	// Routes are only registered for the services that are enabled.
+	httpapi.RegisterSecretManager(mux, registry)
+	httpapi.RegisterKMS(mux, registry)
+	httpapi.RegisterTasks(mux, registry)
+	httpapi.RegisterScheduler(mux, registry)
+	httpapi.RegisterDNS(mux, registry)
+	httpapi.RegisterResourceManager(mux, registry)
+	httpapi.RegisterMetadata(mux, registry)
+	httpapi.RegisterOAuth2(mux, registry)
+	httpapi.RegisterIAMCredentials(mux, registry)
+	httpapi.RegisterIAMAdmin(mux, registry)
+	mux.Use(httpapi.IAMMiddleware(registry))
+	webserver.RegisterCACert(mux, registry)
+	err := webserver.RegisterStatic(mux, registry)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s := &http.Server{Handler: mux}
-	return s.Serve(l)
+	// Project numbers must be resolved before routing as routes
+	// and IAM policies are matched against project IDs.
+	handler := httpapi.ResolveProjectNames(registry, mux)
+	// Requests for hosts routed to emulators listening on their own addresses
+	// never reach the Cloud::1 routes.
+	if p, ok := types.Get(registry, proxy.Key); ok {
+		handler = p.Handler(handler)
+	}
+	return handler, nil
 }
 
 func main() {
-	resolver := services.NewDefaultResolver()
-	err := resolver.Register(coresvc.RegisterServices)
-	if err != nil {
+	registry := services.NewDefaultRegistry(coresvc.RegisterServices)
+	// Providing services adds their hosts, so the services that have been provided
+	// are stopped before exiting to remove them again. Nothing can have been
+	// provided when the config couldn't be.
+	exit := func(err error) {
+		if cfg, ok := types.Get(registry, config.Key); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(cfg))
+			defer cancel()
+			stopErr := registry.Stop(ctx)
+			if stopErr != nil {
+				log.Println("Stop error: ", stopErr)
+			}
+		}
 		log.Fatal(err)
 	}
+	err := registry.Build()
+	if err != nil {
+		exit(err)
+	}
+	cfg := types.MustGet(registry, config.Key)
+
+	// The same handler and gRPC server are used for plain and TLS connections.
+	handler, err := httpHandler(registry)
+	if err != nil {
+		exit(err)
+	}
+	grpcServer := grpc.NewServer(registry)
 	listener, err := net.Listen("tcp", ":5988")
 	if err != nil {
-		log.Fatal(err)
+		exit(err)
+	}
+	var tlsListener net.Listener
+	if ca, ok := types.Get(registry, certs.Key); ok {
+		tlsListener, err = tlsListen(registry, ca)
+		if err != nil {
+			listener.Close()
+			exit(err)
+		}
+	}
+	// Services are started in dependency order once everything is
+	// provided, before any requests can reach them.
+	err = registry.Start(context.Background())
+	if err != nil {
+		exit(err)
 	}
+
+	g, serveCtx := errgroup.WithContext(context.Background())
+	srv := newServers(g, grpcServer)
 	m := cmux.New(listener)
-	grpcListener := m.Match(cmux.HTTP2HeaderField("content-type", "application/grpc"))
+	// gRPC clients such as grpc-go wait for the server's settings before sending
+	// headers, so the matcher has to send them. Only the gRPC server speaks HTTP/2
+	// on this port so the settings can't collide with another server's.
+	grpcListener := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
 	httpListener := m.Match(cmux.HTTP1Fast())
+	srv.serveGRPC(grpcListener)
+	srv.serveHTTP(&http.Server{Handler: handler}, httpListener)
+	srv.serveMux(m, listener)
+	if tlsListener != nil {
+		err = serveTLS(srv, tlsListener, handler)
+		if err != nil {
+			exit(err)
+		}
+		log.Printf("Serving HTTPS and TLS gRPC on %s ...", tlsListener.Addr())
+	}
+	log.Println("Running Cloud::1 Server on port 5988 ...")
 
-	g := new(errgroup.Group)
-	g.Go(func() error { return grpc.Serve(grpcListener, resolver) })
-	g.Go(func() error { return httpServe(httpListener, resolver) })
-	g.Go(func() error { return m.Serve() })
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down ...", sig)
+	case <-serveCtx.Done():
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(cfg))
+	defer cancel()
+	// A second signal gives up on waiting for requests and services.
+	go func() {
+		<-signals
+		cancel()
+	}()
 
-	log.Println("Running Cloud::1 Server on port 5988 ...")
-	g.Wait()
+	// Servers are drained first so services aren't stopped while
+	// they are still handling requests.
+	shutdownErr := srv.shutdown(ctx)
+	stopErr := registry.Stop(ctx)
+	serveErr := g.Wait()
+	if serveErr != nil {
+		log.Fatal("Serve error: ", serveErr)
+	}
+	if shutdownErr != nil {
+		log.Fatal("Shutdown error: ", shutdownErr)
+	}
+	if stopErr != nil {
+		log.Fatal("Stop error: ", stopErr)
+	}
+}
+
+func shutdownTimeout(cfg *config.Config) time.Duration {
+	return time.Duration(*cfg.ShutdownTimeout) * time.Second
 }
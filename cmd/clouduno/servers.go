@@ -0,0 +1,94 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/soheilhy/cmux"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+// servers provides the servers Cloud::1 serves HTTP and gRPC with
+// and the listeners they share, so they can be drained together.
+type servers struct {
+	g           *errgroup.Group
+	grpcServer  *grpc.Server
+	httpServers []*http.Server
+	listeners   []net.Listener
+	mu          sync.Mutex
+	closing     bool
+}
+
+func newServers(g *errgroup.Group, grpcServer *grpc.Server) *servers {
+	return &servers{g: g, grpcServer: grpcServer}
+}
+
+// serveMux serves the connections matched by a cmux listener.
+func (s *servers) serveMux(m cmux.CMux, l net.Listener) {
+	s.listeners = append(s.listeners, l)
+	s.g.Go(func() error { return s.unlessClosing(m.Serve()) })
+}
+
+func (s *servers) serveGRPC(l net.Listener) {
+	s.g.Go(func() error { return s.unlessClosing(s.grpcServer.Serve(l)) })
+}
+
+func (s *servers) serveHTTP(server *http.Server, l net.Listener) {
+	s.httpServers = append(s.httpServers, server)
+	s.g.Go(func() error { return s.unlessClosing(server.Serve(l)) })
+}
+
+// unlessClosing drops the errors servers return
+// once their listeners are closed to shut them down.
+func (s *servers) unlessClosing(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	return err
+}
+
+// shutdown deals with no longer accepting connections and waiting for
+// the requests and calls in progress to finish, connections that are
+// still open when the context is done are closed.
+func (s *servers) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+
+	var err error
+	for _, server := range s.httpServers {
+		shutdownErr := server.Shutdown(ctx)
+		if shutdownErr != nil {
+			server.Close()
+			err = shutdownErr
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		err = ctx.Err()
+	}
+	return err
+}
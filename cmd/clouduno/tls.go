@@ -0,0 +1,73 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/certs"
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/netutils"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"golang.org/x/net/http2"
+)
+
+// tlsListen deals with listening for HTTPS and TLS gRPC connections with certificates
+// issued by the Cloud::1 CA for the emulator host each client asks for with SNI.
+// Clients that don't send a server name get a certificate for the server IP.
+func tlsListen(registry *types.Registry, ca *certs.CA) (net.Listener, error) {
+	cfg := types.MustGet(registry, config.Key)
+	logger := types.MustGet(registry, logging.Key)
+
+	serverIP, err := netutils.SelectServerIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Certificates are only issued for the hosts emulators register.
+	policy, err := hosts.NewPolicy(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	issuer := certs.NewIssuer(ca, serverIP, policy.AllowsHost)
+
+	listener, err := net.Listen("tcp", *cfg.TLSAddr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, issuer.TLSConfig()), nil
+}
+
+// serveTLS serves gRPC and HTTP on the same TLS listener. Clients negotiate HTTP/2 for
+// plain HTTPS requests as well as gRPC, so every HTTP/2 connection is served by one
+// HTTP/2 server that hands gRPC requests to the gRPC server. The HTTP server sees the
+// TLS connections, so it keeps track of HTTP/2 connections when it is shut down.
+// cmux isn't used here as it is for the plain port, matching gRPC connections means the
+// matcher sends the server's HTTP/2 settings, which breaks the HTTP/2 connections
+// of HTTPS clients that are passed on to the HTTP server afterwards.
+func serveTLS(srv *servers, l net.Listener, handler http.Handler) error {
+	grpcOrHTTP := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			srv.grpcServer.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	server := &http.Server{Handler: grpcOrHTTP}
+	err := http2.ConfigureServer(server, &http2.Server{})
+	if err != nil {
+		return err
+	}
+	srv.serveHTTP(server, l)
+	return nil
+}
@@ -11,44 +11,93 @@ package main
 import (
 	"fmt"
 	"log"
-	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/freshwebio/cloud-uno/pkg/config"
-	"github.com/freshwebio/cloud-uno/pkg/connect"
 	"github.com/freshwebio/cloud-uno/pkg/hosts"
 	"github.com/freshwebio/cloud-uno/pkg/logging"
 	"google.golang.org/grpc"
 )
 
 func main() {
+	logger := logging.CreateLogger()
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		err := plan(os.Args[2:], logger)
+		if err != nil {
+			log.Fatal("Plan error: ", err)
+		}
+		return
+	}
 
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	logger := logging.CreateLogger()
-
-	grpcServer := grpc.NewServer()
-	managerImpl, err := hosts.NewManager(cfg, logger)
+	// Listen before creating the hosts service so the host agent fails fast
+	// when another host agent is already running.
+	listener, serverOpts, err := hosts.Listen(cfg)
+	if err != nil {
+		log.Fatal("Listen error: ", err)
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
+	managerImpl, err := hosts.NewService(cfg, logger)
+	if err != nil {
+		log.Fatal("Create hosts service error: ", err)
+	}
+	listService, ok := managerImpl.(hosts.ListService)
+	if !ok {
+		log.Fatal("Create hosts service error: the hosts service does not support listing hosts")
+	}
+	feed, err := hosts.NewChangeFeed(listService)
 	if err != nil {
-		log.Fatal("Create hosts manager error: ", err)
+		log.Fatal("Create hosts change feed error: ", err)
 	}
+	// Only the hosts Cloud::1 emulators use can be added by the host agent,
+	// so it can't be used to redirect other hosts on the machine.
+	policy, err := hosts.NewPolicy(cfg, logger)
+	if err != nil {
+		log.Fatal("Create host agent policy error: ", err)
+	}
+	// Hosts added by Cloud::1 servers are leased so they are removed
+	// if a server dies without removing them.
+	leases := hosts.NewLeases(feed, logger)
 	hosts.RegisterManagerServer(
 		grpcServer,
 		&hosts.GRPCServer{
-			Impl: managerImpl,
+			Impl:   feed,
+			Leases: leases,
+			Feed:   feed,
+			Policy: policy,
 		},
 	)
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", connect.HostAgentPort))
-	if err != nil {
-		log.Fatal("Listen error: ", err)
-	}
+	// On a clean shutdown the hosts service removes the loopback alias it created.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		grpcServer.Stop()
+	}()
 
-	fmt.Println("Serving Cloud::1 Host Agent on port 5989 ...")
+	fmt.Printf("Serving Cloud::1 Host Agent on %s ...\n", listener.Addr())
 	err = grpcServer.Serve(listener)
+	leases.Shutdown()
+	shutdownErr := shutdown(managerImpl)
 	if err != nil {
 		log.Fatal("Serve error: ", err)
 	}
+	if shutdownErr != nil {
+		log.Fatal("Shutdown error: ", shutdownErr)
+	}
+}
+
+func shutdown(service hosts.Service) error {
+	shutdowner, ok := service.(interface{ Shutdown() error })
+	if !ok {
+		return nil
+	}
+	return shutdowner.Shutdown()
 }
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/sirupsen/logrus"
+)
+
+// planTimeout is how long the plan command waits
+// to connect to the host agent and get a plan.
+const planTimeout = 30 * time.Second
+
+// hostsChanges collects the hosts to add or remove for the plan command,
+// each value is an IP (or an IPv4 and IPv6 pair) and a list of hosts
+// (e.g. 172.18.0.22,fd00::22=storage.googleapis.local,pubsub.googleapis.local).
+type hostsChanges []*hosts.HostsRequest
+
+func (c *hostsChanges) String() string {
+	values := []string{}
+	for _, change := range *c {
+		values = append(values, fmt.Sprintf("%s=%s", strings.Join(change.Ips, ","), strings.Join(change.Hosts, ",")))
+	}
+	return strings.Join(values, " ")
+}
+
+func (c *hostsChanges) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("hosts must be given as ip=host1,host2")
+	}
+	*c = append(*c, &hosts.HostsRequest{
+		Ips:   strings.Split(parts[0], ","),
+		Hosts: strings.Split(parts[1], ","),
+	})
+	return nil
+}
+
+func (c hostsChanges) params() []*hosts.Params {
+	paramsList := []*hosts.Params{}
+	for _, change := range c {
+		ip := strings.Join(change.Ips, ",")
+		hostsValue := strings.Join(change.Hosts, ",")
+		paramsList = append(paramsList, &hosts.Params{IP: &ip, Hosts: &hostsValue})
+	}
+	return paramsList
+}
+
+// plan prints a unified diff of the changes adding and removing hosts would make
+// to the hosts file without making them, either through the running host agent
+// or directly against the hosts file. Configuration is taken from environment
+// variables or the config file.
+func plan(args []string, logger *logrus.Entry) error {
+	flagSet := flag.NewFlagSet("plan", flag.ExitOnError)
+	var additions hostsChanges
+	var removals hostsChanges
+	flagSet.Var(&additions, "add", "Hosts to add as ip=host1,host2, can be repeated.")
+	flagSet.Var(&removals, "remove", "Hosts to remove as ip=host1,host2, can be repeated. Removals are planned before additions.")
+	local := flagSet.Bool(
+		"local",
+		false,
+		"Plan against the hosts file directly instead of through the running host agent, the hosts file is only read.",
+	)
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	var diff string
+	if *local {
+		diff, err = planLocal(cfg, logger, removals, additions)
+	} else {
+		diff, err = planWithHostAgent(cfg, removals, additions)
+	}
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Println("No changes to the hosts file.")
+		return nil
+	}
+	fmt.Print(diff)
+	return nil
+}
+
+func planLocal(cfg *config.Config, logger *logrus.Entry, removals hostsChanges, additions hostsChanges) (string, error) {
+	readOnly := true
+	cfg.HostsReadOnly = &readOnly
+	manager, err := hosts.NewManager(cfg, logger)
+	if err != nil {
+		return "", err
+	}
+	return manager.(hosts.PlanService).Plan(removals.params(), additions.params())
+}
+
+func planWithHostAgent(cfg *config.Config, removals hostsChanges, additions hostsChanges) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), planTimeout)
+	defer cancel()
+	conn, err := hosts.DialHostAgent(ctx, cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to the host agent: %w", err)
+	}
+	defer conn.Close()
+	response, err := hosts.NewManagerClient(conn).Plan(ctx, &hosts.PlanRequest{
+		Removals:  removals,
+		Additions: additions,
+	})
+	if err != nil {
+		return "", err
+	}
+	return response.GetDiff(), nil
+}
@@ -1,35 +1,47 @@
 module github.com/freshwebio/cloud-uno
 
-go 1.15
+go 1.18
+
+require (
+	github.com/dimchansky/utfbom v1.1.1
+	github.com/docker/docker v20.10.1+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/google/uuid v1.1.2
+	github.com/gorilla/mux v1.8.0
+	github.com/jinzhu/copier v0.1.0
+	github.com/miekg/dns v1.1.43
+	github.com/namsral/flag v1.7.4-pre
+	github.com/pmezard/go-difflib v1.0.0
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/sirupsen/logrus v1.7.0
+	github.com/soheilhy/cmux v0.1.4
+	github.com/spf13/afero v1.4.1
+	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netns v0.0.0-20211101163701-50045581ed74
+	golang.org/x/net v0.35.0
+	golang.org/x/sync v0.11.0
+	golang.org/x/sys v0.30.0
+	google.golang.org/genproto v0.0.0-20220602131408-e326c6e8e9c8
+	google.golang.org/grpc v1.46.2
+	google.golang.org/protobuf v1.28.0
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405
+)
 
 require (
 	github.com/Microsoft/go-winio v0.5.1 // indirect
 	github.com/containerd/containerd v1.4.3 // indirect
-	github.com/dimchansky/utfbom v1.1.1
 	github.com/docker/distribution v2.7.1+incompatible // indirect
-	github.com/docker/docker v20.10.1+incompatible
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-units v0.4.0 // indirect
 	github.com/gogo/protobuf v1.3.1 // indirect
-	github.com/google/uuid v1.1.2
-	github.com/gorilla/mux v1.8.0
-	github.com/jinzhu/copier v0.1.0
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/moby/term v0.0.0-20210619224110-3f7ff695adc6 // indirect
 	github.com/morikuni/aec v1.0.0 // indirect
-	github.com/namsral/flag v1.7.4-pre
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.0.1 // indirect
-	github.com/sirupsen/logrus v1.7.0
-	github.com/soheilhy/cmux v0.1.4
-	github.com/spf13/afero v1.4.1
-	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58
-	golang.org/x/text v0.3.4 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/text v0.22.0 // indirect
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac // indirect
-	google.golang.org/genproto v0.0.0-20201201144952-b05cb90ed32e
-	google.golang.org/grpc v1.36.0
 	google.golang.org/grpc/examples v0.0.0-20211105190353-878cea231056 // indirect
-	google.golang.org/protobuf v1.25.0
-	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405
 	gotest.tools/v3 v3.0.3 // indirect
 )
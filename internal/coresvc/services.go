@@ -9,41 +9,29 @@
 package coresvc
 
 import (
-	"errors"
-
 	"github.com/freshwebio/cloud-uno/pkg/config"
 	"github.com/freshwebio/cloud-uno/pkg/logging"
 	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/freshwebio/cloud-uno/pkg/utils"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 )
 
-var (
-	// ErrMissingOrInvalidFS provides the error to be used
-	// when the file system service is not where it is expected to be in the service resolver.
-	ErrMissingOrInvalidFS = errors.New("file system service missing in resolver container or is of an unexpected type")
-)
-
-// RegisterServices deals with registering core
+// RegisterServices deals with registering the providers of core
 // services to be used throughout the application.
-func RegisterServices(resolver types.Resolver) error {
-	cfg, ok := resolver.Get("config").(*config.Config)
-	if !ok {
-		return config.ErrMissingOrInvalidConfigService
-	}
-
+func RegisterServices(r *types.Registry) {
 	// The file system is used for services implemented directly in Cloud::1,
 	// when handing off to other services like google cloud emulators we have no
 	// control over whether that uses the file system or not.
-	var fs afero.Fs
-	if *cfg.FileSystem == "memory" {
-		fs = afero.NewMemMapFs()
-	} else {
-		fs = afero.NewOsFs()
-	}
-	resolver.Set("fs", fs)
-
-	logger := logging.CreateLogger()
-	resolver.Set("logger", logger)
-
-	return nil
+	types.Provide(r, utils.FileSystemKey, func(r *types.Registry) (afero.Fs, error) {
+		cfg := types.MustGet(r, config.Key)
+		if *cfg.FileSystem == "memory" {
+			return afero.NewMemMapFs(), nil
+		}
+		return afero.NewOsFs(), nil
+	}, types.Requires(config.Key))
+
+	types.Provide(r, logging.Key, func(r *types.Registry) (*logrus.Entry, error) {
+		return logging.CreateLogger(), nil
+	})
 }
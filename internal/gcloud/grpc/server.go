@@ -11,18 +11,87 @@ package grpc
 import (
 	"net"
 
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/proxy"
 	"github.com/freshwebio/cloud-uno/pkg/types"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
 	"google.golang.org/grpc"
 )
 
 // Serve deals with serving all the gRPC servers for the subset of google cloud services
 // implemented with gRPC.
-func Serve(l net.Listener, resolver types.Resolver) error {
-	s := grpc.NewServer()
-	secretmanagerpb.RegisterSecretManagerServiceServer(
-		s,
-		resolver.Get("gcloud.secretmanager").(secretmanagerpb.SecretManagerServiceServer),
-	)
-	return s.Serve(l)
+func Serve(l net.Listener, r *types.Registry) error {
+	return NewServer(r).Serve(l)
+}
+
+// NewServer creates a gRPC server with the subset of google cloud services
+// implemented with gRPC that are enabled registered, the server can serve more than one listener.
+func NewServer(r *types.Registry) *grpc.Server {
+	unaryInterceptors := []grpc.UnaryServerInterceptor{}
+	streamInterceptors := []grpc.StreamServerInterceptor{}
+	proxyOptions := []grpc.ServerOption{}
+	// Calls for hosts routed to emulators listening on their own addresses
+	// are proxied before any other interceptor sees them.
+	if p, ok := types.Get(r, proxy.Key); ok {
+		streamInterceptors = append(streamInterceptors, p.StreamServerInterceptor())
+		proxyOptions = p.ServerOptions()
+	}
+	// Project numbers are resolved to project IDs before IAM is enforced
+	// so policies apply whichever one a client uses.
+	resourceManager, resourceManagerEnabled := types.Get(r, gcloud.ResourceManagerKey)
+	if resourceManagerEnabled {
+		unaryInterceptors = append(unaryInterceptors, resourceManager.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, resourceManager.StreamServerInterceptor())
+	}
+	// When IAM is enabled every call to a Google Cloud API must carry
+	// an access token for a principal with the required permission.
+	iamService, iamEnabled := types.Get(r, gcloud.IAMKey)
+	if iamEnabled {
+		unaryInterceptors = append(unaryInterceptors, iamService.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, iamService.StreamServerInterceptor())
+	}
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+	serverOptions = append(serverOptions, proxyOptions...)
+	s := grpc.NewServer(serverOptions...)
+	if secretmgr, ok := types.Get(r, gcloud.SecretManagerKey); ok {
+		secretmanagerpb.RegisterSecretManagerServiceServer(s, secretmgr)
+	}
+	// Pub/Sub is served by a single service that implements
+	// both the publisher and subscriber APIs.
+	if pubsub, ok := types.Get(r, gcloud.PubSubKey); ok {
+		pubsubpb.RegisterPublisherServer(s, pubsub)
+		pubsubpb.RegisterSubscriberServer(s, pubsub)
+	}
+	if kms, ok := types.Get(r, gcloud.KMSKey); ok {
+		kmspb.RegisterKeyManagementServiceServer(s, kms)
+	}
+	if tasks, ok := types.Get(r, gcloud.TasksKey); ok {
+		taskspb.RegisterCloudTasksServer(s, tasks)
+	}
+	if scheduler, ok := types.Get(r, gcloud.SchedulerKey); ok {
+		schedulerpb.RegisterCloudSchedulerServer(s, scheduler)
+	}
+	if iamCredentials, ok := types.Get(r, gcloud.IAMCredentialsKey); ok {
+		credentialspb.RegisterIAMCredentialsServer(s, iamCredentials)
+	}
+	if resourceManagerEnabled {
+		resourcemanagerpb.RegisterProjectsServer(s, resourceManager)
+		resourcemanagerpb.RegisterFoldersServer(s, resourceManager)
+	}
+	if iamEnabled {
+		iampb.RegisterIAMPolicyServer(s, iamService)
+		adminpb.RegisterIAMServer(s, iamService)
+	}
+	return s
 }
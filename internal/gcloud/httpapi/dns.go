@@ -0,0 +1,262 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/dns"
+	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DNSHost specifies the host on which Cloud::1 will accept
+	// API requests for Google Cloud DNS.
+	DNSHost = "dns.googleapis.local"
+
+	dnsProjectPath = "/dns/v1/projects/{project}"
+	dnsZonePath    = dnsProjectPath + "/managedZones/{managedZone}"
+	dnsRrsetPath   = dnsZonePath + "/rrsets/{name}/{type}"
+)
+
+// RegisterDNS deals with registering the routes for the Cloud DNS api.
+// Cloud DNS doesn't have a gRPC api so routes are named after
+// the method IDs from the discovery document of the REST api.
+func RegisterDNS(router *mux.Router, registry *types.Registry) {
+	dnsService, ok := types.Get(registry, gcloud.DNSKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &dnsController{
+		dnsService,
+		logger,
+	}
+	router.HandleFunc(dnsProjectPath+"/managedZones", c.ListManagedZones).
+		Methods("GET").Host(DNSHost).
+		Name("dns.managedZones.list")
+	router.HandleFunc(dnsProjectPath+"/managedZones", c.CreateManagedZone).
+		Methods("POST").Host(DNSHost).
+		Name("dns.managedZones.create")
+	router.HandleFunc(dnsZonePath, c.GetManagedZone).
+		Methods("GET").Host(DNSHost).
+		Name("dns.managedZones.get")
+	router.HandleFunc(dnsZonePath, c.PatchManagedZone).
+		Methods("PATCH").Host(DNSHost).
+		Name("dns.managedZones.patch")
+	router.HandleFunc(dnsZonePath, c.UpdateManagedZone).
+		Methods("PUT").Host(DNSHost).
+		Name("dns.managedZones.update")
+	router.HandleFunc(dnsZonePath, c.DeleteManagedZone).
+		Methods("DELETE").Host(DNSHost).
+		Name("dns.managedZones.delete")
+	router.HandleFunc(dnsZonePath+"/changes", c.ListChanges).
+		Methods("GET").Host(DNSHost).
+		Name("dns.changes.list")
+	router.HandleFunc(dnsZonePath+"/changes", c.CreateChange).
+		Methods("POST").Host(DNSHost).
+		Name("dns.changes.create")
+	router.HandleFunc(dnsZonePath+"/changes/{changeId}", c.GetChange).
+		Methods("GET").Host(DNSHost).
+		Name("dns.changes.get")
+	router.HandleFunc(dnsZonePath+"/rrsets", c.ListResourceRecordSets).
+		Methods("GET").Host(DNSHost).
+		Name("dns.resourceRecordSets.list")
+	router.HandleFunc(dnsZonePath+"/rrsets", c.CreateResourceRecordSet).
+		Methods("POST").Host(DNSHost).
+		Name("dns.resourceRecordSets.create")
+	router.HandleFunc(dnsRrsetPath, c.GetResourceRecordSet).
+		Methods("GET").Host(DNSHost).
+		Name("dns.resourceRecordSets.get")
+	router.HandleFunc(dnsRrsetPath, c.PatchResourceRecordSet).
+		Methods("PATCH").Host(DNSHost).
+		Name("dns.resourceRecordSets.patch")
+	router.HandleFunc(dnsRrsetPath, c.DeleteResourceRecordSet).
+		Methods("DELETE").Host(DNSHost).
+		Name("dns.resourceRecordSets.delete")
+}
+
+type dnsController struct {
+	dns    *dns.Service
+	logger *logrus.Entry
+}
+
+func (c *dnsController) ListManagedZones(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	maxResults, _ := strconv.ParseInt(query.Get("maxResults"), 10, 64)
+	response, err := c.dns.ListManagedZones(
+		mux.Vars(r)["project"], query.Get("dnsName"), maxResults, query.Get("pageToken"),
+	)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) CreateManagedZone(w http.ResponseWriter, r *http.Request) {
+	zone := &dns.ManagedZone{}
+	if !readJSONRequest(w, r, zone) {
+		return
+	}
+	response, err := c.dns.CreateManagedZone(mux.Vars(r)["project"], zone)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) GetManagedZone(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	response, err := c.dns.GetManagedZone(vars["project"], vars["managedZone"])
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) PatchManagedZone(w http.ResponseWriter, r *http.Request) {
+	c.updateManagedZone(w, r, true)
+}
+
+func (c *dnsController) UpdateManagedZone(w http.ResponseWriter, r *http.Request) {
+	c.updateManagedZone(w, r, false)
+}
+
+func (c *dnsController) updateManagedZone(w http.ResponseWriter, r *http.Request, patch bool) {
+	zone := &dns.ManagedZone{}
+	if !readJSONRequest(w, r, zone) {
+		return
+	}
+	vars := mux.Vars(r)
+	response, err := c.dns.UpdateManagedZone(vars["project"], vars["managedZone"], zone, patch)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) DeleteManagedZone(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := c.dns.DeleteManagedZone(vars["project"], vars["managedZone"])
+	if err != nil {
+		c.logger.Error(err)
+		httputils.HTTPErrorFromGRPC(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *dnsController) ListChanges(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	maxResults, _ := strconv.ParseInt(query.Get("maxResults"), 10, 64)
+	response, err := c.dns.ListChanges(vars["project"], vars["managedZone"], maxResults, query.Get("pageToken"))
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) CreateChange(w http.ResponseWriter, r *http.Request) {
+	change := &dns.Change{}
+	if !readJSONRequest(w, r, change) {
+		return
+	}
+	vars := mux.Vars(r)
+	response, err := c.dns.CreateChange(vars["project"], vars["managedZone"], change)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) GetChange(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	response, err := c.dns.GetChange(vars["project"], vars["managedZone"], vars["changeId"])
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) ListResourceRecordSets(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	maxResults, _ := strconv.ParseInt(query.Get("maxResults"), 10, 64)
+	response, err := c.dns.ListResourceRecordSets(
+		vars["project"], vars["managedZone"], query.Get("name"), query.Get("type"),
+		maxResults, query.Get("pageToken"),
+	)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) CreateResourceRecordSet(w http.ResponseWriter, r *http.Request) {
+	rrset := &dns.ResourceRecordSet{}
+	if !readJSONRequest(w, r, rrset) {
+		return
+	}
+	vars := mux.Vars(r)
+	response, err := c.dns.CreateResourceRecordSet(vars["project"], vars["managedZone"], rrset)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) GetResourceRecordSet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	response, err := c.dns.GetResourceRecordSet(vars["project"], vars["managedZone"], vars["name"], vars["type"])
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) PatchResourceRecordSet(w http.ResponseWriter, r *http.Request) {
+	rrset := &dns.ResourceRecordSet{}
+	if !readJSONRequest(w, r, rrset) {
+		return
+	}
+	vars := mux.Vars(r)
+	response, err := c.dns.PatchResourceRecordSet(vars["project"], vars["managedZone"], vars["name"], vars["type"], rrset)
+	c.writeJSON(w, http.StatusOK, response, err)
+}
+
+func (c *dnsController) DeleteResourceRecordSet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := c.dns.DeleteResourceRecordSet(vars["project"], vars["managedZone"], vars["name"], vars["type"])
+	c.writeJSON(w, http.StatusOK, &dns.ResourceRecordSetsDeleteResponse{}, err)
+}
+
+func (c *dnsController) writeJSON(w http.ResponseWriter, statusCode int, response interface{}, err error) {
+	if err != nil {
+		c.logger.Error(err)
+		httputils.HTTPErrorFromGRPC(w, err)
+		return
+	}
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		c.logger.Error(err)
+		httputils.HTTPError(
+			w, http.StatusBadRequest,
+			failedPreparingResponseMessage,
+		)
+		return
+	}
+	httputils.SetResponseAsJSON(w)
+	w.WriteHeader(statusCode)
+	w.Write(responseBytes)
+}
+
+// readJSONRequest deals with unmarshalling a JSON request body for APIs
+// that are not backed by protos, an empty body leaves the value untouched.
+// An error response is written when false is returned.
+func readJSONRequest(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	requestBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httputils.HTTPError(
+			w, http.StatusBadRequest,
+			httputils.InvalidRequestMessage(err),
+		)
+		return false
+	}
+	if len(requestBytes) == 0 {
+		return true
+	}
+	err = json.Unmarshal(requestBytes, value)
+	if err != nil {
+		httputils.HTTPError(
+			w, http.StatusBadRequest,
+			httputils.InvalidRequestMessage(err),
+		)
+		return false
+	}
+	return true
+}
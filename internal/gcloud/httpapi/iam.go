@@ -0,0 +1,85 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/iam"
+	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+)
+
+// IAMMiddleware provides middleware that enforces IAM for the Google Cloud REST APIs.
+// Routes are named after the gRPC method they call so the same permissions apply
+// over HTTP and gRPC, unnamed routes such as the token endpoint are left open.
+// Every route is left open when IAM is disabled.
+func IAMMiddleware(registry *types.Registry) mux.MiddlewareFunc {
+	iamService, ok := types.Get(registry, gcloud.IAMKey)
+	if !ok {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	logger := types.MustGet(registry, logging.Key)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil || route.GetName() == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			member, err := iamService.Authenticate(r.Header.Get("Authorization"))
+			if err != nil {
+				httputils.HTTPErrorFromGRPC(w, err)
+				return
+			}
+			ctx := iam.ContextWithPrincipal(r.Context(), member)
+			err = iamService.AuthorizeMethod(ctx, route.GetName(), restResourceName(r.URL.Path))
+			if err != nil {
+				logger.Debug(err)
+				httputils.HTTPErrorFromGRPC(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// restResourceName derives the resource a REST request applies to from its path,
+// the version and custom method are removed and requests to a collection apply to
+// the parent of the collection. APIs such as Cloud DNS prefix the version with
+// the API name so anything before the projects segment is removed for them.
+// (e.g. /v1/projects/p/secrets/s:addVersion -> projects/p/secrets/s)
+func restResourceName(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 {
+		return ""
+	}
+	start := 1
+	for i := 1; i < len(segments) && i < 3; i = i + 1 {
+		if segments[i] == "projects" {
+			start = i
+			break
+		}
+	}
+	segments = segments[start:]
+	lastSegment := segments[len(segments)-1]
+	if colonIndex := strings.Index(lastSegment, ":"); colonIndex >= 0 {
+		segments[len(segments)-1] = lastSegment[:colonIndex]
+	}
+	if len(segments)%2 != 0 {
+		segments = segments[:len(segments)-1]
+	}
+	return strings.Join(segments, "/")
+}
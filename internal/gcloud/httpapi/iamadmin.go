@@ -0,0 +1,406 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+const (
+	// IAMHost specifies the host on which Cloud::1 will accept
+	// API requests for the IAM Admin API.
+	IAMHost = "iam.googleapis.local"
+
+	iamAdminMethod           = "/google.iam.admin.v1.IAM/"
+	iamProjectPath           = "/v1/projects/{project}"
+	iamServiceAccountPath    = iamProjectPath + "/serviceAccounts/{serviceAccount:[^/:]+}"
+	iamServiceAccountKeyPath = iamServiceAccountPath + "/keys/{key:[^/:]+}"
+	iamProjectRolePath       = iamProjectPath + "/roles/{role:[^/:]+}"
+)
+
+// RegisterIAMAdmin deals with registering the routes for the IAM Admin api
+// used to manage service accounts, their keys and roles.
+func RegisterIAMAdmin(router *mux.Router, registry *types.Registry) {
+	admin, ok := types.Get(registry, gcloud.IAMKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &iamAdminController{
+		admin,
+		logger,
+	}
+	router.HandleFunc(iamProjectPath+"/serviceAccounts", c.ListServiceAccounts).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "ListServiceAccounts")
+	router.HandleFunc(iamProjectPath+"/serviceAccounts", c.CreateServiceAccount).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "CreateServiceAccount")
+	router.HandleFunc(iamServiceAccountPath, c.GetServiceAccount).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "GetServiceAccount")
+	router.HandleFunc(iamServiceAccountPath, c.UpdateServiceAccount).
+		Methods("PUT").Host(IAMHost).
+		Name(iamAdminMethod + "UpdateServiceAccount")
+	router.HandleFunc(iamServiceAccountPath, c.PatchServiceAccount).
+		Methods("PATCH").Host(IAMHost).
+		Name(iamAdminMethod + "PatchServiceAccount")
+	router.HandleFunc(iamServiceAccountPath, c.DeleteServiceAccount).
+		Methods("DELETE").Host(IAMHost).
+		Name(iamAdminMethod + "DeleteServiceAccount")
+	router.HandleFunc(iamServiceAccountPath+":undelete", c.UndeleteServiceAccount).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "UndeleteServiceAccount")
+	router.HandleFunc(iamServiceAccountPath+":enable", c.EnableServiceAccount).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "EnableServiceAccount")
+	router.HandleFunc(iamServiceAccountPath+":disable", c.DisableServiceAccount).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "DisableServiceAccount")
+	router.HandleFunc(iamServiceAccountPath+":getIamPolicy", c.GetIamPolicy).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "GetIamPolicy")
+	router.HandleFunc(iamServiceAccountPath+":setIamPolicy", c.SetIamPolicy).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "SetIamPolicy")
+	router.HandleFunc(iamServiceAccountPath+":testIamPermissions", c.TestIamPermissions).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "TestIamPermissions")
+
+	router.HandleFunc(iamServiceAccountPath+"/keys", c.ListServiceAccountKeys).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "ListServiceAccountKeys")
+	router.HandleFunc(iamServiceAccountPath+"/keys", c.CreateServiceAccountKey).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "CreateServiceAccountKey")
+	router.HandleFunc(iamServiceAccountPath+"/keys:upload", c.UploadServiceAccountKey).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "UploadServiceAccountKey")
+	router.HandleFunc(iamServiceAccountKeyPath, c.GetServiceAccountKey).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "GetServiceAccountKey")
+	router.HandleFunc(iamServiceAccountKeyPath, c.DeleteServiceAccountKey).
+		Methods("DELETE").Host(IAMHost).
+		Name(iamAdminMethod + "DeleteServiceAccountKey")
+
+	router.HandleFunc("/v1/roles", c.ListRoles).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "ListRoles")
+	router.HandleFunc("/v1/roles:queryGrantableRoles", c.QueryGrantableRoles).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "QueryGrantableRoles")
+	router.HandleFunc("/v1/roles/{role:[^/:]+}", c.GetRole).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "GetRole")
+	router.HandleFunc("/v1/permissions:queryTestablePermissions", c.QueryTestablePermissions).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "QueryTestablePermissions")
+	router.HandleFunc(iamProjectPath+"/roles", c.ListRoles).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "ListRoles")
+	router.HandleFunc(iamProjectPath+"/roles", c.CreateRole).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "CreateRole")
+	router.HandleFunc(iamProjectRolePath, c.GetRole).
+		Methods("GET").Host(IAMHost).
+		Name(iamAdminMethod + "GetRole")
+	router.HandleFunc(iamProjectRolePath, c.UpdateRole).
+		Methods("PATCH").Host(IAMHost).
+		Name(iamAdminMethod + "UpdateRole")
+	router.HandleFunc(iamProjectRolePath, c.DeleteRole).
+		Methods("DELETE").Host(IAMHost).
+		Name(iamAdminMethod + "DeleteRole")
+	router.HandleFunc(iamProjectRolePath+":undelete", c.UndeleteRole).
+		Methods("POST").Host(IAMHost).
+		Name(iamAdminMethod + "UndeleteRole")
+}
+
+type iamAdminController struct {
+	admin  adminpb.IAMServer
+	logger *logrus.Entry
+}
+
+func (c *iamAdminController) ListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.admin.ListServiceAccounts(r.Context(), &adminpb.ListServiceAccountsRequest{
+		Name:      iamProjectName(r),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.CreateServiceAccountRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamProjectName(r)
+	response, err := c.admin.CreateServiceAccount(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) GetServiceAccount(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.GetServiceAccount(r.Context(), &adminpb.GetServiceAccountRequest{
+		Name: iamServiceAccountName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) UpdateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.ServiceAccount{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamServiceAccountName(r)
+	response, err := c.admin.UpdateServiceAccount(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) PatchServiceAccount(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.PatchServiceAccountRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	if req.ServiceAccount == nil {
+		req.ServiceAccount = &adminpb.ServiceAccount{}
+	}
+	req.ServiceAccount.Name = iamServiceAccountName(r)
+	response, err := c.admin.PatchServiceAccount(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) DeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.DeleteServiceAccount(r.Context(), &adminpb.DeleteServiceAccountRequest{
+		Name: iamServiceAccountName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) UndeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.UndeleteServiceAccount(r.Context(), &adminpb.UndeleteServiceAccountRequest{
+		Name: iamServiceAccountName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) EnableServiceAccount(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.EnableServiceAccount(r.Context(), &adminpb.EnableServiceAccountRequest{
+		Name: iamServiceAccountName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) DisableServiceAccount(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.DisableServiceAccount(r.Context(), &adminpb.DisableServiceAccountRequest{
+		Name: iamServiceAccountName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) GetIamPolicy(w http.ResponseWriter, r *http.Request) {
+	req := &iampb.GetIamPolicyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Resource = iamServiceAccountName(r)
+	response, err := c.admin.GetIamPolicy(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) SetIamPolicy(w http.ResponseWriter, r *http.Request) {
+	req := &iampb.SetIamPolicyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Resource = iamServiceAccountName(r)
+	response, err := c.admin.SetIamPolicy(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) TestIamPermissions(w http.ResponseWriter, r *http.Request) {
+	req := &iampb.TestIamPermissionsRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Resource = iamServiceAccountName(r)
+	response, err := c.admin.TestIamPermissions(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) ListServiceAccountKeys(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.ListServiceAccountKeysRequest{
+		Name: iamServiceAccountName(r),
+	}
+	for _, keyType := range r.URL.Query()["keyTypes"] {
+		req.KeyTypes = append(
+			req.KeyTypes,
+			adminpb.ListServiceAccountKeysRequest_KeyType(adminpb.ListServiceAccountKeysRequest_KeyType_value[keyType]),
+		)
+	}
+	response, err := c.admin.ListServiceAccountKeys(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) CreateServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.CreateServiceAccountKeyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamServiceAccountName(r)
+	response, err := c.admin.CreateServiceAccountKey(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) UploadServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.UploadServiceAccountKeyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamServiceAccountName(r)
+	response, err := c.admin.UploadServiceAccountKey(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) GetServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+	publicKeyType := adminpb.ServiceAccountPublicKeyType_value[r.URL.Query().Get("publicKeyType")]
+	response, err := c.admin.GetServiceAccountKey(r.Context(), &adminpb.GetServiceAccountKeyRequest{
+		Name:          iamServiceAccountKeyName(r),
+		PublicKeyType: adminpb.ServiceAccountPublicKeyType(publicKeyType),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) DeleteServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.DeleteServiceAccountKey(r.Context(), &adminpb.DeleteServiceAccountKeyRequest{
+		Name: iamServiceAccountKeyName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) ListRoles(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	parent := ""
+	if _, ok := mux.Vars(r)["project"]; ok {
+		parent = iamProjectName(r)
+	}
+	response, err := c.admin.ListRoles(r.Context(), &adminpb.ListRolesRequest{
+		Parent:      parent,
+		PageSize:    int32(pageSize),
+		PageToken:   r.URL.Query().Get("pageToken"),
+		View:        adminpb.RoleView(adminpb.RoleView_value[r.URL.Query().Get("view")]),
+		ShowDeleted: r.URL.Query().Get("showDeleted") == "true",
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) GetRole(w http.ResponseWriter, r *http.Request) {
+	response, err := c.admin.GetRole(r.Context(), &adminpb.GetRoleRequest{
+		Name: iamRoleName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) CreateRole(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.CreateRoleRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Parent = iamProjectName(r)
+	response, err := c.admin.CreateRole(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.UpdateRoleRequest{
+		Role: &adminpb.Role{},
+	}
+	if !readProtoRequest(w, r, req.Role) {
+		return
+	}
+	req.Name = iamRoleName(r)
+	if updateMask := r.URL.Query().Get("updateMask"); updateMask != "" {
+		req.UpdateMask = &fieldmaskpb.FieldMask{
+			Paths: strings.Split(updateMask, ","),
+		}
+	}
+	response, err := c.admin.UpdateRole(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	etag, _ := base64.StdEncoding.DecodeString(r.URL.Query().Get("etag"))
+	response, err := c.admin.DeleteRole(r.Context(), &adminpb.DeleteRoleRequest{
+		Name: iamRoleName(r),
+		Etag: etag,
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) UndeleteRole(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.UndeleteRoleRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamRoleName(r)
+	response, err := c.admin.UndeleteRole(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) QueryGrantableRoles(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.QueryGrantableRolesRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	response, err := c.admin.QueryGrantableRoles(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamAdminController) QueryTestablePermissions(w http.ResponseWriter, r *http.Request) {
+	req := &adminpb.QueryTestablePermissionsRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	response, err := c.admin.QueryTestablePermissions(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func iamProjectName(r *http.Request) string {
+	return fmt.Sprintf("projects/%s", mux.Vars(r)["project"])
+}
+
+func iamServiceAccountName(r *http.Request) string {
+	return fmt.Sprintf("%s/serviceAccounts/%s", iamProjectName(r), mux.Vars(r)["serviceAccount"])
+}
+
+func iamServiceAccountKeyName(r *http.Request) string {
+	return fmt.Sprintf("%s/keys/%s", iamServiceAccountName(r), mux.Vars(r)["key"])
+}
+
+func iamRoleName(r *http.Request) string {
+	vars := mux.Vars(r)
+	if _, ok := vars["project"]; ok {
+		return fmt.Sprintf("%s/roles/%s", iamProjectName(r), vars["role"])
+	}
+	return fmt.Sprintf("roles/%s", vars["role"])
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+)
+
+const (
+	// IAMCredentialsHost specifies the host on which Cloud::1 will accept
+	// API requests for the IAM Service Account Credentials API.
+	IAMCredentialsHost = "iamcredentials.googleapis.local"
+
+	iamCredentialsMethod             = "/google.iam.credentials.v1.IAMCredentials/"
+	iamCredentialsServiceAccountPath = "/v1/projects/{project}/serviceAccounts/{serviceAccount:[^/:]+}"
+)
+
+// RegisterIAMCredentials deals with registering the routes for the IAM Credentials api.
+func RegisterIAMCredentials(router *mux.Router, registry *types.Registry) {
+	credentials, ok := types.Get(registry, gcloud.IAMCredentialsKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &iamCredentialsController{
+		credentials,
+		logger,
+	}
+	router.HandleFunc(iamCredentialsServiceAccountPath+":generateAccessToken", c.GenerateAccessToken).
+		Methods("POST").Host(IAMCredentialsHost).
+		Name(iamCredentialsMethod + "GenerateAccessToken")
+	router.HandleFunc(iamCredentialsServiceAccountPath+":generateIdToken", c.GenerateIdToken).
+		Methods("POST").Host(IAMCredentialsHost).
+		Name(iamCredentialsMethod + "GenerateIdToken")
+	router.HandleFunc(iamCredentialsServiceAccountPath+":signBlob", c.SignBlob).
+		Methods("POST").Host(IAMCredentialsHost).
+		Name(iamCredentialsMethod + "SignBlob")
+	router.HandleFunc(iamCredentialsServiceAccountPath+":signJwt", c.SignJwt).
+		Methods("POST").Host(IAMCredentialsHost).
+		Name(iamCredentialsMethod + "SignJwt")
+}
+
+type iamCredentialsController struct {
+	credentials credentialspb.IAMCredentialsServer
+	logger      *logrus.Entry
+}
+
+func (c *iamCredentialsController) GenerateAccessToken(w http.ResponseWriter, r *http.Request) {
+	req := &credentialspb.GenerateAccessTokenRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamCredentialsServiceAccountName(r)
+	response, err := c.credentials.GenerateAccessToken(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamCredentialsController) GenerateIdToken(w http.ResponseWriter, r *http.Request) {
+	req := &credentialspb.GenerateIdTokenRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamCredentialsServiceAccountName(r)
+	response, err := c.credentials.GenerateIdToken(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamCredentialsController) SignBlob(w http.ResponseWriter, r *http.Request) {
+	req := &credentialspb.SignBlobRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamCredentialsServiceAccountName(r)
+	response, err := c.credentials.SignBlob(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *iamCredentialsController) SignJwt(w http.ResponseWriter, r *http.Request) {
+	req := &credentialspb.SignJwtRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = iamCredentialsServiceAccountName(r)
+	response, err := c.credentials.SignJwt(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func iamCredentialsServiceAccountName(r *http.Request) string {
+	vars := mux.Vars(r)
+	return fmt.Sprintf("projects/%s/serviceAccounts/%s", vars["project"], vars["serviceAccount"])
+}
@@ -0,0 +1,369 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+const (
+	// KMSHost specifies the host on which Cloud::1 will accept
+	// API requests for Google Cloud KMS.
+	KMSHost = "cloudkms.googleapis.local"
+
+	kmsMethod         = "/google.cloud.kms.v1.KeyManagementService/"
+	kmsLocationPath   = "/v1/projects/{project}/locations/{location}"
+	kmsKeyRingPath    = kmsLocationPath + "/keyRings/{keyRing:[^/:]+}"
+	kmsCryptoKeyPath  = kmsKeyRingPath + "/cryptoKeys/{cryptoKey:[^/:]+}"
+	kmsKeyVersionPath = kmsCryptoKeyPath + "/cryptoKeyVersions/{version:[^/:]+}"
+)
+
+// RegisterKMS deals with registering the routes for the KMS api.
+func RegisterKMS(router *mux.Router, registry *types.Registry) {
+	kms, ok := types.Get(registry, gcloud.KMSKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &kmsController{
+		kms,
+		logger,
+	}
+	router.HandleFunc(kmsLocationPath+":generateRandomBytes", c.GenerateRandomBytes).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "GenerateRandomBytes")
+
+	router.HandleFunc(kmsLocationPath+"/keyRings", c.ListKeyRings).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "ListKeyRings")
+	router.HandleFunc(kmsLocationPath+"/keyRings", c.CreateKeyRing).
+		Methods("POST").Host(KMSHost).
+		Queries("keyRingId", "{keyRingId:.+}").
+		Name(kmsMethod + "CreateKeyRing")
+	router.HandleFunc(kmsKeyRingPath, c.GetKeyRing).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "GetKeyRing")
+
+	router.HandleFunc(kmsKeyRingPath+"/cryptoKeys", c.ListCryptoKeys).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "ListCryptoKeys")
+	router.HandleFunc(kmsKeyRingPath+"/cryptoKeys", c.CreateCryptoKey).
+		Methods("POST").Host(KMSHost).
+		Queries("cryptoKeyId", "{cryptoKeyId:.+}").
+		Name(kmsMethod + "CreateCryptoKey")
+	router.HandleFunc(kmsCryptoKeyPath, c.GetCryptoKey).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "GetCryptoKey")
+	router.HandleFunc(kmsCryptoKeyPath, c.UpdateCryptoKey).
+		Methods("PATCH").Host(KMSHost).
+		Queries("updateMask", "{updateMask:.+}").
+		Name(kmsMethod + "UpdateCryptoKey")
+	router.HandleFunc(kmsCryptoKeyPath+":encrypt", c.Encrypt).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "Encrypt")
+	router.HandleFunc(kmsCryptoKeyPath+":decrypt", c.Decrypt).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "Decrypt")
+	router.HandleFunc(kmsCryptoKeyPath+":updatePrimaryVersion", c.UpdatePrimaryVersion).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "UpdateCryptoKeyPrimaryVersion")
+
+	router.HandleFunc(kmsCryptoKeyPath+"/cryptoKeyVersions", c.ListCryptoKeyVersions).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "ListCryptoKeyVersions")
+	router.HandleFunc(kmsCryptoKeyPath+"/cryptoKeyVersions", c.CreateCryptoKeyVersion).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "CreateCryptoKeyVersion")
+	router.HandleFunc(kmsKeyVersionPath, c.GetCryptoKeyVersion).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "GetCryptoKeyVersion")
+	router.HandleFunc(kmsKeyVersionPath, c.UpdateCryptoKeyVersion).
+		Methods("PATCH").Host(KMSHost).
+		Queries("updateMask", "{updateMask:.+}").
+		Name(kmsMethod + "UpdateCryptoKeyVersion")
+	router.HandleFunc(kmsKeyVersionPath+"/publicKey", c.GetPublicKey).
+		Methods("GET").Host(KMSHost).
+		Name(kmsMethod + "GetPublicKey")
+	router.HandleFunc(kmsKeyVersionPath+":encrypt", c.Encrypt).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "Encrypt")
+	router.HandleFunc(kmsKeyVersionPath+":asymmetricSign", c.AsymmetricSign).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "AsymmetricSign")
+	router.HandleFunc(kmsKeyVersionPath+":asymmetricDecrypt", c.AsymmetricDecrypt).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "AsymmetricDecrypt")
+	router.HandleFunc(kmsKeyVersionPath+":macSign", c.MacSign).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "MacSign")
+	router.HandleFunc(kmsKeyVersionPath+":macVerify", c.MacVerify).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "MacVerify")
+	router.HandleFunc(kmsKeyVersionPath+":destroy", c.Destroy).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "DestroyCryptoKeyVersion")
+	router.HandleFunc(kmsKeyVersionPath+":restore", c.Restore).
+		Methods("POST").Host(KMSHost).
+		Name(kmsMethod + "RestoreCryptoKeyVersion")
+}
+
+type kmsController struct {
+	kms    kmspb.KeyManagementServiceServer
+	logger *logrus.Entry
+}
+
+func (c *kmsController) GenerateRandomBytes(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.GenerateRandomBytesRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Location = kmsResourceName(r)
+	response, err := c.kms.GenerateRandomBytes(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) ListKeyRings(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.kms.ListKeyRings(r.Context(), &kmspb.ListKeyRingsRequest{
+		Parent:    kmsResourceName(r),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) CreateKeyRing(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.CreateKeyRingRequest{
+		KeyRing: &kmspb.KeyRing{},
+	}
+	if !readProtoRequest(w, r, req.KeyRing) {
+		return
+	}
+	req.Parent = kmsResourceName(r)
+	req.KeyRingId = mux.Vars(r)["keyRingId"]
+	response, err := c.kms.CreateKeyRing(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) GetKeyRing(w http.ResponseWriter, r *http.Request) {
+	response, err := c.kms.GetKeyRing(r.Context(), &kmspb.GetKeyRingRequest{
+		Name: kmsResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) ListCryptoKeys(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.kms.ListCryptoKeys(r.Context(), &kmspb.ListCryptoKeysRequest{
+		Parent:    kmsResourceName(r),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) CreateCryptoKey(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.CreateCryptoKeyRequest{
+		CryptoKey: &kmspb.CryptoKey{},
+	}
+	if !readProtoRequest(w, r, req.CryptoKey) {
+		return
+	}
+	req.Parent = kmsResourceName(r)
+	req.CryptoKeyId = mux.Vars(r)["cryptoKeyId"]
+	req.SkipInitialVersionCreation = r.URL.Query().Get("skipInitialVersionCreation") == "true"
+	response, err := c.kms.CreateCryptoKey(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) GetCryptoKey(w http.ResponseWriter, r *http.Request) {
+	response, err := c.kms.GetCryptoKey(r.Context(), &kmspb.GetCryptoKeyRequest{
+		Name: kmsResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) UpdateCryptoKey(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.UpdateCryptoKeyRequest{
+		CryptoKey: &kmspb.CryptoKey{},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: strings.Split(mux.Vars(r)["updateMask"], ","),
+		},
+	}
+	if !readProtoRequest(w, r, req.CryptoKey) {
+		return
+	}
+	req.CryptoKey.Name = kmsResourceName(r)
+	response, err := c.kms.UpdateCryptoKey(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) Encrypt(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.EncryptRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.Encrypt(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) Decrypt(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.DecryptRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.Decrypt(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) UpdatePrimaryVersion(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.UpdateCryptoKeyPrimaryVersionRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.UpdateCryptoKeyPrimaryVersion(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) ListCryptoKeyVersions(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.kms.ListCryptoKeyVersions(r.Context(), &kmspb.ListCryptoKeyVersionsRequest{
+		Parent:    kmsResourceName(r),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) CreateCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.CreateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{},
+	}
+	if !readProtoRequest(w, r, req.CryptoKeyVersion) {
+		return
+	}
+	req.Parent = kmsResourceName(r)
+	response, err := c.kms.CreateCryptoKeyVersion(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) GetCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	response, err := c.kms.GetCryptoKeyVersion(r.Context(), &kmspb.GetCryptoKeyVersionRequest{
+		Name: kmsResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) UpdateCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.UpdateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: strings.Split(mux.Vars(r)["updateMask"], ","),
+		},
+	}
+	if !readProtoRequest(w, r, req.CryptoKeyVersion) {
+		return
+	}
+	req.CryptoKeyVersion.Name = kmsResourceName(r)
+	response, err := c.kms.UpdateCryptoKeyVersion(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) GetPublicKey(w http.ResponseWriter, r *http.Request) {
+	response, err := c.kms.GetPublicKey(r.Context(), &kmspb.GetPublicKeyRequest{
+		Name: kmsResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) AsymmetricSign(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.AsymmetricSignRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.AsymmetricSign(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) AsymmetricDecrypt(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.AsymmetricDecryptRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.AsymmetricDecrypt(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) MacSign(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.MacSignRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.MacSign(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) MacVerify(w http.ResponseWriter, r *http.Request) {
+	req := &kmspb.MacVerifyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = kmsResourceName(r)
+	response, err := c.kms.MacVerify(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) Destroy(w http.ResponseWriter, r *http.Request) {
+	response, err := c.kms.DestroyCryptoKeyVersion(r.Context(), &kmspb.DestroyCryptoKeyVersionRequest{
+		Name: kmsResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *kmsController) Restore(w http.ResponseWriter, r *http.Request) {
+	response, err := c.kms.RestoreCryptoKeyVersion(r.Context(), &kmspb.RestoreCryptoKeyVersionRequest{
+		Name: kmsResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+// kmsResourceName builds the fully qualified name of the most specific
+// KMS resource identified by the route variables.
+func kmsResourceName(r *http.Request) string {
+	vars := mux.Vars(r)
+	name := fmt.Sprintf("projects/%s/locations/%s", vars["project"], vars["location"])
+	if keyRing, ok := vars["keyRing"]; ok {
+		name = fmt.Sprintf("%s/keyRings/%s", name, keyRing)
+	}
+	if cryptoKey, ok := vars["cryptoKey"]; ok {
+		name = fmt.Sprintf("%s/cryptoKeys/%s", name, cryptoKey)
+	}
+	if version, ok := vars["version"]; ok {
+		name = fmt.Sprintf("%s/cryptoKeyVersions/%s", name, version)
+	}
+	return name
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/metadata"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/netutils"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MetadataHost specifies the host on which Cloud::1 will accept
+	// requests for the Compute Engine metadata server.
+	MetadataHost = "metadata.google.internal"
+	// MetadataIP specifies the link-local address client libraries
+	// fall back to when the metadata host can not be resolved,
+	// the host agent aliases it on the loopback interface.
+	MetadataIP = netutils.MetadataIP
+
+	metadataFlavorHeader = "Metadata-Flavor"
+	metadataFlavor       = "Google"
+	metadataTextType     = "application/text"
+)
+
+// RegisterMetadata deals with registering the routes for the metadata server.
+func RegisterMetadata(router *mux.Router, registry *types.Registry) {
+	metadataService, ok := types.Get(registry, gcloud.MetadataKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &metadataController{
+		metadataService,
+		logger,
+	}
+	for _, host := range []string{MetadataHost, MetadataIP} {
+		subrouter := router.Host(host).Subrouter()
+		subrouter.Use(requireMetadataFlavor)
+		subrouter.HandleFunc("/", c.Root).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/project/project-id", c.ProjectID).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/project/numeric-project-id", c.NumericProjectID).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/id", c.InstanceID).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/zone", c.Zone).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/", c.ListServiceAccounts).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/", c.GetServiceAccount).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/email", c.Email).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/aliases", c.Aliases).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/scopes", c.Scopes).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/token", c.Token).Methods("GET")
+		subrouter.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/identity", c.Identity).Methods("GET")
+	}
+}
+
+// requireMetadataFlavor rejects requests that do not carry the header
+// the real metadata server uses to protect against request forgery.
+func requireMetadataFlavor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(metadataFlavorHeader, metadataFlavor)
+		w.Header().Set("Server", "Metadata Server for VM")
+		legacyRequest := r.Header.Get("X-Google-Metadata-Request") == "True"
+		if r.Header.Get(metadataFlavorHeader) != metadataFlavor && !legacyRequest {
+			writeMetadataText(w, http.StatusForbidden, "Missing required header \"Metadata-Flavor\": \"Google\"\n")
+			return
+		}
+		if r.Header.Get("X-Forwarded-For") != "" {
+			writeMetadataText(w, http.StatusForbidden, "Requests with an X-Forwarded-For header are not allowed\n")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type metadataController struct {
+	metadata *metadata.Service
+	logger   *logrus.Entry
+}
+
+func (c *metadataController) Root(w http.ResponseWriter, r *http.Request) {
+	writeMetadataText(w, http.StatusOK, "computeMetadata/\n")
+}
+
+func (c *metadataController) ProjectID(w http.ResponseWriter, r *http.Request) {
+	writeMetadataText(w, http.StatusOK, c.metadata.ProjectID())
+}
+
+func (c *metadataController) NumericProjectID(w http.ResponseWriter, r *http.Request) {
+	writeMetadataText(w, http.StatusOK, c.metadata.NumericProjectID())
+}
+
+func (c *metadataController) InstanceID(w http.ResponseWriter, r *http.Request) {
+	writeMetadataText(w, http.StatusOK, c.metadata.InstanceID())
+}
+
+func (c *metadataController) Zone(w http.ResponseWriter, r *http.Request) {
+	writeMetadataText(
+		w, http.StatusOK,
+		fmt.Sprintf("projects/%s/zones/%s", c.metadata.NumericProjectID(), metadata.Zone),
+	)
+}
+
+func (c *metadataController) ListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	email, _ := c.metadata.ServiceAccountEmail(metadata.DefaultAccount)
+	writeMetadataText(w, http.StatusOK, fmt.Sprintf("%s/\n%s/\n", metadata.DefaultAccount, email))
+}
+
+func (c *metadataController) GetServiceAccount(w http.ResponseWriter, r *http.Request) {
+	email, ok := c.serviceAccount(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("recursive") != "true" {
+		writeMetadataText(w, http.StatusOK, "aliases\nemail\nidentity\nscopes\ntoken\n")
+		return
+	}
+	c.writeJSON(w, map[string]interface{}{
+		"aliases": []string{metadata.DefaultAccount},
+		"email":   email,
+		"scopes":  []string{tokens.CloudPlatformScope},
+	})
+}
+
+func (c *metadataController) Email(w http.ResponseWriter, r *http.Request) {
+	email, ok := c.serviceAccount(w, r)
+	if !ok {
+		return
+	}
+	writeMetadataText(w, http.StatusOK, email)
+}
+
+func (c *metadataController) Aliases(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.serviceAccount(w, r); !ok {
+		return
+	}
+	writeMetadataText(w, http.StatusOK, metadata.DefaultAccount+"\n")
+}
+
+func (c *metadataController) Scopes(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.serviceAccount(w, r); !ok {
+		return
+	}
+	writeMetadataText(w, http.StatusOK, tokens.CloudPlatformScope+"\n")
+}
+
+func (c *metadataController) Token(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.serviceAccount(w, r); !ok {
+		return
+	}
+	scopes := []string{}
+	if scopesParam := r.URL.Query().Get("scopes"); scopesParam != "" {
+		scopes = strings.Split(scopesParam, ",")
+	}
+	token, err := c.metadata.AccessToken(scopes)
+	if err != nil {
+		c.logger.Error(err)
+		writeMetadataText(w, http.StatusInternalServerError, "Failed to mint an access token\n")
+		return
+	}
+	c.writeJSON(w, map[string]interface{}{
+		"access_token": token.Value,
+		"expires_in":   int64(time.Until(token.Expiry).Seconds()),
+		"token_type":   "Bearer",
+	})
+}
+
+func (c *metadataController) Identity(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.serviceAccount(w, r); !ok {
+		return
+	}
+	audience := r.URL.Query().Get("audience")
+	if audience == "" {
+		writeMetadataText(w, http.StatusBadRequest, "non-empty audience parameter required\n")
+		return
+	}
+	token, err := c.metadata.IdentityToken(audience, r.URL.Query().Get("format") == "full")
+	if err != nil {
+		c.logger.Error(err)
+		writeMetadataText(w, http.StatusInternalServerError, "Failed to mint an identity token\n")
+		return
+	}
+	writeMetadataText(w, http.StatusOK, token.Value)
+}
+
+func (c *metadataController) serviceAccount(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email, ok := c.metadata.ServiceAccountEmail(mux.Vars(r)["account"])
+	if !ok {
+		writeMetadataText(w, http.StatusNotFound, "Service account not found\n")
+	}
+	return email, ok
+}
+
+func (c *metadataController) writeJSON(w http.ResponseWriter, response interface{}) {
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		c.logger.Error(err)
+		writeMetadataText(w, http.StatusInternalServerError, failedPreparingResponseMessage)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+func writeMetadataText(w http.ResponseWriter, statusCode int, body string) {
+	w.Header().Set("Content-Type", metadataTextType)
+	w.WriteHeader(statusCode)
+	w.Write([]byte(body))
+}
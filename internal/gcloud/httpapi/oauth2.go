@@ -0,0 +1,108 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/oauth2"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OAuth2Host specifies the host on which Cloud::1 will accept
+	// requests for the Google OAuth2 token endpoint.
+	OAuth2Host = "oauth2.googleapis.local"
+)
+
+// RegisterOAuth2 deals with registering the routes for the OAuth2 token
+// endpoint along with the key set used to verify the tokens it issues.
+func RegisterOAuth2(router *mux.Router, registry *types.Registry) {
+	oauth2Service, ok := types.Get(registry, gcloud.OAuth2Key)
+	if !ok {
+		return
+	}
+	tokenService := types.MustGet(registry, gcloud.TokensKey)
+	logger := types.MustGet(registry, logging.Key)
+	c := &oauth2Controller{
+		oauth2Service,
+		tokenService,
+		logger,
+	}
+	router.HandleFunc("/token", c.Token).Methods("POST").Host(OAuth2Host)
+	router.HandleFunc("/oauth2/v3/certs", c.Certs).Methods("GET").Host(OAuth2Host)
+	router.HandleFunc("/.well-known/openid-configuration", c.OpenIDConfiguration).
+		Methods("GET").Host(OAuth2Host)
+}
+
+type oauth2Controller struct {
+	oauth2 *oauth2.Service
+	tokens *tokens.Service
+	logger *logrus.Entry
+}
+
+func (c *oauth2Controller) Token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		c.writeJSON(w, http.StatusBadRequest, &oauth2.Error{
+			Code:        "invalid_request",
+			Description: err.Error(),
+		})
+		return
+	}
+	response, err := c.oauth2.Token(r.PostForm.Get("grant_type"), r.PostForm)
+	if err != nil {
+		oauth2Err := &oauth2.Error{}
+		if errors.As(err, &oauth2Err) {
+			c.writeJSON(w, http.StatusBadRequest, oauth2Err)
+			return
+		}
+		c.logger.Error(err)
+		c.writeJSON(w, http.StatusInternalServerError, &oauth2.Error{
+			Code:        "internal_failure",
+			Description: "Unexpected error occurred",
+		})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+func (c *oauth2Controller) Certs(w http.ResponseWriter, r *http.Request) {
+	c.writeJSON(w, http.StatusOK, c.tokens.JWKS())
+}
+
+func (c *oauth2Controller) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	c.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                tokens.Issuer,
+		"token_endpoint":                        tokens.Issuer + "/token",
+		"jwks_uri":                              tokens.Issuer + "/oauth2/v3/certs",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"grant_types_supported":                 []string{oauth2.GrantTypeJWTBearer, oauth2.GrantTypeRefreshToken},
+	})
+}
+
+func (c *oauth2Controller) writeJSON(w http.ResponseWriter, statusCode int, response interface{}) {
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		c.logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(responseBytes)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// readProtoRequest deals with unmarshalling a JSON request body into the
+// provided message, an empty body leaves the message untouched.
+// An error response is written when false is returned.
+func readProtoRequest(w http.ResponseWriter, r *http.Request, message proto.Message) bool {
+	requestBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httputils.HTTPError(
+			w, http.StatusBadRequest,
+			httputils.InvalidRequestMessage(err),
+		)
+		return false
+	}
+	if len(requestBytes) == 0 {
+		return true
+	}
+	err = protojson.Unmarshal(requestBytes, message)
+	if err != nil {
+		httputils.HTTPError(
+			w, http.StatusBadRequest,
+			httputils.InvalidRequestMessage(err),
+		)
+		return false
+	}
+	return true
+}
+
+// writeProtoResponse deals with writing the result of a gRPC service call
+// as a JSON response.
+func writeProtoResponse(w http.ResponseWriter, logger *logrus.Entry, statusCode int, message proto.Message, err error) {
+	if err != nil {
+		logger.Error(err)
+		httputils.HTTPErrorFromGRPC(w, err)
+		return
+	}
+	responseBytes, err := protojson.Marshal(message)
+	if err != nil {
+		logger.Error(err)
+		httputils.HTTPError(
+			w, http.StatusBadRequest,
+			failedPreparingResponseMessage,
+		)
+		return
+	}
+	httputils.SetResponseAsJSON(w)
+	w.WriteHeader(statusCode)
+	w.Write(responseBytes)
+}
@@ -0,0 +1,366 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	gcloudgrpc "github.com/freshwebio/cloud-uno/pkg/gcloud/grpc"
+	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+const (
+	// ResourceManagerHost specifies the host on which Cloud::1 will accept
+	// API requests for the Resource Manager API.
+	ResourceManagerHost = "cloudresourcemanager.googleapis.local"
+
+	projectsMethod = "/google.cloud.resourcemanager.v3.Projects/"
+	foldersMethod  = "/google.cloud.resourcemanager.v3.Folders/"
+	projectPath    = "/v3/projects/{project:[^/:]+}"
+	folderPath     = "/v3/folders/{folder:[^/:]+}"
+)
+
+// RegisterResourceManager deals with registering the routes for the
+// Resource Manager api used to manage projects and folders.
+func RegisterResourceManager(router *mux.Router, registry *types.Registry) {
+	resourceManager, ok := types.Get(registry, gcloud.ResourceManagerKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &resourceManagerController{
+		resourceManager,
+		logger,
+	}
+	router.HandleFunc("/v3/projects", c.ListProjects).
+		Methods("GET").Host(ResourceManagerHost).
+		Name(projectsMethod + "ListProjects")
+	router.HandleFunc("/v3/projects", c.CreateProject).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(projectsMethod + "CreateProject")
+	router.HandleFunc("/v3/projects:search", c.SearchProjects).
+		Methods("GET").Host(ResourceManagerHost).
+		Name(projectsMethod + "SearchProjects")
+	router.HandleFunc(projectPath, c.GetProject).
+		Methods("GET").Host(ResourceManagerHost).
+		Name(projectsMethod + "GetProject")
+	router.HandleFunc(projectPath, c.UpdateProject).
+		Methods("PATCH").Host(ResourceManagerHost).
+		Name(projectsMethod + "UpdateProject")
+	router.HandleFunc(projectPath, c.DeleteProject).
+		Methods("DELETE").Host(ResourceManagerHost).
+		Name(projectsMethod + "DeleteProject")
+	router.HandleFunc(projectPath+":move", c.MoveProject).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(projectsMethod + "MoveProject")
+	router.HandleFunc(projectPath+":undelete", c.UndeleteProject).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(projectsMethod + "UndeleteProject")
+	router.HandleFunc(projectPath+":getIamPolicy", c.GetIamPolicy("project")).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(projectsMethod + "GetIamPolicy")
+	router.HandleFunc(projectPath+":setIamPolicy", c.SetIamPolicy("project")).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(projectsMethod + "SetIamPolicy")
+	router.HandleFunc(projectPath+":testIamPermissions", c.TestIamPermissions("project")).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(projectsMethod + "TestIamPermissions")
+
+	router.HandleFunc("/v3/folders", c.ListFolders).
+		Methods("GET").Host(ResourceManagerHost).
+		Name(foldersMethod + "ListFolders")
+	router.HandleFunc("/v3/folders", c.CreateFolder).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(foldersMethod + "CreateFolder")
+	router.HandleFunc("/v3/folders:search", c.SearchFolders).
+		Methods("GET").Host(ResourceManagerHost).
+		Name(foldersMethod + "SearchFolders")
+	router.HandleFunc(folderPath, c.GetFolder).
+		Methods("GET").Host(ResourceManagerHost).
+		Name(foldersMethod + "GetFolder")
+	router.HandleFunc(folderPath, c.UpdateFolder).
+		Methods("PATCH").Host(ResourceManagerHost).
+		Name(foldersMethod + "UpdateFolder")
+	router.HandleFunc(folderPath, c.DeleteFolder).
+		Methods("DELETE").Host(ResourceManagerHost).
+		Name(foldersMethod + "DeleteFolder")
+	router.HandleFunc(folderPath+":move", c.MoveFolder).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(foldersMethod + "MoveFolder")
+	router.HandleFunc(folderPath+":undelete", c.UndeleteFolder).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(foldersMethod + "UndeleteFolder")
+	router.HandleFunc(folderPath+":getIamPolicy", c.GetIamPolicy("folder")).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(foldersMethod + "GetIamPolicy")
+	router.HandleFunc(folderPath+":setIamPolicy", c.SetIamPolicy("folder")).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(foldersMethod + "SetIamPolicy")
+	router.HandleFunc(folderPath+":testIamPermissions", c.TestIamPermissions("folder")).
+		Methods("POST").Host(ResourceManagerHost).
+		Name(foldersMethod + "TestIamPermissions")
+}
+
+// ResolveProjectNames wraps a handler to replace project numbers in the paths of requests
+// to Google Cloud REST APIs with project IDs before they are routed, in strict mode
+// requests for projects that don't exist are rejected. The handler is left as it is
+// when the resource manager is disabled.
+// (e.g. /v1/projects/123456789012/secrets -> /v1/projects/my-project/secrets)
+func ResolveProjectNames(registry *types.Registry, next http.Handler) http.Handler {
+	resourceManager, ok := types.Get(registry, gcloud.ResourceManagerKey)
+	if !ok {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if !strings.HasSuffix(host, ".googleapis.local") || len(segments) < 2 ||
+			!strings.HasPrefix(segments[1], "projects/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Deleted projects must be reachable through the Resource Manager to be restored.
+		name, err := resourceManager.ResolveResourceName(segments[1], host != ResourceManagerHost)
+		if err != nil {
+			httputils.HTTPErrorFromGRPC(w, err)
+			return
+		}
+		r.URL.Path = fmt.Sprintf("/%s/%s", segments[0], name)
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+type resourceManagerController struct {
+	resourceManager *gcloudgrpc.ResourceManager
+	logger          *logrus.Entry
+}
+
+func (c *resourceManagerController) ListProjects(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.resourceManager.ListProjects(r.Context(), &resourcemanagerpb.ListProjectsRequest{
+		Parent:      r.URL.Query().Get("parent"),
+		PageSize:    int32(pageSize),
+		PageToken:   r.URL.Query().Get("pageToken"),
+		ShowDeleted: r.URL.Query().Get("showDeleted") == "true",
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) SearchProjects(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.resourceManager.SearchProjects(r.Context(), &resourcemanagerpb.SearchProjectsRequest{
+		Query:     r.URL.Query().Get("query"),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) CreateProject(w http.ResponseWriter, r *http.Request) {
+	req := &resourcemanagerpb.CreateProjectRequest{
+		Project: &resourcemanagerpb.Project{},
+	}
+	if !readProtoRequest(w, r, req.Project) {
+		return
+	}
+	response, err := c.resourceManager.CreateProject(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) GetProject(w http.ResponseWriter, r *http.Request) {
+	response, err := c.resourceManager.GetProject(r.Context(), &resourcemanagerpb.GetProjectRequest{
+		Name: resourceManagerName(r, "project"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) UpdateProject(w http.ResponseWriter, r *http.Request) {
+	req := &resourcemanagerpb.UpdateProjectRequest{
+		Project:    &resourcemanagerpb.Project{},
+		UpdateMask: queryUpdateMask(r),
+	}
+	if !readProtoRequest(w, r, req.Project) {
+		return
+	}
+	req.Project.Name = resourceManagerName(r, "project")
+	response, err := c.resourceManager.UpdateProject(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) MoveProject(w http.ResponseWriter, r *http.Request) {
+	req := &resourcemanagerpb.MoveProjectRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = resourceManagerName(r, "project")
+	response, err := c.resourceManager.MoveProject(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) DeleteProject(w http.ResponseWriter, r *http.Request) {
+	response, err := c.resourceManager.DeleteProject(r.Context(), &resourcemanagerpb.DeleteProjectRequest{
+		Name: resourceManagerName(r, "project"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) UndeleteProject(w http.ResponseWriter, r *http.Request) {
+	response, err := c.resourceManager.UndeleteProject(r.Context(), &resourcemanagerpb.UndeleteProjectRequest{
+		Name: resourceManagerName(r, "project"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) ListFolders(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.resourceManager.ListFolders(r.Context(), &resourcemanagerpb.ListFoldersRequest{
+		Parent:      r.URL.Query().Get("parent"),
+		PageSize:    int32(pageSize),
+		PageToken:   r.URL.Query().Get("pageToken"),
+		ShowDeleted: r.URL.Query().Get("showDeleted") == "true",
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) SearchFolders(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.resourceManager.SearchFolders(r.Context(), &resourcemanagerpb.SearchFoldersRequest{
+		Query:     r.URL.Query().Get("query"),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) CreateFolder(w http.ResponseWriter, r *http.Request) {
+	req := &resourcemanagerpb.CreateFolderRequest{
+		Folder: &resourcemanagerpb.Folder{},
+	}
+	if !readProtoRequest(w, r, req.Folder) {
+		return
+	}
+	response, err := c.resourceManager.CreateFolder(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) GetFolder(w http.ResponseWriter, r *http.Request) {
+	response, err := c.resourceManager.GetFolder(r.Context(), &resourcemanagerpb.GetFolderRequest{
+		Name: resourceManagerName(r, "folder"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) UpdateFolder(w http.ResponseWriter, r *http.Request) {
+	req := &resourcemanagerpb.UpdateFolderRequest{
+		Folder:     &resourcemanagerpb.Folder{},
+		UpdateMask: queryUpdateMask(r),
+	}
+	if !readProtoRequest(w, r, req.Folder) {
+		return
+	}
+	req.Folder.Name = resourceManagerName(r, "folder")
+	response, err := c.resourceManager.UpdateFolder(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) MoveFolder(w http.ResponseWriter, r *http.Request) {
+	req := &resourcemanagerpb.MoveFolderRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = resourceManagerName(r, "folder")
+	response, err := c.resourceManager.MoveFolder(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) DeleteFolder(w http.ResponseWriter, r *http.Request) {
+	response, err := c.resourceManager.DeleteFolder(r.Context(), &resourcemanagerpb.DeleteFolderRequest{
+		Name: resourceManagerName(r, "folder"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *resourceManagerController) UndeleteFolder(w http.ResponseWriter, r *http.Request) {
+	response, err := c.resourceManager.UndeleteFolder(r.Context(), &resourcemanagerpb.UndeleteFolderRequest{
+		Name: resourceManagerName(r, "folder"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+// The IAM policy handlers are shared by projects and folders,
+// the route variable identifies which one the policy is for.
+
+func (c *resourceManagerController) GetIamPolicy(resourceType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &iampb.GetIamPolicyRequest{}
+		if !readProtoRequest(w, r, req) {
+			return
+		}
+		req.Resource = resourceManagerName(r, resourceType)
+		response, err := c.resourceManager.GetIamPolicy(r.Context(), req)
+		writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+	}
+}
+
+func (c *resourceManagerController) SetIamPolicy(resourceType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &iampb.SetIamPolicyRequest{}
+		if !readProtoRequest(w, r, req) {
+			return
+		}
+		req.Resource = resourceManagerName(r, resourceType)
+		response, err := c.resourceManager.SetIamPolicy(r.Context(), req)
+		writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+	}
+}
+
+func (c *resourceManagerController) TestIamPermissions(resourceType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &iampb.TestIamPermissionsRequest{}
+		if !readProtoRequest(w, r, req) {
+			return
+		}
+		req.Resource = resourceManagerName(r, resourceType)
+		response, err := c.resourceManager.TestIamPermissions(r.Context(), req)
+		writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+	}
+}
+
+// resourceManagerName builds the name of a project or folder from the route variable
+// of the same name. (e.g. project -> projects/my-project)
+func resourceManagerName(r *http.Request, resourceType string) string {
+	return fmt.Sprintf("%ss/%s", resourceType, mux.Vars(r)[resourceType])
+}
+
+func queryUpdateMask(r *http.Request) *fieldmaskpb.FieldMask {
+	updateMask := r.URL.Query().Get("updateMask")
+	if updateMask == "" {
+		return nil
+	}
+	return &fieldmaskpb.FieldMask{
+		Paths: strings.Split(updateMask, ","),
+	}
+}
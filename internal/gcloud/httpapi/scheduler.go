@@ -0,0 +1,160 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
+)
+
+const (
+	// SchedulerHost specifies the host on which Cloud::1 will accept
+	// API requests for Google Cloud Scheduler.
+	SchedulerHost = "cloudscheduler.googleapis.local"
+
+	schedulerMethod       = "/google.cloud.scheduler.v1.CloudScheduler/"
+	schedulerLocationPath = "/v1/projects/{project}/locations/{location}"
+	schedulerJobPath      = schedulerLocationPath + "/jobs/{job:[^/:]+}"
+)
+
+// RegisterScheduler deals with registering the routes for the Cloud Scheduler api.
+func RegisterScheduler(router *mux.Router, registry *types.Registry) {
+	scheduler, ok := types.Get(registry, gcloud.SchedulerKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &schedulerController{
+		scheduler,
+		logger,
+	}
+	router.HandleFunc(schedulerLocationPath+"/jobs", c.ListJobs).
+		Methods("GET").Host(SchedulerHost).
+		Name(schedulerMethod + "ListJobs")
+	router.HandleFunc(schedulerLocationPath+"/jobs", c.CreateJob).
+		Methods("POST").Host(SchedulerHost).
+		Name(schedulerMethod + "CreateJob")
+	router.HandleFunc(schedulerJobPath, c.GetJob).
+		Methods("GET").Host(SchedulerHost).
+		Name(schedulerMethod + "GetJob")
+	router.HandleFunc(schedulerJobPath, c.UpdateJob).
+		Methods("PATCH").Host(SchedulerHost).
+		Name(schedulerMethod + "UpdateJob")
+	router.HandleFunc(schedulerJobPath, c.DeleteJob).
+		Methods("DELETE").Host(SchedulerHost).
+		Name(schedulerMethod + "DeleteJob")
+	router.HandleFunc(schedulerJobPath+":pause", c.PauseJob).
+		Methods("POST").Host(SchedulerHost).
+		Name(schedulerMethod + "PauseJob")
+	router.HandleFunc(schedulerJobPath+":resume", c.ResumeJob).
+		Methods("POST").Host(SchedulerHost).
+		Name(schedulerMethod + "ResumeJob")
+	router.HandleFunc(schedulerJobPath+":run", c.RunJob).
+		Methods("POST").Host(SchedulerHost).
+		Name(schedulerMethod + "RunJob")
+}
+
+type schedulerController struct {
+	scheduler schedulerpb.CloudSchedulerServer
+	logger    *logrus.Entry
+}
+
+func (c *schedulerController) ListJobs(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.scheduler.ListJobs(r.Context(), &schedulerpb.ListJobsRequest{
+		Parent:    schedulerResourceName(r),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) CreateJob(w http.ResponseWriter, r *http.Request) {
+	req := &schedulerpb.CreateJobRequest{
+		Job: &schedulerpb.Job{},
+	}
+	if !readProtoRequest(w, r, req.Job) {
+		return
+	}
+	req.Parent = schedulerResourceName(r)
+	response, err := c.scheduler.CreateJob(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) GetJob(w http.ResponseWriter, r *http.Request) {
+	response, err := c.scheduler.GetJob(r.Context(), &schedulerpb.GetJobRequest{
+		Name: schedulerResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) UpdateJob(w http.ResponseWriter, r *http.Request) {
+	updateMask, err := restUpdateMask(r)
+	if err != nil {
+		httputils.HTTPError(w, http.StatusBadRequest, httputils.InvalidRequestMessage(err))
+		return
+	}
+	req := &schedulerpb.UpdateJobRequest{
+		Job:        &schedulerpb.Job{},
+		UpdateMask: updateMask,
+	}
+	if !readProtoRequest(w, r, req.Job) {
+		return
+	}
+	req.Job.Name = schedulerResourceName(r)
+	response, err := c.scheduler.UpdateJob(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) DeleteJob(w http.ResponseWriter, r *http.Request) {
+	response, err := c.scheduler.DeleteJob(r.Context(), &schedulerpb.DeleteJobRequest{
+		Name: schedulerResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) PauseJob(w http.ResponseWriter, r *http.Request) {
+	response, err := c.scheduler.PauseJob(r.Context(), &schedulerpb.PauseJobRequest{
+		Name: schedulerResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) ResumeJob(w http.ResponseWriter, r *http.Request) {
+	response, err := c.scheduler.ResumeJob(r.Context(), &schedulerpb.ResumeJobRequest{
+		Name: schedulerResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *schedulerController) RunJob(w http.ResponseWriter, r *http.Request) {
+	response, err := c.scheduler.RunJob(r.Context(), &schedulerpb.RunJobRequest{
+		Name: schedulerResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func schedulerResourceName(r *http.Request) string {
+	vars := mux.Vars(r)
+	name := fmt.Sprintf("projects/%s/locations/%s", vars["project"], vars["location"])
+	if job, ok := vars["job"]; ok {
+		name = fmt.Sprintf("%s/jobs/%s", name, job)
+	}
+	return name
+}
@@ -14,7 +14,9 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
 	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
 	"github.com/freshwebio/cloud-uno/pkg/types"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -29,32 +31,41 @@ const (
 	// API requests for Google Cloud Secret Manager.
 	SecretManagerHost              = "secretmanager.googleapis.local"
 	failedPreparingResponseMessage = "Unexpected error occurred: failed when preparing response"
+	secretManagerMethod            = "/google.cloud.secretmanager.v1.SecretManagerService/"
 )
 
 // RegisterSecretManager deals with registering the routes for the secret manager api.
-func RegisterSecretManager(router *mux.Router, resolver types.Resolver) {
-	secretManager := resolver.Get("gcloud.secretmanager").(secretmanagerpb.SecretManagerServiceServer)
-	logger := resolver.Get("logger").(*logrus.Entry)
+func RegisterSecretManager(router *mux.Router, registry *types.Registry) {
+	secretManager, ok := types.Get(registry, gcloud.SecretManagerKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
 	c := &secretManagerController{
 		secretManager,
 		logger,
 	}
 	router.HandleFunc("/v1/projects/{project}/secrets/{secret:.*:addVersion}", c.AddVersion).
-		Methods("POST").Host(SecretManagerHost)
+		Methods("POST").Host(SecretManagerHost).
+		Name(secretManagerMethod + "AddSecretVersion")
 
 	router.HandleFunc("/v1/projects/{project}/secrets", c.Create).
 		Methods("POST").Host(SecretManagerHost).
-		Queries("secretId", "{secretId:.+}")
+		Queries("secretId", "{secretId:.+}").
+		Name(secretManagerMethod + "CreateSecret")
 
 	router.HandleFunc("/v1/projects/{project}/secrets", c.ListSecrets).
-		Methods("GET").Host(SecretManagerHost)
+		Methods("GET").Host(SecretManagerHost).
+		Name(secretManagerMethod + "ListSecrets")
 
 	router.HandleFunc("/v1/projects/{project}/secrets/{secret}", c.GetSecret).
-		Methods("GET").Host(SecretManagerHost)
+		Methods("GET").Host(SecretManagerHost).
+		Name(secretManagerMethod + "GetSecret")
 
 	router.HandleFunc("/v1/projects/{project}/secrets/{secret}", c.UpdateSecret).
 		Methods("PATCH").Host(SecretManagerHost).
-		Queries("updateMask", "{updateMask:.+}")
+		Queries("updateMask", "{updateMask:.+}").
+		Name(secretManagerMethod + "UpdateSecret")
 }
 
 type secretManagerController struct {
@@ -0,0 +1,289 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/httputils"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+const (
+	// TasksHost specifies the host on which Cloud::1 will accept
+	// API requests for Google Cloud Tasks.
+	TasksHost = "cloudtasks.googleapis.local"
+
+	tasksMethod       = "/google.cloud.tasks.v2.CloudTasks/"
+	tasksLocationPath = "/v2/projects/{project}/locations/{location}"
+	tasksQueuePath    = tasksLocationPath + "/queues/{queue:[^/:]+}"
+	tasksTaskPath     = tasksQueuePath + "/tasks/{task:[^/:]+}"
+)
+
+// RegisterTasks deals with registering the routes for the Cloud Tasks api.
+func RegisterTasks(router *mux.Router, registry *types.Registry) {
+	tasks, ok := types.Get(registry, gcloud.TasksKey)
+	if !ok {
+		return
+	}
+	logger := types.MustGet(registry, logging.Key)
+	c := &tasksController{
+		tasks,
+		logger,
+	}
+	router.HandleFunc(tasksLocationPath+"/queues", c.ListQueues).
+		Methods("GET").Host(TasksHost).
+		Name(tasksMethod + "ListQueues")
+	router.HandleFunc(tasksLocationPath+"/queues", c.CreateQueue).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "CreateQueue")
+	router.HandleFunc(tasksQueuePath, c.GetQueue).
+		Methods("GET").Host(TasksHost).
+		Name(tasksMethod + "GetQueue")
+	router.HandleFunc(tasksQueuePath, c.UpdateQueue).
+		Methods("PATCH").Host(TasksHost).
+		Name(tasksMethod + "UpdateQueue")
+	router.HandleFunc(tasksQueuePath, c.DeleteQueue).
+		Methods("DELETE").Host(TasksHost).
+		Name(tasksMethod + "DeleteQueue")
+	router.HandleFunc(tasksQueuePath+":purge", c.PurgeQueue).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "PurgeQueue")
+	router.HandleFunc(tasksQueuePath+":pause", c.PauseQueue).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "PauseQueue")
+	router.HandleFunc(tasksQueuePath+":resume", c.ResumeQueue).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "ResumeQueue")
+	router.HandleFunc(tasksQueuePath+":getIamPolicy", c.GetIamPolicy).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "GetIamPolicy")
+	router.HandleFunc(tasksQueuePath+":setIamPolicy", c.SetIamPolicy).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "SetIamPolicy")
+	router.HandleFunc(tasksQueuePath+":testIamPermissions", c.TestIamPermissions).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "TestIamPermissions")
+
+	router.HandleFunc(tasksQueuePath+"/tasks", c.ListTasks).
+		Methods("GET").Host(TasksHost).
+		Name(tasksMethod + "ListTasks")
+	router.HandleFunc(tasksQueuePath+"/tasks", c.CreateTask).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "CreateTask")
+	router.HandleFunc(tasksTaskPath, c.GetTask).
+		Methods("GET").Host(TasksHost).
+		Name(tasksMethod + "GetTask")
+	router.HandleFunc(tasksTaskPath, c.DeleteTask).
+		Methods("DELETE").Host(TasksHost).
+		Name(tasksMethod + "DeleteTask")
+	router.HandleFunc(tasksTaskPath+":run", c.RunTask).
+		Methods("POST").Host(TasksHost).
+		Name(tasksMethod + "RunTask")
+}
+
+type tasksController struct {
+	tasks  taskspb.CloudTasksServer
+	logger *logrus.Entry
+}
+
+func (c *tasksController) ListQueues(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.tasks.ListQueues(r.Context(), &taskspb.ListQueuesRequest{
+		Parent:    tasksResourceName(r),
+		Filter:    r.URL.Query().Get("filter"),
+		PageSize:  int32(pageSize),
+		PageToken: r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) CreateQueue(w http.ResponseWriter, r *http.Request) {
+	req := &taskspb.CreateQueueRequest{
+		Queue: &taskspb.Queue{},
+	}
+	if !readProtoRequest(w, r, req.Queue) {
+		return
+	}
+	req.Parent = tasksResourceName(r)
+	response, err := c.tasks.CreateQueue(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) GetQueue(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.GetQueue(r.Context(), &taskspb.GetQueueRequest{
+		Name: tasksResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) UpdateQueue(w http.ResponseWriter, r *http.Request) {
+	updateMask, err := restUpdateMask(r)
+	if err != nil {
+		httputils.HTTPError(w, http.StatusBadRequest, httputils.InvalidRequestMessage(err))
+		return
+	}
+	req := &taskspb.UpdateQueueRequest{
+		Queue:      &taskspb.Queue{},
+		UpdateMask: updateMask,
+	}
+	if !readProtoRequest(w, r, req.Queue) {
+		return
+	}
+	req.Queue.Name = tasksResourceName(r)
+	response, err := c.tasks.UpdateQueue(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) DeleteQueue(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.DeleteQueue(r.Context(), &taskspb.DeleteQueueRequest{
+		Name: tasksResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) PurgeQueue(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.PurgeQueue(r.Context(), &taskspb.PurgeQueueRequest{
+		Name: tasksResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) PauseQueue(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.PauseQueue(r.Context(), &taskspb.PauseQueueRequest{
+		Name: tasksResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) ResumeQueue(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.ResumeQueue(r.Context(), &taskspb.ResumeQueueRequest{
+		Name: tasksResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) GetIamPolicy(w http.ResponseWriter, r *http.Request) {
+	req := &iampb.GetIamPolicyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Resource = tasksResourceName(r)
+	response, err := c.tasks.GetIamPolicy(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) SetIamPolicy(w http.ResponseWriter, r *http.Request) {
+	req := &iampb.SetIamPolicyRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Resource = tasksResourceName(r)
+	response, err := c.tasks.SetIamPolicy(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) TestIamPermissions(w http.ResponseWriter, r *http.Request) {
+	req := &iampb.TestIamPermissionsRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Resource = tasksResourceName(r)
+	response, err := c.tasks.TestIamPermissions(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) ListTasks(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	response, err := c.tasks.ListTasks(r.Context(), &taskspb.ListTasksRequest{
+		Parent:       tasksResourceName(r),
+		ResponseView: tasksResponseView(r),
+		PageSize:     int32(pageSize),
+		PageToken:    r.URL.Query().Get("pageToken"),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) CreateTask(w http.ResponseWriter, r *http.Request) {
+	req := &taskspb.CreateTaskRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Parent = tasksResourceName(r)
+	response, err := c.tasks.CreateTask(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) GetTask(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.GetTask(r.Context(), &taskspb.GetTaskRequest{
+		Name:         tasksResourceName(r),
+		ResponseView: tasksResponseView(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) DeleteTask(w http.ResponseWriter, r *http.Request) {
+	response, err := c.tasks.DeleteTask(r.Context(), &taskspb.DeleteTaskRequest{
+		Name: tasksResourceName(r),
+	})
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func (c *tasksController) RunTask(w http.ResponseWriter, r *http.Request) {
+	req := &taskspb.RunTaskRequest{}
+	if !readProtoRequest(w, r, req) {
+		return
+	}
+	req.Name = tasksResourceName(r)
+	response, err := c.tasks.RunTask(r.Context(), req)
+	writeProtoResponse(w, c.logger, http.StatusOK, response, err)
+}
+
+func tasksResourceName(r *http.Request) string {
+	vars := mux.Vars(r)
+	name := fmt.Sprintf("projects/%s/locations/%s", vars["project"], vars["location"])
+	if queue, ok := vars["queue"]; ok {
+		name = fmt.Sprintf("%s/queues/%s", name, queue)
+	}
+	if task, ok := vars["task"]; ok {
+		name = fmt.Sprintf("%s/tasks/%s", name, task)
+	}
+	return name
+}
+
+func tasksResponseView(r *http.Request) taskspb.Task_View {
+	return taskspb.Task_View(taskspb.Task_View_value[r.URL.Query().Get("responseView")])
+}
+
+// restUpdateMask parses the update mask query parameter, REST clients provide
+// the paths in camel case so it is parsed in the same way as a JSON field mask.
+// (e.g. rateLimits.maxDispatchesPerSecond -> rate_limits.max_dispatches_per_second)
+func restUpdateMask(r *http.Request) (*fieldmaskpb.FieldMask, error) {
+	updateMask := r.URL.Query().Get("updateMask")
+	if updateMask == "" {
+		return nil, nil
+	}
+	fieldMask := &fieldmaskpb.FieldMask{}
+	err := protojson.Unmarshal([]byte(strconv.Quote(updateMask)), fieldMask)
+	if err != nil {
+		return nil, err
+	}
+	return fieldMask, nil
+}
@@ -11,6 +11,7 @@ package webserver
 import (
 	"net/http"
 
+	"github.com/freshwebio/cloud-uno/pkg/certs"
 	"github.com/freshwebio/cloud-uno/pkg/config"
 	"github.com/freshwebio/cloud-uno/pkg/hosts"
 	"github.com/freshwebio/cloud-uno/pkg/netutils"
@@ -21,16 +22,36 @@ import (
 var (
 	// WebServerHost specifies the host on which Cloud::1 UI will be served.
 	WebServerHost = "console.clouduno.local"
+	// CACertPath specifies the path on the web server host
+	// the certificate of the Cloud::1 CA can be downloaded from.
+	CACertPath = "/ca.pem"
 )
 
+// RegisterCACert deals with serving the certificate of the Cloud::1 CA when TLS is enabled
+// so it can be downloaded and installed as a trusted root, this must be registered
+// before the static files as they are served for every other path.
+func RegisterCACert(router *mux.Router, registry *types.Registry) {
+	ca, ok := types.Get(registry, certs.Key)
+	if !ok {
+		return
+	}
+	router.Path(CACertPath).Host(WebServerHost).Methods(http.MethodGet).HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			w.Header().Set("Content-Disposition", `attachment; filename="cloud-uno-ca.pem"`)
+			w.Write(ca.CertPEM())
+		},
+	)
+}
+
 // RegisterStatic deals with registering the web server to serve the Cloud Uno UI.
-func RegisterStatic(router *mux.Router, resolver types.Resolver) (err error) {
+func RegisterStatic(router *mux.Router, registry *types.Registry) (err error) {
 	fileServer := http.FileServer(http.Dir("./client/build/"))
 	router.PathPrefix("/").Handler(fileServer).Host(WebServerHost)
 	// As the web server doesn't have a service in the same way cloud provider API emulators
 	// do, we'll register the host for the web server here.
-	hostsManager := resolver.Get("hosts").(hosts.Service)
-	cfg := resolver.Get("config").(*config.Config)
+	hostsManager := types.MustGet(registry, hosts.Key)
+	cfg := types.MustGet(registry, config.Key)
 
 	serverIP, err := netutils.SelectServerIP(cfg)
 	if err != nil {
@@ -0,0 +1,290 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// CAValidity provides how long a newly created CA is valid for.
+	CAValidity = 10 * 365 * 24 * time.Hour
+	// CertValidity provides how long a certificate issued by a CA is valid for,
+	// kept under the 398 days some clients allow for server certificates.
+	CertValidity = 397 * 24 * time.Hour
+	// RenewBefore provides how long before a certificate expires
+	// a new one is issued in place of loading it.
+	RenewBefore = 30 * 24 * time.Hour
+)
+
+// CA provides a local certificate authority that issues
+// certificates for Cloud::1 servers, clients and endpoints.
+type CA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	now     func() time.Time
+}
+
+// LoadOrCreateCA loads a CA from the given certificate and key files,
+// a new CA is created and saved to the files when they don't exist yet.
+func LoadOrCreateCA(certPath string, keyPath string, commonName string) (*CA, error) {
+	ca, err := loadCA(certPath, keyPath)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return ca, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Cloud::1"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeKeyPair(certPath, certPEM, keyPath, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return newCA(certPEM, keyPEM)
+}
+
+// LoadCAPool loads a pool containing the CA certificate in the given file
+// to verify certificates issued by the CA without access to its key.
+func LoadCAPool(certPath string) (*x509.CertPool, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", certPath)
+	}
+	return pool, nil
+}
+
+// CertPEM provides the PEM encoded certificate of the CA
+// for clients to install as a trusted root.
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// CertPool provides a pool containing only the CA certificate.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue creates a certificate signed by the CA for the given hosts,
+// each host can be a DNS name (including wildcards) or an IP address.
+func (ca *CA) Issue(commonName string, hosts []string, usage x509.ExtKeyUsage) (*tls.Certificate, error) {
+	certPEM, keyPEM, err := ca.issuePEM(commonName, hosts, usage)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+// LoadOrIssue loads a certificate issued by the CA from the given files,
+// a new certificate is issued and saved to the files when they don't exist,
+// weren't issued by the CA or are close to expiring.
+func (ca *CA) LoadOrIssue(
+	certPath string,
+	keyPath string,
+	commonName string,
+	hosts []string,
+	usage x509.ExtKeyUsage,
+) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && ca.valid(&cert, usage) {
+		return &cert, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	certPEM, keyPEM, err := ca.issuePEM(commonName, hosts, usage)
+	if err != nil {
+		return nil, err
+	}
+	err = writeKeyPair(certPath, certPEM, keyPath, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+func (ca *CA) valid(cert *tls.Certificate, usage x509.ExtKeyUsage) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:       ca.CertPool(),
+		CurrentTime: ca.now().Add(RenewBefore),
+		KeyUsages:   []x509.ExtKeyUsage{usage},
+	})
+	return err == nil
+}
+
+func (ca *CA) issuePEM(commonName string, hosts []string, usage x509.ExtKeyUsage) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := ca.now()
+	notAfter := now.Add(CertValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Cloud::1"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	// Include the CA certificate so clients that only trust
+	// the CA can build the chain.
+	certPEM = append(certPEM, ca.certPEM...)
+	return certPEM, keyPEM, nil
+}
+
+func loadCA(certPath string, keyPath string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return newCA(certPEM, keyPEM)
+}
+
+func newCA(certPEM []byte, keyPEM []byte) (*CA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("no CA certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("no CA key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{
+		cert:    cert,
+		key:     key,
+		certPEM: certPEM,
+		now:     time.Now,
+	}, nil
+}
+
+func parseKeyPair(certPEM []byte, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func writeKeyPair(certPath string, certPEM []byte, keyPath string, keyPEM []byte) error {
+	for _, path := range []string{certPath, keyPath} {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	// Write the key first so a certificate is never
+	// saved without the key that goes with it.
+	err := ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, certPEM, 0644)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type CertsSuite struct {
+	dir string
+}
+
+var _ = Suite(&CertsSuite{})
+
+func (s *CertsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *CertsSuite) loadCA(c *C) *CA {
+	ca, err := LoadOrCreateCA(
+		filepath.Join(s.dir, "ca.pem"),
+		filepath.Join(s.dir, "ca-key.pem"),
+		"Test CA",
+	)
+	c.Assert(err, IsNil)
+	return ca
+}
+
+func (s *CertsSuite) Test_creates_ca_and_loads_it_again(c *C) {
+	ca := s.loadCA(c)
+	c.Assert(ca.cert.IsCA, Equals, true)
+	c.Assert(ca.cert.Subject.CommonName, Equals, "Test CA")
+
+	keyInfo, err := os.Stat(filepath.Join(s.dir, "ca-key.pem"))
+	c.Assert(err, IsNil)
+	c.Assert(keyInfo.Mode().Perm(), Equals, os.FileMode(0600))
+
+	reloaded := s.loadCA(c)
+	c.Assert(reloaded.CertPEM(), DeepEquals, ca.CertPEM())
+
+	pool, err := LoadCAPool(filepath.Join(s.dir, "ca.pem"))
+	c.Assert(err, IsNil)
+	c.Assert(pool.Equal(ca.CertPool()), Equals, true)
+}
+
+func (s *CertsSuite) Test_issues_certificates_for_dns_names_and_ips(c *C) {
+	ca := s.loadCA(c)
+	cert, err := ca.Issue(
+		"storage",
+		[]string{"storage.googleapis.local", "*.storage.googleapis.local", "172.18.0.22", "fd00::22"},
+		x509.ExtKeyUsageServerAuth,
+	)
+	c.Assert(err, IsNil)
+	c.Assert(cert.Leaf.DNSNames, DeepEquals, []string{"storage.googleapis.local", "*.storage.googleapis.local"})
+	c.Assert(cert.Leaf.IPAddresses, HasLen, 2)
+
+	for _, name := range []string{"storage.googleapis.local", "bucket.storage.googleapis.local", "172.18.0.22"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName:   name,
+			Roots:     ca.CertPool(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		c.Assert(err, IsNil, Commentf("name %s", name))
+	}
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{
+		DNSName: "pubsub.googleapis.local",
+		Roots:   ca.CertPool(),
+	})
+	c.Assert(err, NotNil)
+}
+
+func (s *CertsSuite) Test_loads_issued_certificate_until_it_needs_renewing(c *C) {
+	ca := s.loadCA(c)
+	certPath := filepath.Join(s.dir, "client.pem")
+	keyPath := filepath.Join(s.dir, "client-key.pem")
+	issued, err := ca.LoadOrIssue(certPath, keyPath, "client", nil, x509.ExtKeyUsageClientAuth)
+	c.Assert(err, IsNil)
+
+	loaded, err := ca.LoadOrIssue(certPath, keyPath, "client", nil, x509.ExtKeyUsageClientAuth)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Certificate[0], DeepEquals, issued.Certificate[0])
+
+	ca.now = func() time.Time {
+		return time.Now().Add(CertValidity - RenewBefore/2)
+	}
+	renewed, err := ca.LoadOrIssue(certPath, keyPath, "client", nil, x509.ExtKeyUsageClientAuth)
+	c.Assert(err, IsNil)
+	c.Assert(renewed.Certificate[0], Not(DeepEquals), issued.Certificate[0])
+}
+
+func (s *CertsSuite) Test_reissues_certificate_from_another_ca(c *C) {
+	ca := s.loadCA(c)
+	certPath := filepath.Join(s.dir, "server.pem")
+	keyPath := filepath.Join(s.dir, "server-key.pem")
+	issued, err := ca.LoadOrIssue(certPath, keyPath, "server", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	c.Assert(err, IsNil)
+
+	c.Assert(os.Remove(filepath.Join(s.dir, "ca.pem")), IsNil)
+	c.Assert(os.Remove(filepath.Join(s.dir, "ca-key.pem")), IsNil)
+	newCA := s.loadCA(c)
+	reissued, err := newCA.LoadOrIssue(certPath, keyPath, "server", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	c.Assert(err, IsNil)
+	c.Assert(reissued.Certificate[0], Not(DeepEquals), issued.Certificate[0])
+
+	saved, err := tls.LoadX509KeyPair(certPath, keyPath)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(saved.Certificate[0])
+	c.Assert(err, IsNil)
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: newCA.CertPool()})
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrHostNotIssued is returned when a client asks for a certificate
+	// for a host the issuer does not issue certificates for.
+	ErrHostNotIssued = errors.New("no certificate is issued for the host")
+)
+
+// Issuer issues server certificates signed by a CA on the fly for the host
+// a client asks for with SNI, certificates are kept in memory and a new one is
+// issued when a certificate is close to expiring.
+type Issuer struct {
+	ca          *CA
+	defaultHost string
+	allow       func(host string) bool
+	mu          sync.Mutex
+	issued      map[string]*tls.Certificate
+}
+
+// NewIssuer creates an issuer for the hosts allow returns true for, the default
+// host (e.g. the IP of the server) is used for clients that don't send a server name.
+func NewIssuer(ca *CA, defaultHost string, allow func(host string) bool) *Issuer {
+	return &Issuer{
+		ca:          ca,
+		defaultHost: defaultHost,
+		allow:       allow,
+		issued:      map[string]*tls.Certificate{},
+	}
+}
+
+// GetCertificate provides the certificate for the server name in a TLS handshake,
+// it is used as the GetCertificate func of a tls.Config.
+func (i *Issuer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		host = i.defaultHost
+	}
+	if host != i.defaultHost && !i.allow(host) {
+		return nil, fmt.Errorf("%s: %w", host, ErrHostNotIssued)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	cert, ok := i.issued[host]
+	if ok && i.ca.valid(cert, x509.ExtKeyUsageServerAuth) {
+		return cert, nil
+	}
+	cert, err := i.ca.Issue(host, []string{host}, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+	i.issued[host] = cert
+	return cert, nil
+}
+
+// TLSConfig provides a server TLS config that issues certificates with
+// the issuer and offers HTTP/2 for gRPC along with HTTP/1.1.
+func (i *Issuer) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: i.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
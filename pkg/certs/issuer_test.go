@@ -0,0 +1,92 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package certs
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type IssuerSuite struct {
+	ca     *CA
+	issuer *Issuer
+}
+
+var _ = Suite(&IssuerSuite{})
+
+func (s *IssuerSuite) SetUpTest(c *C) {
+	dir := c.MkDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), "Test CA")
+	c.Assert(err, IsNil)
+	s.ca = ca
+	s.issuer = NewIssuer(ca, "172.18.0.22", func(host string) bool {
+		return strings.HasSuffix(host, ".googleapis.local")
+	})
+}
+
+func (s *IssuerSuite) Test_issues_certificates_for_allowed_hosts_with_sni(c *C) {
+	cert, err := s.issuer.GetCertificate(&tls.ClientHelloInfo{ServerName: "Storage.googleapis.local."})
+	c.Assert(err, IsNil)
+	c.Assert(cert.Leaf.DNSNames, DeepEquals, []string{"storage.googleapis.local"})
+
+	again, err := s.issuer.GetCertificate(&tls.ClientHelloInfo{ServerName: "storage.googleapis.local"})
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, cert)
+}
+
+func (s *IssuerSuite) Test_issues_certificate_for_the_default_host_without_sni(c *C) {
+	cert, err := s.issuer.GetCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, IsNil)
+	c.Assert(cert.Leaf.IPAddresses, HasLen, 1)
+	c.Assert(cert.Leaf.IPAddresses[0].String(), Equals, "172.18.0.22")
+}
+
+func (s *IssuerSuite) Test_refuses_hosts_that_are_not_allowed(c *C) {
+	_, err := s.issuer.GetCertificate(&tls.ClientHelloInfo{ServerName: "github.com"})
+	c.Assert(err, ErrorMatches, "github.com: no certificate is issued for the host")
+}
+
+func (s *IssuerSuite) Test_issues_a_new_certificate_when_close_to_expiring(c *C) {
+	cert, err := s.issuer.GetCertificate(&tls.ClientHelloInfo{ServerName: "pubsub.googleapis.local"})
+	c.Assert(err, IsNil)
+
+	s.ca.now = func() time.Time {
+		return cert.Leaf.NotAfter.Add(-RenewBefore / 2)
+	}
+	renewed, err := s.issuer.GetCertificate(&tls.ClientHelloInfo{ServerName: "pubsub.googleapis.local"})
+	c.Assert(err, IsNil)
+	c.Assert(renewed, Not(Equals), cert)
+	c.Assert(renewed.Leaf.NotAfter.After(cert.Leaf.NotAfter), Equals, true)
+}
+
+func (s *IssuerSuite) Test_clients_trusting_the_ca_complete_a_handshake(c *C) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, s.issuer.TLSConfig())
+	go server.Handshake()
+
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName: "cloudkms.googleapis.local",
+		RootCAs:    s.ca.CertPool(),
+		NextProtos: []string{"h2"},
+	})
+	err := client.Handshake()
+	c.Assert(err, IsNil)
+	state := client.ConnectionState()
+	c.Assert(state.NegotiatedProtocol, Equals, "h2")
+	c.Assert(state.PeerCertificates[0].DNSNames, DeepEquals, []string{"cloudkms.googleapis.local"})
+}
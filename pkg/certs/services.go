@@ -0,0 +1,52 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package certs
+
+import (
+	"path/filepath"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+)
+
+const (
+	// CADirName is the directory in the data directory
+	// the Cloud::1 CA is kept in.
+	CADirName = "ca"
+	// CACertFileName is the file the certificate of the Cloud::1 CA is kept in.
+	CACertFileName = "ca.pem"
+	// CAKeyFileName is the file the key of the Cloud::1 CA is kept in.
+	CAKeyFileName = "ca-key.pem"
+	// CACommonName is the common name of the Cloud::1 CA,
+	// it is how the CA appears in trust stores.
+	CACommonName = "Cloud::1 Local CA"
+)
+
+var (
+	// Key provides the key the Cloud::1 CA is provided under in the service registry.
+	Key = types.NewKey[*CA]("ca")
+)
+
+// RegisterServices deals with registering the provider of the Cloud::1 CA, the CA
+// is disabled when TLS is. The CA is created in the data directory the first time
+// so certificates issued by it stay trusted between runs.
+func RegisterServices(r *types.Registry) {
+	types.Provide(r, Key, func(r *types.Registry) (*CA, error) {
+		cfg := types.MustGet(r, config.Key)
+		if *cfg.TLSAddr == "" {
+			return nil, types.ErrDisabled
+		}
+		caDir := filepath.Join(*cfg.DataDirectory, CADirName)
+		return LoadOrCreateCA(
+			filepath.Join(caDir, CACertFileName),
+			filepath.Join(caDir, CAKeyFileName),
+			CACommonName,
+		)
+	}, types.Requires(config.Key))
+}
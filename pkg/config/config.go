@@ -11,22 +11,53 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/namsral/flag"
 )
 
+const (
+	// HostAgentAuthToken is the host agent auth where Cloud::1 servers
+	// send a shared secret token with every request.
+	HostAgentAuthToken = "token"
+	// HostAgentAuthMTLS is the host agent auth where Cloud::1 servers
+	// present a client certificate issued by the host agent.
+	HostAgentAuthMTLS = "mtls"
+)
+
 // Config provides all the configuration needed
 // for the Cloud::1 server.
 type Config struct {
-	FileSystem     *string
-	DataDirectory  *string
-	RunOnHost      *bool
-	ServerIP       *string
-	HostsPath      *string
-	AWSServices    *string
-	GCloudServices *string
-	AzureServices  *string
-	Debug          *bool
+	FileSystem           *string
+	DataDirectory        *string
+	RunOnHost            *bool
+	ServerIP             *string
+	TLSAddr              *string
+	ProxyUpstreams       *string
+	ShutdownTimeout      *int
+	HostsPath            *string
+	HostsBackupDir       *string
+	HostsBackups         *int
+	HostsReadOnly        *bool
+	HostAgentAddr        *string
+	HostAgentAuth        *string
+	HostAgentCredsDir    *string
+	HostAgentSuffixes    *string
+	HostAgentCIDRs       *string
+	HostAgentDenyList    *string
+	DNSServerAddr        *string
+	DNSUpstreams         *string
+	DNSConfigureResolved *bool
+	AWSServices          *string
+	GCloudServices       *string
+	GCloudIAM            *bool
+	GCloudSecretKeyFile  *string
+	GCloudProjectID      *string
+	GCloudServiceAccount *string
+	GCloudStrictProjects *bool
+	GCloudTaskTargets    *string
+	AzureServices        *string
+	Debug                *bool
 }
 
 // Load deals with loading configuration from
@@ -86,6 +117,34 @@ func prepare(flagSet *flag.FlagSet) *Config {
 		"The IP Address the cloud one server is running on, this is ignored when running the server directly on the host.",
 	)
 
+	var tlsAddr string
+	flagSet.StringVar(
+		&tlsAddr,
+		"cloud_uno_tls_addr",
+		":5989",
+		"The address (host:port) to serve HTTPS and TLS gRPC on with certificates issued by the Cloud::1 CA"+
+			" in the data directory, set to an empty string to only serve plain HTTP and gRPC.",
+	)
+
+	var proxyUpstreams string
+	flagSet.StringVar(
+		&proxyUpstreams,
+		"cloud_uno_proxy_upstreams",
+		"",
+		"A comma separated list of host=host:port pairs that route requests for a host to an emulator listening on its own address,"+
+			" a host can be listed more than once to spread requests across several upstreams."+
+			" (e.g. firestore.googleapis.local=firestore:8080)",
+	)
+
+	var shutdownTimeout int
+	flagSet.IntVar(
+		&shutdownTimeout,
+		"cloud_uno_shutdown_timeout",
+		10,
+		"The number of seconds the server has to finish requests in progress and clean up,"+
+			" such as removing hosts, when it is stopped with SIGINT or SIGTERM.",
+	)
+
 	var hostsPath string
 	flagSet.StringVar(
 		&hostsPath,
@@ -95,6 +154,114 @@ func prepare(flagSet *flag.FlagSet) *Config {
 			" otherwise defaults to the correct hosts file for the OS the host agent/server directly on the host is running on.",
 	)
 
+	var hostsBackupDir string
+	flagSet.StringVar(
+		&hostsBackupDir,
+		"cloud_uno_hosts_backup_dir",
+		"",
+		"The directory to keep backups of the hosts file in before it is changed,"+
+			" defaults to a cloud-uno-backups directory next to the hosts file.",
+	)
+
+	var hostsBackups int
+	flagSet.IntVar(
+		&hostsBackups,
+		"cloud_uno_hosts_backups",
+		10,
+		"The number of hosts file backups to keep, the oldest backups are removed first. Set to 0 to disable backups.",
+	)
+
+	var hostsReadOnly bool
+	flagSet.BoolVar(
+		&hostsReadOnly,
+		"cloud_uno_hosts_read_only",
+		false,
+		"If set, changes to the hosts file are logged as a diff instead of being written"+
+			" and no loopback alias is created for the server IP.",
+	)
+
+	var hostAgentAddr string
+	flagSet.StringVar(
+		&hostAgentAddr,
+		"cloud_uno_host_agent_addr",
+		"",
+		"The address the host agent listens on and Cloud::1 servers connect to, either a unix socket (unix:/path/to/socket)"+
+			" or a tcp address (host:port) that requires host agent auth to be set."+
+			" Defaults to a unix socket in the host agent credentials directory.",
+	)
+
+	var hostAgentAuth string
+	flagSet.StringVar(
+		&hostAgentAuth,
+		"cloud_uno_host_agent_auth",
+		"",
+		"How Cloud::1 servers authenticate with the host agent over tcp, either token for a shared secret token"+
+			" or mtls for client certificates. Not needed for a unix socket.",
+	)
+
+	var hostAgentCredsDir string
+	flagSet.StringVar(
+		&hostAgentCredsDir,
+		"cloud_uno_host_agent_creds_dir",
+		"",
+		"The directory the host agent writes its unix socket, token and certificates to,"+
+			" defaults to /var/run/cloud-uno (%ProgramData%\\cloud-uno on windows).",
+	)
+
+	var hostAgentSuffixes string
+	flagSet.StringVar(
+		&hostAgentSuffixes,
+		"cloud_uno_host_agent_suffixes",
+		"",
+		"A comma separated list of domain suffixes the host agent may add hosts for,"+
+			" defaults to googleapis.local, clouduno.local and metadata.google.internal.",
+	)
+
+	var hostAgentCIDRs string
+	flagSet.StringVar(
+		&hostAgentCIDRs,
+		"cloud_uno_host_agent_cidrs",
+		"",
+		"A comma separated list of CIDRs the host agent may point hosts at,"+
+			" defaults to loopback and private network ranges.",
+	)
+
+	var hostAgentDenyList string
+	flagSet.StringVar(
+		&hostAgentDenyList,
+		"cloud_uno_host_agent_deny_list",
+		"",
+		"A comma separated list of hosts the host agent must never add, along with every host under them,"+
+			" this takes precedence over the host agent suffixes.",
+	)
+
+	var dnsServerAddr string
+	flagSet.StringVar(
+		&dnsServerAddr,
+		"cloud_uno_dns_server_addr",
+		"",
+		"The address (host:port) for an embedded DNS server to listen on over UDP and TCP,"+
+			" when set the DNS server is used to resolve emulator hosts instead of the os hosts file.",
+	)
+
+	var dnsUpstreams string
+	flagSet.StringVar(
+		&dnsUpstreams,
+		"cloud_uno_dns_upstreams",
+		"",
+		"A comma separated list of DNS servers (host:port) the embedded DNS server forwards queries it can't answer to,"+
+			" defaults to the name servers in /etc/resolv.conf.",
+	)
+
+	var dnsConfigureResolved bool
+	flagSet.BoolVar(
+		&dnsConfigureResolved,
+		"cloud_uno_dns_configure_resolved",
+		false,
+		"Whether systemd-resolved should be configured to send queries for emulator hosts to the embedded DNS server,"+
+			" only supported on linux.",
+	)
+
 	var awsServices string
 	flagSet.StringVar(
 		&awsServices,
@@ -111,6 +278,58 @@ func prepare(flagSet *flag.FlagSet) *Config {
 		"Google Cloud Services to run emulations for.",
 	)
 
+	var gcloudIAM bool
+	flagSet.BoolVar(
+		&gcloudIAM,
+		"cloud_uno_gcloud_iam",
+		false,
+		"Whether IAM should be used to authenticate/authorise requests to local Google Cloud service emulators.",
+	)
+
+	var gcloudSecretKeyFile string
+	flagSet.StringVar(
+		&gcloudSecretKeyFile,
+		"cloud_uno_gcloud_secret_key_file",
+		"",
+		"The path to a file containing a 256-bit key, as raw bytes or base64, used to encrypt Secret Manager payloads at rest."+
+			" Secrets configured with a customer-managed encryption key use the KMS emulator instead.",
+	)
+
+	var gcloudProjectID string
+	flagSet.StringVar(
+		&gcloudProjectID,
+		"cloud_uno_gcloud_project_id",
+		"clouduno-local",
+		"The Google Cloud project ID reported by the metadata server to Application Default Credentials.",
+	)
+
+	var gcloudServiceAccount string
+	flagSet.StringVar(
+		&gcloudServiceAccount,
+		"cloud_uno_gcloud_service_account",
+		"",
+		"The service account email the metadata server mints tokens for,"+
+			" defaults to clouduno@{project ID}.iam.gserviceaccount.com.",
+	)
+
+	var gcloudStrictProjects bool
+	flagSet.BoolVar(
+		&gcloudStrictProjects,
+		"cloud_uno_gcloud_strict_projects",
+		false,
+		"Whether requests to Google Cloud service emulators should be rejected when the project they are for"+
+			" has not been created with the Resource Manager emulator or has been deleted.",
+	)
+
+	var gcloudTaskTargets string
+	flagSet.StringVar(
+		&gcloudTaskTargets,
+		"cloud_uno_gcloud_task_targets",
+		"",
+		"A comma separated list of host=URL pairs used to send Cloud Tasks and Cloud Scheduler requests to local services,"+
+			" HTTP targets are matched by host and App Engine targets by service. (e.g. api.example.com=http://localhost:8080)",
+	)
+
 	var azureServices string
 	flagSet.StringVar(
 		&azureServices,
@@ -128,15 +347,36 @@ func prepare(flagSet *flag.FlagSet) *Config {
 	)
 
 	return &Config{
-		FileSystem:     &fileSystem,
-		DataDirectory:  &dataDirectory,
-		RunOnHost:      &runOnHost,
-		ServerIP:       &serverIP,
-		HostsPath:      &hostsPath,
-		AWSServices:    &awsServices,
-		GCloudServices: &gcloudServices,
-		AzureServices:  &azureServices,
-		Debug:          &debug,
+		FileSystem:           &fileSystem,
+		DataDirectory:        &dataDirectory,
+		RunOnHost:            &runOnHost,
+		ServerIP:             &serverIP,
+		TLSAddr:              &tlsAddr,
+		ProxyUpstreams:       &proxyUpstreams,
+		ShutdownTimeout:      &shutdownTimeout,
+		HostsPath:            &hostsPath,
+		HostsBackupDir:       &hostsBackupDir,
+		HostsBackups:         &hostsBackups,
+		HostsReadOnly:        &hostsReadOnly,
+		HostAgentAddr:        &hostAgentAddr,
+		HostAgentAuth:        &hostAgentAuth,
+		HostAgentCredsDir:    &hostAgentCredsDir,
+		HostAgentSuffixes:    &hostAgentSuffixes,
+		HostAgentCIDRs:       &hostAgentCIDRs,
+		HostAgentDenyList:    &hostAgentDenyList,
+		DNSServerAddr:        &dnsServerAddr,
+		DNSUpstreams:         &dnsUpstreams,
+		DNSConfigureResolved: &dnsConfigureResolved,
+		AWSServices:          &awsServices,
+		GCloudServices:       &gcloudServices,
+		GCloudIAM:            &gcloudIAM,
+		AzureServices:        &azureServices,
+		GCloudSecretKeyFile:  &gcloudSecretKeyFile,
+		GCloudProjectID:      &gcloudProjectID,
+		GCloudServiceAccount: &gcloudServiceAccount,
+		GCloudStrictProjects: &gcloudStrictProjects,
+		GCloudTaskTargets:    &gcloudTaskTargets,
+		Debug:                &debug,
 	}
 }
 
@@ -147,5 +387,14 @@ func validate(config *Config) error {
 	if noAWSServices && noAzureServices && noGCloudServices {
 		return fmt.Errorf("You must select some services to run for at least one cloud provider to emulate")
 	}
+	switch *config.HostAgentAuth {
+	case "", HostAgentAuthToken, HostAgentAuthMTLS:
+	default:
+		return fmt.Errorf("Host agent auth must be either %s or %s", HostAgentAuthToken, HostAgentAuthMTLS)
+	}
+	tcpHostAgent := *config.HostAgentAddr != "" && !strings.HasPrefix(*config.HostAgentAddr, "unix:")
+	if tcpHostAgent && *config.HostAgentAuth == "" {
+		return fmt.Errorf("Host agent auth must be set when the host agent address is a tcp address")
+	}
 	return nil
 }
@@ -9,24 +9,18 @@
 package config
 
 import (
-	"errors"
-
 	"github.com/freshwebio/cloud-uno/pkg/types"
 )
 
 var (
-	// ErrMissingOrInvalidConfigService provides the error to be used
-	// when the config struct is not where it is expected to be in the service resolver.
-	ErrMissingOrInvalidConfigService = errors.New("config service missing in resolver container or is of an unexpected type")
+	// Key provides the key the config is provided under in the service registry.
+	Key = types.NewKey[*Config]("config")
 )
 
-// RegisterServices deals with registering config-specific
-// services to be used throughout the application.
-func RegisterServices(r types.Resolver) (err error) {
-	cfg, err := Load()
-	if err != nil {
-		return
-	}
-	r.Set("config", cfg)
-	return nil
+// RegisterServices deals with registering the provider of the config,
+// the config is loaded when the registry is built.
+func RegisterServices(r *types.Registry) {
+	types.Provide(r, Key, func(r *types.Registry) (*Config, error) {
+		return Load()
+	})
 }
@@ -10,19 +10,58 @@ package connect
 
 import (
 	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
 
+	"github.com/freshwebio/cloud-uno/pkg/config"
 	"github.com/freshwebio/cloud-uno/pkg/utils"
 )
 
-// HostAgentPort provides the tcp port the host
-// agent is running on.
-const HostAgentPort = "5989"
+// HostAgentSocketName provides the name of the host agent's
+// unix socket in the host agent credentials directory.
+const HostAgentSocketName = "hostagent.sock"
 
-// DeriveHostAgentAddr determines the correct
-// address to connect to for the host agent.
-func DeriveHostAgentAddr() string {
+// HostAgentCredsDir determines the directory the host agent keeps
+// its unix socket, token and certificates in.
+func HostAgentCredsDir(cfg *config.Config) string {
+	if cfg.HostAgentCredsDir != nil && *cfg.HostAgentCredsDir != "" {
+		return *cfg.HostAgentCredsDir
+	}
+	return defaultHostAgentCredsDir()
+}
+
+// HostAgentListenAddr determines the network ("unix" or "tcp")
+// and address the host agent listens on.
+func HostAgentListenAddr(cfg *config.Config) (string, string) {
+	addr := ""
+	if cfg.HostAgentAddr != nil {
+		addr = *cfg.HostAgentAddr
+	}
+	if addr == "" {
+		return "unix", filepath.Join(HostAgentCredsDir(cfg), HostAgentSocketName)
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix://"), "unix:")
+		return "unix", filepath.FromSlash(path)
+	}
+	return "tcp", addr
+}
+
+// DeriveHostAgentAddr determines the correct network and address
+// to connect to for the host agent. A tcp address without a host
+// (e.g. ":5989") connects to the docker host when running in a container.
+func DeriveHostAgentAddr(cfg *config.Config) (string, string) {
+	network, addr := HostAgentListenAddr(cfg)
+	if network != "tcp" {
+		return network, addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return network, addr
+	}
 	if utils.IsRunningInDockerContainer() {
-		return fmt.Sprintf("host.docker.internal:%s", HostAgentPort)
+		return network, fmt.Sprintf("host.docker.internal:%s", port)
 	}
-	return fmt.Sprintf("127.0.0.1:%s", HostAgentPort)
+	return network, fmt.Sprintf("127.0.0.1:%s", port)
 }
@@ -6,12 +6,13 @@
 // by the Apache License, Version 2.0, included in the file
 // licenses/LICENSE-Apache-2.0
 
-package utils
+package connect
 
-import "errors"
-
-var (
-	// ErrMissingOrInvalidLogger provides an error that should be used
-	// upon failure to get the logger from a service resolver.
-	ErrMissingOrInvalidLogger = errors.New("the logger service is either missing or is of an unexpected type")
+import (
+	"os"
+	"path/filepath"
 )
+
+func defaultHostAgentCredsDir() string {
+	return filepath.Join(os.Getenv("ProgramData"), "cloud-uno")
+}
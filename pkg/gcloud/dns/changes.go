@@ -0,0 +1,396 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package dns
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var supportedRecordTypes = map[string]bool{
+	"A": true, "AAAA": true, "CAA": true, "CNAME": true, "DNSKEY": true, "DS": true,
+	"HTTPS": true, "IPSECKEY": true, "MX": true, "NAPTR": true, "NS": true, "PTR": true,
+	"SOA": true, "SPF": true, "SRV": true, "SSHFP": true, "SVCB": true, "TLSA": true, "TXT": true,
+}
+
+// ListChanges deals with listing the changes made to a managed zone
+// in the order they were made.
+func (s *Service) ListChanges(project string, managedZone string, maxResults int64, pageToken string) (*ChangesListResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := pagination.Page(len(state.Changes), maxResults, pageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &ChangesListResponse{
+		Kind:          kindChangesListResponse,
+		Changes:       []*Change{},
+		NextPageToken: nextPageToken,
+	}
+	for _, change := range state.Changes[start:end] {
+		response.Changes = append(response.Changes, copyChange(change))
+	}
+	return response, nil
+}
+
+// GetChange deals with retrieving a change made to a managed zone.
+func (s *Service) GetChange(project string, managedZone string, changeID string) (*Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range state.Changes {
+		if change.ID == changeID {
+			return copyChange(change), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "The 'parameters.changeId' resource named '%s' does not exist.", changeID)
+}
+
+// CreateChange deals with atomically applying the deletions and then the additions
+// of a change to the record sets of a managed zone, changes are done straight away.
+func (s *Service) CreateChange(project string, managedZone string, change *Change) (*Change, error) {
+	if change == nil || (len(change.Additions) == 0 && len(change.Deletions) == 0) {
+		return nil, status.Errorf(codes.InvalidArgument, "The change must have at least one addition or deletion")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyChangeLocked(project, state, change.Additions, change.Deletions)
+}
+
+// ListResourceRecordSets deals with listing the record sets in a managed zone,
+// record sets can be filtered by name and by type when a name is provided.
+func (s *Service) ListResourceRecordSets(
+	project string,
+	managedZone string,
+	name string,
+	recordType string,
+	maxResults int64,
+	pageToken string,
+) (*ResourceRecordSetsListResponse, error) {
+	if recordType != "" && name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A name must be provided to filter record sets by type")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	rrsets := []*ResourceRecordSet{}
+	for _, rrset := range state.Rrsets {
+		if (name == "" || rrset.Name == canonicalName(name)) && (recordType == "" || rrset.Type == recordType) {
+			rrsets = append(rrsets, rrset)
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(rrsets), maxResults, pageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &ResourceRecordSetsListResponse{
+		Kind:          kindResourceRecordSetsListResponse,
+		Rrsets:        []*ResourceRecordSet{},
+		NextPageToken: nextPageToken,
+	}
+	for _, rrset := range rrsets[start:end] {
+		response.Rrsets = append(response.Rrsets, copyRrset(rrset))
+	}
+	return response, nil
+}
+
+// GetResourceRecordSet deals with retrieving the record set
+// for a name and type in a managed zone.
+func (s *Service) GetResourceRecordSet(project string, managedZone string, name string, recordType string) (*ResourceRecordSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	rrset, err := findRrset(state, name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return copyRrset(rrset), nil
+}
+
+// CreateResourceRecordSet deals with adding a record set to a managed zone.
+func (s *Service) CreateResourceRecordSet(project string, managedZone string, rrset *ResourceRecordSet) (*ResourceRecordSet, error) {
+	if rrset == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A record set must be provided")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	change, err := s.applyChangeLocked(project, state, []*ResourceRecordSet{rrset}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return change.Additions[0], nil
+}
+
+// PatchResourceRecordSet deals with replacing the TTL and data of the record set
+// for a name and type, the TTL is kept when one is not provided.
+func (s *Service) PatchResourceRecordSet(
+	project string,
+	managedZone string,
+	name string,
+	recordType string,
+	update *ResourceRecordSet,
+) (*ResourceRecordSet, error) {
+	if update == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A record set must be provided")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := findRrset(state, name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	patched := copyRrset(existing)
+	if update.TTL != 0 {
+		patched.TTL = update.TTL
+	}
+	if update.Rrdatas != nil {
+		patched.Rrdatas = update.Rrdatas
+	}
+	change, err := s.applyChangeLocked(project, state, []*ResourceRecordSet{patched}, []*ResourceRecordSet{existing})
+	if err != nil {
+		return nil, err
+	}
+	return change.Additions[0], nil
+}
+
+// DeleteResourceRecordSet deals with removing the record set
+// for a name and type from a managed zone.
+func (s *Service) DeleteResourceRecordSet(project string, managedZone string, name string, recordType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return err
+	}
+	existing, err := findRrset(state, name, recordType)
+	if err != nil {
+		return err
+	}
+	_, err = s.applyChangeLocked(project, state, nil, []*ResourceRecordSet{existing})
+	return err
+}
+
+// applyChangeLocked validates a change against the record sets of a zone and
+// records it once the updated record sets have been applied with the hosts service
+// and persisted, deletions must match an existing record set exactly as per Cloud DNS.
+func (s *Service) applyChangeLocked(
+	project string,
+	state *zoneState,
+	additions []*ResourceRecordSet,
+	deletions []*ResourceRecordSet,
+) (*Change, error) {
+	rrsets := map[string]*ResourceRecordSet{}
+	for _, rrset := range state.Rrsets {
+		rrsets[rrsetKey(rrset.Name, rrset.Type)] = rrset
+	}
+	change := &Change{
+		Kind:      kindChange,
+		ID:        strconv.Itoa(len(state.Changes)),
+		StartTime: formatTime(s.now()),
+		Status:    statusDone,
+	}
+	for _, deletion := range deletions {
+		deleted := prepareRrset(deletion)
+		key := rrsetKey(deleted.Name, deleted.Type)
+		existing, ok := rrsets[key]
+		if !ok {
+			return nil, status.Errorf(
+				codes.NotFound,
+				"The 'entity.change.deletions[%s][%s]' resource named '%s (%s)' does not exist.",
+				deleted.Name, deleted.Type, deleted.Name, deleted.Type,
+			)
+		}
+		if existing.TTL != deleted.TTL || !reflect.DeepEqual(existing.Rrdatas, deleted.Rrdatas) {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"The resource 'entity.change.deletions[%s][%s]' does not match the existing record set",
+				deleted.Name, deleted.Type,
+			)
+		}
+		delete(rrsets, key)
+		change.Deletions = append(change.Deletions, existing)
+	}
+	for _, addition := range additions {
+		added := prepareRrset(addition)
+		err := validateRrset(state.Zone, added)
+		if err != nil {
+			return nil, err
+		}
+		key := rrsetKey(added.Name, added.Type)
+		if _, exists := rrsets[key]; exists {
+			return nil, status.Errorf(
+				codes.AlreadyExists,
+				"The resource 'entity.change.additions[%s][%s]' named '%s (%s)' already exists",
+				added.Name, added.Type, added.Name, added.Type,
+			)
+		}
+		rrsets[key] = added
+		change.Additions = append(change.Additions, added)
+	}
+	err := validateZoneRecords(state.Zone, rrsets)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := &zoneState{Zone: state.Zone, Changes: append(append([]*Change{}, state.Changes...), change)}
+	for _, rrset := range rrsets {
+		updated.Rrsets = append(updated.Rrsets, rrset)
+	}
+	sort.Slice(updated.Rrsets, func(i, j int) bool {
+		return rrsetKey(updated.Rrsets[i].Name, updated.Rrsets[i].Type) < rrsetKey(updated.Rrsets[j].Name, updated.Rrsets[j].Type)
+	})
+	// The hosts are applied before the change is persisted so a change
+	// the hosts service rejects isn't applied again the next time Cloud::1 starts.
+	key := zoneKey(project, state.Zone.Name)
+	s.zones[key] = updated
+	err = s.syncHostsLocked()
+	if err == nil {
+		err = s.writeZoneLocked(key, updated)
+	}
+	if err != nil {
+		s.zones[key] = state
+		return nil, s.restoreHostsLocked(err)
+	}
+	return copyChange(change), nil
+}
+
+// prepareRrset makes a copy of a record set with a canonical
+// name and type and the default TTL when one is not provided.
+func prepareRrset(rrset *ResourceRecordSet) *ResourceRecordSet {
+	prepared := copyRrset(rrset)
+	prepared.Kind = kindResourceRecordSet
+	prepared.Name = canonicalName(rrset.Name)
+	prepared.Type = strings.ToUpper(rrset.Type)
+	if prepared.TTL == 0 {
+		prepared.TTL = defaultTTL
+	}
+	return prepared
+}
+
+func validateRrset(zone *ManagedZone, rrset *ResourceRecordSet) error {
+	if !dnsNamePattern.MatchString(rrset.Name) ||
+		(rrset.Name != zone.DNSName && !strings.HasSuffix(rrset.Name, "."+zone.DNSName)) {
+		return status.Errorf(codes.InvalidArgument, "Invalid value for 'entity.change.additions[%s].name': must be within %s", rrset.Name, zone.DNSName)
+	}
+	if !supportedRecordTypes[rrset.Type] {
+		return status.Errorf(codes.InvalidArgument, "Invalid value for 'entity.change.additions[%s].type': '%s'", rrset.Name, rrset.Type)
+	}
+	if rrset.TTL < 0 {
+		return status.Errorf(codes.InvalidArgument, "Invalid value for 'entity.change.additions[%s].ttl': '%d'", rrset.Name, rrset.TTL)
+	}
+	if len(rrset.Rrdatas) == 0 {
+		return status.Errorf(codes.InvalidArgument, "The record set %s (%s) must have at least one record", rrset.Name, rrset.Type)
+	}
+	for _, rrdata := range rrset.Rrdatas {
+		ip := net.ParseIP(rrdata)
+		validData := true
+		switch rrset.Type {
+		case "A":
+			validData = ip != nil && ip.To4() != nil
+		case "AAAA":
+			validData = ip != nil && ip.To4() == nil
+		case "CNAME":
+			validData = len(rrset.Rrdatas) == 1 && dnsNamePattern.MatchString(canonicalName(rrdata))
+		}
+		if !validData {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"Invalid value for 'entity.change.additions[%s][%s].rrdata': '%s'", rrset.Name, rrset.Type, rrdata,
+			)
+		}
+	}
+	return nil
+}
+
+// validateZoneRecords checks the record sets of a zone would be valid once
+// a change has been applied, the apex SOA and NS record sets can be replaced but
+// not removed and a CNAME can't share its name with other record sets.
+func validateZoneRecords(zone *ManagedZone, rrsets map[string]*ResourceRecordSet) error {
+	for _, recordType := range []string{"SOA", "NS"} {
+		if _, ok := rrsets[rrsetKey(zone.DNSName, recordType)]; !ok {
+			return status.Errorf(codes.FailedPrecondition, "The %s record set at the apex of %s can not be deleted", recordType, zone.DNSName)
+		}
+	}
+	names := map[string]int{}
+	for _, rrset := range rrsets {
+		names[rrset.Name] = names[rrset.Name] + 1
+	}
+	for _, rrset := range rrsets {
+		if rrset.Type == "CNAME" && names[rrset.Name] > 1 {
+			return status.Errorf(codes.FailedPrecondition, "A CNAME record set can not share the name %s with other record sets", rrset.Name)
+		}
+	}
+	return nil
+}
+
+func findRrset(state *zoneState, name string, recordType string) (*ResourceRecordSet, error) {
+	name = canonicalName(name)
+	recordType = strings.ToUpper(recordType)
+	for _, rrset := range state.Rrsets {
+		if rrset.Name == name && rrset.Type == recordType {
+			return rrset, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "The 'parameters.name' resource named '%s (%s)' does not exist.", name, recordType)
+}
+
+func rrsetKey(name string, recordType string) string {
+	return name + " " + recordType
+}
+
+func copyRrset(rrset *ResourceRecordSet) *ResourceRecordSet {
+	copied := *rrset
+	copied.Rrdatas = append([]string{}, rrset.Rrdatas...)
+	return &copied
+}
+
+func copyChange(change *Change) *Change {
+	copied := *change
+	copied.Additions = nil
+	copied.Deletions = nil
+	for _, rrset := range change.Additions {
+		copied.Additions = append(copied.Additions, copyRrset(rrset))
+	}
+	for _, rrset := range change.Deletions {
+		copied.Deletions = append(copied.Deletions, copyRrset(rrset))
+	}
+	return &copied
+}
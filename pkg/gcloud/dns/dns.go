@@ -0,0 +1,468 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	zoneFile = "zone.json"
+	// defaultTTL is used for record sets that are created
+	// without a TTL.
+	defaultTTL = 300
+	// apexTTL is the TTL of the SOA and NS record sets
+	// created with a zone.
+	apexTTL = 21600
+)
+
+var (
+	dnsLocalHost     = "dns.googleapis.local"
+	zoneNamePattern  = regexp.MustCompile(`^[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	dnsNamePattern   = regexp.MustCompile(`^(\*\.)?([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?\.)+$`)
+	projectIDPattern = regexp.MustCompile(`^[a-z0-9.:-]{1,100}$`)
+
+	publicNameServers = []string{
+		"ns-cloud-a1.googledomains.com.",
+		"ns-cloud-a2.googledomains.com.",
+		"ns-cloud-a3.googledomains.com.",
+		"ns-cloud-a4.googledomains.com.",
+	}
+	privateNameServers = []string{"ns-gcp-private.googledomains.com."}
+)
+
+// Service provides a Cloud DNS emulator, the records of private zones are
+// applied with the hosts service so the names resolve on the machine
+// Cloud::1 runs on. Zones are persisted to the configured
+// file system along with their record sets and changes.
+type Service struct {
+	mu           sync.Mutex
+	dataRootDir  string
+	fs           afero.Fs
+	hostsService hosts.Service
+	zones        map[string]*zoneState
+	// hostIPs holds the IP the hosts service has been asked to map each
+	// host onto for the records in private zones.
+	hostIPs map[string]string
+	// servedZones holds the DNS names of the private zones being served
+	// when the hosts service can serve zones in full.
+	servedZones map[string]bool
+	logger      *logrus.Entry
+	now         func() time.Time
+}
+
+// zoneState holds a managed zone along with its record sets
+// and the changes that have been made to them.
+type zoneState struct {
+	Zone    *ManagedZone         `json:"zone"`
+	Rrsets  []*ResourceRecordSet `json:"rrsets"`
+	Changes []*Change            `json:"changes"`
+}
+
+// New creates an instance of the Cloud::1 Cloud DNS implementation,
+// the records of persisted private zones are applied with the hosts
+// service straight away. Records the hosts service rejects, such as those
+// the host agent policy has changed to deny, are logged so the emulator
+// can still be used to fix them.
+func New(dataRootDir string, fs afero.Fs, ip string, hostsService hosts.Service, logger *logrus.Entry) (*Service, error) {
+	err := hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &dnsLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		dataRootDir:  dataRootDir,
+		fs:           fs,
+		hostsService: hostsService,
+		zones:        map[string]*zoneState{},
+		hostIPs:      map[string]string{},
+		servedZones:  map[string]bool{},
+		logger:       logger,
+		now:          time.Now,
+	}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	err = s.syncHostsLocked()
+	if err != nil {
+		s.logger.Errorf("failed to apply the records of private zones with the hosts service: %s", err)
+	}
+	return s, nil
+}
+
+// ListManagedZones deals with listing the managed zones in a project,
+// zones can be filtered by DNS name.
+func (s *Service) ListManagedZones(project string, dnsName string, maxResults int64, pageToken string) (*ManagedZonesListResponse, error) {
+	err := validateProject(project)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zones := []*ManagedZone{}
+	for _, key := range s.zoneKeysLocked() {
+		zone := s.zones[key].Zone
+		if strings.HasPrefix(key, "projects/"+project+"/") && (dnsName == "" || zone.DNSName == canonicalName(dnsName)) {
+			zones = append(zones, zone)
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(zones), maxResults, pageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &ManagedZonesListResponse{
+		Kind:          kindManagedZonesListResponse,
+		ManagedZones:  []*ManagedZone{},
+		NextPageToken: nextPageToken,
+	}
+	for _, zone := range zones[start:end] {
+		response.ManagedZones = append(response.ManagedZones, copyZone(zone))
+	}
+	return response, nil
+}
+
+// GetManagedZone deals with retrieving a managed zone by name or ID.
+func (s *Service) GetManagedZone(project string, managedZone string) (*ManagedZone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	return copyZone(state.Zone), nil
+}
+
+// CreateManagedZone deals with creating a managed zone, the SOA and NS record
+// sets for the zone are created along with it as per Cloud DNS.
+func (s *Service) CreateManagedZone(project string, zone *ManagedZone) (*ManagedZone, error) {
+	err := validateProject(project)
+	if err != nil {
+		return nil, err
+	}
+	if zone == nil || !zoneNamePattern.MatchString(zone.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid value for 'entity.managedZone.name'")
+	}
+	dnsName := canonicalName(zone.DNSName)
+	if !dnsNamePattern.MatchString(dnsName) || strings.HasPrefix(dnsName, "*") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid value for 'entity.managedZone.dnsName': '%s'", zone.DNSName)
+	}
+	created := copyZone(zone)
+	created.Kind = kindManagedZone
+	created.DNSName = dnsName
+	if created.Visibility == "" {
+		created.Visibility = visibilityPublic
+	}
+	err = prepareVisibility(created)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := zoneKey(project, zone.Name)
+	if _, exists := s.zones[key]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "The resource 'entity.managedZone' named '%s' already exists", zone.Name)
+	}
+	created.ID, err = s.newZoneIDLocked()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	created.CreationTime = formatTime(now)
+	created.NameServers = publicNameServers
+	if created.Visibility == visibilityPrivate {
+		created.NameServers = privateNameServers
+	}
+	apex := []*ResourceRecordSet{
+		{
+			Kind:    kindResourceRecordSet,
+			Name:    dnsName,
+			Type:    "NS",
+			TTL:     apexTTL,
+			Rrdatas: created.NameServers,
+		},
+		{
+			Kind: kindResourceRecordSet,
+			Name: dnsName,
+			Type: "SOA",
+			TTL:  apexTTL,
+			Rrdatas: []string{
+				fmt.Sprintf("%s cloud-dns-hostmaster.google.com. 1 21600 3600 259200 300", created.NameServers[0]),
+			},
+		},
+	}
+	state := &zoneState{
+		Zone:   created,
+		Rrsets: apex,
+		Changes: []*Change{
+			{Kind: kindChange, ID: "0", Additions: apex, StartTime: created.CreationTime, Status: statusDone},
+		},
+	}
+	err = s.writeZoneLocked(key, state)
+	if err != nil {
+		return nil, err
+	}
+	s.zones[key] = state
+	return copyZone(created), nil
+}
+
+// UpdateManagedZone deals with updating the description, labels and private
+// visibility of a managed zone. When patching only the fields that are provided
+// are updated, otherwise the zone is replaced with the one provided.
+// The DNS name and visibility of a zone can't be changed.
+func (s *Service) UpdateManagedZone(project string, managedZone string, update *ManagedZone, patch bool) (*Operation, error) {
+	if update == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A managed zone must be provided")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return nil, err
+	}
+	old := state.Zone
+	if (update.DNSName != "" && canonicalName(update.DNSName) != old.DNSName) ||
+		(update.Visibility != "" && update.Visibility != old.Visibility) {
+		return nil, status.Errorf(codes.InvalidArgument, "The DNS name and visibility of a managed zone can not be changed")
+	}
+	updated := copyZone(old)
+	if !patch || update.Description != "" {
+		updated.Description = update.Description
+	}
+	if !patch || update.Labels != nil {
+		updated.Labels = update.Labels
+	}
+	if !patch || update.PrivateVisibilityConfig != nil {
+		updated.PrivateVisibilityConfig = update.PrivateVisibilityConfig
+	}
+	if !patch || update.DNSSECConfig != nil {
+		updated.DNSSECConfig = update.DNSSECConfig
+	}
+	if !patch || update.CloudLoggingConfig != nil {
+		updated.CloudLoggingConfig = update.CloudLoggingConfig
+	}
+	err = prepareVisibility(updated)
+	if err != nil {
+		return nil, err
+	}
+	key := zoneKey(project, old.Name)
+	updatedState := &zoneState{Zone: updated, Rrsets: state.Rrsets, Changes: state.Changes}
+	err = s.writeZoneLocked(key, updatedState)
+	if err != nil {
+		return nil, err
+	}
+	s.zones[key] = updatedState
+	id, err := s.newZoneIDLocked()
+	if err != nil {
+		return nil, err
+	}
+	return &Operation{
+		Kind:        kindOperation,
+		ID:          id,
+		StartTime:   formatTime(s.now()),
+		Status:      statusDone,
+		Type:        operationTypeUpdate,
+		ZoneContext: &OperationZoneContext{OldValue: copyZone(old), NewValue: copyZone(updated)},
+	}, nil
+}
+
+// DeleteManagedZone deals with deleting a managed zone along with its record sets,
+// the hosts that were added for the records of a private zone are removed.
+// Unlike Cloud DNS, zones that still have records can be deleted so local
+// environments can be torn down in one go.
+func (s *Service) DeleteManagedZone(project string, managedZone string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.getZoneLocked(project, managedZone)
+	if err != nil {
+		return err
+	}
+	key := zoneKey(project, state.Zone.Name)
+	delete(s.zones, key)
+	err = s.syncHostsLocked()
+	if err == nil {
+		err = s.fs.RemoveAll(path.Join(s.dataRootDir, key))
+	}
+	if err != nil {
+		s.zones[key] = state
+		return s.restoreHostsLocked(err)
+	}
+	return nil
+}
+
+// restoreHostsLocked brings the hosts back in line with the zones once a change
+// that failed has been rolled back, the error the change failed with is returned.
+func (s *Service) restoreHostsLocked(cause error) error {
+	err := s.syncHostsLocked()
+	if err != nil {
+		s.logger.Errorf("failed to restore the hosts for the records of private zones: %s", err)
+	}
+	return cause
+}
+
+// getZoneLocked retrieves a zone by name, or by ID as
+// client libraries allow either to be used.
+func (s *Service) getZoneLocked(project string, managedZone string) (*zoneState, error) {
+	err := validateProject(project)
+	if err != nil {
+		return nil, err
+	}
+	if state, ok := s.zones[zoneKey(project, managedZone)]; ok {
+		return state, nil
+	}
+	for key, state := range s.zones {
+		if strings.HasPrefix(key, "projects/"+project+"/") && state.Zone.ID == managedZone {
+			return state, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "The 'parameters.managedZone' resource named '%s' does not exist.", managedZone)
+}
+
+// newZoneIDLocked generates a random numeric ID in the same format as Cloud DNS.
+func (s *Service) newZoneIDLocked() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(9000000000000000000))
+	if err != nil {
+		return "", err
+	}
+	n.Add(n, big.NewInt(1000000000000000000))
+	return n.String(), nil
+}
+
+func (s *Service) zoneKeysLocked() []string {
+	keys := []string{}
+	for key := range s.zones {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// load deals with loading persisted zones when the emulator starts.
+func (s *Service) load() error {
+	walkFn := func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != zoneFile {
+			return err
+		}
+		bytes, err := afero.ReadFile(s.fs, filePath)
+		if err != nil {
+			return err
+		}
+		state := &zoneState{}
+		err = json.Unmarshal(bytes, state)
+		if err != nil {
+			return err
+		}
+		s.zones[strings.TrimPrefix(path.Dir(filePath), s.dataRootDir+"/")] = state
+		return nil
+	}
+	return afero.Walk(s.fs, s.dataRootDir, walkFn)
+}
+
+func (s *Service) writeZoneLocked(key string, state *zoneState) error {
+	zoneDir := path.Join(s.dataRootDir, key)
+	err := s.fs.MkdirAll(zoneDir, 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(s.fs, path.Join(zoneDir, zoneFile), bytes, 0755)
+}
+
+// prepareVisibility validates the visibility of a zone, private
+// visibility configuration only applies to private zones.
+func prepareVisibility(zone *ManagedZone) error {
+	if zone.Visibility != visibilityPublic && zone.Visibility != visibilityPrivate {
+		return status.Errorf(codes.InvalidArgument, "Invalid value for 'entity.managedZone.visibility': '%s'", zone.Visibility)
+	}
+	if zone.Visibility == visibilityPublic && zone.PrivateVisibilityConfig != nil {
+		return status.Errorf(codes.InvalidArgument, "Private visibility configuration can only be set for private zones")
+	}
+	if config := zone.PrivateVisibilityConfig; config != nil {
+		config.Kind = kindPrivateVisibilityConfig
+		for _, network := range config.Networks {
+			network.Kind = kindPrivateVisibilityConfigNetwork
+		}
+	}
+	return nil
+}
+
+func validateProject(project string) error {
+	if !projectIDPattern.MatchString(project) {
+		return status.Errorf(codes.InvalidArgument, "Invalid value for 'parameters.project': '%s'", project)
+	}
+	return nil
+}
+
+func zoneKey(project string, managedZone string) string {
+	return fmt.Sprintf("projects/%s/managedZones/%s", project, managedZone)
+}
+
+// copyZone makes a copy of a zone so zones held by the service
+// are never shared with callers.
+func copyZone(zone *ManagedZone) *ManagedZone {
+	copied := *zone
+	if zone.NameServers != nil {
+		copied.NameServers = append([]string{}, zone.NameServers...)
+	}
+	if zone.Labels != nil {
+		copied.Labels = map[string]string{}
+		for key, value := range zone.Labels {
+			copied.Labels[key] = value
+		}
+	}
+	if config := zone.PrivateVisibilityConfig; config != nil {
+		copied.PrivateVisibilityConfig = &ManagedZonePrivateVisibilityConfig{Kind: config.Kind}
+		for _, network := range config.Networks {
+			copiedNetwork := *network
+			copied.PrivateVisibilityConfig.Networks = append(copied.PrivateVisibilityConfig.Networks, &copiedNetwork)
+		}
+	}
+	return &copied
+}
+
+// canonicalName converts a DNS name to lower case and makes it fully qualified.
+// (e.g. API.Example.com -> api.example.com.)
+func canonicalName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name != "" && !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	return name
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
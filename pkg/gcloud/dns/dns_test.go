@@ -0,0 +1,407 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type DNSSuite struct {
+	fs      afero.Fs
+	hosts   *recordingHostsService
+	logger  *logrus.Entry
+	service *Service
+}
+
+var _ = Suite(&DNSSuite{})
+
+const testProject = "test-project"
+
+func (s *DNSSuite) SetUpTest(c *C) {
+	s.fs = afero.NewMemMapFs()
+	s.hosts = &recordingHostsService{ips: map[string]string{}}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	s.logger = logrus.NewEntry(logger)
+	service, err := New("/data/gcloud/dns", s.fs, "127.0.0.1", s.hosts, s.logger)
+	c.Assert(err, IsNil)
+	service.now = func() time.Time {
+		return time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	}
+	s.service = service
+}
+
+func (s *DNSSuite) createPrivateZone(c *C) {
+	_, err := s.service.CreateManagedZone(testProject, &ManagedZone{
+		Name:       "internal",
+		DNSName:    "internal.example.com",
+		Visibility: visibilityPrivate,
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *DNSSuite) Test_creates_zone_with_apex_record_sets(c *C) {
+	zone, err := s.service.CreateManagedZone(testProject, &ManagedZone{
+		Name:    "example",
+		DNSName: "Example.com",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(zone.DNSName, Equals, "example.com.")
+	c.Assert(zone.Visibility, Equals, visibilityPublic)
+	c.Assert(zone.ID, Not(Equals), "")
+	c.Assert(zone.CreationTime, Equals, "2022-06-01T12:00:00.000Z")
+
+	rrsets, err := s.service.ListResourceRecordSets(testProject, zone.ID, "", "", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(rrsets.Rrsets, HasLen, 2)
+	c.Assert(rrsets.Rrsets[0].Type, Equals, "NS")
+	c.Assert(rrsets.Rrsets[0].Rrdatas, DeepEquals, publicNameServers)
+	c.Assert(rrsets.Rrsets[1].Type, Equals, "SOA")
+
+	change, err := s.service.GetChange(testProject, "example", "0")
+	c.Assert(err, IsNil)
+	c.Assert(change.Status, Equals, statusDone)
+	c.Assert(change.Additions, HasLen, 2)
+
+	_, err = s.service.CreateManagedZone(testProject, &ManagedZone{Name: "example", DNSName: "example.org."})
+	c.Assert(status.Code(err), Equals, codes.AlreadyExists)
+}
+
+func (s *DNSSuite) Test_applies_private_zone_records_to_hosts(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateChange(testProject, "internal", &Change{
+		Additions: []*ResourceRecordSet{
+			{Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"}},
+			{Name: "v6.internal.example.com.", Type: "AAAA", Rrdatas: []string{"fd00::5"}},
+			{Name: "dual.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.7"}},
+			{Name: "dual.internal.example.com.", Type: "AAAA", Rrdatas: []string{"fd00::7"}},
+			{Name: "www.internal.example.com.", Type: "CNAME", Rrdatas: []string{"api.internal.example.com."}},
+			{Name: "app.internal.example.com.", Type: "CNAME", Rrdatas: []string{"dual.internal.example.com."}},
+			{Name: "*.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.6"}},
+			{Name: "internal.example.com.", Type: "TXT", Rrdatas: []string{"\"v=spf1 -all\""}},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.hosts.ips, DeepEquals, map[string]string{
+		dnsLocalHost:                "127.0.0.1",
+		"api.internal.example.com":  "10.0.0.5",
+		"v6.internal.example.com":   "fd00::5",
+		"dual.internal.example.com": "10.0.0.7,fd00::7",
+		"www.internal.example.com":  "10.0.0.5",
+		"app.internal.example.com":  "10.0.0.7,fd00::7",
+	})
+
+	rrset, err := s.service.GetResourceRecordSet(testProject, "internal", "api.internal.example.com.", "A")
+	c.Assert(err, IsNil)
+	c.Assert(rrset.TTL, Equals, int64(defaultTTL))
+}
+
+func (s *DNSSuite) Test_does_not_apply_public_zone_records_to_hosts(c *C) {
+	_, err := s.service.CreateManagedZone(testProject, &ManagedZone{Name: "example", DNSName: "example.com."})
+	c.Assert(err, IsNil)
+	_, err = s.service.CreateResourceRecordSet(testProject, "example", &ResourceRecordSet{
+		Name: "api.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.hosts.ips, DeepEquals, map[string]string{dnsLocalHost: "127.0.0.1"})
+}
+
+func (s *DNSSuite) Test_updates_hosts_when_records_change(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", TTL: 60, Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	patched, err := s.service.PatchResourceRecordSet(testProject, "internal", "api.internal.example.com.", "A", &ResourceRecordSet{
+		Rrdatas: []string{"10.0.0.9"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(patched.TTL, Equals, int64(60))
+	c.Assert(s.hosts.ips["api.internal.example.com"], Equals, "10.0.0.9")
+
+	err = s.service.DeleteResourceRecordSet(testProject, "internal", "api.internal.example.com.", "A")
+	c.Assert(err, IsNil)
+	_, hasHost := s.hosts.ips["api.internal.example.com"]
+	c.Assert(hasHost, Equals, false)
+
+	changes, err := s.service.ListChanges(testProject, "internal", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(changes.Changes, HasLen, 4)
+	c.Assert(changes.Changes[2].Deletions[0].Rrdatas, DeepEquals, []string{"10.0.0.5"})
+	c.Assert(changes.Changes[2].Additions[0].Rrdatas, DeepEquals, []string{"10.0.0.9"})
+}
+
+func (s *DNSSuite) Test_rejects_changes_atomically(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	// The deletion doesn't match the existing record set so the addition
+	// must not be applied either.
+	_, err = s.service.CreateChange(testProject, "internal", &Change{
+		Deletions: []*ResourceRecordSet{
+			{Name: "api.internal.example.com.", Type: "A", TTL: defaultTTL, Rrdatas: []string{"10.0.0.1"}},
+		},
+		Additions: []*ResourceRecordSet{
+			{Name: "web.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.7"}},
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+	_, err = s.service.GetResourceRecordSet(testProject, "internal", "web.internal.example.com.", "A")
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+	_, hasHost := s.hosts.ips["web.internal.example.com"]
+	c.Assert(hasHost, Equals, false)
+
+	_, err = s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.6"},
+	})
+	c.Assert(status.Code(err), Equals, codes.AlreadyExists)
+}
+
+func (s *DNSSuite) Test_rejects_invalid_record_sets(c *C) {
+	s.createPrivateZone(c)
+	invalid := []*ResourceRecordSet{
+		{Name: "api.example.org.", Type: "A", Rrdatas: []string{"10.0.0.5"}},
+		{Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"fd00::5"}},
+		{Name: "api.internal.example.com.", Type: "AAAA", Rrdatas: []string{"10.0.0.5"}},
+		{Name: "api.internal.example.com.", Type: "CNAME", Rrdatas: []string{"a.example.com.", "b.example.com."}},
+		{Name: "api.internal.example.com.", Type: "UNKNOWN", Rrdatas: []string{"value"}},
+		{Name: "api.internal.example.com.", Type: "A"},
+	}
+	for _, rrset := range invalid {
+		_, err := s.service.CreateResourceRecordSet(testProject, "internal", rrset)
+		c.Assert(status.Code(err), Equals, codes.InvalidArgument, Commentf("%s %s", rrset.Type, rrset.Rrdatas))
+	}
+
+	_, err := s.service.CreateChange(testProject, "internal", &Change{
+		Additions: []*ResourceRecordSet{
+			{Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"}},
+			{Name: "api.internal.example.com.", Type: "CNAME", Rrdatas: []string{"web.internal.example.com."}},
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+
+	err = s.service.DeleteResourceRecordSet(testProject, "internal", "internal.example.com.", "SOA")
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *DNSSuite) Test_deleting_zone_removes_hosts(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	err = s.service.DeleteManagedZone(testProject, "internal")
+	c.Assert(err, IsNil)
+	c.Assert(s.hosts.ips, DeepEquals, map[string]string{dnsLocalHost: "127.0.0.1"})
+	_, err = s.service.GetManagedZone(testProject, "internal")
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
+func (s *DNSSuite) Test_reloads_zones_and_hosts(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	reloadedHosts := &recordingHostsService{ips: map[string]string{}}
+	reloaded, err := New("/data/gcloud/dns", s.fs, "127.0.0.1", reloadedHosts, s.logger)
+	c.Assert(err, IsNil)
+	zone, err := reloaded.GetManagedZone(testProject, "internal")
+	c.Assert(err, IsNil)
+	c.Assert(zone.Visibility, Equals, visibilityPrivate)
+	c.Assert(reloadedHosts.ips["api.internal.example.com"], Equals, "10.0.0.5")
+
+	changes, err := reloaded.ListChanges(testProject, "internal", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(changes.Changes, HasLen, 2)
+}
+
+func (s *DNSSuite) Test_changes_the_hosts_service_rejects_are_rolled_back(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	s.hosts.denied = map[string]bool{"github.internal.example.com": true}
+	_, err = s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "github.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.6"},
+	})
+	c.Assert(err, ErrorMatches, ".*not allowed.*")
+	_, err = s.service.GetResourceRecordSet(testProject, "internal", "github.internal.example.com.", "A")
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+	c.Assert(s.hosts.ips["api.internal.example.com"], Equals, "10.0.0.5")
+
+	s.hosts.removeErr = errors.New("hosts file is locked")
+	err = s.service.DeleteManagedZone(testProject, "internal")
+	c.Assert(err, ErrorMatches, "hosts file is locked")
+	_, err = s.service.GetManagedZone(testProject, "internal")
+	c.Assert(err, IsNil)
+	c.Assert(s.hosts.ips["api.internal.example.com"], Equals, "10.0.0.5")
+
+	// The rejected change wasn't persisted so it isn't applied again on start up.
+	reloadedHosts := &recordingHostsService{ips: map[string]string{}, denied: s.hosts.denied}
+	reloaded, err := New("/data/gcloud/dns", s.fs, "127.0.0.1", reloadedHosts, s.logger)
+	c.Assert(err, IsNil)
+	changes, err := reloaded.ListChanges(testProject, "internal", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(changes.Changes, HasLen, 2)
+}
+
+func (s *DNSSuite) Test_starts_when_the_hosts_service_rejects_persisted_records(c *C) {
+	s.createPrivateZone(c)
+	_, err := s.service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "api.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	reloadedHosts := &recordingHostsService{
+		ips:    map[string]string{},
+		denied: map[string]bool{"api.internal.example.com": true},
+	}
+	reloaded, err := New("/data/gcloud/dns", s.fs, "127.0.0.1", reloadedHosts, s.logger)
+	c.Assert(err, IsNil)
+	_, err = reloaded.GetResourceRecordSet(testProject, "internal", "api.internal.example.com.", "A")
+	c.Assert(err, IsNil)
+	// The record can still be removed once it is rejected.
+	err = reloaded.DeleteResourceRecordSet(testProject, "internal", "api.internal.example.com.", "A")
+	c.Assert(err, IsNil)
+}
+
+func (s *DNSSuite) Test_updates_and_lists_zones(c *C) {
+	for _, name := range []string{"zone-a", "zone-b", "zone-c"} {
+		_, err := s.service.CreateManagedZone(testProject, &ManagedZone{Name: name, DNSName: name + ".example.com."})
+		c.Assert(err, IsNil)
+	}
+	page, err := s.service.ListManagedZones(testProject, "", 2, "")
+	c.Assert(err, IsNil)
+	c.Assert(page.ManagedZones, HasLen, 2)
+	c.Assert(page.NextPageToken, Equals, "2")
+	page, err = s.service.ListManagedZones(testProject, "", 2, page.NextPageToken)
+	c.Assert(err, IsNil)
+	c.Assert(page.ManagedZones, HasLen, 1)
+	c.Assert(page.ManagedZones[0].Name, Equals, "zone-c")
+
+	operation, err := s.service.UpdateManagedZone(testProject, "zone-a", &ManagedZone{
+		Description: "Zone A",
+		Labels:      map[string]string{"env": "local"},
+	}, true)
+	c.Assert(err, IsNil)
+	c.Assert(operation.Status, Equals, statusDone)
+	c.Assert(operation.ZoneContext.OldValue.Description, Equals, "")
+	c.Assert(operation.ZoneContext.NewValue.Labels, DeepEquals, map[string]string{"env": "local"})
+
+	_, err = s.service.UpdateManagedZone(testProject, "zone-a", &ManagedZone{Visibility: visibilityPrivate}, true)
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+}
+
+func (s *DNSSuite) Test_serves_private_zones_when_supported(c *C) {
+	zoneHosts := &recordingZoneService{
+		recordingHostsService: recordingHostsService{ips: map[string]string{}},
+		zones:                 map[string][]*hosts.Record{},
+	}
+	service, err := New("/data/gcloud/dns-zones", s.fs, "127.0.0.1", zoneHosts, s.logger)
+	c.Assert(err, IsNil)
+	_, err = service.CreateManagedZone(testProject, &ManagedZone{
+		Name:       "internal",
+		DNSName:    "internal.example.com.",
+		Visibility: visibilityPrivate,
+	})
+	c.Assert(err, IsNil)
+	_, err = service.CreateResourceRecordSet(testProject, "internal", &ResourceRecordSet{
+		Name: "*.internal.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	records := zoneHosts.zones["internal.example.com."]
+	c.Assert(records, HasLen, 3)
+	c.Assert(*records[0], DeepEquals, hosts.Record{
+		Name: "*.internal.example.com.", Type: "A", TTL: defaultTTL, Data: []string{"10.0.0.5"},
+	})
+	// Records are served by the hosts service rather than added as hosts.
+	c.Assert(zoneHosts.ips, DeepEquals, map[string]string{dnsLocalHost: "127.0.0.1"})
+
+	err = service.DeleteManagedZone(testProject, "internal")
+	c.Assert(err, IsNil)
+	c.Assert(zoneHosts.zones, HasLen, 0)
+}
+
+// recordingHostsService keeps track of the IP each host is mapped to
+// in the same way as the hosts manager, adding denied hosts fails
+// as it would with the host agent policy.
+type recordingHostsService struct {
+	ips       map[string]string
+	denied    map[string]bool
+	removeErr error
+}
+
+func (m *recordingHostsService) Add(params *hosts.Params) error {
+	for _, host := range strings.Split(*params.Hosts, ",") {
+		if m.denied[host] {
+			return fmt.Errorf("host %s is %w", host, hosts.ErrHostNotAllowed)
+		}
+	}
+	for _, host := range strings.Split(*params.Hosts, ",") {
+		m.ips[host] = *params.IP
+	}
+	return nil
+}
+
+func (m *recordingHostsService) Remove(params *hosts.Params) error {
+	if m.removeErr != nil {
+		return m.removeErr
+	}
+	for _, host := range strings.Split(*params.Hosts, ",") {
+		if m.ips[host] == *params.IP {
+			delete(m.ips, host)
+		}
+	}
+	return nil
+}
+
+// recordingZoneService keeps track of the zones served
+// in the same way as the embedded DNS server.
+type recordingZoneService struct {
+	recordingHostsService
+	zones map[string][]*hosts.Record
+}
+
+func (m *recordingZoneService) SetZone(name string, records []*hosts.Record) error {
+	m.zones[name] = records
+	return nil
+}
+
+func (m *recordingZoneService) RemoveZone(name string) error {
+	delete(m.zones, name)
+	return nil
+}
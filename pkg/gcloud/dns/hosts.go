@@ -0,0 +1,181 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+)
+
+// maxCNAMEDepth is the number of CNAME records that will be
+// followed to find the IP for a host before giving up.
+const maxCNAMEDepth = 8
+
+// syncHostsLocked brings the hosts service in line with the records of private zones.
+// When the hosts service can serve zones, such as the embedded DNS server, private zones
+// are served in full. Otherwise only A, AAAA and CNAME records can be applied, a hosts
+// file can only map a host to one IPv4 and one IPv6 address so the first A record and
+// the first AAAA record are used, and CNAME records are followed to the addresses of their
+// target. Wildcard names can't be expressed in a hosts file so they are skipped.
+func (s *Service) syncHostsLocked() error {
+	if zoneService, ok := s.hostsService.(hosts.ZoneService); ok {
+		return s.syncZonesLocked(zoneService)
+	}
+	desired := s.desiredHostIPsLocked()
+
+	removals := map[string][]string{}
+	for host, ip := range s.hostIPs {
+		if desired[host] != ip {
+			removals[ip] = append(removals[ip], host)
+		}
+	}
+	additions := map[string][]string{}
+	for host, ip := range desired {
+		if s.hostIPs[host] != ip {
+			additions[ip] = append(additions[ip], host)
+		}
+	}
+
+	for _, ip := range sortedKeys(removals) {
+		err := s.applyHosts(s.hostsService.Remove, ip, removals[ip])
+		if err != nil {
+			return err
+		}
+		for _, host := range removals[ip] {
+			delete(s.hostIPs, host)
+		}
+	}
+	for _, ip := range sortedKeys(additions) {
+		err := s.applyHosts(s.hostsService.Add, ip, additions[ip])
+		if err != nil {
+			return err
+		}
+		for _, host := range additions[ip] {
+			s.hostIPs[host] = ip
+		}
+	}
+	return nil
+}
+
+// syncZonesLocked serves the records of private zones with the hosts service,
+// private zones with the same DNS name in different projects are served together.
+func (s *Service) syncZonesLocked(zoneService hosts.ZoneService) error {
+	desired := map[string][]*hosts.Record{}
+	for _, key := range s.zoneKeysLocked() {
+		state := s.zones[key]
+		if state.Zone.Visibility != visibilityPrivate {
+			continue
+		}
+		records := desired[state.Zone.DNSName]
+		for _, rrset := range state.Rrsets {
+			records = append(records, &hosts.Record{
+				Name: rrset.Name,
+				Type: rrset.Type,
+				TTL:  uint32(rrset.TTL),
+				Data: rrset.Rrdatas,
+			})
+		}
+		desired[state.Zone.DNSName] = records
+	}
+	for dnsName := range s.servedZones {
+		if _, ok := desired[dnsName]; !ok {
+			err := zoneService.RemoveZone(dnsName)
+			if err != nil {
+				return err
+			}
+			delete(s.servedZones, dnsName)
+		}
+	}
+	for dnsName, records := range desired {
+		err := zoneService.SetZone(dnsName, records)
+		if err != nil {
+			return err
+		}
+		s.servedZones[dnsName] = true
+	}
+	return nil
+}
+
+func (s *Service) applyHosts(apply func(*hosts.Params) error, ip string, hostList []string) error {
+	sort.Strings(hostList)
+	ipVar := ip
+	hostsVar := strings.Join(hostList, ",")
+	return apply(&hosts.Params{
+		IP:    &ipVar,
+		Hosts: &hostsVar,
+	})
+}
+
+// desiredHostIPsLocked works out the IP or IPv4 and IPv6 address pair each host
+// in the private zones should be mapped to.
+func (s *Service) desiredHostIPsLocked() map[string]string {
+	addresses := map[string]string{}
+	ipv6Addresses := map[string]string{}
+	aliases := map[string]string{}
+	for _, state := range s.zones {
+		if state.Zone.Visibility != visibilityPrivate {
+			continue
+		}
+		for _, rrset := range state.Rrsets {
+			if strings.HasPrefix(rrset.Name, "*") || len(rrset.Rrdatas) == 0 {
+				continue
+			}
+			switch rrset.Type {
+			case "A":
+				addresses[rrset.Name] = rrset.Rrdatas[0]
+			case "AAAA":
+				ipv6Addresses[rrset.Name] = rrset.Rrdatas[0]
+			case "CNAME":
+				aliases[rrset.Name] = canonicalName(rrset.Rrdatas[0])
+			}
+		}
+	}
+	// The hosts service accepts an IPv4 and IPv6 address pair
+	// as a comma-separated list.
+	for name, ip := range ipv6Addresses {
+		if ipv4, hasIPv4 := addresses[name]; hasIPv4 {
+			addresses[name] = fmt.Sprintf("%s,%s", ipv4, ip)
+		} else {
+			addresses[name] = ip
+		}
+	}
+
+	desired := map[string]string{}
+	for name, ip := range addresses {
+		desired[strings.TrimSuffix(name, ".")] = ip
+	}
+	for name, target := range aliases {
+		depth := 0
+		for depth < maxCNAMEDepth {
+			if ip, ok := addresses[target]; ok {
+				desired[strings.TrimSuffix(name, ".")] = ip
+				break
+			}
+			next, ok := aliases[target]
+			if !ok {
+				break
+			}
+			target = next
+			depth = depth + 1
+		}
+	}
+	return desired
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
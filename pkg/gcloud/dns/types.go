@@ -0,0 +1,125 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package dns
+
+import "encoding/json"
+
+// Cloud DNS is only provided as a REST API so the resources are defined here
+// with the same JSON representation as the dns/v1 API rather than as protos.
+
+// ManagedZone provides a zone that holds record sets for a DNS name.
+type ManagedZone struct {
+	Kind                    string                              `json:"kind"`
+	Name                    string                              `json:"name"`
+	DNSName                 string                              `json:"dnsName"`
+	Description             string                              `json:"description"`
+	ID                      string                              `json:"id,omitempty"`
+	NameServers             []string                            `json:"nameServers,omitempty"`
+	CreationTime            string                              `json:"creationTime,omitempty"`
+	Visibility              string                              `json:"visibility,omitempty"`
+	PrivateVisibilityConfig *ManagedZonePrivateVisibilityConfig `json:"privateVisibilityConfig,omitempty"`
+	Labels                  map[string]string                   `json:"labels,omitempty"`
+	// The configuration for features that are not emulated is kept as it is provided
+	// so clients that manage zones declaratively don't see changes that never happened.
+	DNSSECConfig       json.RawMessage `json:"dnssecConfig,omitempty"`
+	CloudLoggingConfig json.RawMessage `json:"cloudLoggingConfig,omitempty"`
+	ForwardingConfig   json.RawMessage `json:"forwardingConfig,omitempty"`
+	PeeringConfig      json.RawMessage `json:"peeringConfig,omitempty"`
+}
+
+// ManagedZonePrivateVisibilityConfig provides the networks
+// a private zone is visible to.
+type ManagedZonePrivateVisibilityConfig struct {
+	Kind     string                                       `json:"kind"`
+	Networks []*ManagedZonePrivateVisibilityConfigNetwork `json:"networks"`
+}
+
+// ManagedZonePrivateVisibilityConfigNetwork provides a network
+// a private zone is visible to.
+type ManagedZonePrivateVisibilityConfigNetwork struct {
+	Kind       string `json:"kind"`
+	NetworkURL string `json:"networkUrl"`
+}
+
+// ManagedZonesListResponse provides a page of managed zones.
+type ManagedZonesListResponse struct {
+	Kind          string         `json:"kind"`
+	ManagedZones  []*ManagedZone `json:"managedZones"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+// Operation provides the outcome of an update to a managed zone,
+// updates are applied straight away so operations are always done.
+type Operation struct {
+	Kind        string                `json:"kind"`
+	ID          string                `json:"id"`
+	StartTime   string                `json:"startTime"`
+	Status      string                `json:"status"`
+	Type        string                `json:"type"`
+	ZoneContext *OperationZoneContext `json:"zoneContext,omitempty"`
+}
+
+// OperationZoneContext provides a managed zone before and after an update.
+type OperationZoneContext struct {
+	OldValue *ManagedZone `json:"oldValue"`
+	NewValue *ManagedZone `json:"newValue"`
+}
+
+// ResourceRecordSet provides the records for a name and type in a managed zone.
+type ResourceRecordSet struct {
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int64    `json:"ttl"`
+	Rrdatas []string `json:"rrdatas"`
+}
+
+// ResourceRecordSetsListResponse provides a page of record sets.
+type ResourceRecordSetsListResponse struct {
+	Kind          string               `json:"kind"`
+	Rrsets        []*ResourceRecordSet `json:"rrsets"`
+	NextPageToken string               `json:"nextPageToken,omitempty"`
+}
+
+// ResourceRecordSetsDeleteResponse provides the response
+// for a record set that has been deleted.
+type ResourceRecordSetsDeleteResponse struct{}
+
+// Change provides an atomic update to the record sets of a managed zone.
+type Change struct {
+	Kind      string               `json:"kind"`
+	ID        string               `json:"id,omitempty"`
+	Additions []*ResourceRecordSet `json:"additions,omitempty"`
+	Deletions []*ResourceRecordSet `json:"deletions,omitempty"`
+	StartTime string               `json:"startTime,omitempty"`
+	Status    string               `json:"status,omitempty"`
+}
+
+// ChangesListResponse provides a page of changes.
+type ChangesListResponse struct {
+	Kind          string    `json:"kind"`
+	Changes       []*Change `json:"changes"`
+	NextPageToken string    `json:"nextPageToken,omitempty"`
+}
+
+const (
+	kindManagedZone                    = "dns#managedZone"
+	kindManagedZonesListResponse       = "dns#managedZonesListResponse"
+	kindPrivateVisibilityConfig        = "dns#managedZonePrivateVisibilityConfig"
+	kindPrivateVisibilityConfigNetwork = "dns#managedZonePrivateVisibilityConfigNetwork"
+	kindOperation                      = "dns#operation"
+	kindResourceRecordSet              = "dns#resourceRecordSet"
+	kindResourceRecordSetsListResponse = "dns#resourceRecordSetsListResponse"
+	kindChange                         = "dns#change"
+	kindChangesListResponse            = "dns#changesListResponse"
+	visibilityPublic                   = "public"
+	visibilityPrivate                  = "private"
+	statusDone                         = "done"
+	operationTypeUpdate                = "UPDATE"
+)
@@ -0,0 +1,155 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+)
+
+// IAMCredentials provides a gRPC IAM Service Account Credentials service
+// that issues short-lived credentials signed by the emulator's token service.
+type IAMCredentials struct {
+	tokens *tokens.Service
+	now    func() time.Time
+}
+
+const (
+	iamCredentialsServiceAccountPrefix = "projects/-/serviceAccounts/"
+	iamCredentialsMaxTokenLifetime     = time.Hour
+	iamCredentialsMaxSignedJWTLifetime = 12 * time.Hour
+)
+
+var (
+	iamCredentialsLocalHost = "iamcredentials.googleapis.local"
+)
+
+// NewIAMCredentials creates an instance of the Cloud::1 IAM Credentials implementation.
+func NewIAMCredentials(tokenService *tokens.Service, ip string, hostsService hosts.Service) (*IAMCredentials, error) {
+	err := hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &iamCredentialsLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &IAMCredentials{
+		tokens: tokenService,
+		now:    time.Now,
+	}, nil
+}
+
+// GenerateAccessToken deals with generating an OAuth 2.0 access token for a service account.
+func (s *IAMCredentials) GenerateAccessToken(ctx context.Context, req *credentialspb.GenerateAccessTokenRequest) (*credentialspb.GenerateAccessTokenResponse, error) {
+	serviceAccount, err := serviceAccountFromCredentialsName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Scope) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Scope must be provided")
+	}
+	lifetime := tokens.DefaultLifetime
+	if req.Lifetime != nil {
+		lifetime = req.Lifetime.AsDuration()
+		if lifetime <= 0 || lifetime > iamCredentialsMaxTokenLifetime {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"The lifetime must be between 1 and %d seconds", int64(iamCredentialsMaxTokenLifetime.Seconds()),
+			)
+		}
+	}
+	token, err := s.tokens.AccessToken(serviceAccount, req.Scope, lifetime)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to generate access token: %s", err)
+	}
+	return &credentialspb.GenerateAccessTokenResponse{
+		AccessToken: token.Value,
+		ExpireTime:  timestamppb.New(token.Expiry),
+	}, nil
+}
+
+// GenerateIdToken deals with generating an OpenID Connect ID token for a service account.
+func (s *IAMCredentials) GenerateIdToken(ctx context.Context, req *credentialspb.GenerateIdTokenRequest) (*credentialspb.GenerateIdTokenResponse, error) {
+	serviceAccount, err := serviceAccountFromCredentialsName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Audience == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Audience must be provided")
+	}
+	token, err := s.tokens.IDToken(serviceAccount, req.Audience, req.IncludeEmail, tokens.DefaultLifetime)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to generate ID token: %s", err)
+	}
+	return &credentialspb.GenerateIdTokenResponse{
+		Token: token.Value,
+	}, nil
+}
+
+// SignBlob is not supported as the emulator only signs JWTs.
+func (s *IAMCredentials) SignBlob(ctx context.Context, req *credentialspb.SignBlobRequest) (*credentialspb.SignBlobResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SignBlob not implemented")
+}
+
+// SignJwt deals with signing the provided JWT claims with the emulator's signing key,
+// the resulting JWT can be verified with the keys served by the OAuth2 JWKS endpoint.
+func (s *IAMCredentials) SignJwt(ctx context.Context, req *credentialspb.SignJwtRequest) (*credentialspb.SignJwtResponse, error) {
+	_, err := serviceAccountFromCredentialsName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	err = json.Unmarshal([]byte(req.Payload), &claims)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "The payload must be a JSON object: %s", err)
+	}
+	if exp, hasExpiry := claims["exp"]; hasExpiry {
+		expiry, isNumber := exp.(float64)
+		if !isNumber {
+			return nil, status.Errorf(codes.InvalidArgument, "The exp claim must be a number")
+		}
+		if time.Unix(int64(expiry), 0).After(s.now().Add(iamCredentialsMaxSignedJWTLifetime)) {
+			return nil, status.Errorf(codes.InvalidArgument, "The exp claim must be at most 12 hours in the future")
+		}
+	}
+	signedJWT, err := s.tokens.Sign(json.RawMessage(req.Payload))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to sign JWT: %s", err)
+	}
+	return &credentialspb.SignJwtResponse{
+		KeyId:     s.tokens.KeyID(),
+		SignedJwt: signedJWT,
+	}, nil
+}
+
+// serviceAccountFromCredentialsName extracts the service account email from a
+// resource name in the `projects/-/serviceAccounts/{email}` format.
+func serviceAccountFromCredentialsName(name string) (string, error) {
+	if !strings.HasPrefix(name, iamCredentialsServiceAccountPrefix) {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			"Name must be in the format projects/-/serviceAccounts/{ACCOUNT_EMAIL_OR_UNIQUEID}",
+		)
+	}
+	serviceAccount := strings.TrimPrefix(name, iamCredentialsServiceAccountPrefix)
+	if !strings.Contains(serviceAccount, "@") || strings.Contains(serviceAccount, "/") {
+		return "", status.Errorf(codes.NotFound, "Service account %s could not be found", serviceAccount)
+	}
+	return serviceAccount, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	. "gopkg.in/check.v1"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+)
+
+type IAMCredentialsSuite struct {
+	tokens      *tokens.Service
+	credentials *IAMCredentials
+}
+
+var _ = Suite(&IAMCredentialsSuite{})
+
+const testCredentialsServiceAccount = "worker@test-project.iam.gserviceaccount.com"
+
+func (s *IAMCredentialsSuite) SetUpTest(c *C) {
+	tokenService, err := tokens.New("/data/gcloud/tokens", afero.NewMemMapFs())
+	c.Assert(err, IsNil)
+	s.tokens = tokenService
+	credentials, err := NewIAMCredentials(tokenService, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+	s.credentials = credentials
+}
+
+func (s *IAMCredentialsSuite) Test_generates_access_tokens_for_the_service_account(c *C) {
+	response, err := s.credentials.GenerateAccessToken(context.Background(), &credentialspb.GenerateAccessTokenRequest{
+		Name:     "projects/-/serviceAccounts/" + testCredentialsServiceAccount,
+		Scope:    []string{"https://www.googleapis.com/auth/pubsub"},
+		Lifetime: durationpb.New(10 * time.Minute),
+	})
+	c.Assert(err, IsNil)
+	claims, err := s.tokens.Validate(response.AccessToken)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testCredentialsServiceAccount)
+	c.Assert(claims.Scope, Equals, "https://www.googleapis.com/auth/pubsub")
+	c.Assert(response.ExpireTime.AsTime().Unix(), Equals, claims.Expiry)
+
+	_, err = s.credentials.GenerateAccessToken(context.Background(), &credentialspb.GenerateAccessTokenRequest{
+		Name:     "projects/-/serviceAccounts/" + testCredentialsServiceAccount,
+		Scope:    []string{tokens.CloudPlatformScope},
+		Lifetime: durationpb.New(2 * time.Hour),
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+}
+
+func (s *IAMCredentialsSuite) Test_generates_id_tokens_for_the_requested_audience(c *C) {
+	response, err := s.credentials.GenerateIdToken(context.Background(), &credentialspb.GenerateIdTokenRequest{
+		Name:         "projects/-/serviceAccounts/" + testCredentialsServiceAccount,
+		Audience:     "https://backend.local",
+		IncludeEmail: true,
+	})
+	c.Assert(err, IsNil)
+	claims, err := s.tokens.Validate(response.Token)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Audience, Equals, "https://backend.local")
+	c.Assert(claims.Email, Equals, testCredentialsServiceAccount)
+	c.Assert(claims.TokenUse, Equals, tokens.TokenUseID)
+}
+
+func (s *IAMCredentialsSuite) Test_signs_jwts_with_the_emulator_key(c *C) {
+	payload := fmt.Sprintf(
+		`{"iss":%q,"aud":"https://backend.local","exp":%d}`,
+		testCredentialsServiceAccount, time.Now().Add(time.Hour).Unix(),
+	)
+	response, err := s.credentials.SignJwt(context.Background(), &credentialspb.SignJwtRequest{
+		Name:    "projects/-/serviceAccounts/" + testCredentialsServiceAccount,
+		Payload: payload,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(response.KeyId, Equals, s.tokens.KeyID())
+	signedPayload, err := s.tokens.Verify(response.SignedJwt)
+	c.Assert(err, IsNil)
+	claims := map[string]interface{}{}
+	c.Assert(json.Unmarshal(signedPayload, &claims), IsNil)
+	c.Assert(claims["aud"], Equals, "https://backend.local")
+
+	_, err = s.credentials.SignJwt(context.Background(), &credentialspb.SignJwtRequest{
+		Name:    "projects/-/serviceAccounts/" + testCredentialsServiceAccount,
+		Payload: fmt.Sprintf(`{"exp":%d}`, time.Now().Add(13*time.Hour).Unix()),
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+}
+
+func (s *IAMCredentialsSuite) Test_rejects_names_without_the_project_wildcard(c *C) {
+	_, err := s.credentials.GenerateIdToken(context.Background(), &credentialspb.GenerateIdTokenRequest{
+		Name:     "projects/test-project/serviceAccounts/" + testCredentialsServiceAccount,
+		Audience: "https://backend.local",
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	c.Assert(strings.Contains(err.Error(), "projects/-/serviceAccounts"), Equals, true)
+}
@@ -0,0 +1,1075 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// KMS provides a gRPC Cloud KMS service that carries out real
+// cryptographic operations with key material persisted to the configured
+// file system.
+type KMS struct {
+	mu          sync.Mutex
+	dataRootDir string
+	fs          afero.Fs
+	now         func() time.Time
+}
+
+const (
+	kmsMaxPlaintextSize            = 64 * 1024
+	kmsMaxAdditionalDataSize       = 64 * 1024
+	kmsMinRandomBytes              = 8
+	kmsMaxRandomBytes              = 1024
+	kmsMinRotationPeriod           = 24 * time.Hour
+	kmsDefaultDestroyScheduledTime = 24 * time.Hour
+	kmsKeyMaterialFile             = "material"
+)
+
+var (
+	kmsLocalHost = "cloudkms.googleapis.local"
+	kmsIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,63}$`)
+)
+
+// NewKMS creates an instance of the Cloud::1 KMS implementation.
+func NewKMS(dataRootDir string, fs afero.Fs, ip string, hostsService hosts.Service) (*KMS, error) {
+	err := fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &kmsLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KMS{
+		dataRootDir: dataRootDir,
+		fs:          fs,
+		now:         time.Now,
+	}, nil
+}
+
+// ListKeyRings deals with listing the key rings in a project location.
+func (k *KMS) ListKeyRings(ctx context.Context, req *kmspb.ListKeyRingsRequest) (*kmspb.ListKeyRingsResponse, error) {
+	if !isValidKMSName(req.Parent, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Parent)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names, err := k.listChildNamesLocked(req.Parent, "keyRings")
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := pagination.Page(len(names), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &kmspb.ListKeyRingsResponse{
+		KeyRings:      []*kmspb.KeyRing{},
+		NextPageToken: nextPageToken,
+		TotalSize:     int32(len(names)),
+	}
+	for _, name := range names[start:end] {
+		keyRing := &kmspb.KeyRing{}
+		err = k.readResourceLocked(name, "keyRing.json", keyRing)
+		if err != nil {
+			return nil, err
+		}
+		response.KeyRings = append(response.KeyRings, keyRing)
+	}
+	return response, nil
+}
+
+// ListCryptoKeys deals with listing the crypto keys in a key ring.
+func (k *KMS) ListCryptoKeys(ctx context.Context, req *kmspb.ListCryptoKeysRequest) (*kmspb.ListCryptoKeysResponse, error) {
+	if !isValidKMSName(req.Parent, "keyRings") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid key ring name: %s", req.Parent)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names, err := k.listChildNamesLocked(req.Parent, "cryptoKeys")
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := pagination.Page(len(names), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &kmspb.ListCryptoKeysResponse{
+		CryptoKeys:    []*kmspb.CryptoKey{},
+		NextPageToken: nextPageToken,
+		TotalSize:     int32(len(names)),
+	}
+	for _, name := range names[start:end] {
+		key, err := k.getCryptoKeyLocked(name)
+		if err != nil {
+			return nil, err
+		}
+		response.CryptoKeys = append(response.CryptoKeys, key)
+	}
+	return response, nil
+}
+
+// ListCryptoKeyVersions deals with listing the versions of a crypto key
+// in the order they were created.
+func (k *KMS) ListCryptoKeyVersions(ctx context.Context, req *kmspb.ListCryptoKeyVersionsRequest) (*kmspb.ListCryptoKeyVersionsResponse, error) {
+	if !isValidKMSName(req.Parent, "cryptoKeys") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid crypto key name: %s", req.Parent)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names, err := k.listVersionNamesLocked(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := pagination.Page(len(names), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &kmspb.ListCryptoKeyVersionsResponse{
+		CryptoKeyVersions: []*kmspb.CryptoKeyVersion{},
+		NextPageToken:     nextPageToken,
+		TotalSize:         int32(len(names)),
+	}
+	for _, name := range names[start:end] {
+		version, err := k.getVersionLocked(name)
+		if err != nil {
+			return nil, err
+		}
+		response.CryptoKeyVersions = append(response.CryptoKeyVersions, version)
+	}
+	return response, nil
+}
+
+// ListImportJobs deals with listing the import jobs in a key ring.
+func (*KMS) ListImportJobs(context.Context, *kmspb.ListImportJobsRequest) (*kmspb.ListImportJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListImportJobs not implemented")
+}
+
+// GetKeyRing deals with retrieving a specified key ring.
+func (k *KMS) GetKeyRing(ctx context.Context, req *kmspb.GetKeyRingRequest) (*kmspb.KeyRing, error) {
+	if !isValidKMSName(req.Name, "keyRings") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid key ring name: %s", req.Name)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keyRing := &kmspb.KeyRing{}
+	err := k.readResourceLocked(req.Name, "keyRing.json", keyRing)
+	if err != nil {
+		return nil, err
+	}
+	return keyRing, nil
+}
+
+// GetCryptoKey deals with retrieving a specified crypto key along with
+// its primary version.
+func (k *KMS) GetCryptoKey(ctx context.Context, req *kmspb.GetCryptoKeyRequest) (*kmspb.CryptoKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.getCryptoKeyLocked(req.Name)
+}
+
+// GetCryptoKeyVersion deals with retrieving a specified crypto key version.
+func (k *KMS) GetCryptoKeyVersion(ctx context.Context, req *kmspb.GetCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.getVersionLocked(req.Name)
+}
+
+// GetPublicKey deals with retrieving the PEM encoded public key
+// for an asymmetric crypto key version.
+func (k *KMS) GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest) (*kmspb.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, _, err := k.getUsableVersionLocked(
+		req.Name, kmspb.CryptoKey_ASYMMETRIC_SIGN, kmspb.CryptoKey_ASYMMETRIC_DECRYPT,
+	)
+	if err != nil {
+		return nil, err
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := kmsPublicKeyPEM(material)
+	if err != nil {
+		return nil, err
+	}
+	return &kmspb.PublicKey{
+		Pem:             publicKeyPEM,
+		Algorithm:       version.Algorithm,
+		PemCrc32C:       kmsCRC32C([]byte(publicKeyPEM)),
+		Name:            version.Name,
+		ProtectionLevel: version.ProtectionLevel,
+	}, nil
+}
+
+// GetImportJob deals with retrieving a specified import job.
+func (*KMS) GetImportJob(context.Context, *kmspb.GetImportJobRequest) (*kmspb.ImportJob, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetImportJob not implemented")
+}
+
+// CreateKeyRing deals with creating a new key ring in a project location.
+func (k *KMS) CreateKeyRing(ctx context.Context, req *kmspb.CreateKeyRingRequest) (*kmspb.KeyRing, error) {
+	if !isValidKMSName(req.Parent, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Parent)
+	}
+	if !kmsIDPattern.MatchString(req.KeyRingId) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid key ring ID: %s", req.KeyRingId)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	name := fmt.Sprintf("%s/keyRings/%s", req.Parent, req.KeyRingId)
+	exists, err := k.resourceExistsLocked(name, "keyRing.json")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, status.Errorf(codes.AlreadyExists, "KeyRing %s already exists", name)
+	}
+	keyRing := &kmspb.KeyRing{
+		Name:       name,
+		CreateTime: timestamppb.New(k.now()),
+	}
+	err = k.writeResourceLocked(name, "keyRing.json", keyRing)
+	if err != nil {
+		return nil, err
+	}
+	return keyRing, nil
+}
+
+// CreateCryptoKey deals with creating a new crypto key in a key ring,
+// an initial version is created unless the request asks to skip it.
+func (k *KMS) CreateCryptoKey(ctx context.Context, req *kmspb.CreateCryptoKeyRequest) (*kmspb.CryptoKey, error) {
+	if !isValidKMSName(req.Parent, "keyRings") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid key ring name: %s", req.Parent)
+	}
+	if !kmsIDPattern.MatchString(req.CryptoKeyId) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid crypto key ID: %s", req.CryptoKeyId)
+	}
+	if req.CryptoKey == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A crypto key must be provided")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keyRingExists, err := k.resourceExistsLocked(req.Parent, "keyRing.json")
+	if err != nil {
+		return nil, err
+	}
+	if !keyRingExists {
+		return nil, status.Errorf(codes.NotFound, "KeyRing %s not found", req.Parent)
+	}
+	name := fmt.Sprintf("%s/cryptoKeys/%s", req.Parent, req.CryptoKeyId)
+	exists, err := k.resourceExistsLocked(name, "cryptoKey.json")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, status.Errorf(codes.AlreadyExists, "CryptoKey %s already exists", name)
+	}
+
+	key := proto.Clone(req.CryptoKey).(*kmspb.CryptoKey)
+	key.Name = name
+	key.Primary = nil
+	key.CreateTime = timestamppb.New(k.now())
+	err = k.applyCryptoKeyDefaults(key)
+	if err != nil {
+		return nil, err
+	}
+	if !req.SkipInitialVersionCreation && !key.ImportOnly {
+		version, err := k.createVersionLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		if key.Purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT {
+			key.Primary = version
+		}
+	}
+	err = k.writeCryptoKeyLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CreateCryptoKeyVersion deals with creating a new version of a crypto key
+// using the key's version template, the new version does not become the primary.
+func (k *KMS) CreateCryptoKeyVersion(ctx context.Context, req *kmspb.CreateCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	if !isValidKMSName(req.Parent, "cryptoKeys") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid crypto key name: %s", req.Parent)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, err := k.getCryptoKeyLocked(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	if key.ImportOnly {
+		return nil, status.Errorf(codes.FailedPrecondition, "CryptoKey %s only accepts imported versions", key.Name)
+	}
+	return k.createVersionLocked(key)
+}
+
+// ImportCryptoKeyVersion deals with importing key material into a new crypto key version.
+func (*KMS) ImportCryptoKeyVersion(context.Context, *kmspb.ImportCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportCryptoKeyVersion not implemented")
+}
+
+// CreateImportJob deals with creating a new import job in a key ring.
+func (*KMS) CreateImportJob(context.Context, *kmspb.CreateImportJobRequest) (*kmspb.ImportJob, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateImportJob not implemented")
+}
+
+// UpdateCryptoKey deals with updating the labels, rotation schedule
+// and version template of a crypto key.
+func (k *KMS) UpdateCryptoKey(ctx context.Context, req *kmspb.UpdateCryptoKeyRequest) (*kmspb.CryptoKey, error) {
+	if req.CryptoKey == nil || req.UpdateMask == nil || len(req.UpdateMask.Paths) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "A crypto key and update mask must be provided")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, err := k.getCryptoKeyLocked(req.CryptoKey.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range req.UpdateMask.Paths {
+		switch field {
+		case "labels":
+			key.Labels = req.CryptoKey.Labels
+		case "rotation_period", "rotationPeriod":
+			key.RotationSchedule = req.CryptoKey.RotationSchedule
+		case "next_rotation_time", "nextRotationTime":
+			key.NextRotationTime = req.CryptoKey.NextRotationTime
+		case "version_template", "versionTemplate":
+			key.VersionTemplate = req.CryptoKey.VersionTemplate
+		case "version_template.algorithm", "versionTemplate.algorithm":
+			if key.VersionTemplate == nil {
+				key.VersionTemplate = &kmspb.CryptoKeyVersionTemplate{}
+			}
+			key.VersionTemplate.Algorithm = req.CryptoKey.GetVersionTemplate().GetAlgorithm()
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Update mask must only contain mutable fields, %s can not be updated", field)
+		}
+	}
+	err = k.applyCryptoKeyDefaults(key)
+	if err != nil {
+		return nil, err
+	}
+	err = k.writeCryptoKeyLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// UpdateCryptoKeyVersion deals with enabling or disabling a crypto key version.
+func (k *KMS) UpdateCryptoKeyVersion(ctx context.Context, req *kmspb.UpdateCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	if req.CryptoKeyVersion == nil || req.UpdateMask == nil || len(req.UpdateMask.Paths) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "A crypto key version and update mask must be provided")
+	}
+	for _, field := range req.UpdateMask.Paths {
+		if field != "state" {
+			return nil, status.Errorf(codes.InvalidArgument, "Update mask must only contain mutable fields, %s can not be updated", field)
+		}
+	}
+	newState := req.CryptoKeyVersion.State
+	if newState != kmspb.CryptoKeyVersion_ENABLED && newState != kmspb.CryptoKeyVersion_DISABLED {
+		return nil, status.Errorf(codes.InvalidArgument, "The state of a crypto key version can only be updated to ENABLED or DISABLED")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, err := k.getVersionLocked(req.CryptoKeyVersion.Name)
+	if err != nil {
+		return nil, err
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED && version.State != kmspb.CryptoKeyVersion_DISABLED {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"%s can not be updated as its current state is %s", version.Name, version.State,
+		)
+	}
+	version.State = newState
+	err = k.writeResourceLocked(version.Name, "version.json", version)
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// UpdateCryptoKeyPrimaryVersion deals with rotating a symmetric crypto key
+// to use the provided version for new encryption requests.
+func (k *KMS) UpdateCryptoKeyPrimaryVersion(ctx context.Context, req *kmspb.UpdateCryptoKeyPrimaryVersionRequest) (*kmspb.CryptoKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, err := k.getCryptoKeyLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if key.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+		return nil, status.Errorf(codes.FailedPrecondition, "Only ENCRYPT_DECRYPT crypto keys have a primary version")
+	}
+	version, err := k.getVersionLocked(fmt.Sprintf("%s/cryptoKeyVersions/%s", key.Name, req.CryptoKeyVersionId))
+	if err != nil {
+		return nil, err
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not enabled, current state is %s", version.Name, version.State)
+	}
+	key.Primary = version
+	err = k.writeCryptoKeyLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DestroyCryptoKeyVersion deals with scheduling a crypto key version for destruction,
+// the key material is removed once the key's destroy scheduled duration has passed.
+func (k *KMS) DestroyCryptoKeyVersion(ctx context.Context, req *kmspb.DestroyCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, err := k.getVersionLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED && version.State != kmspb.CryptoKeyVersion_DISABLED {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"%s can not be destroyed as its current state is %s", version.Name, version.State,
+		)
+	}
+	key := &kmspb.CryptoKey{}
+	err = k.readResourceLocked(kmsParentName(version.Name), "cryptoKey.json", key)
+	if err != nil {
+		return nil, err
+	}
+	version.State = kmspb.CryptoKeyVersion_DESTROY_SCHEDULED
+	version.DestroyTime = timestamppb.New(k.now().Add(key.DestroyScheduledDuration.AsDuration()))
+	err = k.writeResourceLocked(version.Name, "version.json", version)
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// RestoreCryptoKeyVersion deals with cancelling the scheduled destruction
+// of a crypto key version, restored versions are disabled.
+func (k *KMS) RestoreCryptoKeyVersion(ctx context.Context, req *kmspb.RestoreCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, err := k.getVersionLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if version.State != kmspb.CryptoKeyVersion_DESTROY_SCHEDULED {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"%s can not be restored as its current state is %s", version.Name, version.State,
+		)
+	}
+	version.State = kmspb.CryptoKeyVersion_DISABLED
+	version.DestroyTime = nil
+	err = k.writeResourceLocked(version.Name, "version.json", version)
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// Encrypt deals with encrypting data with the primary version of a crypto key
+// or with a specific version when a version name is provided.
+func (k *KMS) Encrypt(ctx context.Context, req *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
+	if len(req.Plaintext) > kmsMaxPlaintextSize {
+		return nil, status.Errorf(codes.InvalidArgument, "The plaintext must not exceed %d bytes", kmsMaxPlaintextSize)
+	}
+	if len(req.AdditionalAuthenticatedData) > kmsMaxAdditionalDataSize {
+		return nil, status.Errorf(codes.InvalidArgument, "The additional authenticated data must not exceed %d bytes", kmsMaxAdditionalDataSize)
+	}
+	verifiedPlaintext, err := verifyKMSCRC32C("plaintext_crc32c", req.Plaintext, req.PlaintextCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	verifiedAAD, err := verifyKMSCRC32C(
+		"additional_authenticated_data_crc32c", req.AdditionalAuthenticatedData, req.AdditionalAuthenticatedDataCrc32C,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	versionName := req.Name
+	if isValidKMSName(req.Name, "cryptoKeys") {
+		key, err := k.getCryptoKeyLocked(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		if key.Primary == nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "CryptoKey %s does not have a primary version", key.Name)
+		}
+		versionName = key.Primary.Name
+	}
+	version, _, err := k.getUsableVersionLocked(versionName, kmspb.CryptoKey_ENCRYPT_DECRYPT)
+	if err != nil {
+		return nil, err
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := encryptKMSSymmetric(material, kmsVersionNumber(version.Name), req.Plaintext, req.AdditionalAuthenticatedData)
+	if err != nil {
+		return nil, err
+	}
+	return &kmspb.EncryptResponse{
+		Name:                    version.Name,
+		Ciphertext:              ciphertext,
+		CiphertextCrc32C:        kmsCRC32C(ciphertext),
+		VerifiedPlaintextCrc32C: verifiedPlaintext,
+		VerifiedAdditionalAuthenticatedDataCrc32C: verifiedAAD,
+		ProtectionLevel: version.ProtectionLevel,
+	}, nil
+}
+
+// Decrypt deals with decrypting ciphertext produced by Encrypt, the version
+// used for decryption is taken from the ciphertext.
+func (k *KMS) Decrypt(ctx context.Context, req *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
+	if !isValidKMSName(req.Name, "cryptoKeys") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid crypto key name: %s", req.Name)
+	}
+	_, err := verifyKMSCRC32C("ciphertext_crc32c", req.Ciphertext, req.CiphertextCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	_, err = verifyKMSCRC32C(
+		"additional_authenticated_data_crc32c", req.AdditionalAuthenticatedData, req.AdditionalAuthenticatedDataCrc32C,
+	)
+	if err != nil {
+		return nil, err
+	}
+	versionNumber, err := kmsCiphertextVersion(req.Ciphertext)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Decryption failed: %s", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, err := k.getCryptoKeyLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	versionName := fmt.Sprintf("%s/cryptoKeyVersions/%d", key.Name, versionNumber)
+	exists, err := k.resourceExistsLocked(versionName, "version.json")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, status.Errorf(codes.InvalidArgument, "Decryption failed: %s", errKMSInvalidCiphertext)
+	}
+	version, _, err := k.getUsableVersionLocked(versionName, kmspb.CryptoKey_ENCRYPT_DECRYPT)
+	if err != nil {
+		return nil, err
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptKMSSymmetric(material, req.Ciphertext, req.AdditionalAuthenticatedData)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Decryption failed: %s", err)
+	}
+	return &kmspb.DecryptResponse{
+		Plaintext:       plaintext,
+		PlaintextCrc32C: kmsCRC32C(plaintext),
+		UsedPrimary:     key.Primary != nil && key.Primary.Name == version.Name,
+		ProtectionLevel: version.ProtectionLevel,
+	}, nil
+}
+
+// AsymmetricSign deals with signing a digest, or data that is hashed
+// with the algorithm's digest, using an asymmetric signing key version.
+func (k *KMS) AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest) (*kmspb.AsymmetricSignResponse, error) {
+	if req.Digest != nil && len(req.Data) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Only one of digest or data can be provided")
+	}
+	verifiedDigest, err := verifyKMSCRC32C("digest_crc32c", kmsProvidedDigest(req.Digest), req.DigestCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	verifiedData, err := verifyKMSCRC32C("data_crc32c", req.Data, req.DataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, spec, err := k.getUsableVersionLocked(req.Name, kmspb.CryptoKey_ASYMMETRIC_SIGN)
+	if err != nil {
+		return nil, err
+	}
+	var toSign []byte
+	switch {
+	case spec.hash == 0:
+		// Raw PKCS#1 signing operates on the provided data directly.
+		if len(req.Data) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Data must be provided for %s", version.Algorithm)
+		}
+		toSign = req.Data
+	case req.Digest != nil:
+		toSign, err = kmsDigestBytes(spec.hash, req.Digest)
+		if err != nil {
+			return nil, err
+		}
+	case len(req.Data) > 0:
+		digest := newKMSHash(spec.hash)
+		digest.Write(req.Data)
+		toSign = digest.Sum(nil)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "Either a digest or data must be provided")
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signKMSDigest(spec, material, toSign)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Signing failed: %s", err)
+	}
+	return &kmspb.AsymmetricSignResponse{
+		Signature:            signature,
+		SignatureCrc32C:      kmsCRC32C(signature),
+		VerifiedDigestCrc32C: verifiedDigest,
+		Name:                 version.Name,
+		VerifiedDataCrc32C:   verifiedData,
+		ProtectionLevel:      version.ProtectionLevel,
+	}, nil
+}
+
+// AsymmetricDecrypt deals with decrypting data that was encrypted with
+// the public key of an asymmetric decryption key version.
+func (k *KMS) AsymmetricDecrypt(ctx context.Context, req *kmspb.AsymmetricDecryptRequest) (*kmspb.AsymmetricDecryptResponse, error) {
+	verifiedCiphertext, err := verifyKMSCRC32C("ciphertext_crc32c", req.Ciphertext, req.CiphertextCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, spec, err := k.getUsableVersionLocked(req.Name, kmspb.CryptoKey_ASYMMETRIC_DECRYPT)
+	if err != nil {
+		return nil, err
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptKMSAsymmetric(spec, material, req.Ciphertext)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Decryption failed: %s", err)
+	}
+	return &kmspb.AsymmetricDecryptResponse{
+		Plaintext:                plaintext,
+		PlaintextCrc32C:          kmsCRC32C(plaintext),
+		VerifiedCiphertextCrc32C: verifiedCiphertext,
+		ProtectionLevel:          version.ProtectionLevel,
+	}, nil
+}
+
+// MacSign deals with producing a MAC tag for the provided data.
+func (k *KMS) MacSign(ctx context.Context, req *kmspb.MacSignRequest) (*kmspb.MacSignResponse, error) {
+	verifiedData, err := verifyKMSCRC32C("data_crc32c", req.Data, req.DataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, _, err := k.getUsableVersionLocked(req.Name, kmspb.CryptoKey_MAC)
+	if err != nil {
+		return nil, err
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	mac := kmsMAC(material, req.Data)
+	return &kmspb.MacSignResponse{
+		Name:               version.Name,
+		Mac:                mac,
+		MacCrc32C:          kmsCRC32C(mac),
+		VerifiedDataCrc32C: verifiedData,
+		ProtectionLevel:    version.ProtectionLevel,
+	}, nil
+}
+
+// MacVerify deals with checking a MAC tag against the provided data.
+func (k *KMS) MacVerify(ctx context.Context, req *kmspb.MacVerifyRequest) (*kmspb.MacVerifyResponse, error) {
+	verifiedData, err := verifyKMSCRC32C("data_crc32c", req.Data, req.DataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	verifiedMac, err := verifyKMSCRC32C("mac_crc32c", req.Mac, req.MacCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	version, _, err := k.getUsableVersionLocked(req.Name, kmspb.CryptoKey_MAC)
+	if err != nil {
+		return nil, err
+	}
+	material, err := k.readKeyMaterialLocked(version.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &kmspb.MacVerifyResponse{
+		Name:                     version.Name,
+		Success:                  hmac.Equal(kmsMAC(material, req.Data), req.Mac),
+		VerifiedDataCrc32C:       verifiedData,
+		VerifiedMacCrc32C:        verifiedMac,
+		VerifiedSuccessIntegrity: true,
+		ProtectionLevel:          version.ProtectionLevel,
+	}, nil
+}
+
+// GenerateRandomBytes deals with producing random bytes for a location.
+func (k *KMS) GenerateRandomBytes(ctx context.Context, req *kmspb.GenerateRandomBytesRequest) (*kmspb.GenerateRandomBytesResponse, error) {
+	if !isValidKMSName(req.Location, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Location)
+	}
+	if req.LengthBytes < kmsMinRandomBytes || req.LengthBytes > kmsMaxRandomBytes {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"The number of bytes must be between %d and %d", kmsMinRandomBytes, kmsMaxRandomBytes,
+		)
+	}
+	data, err := randomKMSBytes(int(req.LengthBytes))
+	if err != nil {
+		return nil, err
+	}
+	return &kmspb.GenerateRandomBytesResponse{
+		Data:       data,
+		DataCrc32C: kmsCRC32C(data),
+	}, nil
+}
+
+func (k *KMS) applyCryptoKeyDefaults(key *kmspb.CryptoKey) error {
+	if key.Purpose == kmspb.CryptoKey_CRYPTO_KEY_PURPOSE_UNSPECIFIED {
+		return status.Errorf(codes.InvalidArgument, "A crypto key purpose must be provided")
+	}
+	if key.VersionTemplate == nil {
+		key.VersionTemplate = &kmspb.CryptoKeyVersionTemplate{}
+	}
+	switch key.VersionTemplate.ProtectionLevel {
+	case kmspb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED:
+		key.VersionTemplate.ProtectionLevel = kmspb.ProtectionLevel_SOFTWARE
+	case kmspb.ProtectionLevel_SOFTWARE, kmspb.ProtectionLevel_HSM:
+	default:
+		return status.Errorf(
+			codes.InvalidArgument,
+			"Protection level %s is not supported by the emulator", key.VersionTemplate.ProtectionLevel,
+		)
+	}
+	if key.VersionTemplate.Algorithm == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+		if key.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+			return status.Errorf(codes.InvalidArgument, "An algorithm must be provided for %s crypto keys", key.Purpose)
+		}
+		key.VersionTemplate.Algorithm = kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION
+	}
+	spec, err := getKMSAlgorithm(key.VersionTemplate.Algorithm)
+	if err != nil {
+		return err
+	}
+	if spec.purpose != key.Purpose {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"Algorithm %s can not be used for %s crypto keys", key.VersionTemplate.Algorithm, key.Purpose,
+		)
+	}
+	if rotationPeriod := key.GetRotationPeriod(); rotationPeriod != nil {
+		if key.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+			return status.Errorf(codes.InvalidArgument, "Only ENCRYPT_DECRYPT crypto keys can be rotated automatically")
+		}
+		if rotationPeriod.AsDuration() < kmsMinRotationPeriod {
+			return status.Errorf(codes.InvalidArgument, "The rotation period must be at least %s", kmsMinRotationPeriod)
+		}
+		if key.NextRotationTime == nil {
+			key.NextRotationTime = timestamppb.New(k.now().Add(rotationPeriod.AsDuration()))
+		}
+	}
+	if key.DestroyScheduledDuration == nil {
+		key.DestroyScheduledDuration = durationpb.New(kmsDefaultDestroyScheduledTime)
+	}
+	return nil
+}
+
+func (k *KMS) createVersionLocked(key *kmspb.CryptoKey) (*kmspb.CryptoKeyVersion, error) {
+	spec, err := getKMSAlgorithm(key.VersionTemplate.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	material, err := generateKMSKeyMaterial(spec)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := k.listVersionNamesLocked(key.Name)
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.New(k.now())
+	version := &kmspb.CryptoKeyVersion{
+		Name:            fmt.Sprintf("%s/cryptoKeyVersions/%d", key.Name, len(existing)+1),
+		State:           kmspb.CryptoKeyVersion_ENABLED,
+		ProtectionLevel: key.VersionTemplate.ProtectionLevel,
+		Algorithm:       key.VersionTemplate.Algorithm,
+		CreateTime:      now,
+		GenerateTime:    now,
+	}
+	err = k.fs.MkdirAll(k.resourceDir(version.Name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = afero.WriteFile(k.fs, path.Join(k.resourceDir(version.Name), kmsKeyMaterialFile), material, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = k.writeResourceLocked(version.Name, "version.json", version)
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// getCryptoKeyLocked loads a crypto key, rotating it first when automatic
+// rotation is due, and populates the primary version.
+func (k *KMS) getCryptoKeyLocked(name string) (*kmspb.CryptoKey, error) {
+	if !isValidKMSName(name, "cryptoKeys") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid crypto key name: %s", name)
+	}
+	key := &kmspb.CryptoKey{}
+	err := k.readResourceLocked(name, "cryptoKey.json", key)
+	if err != nil {
+		return nil, err
+	}
+	rotationPeriod := key.GetRotationPeriod()
+	if rotationPeriod != nil && key.NextRotationTime != nil && !k.now().Before(key.NextRotationTime.AsTime()) {
+		version, err := k.createVersionLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		key.Primary = version
+		key.NextRotationTime = timestamppb.New(k.now().Add(rotationPeriod.AsDuration()))
+		err = k.writeCryptoKeyLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if key.Primary != nil {
+		key.Primary, err = k.getVersionLocked(key.Primary.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// writeCryptoKeyLocked persists a crypto key with a reference to the primary
+// version rather than a copy that could go stale.
+func (k *KMS) writeCryptoKeyLocked(key *kmspb.CryptoKey) error {
+	stored := proto.Clone(key).(*kmspb.CryptoKey)
+	if stored.Primary != nil {
+		stored.Primary = &kmspb.CryptoKeyVersion{Name: stored.Primary.Name}
+	}
+	return k.writeResourceLocked(key.Name, "cryptoKey.json", stored)
+}
+
+// getVersionLocked loads a crypto key version, completing any scheduled
+// destruction that is due by removing the key material.
+func (k *KMS) getVersionLocked(name string) (*kmspb.CryptoKeyVersion, error) {
+	if !isValidKMSName(name, "cryptoKeyVersions") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid crypto key version name: %s", name)
+	}
+	version := &kmspb.CryptoKeyVersion{}
+	err := k.readResourceLocked(name, "version.json", version)
+	if err != nil {
+		return nil, err
+	}
+	if version.State == kmspb.CryptoKeyVersion_DESTROY_SCHEDULED &&
+		version.DestroyTime != nil && !k.now().Before(version.DestroyTime.AsTime()) {
+		err = k.fs.Remove(path.Join(k.resourceDir(name), kmsKeyMaterialFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		version.State = kmspb.CryptoKeyVersion_DESTROYED
+		version.DestroyEventTime = version.DestroyTime
+		err = k.writeResourceLocked(name, "version.json", version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return version, nil
+}
+
+// getUsableVersionLocked loads an enabled crypto key version
+// with an algorithm that serves one of the provided purposes.
+func (k *KMS) getUsableVersionLocked(name string, purposes ...kmspb.CryptoKey_CryptoKeyPurpose) (*kmspb.CryptoKeyVersion, kmsAlgorithm, error) {
+	version, err := k.getVersionLocked(name)
+	if err != nil {
+		return nil, kmsAlgorithm{}, err
+	}
+	spec, err := getKMSAlgorithm(version.Algorithm)
+	if err != nil {
+		return nil, kmsAlgorithm{}, err
+	}
+	supported := false
+	for _, purpose := range purposes {
+		supported = supported || spec.purpose == purpose
+	}
+	if !supported {
+		return nil, kmsAlgorithm{}, status.Errorf(
+			codes.FailedPrecondition,
+			"%s has algorithm %s which does not support this operation", version.Name, version.Algorithm,
+		)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, kmsAlgorithm{}, status.Errorf(
+			codes.FailedPrecondition,
+			"%s is not enabled, current state is %s", version.Name, version.State,
+		)
+	}
+	return version, spec, nil
+}
+
+func (k *KMS) readKeyMaterialLocked(versionName string) ([]byte, error) {
+	return afero.ReadFile(k.fs, path.Join(k.resourceDir(versionName), kmsKeyMaterialFile))
+}
+
+func (k *KMS) resourceDir(name string) string {
+	return path.Join(k.dataRootDir, name)
+}
+
+func (k *KMS) resourceExistsLocked(name string, fileName string) (bool, error) {
+	return afero.Exists(k.fs, path.Join(k.resourceDir(name), fileName))
+}
+
+func (k *KMS) readResourceLocked(name string, fileName string, resource proto.Message) error {
+	bytes, err := afero.ReadFile(k.fs, path.Join(k.resourceDir(name), fileName))
+	if os.IsNotExist(err) {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(bytes, resource)
+}
+
+func (k *KMS) writeResourceLocked(name string, fileName string, resource proto.Message) error {
+	err := k.fs.MkdirAll(k.resourceDir(name), 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := protojson.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(k.fs, path.Join(k.resourceDir(name), fileName), bytes, 0755)
+}
+
+// listChildNamesLocked produces the sorted names of the resources
+// in a collection of the provided parent.
+func (k *KMS) listChildNamesLocked(parent string, collection string) ([]string, error) {
+	entries, err := afero.ReadDir(k.fs, path.Join(k.resourceDir(parent), collection))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, fmt.Sprintf("%s/%s/%s", parent, collection, entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// listVersionNamesLocked produces the names of the versions
+// of a crypto key ordered by version number.
+func (k *KMS) listVersionNamesLocked(keyName string) ([]string, error) {
+	names, err := k.listChildNamesLocked(keyName, "cryptoKeyVersions")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return kmsVersionNumber(names[i]) < kmsVersionNumber(names[j])
+	})
+	return names, nil
+}
+
+// isValidKMSName checks that a resource name is made up of the
+// expected collection/ID pairs up to and including the provided collection.
+func isValidKMSName(name string, collection string) bool {
+	expected := []string{"projects", "locations", "keyRings", "cryptoKeys", "cryptoKeyVersions"}
+	pieces := strings.Split(name, "/")
+	if len(pieces)%2 != 0 || len(pieces) > len(expected)*2 {
+		return false
+	}
+	for i := 0; i < len(pieces); i = i + 2 {
+		if pieces[i] != expected[i/2] || pieces[i+1] == "" || strings.Contains(pieces[i+1], "..") {
+			return false
+		}
+	}
+	return len(pieces) >= 2 && pieces[len(pieces)-2] == collection
+}
+
+func kmsParentName(name string) string {
+	pieces := strings.Split(name, "/")
+	return strings.Join(pieces[:len(pieces)-2], "/")
+}
+
+func kmsVersionNumber(name string) int {
+	number, _ := strconv.Atoi(name[strings.LastIndex(name, "/")+1:])
+	return number
+}
+
+func kmsProvidedDigest(digest *kmspb.Digest) []byte {
+	switch {
+	case len(digest.GetSha256()) > 0:
+		return digest.GetSha256()
+	case len(digest.GetSha384()) > 0:
+		return digest.GetSha384()
+	}
+	return digest.GetSha512()
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"hash/crc32"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+const (
+	kmsSymmetricKeySize = 32
+	kmsMacKeySize       = 32
+	kmsNonceSize        = 12
+	// Ciphertext produced by symmetric keys is prefixed with the
+	// big endian version number so Decrypt can find the version that was used.
+	kmsCiphertextVersionSize = 4
+)
+
+var errKMSInvalidCiphertext = errors.New("the ciphertext is invalid")
+
+// kmsAlgorithm describes how key material is generated and used
+// for a crypto key version algorithm.
+type kmsAlgorithm struct {
+	purpose kmspb.CryptoKey_CryptoKeyPurpose
+	// rsaBits is set for RSA algorithms.
+	rsaBits int
+	// curve is set for EC algorithms.
+	curve elliptic.Curve
+	// hash is the digest algorithm for signing and OAEP, it is zero
+	// for raw PKCS#1 signatures and symmetric algorithms.
+	hash crypto.Hash
+	pss  bool
+}
+
+var kmsAlgorithms = map[kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]kmsAlgorithm{
+	kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION:  {purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256:     {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 2048, hash: crypto.SHA256, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_3072_SHA256:     {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 3072, hash: crypto.SHA256, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_4096_SHA256:     {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA256, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_4096_SHA512:     {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA512, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 2048, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_3072_SHA256:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 3072, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA256:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA512:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA512},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_2048:      {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 2048},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_3072:      {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 3072},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_4096:      {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 2048, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 3072, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 4096, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA512: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 4096, hash: crypto.SHA512},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA1:   {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 2048, hash: crypto.SHA1},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA1:   {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 3072, hash: crypto.SHA1},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA1:   {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 4096, hash: crypto.SHA1},
+	kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:          {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, curve: elliptic.P256(), hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384:          {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, curve: elliptic.P384(), hash: crypto.SHA384},
+	kmspb.CryptoKeyVersion_HMAC_SHA256:                  {purpose: kmspb.CryptoKey_MAC, hash: crypto.SHA256},
+}
+
+func getKMSAlgorithm(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (kmsAlgorithm, error) {
+	spec, ok := kmsAlgorithms[algorithm]
+	if !ok {
+		return kmsAlgorithm{}, status.Errorf(
+			codes.InvalidArgument,
+			"Algorithm %s is not supported by the emulator", algorithm,
+		)
+	}
+	return spec, nil
+}
+
+// generateKMSKeyMaterial produces new key material for the provided algorithm,
+// symmetric and MAC keys are raw bytes and asymmetric keys are PKCS#8 DER.
+func generateKMSKeyMaterial(spec kmsAlgorithm) ([]byte, error) {
+	switch {
+	case spec.purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT:
+		return randomKMSBytes(kmsSymmetricKeySize)
+	case spec.purpose == kmspb.CryptoKey_MAC:
+		return randomKMSBytes(kmsMacKeySize)
+	case spec.rsaBits > 0:
+		privateKey, err := rsa.GenerateKey(rand.Reader, spec.rsaBits)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(privateKey)
+	case spec.curve != nil:
+		privateKey, err := ecdsa.GenerateKey(spec.curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(privateKey)
+	}
+	return nil, errors.New("unable to generate key material for algorithm")
+}
+
+func randomKMSBytes(length int) ([]byte, error) {
+	bytes := make([]byte, length)
+	_, err := rand.Read(bytes)
+	return bytes, err
+}
+
+// encryptKMSSymmetric seals the plaintext with AES-256-GCM, the ciphertext
+// is made up of the version number, the nonce and the sealed data.
+func encryptKMSSymmetric(key []byte, version int, plaintext []byte, aad []byte) ([]byte, error) {
+	aead, err := newKMSAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomKMSBytes(kmsNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, kmsCiphertextVersionSize, kmsCiphertextVersionSize+kmsNonceSize+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(ciphertext, uint32(version))
+	ciphertext = append(ciphertext, nonce...)
+	return aead.Seal(ciphertext, nonce, plaintext, aad), nil
+}
+
+// kmsCiphertextVersion extracts the version number embedded
+// in ciphertext produced by encryptKMSSymmetric.
+func kmsCiphertextVersion(ciphertext []byte) (int, error) {
+	if len(ciphertext) < kmsCiphertextVersionSize+kmsNonceSize {
+		return 0, errKMSInvalidCiphertext
+	}
+	return int(binary.BigEndian.Uint32(ciphertext)), nil
+}
+
+func decryptKMSSymmetric(key []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	aead, err := newKMSAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < kmsCiphertextVersionSize+kmsNonceSize+aead.Overhead() {
+		return nil, errKMSInvalidCiphertext
+	}
+	nonce := ciphertext[kmsCiphertextVersionSize : kmsCiphertextVersionSize+kmsNonceSize]
+	sealed := ciphertext[kmsCiphertextVersionSize+kmsNonceSize:]
+	plaintext, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return nil, errKMSInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func newKMSAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseKMSPrivateKey(material []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(material)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("stored key material is not a private key")
+	}
+	return signer, nil
+}
+
+// signKMSDigest signs a digest that was produced with the algorithm's
+// hash function, raw PKCS#1 algorithms sign the provided data as is.
+func signKMSDigest(spec kmsAlgorithm, material []byte, digest []byte) ([]byte, error) {
+	signer, err := parseKMSPrivateKey(material)
+	if err != nil {
+		return nil, err
+	}
+	switch privateKey := signer.(type) {
+	case *rsa.PrivateKey:
+		if spec.pss {
+			return rsa.SignPSS(rand.Reader, privateKey, spec.hash, digest, &rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthEqualsHash,
+				Hash:       spec.hash,
+			})
+		}
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, spec.hash, digest)
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, privateKey, digest)
+	}
+	return nil, errors.New("stored key material can not be used for signing")
+}
+
+func decryptKMSAsymmetric(spec kmsAlgorithm, material []byte, ciphertext []byte) ([]byte, error) {
+	signer, err := parseKMSPrivateKey(material)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := signer.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("stored key material can not be used for decryption")
+	}
+	plaintext, err := rsa.DecryptOAEP(newKMSHash(spec.hash), rand.Reader, privateKey, ciphertext, nil)
+	if err != nil {
+		return nil, errKMSInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func kmsPublicKeyPEM(material []byte) (string, error) {
+	signer, err := parseKMSPrivateKey(material)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+func kmsMAC(material []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, material)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func newKMSHash(hash crypto.Hash) hash.Hash {
+	switch hash {
+	case crypto.SHA1:
+		return sha1.New()
+	case crypto.SHA384:
+		return sha512.New384()
+	case crypto.SHA512:
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// kmsDigestBytes extracts the digest for the hash function
+// the signing algorithm expects.
+func kmsDigestBytes(hash crypto.Hash, digest *kmspb.Digest) ([]byte, error) {
+	var value []byte
+	switch hash {
+	case crypto.SHA256:
+		value = digest.GetSha256()
+	case crypto.SHA384:
+		value = digest.GetSha384()
+	case crypto.SHA512:
+		value = digest.GetSha512()
+	}
+	if len(value) != hash.Size() {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"The digest must be a %d byte %s digest for this key version", hash.Size(), hash,
+		)
+	}
+	return value, nil
+}
+
+var kmsCRC32CTable = crc32.MakeTable(crc32.Castagnoli)
+
+func kmsCRC32C(data []byte) *wrapperspb.Int64Value {
+	return wrapperspb.Int64(int64(crc32.Checksum(data, kmsCRC32CTable)))
+}
+
+// verifyKMSCRC32C checks data against an optional client-provided checksum,
+// the returned flag reports whether a checksum was verified.
+func verifyKMSCRC32C(field string, data []byte, checksum *wrapperspb.Int64Value) (bool, error) {
+	if checksum == nil {
+		return false, nil
+	}
+	if checksum.Value != kmsCRC32C(data).Value {
+		return false, status.Errorf(codes.InvalidArgument, "The checksum in field %s did not match the data", field)
+	}
+	return true, nil
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	. "gopkg.in/check.v1"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+type KMSSuite struct {
+	kms   *KMS
+	clock time.Time
+}
+
+var _ = Suite(&KMSSuite{})
+
+const (
+	testKeyRing = "projects/test-project/locations/global/keyRings/test-ring"
+)
+
+func (s *KMSSuite) SetUpTest(c *C) {
+	kms, err := NewKMS("/data/gcloud/kms", afero.NewMemMapFs(), "127.0.0.1", &noopHostsService{})
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	s.clock = time.Date(2022, time.March, 1, 9, 0, 0, 0, time.UTC)
+	kms.now = func() time.Time {
+		return s.clock
+	}
+	s.kms = kms
+	_, err = s.kms.CreateKeyRing(context.Background(), &kmspb.CreateKeyRingRequest{
+		Parent:    "projects/test-project/locations/global",
+		KeyRingId: "test-ring",
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *KMSSuite) Test_ciphertext_from_previous_primary_versions_can_still_be_decrypted(c *C) {
+	key := s.createKey(c, "symmetric", &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT})
+	first := s.encrypt(c, key.Name, "first secret")
+	c.Assert(first.Name, Equals, key.Name+"/cryptoKeyVersions/1")
+
+	version, err := s.kms.CreateCryptoKeyVersion(context.Background(), &kmspb.CreateCryptoKeyVersionRequest{Parent: key.Name})
+	c.Assert(err, IsNil)
+	rotated, err := s.kms.UpdateCryptoKeyPrimaryVersion(context.Background(), &kmspb.UpdateCryptoKeyPrimaryVersionRequest{
+		Name:               key.Name,
+		CryptoKeyVersionId: "2",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(rotated.Primary.Name, Equals, version.Name)
+	second := s.encrypt(c, key.Name, "second secret")
+	c.Assert(second.Name, Equals, version.Name)
+
+	decrypted, err := s.kms.Decrypt(context.Background(), &kmspb.DecryptRequest{Name: key.Name, Ciphertext: first.Ciphertext})
+	c.Assert(err, IsNil)
+	c.Assert(string(decrypted.Plaintext), Equals, "first secret")
+	c.Assert(decrypted.UsedPrimary, Equals, false)
+
+	decrypted, err = s.kms.Decrypt(context.Background(), &kmspb.DecryptRequest{Name: key.Name, Ciphertext: second.Ciphertext})
+	c.Assert(err, IsNil)
+	c.Assert(string(decrypted.Plaintext), Equals, "second secret")
+	c.Assert(decrypted.UsedPrimary, Equals, true)
+}
+
+func (s *KMSSuite) Test_decryption_fails_for_disabled_versions_and_mismatched_aad(c *C) {
+	key := s.createKey(c, "symmetric", &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT})
+	encrypted, err := s.kms.Encrypt(context.Background(), &kmspb.EncryptRequest{
+		Name:                        key.Name,
+		Plaintext:                   []byte("payload"),
+		AdditionalAuthenticatedData: []byte("context"),
+	})
+	c.Assert(err, IsNil)
+
+	_, err = s.kms.Decrypt(context.Background(), &kmspb.DecryptRequest{
+		Name:                        key.Name,
+		Ciphertext:                  encrypted.Ciphertext,
+		AdditionalAuthenticatedData: []byte("other context"),
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	_, err = s.kms.UpdateCryptoKeyVersion(context.Background(), &kmspb.UpdateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{Name: encrypted.Name, State: kmspb.CryptoKeyVersion_DISABLED},
+		UpdateMask:       &fieldmaskpb.FieldMask{Paths: []string{"state"}},
+	})
+	c.Assert(err, IsNil)
+	_, err = s.kms.Decrypt(context.Background(), &kmspb.DecryptRequest{
+		Name:                        key.Name,
+		Ciphertext:                  encrypted.Ciphertext,
+		AdditionalAuthenticatedData: []byte("context"),
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *KMSSuite) Test_ec_signatures_verify_with_the_public_key(c *C) {
+	s.createKey(c, "signing", &kmspb.CryptoKey{
+		Purpose:         kmspb.CryptoKey_ASYMMETRIC_SIGN,
+		VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256},
+	})
+	versionName := testKeyRing + "/cryptoKeys/signing/cryptoKeyVersions/1"
+	digest := sha256.Sum256([]byte("document"))
+	signed, err := s.kms.AsymmetricSign(context.Background(), &kmspb.AsymmetricSignRequest{
+		Name:   versionName,
+		Digest: &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}},
+	})
+	c.Assert(err, IsNil)
+
+	publicKey := s.publicKey(c, versionName).(*ecdsa.PublicKey)
+	c.Assert(ecdsa.VerifyASN1(publicKey, digest[:], signed.Signature), Equals, true)
+}
+
+func (s *KMSSuite) Test_rsa_oaep_ciphertext_is_decrypted(c *C) {
+	s.createKey(c, "decryption", &kmspb.CryptoKey{
+		Purpose:         kmspb.CryptoKey_ASYMMETRIC_DECRYPT,
+		VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256},
+	})
+	versionName := testKeyRing + "/cryptoKeys/decryption/cryptoKeyVersions/1"
+	publicKey := s.publicKey(c, versionName).(*rsa.PublicKey)
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, []byte("wrapped key"), nil)
+	c.Assert(err, IsNil)
+
+	decrypted, err := s.kms.AsymmetricDecrypt(context.Background(), &kmspb.AsymmetricDecryptRequest{
+		Name:       versionName,
+		Ciphertext: ciphertext,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(decrypted.Plaintext), Equals, "wrapped key")
+}
+
+func (s *KMSSuite) Test_mac_tags_are_verified(c *C) {
+	s.createKey(c, "mac", &kmspb.CryptoKey{
+		Purpose:         kmspb.CryptoKey_MAC,
+		VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256},
+	})
+	versionName := testKeyRing + "/cryptoKeys/mac/cryptoKeyVersions/1"
+	signed, err := s.kms.MacSign(context.Background(), &kmspb.MacSignRequest{Name: versionName, Data: []byte("message")})
+	c.Assert(err, IsNil)
+
+	verified, err := s.kms.MacVerify(context.Background(), &kmspb.MacVerifyRequest{
+		Name: versionName, Data: []byte("message"), Mac: signed.Mac,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(verified.Success, Equals, true)
+
+	verified, err = s.kms.MacVerify(context.Background(), &kmspb.MacVerifyRequest{
+		Name: versionName, Data: []byte("tampered"), Mac: signed.Mac,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(verified.Success, Equals, false)
+}
+
+func (s *KMSSuite) Test_keys_are_rotated_automatically_and_versions_are_destroyed_after_the_scheduled_duration(c *C) {
+	key := s.createKey(c, "rotating", &kmspb.CryptoKey{
+		Purpose:          kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		RotationSchedule: &kmspb.CryptoKey_RotationPeriod{RotationPeriod: durationpb.New(48 * time.Hour)},
+	})
+	s.clock = s.clock.Add(48 * time.Hour)
+	rotated, err := s.kms.GetCryptoKey(context.Background(), &kmspb.GetCryptoKeyRequest{Name: key.Name})
+	c.Assert(err, IsNil)
+	c.Assert(rotated.Primary.Name, Equals, key.Name+"/cryptoKeyVersions/2")
+	c.Assert(rotated.NextRotationTime.AsTime(), Equals, s.clock.Add(48*time.Hour))
+
+	destroyed, err := s.kms.DestroyCryptoKeyVersion(context.Background(), &kmspb.DestroyCryptoKeyVersionRequest{
+		Name: key.Name + "/cryptoKeyVersions/1",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(destroyed.State, Equals, kmspb.CryptoKeyVersion_DESTROY_SCHEDULED)
+
+	s.clock = s.clock.Add(24 * time.Hour)
+	version, err := s.kms.GetCryptoKeyVersion(context.Background(), &kmspb.GetCryptoKeyVersionRequest{Name: destroyed.Name})
+	c.Assert(err, IsNil)
+	c.Assert(version.State, Equals, kmspb.CryptoKeyVersion_DESTROYED)
+	_, err = s.kms.RestoreCryptoKeyVersion(context.Background(), &kmspb.RestoreCryptoKeyVersionRequest{Name: destroyed.Name})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *KMSSuite) createKey(c *C, id string, key *kmspb.CryptoKey) *kmspb.CryptoKey {
+	created, err := s.kms.CreateCryptoKey(context.Background(), &kmspb.CreateCryptoKeyRequest{
+		Parent:      testKeyRing,
+		CryptoKeyId: id,
+		CryptoKey:   key,
+	})
+	c.Assert(err, IsNil)
+	return created
+}
+
+func (s *KMSSuite) encrypt(c *C, name string, plaintext string) *kmspb.EncryptResponse {
+	response, err := s.kms.Encrypt(context.Background(), &kmspb.EncryptRequest{
+		Name:      name,
+		Plaintext: []byte(plaintext),
+	})
+	c.Assert(err, IsNil)
+	return response
+}
+
+func (s *KMSSuite) publicKey(c *C, versionName string) interface{} {
+	response, err := s.kms.GetPublicKey(context.Background(), &kmspb.GetPublicKeyRequest{Name: versionName})
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode([]byte(response.Pem))
+	c.Assert(block, NotNil)
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	c.Assert(err, IsNil)
+	return publicKey
+}
@@ -0,0 +1,753 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// PubSub provides a gRPC Pub/Sub service that implements both the
+// publisher and subscriber APIs.
+// Unlike secret manager, topics, subscriptions and messages are held in memory
+// in the same way as the vendor-provided Pub/Sub emulator.
+type PubSub struct {
+	mu            sync.Mutex
+	topics        map[string]*pubsubTopic
+	subscriptions map[string]*pubsubSubscription
+	snapshots     map[string]*pubsubSnapshot
+	nextSeq       int64
+	nextAckID     int64
+	// notify is closed and replaced every time the state of messages
+	// changes so blocked pull requests can wake up.
+	notify chan struct{}
+	now    func() time.Time
+}
+
+const (
+	pubsubDefaultAckDeadline         = 10 * time.Second
+	pubsubMaxAckDeadline             = 600 * time.Second
+	pubsubDefaultRetention           = 7 * 24 * time.Hour
+	pubsubDefaultMaxDeliveryAttempts = 5
+	pubsubDefaultMinBackoff          = 10 * time.Second
+	pubsubDefaultMaxBackoff          = 600 * time.Second
+	pubsubDeletedTopic               = "_deleted-topic_"
+)
+
+var (
+	pubsubLocalHost = "pubsub.googleapis.local"
+)
+
+type pubsubTopic struct {
+	topic *pubsubpb.Topic
+	// log holds every message published to the topic within the longest
+	// retention window so subscriptions can seek back in time
+	// and snapshots can be restored.
+	log []*pubsubLoggedMessage
+}
+
+type pubsubLoggedMessage struct {
+	seq     int64
+	message *pubsubpb.PubsubMessage
+}
+
+type pubsubSnapshot struct {
+	snapshot *pubsubpb.Snapshot
+	// unacked holds the sequence numbers of the messages that were
+	// unacknowledged in the source subscription when the snapshot was taken.
+	unacked map[int64]bool
+	// lastSeq is the sequence number of the last message published
+	// before the snapshot was taken.
+	lastSeq int64
+}
+
+// NewPubSub creates an instance of the Cloud::1 Pub/Sub implementation.
+func NewPubSub(ip string, hostsService hosts.Service) (*PubSub, error) {
+	err := hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &pubsubLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PubSub{
+		topics:        make(map[string]*pubsubTopic),
+		subscriptions: make(map[string]*pubsubSubscription),
+		snapshots:     make(map[string]*pubsubSnapshot),
+		nextSeq:       1,
+		notify:        make(chan struct{}),
+		now:           time.Now,
+	}, nil
+}
+
+// CreateTopic deals with creating a new topic.
+func (p *PubSub) CreateTopic(ctx context.Context, req *pubsubpb.Topic) (*pubsubpb.Topic, error) {
+	if !isValidPubSubResourceName(req.Name, "topics") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid topic name %q", req.Name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.topics[req.Name]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Topic already exists")
+	}
+	topic := proto.Clone(req).(*pubsubpb.Topic)
+	p.topics[req.Name] = &pubsubTopic{topic: topic}
+	return proto.Clone(topic).(*pubsubpb.Topic), nil
+}
+
+// UpdateTopic deals with updating a subset of fields for the specified topic.
+func (p *PubSub) UpdateTopic(ctx context.Context, req *pubsubpb.UpdateTopicRequest) (*pubsubpb.Topic, error) {
+	err := validatePubSubUpdateMask(req.UpdateMask, []string{
+		"labels", "message_storage_policy", "kms_key_name", "schema_settings", "message_retention_duration",
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	topic, err := p.getTopicLocked(req.GetTopic().GetName())
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range req.UpdateMask.Paths {
+		switch path {
+		case "labels":
+			topic.topic.Labels = req.Topic.Labels
+		case "message_storage_policy":
+			topic.topic.MessageStoragePolicy = req.Topic.MessageStoragePolicy
+		case "kms_key_name":
+			topic.topic.KmsKeyName = req.Topic.KmsKeyName
+		case "schema_settings":
+			topic.topic.SchemaSettings = req.Topic.SchemaSettings
+		case "message_retention_duration":
+			topic.topic.MessageRetentionDuration = req.Topic.MessageRetentionDuration
+			for _, sub := range p.subscriptions {
+				if sub.subscription.Topic == topic.topic.Name {
+					sub.subscription.TopicMessageRetentionDuration = req.Topic.MessageRetentionDuration
+				}
+			}
+		}
+	}
+	return proto.Clone(topic.topic).(*pubsubpb.Topic), nil
+}
+
+// Publish deals with adding one or more messages to a topic and fanning
+// them out to every attached subscription whose filter matches.
+func (p *PubSub) Publish(ctx context.Context, req *pubsubpb.PublishRequest) (*pubsubpb.PublishResponse, error) {
+	if len(req.Messages) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "At least one message must be provided")
+	}
+	for _, message := range req.Messages {
+		if len(message.Data) == 0 && len(message.Attributes) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "A message must contain either data or attributes")
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	topic, err := p.getTopicLocked(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	messageIDs := p.publishLocked(topic, req.Messages)
+	return &pubsubpb.PublishResponse{
+		MessageIds: messageIDs,
+	}, nil
+}
+
+func (p *PubSub) publishLocked(topic *pubsubTopic, messages []*pubsubpb.PubsubMessage) []string {
+	now := p.now()
+	p.pruneTopicLocked(topic, now)
+	messageIDs := []string{}
+	for _, message := range messages {
+		published := proto.Clone(message).(*pubsubpb.PubsubMessage)
+		seq := p.nextSeq
+		p.nextSeq = p.nextSeq + 1
+		published.MessageId = fmt.Sprintf("%d", seq)
+		published.PublishTime = timestamppb.New(now)
+		logged := &pubsubLoggedMessage{
+			seq:     seq,
+			message: published,
+		}
+		topic.log = append(topic.log, logged)
+		for _, sub := range p.subscriptions {
+			if sub.subscription.Topic == topic.topic.Name && !sub.subscription.Detached {
+				sub.enqueue(logged, now)
+			}
+		}
+		messageIDs = append(messageIDs, published.MessageId)
+	}
+	p.broadcastLocked()
+	return messageIDs
+}
+
+// GetTopic deals with retrieving the configuration of a topic.
+func (p *PubSub) GetTopic(ctx context.Context, req *pubsubpb.GetTopicRequest) (*pubsubpb.Topic, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	topic, err := p.getTopicLocked(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(topic.topic).(*pubsubpb.Topic), nil
+}
+
+// ListTopics deals with listing the topics in a project.
+func (p *PubSub) ListTopics(ctx context.Context, req *pubsubpb.ListTopicsRequest) (*pubsubpb.ListTopicsResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := []string{}
+	for name := range p.topics {
+		if strings.HasPrefix(name, fmt.Sprintf("%s/topics/", req.Project)) {
+			names = append(names, name)
+		}
+	}
+	page, nextPageToken := paginateNames(names, req.PageSize, req.PageToken)
+	topics := []*pubsubpb.Topic{}
+	for _, name := range page {
+		topics = append(topics, proto.Clone(p.topics[name].topic).(*pubsubpb.Topic))
+	}
+	return &pubsubpb.ListTopicsResponse{
+		Topics:        topics,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// ListTopicSubscriptions deals with listing the names of the subscriptions
+// attached to a topic.
+func (p *PubSub) ListTopicSubscriptions(ctx context.Context, req *pubsubpb.ListTopicSubscriptionsRequest) (*pubsubpb.ListTopicSubscriptionsResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.getTopicLocked(req.Topic); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name, sub := range p.subscriptions {
+		if sub.subscription.Topic == req.Topic {
+			names = append(names, name)
+		}
+	}
+	page, nextPageToken := paginateNames(names, req.PageSize, req.PageToken)
+	return &pubsubpb.ListTopicSubscriptionsResponse{
+		Subscriptions: page,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// ListTopicSnapshots deals with listing the names of the snapshots
+// taken from subscriptions attached to a topic.
+func (p *PubSub) ListTopicSnapshots(ctx context.Context, req *pubsubpb.ListTopicSnapshotsRequest) (*pubsubpb.ListTopicSnapshotsResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.getTopicLocked(req.Topic); err != nil {
+		return nil, err
+	}
+	p.pruneSnapshotsLocked(p.now())
+	names := []string{}
+	for name, snapshot := range p.snapshots {
+		if snapshot.snapshot.Topic == req.Topic {
+			names = append(names, name)
+		}
+	}
+	page, nextPageToken := paginateNames(names, req.PageSize, req.PageToken)
+	return &pubsubpb.ListTopicSnapshotsResponse{
+		Snapshots:     page,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// DeleteTopic deals with deleting a topic, existing subscriptions
+// are kept but their topic is set to "_deleted-topic_".
+func (p *PubSub) DeleteTopic(ctx context.Context, req *pubsubpb.DeleteTopicRequest) (*emptypb.Empty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.getTopicLocked(req.Topic); err != nil {
+		return nil, err
+	}
+	delete(p.topics, req.Topic)
+	for _, sub := range p.subscriptions {
+		if sub.subscription.Topic == req.Topic {
+			sub.subscription.Topic = pubsubDeletedTopic
+		}
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// DetachSubscription deals with detaching a subscription from its topic,
+// all messages retained in the subscription are dropped.
+func (p *PubSub) DetachSubscription(ctx context.Context, req *pubsubpb.DetachSubscriptionRequest) (*pubsubpb.DetachSubscriptionResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	sub.subscription.Detached = true
+	sub.reset(nil, p.now())
+	p.broadcastLocked()
+	return &pubsubpb.DetachSubscriptionResponse{}, nil
+}
+
+// CreateSubscription deals with creating a subscription to a topic.
+func (p *PubSub) CreateSubscription(ctx context.Context, req *pubsubpb.Subscription) (*pubsubpb.Subscription, error) {
+	if !isValidPubSubResourceName(req.Name, "subscriptions") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid subscription name %q", req.Name)
+	}
+	subscription := proto.Clone(req).(*pubsubpb.Subscription)
+	err := applyPubSubSubscriptionDefaults(subscription)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parsePubSubFilter(subscription.Filter)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %s", err.Error())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.subscriptions[req.Name]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Subscription already exists")
+	}
+	topic, err := p.getTopicLocked(subscription.Topic)
+	if err != nil {
+		return nil, err
+	}
+	err = p.validateDeadLetterPolicyLocked(subscription.DeadLetterPolicy)
+	if err != nil {
+		return nil, err
+	}
+	subscription.TopicMessageRetentionDuration = topic.topic.MessageRetentionDuration
+	subscription.State = pubsubpb.Subscription_ACTIVE
+	p.subscriptions[req.Name] = newPubSubSubscription(subscription, filter, p.nextSeq)
+	return proto.Clone(subscription).(*pubsubpb.Subscription), nil
+}
+
+// GetSubscription deals with retrieving the configuration of a subscription.
+func (p *PubSub) GetSubscription(ctx context.Context, req *pubsubpb.GetSubscriptionRequest) (*pubsubpb.Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(sub.subscription).(*pubsubpb.Subscription), nil
+}
+
+// UpdateSubscription deals with updating a subset of fields for the specified subscription.
+// The topic, filter and message ordering of a subscription are not modifiable.
+func (p *PubSub) UpdateSubscription(ctx context.Context, req *pubsubpb.UpdateSubscriptionRequest) (*pubsubpb.Subscription, error) {
+	err := validatePubSubUpdateMask(req.UpdateMask, []string{
+		"push_config", "ack_deadline_seconds", "retain_acked_messages", "message_retention_duration",
+		"labels", "expiration_policy", "dead_letter_policy", "retry_policy", "enable_exactly_once_delivery",
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.GetSubscription().GetName())
+	if err != nil {
+		return nil, err
+	}
+	updated := proto.Clone(sub.subscription).(*pubsubpb.Subscription)
+	for _, path := range req.UpdateMask.Paths {
+		switch path {
+		case "push_config":
+			updated.PushConfig = req.Subscription.PushConfig
+		case "ack_deadline_seconds":
+			updated.AckDeadlineSeconds = req.Subscription.AckDeadlineSeconds
+		case "retain_acked_messages":
+			updated.RetainAckedMessages = req.Subscription.RetainAckedMessages
+		case "message_retention_duration":
+			updated.MessageRetentionDuration = req.Subscription.MessageRetentionDuration
+		case "labels":
+			updated.Labels = req.Subscription.Labels
+		case "expiration_policy":
+			updated.ExpirationPolicy = req.Subscription.ExpirationPolicy
+		case "dead_letter_policy":
+			updated.DeadLetterPolicy = req.Subscription.DeadLetterPolicy
+		case "retry_policy":
+			updated.RetryPolicy = req.Subscription.RetryPolicy
+		case "enable_exactly_once_delivery":
+			updated.EnableExactlyOnceDelivery = req.Subscription.EnableExactlyOnceDelivery
+		}
+	}
+	err = applyPubSubSubscriptionDefaults(updated)
+	if err != nil {
+		return nil, err
+	}
+	err = p.validateDeadLetterPolicyLocked(updated.DeadLetterPolicy)
+	if err != nil {
+		return nil, err
+	}
+	sub.subscription = updated
+	p.broadcastLocked()
+	return proto.Clone(updated).(*pubsubpb.Subscription), nil
+}
+
+// ListSubscriptions deals with listing the subscriptions in a project.
+func (p *PubSub) ListSubscriptions(ctx context.Context, req *pubsubpb.ListSubscriptionsRequest) (*pubsubpb.ListSubscriptionsResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := []string{}
+	for name := range p.subscriptions {
+		if strings.HasPrefix(name, fmt.Sprintf("%s/subscriptions/", req.Project)) {
+			names = append(names, name)
+		}
+	}
+	page, nextPageToken := paginateNames(names, req.PageSize, req.PageToken)
+	subscriptions := []*pubsubpb.Subscription{}
+	for _, name := range page {
+		subscriptions = append(subscriptions, proto.Clone(p.subscriptions[name].subscription).(*pubsubpb.Subscription))
+	}
+	return &pubsubpb.ListSubscriptionsResponse{
+		Subscriptions: subscriptions,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// DeleteSubscription deals with deleting a subscription,
+// all messages retained in the subscription are dropped.
+func (p *PubSub) DeleteSubscription(ctx context.Context, req *pubsubpb.DeleteSubscriptionRequest) (*emptypb.Empty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.getSubscriptionLocked(req.Subscription); err != nil {
+		return nil, err
+	}
+	delete(p.subscriptions, req.Subscription)
+	p.broadcastLocked()
+	return &emptypb.Empty{}, nil
+}
+
+// ModifyPushConfig deals with modifying the push config of a subscription.
+// Push delivery is not supported yet so the configuration is only stored.
+func (p *PubSub) ModifyPushConfig(ctx context.Context, req *pubsubpb.ModifyPushConfigRequest) (*emptypb.Empty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	sub.subscription.PushConfig = req.PushConfig
+	return &emptypb.Empty{}, nil
+}
+
+// GetSnapshot deals with retrieving the configuration of a snapshot.
+func (p *PubSub) GetSnapshot(ctx context.Context, req *pubsubpb.GetSnapshotRequest) (*pubsubpb.Snapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot, err := p.getSnapshotLocked(req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(snapshot.snapshot).(*pubsubpb.Snapshot), nil
+}
+
+// ListSnapshots deals with listing the snapshots in a project.
+func (p *PubSub) ListSnapshots(ctx context.Context, req *pubsubpb.ListSnapshotsRequest) (*pubsubpb.ListSnapshotsResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneSnapshotsLocked(p.now())
+	names := []string{}
+	for name := range p.snapshots {
+		if strings.HasPrefix(name, fmt.Sprintf("%s/snapshots/", req.Project)) {
+			names = append(names, name)
+		}
+	}
+	page, nextPageToken := paginateNames(names, req.PageSize, req.PageToken)
+	snapshots := []*pubsubpb.Snapshot{}
+	for _, name := range page {
+		snapshots = append(snapshots, proto.Clone(p.snapshots[name].snapshot).(*pubsubpb.Snapshot))
+	}
+	return &pubsubpb.ListSnapshotsResponse{
+		Snapshots:     snapshots,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// CreateSnapshot deals with capturing the acknowledgement state of a subscription
+// so it can later be restored with Seek.
+func (p *PubSub) CreateSnapshot(ctx context.Context, req *pubsubpb.CreateSnapshotRequest) (*pubsubpb.Snapshot, error) {
+	if !isValidPubSubResourceName(req.Name, "snapshots") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid snapshot name %q", req.Name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.snapshots[req.Name]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Snapshot already exists")
+	}
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	if sub.subscription.Detached || sub.subscription.Topic == pubsubDeletedTopic {
+		return nil, status.Errorf(codes.FailedPrecondition, "Subscription is detached from its topic")
+	}
+	now := p.now()
+	sub.prune(now)
+	unacked := map[int64]bool{}
+	oldest := now
+	for _, message := range sub.pending {
+		unacked[message.seq] = true
+		publishTime := message.message.PublishTime.AsTime()
+		if publishTime.Before(oldest) {
+			oldest = publishTime
+		}
+	}
+	snapshot := &pubsubpb.Snapshot{
+		Name:       req.Name,
+		Topic:      sub.subscription.Topic,
+		ExpireTime: timestamppb.New(oldest.Add(pubsubDefaultRetention)),
+		Labels:     req.Labels,
+	}
+	p.snapshots[req.Name] = &pubsubSnapshot{
+		snapshot: snapshot,
+		unacked:  unacked,
+		lastSeq:  p.nextSeq - 1,
+	}
+	return proto.Clone(snapshot).(*pubsubpb.Snapshot), nil
+}
+
+// UpdateSnapshot deals with updating the labels or expiry time of a snapshot.
+func (p *PubSub) UpdateSnapshot(ctx context.Context, req *pubsubpb.UpdateSnapshotRequest) (*pubsubpb.Snapshot, error) {
+	err := validatePubSubUpdateMask(req.UpdateMask, []string{"labels", "expire_time"})
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot, err := p.getSnapshotLocked(req.GetSnapshot().GetName())
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range req.UpdateMask.Paths {
+		switch path {
+		case "labels":
+			snapshot.snapshot.Labels = req.Snapshot.Labels
+		case "expire_time":
+			snapshot.snapshot.ExpireTime = req.Snapshot.ExpireTime
+		}
+	}
+	return proto.Clone(snapshot.snapshot).(*pubsubpb.Snapshot), nil
+}
+
+// DeleteSnapshot deals with deleting a snapshot.
+func (p *PubSub) DeleteSnapshot(ctx context.Context, req *pubsubpb.DeleteSnapshotRequest) (*emptypb.Empty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.getSnapshotLocked(req.Snapshot); err != nil {
+		return nil, err
+	}
+	delete(p.snapshots, req.Snapshot)
+	return &emptypb.Empty{}, nil
+}
+
+// Seek deals with resetting the acknowledgement state of the messages in a subscription
+// to a point in time or to the state captured by a snapshot.
+func (p *PubSub) Seek(ctx context.Context, req *pubsubpb.SeekRequest) (*pubsubpb.SeekResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	if sub.subscription.Detached {
+		return nil, status.Errorf(codes.FailedPrecondition, "Subscription is detached from its topic")
+	}
+	now := p.now()
+	topic := p.topics[sub.subscription.Topic]
+	switch target := req.Target.(type) {
+	case *pubsubpb.SeekRequest_Time:
+		if target.Time == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "A time to seek to must be provided")
+		}
+		sub.seekToTime(topic, target.Time.AsTime(), now)
+	case *pubsubpb.SeekRequest_Snapshot:
+		snapshot, err := p.getSnapshotLocked(target.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.snapshot.Topic != sub.subscription.Topic || topic == nil {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"Snapshot %q belongs to a different topic than subscription %q",
+				target.Snapshot,
+				req.Subscription,
+			)
+		}
+		sub.seekToSnapshot(topic, snapshot, now)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "Either a time or a snapshot to seek to must be provided")
+	}
+	p.broadcastLocked()
+	return &pubsubpb.SeekResponse{}, nil
+}
+
+func (p *PubSub) getTopicLocked(name string) (*pubsubTopic, error) {
+	topic, exists := p.topics[name]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "Topic not found")
+	}
+	return topic, nil
+}
+
+func (p *PubSub) getSubscriptionLocked(name string) (*pubsubSubscription, error) {
+	sub, exists := p.subscriptions[name]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "Subscription does not exist")
+	}
+	return sub, nil
+}
+
+func (p *PubSub) getSnapshotLocked(name string) (*pubsubSnapshot, error) {
+	p.pruneSnapshotsLocked(p.now())
+	snapshot, exists := p.snapshots[name]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "Snapshot does not exist")
+	}
+	return snapshot, nil
+}
+
+func (p *PubSub) validateDeadLetterPolicyLocked(policy *pubsubpb.DeadLetterPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if _, exists := p.topics[policy.DeadLetterTopic]; !exists {
+		return status.Errorf(codes.InvalidArgument, "Dead letter topic %q does not exist", policy.DeadLetterTopic)
+	}
+	return nil
+}
+
+// broadcastLocked wakes up every pull request waiting for the state
+// of messages to change.
+func (p *PubSub) broadcastLocked() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+func (p *PubSub) pruneTopicLocked(topic *pubsubTopic, now time.Time) {
+	// Subscriptions can retain acknowledged messages for up to the default retention
+	// period, so the topic log must hold messages for at least as long.
+	retention := pubsubDefaultRetention
+	if topicRetention := topic.topic.MessageRetentionDuration.AsDuration(); topicRetention > retention {
+		retention = topicRetention
+	}
+	cutOff := now.Add(-retention)
+	i := 0
+	for i < len(topic.log) && topic.log[i].message.PublishTime.AsTime().Before(cutOff) {
+		i = i + 1
+	}
+	topic.log = topic.log[i:]
+}
+
+func (p *PubSub) pruneSnapshotsLocked(now time.Time) {
+	for name, snapshot := range p.snapshots {
+		if snapshot.snapshot.ExpireTime != nil && !now.Before(snapshot.snapshot.ExpireTime.AsTime()) {
+			delete(p.snapshots, name)
+		}
+	}
+}
+
+func applyPubSubSubscriptionDefaults(subscription *pubsubpb.Subscription) error {
+	if subscription.AckDeadlineSeconds == 0 {
+		subscription.AckDeadlineSeconds = int32(pubsubDefaultAckDeadline.Seconds())
+	}
+	if subscription.AckDeadlineSeconds < 10 || subscription.AckDeadlineSeconds > int32(pubsubMaxAckDeadline.Seconds()) {
+		return status.Errorf(codes.InvalidArgument, "The ack deadline must be between 10 and 600 seconds")
+	}
+	if subscription.MessageRetentionDuration == nil {
+		subscription.MessageRetentionDuration = durationpb.New(pubsubDefaultRetention)
+	}
+	retention := subscription.MessageRetentionDuration.AsDuration()
+	if retention < 10*time.Minute || retention > pubsubDefaultRetention {
+		return status.Errorf(codes.InvalidArgument, "The message retention duration must be between 10 minutes and 7 days")
+	}
+	if policy := subscription.DeadLetterPolicy; policy != nil {
+		if policy.MaxDeliveryAttempts == 0 {
+			policy.MaxDeliveryAttempts = pubsubDefaultMaxDeliveryAttempts
+		}
+		if policy.MaxDeliveryAttempts < 5 || policy.MaxDeliveryAttempts > 100 {
+			return status.Errorf(codes.InvalidArgument, "The max delivery attempts for a dead letter policy must be between 5 and 100")
+		}
+	}
+	if policy := subscription.RetryPolicy; policy != nil {
+		if policy.MinimumBackoff == nil {
+			policy.MinimumBackoff = durationpb.New(pubsubDefaultMinBackoff)
+		}
+		if policy.MaximumBackoff == nil {
+			policy.MaximumBackoff = durationpb.New(pubsubDefaultMaxBackoff)
+		}
+		if policy.MinimumBackoff.AsDuration() > policy.MaximumBackoff.AsDuration() {
+			return status.Errorf(codes.InvalidArgument, "The minimum backoff of a retry policy must not exceed the maximum backoff")
+		}
+	}
+	return nil
+}
+
+func validatePubSubUpdateMask(updateMask *fieldmaskpb.FieldMask, mutableFields []string) error {
+	if updateMask == nil || len(updateMask.Paths) == 0 {
+		return status.Errorf(codes.InvalidArgument, "An update mask must be provided")
+	}
+	for _, path := range updateMask.Paths {
+		found := false
+		for _, field := range mutableFields {
+			found = found || field == path
+		}
+		if !found {
+			return status.Errorf(codes.InvalidArgument, "Update mask must only contain mutable fields, %q is not mutable", path)
+		}
+	}
+	return nil
+}
+
+func isValidPubSubResourceName(name string, collection string) bool {
+	pieces := strings.Split(name, "/")
+	return len(pieces) == 4 && pieces[0] == "projects" && pieces[1] != "" &&
+		pieces[2] == collection && pieces[3] != ""
+}
+
+// paginateNames sorts the provided resource names and produces
+// the page that follows the provided token, the token for the next page
+// is the last name in the current page.
+func paginateNames(names []string, pageSize int32, pageToken string) ([]string, string) {
+	sort.Strings(names)
+	start := 0
+	if pageToken != "" {
+		start = sort.SearchStrings(names, pageToken)
+		if start < len(names) && names[start] == pageToken {
+			start = start + 1
+		}
+	}
+	end := len(names)
+	if pageSize > 0 && start+int(pageSize) < end {
+		end = start + int(pageSize)
+	}
+	if start > end {
+		start = end
+	}
+	nextPageToken := ""
+	if end < len(names) {
+		nextPageToken = names[end-1]
+	}
+	return names[start:end], nextPageToken
+}
@@ -0,0 +1,688 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+const (
+	// pubsubPullTimeout is how long a pull request will wait
+	// for messages before returning an empty response.
+	pubsubPullTimeout = 10 * time.Second
+	// pubsubMaxBatchSize is the maximum number of messages sent
+	// in a single streaming pull response.
+	pubsubMaxBatchSize = 1000
+)
+
+var (
+	errPubSubPullTimeout = errors.New("timed out waiting for messages")
+)
+
+type pubsubSubscription struct {
+	subscription *pubsubpb.Subscription
+	filter       pubsubFilter
+	// startSeq is the sequence number of the first message
+	// published after the subscription was created.
+	startSeq int64
+	// pending holds unacknowledged messages in the order
+	// they were published.
+	pending []*pubsubPendingMessage
+	ackIDs  map[string]*pubsubPendingMessage
+}
+
+type pubsubPendingMessage struct {
+	seq             int64
+	message         *pubsubpb.PubsubMessage
+	deliveryAttempt int32
+	// ackID is the ack ID of the current delivery,
+	// this will be empty when the message is waiting to be delivered.
+	ackID string
+	// issuedAckIDs holds every ack ID issued for the message so they can
+	// be cleaned up once the message is acknowledged.
+	issuedAckIDs []string
+	leaseExpiry  time.Time
+	// availableAt is the earliest time the message can be delivered,
+	// this is pushed back by the retry policy when a message is nacked.
+	availableAt time.Time
+}
+
+func newPubSubSubscription(subscription *pubsubpb.Subscription, filter pubsubFilter, startSeq int64) *pubsubSubscription {
+	return &pubsubSubscription{
+		subscription: subscription,
+		filter:       filter,
+		startSeq:     startSeq,
+		pending:      []*pubsubPendingMessage{},
+		ackIDs:       make(map[string]*pubsubPendingMessage),
+	}
+}
+
+// enqueue adds a published message to the subscription if it matches
+// the subscription filter, messages that do not match are automatically acknowledged.
+func (s *pubsubSubscription) enqueue(logged *pubsubLoggedMessage, now time.Time) {
+	if s.filter != nil && !s.filter(logged.message.Attributes) {
+		return
+	}
+	s.pending = append(s.pending, &pubsubPendingMessage{
+		seq:         logged.seq,
+		message:     logged.message,
+		availableAt: now,
+	})
+}
+
+// reset replaces the messages in the subscription, this is used
+// when seeking and detaching. Delivery attempts are carried over for messages
+// that were already waiting to be acknowledged.
+func (s *pubsubSubscription) reset(messages []*pubsubLoggedMessage, now time.Time) {
+	attempts := map[int64]int32{}
+	for _, message := range s.pending {
+		attempts[message.seq] = message.deliveryAttempt
+	}
+	s.pending = []*pubsubPendingMessage{}
+	s.ackIDs = make(map[string]*pubsubPendingMessage)
+	for _, logged := range messages {
+		s.enqueue(logged, now)
+	}
+	for _, message := range s.pending {
+		message.deliveryAttempt = attempts[message.seq]
+	}
+}
+
+func (s *pubsubSubscription) seekToTime(topic *pubsubTopic, seekTime time.Time, now time.Time) {
+	// Acknowledged messages can only be restored when they have been retained
+	// by the subscription or the topic.
+	canRestoreAcked := topic != nil &&
+		(s.subscription.RetainAckedMessages || topic.topic.MessageRetentionDuration.AsDuration() > 0)
+	messages := []*pubsubLoggedMessage{}
+	if canRestoreAcked {
+		for _, logged := range topic.log {
+			if logged.seq >= s.startSeq && !logged.message.PublishTime.AsTime().Before(seekTime) {
+				messages = append(messages, logged)
+			}
+		}
+	} else {
+		for _, message := range s.pending {
+			if !message.message.PublishTime.AsTime().Before(seekTime) {
+				messages = append(messages, &pubsubLoggedMessage{seq: message.seq, message: message.message})
+			}
+		}
+	}
+	s.reset(messages, now)
+	s.prune(now)
+}
+
+func (s *pubsubSubscription) seekToSnapshot(topic *pubsubTopic, snapshot *pubsubSnapshot, now time.Time) {
+	messages := []*pubsubLoggedMessage{}
+	for _, logged := range topic.log {
+		if snapshot.unacked[logged.seq] || logged.seq > snapshot.lastSeq {
+			messages = append(messages, logged)
+		}
+	}
+	s.reset(messages, now)
+	s.prune(now)
+}
+
+// prune drops messages that are older than the retention
+// period of the subscription or its topic, whichever is longer.
+func (s *pubsubSubscription) prune(now time.Time) {
+	retention := s.subscription.MessageRetentionDuration.AsDuration()
+	if topicRetention := s.subscription.TopicMessageRetentionDuration.AsDuration(); topicRetention > retention {
+		retention = topicRetention
+	}
+	cutOff := now.Add(-retention)
+	kept := []*pubsubPendingMessage{}
+	for _, message := range s.pending {
+		if message.message.PublishTime.AsTime().Before(cutOff) {
+			s.forgetAckIDs(message)
+		} else {
+			kept = append(kept, message)
+		}
+	}
+	s.pending = kept
+}
+
+func (s *pubsubSubscription) remove(message *pubsubPendingMessage) {
+	kept := []*pubsubPendingMessage{}
+	for _, pending := range s.pending {
+		if pending != message {
+			kept = append(kept, pending)
+		}
+	}
+	s.pending = kept
+	s.forgetAckIDs(message)
+}
+
+func (s *pubsubSubscription) forgetAckIDs(message *pubsubPendingMessage) {
+	for _, ackID := range message.issuedAckIDs {
+		delete(s.ackIDs, ackID)
+	}
+	message.issuedAckIDs = nil
+}
+
+// endLease ends the current delivery of a message, with exactly once delivery
+// enabled the ack IDs from previous deliveries can no longer be used.
+func (s *pubsubSubscription) endLease(message *pubsubPendingMessage) {
+	message.ackID = ""
+	if s.subscription.EnableExactlyOnceDelivery {
+		s.forgetAckIDs(message)
+	}
+}
+
+func (s *pubsubSubscription) orderingKey(message *pubsubPendingMessage) string {
+	if !s.subscription.EnableMessageOrdering {
+		return ""
+	}
+	return message.message.OrderingKey
+}
+
+// backoff determines how long to wait before redelivering a message
+// that has been nacked or whose ack deadline has expired.
+func (s *pubsubSubscription) backoff(deliveryAttempt int32) time.Duration {
+	policy := s.subscription.RetryPolicy
+	if policy == nil {
+		return 0
+	}
+	backoff := policy.MinimumBackoff.AsDuration()
+	maxBackoff := policy.MaximumBackoff.AsDuration()
+	for i := int32(1); i < deliveryAttempt && backoff < maxBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// nextEvent determines how long until a message becomes available
+// for delivery or a lease expires, zero is returned when there is nothing to wait for.
+func (s *pubsubSubscription) nextEvent(now time.Time) time.Duration {
+	var next time.Duration
+	for _, message := range s.pending {
+		var until time.Duration
+		if message.ackID != "" {
+			until = message.leaseExpiry.Sub(now)
+		} else {
+			until = message.availableAt.Sub(now)
+		}
+		if until > 0 && (next == 0 || until < next) {
+			next = until
+		}
+	}
+	return next
+}
+
+// ModifyAckDeadline deals with extending the ack deadline for messages,
+// a deadline of 0 will nack the messages so they are redelivered.
+func (p *PubSub) ModifyAckDeadline(ctx context.Context, req *pubsubpb.ModifyAckDeadlineRequest) (*emptypb.Empty, error) {
+	if req.AckDeadlineSeconds < 0 || req.AckDeadlineSeconds > int32(pubsubMaxAckDeadline.Seconds()) {
+		return nil, status.Errorf(codes.InvalidArgument, "The ack deadline must be between 0 and 600 seconds")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	now := p.now()
+	p.expireLeasesLocked(sub, now)
+	_, invalid := p.modifyAckDeadlineLocked(sub, req.AckIds, req.AckDeadlineSeconds, now)
+	p.broadcastLocked()
+	if len(invalid) > 0 {
+		return nil, exactlyOnceAckError(invalid)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Acknowledge deals with acknowledging messages so they are not redelivered.
+func (p *PubSub) Acknowledge(ctx context.Context, req *pubsubpb.AcknowledgeRequest) (*emptypb.Empty, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, err := p.getSubscriptionLocked(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	now := p.now()
+	p.expireLeasesLocked(sub, now)
+	_, invalid := p.acknowledgeLocked(sub, req.AckIds)
+	p.broadcastLocked()
+	if len(invalid) > 0 {
+		return nil, exactlyOnceAckError(invalid)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Pull deals with delivering messages for a subscription, waiting for messages
+// to become available unless the request asks to return immediately.
+func (p *PubSub) Pull(ctx context.Context, req *pubsubpb.PullRequest) (*pubsubpb.PullResponse, error) {
+	if req.MaxMessages <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "The maximum number of messages must be greater than 0")
+	}
+	timeout := time.NewTimer(pubsubPullTimeout)
+	defer timeout.Stop()
+	for {
+		p.mu.Lock()
+		sub, err := p.getActiveSubscriptionLocked(req.Subscription)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		now := p.now()
+		ackDeadline := time.Duration(sub.subscription.AckDeadlineSeconds) * time.Second
+		received := p.deliverLocked(sub, int(req.MaxMessages), 0, ackDeadline, now)
+		notify := p.notify
+		next := sub.nextEvent(now)
+		p.mu.Unlock()
+
+		if len(received) > 0 || req.ReturnImmediately {
+			return &pubsubpb.PullResponse{
+				ReceivedMessages: received,
+			}, nil
+		}
+		err = waitForPubSubEvent(ctx, notify, next, timeout.C)
+		if err == errPubSubPullTimeout {
+			return &pubsubpb.PullResponse{}, nil
+		}
+		if err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+	}
+}
+
+// StreamingPull deals with delivering messages over a bi-directional stream
+// while processing acknowledgements and ack deadline modifications sent by the client.
+func (p *PubSub) StreamingPull(stream pubsubpb.Subscriber_StreamingPullServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.Subscription == "" {
+		return status.Errorf(codes.InvalidArgument, "The subscription must be set in the first request")
+	}
+	if req.StreamAckDeadlineSeconds < 10 || req.StreamAckDeadlineSeconds > int32(pubsubMaxAckDeadline.Seconds()) {
+		return status.Errorf(codes.InvalidArgument, "The stream ack deadline must be between 10 and 600 seconds")
+	}
+	subscriptionName := req.Subscription
+	ackDeadline := time.Duration(req.StreamAckDeadlineSeconds) * time.Second
+	maxOutstandingMessages := req.MaxOutstandingMessages
+	maxOutstandingBytes := req.MaxOutstandingBytes
+
+	ctx := stream.Context()
+	requests := make(chan *pubsubpb.StreamingPullRequest)
+	recvErrors := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			next, err := stream.Recv()
+			if err != nil {
+				recvErrors <- err
+				return
+			}
+			select {
+			case requests <- next:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// delivered holds the ack IDs of messages sent on this stream
+	// so flow control can be applied.
+	delivered := map[string]bool{}
+	for {
+		p.mu.Lock()
+		sub, err := p.getActiveSubscriptionLocked(subscriptionName)
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		now := p.now()
+		p.expireLeasesLocked(sub, now)
+		var confirmation *pubsubpb.StreamingPullResponse
+		if req != nil {
+			confirmation = p.processStreamingPullRequestLocked(sub, req, now)
+			req = nil
+		}
+
+		outstandingMessages, outstandingBytes := int64(0), int64(0)
+		for ackID := range delivered {
+			message, ok := sub.ackIDs[ackID]
+			if !ok || message.ackID != ackID {
+				delete(delivered, ackID)
+			} else {
+				outstandingMessages = outstandingMessages + 1
+				outstandingBytes = outstandingBytes + int64(len(message.message.Data))
+			}
+		}
+		maxMessages := int64(pubsubMaxBatchSize)
+		if maxOutstandingMessages > 0 && maxOutstandingMessages-outstandingMessages < maxMessages {
+			maxMessages = maxOutstandingMessages - outstandingMessages
+		}
+		maxBytes := int64(0)
+		if maxOutstandingBytes > 0 {
+			maxBytes = maxOutstandingBytes - outstandingBytes
+		}
+		received := []*pubsubpb.ReceivedMessage{}
+		if maxMessages > 0 && (maxOutstandingBytes <= 0 || maxBytes > 0) {
+			received = p.deliverLocked(sub, int(maxMessages), maxBytes, ackDeadline, now)
+		}
+		for _, message := range received {
+			delivered[message.AckId] = true
+		}
+		properties := &pubsubpb.StreamingPullResponse_SubscriptionProperties{
+			ExactlyOnceDeliveryEnabled: sub.subscription.EnableExactlyOnceDelivery,
+			MessageOrderingEnabled:     sub.subscription.EnableMessageOrdering,
+		}
+		notify := p.notify
+		next := sub.nextEvent(now)
+		p.mu.Unlock()
+
+		if confirmation != nil {
+			if err := stream.Send(confirmation); err != nil {
+				return err
+			}
+		}
+		if len(received) > 0 {
+			err := stream.Send(&pubsubpb.StreamingPullResponse{
+				ReceivedMessages:       received,
+				SubscriptionProperties: properties,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if next > 0 {
+			timer = time.NewTimer(next)
+			timerC = timer.C
+		}
+		var recvErr error
+		select {
+		case <-ctx.Done():
+			recvErr = status.FromContextError(ctx.Err()).Err()
+		case recvErr = <-recvErrors:
+		case req = <-requests:
+		case <-notify:
+		case <-timerC:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if recvErr == io.EOF {
+			return nil
+		}
+		if recvErr != nil {
+			return recvErr
+		}
+	}
+}
+
+func (p *PubSub) processStreamingPullRequestLocked(
+	sub *pubsubSubscription,
+	req *pubsubpb.StreamingPullRequest,
+	now time.Time,
+) *pubsubpb.StreamingPullResponse {
+	if len(req.ModifyDeadlineAckIds) != len(req.ModifyDeadlineSeconds) {
+		return nil
+	}
+	ackedIDs, invalidAckIDs := p.acknowledgeLocked(sub, req.AckIds)
+	modifiedIDs := []string{}
+	invalidModifiedIDs := []string{}
+	for i, ackID := range req.ModifyDeadlineAckIds {
+		modified, invalid := p.modifyAckDeadlineLocked(sub, []string{ackID}, req.ModifyDeadlineSeconds[i], now)
+		modifiedIDs = append(modifiedIDs, modified...)
+		invalidModifiedIDs = append(invalidModifiedIDs, invalid...)
+	}
+	p.broadcastLocked()
+	if !sub.subscription.EnableExactlyOnceDelivery || (len(req.AckIds) == 0 && len(req.ModifyDeadlineAckIds) == 0) {
+		return nil
+	}
+	return &pubsubpb.StreamingPullResponse{
+		AcknowledgeConfirmation: &pubsubpb.StreamingPullResponse_AcknowledgeConfirmation{
+			AckIds:        ackedIDs,
+			InvalidAckIds: invalidAckIDs,
+		},
+		ModifyAckDeadlineConfirmation: &pubsubpb.StreamingPullResponse_ModifyAckDeadlineConfirmation{
+			AckIds:        modifiedIDs,
+			InvalidAckIds: invalidModifiedIDs,
+		},
+	}
+}
+
+// acknowledgeLocked acknowledges the messages for the provided ack IDs,
+// invalid ack IDs are only reported when exactly once delivery is enabled
+// as they are otherwise silently ignored.
+func (p *PubSub) acknowledgeLocked(sub *pubsubSubscription, ackIDs []string) ([]string, []string) {
+	acked := []string{}
+	invalid := []string{}
+	for _, ackID := range ackIDs {
+		message, ok := sub.ackIDs[ackID]
+		if ok && (!sub.subscription.EnableExactlyOnceDelivery || message.ackID == ackID) {
+			sub.remove(message)
+			acked = append(acked, ackID)
+		} else if sub.subscription.EnableExactlyOnceDelivery {
+			invalid = append(invalid, ackID)
+		}
+	}
+	return acked, invalid
+}
+
+func (p *PubSub) modifyAckDeadlineLocked(
+	sub *pubsubSubscription,
+	ackIDs []string,
+	deadlineSeconds int32,
+	now time.Time,
+) ([]string, []string) {
+	modified := []string{}
+	invalid := []string{}
+	for _, ackID := range ackIDs {
+		message, ok := sub.ackIDs[ackID]
+		if ok && message.ackID == ackID {
+			if deadlineSeconds == 0 {
+				p.nackLocked(sub, message, now)
+			} else {
+				message.leaseExpiry = now.Add(time.Duration(deadlineSeconds) * time.Second)
+			}
+			modified = append(modified, ackID)
+		} else if sub.subscription.EnableExactlyOnceDelivery {
+			invalid = append(invalid, ackID)
+		}
+	}
+	return modified, invalid
+}
+
+// deliverLocked leases available messages to a subscriber.
+// Messages that share an ordering key are delivered in publish order and a key
+// is paused while an earlier message for the key is waiting to be redelivered.
+func (p *PubSub) deliverLocked(
+	sub *pubsubSubscription,
+	maxMessages int,
+	maxBytes int64,
+	ackDeadline time.Duration,
+	now time.Time,
+) []*pubsubpb.ReceivedMessage {
+	p.expireLeasesLocked(sub, now)
+	sub.prune(now)
+	received := []*pubsubpb.ReceivedMessage{}
+	receivedBytes := int64(0)
+	pausedKeys := map[string]bool{}
+	i := 0
+	for len(received) < maxMessages && i < len(sub.pending) {
+		message := sub.pending[i]
+		i = i + 1
+		key := sub.orderingKey(message)
+		if message.ackID != "" {
+			continue
+		}
+		if key != "" && pausedKeys[key] {
+			continue
+		}
+		if message.availableAt.After(now) {
+			if key != "" {
+				pausedKeys[key] = true
+			}
+			continue
+		}
+		size := int64(len(message.message.Data))
+		if maxBytes > 0 && len(received) > 0 && receivedBytes+size > maxBytes {
+			break
+		}
+		receivedBytes = receivedBytes + size
+		received = append(received, p.leaseLocked(sub, message, ackDeadline, now))
+	}
+	return received
+}
+
+func (p *PubSub) leaseLocked(
+	sub *pubsubSubscription,
+	message *pubsubPendingMessage,
+	ackDeadline time.Duration,
+	now time.Time,
+) *pubsubpb.ReceivedMessage {
+	p.nextAckID = p.nextAckID + 1
+	ackID := fmt.Sprintf("%d-%d", message.seq, p.nextAckID)
+	message.deliveryAttempt = message.deliveryAttempt + 1
+	message.ackID = ackID
+	message.issuedAckIDs = append(message.issuedAckIDs, ackID)
+	message.leaseExpiry = now.Add(ackDeadline)
+	sub.ackIDs[ackID] = message
+	received := &pubsubpb.ReceivedMessage{
+		AckId:   ackID,
+		Message: message.message,
+	}
+	// The delivery attempt is only populated for subscriptions
+	// with a dead letter policy.
+	if sub.subscription.DeadLetterPolicy != nil {
+		received.DeliveryAttempt = message.deliveryAttempt
+	}
+	return received
+}
+
+// expireLeasesLocked treats every message whose ack deadline has passed
+// as if it had been nacked.
+func (p *PubSub) expireLeasesLocked(sub *pubsubSubscription, now time.Time) {
+	expired := []*pubsubPendingMessage{}
+	for _, message := range sub.pending {
+		if message.ackID != "" && !now.Before(message.leaseExpiry) {
+			expired = append(expired, message)
+		}
+	}
+	for _, message := range expired {
+		p.nackLocked(sub, message, now)
+	}
+}
+
+// nackLocked makes a message available for redelivery after the backoff
+// in the subscription's retry policy, or forwards it to the dead letter topic
+// once the maximum number of delivery attempts has been reached.
+func (p *PubSub) nackLocked(sub *pubsubSubscription, message *pubsubPendingMessage, now time.Time) {
+	if message.ackID == "" {
+		return
+	}
+	sub.endLease(message)
+	policy := sub.subscription.DeadLetterPolicy
+	if policy != nil && message.deliveryAttempt >= policy.MaxDeliveryAttempts {
+		p.deadLetterLocked(sub, message)
+		return
+	}
+	message.availableAt = now.Add(sub.backoff(message.deliveryAttempt))
+	key := sub.orderingKey(message)
+	if key == "" {
+		return
+	}
+	// Later messages with the same ordering key must not be processed before
+	// the nacked message, so they are redelivered once it has been redelivered.
+	for _, later := range sub.pending {
+		if later.seq > message.seq && sub.orderingKey(later) == key && later.ackID != "" {
+			sub.endLease(later)
+			later.availableAt = now
+		}
+	}
+}
+
+func (p *PubSub) deadLetterLocked(sub *pubsubSubscription, message *pubsubPendingMessage) {
+	sub.remove(message)
+	topic, exists := p.topics[sub.subscription.DeadLetterPolicy.DeadLetterTopic]
+	if !exists {
+		return
+	}
+	subNamePieces := strings.Split(sub.subscription.Name, "/")
+	forwarded := proto.Clone(message.message).(*pubsubpb.PubsubMessage)
+	if forwarded.Attributes == nil {
+		forwarded.Attributes = map[string]string{}
+	}
+	forwarded.Attributes["CloudPubSubDeadLetterSourceDeliveryCount"] = fmt.Sprintf("%d", message.deliveryAttempt)
+	forwarded.Attributes["CloudPubSubDeadLetterSourceSubscription"] = subNamePieces[len(subNamePieces)-1]
+	forwarded.Attributes["CloudPubSubDeadLetterSourceSubscriptionProject"] = subNamePieces[1]
+	forwarded.Attributes["CloudPubSubDeadLetterSourceTopicPublishTime"] = message.message.PublishTime.AsTime().Format(time.RFC3339Nano)
+	p.publishLocked(topic, []*pubsubpb.PubsubMessage{forwarded})
+}
+
+func (p *PubSub) getActiveSubscriptionLocked(name string) (*pubsubSubscription, error) {
+	sub, err := p.getSubscriptionLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if sub.subscription.Detached {
+		return nil, status.Errorf(codes.FailedPrecondition, "Subscription is detached from its topic")
+	}
+	return sub, nil
+}
+
+func waitForPubSubEvent(ctx context.Context, notify <-chan struct{}, next time.Duration, timeout <-chan time.Time) error {
+	var timerC <-chan time.Time
+	if next > 0 {
+		timer := time.NewTimer(next)
+		defer timer.Stop()
+		timerC = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return errPubSubPullTimeout
+	case <-notify:
+	case <-timerC:
+	}
+	return nil
+}
+
+// exactlyOnceAckError produces an error in the format client libraries
+// expect for failed acknowledgements with exactly once delivery enabled.
+func exactlyOnceAckError(invalidAckIDs []string) error {
+	metadata := map[string]string{}
+	for _, ackID := range invalidAckIDs {
+		metadata[ackID] = "PERMANENT_FAILURE_INVALID_ACK_ID"
+	}
+	st := status.New(codes.InvalidArgument, "Some acknowledgement ids in the request were invalid")
+	withDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "EXACTLY_ONCE_ACKID_FAILURE",
+		Domain:   "pubsub.googleapis.com",
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
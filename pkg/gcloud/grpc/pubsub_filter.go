@@ -0,0 +1,328 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// pubsubFilter determines whether a message with the provided attributes
+// should be delivered to a subscription.
+type pubsubFilter func(attributes map[string]string) bool
+
+const pubsubMaxFilterLength = 256
+
+// parsePubSubFilter parses a subscription filter expression as per
+// https://cloud.google.com/pubsub/docs/filtering,
+// a nil filter is returned for an empty expression.
+func parsePubSubFilter(expression string) (pubsubFilter, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+	if len(expression) > pubsubMaxFilterLength {
+		return nil, fmt.Errorf("filter expressions must not exceed %d bytes", pubsubMaxFilterLength)
+	}
+	tokens, err := tokenisePubSubFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &pubsubFilterParser{tokens: tokens}
+	filter, err := parser.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != pubsubTokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", parser.peek().value, parser.peek().pos)
+	}
+	return filter, nil
+}
+
+type pubsubTokenKind int
+
+const (
+	pubsubTokenEOF pubsubTokenKind = iota
+	pubsubTokenIdentifier
+	pubsubTokenString
+	pubsubTokenLeftParen
+	pubsubTokenRightParen
+	pubsubTokenComma
+	pubsubTokenColon
+	pubsubTokenDot
+	pubsubTokenEquals
+	pubsubTokenNotEquals
+	pubsubTokenMinus
+)
+
+type pubsubToken struct {
+	kind  pubsubTokenKind
+	value string
+	pos   int
+}
+
+func tokenisePubSubFilter(expression string) ([]pubsubToken, error) {
+	tokens := []pubsubToken{}
+	runes := []rune(expression)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i = i + 1
+		case r == '(':
+			tokens = append(tokens, pubsubToken{pubsubTokenLeftParen, "(", i})
+			i = i + 1
+		case r == ')':
+			tokens = append(tokens, pubsubToken{pubsubTokenRightParen, ")", i})
+			i = i + 1
+		case r == ',':
+			tokens = append(tokens, pubsubToken{pubsubTokenComma, ",", i})
+			i = i + 1
+		case r == ':':
+			tokens = append(tokens, pubsubToken{pubsubTokenColon, ":", i})
+			i = i + 1
+		case r == '.':
+			tokens = append(tokens, pubsubToken{pubsubTokenDot, ".", i})
+			i = i + 1
+		case r == '=':
+			tokens = append(tokens, pubsubToken{pubsubTokenEquals, "=", i})
+			i = i + 1
+		case r == '-':
+			tokens = append(tokens, pubsubToken{pubsubTokenMinus, "-", i})
+			i = i + 1
+		case r == '!':
+			if i+1 >= len(runes) || runes[i+1] != '=' {
+				return nil, fmt.Errorf("expected \"!=\" at position %d", i)
+			}
+			tokens = append(tokens, pubsubToken{pubsubTokenNotEquals, "!=", i})
+			i = i + 2
+		case r == '"' || r == '\'':
+			value, end, err := readPubSubFilterString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, pubsubToken{pubsubTokenString, value, i})
+			i = end
+		case isPubSubFilterIdentifierRune(r):
+			start := i
+			for i < len(runes) && isPubSubFilterIdentifierRune(runes[i]) {
+				i = i + 1
+			}
+			tokens = append(tokens, pubsubToken{pubsubTokenIdentifier, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, pubsubToken{pubsubTokenEOF, "", len(runes)}), nil
+}
+
+func readPubSubFilterString(runes []rune, start int) (string, int, error) {
+	quote := runes[start]
+	var value strings.Builder
+	i := start + 1
+	for i < len(runes) {
+		r := runes[i]
+		if r == '\\' && i+1 < len(runes) {
+			value.WriteRune(runes[i+1])
+			i = i + 2
+		} else if r == quote {
+			return value.String(), i + 1, nil
+		} else {
+			value.WriteRune(r)
+			i = i + 1
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+func isPubSubFilterIdentifierRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+type pubsubFilterParser struct {
+	tokens []pubsubToken
+	pos    int
+}
+
+func (p *pubsubFilterParser) peek() pubsubToken {
+	return p.tokens[p.pos]
+}
+
+func (p *pubsubFilterParser) next() pubsubToken {
+	token := p.tokens[p.pos]
+	if token.kind != pubsubTokenEOF {
+		p.pos = p.pos + 1
+	}
+	return token
+}
+
+func (p *pubsubFilterParser) expect(kind pubsubTokenKind, description string) (pubsubToken, error) {
+	token := p.next()
+	if token.kind != kind {
+		return token, fmt.Errorf("expected %s at position %d", description, token.pos)
+	}
+	return token, nil
+}
+
+func (p *pubsubFilterParser) isOperator(keyword string) bool {
+	token := p.peek()
+	return token.kind == pubsubTokenIdentifier && token.value == keyword
+}
+
+// parseExpression parses terms joined by AND or OR,
+// the two operators can not be mixed without parentheses.
+func (p *pubsubFilterParser) parseExpression() (pubsubFilter, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	operator := ""
+	for p.isOperator("AND") || p.isOperator("OR") {
+		token := p.next()
+		if operator != "" && operator != token.value {
+			return nil, fmt.Errorf("AND and OR can not be combined without parentheses at position %d", token.pos)
+		}
+		operator = token.value
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = combinePubSubFilters(operator, left, right)
+	}
+	return left, nil
+}
+
+func combinePubSubFilters(operator string, left pubsubFilter, right pubsubFilter) pubsubFilter {
+	if operator == "AND" {
+		return func(attributes map[string]string) bool {
+			return left(attributes) && right(attributes)
+		}
+	}
+	return func(attributes map[string]string) bool {
+		return left(attributes) || right(attributes)
+	}
+}
+
+func (p *pubsubFilterParser) parseTerm() (pubsubFilter, error) {
+	if p.isOperator("NOT") || p.peek().kind == pubsubTokenMinus {
+		p.next()
+		negated, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return func(attributes map[string]string) bool {
+			return !negated(attributes)
+		}, nil
+	}
+	return p.parseFactor()
+}
+
+func (p *pubsubFilterParser) parseFactor() (pubsubFilter, error) {
+	token := p.peek()
+	switch {
+	case token.kind == pubsubTokenLeftParen:
+		p.next()
+		inner, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(pubsubTokenRightParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case token.kind == pubsubTokenIdentifier && token.value == "hasPrefix":
+		return p.parseHasPrefix()
+	case token.kind == pubsubTokenIdentifier && token.value == "attributes":
+		return p.parseAttributeComparison()
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", token.value, token.pos)
+}
+
+func (p *pubsubFilterParser) parseHasPrefix() (pubsubFilter, error) {
+	p.next()
+	if _, err := p.expect(pubsubTokenLeftParen, "\"(\""); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(pubsubTokenIdentifier, "\"attributes\""); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(pubsubTokenDot, "\".\""); err != nil {
+		return nil, err
+	}
+	key, err := p.parseAttributeKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(pubsubTokenComma, "\",\""); err != nil {
+		return nil, err
+	}
+	prefix, err := p.expect(pubsubTokenString, "a string prefix")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(pubsubTokenRightParen, "\")\""); err != nil {
+		return nil, err
+	}
+	return func(attributes map[string]string) bool {
+		value, ok := attributes[key]
+		return ok && strings.HasPrefix(value, prefix.value)
+	}, nil
+}
+
+func (p *pubsubFilterParser) parseAttributeComparison() (pubsubFilter, error) {
+	p.next()
+	separator := p.next()
+	switch separator.kind {
+	case pubsubTokenColon:
+		// attributes:key checks whether an attribute exists.
+		key, err := p.parseAttributeKey()
+		if err != nil {
+			return nil, err
+		}
+		return func(attributes map[string]string) bool {
+			_, ok := attributes[key]
+			return ok
+		}, nil
+	case pubsubTokenDot:
+		key, err := p.parseAttributeKey()
+		if err != nil {
+			return nil, err
+		}
+		operator := p.next()
+		if operator.kind != pubsubTokenEquals && operator.kind != pubsubTokenNotEquals {
+			return nil, fmt.Errorf("expected \"=\" or \"!=\" at position %d", operator.pos)
+		}
+		value, err := p.expect(pubsubTokenString, "a string value")
+		if err != nil {
+			return nil, err
+		}
+		if operator.kind == pubsubTokenEquals {
+			return func(attributes map[string]string) bool {
+				actual, ok := attributes[key]
+				return ok && actual == value.value
+			}, nil
+		}
+		// Messages without the attribute do not match an inequality,
+		// "NOT attributes.key = value" must be used to include them.
+		return func(attributes map[string]string) bool {
+			actual, ok := attributes[key]
+			return ok && actual != value.value
+		}, nil
+	}
+	return nil, fmt.Errorf("expected \":\" or \".\" after attributes at position %d", separator.pos)
+}
+
+func (p *pubsubFilterParser) parseAttributeKey() (string, error) {
+	token := p.next()
+	if token.kind != pubsubTokenIdentifier && token.kind != pubsubTokenString {
+		return "", fmt.Errorf("expected an attribute key at position %d", token.pos)
+	}
+	return token.value, nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	. "gopkg.in/check.v1"
+
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PubSubSuite struct {
+	pubsub *PubSub
+	clock  time.Time
+}
+
+var _ = Suite(&PubSubSuite{})
+
+const (
+	testTopic         = "projects/test-project/topics/orders"
+	testDeadLetter    = "projects/test-project/topics/orders-dead-letter"
+	testSubscription  = "projects/test-project/subscriptions/orders-worker"
+	testDeadLetterSub = "projects/test-project/subscriptions/orders-dead-letter"
+)
+
+func (s *PubSubSuite) SetUpTest(c *C) {
+	pubsub, err := NewPubSub("127.0.0.1", &noopHostsService{})
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	s.clock = time.Date(2022, time.March, 1, 9, 0, 0, 0, time.UTC)
+	pubsub.now = func() time.Time {
+		return s.clock
+	}
+	s.pubsub = pubsub
+	s.createTopic(c, testTopic)
+}
+
+func (s *PubSubSuite) Test_filter_expressions(c *C) {
+	attributes := map[string]string{
+		"region":   "europe-west2",
+		"priority": "high",
+		"tenant":   "acme",
+	}
+	expectations := map[string]bool{
+		`attributes:region`:                                         true,
+		`attributes:missing`:                                        false,
+		`-attributes:missing`:                                       true,
+		`NOT attributes:region`:                                     false,
+		`attributes.priority = "high"`:                              true,
+		`attributes.priority != "high"`:                             false,
+		`attributes.missing != "high"`:                              false,
+		`NOT attributes.missing = "high"`:                           true,
+		`hasPrefix(attributes.region, "europe-")`:                   true,
+		`attributes.priority = "low" OR attributes.tenant = "acme"`: true,
+		`attributes:region AND attributes.tenant = "other"`:         false,
+		`(attributes.priority = "low" OR attributes:tenant) AND hasPrefix(attributes."region", "europe")`: true,
+	}
+	for expression, expected := range expectations {
+		filter, err := parsePubSubFilter(expression)
+		c.Assert(err, IsNil, Commentf("expression: %s", expression))
+		c.Assert(filter(attributes), Equals, expected, Commentf("expression: %s", expression))
+	}
+}
+
+func (s *PubSubSuite) Test_filter_expressions_that_mix_operators_without_parentheses_are_rejected(c *C) {
+	_, err := parsePubSubFilter(`attributes:a AND attributes:b OR attributes:c`)
+	c.Assert(err, NotNil)
+}
+
+func (s *PubSubSuite) Test_messages_that_do_not_match_the_filter_are_not_delivered(c *C) {
+	s.createSubscription(c, &pubsubpb.Subscription{
+		Name:   testSubscription,
+		Topic:  testTopic,
+		Filter: `attributes.priority = "high"`,
+	})
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("low"), Attributes: map[string]string{"priority": "low"}})
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("high"), Attributes: map[string]string{"priority": "high"}})
+
+	received := s.pull(c, testSubscription, 10)
+	c.Assert(messageData(received), DeepEquals, []string{"high"})
+}
+
+func (s *PubSubSuite) Test_ordered_messages_are_paused_and_redelivered_in_order_after_a_nack(c *C) {
+	s.createSubscription(c, &pubsubpb.Subscription{
+		Name:                  testSubscription,
+		Topic:                 testTopic,
+		EnableMessageOrdering: true,
+		RetryPolicy: &pubsubpb.RetryPolicy{
+			MinimumBackoff: durationpb.New(10 * time.Second),
+			MaximumBackoff: durationpb.New(60 * time.Second),
+		},
+	})
+	for i := 1; i <= 3; i++ {
+		s.publish(c, &pubsubpb.PubsubMessage{Data: []byte(fmt.Sprintf("order-%d", i)), OrderingKey: "customer-1"})
+	}
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("other"), OrderingKey: "customer-2"})
+
+	received := s.pull(c, testSubscription, 10)
+	c.Assert(messageData(received), DeepEquals, []string{"order-1", "order-2", "order-3", "other"})
+
+	_, err := s.pubsub.ModifyAckDeadline(context.Background(), &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       testSubscription,
+		AckIds:             []string{received[0].AckId},
+		AckDeadlineSeconds: 0,
+	})
+	c.Assert(err, IsNil)
+
+	// The ordering key is paused until the backoff for the nacked message has passed.
+	c.Assert(s.pull(c, testSubscription, 10), HasLen, 0)
+	s.clock = s.clock.Add(10 * time.Second)
+	redelivered := s.pull(c, testSubscription, 10)
+	c.Assert(messageData(redelivered), DeepEquals, []string{"order-1", "order-2", "order-3"})
+}
+
+func (s *PubSubSuite) Test_messages_are_forwarded_to_the_dead_letter_topic_after_max_delivery_attempts(c *C) {
+	s.createTopic(c, testDeadLetter)
+	s.createSubscription(c, &pubsubpb.Subscription{
+		Name:  testDeadLetterSub,
+		Topic: testDeadLetter,
+	})
+	s.createSubscription(c, &pubsubpb.Subscription{
+		Name:  testSubscription,
+		Topic: testTopic,
+		DeadLetterPolicy: &pubsubpb.DeadLetterPolicy{
+			DeadLetterTopic:     testDeadLetter,
+			MaxDeliveryAttempts: 5,
+		},
+	})
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("poison")})
+
+	for attempt := int32(1); attempt <= 5; attempt++ {
+		received := s.pull(c, testSubscription, 1)
+		c.Assert(received, HasLen, 1)
+		c.Assert(received[0].DeliveryAttempt, Equals, attempt)
+		// Let the ack deadline expire instead of acknowledging the message.
+		s.clock = s.clock.Add(pubsubDefaultAckDeadline)
+	}
+
+	c.Assert(s.pull(c, testSubscription, 1), HasLen, 0)
+	deadLettered := s.pull(c, testDeadLetterSub, 1)
+	c.Assert(messageData(deadLettered), DeepEquals, []string{"poison"})
+	attributes := deadLettered[0].Message.Attributes
+	c.Assert(attributes["CloudPubSubDeadLetterSourceDeliveryCount"], Equals, "5")
+	c.Assert(attributes["CloudPubSubDeadLetterSourceSubscription"], Equals, "orders-worker")
+}
+
+func (s *PubSubSuite) Test_exactly_once_delivery_rejects_expired_ack_ids(c *C) {
+	s.createSubscription(c, &pubsubpb.Subscription{
+		Name:                      testSubscription,
+		Topic:                     testTopic,
+		EnableExactlyOnceDelivery: true,
+	})
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("payment")})
+
+	first := s.pull(c, testSubscription, 1)
+	s.clock = s.clock.Add(pubsubDefaultAckDeadline)
+	second := s.pull(c, testSubscription, 1)
+	c.Assert(second, HasLen, 1)
+
+	_, err := s.pubsub.Acknowledge(context.Background(), &pubsubpb.AcknowledgeRequest{
+		Subscription: testSubscription,
+		AckIds:       []string{first[0].AckId},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	_, err = s.pubsub.Acknowledge(context.Background(), &pubsubpb.AcknowledgeRequest{
+		Subscription: testSubscription,
+		AckIds:       []string{second[0].AckId},
+	})
+	c.Assert(err, IsNil)
+	s.clock = s.clock.Add(pubsubDefaultAckDeadline)
+	c.Assert(s.pull(c, testSubscription, 1), HasLen, 0)
+}
+
+func (s *PubSubSuite) Test_seek_to_snapshot_restores_acknowledged_messages(c *C) {
+	s.createSubscription(c, &pubsubpb.Subscription{
+		Name:  testSubscription,
+		Topic: testTopic,
+	})
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("first")})
+	_, err := s.pubsub.CreateSnapshot(context.Background(), &pubsubpb.CreateSnapshotRequest{
+		Name:         "projects/test-project/snapshots/before-processing",
+		Subscription: testSubscription,
+	})
+	c.Assert(err, IsNil)
+	s.publish(c, &pubsubpb.PubsubMessage{Data: []byte("second")})
+	s.ackAll(c, s.pull(c, testSubscription, 10))
+
+	_, err = s.pubsub.Seek(context.Background(), &pubsubpb.SeekRequest{
+		Subscription: testSubscription,
+		Target: &pubsubpb.SeekRequest_Snapshot{
+			Snapshot: "projects/test-project/snapshots/before-processing",
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(messageData(s.pull(c, testSubscription, 10)), DeepEquals, []string{"first", "second"})
+}
+
+func (s *PubSubSuite) createTopic(c *C, name string) {
+	_, err := s.pubsub.CreateTopic(context.Background(), &pubsubpb.Topic{Name: name})
+	c.Assert(err, IsNil)
+}
+
+func (s *PubSubSuite) createSubscription(c *C, subscription *pubsubpb.Subscription) {
+	_, err := s.pubsub.CreateSubscription(context.Background(), subscription)
+	c.Assert(err, IsNil)
+}
+
+func (s *PubSubSuite) publish(c *C, message *pubsubpb.PubsubMessage) {
+	_, err := s.pubsub.Publish(context.Background(), &pubsubpb.PublishRequest{
+		Topic:    testTopic,
+		Messages: []*pubsubpb.PubsubMessage{message},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *PubSubSuite) pull(c *C, subscription string, maxMessages int32) []*pubsubpb.ReceivedMessage {
+	response, err := s.pubsub.Pull(context.Background(), &pubsubpb.PullRequest{
+		Subscription:      subscription,
+		MaxMessages:       maxMessages,
+		ReturnImmediately: true,
+	})
+	c.Assert(err, IsNil)
+	return response.ReceivedMessages
+}
+
+func (s *PubSubSuite) ackAll(c *C, received []*pubsubpb.ReceivedMessage) {
+	ackIDs := []string{}
+	for _, message := range received {
+		ackIDs = append(ackIDs, message.AckId)
+	}
+	_, err := s.pubsub.Acknowledge(context.Background(), &pubsubpb.AcknowledgeRequest{
+		Subscription: testSubscription,
+		AckIds:       ackIDs,
+	})
+	c.Assert(err, IsNil)
+}
+
+func messageData(received []*pubsubpb.ReceivedMessage) []string {
+	data := []string{}
+	for _, message := range received {
+		data = append(data, string(message.Message.Data))
+	}
+	return data
+}
+
+type noopHostsService struct{}
+
+func (m *noopHostsService) Add(params *hosts.Params) error {
+	return nil
+}
+
+func (m *noopHostsService) Remove(params *hosts.Params) error {
+	return nil
+}
@@ -0,0 +1,617 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/iam"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+)
+
+// ResourceManager provides a gRPC Resource Manager service for the projects
+// and folders that resources in the other emulators belong to.
+// Projects are stored by ID, project numbers are derived from the ID
+// so they are stable across restarts and match the number reported by
+// the metadata server.
+type ResourceManager struct {
+	mu          sync.Mutex
+	dataRootDir string
+	fs          afero.Fs
+	strict      bool
+	iamPolicy   iampb.IAMPolicyServer
+	now         func() time.Time
+}
+
+const (
+	resourceManagerProjectFile = "project.json"
+	resourceManagerFolderFile  = "folder.json"
+)
+
+var (
+	resourceManagerLocalHost = "cloudresourcemanager.googleapis.local"
+	projectIDPattern         = regexp.MustCompile(`^[a-z][-a-z0-9]{4,28}[a-z0-9]$`)
+	projectNumberPattern     = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// NewResourceManager creates an instance of the Cloud::1 Resource Manager implementation,
+// the provided project is created when it doesn't already exist.
+// In strict mode requests to other emulators are rejected when the project
+// they name doesn't exist or has been deleted.
+func NewResourceManager(
+	dataRootDir string,
+	fs afero.Fs,
+	projectID string,
+	strict bool,
+	iamPolicy iampb.IAMPolicyServer,
+	ip string,
+	hostsService hosts.Service,
+) (*ResourceManager, error) {
+	err := fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &resourceManagerLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &ResourceManager{
+		dataRootDir: dataRootDir,
+		fs:          fs,
+		strict:      strict,
+		iamPolicy:   iamPolicy,
+		now:         time.Now,
+	}
+	err = r.seedProject(projectID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ResourceManager) seedProject(projectID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exists, err := r.resourceExistsLocked("projects/"+projectID, resourceManagerProjectFile)
+	if err != nil || exists {
+		return err
+	}
+	now := timestamppb.New(r.now())
+	return r.writeProjectLocked(&resourcemanagerpb.Project{
+		Name:        projectName(projectID),
+		ProjectId:   projectID,
+		State:       resourcemanagerpb.Project_ACTIVE,
+		DisplayName: projectID,
+		CreateTime:  now,
+		UpdateTime:  now,
+	})
+}
+
+// GetProject retrieves a project by its ID or number.
+func (r *ResourceManager) GetProject(ctx context.Context, req *resourcemanagerpb.GetProjectRequest) (*resourcemanagerpb.Project, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.getProjectLocked(req.Name)
+}
+
+// ListProjects deals with listing the projects that are direct children of a folder or organization.
+func (r *ResourceManager) ListProjects(ctx context.Context, req *resourcemanagerpb.ListProjectsRequest) (*resourcemanagerpb.ListProjectsResponse, error) {
+	if req.Parent == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A parent must be provided")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	projects, err := r.listProjectsLocked(func(project *resourcemanagerpb.Project) bool {
+		return project.Parent == req.Parent &&
+			(req.ShowDeleted || project.State == resourcemanagerpb.Project_ACTIVE)
+	})
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := pagination.Page(len(projects), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resourcemanagerpb.ListProjectsResponse{
+		Projects:      projects[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// SearchProjects deals with finding projects that match a query made up of
+// field:value terms, projects that have been deleted are only included
+// when the query filters by state.
+func (r *ResourceManager) SearchProjects(ctx context.Context, req *resourcemanagerpb.SearchProjectsRequest) (*resourcemanagerpb.SearchProjectsResponse, error) {
+	terms, err := parseSearchQuery(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matchErr error
+	projects, err := r.listProjectsLocked(func(project *resourcemanagerpb.Project) bool {
+		matches, err := terms.matches(
+			project.State == resourcemanagerpb.Project_ACTIVE,
+			func(field string) ([]string, bool) {
+				return projectSearchValues(project, field)
+			},
+		)
+		if err != nil {
+			matchErr = err
+		}
+		return matches
+	})
+	if err != nil {
+		return nil, err
+	}
+	if matchErr != nil {
+		return nil, matchErr
+	}
+	start, end, nextPageToken, err := pagination.Page(len(projects), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resourcemanagerpb.SearchProjectsResponse{
+		Projects:      projects[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// CreateProject deals with creating a project, the operation that is returned has
+// already completed. When IAM is enabled the caller is made owner of the project.
+func (r *ResourceManager) CreateProject(ctx context.Context, req *resourcemanagerpb.CreateProjectRequest) (*longrunningpb.Operation, error) {
+	if req.Project == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A project must be provided")
+	}
+	if !projectIDPattern.MatchString(req.Project.ProjectId) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"Project ID %q must be 6 to 30 lowercase letters, digits, or hyphens, start with a letter"+
+				" and not end with a hyphen",
+			req.Project.ProjectId,
+		)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.validateParentLocked(req.Project.Parent)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := r.resourceExistsLocked("projects/"+req.Project.ProjectId, resourceManagerProjectFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, status.Errorf(
+			codes.AlreadyExists,
+			"The project ID you specified is already in use by another project. Please try an alternative ID.",
+		)
+	}
+	now := timestamppb.New(r.now())
+	project := &resourcemanagerpb.Project{
+		Name:        projectName(req.Project.ProjectId),
+		Parent:      req.Project.Parent,
+		ProjectId:   req.Project.ProjectId,
+		State:       resourcemanagerpb.Project_ACTIVE,
+		DisplayName: req.Project.DisplayName,
+		CreateTime:  now,
+		UpdateTime:  now,
+		Labels:      req.Project.Labels,
+	}
+	err = r.writeProjectLocked(project)
+	if err != nil {
+		return nil, err
+	}
+	err = r.seedProjectOwner(ctx, project.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("cp", &resourcemanagerpb.CreateProjectMetadata{
+		CreateTime: now,
+		Gettable:   true,
+		Ready:      true,
+	}, project)
+}
+
+// UpdateProject deals with updating the display name and labels of a project,
+// both fields are replaced when an update mask isn't provided.
+func (r *ResourceManager) UpdateProject(ctx context.Context, req *resourcemanagerpb.UpdateProjectRequest) (*longrunningpb.Operation, error) {
+	if req.Project == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A project must be provided")
+	}
+	paths := []string{"display_name", "labels"}
+	if req.UpdateMask != nil && len(req.UpdateMask.Paths) > 0 {
+		paths = req.UpdateMask.Paths
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	project, err := r.getActiveProjectLocked(req.Project.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Project.Etag != "" && req.Project.Etag != project.Etag {
+		return nil, status.Errorf(codes.Aborted, "The etag %s does not match the current project etag", req.Project.Etag)
+	}
+	for _, field := range paths {
+		switch field {
+		case "display_name", "displayName":
+			project.DisplayName = req.Project.DisplayName
+		case "labels":
+			project.Labels = req.Project.Labels
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Update mask must only contain mutable fields, %s can not be updated", field)
+		}
+	}
+	project.UpdateTime = timestamppb.New(r.now())
+	err = r.writeProjectLocked(project)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("up", &resourcemanagerpb.UpdateProjectMetadata{}, project)
+}
+
+// MoveProject deals with moving a project to a different folder or organization.
+func (r *ResourceManager) MoveProject(ctx context.Context, req *resourcemanagerpb.MoveProjectRequest) (*longrunningpb.Operation, error) {
+	if req.DestinationParent == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A destination parent must be provided")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	project, err := r.getActiveProjectLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = r.validateParentLocked(req.DestinationParent)
+	if err != nil {
+		return nil, err
+	}
+	project.Parent = req.DestinationParent
+	project.UpdateTime = timestamppb.New(r.now())
+	err = r.writeProjectLocked(project)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("mp", &resourcemanagerpb.MoveProjectMetadata{}, project)
+}
+
+// DeleteProject deals with marking a project for deletion, the project
+// and the resources that belong to it are kept so it can be restored.
+func (r *ResourceManager) DeleteProject(ctx context.Context, req *resourcemanagerpb.DeleteProjectRequest) (*longrunningpb.Operation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	project, err := r.getActiveProjectLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.New(r.now())
+	project.State = resourcemanagerpb.Project_DELETE_REQUESTED
+	project.DeleteTime = now
+	project.UpdateTime = now
+	err = r.writeProjectLocked(project)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("dp", &resourcemanagerpb.DeleteProjectMetadata{}, project)
+}
+
+// UndeleteProject deals with restoring a project that has been marked for deletion.
+func (r *ResourceManager) UndeleteProject(ctx context.Context, req *resourcemanagerpb.UndeleteProjectRequest) (*longrunningpb.Operation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	project, err := r.getProjectLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if project.State != resourcemanagerpb.Project_DELETE_REQUESTED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Project %s has not been deleted", project.ProjectId)
+	}
+	project.State = resourcemanagerpb.Project_ACTIVE
+	project.DeleteTime = nil
+	project.UpdateTime = timestamppb.New(r.now())
+	err = r.writeProjectLocked(project)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("udp", &resourcemanagerpb.UndeleteProjectMetadata{}, project)
+}
+
+// GetIamPolicy retrieves the IAM policy for a project or folder.
+func (r *ResourceManager) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	resource, err := r.checkPolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	policyReq := proto.Clone(req).(*iampb.GetIamPolicyRequest)
+	policyReq.Resource = resource
+	return r.iamPolicy.GetIamPolicy(ctx, policyReq)
+}
+
+// SetIamPolicy deals with setting the IAM policy for a project or folder.
+func (r *ResourceManager) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	resource, err := r.checkPolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	policyReq := proto.Clone(req).(*iampb.SetIamPolicyRequest)
+	policyReq.Resource = resource
+	return r.iamPolicy.SetIamPolicy(ctx, policyReq)
+}
+
+// TestIamPermissions checks the permissions the caller has for a project or folder.
+func (r *ResourceManager) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	resource, err := r.checkPolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	policyReq := proto.Clone(req).(*iampb.TestIamPermissionsRequest)
+	policyReq.Resource = resource
+	return r.iamPolicy.TestIamPermissions(ctx, policyReq)
+}
+
+// ResourceParent retrieves the folder or organization a project or folder belongs to
+// so IAM policies are inherited through the folders, resources that don't exist
+// and projects without a parent have no parent.
+func (r *ResourceManager) ResourceParent(resource string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if strings.HasPrefix(resource, "folders/") {
+		folder, err := r.getFolderLocked(resource)
+		return existingParent(folder.GetParent(), err)
+	}
+	if strings.HasPrefix(resource, "projects/") {
+		project, err := r.getProjectLocked(resource)
+		return existingParent(project.GetParent(), err)
+	}
+	return "", nil
+}
+
+func existingParent(parent string, err error) (string, error) {
+	if status.Code(err) == codes.NotFound || status.Code(err) == codes.InvalidArgument {
+		return "", nil
+	}
+	return parent, err
+}
+
+// checkPolicyResource ensures IAM policies are managed by the emulator and that
+// the project or folder exists, policies for projects are always stored against
+// the project ID.
+func (r *ResourceManager) checkPolicyResource(resource string) (string, error) {
+	if r.iamPolicy == nil {
+		return "", status.Errorf(codes.Unimplemented, "IAM policies are only supported when IAM is enabled")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if strings.HasPrefix(resource, "folders/") {
+		_, err := r.getActiveFolderLocked(resource)
+		return resource, err
+	}
+	project, err := r.getActiveProjectLocked(resource)
+	if err != nil {
+		return "", err
+	}
+	return "projects/" + project.ProjectId, nil
+}
+
+func (r *ResourceManager) seedProjectOwner(ctx context.Context, projectID string) error {
+	member, ok := iam.PrincipalFromContext(ctx)
+	if r.iamPolicy == nil || !ok {
+		return nil
+	}
+	_, err := r.iamPolicy.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{
+		Resource: "projects/" + projectID,
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{{Role: "roles/owner", Members: []string{member}}},
+		},
+	})
+	return err
+}
+
+// getProjectLocked retrieves a project from a name that contains
+// either the project ID or number. (e.g. projects/my-project or projects/123456789012)
+func (r *ResourceManager) getProjectLocked(name string) (*resourcemanagerpb.Project, error) {
+	pieces := strings.Split(name, "/")
+	if len(pieces) != 2 || pieces[0] != "projects" || pieces[1] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid project name: %s", name)
+	}
+	projectID, err := r.projectIDLocked(pieces[1])
+	if err != nil {
+		return nil, err
+	}
+	project := &resourcemanagerpb.Project{}
+	err = r.readResourceLocked("projects/"+projectID, resourceManagerProjectFile, project)
+	if status.Code(err) == codes.NotFound {
+		return nil, status.Errorf(codes.NotFound, "Project %s not found", pieces[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+func (r *ResourceManager) getActiveProjectLocked(name string) (*resourcemanagerpb.Project, error) {
+	project, err := r.getProjectLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if project.State != resourcemanagerpb.Project_ACTIVE {
+		return nil, status.Errorf(codes.FailedPrecondition, "Project %s has been deleted", project.ProjectId)
+	}
+	return project, nil
+}
+
+// projectIDLocked resolves a project number to the ID of the project it belongs to,
+// project IDs and numbers that don't belong to a project are returned as they are.
+func (r *ResourceManager) projectIDLocked(projectIDOrNumber string) (string, error) {
+	if !projectNumberPattern.MatchString(projectIDOrNumber) {
+		return projectIDOrNumber, nil
+	}
+	entries, err := afero.ReadDir(r.fs, path.Join(r.dataRootDir, "projects"))
+	if os.IsNotExist(err) {
+		return projectIDOrNumber, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && projectNumber(entry.Name()) == projectIDOrNumber {
+			return entry.Name(), nil
+		}
+	}
+	return projectIDOrNumber, nil
+}
+
+// listProjectsLocked produces the projects that match the provided filter ordered by project ID.
+func (r *ResourceManager) listProjectsLocked(filter func(*resourcemanagerpb.Project) bool) ([]*resourcemanagerpb.Project, error) {
+	entries, err := afero.ReadDir(r.fs, path.Join(r.dataRootDir, "projects"))
+	if os.IsNotExist(err) {
+		return []*resourcemanagerpb.Project{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	projects := []*resourcemanagerpb.Project{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		project := &resourcemanagerpb.Project{}
+		err = r.readResourceLocked("projects/"+entry.Name(), resourceManagerProjectFile, project)
+		if err != nil {
+			return nil, err
+		}
+		if filter(project) {
+			projects = append(projects, project)
+		}
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].ProjectId < projects[j].ProjectId
+	})
+	return projects, nil
+}
+
+func (r *ResourceManager) writeProjectLocked(project *resourcemanagerpb.Project) error {
+	project.Etag = ""
+	project.Etag = resourceManagerEtag(project)
+	return r.writeResourceLocked("projects/"+project.ProjectId, resourceManagerProjectFile, project)
+}
+
+// validateParentLocked ensures the parent of a project or folder is either
+// an organization or a folder that exists, projects don't need to have a parent.
+func (r *ResourceManager) validateParentLocked(parent string) error {
+	if parent == "" {
+		return nil
+	}
+	pieces := strings.Split(parent, "/")
+	if len(pieces) != 2 || !projectNumberPattern.MatchString(pieces[1]) {
+		return status.Errorf(codes.InvalidArgument, "Invalid parent: %s", parent)
+	}
+	switch pieces[0] {
+	case "organizations":
+		return nil
+	case "folders":
+		_, err := r.getActiveFolderLocked(parent)
+		return err
+	}
+	return status.Errorf(codes.InvalidArgument, "Invalid parent: %s, must be a folder or organization", parent)
+}
+
+func (r *ResourceManager) resourceDir(name string) string {
+	return path.Join(r.dataRootDir, name)
+}
+
+func (r *ResourceManager) resourceExistsLocked(name string, fileName string) (bool, error) {
+	return afero.Exists(r.fs, path.Join(r.resourceDir(name), fileName))
+}
+
+func (r *ResourceManager) readResourceLocked(name string, fileName string, resource proto.Message) error {
+	bytes, err := afero.ReadFile(r.fs, path.Join(r.resourceDir(name), fileName))
+	if os.IsNotExist(err) {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(bytes, resource)
+}
+
+func (r *ResourceManager) writeResourceLocked(name string, fileName string, resource proto.Message) error {
+	err := r.fs.MkdirAll(r.resourceDir(name), 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := protojson.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(r.fs, path.Join(r.resourceDir(name), fileName), bytes, 0755)
+}
+
+// projectNumber derives the number of a project from its ID in the same way
+// as the metadata server, the last 12 digits of the unique ID for the project.
+func projectNumber(projectID string) string {
+	uniqueID := tokens.UniqueID(projectID)
+	return uniqueID[len(uniqueID)-12:]
+}
+
+func projectName(projectID string) string {
+	return "projects/" + projectNumber(projectID)
+}
+
+func resourceManagerEtag(message proto.Message) string {
+	messageBytes, _ := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	digest := sha256.Sum256(messageBytes)
+	return fmt.Sprintf("W/%q", base64.RawURLEncoding.EncodeToString(digest[:12]))
+}
+
+// resourceManagerOperation wraps the result of a Resource Manager method
+// in an operation that has already completed.
+func resourceManagerOperation(kind string, metadata proto.Message, response proto.Message) (*longrunningpb.Operation, error) {
+	metadataAny, err := anypb.New(metadata)
+	if err != nil {
+		return nil, err
+	}
+	responseAny, err := anypb.New(response)
+	if err != nil {
+		return nil, err
+	}
+	return &longrunningpb.Operation{
+		Name:     fmt.Sprintf("operations/%s.%s", kind, uuid.New().String()),
+		Metadata: metadataAny,
+		Done:     true,
+		Result:   &longrunningpb.Operation_Response{Response: responseAny},
+	}, nil
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+)
+
+// GetFolder retrieves a folder by its name. (e.g. folders/123456789012)
+func (r *ResourceManager) GetFolder(ctx context.Context, req *resourcemanagerpb.GetFolderRequest) (*resourcemanagerpb.Folder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.getFolderLocked(req.Name)
+}
+
+// ListFolders deals with listing the folders that are direct children of a folder or organization.
+func (r *ResourceManager) ListFolders(ctx context.Context, req *resourcemanagerpb.ListFoldersRequest) (*resourcemanagerpb.ListFoldersResponse, error) {
+	if req.Parent == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A parent must be provided")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	folders, err := r.listFoldersLocked(func(folder *resourcemanagerpb.Folder) bool {
+		return folder.Parent == req.Parent &&
+			(req.ShowDeleted || folder.State == resourcemanagerpb.Folder_ACTIVE)
+	})
+	if err != nil {
+		return nil, err
+	}
+	start, end, nextPageToken, err := pagination.Page(len(folders), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resourcemanagerpb.ListFoldersResponse{
+		Folders:       folders[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// SearchFolders deals with finding folders that match a query made up of field:value terms.
+func (r *ResourceManager) SearchFolders(ctx context.Context, req *resourcemanagerpb.SearchFoldersRequest) (*resourcemanagerpb.SearchFoldersResponse, error) {
+	terms, err := parseSearchQuery(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matchErr error
+	folders, err := r.listFoldersLocked(func(folder *resourcemanagerpb.Folder) bool {
+		matches, err := terms.matches(
+			folder.State == resourcemanagerpb.Folder_ACTIVE,
+			func(field string) ([]string, bool) {
+				return folderSearchValues(folder, field)
+			},
+		)
+		if err != nil {
+			matchErr = err
+		}
+		return matches
+	})
+	if err != nil {
+		return nil, err
+	}
+	if matchErr != nil {
+		return nil, matchErr
+	}
+	start, end, nextPageToken, err := pagination.Page(len(folders), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resourcemanagerpb.SearchFoldersResponse{
+		Folders:       folders[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// CreateFolder deals with creating a folder in an organization or another folder,
+// display names must be unique among the active folders with the same parent.
+func (r *ResourceManager) CreateFolder(ctx context.Context, req *resourcemanagerpb.CreateFolderRequest) (*longrunningpb.Operation, error) {
+	if req.Folder == nil || req.Folder.Parent == "" || req.Folder.DisplayName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A folder with a parent and display name must be provided")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.validateParentLocked(req.Folder.Parent)
+	if err != nil {
+		return nil, err
+	}
+	err = r.checkFolderDisplayNameLocked("", req.Folder.Parent, req.Folder.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	name, err := r.newFolderNameLocked()
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.New(r.now())
+	folder := &resourcemanagerpb.Folder{
+		Name:        name,
+		Parent:      req.Folder.Parent,
+		DisplayName: req.Folder.DisplayName,
+		State:       resourcemanagerpb.Folder_ACTIVE,
+		CreateTime:  now,
+		UpdateTime:  now,
+	}
+	err = r.writeFolderLocked(folder)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("cf", &resourcemanagerpb.CreateFolderMetadata{
+		DisplayName: folder.DisplayName,
+		Parent:      folder.Parent,
+	}, folder)
+}
+
+// UpdateFolder deals with renaming a folder, the display name is the only mutable field.
+func (r *ResourceManager) UpdateFolder(ctx context.Context, req *resourcemanagerpb.UpdateFolderRequest) (*longrunningpb.Operation, error) {
+	if req.Folder == nil || req.UpdateMask == nil || len(req.UpdateMask.Paths) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "A folder and update mask must be provided")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	folder, err := r.getActiveFolderLocked(req.Folder.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Folder.Etag != "" && req.Folder.Etag != folder.Etag {
+		return nil, status.Errorf(codes.Aborted, "The etag %s does not match the current folder etag", req.Folder.Etag)
+	}
+	for _, field := range req.UpdateMask.Paths {
+		if field != "display_name" && field != "displayName" {
+			return nil, status.Errorf(codes.InvalidArgument, "Update mask must only contain mutable fields, %s can not be updated", field)
+		}
+	}
+	if req.Folder.DisplayName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A folder must have a display name")
+	}
+	err = r.checkFolderDisplayNameLocked(folder.Name, folder.Parent, req.Folder.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	folder.DisplayName = req.Folder.DisplayName
+	folder.UpdateTime = timestamppb.New(r.now())
+	err = r.writeFolderLocked(folder)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("uf", &resourcemanagerpb.UpdateFolderMetadata{}, folder)
+}
+
+// MoveFolder deals with moving a folder to a different folder or organization,
+// a folder can not be moved into itself or one of its descendants.
+func (r *ResourceManager) MoveFolder(ctx context.Context, req *resourcemanagerpb.MoveFolderRequest) (*longrunningpb.Operation, error) {
+	if req.DestinationParent == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A destination parent must be provided")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	folder, err := r.getActiveFolderLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = r.validateParentLocked(req.DestinationParent)
+	if err != nil {
+		return nil, err
+	}
+	ancestor := req.DestinationParent
+	for strings.HasPrefix(ancestor, "folders/") {
+		if ancestor == folder.Name {
+			return nil, status.Errorf(codes.FailedPrecondition, "Folder %s can not be moved into itself or one of its descendants", folder.Name)
+		}
+		parent, err := r.getFolderLocked(ancestor)
+		if err != nil {
+			return nil, err
+		}
+		ancestor = parent.Parent
+	}
+	err = r.checkFolderDisplayNameLocked(folder.Name, req.DestinationParent, folder.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &resourcemanagerpb.MoveFolderMetadata{
+		DisplayName:       folder.DisplayName,
+		SourceParent:      folder.Parent,
+		DestinationParent: req.DestinationParent,
+	}
+	folder.Parent = req.DestinationParent
+	folder.UpdateTime = timestamppb.New(r.now())
+	err = r.writeFolderLocked(folder)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("mf", metadata, folder)
+}
+
+// DeleteFolder deals with marking a folder for deletion,
+// only folders without active projects or folders can be deleted.
+func (r *ResourceManager) DeleteFolder(ctx context.Context, req *resourcemanagerpb.DeleteFolderRequest) (*longrunningpb.Operation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	folder, err := r.getActiveFolderLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	children, err := r.listFoldersLocked(func(child *resourcemanagerpb.Folder) bool {
+		return child.Parent == folder.Name && child.State == resourcemanagerpb.Folder_ACTIVE
+	})
+	if err != nil {
+		return nil, err
+	}
+	projects, err := r.listProjectsLocked(func(project *resourcemanagerpb.Project) bool {
+		return project.Parent == folder.Name && project.State == resourcemanagerpb.Project_ACTIVE
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(children) > 0 || len(projects) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Folder %s is not empty", folder.Name)
+	}
+	now := timestamppb.New(r.now())
+	folder.State = resourcemanagerpb.Folder_DELETE_REQUESTED
+	folder.DeleteTime = now
+	folder.UpdateTime = now
+	err = r.writeFolderLocked(folder)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("df", &resourcemanagerpb.DeleteFolderMetadata{}, folder)
+}
+
+// UndeleteFolder deals with restoring a folder that has been marked for deletion.
+func (r *ResourceManager) UndeleteFolder(ctx context.Context, req *resourcemanagerpb.UndeleteFolderRequest) (*longrunningpb.Operation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	folder, err := r.getFolderLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if folder.State != resourcemanagerpb.Folder_DELETE_REQUESTED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Folder %s has not been deleted", folder.Name)
+	}
+	err = r.validateParentLocked(folder.Parent)
+	if err != nil {
+		return nil, err
+	}
+	err = r.checkFolderDisplayNameLocked(folder.Name, folder.Parent, folder.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	folder.State = resourcemanagerpb.Folder_ACTIVE
+	folder.DeleteTime = nil
+	folder.UpdateTime = timestamppb.New(r.now())
+	err = r.writeFolderLocked(folder)
+	if err != nil {
+		return nil, err
+	}
+	return resourceManagerOperation("udf", &resourcemanagerpb.UndeleteFolderMetadata{}, folder)
+}
+
+func (r *ResourceManager) getFolderLocked(name string) (*resourcemanagerpb.Folder, error) {
+	pieces := strings.Split(name, "/")
+	if len(pieces) != 2 || pieces[0] != "folders" || !projectNumberPattern.MatchString(pieces[1]) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid folder name: %s", name)
+	}
+	folder := &resourcemanagerpb.Folder{}
+	err := r.readResourceLocked(name, resourceManagerFolderFile, folder)
+	if status.Code(err) == codes.NotFound {
+		return nil, status.Errorf(codes.NotFound, "Folder %s not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+func (r *ResourceManager) getActiveFolderLocked(name string) (*resourcemanagerpb.Folder, error) {
+	folder, err := r.getFolderLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if folder.State != resourcemanagerpb.Folder_ACTIVE {
+		return nil, status.Errorf(codes.FailedPrecondition, "Folder %s has been deleted", name)
+	}
+	return folder, nil
+}
+
+// checkFolderDisplayNameLocked ensures no other active folder
+// with the same parent has the provided display name.
+func (r *ResourceManager) checkFolderDisplayNameLocked(name string, parent string, displayName string) error {
+	siblings, err := r.listFoldersLocked(func(folder *resourcemanagerpb.Folder) bool {
+		return folder.Name != name && folder.Parent == parent &&
+			folder.State == resourcemanagerpb.Folder_ACTIVE && folder.DisplayName == displayName
+	})
+	if err != nil {
+		return err
+	}
+	if len(siblings) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "A folder named %q already exists in %s", displayName, parent)
+	}
+	return nil
+}
+
+// listFoldersLocked produces the folders that match the provided filter ordered by name.
+func (r *ResourceManager) listFoldersLocked(filter func(*resourcemanagerpb.Folder) bool) ([]*resourcemanagerpb.Folder, error) {
+	entries, err := afero.ReadDir(r.fs, path.Join(r.dataRootDir, "folders"))
+	if os.IsNotExist(err) {
+		return []*resourcemanagerpb.Folder{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	folders := []*resourcemanagerpb.Folder{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		folder := &resourcemanagerpb.Folder{}
+		err = r.readResourceLocked("folders/"+entry.Name(), resourceManagerFolderFile, folder)
+		if err != nil {
+			return nil, err
+		}
+		if filter(folder) {
+			folders = append(folders, folder)
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].Name < folders[j].Name
+	})
+	return folders, nil
+}
+
+func (r *ResourceManager) writeFolderLocked(folder *resourcemanagerpb.Folder) error {
+	folder.Etag = ""
+	folder.Etag = resourceManagerEtag(folder)
+	return r.writeResourceLocked(folder.Name, resourceManagerFolderFile, folder)
+}
+
+// newFolderNameLocked generates a name for a folder with a random 12 digit ID.
+func (r *ResourceManager) newFolderNameLocked() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(900000000000))
+		if err != nil {
+			return "", err
+		}
+		name := "folders/" + n.Add(n, big.NewInt(100000000000)).String()
+		exists, err := r.resourceExistsLocked(name, resourceManagerFolderFile)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+	}
+}
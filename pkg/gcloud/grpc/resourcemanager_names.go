@@ -0,0 +1,146 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const resourceManagerServicePrefix = "/google.cloud.resourcemanager."
+
+// ResolveResourceName deals with replacing the project number in a resource name
+// with the project ID, emulators store resources by project ID so clients can use either.
+// (e.g. projects/123456789012/secrets/s -> projects/my-project/secrets/s)
+// When validate is set and the Resource Manager is in strict mode, an error is returned
+// for names of projects that don't exist or have been deleted.
+func (r *ResourceManager) ResolveResourceName(name string, validate bool) (string, error) {
+	pieces := strings.SplitN(name, "/", 3)
+	if len(pieces) < 2 || pieces[0] != "projects" || pieces[1] == "" || pieces[1] == "-" {
+		return name, nil
+	}
+	// Custom methods are appended to the last segment of a name in REST paths.
+	// (e.g. projects/123456789012:getIamPolicy)
+	project := pieces[1]
+	customMethod := ""
+	if colonIndex := strings.Index(project, ":"); colonIndex >= 0 && len(pieces) == 2 {
+		project, customMethod = project[:colonIndex], project[colonIndex:]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	projectID, err := r.projectIDLocked(project)
+	if err != nil {
+		return "", err
+	}
+	if validate && r.strict {
+		_, err = r.getActiveProjectLocked("projects/" + projectID)
+		if err != nil {
+			return "", err
+		}
+	}
+	pieces[1] = projectID + customMethod
+	return strings.Join(pieces, "/"), nil
+}
+
+// UnaryServerInterceptor provides a gRPC interceptor that resolves the projects in the
+// resource names of requests to Google Cloud APIs before they reach the emulators.
+func (r *ResourceManager) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, "/google.") {
+			return handler(ctx, req)
+		}
+		err := r.resolveRequestNames(info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor provides a gRPC interceptor that resolves the projects
+// in the resource names of every message received by a streaming method.
+func (r *ResourceManager) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasPrefix(info.FullMethod, "/google.") {
+			return handler(srv, stream)
+		}
+		return handler(srv, &projectResolvingServerStream{
+			ServerStream:    stream,
+			fullMethod:      info.FullMethod,
+			resourceManager: r,
+		})
+	}
+}
+
+// resolveRequestNames resolves the projects in the resource names of a request,
+// projects are not validated for Resource Manager methods so deleted projects
+// can be retrieved and restored.
+func (r *ResourceManager) resolveRequestNames(fullMethod string, req interface{}) error {
+	message, ok := req.(proto.Message)
+	if !ok {
+		return nil
+	}
+	validate := !strings.HasPrefix(fullMethod, resourceManagerServicePrefix)
+	return r.resolveMessageNames(message.ProtoReflect(), validate)
+}
+
+// resolveMessageNames resolves every string field of a message, including those in
+// nested messages, that holds the name of a resource in a project.
+func (r *ResourceManager) resolveMessageNames(message protoreflect.Message, validate bool) error {
+	var err error
+	// Fields are set once the message has been ranged over
+	// as a message must not be modified during iteration.
+	resolved := map[protoreflect.FieldDescriptor]string{}
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if field.IsList() || field.IsMap() {
+			return true
+		}
+		switch field.Kind() {
+		case protoreflect.StringKind:
+			if !strings.HasPrefix(value.String(), "projects/") {
+				return true
+			}
+			var name string
+			name, err = r.ResolveResourceName(value.String(), validate)
+			if err == nil && name != value.String() {
+				resolved[field] = name
+			}
+		case protoreflect.MessageKind:
+			err = r.resolveMessageNames(value.Message(), validate)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	for field, name := range resolved {
+		message.Set(field, protoreflect.ValueOfString(name))
+	}
+	return nil
+}
+
+// projectResolvingServerStream wraps a server stream to resolve
+// the projects in the resource names of received messages.
+type projectResolvingServerStream struct {
+	grpc.ServerStream
+	fullMethod      string
+	resourceManager *ResourceManager
+}
+
+func (s *projectResolvingServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	return s.resourceManager.resolveRequestNames(s.fullMethod, m)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+)
+
+// searchTerm is a single field:value term of a Resource Manager search query,
+// values ending in "*" match as a prefix.
+type searchTerm struct {
+	field string
+	value string
+}
+
+type searchTerms []searchTerm
+
+// parseSearchQuery parses a query made up of space separated field:value terms,
+// every term must match for a resource to be included. Search is case insensitive.
+// (e.g. "displayName:web* parent:folders/123456789012")
+func parseSearchQuery(query string) (searchTerms, error) {
+	terms := searchTerms{}
+	for _, term := range strings.Fields(query) {
+		separatorIndex := strings.Index(term, ":")
+		if separatorIndex <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid search term %q, expected field:value", term)
+		}
+		terms = append(terms, searchTerm{
+			field: strings.ToLower(term[:separatorIndex]),
+			value: strings.ToLower(term[separatorIndex+1:]),
+		})
+	}
+	return terms, nil
+}
+
+// matches determines whether a resource matches every term, values provides the values
+// of a field for the resource. Resources that are not active are only matched when the
+// query filters by state.
+func (t searchTerms) matches(active bool, values func(field string) ([]string, bool)) (bool, error) {
+	filtersByState := false
+	for _, term := range t {
+		fieldValues, ok := values(term.field)
+		if !ok {
+			return false, status.Errorf(codes.InvalidArgument, "Unsupported search field: %s", term.field)
+		}
+		filtersByState = filtersByState || term.field == "state" || term.field == "lifecyclestate"
+		if !term.matchesAny(fieldValues) {
+			return false, nil
+		}
+	}
+	return active || filtersByState, nil
+}
+
+func (t searchTerm) matchesAny(values []string) bool {
+	for _, value := range values {
+		value = strings.ToLower(value)
+		if t.value == "*" && value != "" {
+			return true
+		}
+		if strings.HasSuffix(t.value, "*") && strings.HasPrefix(value, strings.TrimSuffix(t.value, "*")) {
+			return true
+		}
+		if value == t.value {
+			return true
+		}
+	}
+	return false
+}
+
+func projectSearchValues(project *resourcemanagerpb.Project, field string) ([]string, bool) {
+	switch field {
+	case "id", "projectid":
+		return []string{project.ProjectId}, true
+	case "name", "displayname":
+		return []string{project.DisplayName}, true
+	case "parent":
+		return []string{project.Parent}, true
+	case "state", "lifecyclestate":
+		return []string{project.State.String()}, true
+	case "labels":
+		values := []string{}
+		for key, value := range project.Labels {
+			values = append(values, key, value)
+		}
+		return values, true
+	}
+	if strings.HasPrefix(field, "labels.") {
+		for key, value := range project.Labels {
+			if strings.ToLower(key) == strings.TrimPrefix(field, "labels.") {
+				return []string{value}, true
+			}
+		}
+		return []string{}, true
+	}
+	return nil, false
+}
+
+func folderSearchValues(folder *resourcemanagerpb.Folder, field string) ([]string, bool) {
+	switch field {
+	case "displayname":
+		return []string{folder.DisplayName}, true
+	case "parent":
+		return []string{folder.Parent}, true
+	case "state", "lifecyclestate":
+		return []string{folder.State.String()}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"context"
+
+	"github.com/spf13/afero"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+type ResourceManagerSuite struct {
+	resourceManager *ResourceManager
+	iamPolicy       *recordingIAMPolicy
+}
+
+var _ = Suite(&ResourceManagerSuite{})
+
+const (
+	testResourceManagerProject = "clouduno-local"
+)
+
+func (s *ResourceManagerSuite) SetUpTest(c *C) {
+	s.iamPolicy = &recordingIAMPolicy{}
+	resourceManager, err := NewResourceManager(
+		"/data/gcloud/resourcemanager",
+		afero.NewMemMapFs(),
+		testResourceManagerProject,
+		true,
+		s.iamPolicy,
+		"127.0.0.1",
+		&noopHostsService{},
+	)
+	c.Assert(err, IsNil)
+	s.resourceManager = resourceManager
+}
+
+func (s *ResourceManagerSuite) Test_the_configured_project_can_be_retrieved_by_id_or_number(c *C) {
+	project, err := s.resourceManager.GetProject(context.Background(), &resourcemanagerpb.GetProjectRequest{
+		Name: "projects/" + testResourceManagerProject,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(project.ProjectId, Equals, testResourceManagerProject)
+	c.Assert(project.State, Equals, resourcemanagerpb.Project_ACTIVE)
+	c.Assert(project.Name, Matches, `projects/[0-9]{12}`)
+
+	byNumber, err := s.resourceManager.GetProject(context.Background(), &resourcemanagerpb.GetProjectRequest{
+		Name: project.Name,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(byNumber.ProjectId, Equals, testResourceManagerProject)
+}
+
+func (s *ResourceManagerSuite) Test_creates_projects_with_completed_operations(c *C) {
+	operation, err := s.resourceManager.CreateProject(context.Background(), &resourcemanagerpb.CreateProjectRequest{
+		Project: &resourcemanagerpb.Project{ProjectId: "other-project", DisplayName: "Other"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(operation.Done, Equals, true)
+	project := &resourcemanagerpb.Project{}
+	c.Assert(operation.GetResponse().UnmarshalTo(project), IsNil)
+	c.Assert(project.ProjectId, Equals, "other-project")
+	c.Assert(project.Etag, Not(Equals), "")
+
+	_, err = s.resourceManager.CreateProject(context.Background(), &resourcemanagerpb.CreateProjectRequest{
+		Project: &resourcemanagerpb.Project{ProjectId: "other-project"},
+	})
+	c.Assert(status.Code(err), Equals, codes.AlreadyExists)
+	_, err = s.resourceManager.CreateProject(context.Background(), &resourcemanagerpb.CreateProjectRequest{
+		Project: &resourcemanagerpb.Project{ProjectId: "Not_Valid"},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	found, err := s.resourceManager.SearchProjects(context.Background(), &resourcemanagerpb.SearchProjectsRequest{
+		Query: "name:oth*",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(found.Projects, HasLen, 1)
+	c.Assert(found.Projects[0].ProjectId, Equals, "other-project")
+}
+
+func (s *ResourceManagerSuite) Test_project_numbers_are_resolved_for_other_emulators(c *C) {
+	name := "projects/" + projectNumber(testResourceManagerProject) + "/secrets/db-password"
+	req := &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{Name: name},
+	}
+	_, err := s.resourceManager.UnaryServerInterceptor()(
+		context.Background(),
+		req,
+		&grpc.UnaryServerInfo{FullMethod: "/google.cloud.secretmanager.v1.SecretManagerService/UpdateSecret"},
+		noopUnaryHandler,
+	)
+	c.Assert(err, IsNil)
+	c.Assert(req.Secret.Name, Equals, "projects/clouduno-local/secrets/db-password")
+}
+
+func (s *ResourceManagerSuite) Test_strict_mode_rejects_requests_for_missing_or_deleted_projects(c *C) {
+	interceptor := s.resourceManager.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.secretmanager.v1.SecretManagerService/ListSecrets"}
+	_, err := interceptor(context.Background(), &secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/unknown-project",
+	}, info, noopUnaryHandler)
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	_, err = s.resourceManager.DeleteProject(context.Background(), &resourcemanagerpb.DeleteProjectRequest{
+		Name: "projects/" + testResourceManagerProject,
+	})
+	c.Assert(err, IsNil)
+	_, err = interceptor(context.Background(), &secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/" + testResourceManagerProject,
+	}, info, noopUnaryHandler)
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+
+	// Deleted projects can still be restored through the Resource Manager.
+	undelete := &resourcemanagerpb.UndeleteProjectRequest{Name: "projects/" + projectNumber(testResourceManagerProject)}
+	_, err = interceptor(
+		context.Background(), undelete,
+		&grpc.UnaryServerInfo{FullMethod: "/google.cloud.resourcemanager.v3.Projects/UndeleteProject"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.resourceManager.UndeleteProject(ctx, req.(*resourcemanagerpb.UndeleteProjectRequest))
+		},
+	)
+	c.Assert(err, IsNil)
+	_, err = interceptor(context.Background(), &secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/" + testResourceManagerProject,
+	}, info, noopUnaryHandler)
+	c.Assert(err, IsNil)
+}
+
+func (s *ResourceManagerSuite) Test_project_policies_are_stored_against_the_project_id(c *C) {
+	_, err := s.resourceManager.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: "projects/" + projectNumber(testResourceManagerProject),
+		Policy:   &iampb.Policy{},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.iamPolicy.resources, DeepEquals, []string{"projects/clouduno-local"})
+
+	_, err = s.resourceManager.GetIamPolicy(context.Background(), &iampb.GetIamPolicyRequest{
+		Resource: "projects/missing-project",
+	})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
+func (s *ResourceManagerSuite) Test_folders_with_active_children_can_not_be_deleted(c *C) {
+	operation, err := s.resourceManager.CreateFolder(context.Background(), &resourcemanagerpb.CreateFolderRequest{
+		Folder: &resourcemanagerpb.Folder{Parent: "organizations/1234", DisplayName: "Engineering"},
+	})
+	c.Assert(err, IsNil)
+	folder := &resourcemanagerpb.Folder{}
+	c.Assert(operation.GetResponse().UnmarshalTo(folder), IsNil)
+	c.Assert(folder.Name, Matches, `folders/[0-9]{12}`)
+
+	_, err = s.resourceManager.CreateFolder(context.Background(), &resourcemanagerpb.CreateFolderRequest{
+		Folder: &resourcemanagerpb.Folder{Parent: "organizations/1234", DisplayName: "Engineering"},
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+
+	_, err = s.resourceManager.MoveProject(context.Background(), &resourcemanagerpb.MoveProjectRequest{
+		Name:              "projects/" + testResourceManagerProject,
+		DestinationParent: folder.Name,
+	})
+	c.Assert(err, IsNil)
+	projects, err := s.resourceManager.ListProjects(context.Background(), &resourcemanagerpb.ListProjectsRequest{
+		Parent: folder.Name,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(projects.Projects, HasLen, 1)
+
+	_, err = s.resourceManager.DeleteFolder(context.Background(), &resourcemanagerpb.DeleteFolderRequest{Name: folder.Name})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+	_, err = s.resourceManager.MoveFolder(context.Background(), &resourcemanagerpb.MoveFolderRequest{
+		Name:              folder.Name,
+		DestinationParent: folder.Name,
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *ResourceManagerSuite) Test_resolves_the_parents_of_projects_and_folders(c *C) {
+	operation, err := s.resourceManager.CreateFolder(context.Background(), &resourcemanagerpb.CreateFolderRequest{
+		Folder: &resourcemanagerpb.Folder{Parent: "organizations/1234", DisplayName: "Engineering"},
+	})
+	c.Assert(err, IsNil)
+	folder := &resourcemanagerpb.Folder{}
+	c.Assert(operation.GetResponse().UnmarshalTo(folder), IsNil)
+	_, err = s.resourceManager.MoveProject(context.Background(), &resourcemanagerpb.MoveProjectRequest{
+		Name:              "projects/" + testResourceManagerProject,
+		DestinationParent: folder.Name,
+	})
+	c.Assert(err, IsNil)
+
+	parent, err := s.resourceManager.ResourceParent("projects/" + testResourceManagerProject)
+	c.Assert(err, IsNil)
+	c.Assert(parent, Equals, folder.Name)
+	parent, err = s.resourceManager.ResourceParent(folder.Name)
+	c.Assert(err, IsNil)
+	c.Assert(parent, Equals, "organizations/1234")
+	parent, err = s.resourceManager.ResourceParent("projects/missing-project")
+	c.Assert(err, IsNil)
+	c.Assert(parent, Equals, "")
+}
+
+func noopUnaryHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+// recordingIAMPolicy records the resources policies are set for.
+type recordingIAMPolicy struct {
+	iampb.UnimplementedIAMPolicyServer
+	resources []string
+}
+
+func (m *recordingIAMPolicy) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	m.resources = append(m.resources, req.Resource)
+	return req.Policy, nil
+}
+
+func (m *recordingIAMPolicy) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	return &iampb.Policy{}, nil
+}
@@ -0,0 +1,649 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// The time zone database is embedded so the time zones of jobs can be
+	// loaded in minimal containers that don't provide one.
+	_ "time/tzdata"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// Scheduler provides a gRPC Cloud Scheduler service that runs jobs on
+// unix-cron schedules, sending HTTP requests to local targets or publishing
+// messages to the local Pub/Sub emulator. Jobs are persisted to the configured
+// file system, runs that were missed while the emulator was stopped are skipped.
+type Scheduler struct {
+	mu           sync.Mutex
+	dataRootDir  string
+	fs           afero.Fs
+	tokenService *tokens.Service
+	// targets maps the hosts of HTTP targets and the services of App Engine
+	// targets onto the base URLs of local services.
+	targets   map[string]string
+	publisher pubsubpb.PublisherServer
+	client    *http.Client
+	jobs      map[string]*schedulerJob
+	// attempts tracks the attempts that are in progress.
+	attempts sync.WaitGroup
+	// wake is used to let the scheduler know jobs have changed.
+	wake chan struct{}
+	// stop is closed to stop the scheduler, loop tracks the scheduler.
+	stop     chan struct{}
+	stopOnce sync.Once
+	loop     sync.WaitGroup
+	clock    Clock
+}
+
+const (
+	schedulerDefaultMinBackoff      = 5 * time.Second
+	schedulerDefaultMaxBackoff      = 3600 * time.Second
+	schedulerDefaultMaxDoublings    = 5
+	schedulerMaxRetryCount          = 5
+	schedulerDefaultAttemptDeadline = 3 * time.Minute
+	schedulerMinAttemptDeadline     = 15 * time.Second
+	schedulerMaxAttemptDeadline     = 30 * time.Minute
+	schedulerJobFile                = "job.json"
+)
+
+var (
+	schedulerLocalHost    = "cloudscheduler.googleapis.local"
+	schedulerJobIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,500}$`)
+	pubsubTopicPattern    = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+)
+
+type schedulerJob struct {
+	job      *schedulerpb.Job
+	schedule cron.Schedule
+	location *time.Location
+	running  bool
+	// runScheduleTime holds the time the current run was scheduled for,
+	// it is sent with every attempt of the run.
+	runScheduleTime time.Time
+	// firstAttemptAt and attempts are used to apply the retry
+	// configuration of the job to the current run.
+	firstAttemptAt time.Time
+	attempts       int32
+	// retryAt holds the time a failed attempt should be retried,
+	// it is zero when no retry is pending.
+	retryAt time.Time
+}
+
+// NewScheduler creates an instance of the Cloud::1 Cloud Scheduler implementation,
+// the token service is used to mint OIDC and OAuth tokens for HTTP targets,
+// targets provides the local URLs HTTP requests are sent to and the publisher
+// is used for Pub/Sub targets when the Pub/Sub emulator is enabled.
+// Jobs run by the provided clock, the system clock is used when it is nil.
+func NewScheduler(
+	dataRootDir string,
+	fs afero.Fs,
+	tokenService *tokens.Service,
+	targets map[string]string,
+	publisher pubsubpb.PublisherServer,
+	clock Clock,
+	ip string,
+	hostsService hosts.Service,
+) (*Scheduler, error) {
+	err := hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &schedulerLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = SystemClock()
+	}
+	return newScheduler(dataRootDir, fs, tokenService, targets, publisher, clock)
+}
+
+// Start deals with starting to run jobs, jobs are only run once
+// the local services they target have been started.
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.loop.Add(1)
+	go s.scheduleLoop()
+	return nil
+}
+
+// Stop deals with no longer running jobs and waiting for the attempts
+// in progress to be recorded, runs that are missed while Cloud::1
+// is stopped are skipped.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	return waitUntilDone(ctx, &s.loop, &s.attempts)
+}
+
+// newScheduler creates a scheduler driven by the provided clock without starting
+// the loop that runs jobs, so jobs can be run deterministically.
+func newScheduler(
+	dataRootDir string,
+	fs afero.Fs,
+	tokenService *tokens.Service,
+	targets map[string]string,
+	publisher pubsubpb.PublisherServer,
+	clock Clock,
+) (*Scheduler, error) {
+	err := fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scheduler{
+		dataRootDir:  dataRootDir,
+		fs:           fs,
+		tokenService: tokenService,
+		targets:      targets,
+		publisher:    publisher,
+		client: &http.Client{
+			// Cloud Scheduler treats redirects as a failed attempt.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		jobs:  map[string]*schedulerJob{},
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		clock: clock,
+	}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListJobs deals with listing the jobs in a project location.
+func (s *Scheduler) ListJobs(ctx context.Context, req *schedulerpb.ListJobsRequest) (*schedulerpb.ListJobsResponse, error) {
+	if !isValidSchedulerName(req.Parent, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Parent)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []*schedulerpb.Job{}
+	for _, name := range s.jobNamesLocked() {
+		if tasksParentName(name) == req.Parent {
+			jobs = append(jobs, s.jobs[name].job)
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(jobs), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &schedulerpb.ListJobsResponse{
+		Jobs:          []*schedulerpb.Job{},
+		NextPageToken: nextPageToken,
+	}
+	for _, job := range jobs[start:end] {
+		response.Jobs = append(response.Jobs, proto.Clone(job).(*schedulerpb.Job))
+	}
+	return response, nil
+}
+
+// GetJob deals with retrieving a specified job.
+func (s *Scheduler) GetJob(ctx context.Context, req *schedulerpb.GetJobRequest) (*schedulerpb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, err := s.getJobLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(j.job).(*schedulerpb.Job), nil
+}
+
+// CreateJob deals with creating a job, the job is enabled
+// and scheduled for the next time that matches its schedule.
+func (s *Scheduler) CreateJob(ctx context.Context, req *schedulerpb.CreateJobRequest) (*schedulerpb.Job, error) {
+	if !isValidSchedulerName(req.Parent, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Parent)
+	}
+	if req.Job == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A job must be provided")
+	}
+	if tasksParentName(req.Job.Name) != req.Parent || !isValidSchedulerName(req.Job.Name, "jobs") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid job name: %s, must be in %s", req.Job.Name, req.Parent)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.jobs[req.Job.Name]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Job %s already exists", req.Job.Name)
+	}
+	job := &schedulerpb.Job{Name: req.Job.Name, State: schedulerpb.Job_ENABLED}
+	j := &schedulerJob{job: job}
+	err := s.applyJobUpdate(j, req.Job, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.saveJobLocked(j)
+}
+
+// UpdateJob deals with updating the fields of a job in the provided update mask,
+// all the fields that can be configured are updated when no mask is provided.
+func (s *Scheduler) UpdateJob(ctx context.Context, req *schedulerpb.UpdateJobRequest) (*schedulerpb.Job, error) {
+	if req.Job == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A job must be provided")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, err := s.getJobLocked(req.Job.Name)
+	if err != nil {
+		return nil, err
+	}
+	j := &schedulerJob{job: proto.Clone(existing.job).(*schedulerpb.Job)}
+	err = s.applyJobUpdate(j, req.Job, req.UpdateMask.GetPaths())
+	if err != nil {
+		return nil, err
+	}
+	// Pending retries are abandoned as the job may no longer be
+	// configured to retry or may now target a different service.
+	j.running = existing.running
+	j.runScheduleTime = existing.runScheduleTime
+	return s.saveJobLocked(j)
+}
+
+// DeleteJob deals with deleting a job, attempts that are in progress
+// are allowed to finish but the job will not be retried.
+func (s *Scheduler) DeleteJob(ctx context.Context, req *schedulerpb.DeleteJobRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.getJobLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.RemoveAll(s.resourceDir(req.Name))
+	if err != nil {
+		return nil, err
+	}
+	delete(s.jobs, req.Name)
+	return &emptypb.Empty{}, nil
+}
+
+// PauseJob deals with pausing a job, a paused job will not be run
+// on its schedule until it is resumed.
+func (s *Scheduler) PauseJob(ctx context.Context, req *schedulerpb.PauseJobRequest) (*schedulerpb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, err := s.getJobLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing.job.State != schedulerpb.Job_ENABLED && existing.job.State != schedulerpb.Job_PAUSED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Job %s can not be paused in the %s state", req.Name, existing.job.State)
+	}
+	j := *existing
+	j.job = proto.Clone(existing.job).(*schedulerpb.Job)
+	j.job.State = schedulerpb.Job_PAUSED
+	j.job.ScheduleTime = nil
+	j.job.UserUpdateTime = timestamppb.New(s.clock.Now())
+	j.retryAt = time.Time{}
+	return s.saveJobLocked(&j)
+}
+
+// ResumeJob deals with resuming a paused job, the job is scheduled
+// for the next time that matches its schedule from now on.
+func (s *Scheduler) ResumeJob(ctx context.Context, req *schedulerpb.ResumeJobRequest) (*schedulerpb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, err := s.getJobLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing.job.State != schedulerpb.Job_ENABLED && existing.job.State != schedulerpb.Job_PAUSED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Job %s can not be resumed in the %s state", req.Name, existing.job.State)
+	}
+	j := *existing
+	j.job = proto.Clone(existing.job).(*schedulerpb.Job)
+	j.job.State = schedulerpb.Job_ENABLED
+	j.job.UserUpdateTime = timestamppb.New(s.clock.Now())
+	return s.saveJobLocked(&j)
+}
+
+// RunJob forces a job to run straight away, regardless of its schedule and state,
+// the attempt is retried as per the retry configuration of the job when it fails.
+func (s *Scheduler) RunJob(ctx context.Context, req *schedulerpb.RunJobRequest) (*schedulerpb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, err := s.getJobLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !j.running {
+		s.startRunLocked(j, s.clock.Now())
+	}
+	return proto.Clone(j.job).(*schedulerpb.Job), nil
+}
+
+// applyJobUpdate copies the fields in the provided paths from the update to the job
+// being prepared, validates the job and parses its schedule and time zone.
+func (s *Scheduler) applyJobUpdate(j *schedulerJob, update *schedulerpb.Job, paths []string) error {
+	job := j.job
+	if len(paths) == 0 {
+		paths = []string{"description", "schedule", "time_zone", "retry_config", "attempt_deadline", "target"}
+	}
+	if job.RetryConfig == nil {
+		job.RetryConfig = &schedulerpb.RetryConfig{}
+	}
+	for _, fieldPath := range paths {
+		switch fieldPath {
+		case "description":
+			job.Description = update.Description
+		case "schedule":
+			job.Schedule = update.Schedule
+		case "time_zone":
+			job.TimeZone = update.TimeZone
+		case "attempt_deadline":
+			job.AttemptDeadline = update.AttemptDeadline
+		case "retry_config":
+			job.RetryConfig = &schedulerpb.RetryConfig{}
+			if update.RetryConfig != nil {
+				job.RetryConfig = proto.Clone(update.RetryConfig).(*schedulerpb.RetryConfig)
+			}
+		case "retry_config.retry_count":
+			job.RetryConfig.RetryCount = update.GetRetryConfig().GetRetryCount()
+		case "retry_config.max_retry_duration":
+			job.RetryConfig.MaxRetryDuration = update.GetRetryConfig().GetMaxRetryDuration()
+		case "retry_config.min_backoff_duration":
+			job.RetryConfig.MinBackoffDuration = update.GetRetryConfig().GetMinBackoffDuration()
+		case "retry_config.max_backoff_duration":
+			job.RetryConfig.MaxBackoffDuration = update.GetRetryConfig().GetMaxBackoffDuration()
+		case "retry_config.max_doublings":
+			job.RetryConfig.MaxDoublings = update.GetRetryConfig().GetMaxDoublings()
+		case "target", "pubsub_target", "app_engine_http_target", "http_target":
+			if update.Target != nil {
+				job.Target = proto.Clone(update).(*schedulerpb.Job).Target
+			}
+		default:
+			return status.Errorf(codes.InvalidArgument, "Unsupported update mask path: %s", fieldPath)
+		}
+	}
+	job.UserUpdateTime = timestamppb.New(s.clock.Now())
+	return s.prepareJob(j)
+}
+
+// prepareJob validates a job and applies defaults for the
+// retry configuration, attempt deadline and HTTP methods.
+func (s *Scheduler) prepareJob(j *schedulerJob) error {
+	job := j.job
+	if strings.HasPrefix(job.Schedule, "CRON_TZ=") || strings.HasPrefix(job.Schedule, "TZ=") {
+		return status.Errorf(codes.InvalidArgument, "The time zone of a job must be set with the time zone field")
+	}
+	schedule, err := cron.ParseStandard(job.Schedule)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid schedule: %s, %s", job.Schedule, err)
+	}
+	location, err := time.LoadLocation(job.TimeZone)
+	if err != nil || job.TimeZone == "Local" {
+		return status.Errorf(codes.InvalidArgument, "Invalid time zone: %s, must be a time zone from the tz database", job.TimeZone)
+	}
+	j.schedule = schedule
+	j.location = location
+
+	switch {
+	case job.GetHttpTarget() != nil:
+		err = s.prepareHTTPTarget(job.GetHttpTarget())
+	case job.GetAppEngineHttpTarget() != nil:
+		err = prepareAppEngineHTTPTarget(job.GetAppEngineHttpTarget())
+	case job.GetPubsubTarget() != nil:
+		err = s.preparePubsubTarget(job.GetPubsubTarget())
+	default:
+		err = status.Errorf(codes.InvalidArgument, "A job must have a Pub/Sub, App Engine HTTP or HTTP target")
+	}
+	if err != nil {
+		return err
+	}
+
+	if job.AttemptDeadline == nil {
+		job.AttemptDeadline = durationpb.New(schedulerDefaultAttemptDeadline)
+	}
+	deadline := job.AttemptDeadline.AsDuration()
+	if deadline < schedulerMinAttemptDeadline || deadline > schedulerMaxAttemptDeadline {
+		return status.Errorf(codes.InvalidArgument, "The attempt deadline must be between 15 seconds and 30 minutes")
+	}
+
+	retryConfig := job.RetryConfig
+	if retryConfig.RetryCount < 0 || retryConfig.RetryCount > schedulerMaxRetryCount {
+		return status.Errorf(codes.InvalidArgument, "The retry count must be between 0 and 5")
+	}
+	if retryConfig.MaxRetryDuration.AsDuration() < 0 {
+		return status.Errorf(codes.InvalidArgument, "The max retry duration can not be negative")
+	}
+	if retryConfig.MinBackoffDuration == nil {
+		retryConfig.MinBackoffDuration = durationpb.New(schedulerDefaultMinBackoff)
+	}
+	if retryConfig.MaxBackoffDuration == nil {
+		retryConfig.MaxBackoffDuration = durationpb.New(schedulerDefaultMaxBackoff)
+	}
+	minBackoff := retryConfig.MinBackoffDuration.AsDuration()
+	if minBackoff < 0 || minBackoff > retryConfig.MaxBackoffDuration.AsDuration() {
+		return status.Errorf(codes.InvalidArgument, "The min backoff must not be negative or greater than the max backoff")
+	}
+	if retryConfig.MaxDoublings == 0 {
+		retryConfig.MaxDoublings = schedulerDefaultMaxDoublings
+	}
+	if retryConfig.MaxDoublings < 0 {
+		return status.Errorf(codes.InvalidArgument, "The max doublings can not be negative")
+	}
+	return nil
+}
+
+func (s *Scheduler) prepareHTTPTarget(httpTarget *schedulerpb.HttpTarget) error {
+	target, err := url.Parse(httpTarget.Uri)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return status.Errorf(codes.InvalidArgument, "Invalid job URI: %s, must be an absolute http or https URL", httpTarget.Uri)
+	}
+	if httpTarget.HttpMethod == schedulerpb.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+		httpTarget.HttpMethod = schedulerpb.HttpMethod_POST
+	}
+	err = validateJobBody(httpTarget.HttpMethod, httpTarget.Body)
+	if err != nil {
+		return err
+	}
+	serviceAccount := httpTarget.GetOidcToken().GetServiceAccountEmail() + httpTarget.GetOauthToken().GetServiceAccountEmail()
+	usesToken := httpTarget.GetOidcToken() != nil || httpTarget.GetOauthToken() != nil
+	if usesToken && serviceAccount == "" {
+		return status.Errorf(codes.InvalidArgument, "A service account email must be provided for job tokens")
+	}
+	if usesToken && s.tokenService == nil {
+		return status.Errorf(codes.Unimplemented, "Job tokens are not supported without the token service")
+	}
+	return nil
+}
+
+func prepareAppEngineHTTPTarget(appEngineTarget *schedulerpb.AppEngineHttpTarget) error {
+	if appEngineTarget.RelativeUri == "" {
+		appEngineTarget.RelativeUri = "/"
+	}
+	if !strings.HasPrefix(appEngineTarget.RelativeUri, "/") {
+		return status.Errorf(codes.InvalidArgument, "The relative URI of a job must begin with \"/\"")
+	}
+	if appEngineTarget.HttpMethod == schedulerpb.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+		appEngineTarget.HttpMethod = schedulerpb.HttpMethod_POST
+	}
+	return validateJobBody(appEngineTarget.HttpMethod, appEngineTarget.Body)
+}
+
+func (s *Scheduler) preparePubsubTarget(pubsubTarget *schedulerpb.PubsubTarget) error {
+	if s.publisher == nil {
+		return status.Errorf(codes.FailedPrecondition, "Pub/Sub targets are only supported when the Pub/Sub emulator is enabled")
+	}
+	if !pubsubTopicPattern.MatchString(pubsubTarget.TopicName) {
+		return status.Errorf(codes.InvalidArgument, "Invalid topic name: %s", pubsubTarget.TopicName)
+	}
+	if len(pubsubTarget.Data) == 0 && len(pubsubTarget.Attributes) == 0 {
+		return status.Errorf(codes.InvalidArgument, "A Pub/Sub target must have data or at least one attribute")
+	}
+	return nil
+}
+
+func validateJobBody(method schedulerpb.HttpMethod, body []byte) error {
+	bodyAllowed := method == schedulerpb.HttpMethod_POST || method == schedulerpb.HttpMethod_PUT ||
+		method == schedulerpb.HttpMethod_PATCH
+	if len(body) > 0 && !bodyAllowed {
+		return status.Errorf(codes.InvalidArgument, "A body can only be provided for POST, PUT and PATCH requests")
+	}
+	return nil
+}
+
+// saveJobLocked persists a job and replaces the job that was previously stored
+// under its name, enabled jobs are scheduled for the next time that matches
+// their schedule.
+func (s *Scheduler) saveJobLocked(j *schedulerJob) (*schedulerpb.Job, error) {
+	if j.job.State == schedulerpb.Job_ENABLED {
+		j.job.ScheduleTime = timestamppb.New(j.next(s.clock.Now()))
+	}
+	err := s.writeResourceLocked(j.job.Name, schedulerJobFile, j.job)
+	if err != nil {
+		return nil, err
+	}
+	s.jobs[j.job.Name] = j
+	s.wakeScheduler()
+	return proto.Clone(j.job).(*schedulerpb.Job), nil
+}
+
+func (s *Scheduler) getJobLocked(name string) (*schedulerJob, error) {
+	if !isValidSchedulerName(name, "jobs") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid job name: %s", name)
+	}
+	j, ok := s.jobs[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	return j, nil
+}
+
+func (s *Scheduler) jobNamesLocked() []string {
+	names := []string{}
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load deals with loading persisted jobs when the emulator starts,
+// enabled jobs are scheduled from the current time so runs that
+// were missed while the emulator was stopped are not made up for.
+func (s *Scheduler) load() error {
+	jobNames := []string{}
+	walkFn := func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if info.Name() == schedulerJobFile {
+			jobNames = append(jobNames, strings.TrimPrefix(path.Dir(filePath), s.dataRootDir+"/"))
+		}
+		return nil
+	}
+	err := afero.Walk(s.fs, s.dataRootDir, walkFn)
+	if err != nil {
+		return err
+	}
+	for _, name := range jobNames {
+		job := &schedulerpb.Job{}
+		err = s.readResourceLocked(name, schedulerJobFile, job)
+		if err != nil {
+			return err
+		}
+		j := &schedulerJob{job: job}
+		j.schedule, err = cron.ParseStandard(job.Schedule)
+		if err != nil {
+			return err
+		}
+		j.location, err = time.LoadLocation(job.TimeZone)
+		if err != nil {
+			return err
+		}
+		if job.State == schedulerpb.Job_ENABLED && job.ScheduleTime.AsTime().Before(s.clock.Now()) {
+			job.ScheduleTime = timestamppb.New(j.next(s.clock.Now()))
+		}
+		s.jobs[name] = j
+	}
+	return nil
+}
+
+func (s *Scheduler) resourceDir(name string) string {
+	return path.Join(s.dataRootDir, name)
+}
+
+func (s *Scheduler) readResourceLocked(name string, fileName string, resource proto.Message) error {
+	bytes, err := afero.ReadFile(s.fs, path.Join(s.resourceDir(name), fileName))
+	if os.IsNotExist(err) {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(bytes, resource)
+}
+
+func (s *Scheduler) writeResourceLocked(name string, fileName string, resource proto.Message) error {
+	err := s.fs.MkdirAll(s.resourceDir(name), 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := protojson.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(s.fs, path.Join(s.resourceDir(name), fileName), bytes, 0755)
+}
+
+// next determines the next time after the provided time that
+// matches the schedule of a job in the time zone of the job.
+func (j *schedulerJob) next(after time.Time) time.Time {
+	return j.schedule.Next(after.In(j.location)).UTC()
+}
+
+// isValidSchedulerName checks that a resource name is made up of the
+// expected collection/ID pairs up to and including the provided collection.
+func isValidSchedulerName(name string, collection string) bool {
+	expected := []string{"projects", "locations", "jobs"}
+	pieces := strings.Split(name, "/")
+	if len(pieces)%2 != 0 || len(pieces) > len(expected)*2 {
+		return false
+	}
+	for i := 0; i < len(pieces); i = i + 2 {
+		if pieces[i] != expected[i/2] || pieces[i+1] == "" || strings.Contains(pieces[i+1], "..") {
+			return false
+		}
+	}
+	if len(pieces) < 2 || pieces[len(pieces)-2] != collection {
+		return false
+	}
+	if collection == "jobs" {
+		return schedulerJobIDPattern.MatchString(pieces[5])
+	}
+	return true
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+const (
+	schedulerIdleWait  = time.Minute
+	schedulerUserAgent = "Google-Cloud-Scheduler"
+)
+
+// scheduleLoop runs jobs as they become due by the clock of the scheduler,
+// waking up early whenever jobs change or due jobs are run on demand.
+func (s *Scheduler) scheduleLoop() {
+	defer s.loop.Done()
+	for {
+		wait := s.runDueJobs()
+		timer := s.clock.NewTimer(wait)
+		select {
+		case <-s.wake:
+		case <-timer.C():
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func (s *Scheduler) wakeScheduler() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunDueJobs runs the jobs and retries that are due by the clock of the scheduler
+// straight away instead of waiting for the scheduler to wake up, attempts are made
+// in the background and recorded in the status of each job.
+func (s *Scheduler) RunDueJobs() {
+	s.runDueJobs()
+	s.wakeScheduler()
+}
+
+// runDueJobs starts the runs of enabled jobs that are due along with the retries
+// that are due, then determines how long to wait before the next run or retry.
+// A job that is still running when it is next due skips that run.
+func (s *Scheduler) runDueJobs() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	wait := schedulerIdleWait
+	for _, name := range s.jobNamesLocked() {
+		j := s.jobs[name]
+		if j.job.State != schedulerpb.Job_ENABLED {
+			continue
+		}
+		scheduleTime := j.job.ScheduleTime.AsTime()
+		if !scheduleTime.After(now) {
+			j.job.ScheduleTime = timestamppb.New(j.next(now))
+			s.writeResourceLocked(name, schedulerJobFile, j.job)
+			if !j.running {
+				s.startRunLocked(j, scheduleTime)
+			}
+		} else if !j.running && !j.retryAt.IsZero() && !j.retryAt.After(now) {
+			s.startAttemptLocked(j)
+		}
+		wait = minDuration(wait, j.job.ScheduleTime.AsTime().Sub(now))
+		if !j.retryAt.IsZero() {
+			wait = minDuration(wait, j.retryAt.Sub(now))
+		}
+	}
+	return wait
+}
+
+// startRunLocked starts a new run of a job, resetting the state
+// used to retry the previous run.
+func (s *Scheduler) startRunLocked(j *schedulerJob, scheduleTime time.Time) {
+	j.runScheduleTime = scheduleTime
+	j.firstAttemptAt = s.clock.Now()
+	j.attempts = 0
+	s.startAttemptLocked(j)
+}
+
+// startAttemptLocked marks a job as running and makes
+// an attempt in the background.
+func (s *Scheduler) startAttemptLocked(j *schedulerJob) {
+	j.running = true
+	j.retryAt = time.Time{}
+	s.attempts.Add(1)
+	go s.attempt(proto.Clone(j.job).(*schedulerpb.Job), j.runScheduleTime)
+}
+
+// attempt sends the request or publishes the message for a job
+// and records the outcome of the attempt.
+func (s *Scheduler) attempt(job *schedulerpb.Job, scheduleTime time.Time) {
+	defer s.attempts.Done()
+	attemptTime := s.clock.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), job.AttemptDeadline.AsDuration())
+	defer cancel()
+	var attemptStatus *statuspb.Status
+	if pubsubTarget := job.GetPubsubTarget(); pubsubTarget != nil {
+		attemptStatus = s.publish(ctx, pubsubTarget)
+	} else {
+		attemptStatus = s.send(ctx, job, scheduleTime)
+	}
+	s.completeAttempt(job.Name, attemptTime, attemptStatus)
+}
+
+// completeAttempt records the outcome of an attempt for a job, failed attempts
+// are retried after a backoff as long as the retry configuration allows it and
+// the retry would happen before the next scheduled run.
+func (s *Scheduler) completeAttempt(name string, attemptTime time.Time, attemptStatus *statuspb.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.wakeScheduler()
+	j, ok := s.jobs[name]
+	if !ok {
+		// The job was deleted while the attempt was being made.
+		return
+	}
+	now := s.clock.Now()
+	j.running = false
+	j.attempts = j.attempts + 1
+	j.job.LastAttemptTime = timestamppb.New(attemptTime)
+	j.job.Status = attemptStatus
+	if attemptStatus.Code != int32(codes.OK) && j.job.State == schedulerpb.Job_ENABLED {
+		retryConfig := j.job.RetryConfig
+		maxRetryDuration := retryConfig.MaxRetryDuration.AsDuration()
+		backoff := retryBackoff(
+			retryConfig.MinBackoffDuration.AsDuration(),
+			retryConfig.MaxBackoffDuration.AsDuration(),
+			retryConfig.MaxDoublings,
+			j.attempts,
+		)
+		retryAt := now.Add(backoff)
+		canRetry := j.attempts <= retryConfig.RetryCount &&
+			(maxRetryDuration == 0 || retryAt.Sub(j.firstAttemptAt) <= maxRetryDuration) &&
+			retryAt.Before(j.job.ScheduleTime.AsTime())
+		if canRetry {
+			j.retryAt = retryAt
+		}
+	}
+	s.writeResourceLocked(name, schedulerJobFile, j.job)
+}
+
+// send makes an HTTP request for a job with an HTTP or App Engine HTTP target.
+func (s *Scheduler) send(ctx context.Context, job *schedulerpb.Job, scheduleTime time.Time) *statuspb.Status {
+	req, err := s.attemptRequest(job, scheduleTime)
+	if err != nil {
+		return attemptStatus(0, err)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return attemptStatus(0, err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return attemptStatus(resp.StatusCode, nil)
+}
+
+// publish publishes the message for a job with a Pub/Sub target
+// to the local Pub/Sub emulator.
+func (s *Scheduler) publish(ctx context.Context, pubsubTarget *schedulerpb.PubsubTarget) *statuspb.Status {
+	_, err := s.publisher.Publish(ctx, &pubsubpb.PublishRequest{
+		Topic: pubsubTarget.TopicName,
+		Messages: []*pubsubpb.PubsubMessage{
+			{Data: pubsubTarget.Data, Attributes: pubsubTarget.Attributes},
+		},
+	})
+	if err != nil {
+		return status.Convert(err).Proto()
+	}
+	return &statuspb.Status{Code: int32(codes.OK)}
+}
+
+// attemptRequest builds the HTTP request for a job, targets are rewritten
+// to local URLs and the headers set by Cloud Scheduler are added.
+func (s *Scheduler) attemptRequest(job *schedulerpb.Job, scheduleTime time.Time) (*http.Request, error) {
+	var method schedulerpb.HttpMethod
+	var target string
+	var headers map[string]string
+	var body []byte
+	httpTarget := job.GetHttpTarget()
+	if httpTarget != nil {
+		localURL, err := localTargetURL(s.targets, httpTarget.Uri)
+		if err != nil {
+			return nil, err
+		}
+		method, target, headers, body = httpTarget.HttpMethod, localURL, httpTarget.Headers, httpTarget.Body
+	} else {
+		appEngineTarget := job.GetAppEngineHttpTarget()
+		localURL, err := appEngineTargetURL(
+			s.targets,
+			appEngineTarget.GetAppEngineRouting().GetService(),
+			appEngineTarget.RelativeUri,
+		)
+		if err != nil {
+			return nil, err
+		}
+		method, target, headers, body = appEngineTarget.HttpMethod, localURL, appEngineTarget.Headers, appEngineTarget.Body
+	}
+
+	req, err := http.NewRequest(method.String(), target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if len(body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	jobPieces := strings.Split(job.Name, "/")
+	req.Header.Set("User-Agent", schedulerUserAgent)
+	req.Header.Set("X-CloudScheduler", "true")
+	req.Header.Set("X-CloudScheduler-JobName", jobPieces[5])
+	req.Header.Set("X-CloudScheduler-ScheduleTime", scheduleTime.UTC().Format(time.RFC3339))
+
+	err = s.authorize(req, httpTarget)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// authorize adds the OIDC or OAuth token requested for an HTTP target to its request,
+// the audience of OIDC tokens defaults to the URI of the target before it is rewritten.
+func (s *Scheduler) authorize(req *http.Request, httpTarget *schedulerpb.HttpTarget) error {
+	if oidcToken := httpTarget.GetOidcToken(); oidcToken != nil {
+		audience := oidcToken.Audience
+		if audience == "" {
+			audience = httpTarget.Uri
+		}
+		return addOIDCToken(req, s.tokenService, oidcToken.ServiceAccountEmail, audience)
+	}
+	if oauthToken := httpTarget.GetOauthToken(); oauthToken != nil {
+		return addOAuthToken(req, s.tokenService, oauthToken.ServiceAccountEmail, oauthToken.Scope)
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	. "gopkg.in/check.v1"
+
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+type SchedulerSuite struct {
+	fs           afero.Fs
+	tokens       *tokens.Service
+	pubsub       *PubSub
+	scheduler    *Scheduler
+	worker       *httptest.Server
+	received     chan *receivedTaskRequest
+	responseCode int
+	clock        *ManualClock
+}
+
+var _ = Suite(&SchedulerSuite{})
+
+const (
+	testSchedulerLocation       = "projects/test-project/locations/europe-west2"
+	testSchedulerJob            = testSchedulerLocation + "/jobs/nightly-report"
+	testSchedulerServiceAccount = "scheduler@test-project.iam.gserviceaccount.com"
+)
+
+func (s *SchedulerSuite) SetUpTest(c *C) {
+	s.received = make(chan *receivedTaskRequest, 10)
+	s.responseCode = http.StatusOK
+	s.worker = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.received <- &receivedTaskRequest{path: r.URL.RequestURI(), headers: r.Header, body: string(body)}
+		w.WriteHeader(s.responseCode)
+	}))
+	s.fs = afero.NewMemMapFs()
+	tokenService, err := tokens.New("/data/gcloud/tokens", s.fs)
+	c.Assert(err, IsNil)
+	s.tokens = tokenService
+	pubsub, err := NewPubSub("127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+	s.pubsub = pubsub
+	s.clock = NewManualClock(time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC))
+	s.scheduler = s.newScheduler(c)
+}
+
+func (s *SchedulerSuite) TearDownTest(c *C) {
+	s.worker.Close()
+}
+
+func (s *SchedulerSuite) newScheduler(c *C) *Scheduler {
+	scheduler, err := newScheduler(
+		"/data/gcloud/scheduler",
+		s.fs,
+		s.tokens,
+		map[string]string{"worker.example.com": s.worker.URL, "default": s.worker.URL + "/appengine"},
+		s.pubsub,
+		s.clock,
+	)
+	c.Assert(err, IsNil)
+	return scheduler
+}
+
+// advance moves the clock forward, runs the jobs that are due
+// and waits for their attempts to finish.
+func (s *SchedulerSuite) advance(duration time.Duration) {
+	s.clock.Advance(duration)
+	s.scheduler.RunDueJobs()
+	s.scheduler.attempts.Wait()
+}
+
+// waitForTimer waits for the started scheduler to wait on a timer of its clock.
+func (s *SchedulerSuite) waitForTimer(c *C) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.clock.mu.Lock()
+		waiting := len(s.clock.timers) > 0
+		s.clock.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("timed out waiting for the scheduler to wait on its clock")
+}
+
+func (s *SchedulerSuite) receivedCount() int {
+	count := 0
+	for {
+		select {
+		case <-s.received:
+			count = count + 1
+		default:
+			return count
+		}
+	}
+}
+
+func (s *SchedulerSuite) createHTTPJob(c *C, schedule string, timeZone string, retryConfig *schedulerpb.RetryConfig) *schedulerpb.Job {
+	job, err := s.scheduler.CreateJob(context.Background(), &schedulerpb.CreateJobRequest{
+		Parent: testSchedulerLocation,
+		Job: &schedulerpb.Job{
+			Name:        testSchedulerJob,
+			Schedule:    schedule,
+			TimeZone:    timeZone,
+			RetryConfig: retryConfig,
+			Target: &schedulerpb.Job_HttpTarget{HttpTarget: &schedulerpb.HttpTarget{
+				Uri:  "https://worker.example.com/reports?kind=nightly",
+				Body: []byte(`{"format":"csv"}`),
+				AuthorizationHeader: &schedulerpb.HttpTarget_OidcToken{OidcToken: &schedulerpb.OidcToken{
+					ServiceAccountEmail: testSchedulerServiceAccount,
+				}},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	return job
+}
+
+func (s *SchedulerSuite) getJob(c *C) *schedulerpb.Job {
+	job, err := s.scheduler.GetJob(context.Background(), &schedulerpb.GetJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+	return job
+}
+
+func (s *SchedulerSuite) Test_http_jobs_run_on_their_schedule_in_their_time_zone(c *C) {
+	job := s.createHTTPJob(c, "0 9 * * *", "America/New_York", nil)
+	c.Assert(job.State, Equals, schedulerpb.Job_ENABLED)
+	c.Assert(job.ScheduleTime.AsTime(), Equals, time.Date(2022, time.June, 1, 13, 0, 0, 0, time.UTC))
+	c.Assert(job.AttemptDeadline.AsDuration(), Equals, 3*time.Minute)
+	c.Assert(job.RetryConfig.MinBackoffDuration.AsDuration(), Equals, 5*time.Second)
+	c.Assert(job.GetHttpTarget().HttpMethod, Equals, schedulerpb.HttpMethod_POST)
+
+	s.advance(59 * time.Minute)
+	c.Assert(s.receivedCount(), Equals, 0)
+
+	s.advance(time.Minute)
+	req := <-s.received
+	c.Assert(req.path, Equals, "/reports?kind=nightly")
+	c.Assert(req.body, Equals, `{"format":"csv"}`)
+	c.Assert(req.headers.Get("User-Agent"), Equals, "Google-Cloud-Scheduler")
+	c.Assert(req.headers.Get("X-CloudScheduler"), Equals, "true")
+	c.Assert(req.headers.Get("X-CloudScheduler-JobName"), Equals, "nightly-report")
+	c.Assert(req.headers.Get("X-CloudScheduler-ScheduleTime"), Equals, "2022-06-01T13:00:00Z")
+	claims, err := s.tokens.Validate(strings.TrimPrefix(req.headers.Get("Authorization"), "Bearer "))
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testSchedulerServiceAccount)
+	c.Assert(claims.Audience, Equals, "https://worker.example.com/reports?kind=nightly")
+
+	job = s.getJob(c)
+	c.Assert(job.ScheduleTime.AsTime(), Equals, time.Date(2022, time.June, 2, 13, 0, 0, 0, time.UTC))
+	c.Assert(job.LastAttemptTime.AsTime(), Equals, time.Date(2022, time.June, 1, 13, 0, 0, 0, time.UTC))
+	c.Assert(job.Status.Code, Equals, int32(codes.OK))
+}
+
+func (s *SchedulerSuite) Test_failed_attempts_are_retried_with_backoff_up_to_the_retry_count(c *C) {
+	s.responseCode = http.StatusInternalServerError
+	s.createHTTPJob(c, "*/10 * * * *", "", &schedulerpb.RetryConfig{
+		RetryCount:         2,
+		MinBackoffDuration: durationpb.New(time.Second),
+		MaxBackoffDuration: durationpb.New(10 * time.Second),
+	})
+
+	s.advance(10 * time.Minute)
+	c.Assert(s.receivedCount(), Equals, 1)
+	c.Assert(s.getJob(c).Status.Code, Equals, int32(codes.Internal))
+
+	s.advance(time.Second)
+	c.Assert(s.receivedCount(), Equals, 1)
+	s.advance(time.Second)
+	c.Assert(s.receivedCount(), Equals, 0)
+	s.advance(time.Second)
+	c.Assert(s.receivedCount(), Equals, 1)
+
+	s.advance(time.Minute)
+	c.Assert(s.receivedCount(), Equals, 0)
+}
+
+func (s *SchedulerSuite) Test_retries_are_not_made_after_the_next_scheduled_run(c *C) {
+	s.responseCode = http.StatusServiceUnavailable
+	s.createHTTPJob(c, "* * * * *", "", &schedulerpb.RetryConfig{
+		RetryCount:         5,
+		MinBackoffDuration: durationpb.New(90 * time.Second),
+	})
+
+	s.advance(time.Minute)
+	c.Assert(s.receivedCount(), Equals, 1)
+	s.advance(30 * time.Second)
+	c.Assert(s.receivedCount(), Equals, 0)
+	s.advance(30 * time.Second)
+	req := <-s.received
+	c.Assert(req.headers.Get("X-CloudScheduler-ScheduleTime"), Equals, "2022-06-01T12:02:00Z")
+}
+
+func (s *SchedulerSuite) Test_pubsub_jobs_publish_to_the_local_pubsub_emulator(c *C) {
+	_, err := s.pubsub.CreateTopic(context.Background(), &pubsubpb.Topic{Name: "projects/test-project/topics/reports"})
+	c.Assert(err, IsNil)
+	_, err = s.pubsub.CreateSubscription(context.Background(), &pubsubpb.Subscription{
+		Name:  "projects/test-project/subscriptions/reports-worker",
+		Topic: "projects/test-project/topics/reports",
+	})
+	c.Assert(err, IsNil)
+	_, err = s.scheduler.CreateJob(context.Background(), &schedulerpb.CreateJobRequest{
+		Parent: testSchedulerLocation,
+		Job: &schedulerpb.Job{
+			Name:     testSchedulerJob,
+			Schedule: "0 * * * *",
+			Target: &schedulerpb.Job_PubsubTarget{PubsubTarget: &schedulerpb.PubsubTarget{
+				TopicName:  "projects/test-project/topics/reports",
+				Data:       []byte("generate"),
+				Attributes: map[string]string{"kind": "nightly"},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	s.advance(time.Hour)
+	response, err := s.pubsub.Pull(context.Background(), &pubsubpb.PullRequest{
+		Subscription:      "projects/test-project/subscriptions/reports-worker",
+		MaxMessages:       10,
+		ReturnImmediately: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(response.ReceivedMessages, HasLen, 1)
+	c.Assert(string(response.ReceivedMessages[0].Message.Data), Equals, "generate")
+	c.Assert(response.ReceivedMessages[0].Message.Attributes["kind"], Equals, "nightly")
+	c.Assert(s.getJob(c).Status.Code, Equals, int32(codes.OK))
+}
+
+func (s *SchedulerSuite) Test_paused_jobs_are_not_run_until_they_are_resumed(c *C) {
+	s.createHTTPJob(c, "*/10 * * * *", "", nil)
+	job, err := s.scheduler.PauseJob(context.Background(), &schedulerpb.PauseJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+	c.Assert(job.State, Equals, schedulerpb.Job_PAUSED)
+	c.Assert(job.ScheduleTime, IsNil)
+
+	s.advance(25 * time.Minute)
+	c.Assert(s.receivedCount(), Equals, 0)
+
+	job, err = s.scheduler.ResumeJob(context.Background(), &schedulerpb.ResumeJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+	c.Assert(job.State, Equals, schedulerpb.Job_ENABLED)
+	c.Assert(job.ScheduleTime.AsTime(), Equals, time.Date(2022, time.June, 1, 12, 30, 0, 0, time.UTC))
+	s.advance(5 * time.Minute)
+	c.Assert(s.receivedCount(), Equals, 1)
+}
+
+func (s *SchedulerSuite) Test_run_job_runs_a_paused_job_straight_away(c *C) {
+	s.createHTTPJob(c, "0 9 * * *", "", nil)
+	_, err := s.scheduler.PauseJob(context.Background(), &schedulerpb.PauseJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+
+	_, err = s.scheduler.RunJob(context.Background(), &schedulerpb.RunJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+	s.scheduler.attempts.Wait()
+	req := <-s.received
+	c.Assert(req.headers.Get("X-CloudScheduler-ScheduleTime"), Equals, "2022-06-01T12:00:00Z")
+	c.Assert(s.getJob(c).LastAttemptTime.AsTime(), Equals, s.clock.Now())
+}
+
+func (s *SchedulerSuite) Test_app_engine_jobs_are_sent_to_the_target_for_the_service(c *C) {
+	_, err := s.scheduler.CreateJob(context.Background(), &schedulerpb.CreateJobRequest{
+		Parent: testSchedulerLocation,
+		Job: &schedulerpb.Job{
+			Name:     testSchedulerJob,
+			Schedule: "0 * * * *",
+			Target: &schedulerpb.Job_AppEngineHttpTarget{AppEngineHttpTarget: &schedulerpb.AppEngineHttpTarget{
+				RelativeUri: "/cron/cleanup",
+				HttpMethod:  schedulerpb.HttpMethod_GET,
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	_, err = s.scheduler.RunJob(context.Background(), &schedulerpb.RunJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+	s.scheduler.attempts.Wait()
+	req := <-s.received
+	c.Assert(req.path, Equals, "/appengine/cron/cleanup")
+	c.Assert(req.headers.Get("X-CloudScheduler"), Equals, "true")
+}
+
+func (s *SchedulerSuite) Test_updating_the_schedule_reschedules_the_job(c *C) {
+	s.createHTTPJob(c, "0 9 * * *", "", nil)
+	job, err := s.scheduler.UpdateJob(context.Background(), &schedulerpb.UpdateJobRequest{
+		Job:        &schedulerpb.Job{Name: testSchedulerJob, Schedule: "30 12 * * *", Description: "ignored"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"schedule"}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(job.Schedule, Equals, "30 12 * * *")
+	c.Assert(job.Description, Equals, "")
+	c.Assert(job.GetHttpTarget().Uri, Equals, "https://worker.example.com/reports?kind=nightly")
+	c.Assert(job.ScheduleTime.AsTime(), Equals, time.Date(2022, time.June, 1, 12, 30, 0, 0, time.UTC))
+}
+
+func (s *SchedulerSuite) Test_jobs_are_reloaded_without_making_up_for_missed_runs(c *C) {
+	s.createHTTPJob(c, "*/10 * * * *", "Europe/London", nil)
+	s.clock.Advance(time.Hour + 5*time.Minute)
+	s.scheduler = s.newScheduler(c)
+
+	job := s.getJob(c)
+	c.Assert(job.TimeZone, Equals, "Europe/London")
+	c.Assert(job.ScheduleTime.AsTime(), Equals, time.Date(2022, time.June, 1, 13, 10, 0, 0, time.UTC))
+	s.advance(time.Minute)
+	c.Assert(s.receivedCount(), Equals, 0)
+}
+
+func (s *SchedulerSuite) Test_started_scheduler_runs_due_jobs_until_it_is_stopped(c *C) {
+	s.createHTTPJob(c, "*/10 * * * *", "", nil)
+	c.Assert(s.scheduler.Start(context.Background()), IsNil)
+
+	// The scheduler waits for the next run by its clock,
+	// so advancing the clock wakes it up.
+	s.waitForTimer(c)
+	s.clock.Advance(10 * time.Minute)
+	select {
+	case <-s.received:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the job to run")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(s.scheduler.Stop(ctx), IsNil)
+}
+
+func (s *SchedulerSuite) Test_jobs_are_listed_in_a_location(c *C) {
+	s.createHTTPJob(c, "0 9 * * *", "", nil)
+	response, err := s.scheduler.ListJobs(context.Background(), &schedulerpb.ListJobsRequest{Parent: testSchedulerLocation})
+	c.Assert(err, IsNil)
+	c.Assert(response.Jobs, HasLen, 1)
+	c.Assert(response.Jobs[0].Name, Equals, testSchedulerJob)
+
+	_, err = s.scheduler.DeleteJob(context.Background(), &schedulerpb.DeleteJobRequest{Name: testSchedulerJob})
+	c.Assert(err, IsNil)
+	response, err = s.scheduler.ListJobs(context.Background(), &schedulerpb.ListJobsRequest{Parent: testSchedulerLocation})
+	c.Assert(err, IsNil)
+	c.Assert(response.Jobs, HasLen, 0)
+}
+
+func (s *SchedulerSuite) Test_invalid_jobs_are_rejected(c *C) {
+	invalidJobs := []*schedulerpb.Job{
+		{Name: testSchedulerJob, Schedule: "every 5 minutes"},
+		{Name: testSchedulerJob, Schedule: "CRON_TZ=Europe/London 0 9 * * *"},
+		{Name: testSchedulerJob, Schedule: "0 9 * * *", TimeZone: "Mars/Olympus_Mons"},
+		{Name: testSchedulerJob, Schedule: "0 9 * * *"},
+		{
+			Name:        testSchedulerJob,
+			Schedule:    "0 9 * * *",
+			RetryConfig: &schedulerpb.RetryConfig{RetryCount: 6},
+			Target: &schedulerpb.Job_HttpTarget{HttpTarget: &schedulerpb.HttpTarget{
+				Uri: "https://worker.example.com/reports",
+			}},
+		},
+		{
+			Name:     testSchedulerJob,
+			Schedule: "0 9 * * *",
+			Target: &schedulerpb.Job_HttpTarget{HttpTarget: &schedulerpb.HttpTarget{
+				Uri:        "https://worker.example.com/reports",
+				HttpMethod: schedulerpb.HttpMethod_GET,
+				Body:       []byte("body"),
+			}},
+		},
+	}
+	for _, job := range invalidJobs {
+		_, err := s.scheduler.CreateJob(context.Background(), &schedulerpb.CreateJobRequest{
+			Parent: testSchedulerLocation,
+			Job:    job,
+		})
+		c.Assert(status.Code(err), Equals, codes.InvalidArgument, Commentf("job: %v", job))
+	}
+}
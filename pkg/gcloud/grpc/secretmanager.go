@@ -12,7 +12,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,21 +37,36 @@ import (
 // be used for the HTTP API using Google's handy protojson package to translate
 // between proto3 and json.
 type SecretManager struct {
-	dataRootDir string
-	fs          afero.Fs
+	dataRootDir   string
+	fs            afero.Fs
+	payloadCipher *secretPayloadCipher
+	iamPolicy     v1Iam.IAMPolicyServer
 }
 
 var (
 	secretManagerLocalHost = "secretmanager.googleapis.local"
 )
 
-// NewSecretManager creates an instance of the Cloud::1 secret manager implementaiton.
-func NewSecretManager(dataRootDir string, fs afero.Fs, ip string, hostsService hosts.Service) (secretmanagerpb.SecretManagerServiceServer, error) {
+// NewSecretManager creates an instance of the Cloud::1 secret manager implementaiton,
+// version payloads are encrypted at rest as per the provided encryption configuration.
+func NewSecretManager(
+	dataRootDir string,
+	fs afero.Fs,
+	ip string,
+	hostsService hosts.Service,
+	encryption *SecretEncryption,
+	iamPolicy v1Iam.IAMPolicyServer,
+) (secretmanagerpb.SecretManagerServiceServer, error) {
 	err := fs.MkdirAll(dataRootDir, 0755)
 	if err != nil {
 		return nil, err
 	}
 
+	payloadCipher, err := newSecretPayloadCipher(encryption)
+	if err != nil {
+		return nil, err
+	}
+
 	err = hostsService.Add(&hosts.Params{
 		IP:    &ip,
 		Hosts: &secretManagerLocalHost,
@@ -60,6 +77,8 @@ func NewSecretManager(dataRootDir string, fs afero.Fs, ip string, hostsService h
 	return &SecretManager{
 		dataRootDir,
 		fs,
+		payloadCipher,
+		iamPolicy,
 	}, nil
 }
 
@@ -96,6 +115,10 @@ func (s *SecretManager) ListSecrets(ctx context.Context, req *secretmanagerpb.Li
 func (s *SecretManager) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
 	secret := secretmanagerpb.Secret{}
 	copier.Copy(&secret, req.Secret)
+	err := s.payloadCipher.validateSecretEncryption(&secret)
+	if err != nil {
+		return nil, err
+	}
 	secret.CreateTime = timestamppb.Now()
 	secret.Name = fmt.Sprintf("%s/secrets/%s", req.Parent, req.SecretId)
 	bytes, err := protojson.Marshal(&secret)
@@ -129,6 +152,11 @@ type Version struct {
 	File       string `json:"file"`
 	Number     int    `json:"number"`
 	CreateTime int    `json:"createTime"`
+	// Encryption is empty for payloads stored in plain text,
+	// otherwise it is either "keyfile" or "kms".
+	Encryption        string `json:"encryption,omitempty"`
+	KMSKeyName        string `json:"kmsKeyName,omitempty"`
+	KMSKeyVersionName string `json:"kmsKeyVersionName,omitempty"`
 }
 
 func (s *SecretManager) getVersions(secret string) (*Versions, error) {
@@ -155,7 +183,13 @@ func (s *SecretManager) getVersions(secret string) (*Versions, error) {
 	}, nil
 }
 
-func (s *SecretManager) addVersion(versions *Versions, versionsDirectory string, payload []byte) (*Version, error) {
+func (s *SecretManager) addVersion(
+	ctx context.Context,
+	secret *secretmanagerpb.Secret,
+	versions *Versions,
+	versionsDirectory string,
+	payload []byte,
+) (*Version, error) {
 	versionsCopy := &Versions{}
 	copier.Copy(versionsCopy, versions)
 	fileNameUUID, err := uuid.NewRandom()
@@ -170,10 +204,14 @@ func (s *SecretManager) addVersion(versions *Versions, versionsDirectory string,
 		Number:     (*versionsCopy).Next,
 		CreateTime: int(time.Now().Unix()),
 	}
+	storedPayload, err := s.payloadCipher.encrypt(ctx, secret, &version, payload)
+	if err != nil {
+		return nil, err
+	}
 	versionsCopy.Versions[version.Number] = version
 	filePath := fmt.Sprintf("%s/%s", versionsDirectory, fileName)
 	// Write the file containng the secret data.
-	err = afero.WriteFile(s.fs, filePath, payload, 0755)
+	err = afero.WriteFile(s.fs, filePath, storedPayload, 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -183,33 +221,56 @@ func (s *SecretManager) addVersion(versions *Versions, versionsDirectory string,
 	// to orchestrate emulations of infrastructure.
 	versionsCopy.Next = versionsCopy.Next + 1
 	// Write changes to the versions object to the file system.
-	versionsBytes, err := json.Marshal(versions)
+	versionsBytes, err := json.Marshal(versionsCopy)
 	if err != nil {
 		return nil, err
 	}
 	versionsFilePath := fmt.Sprintf("%s/versions.json", versionsDirectory)
 	err = afero.WriteFile(s.fs, versionsFilePath, versionsBytes, 0755)
+	if err != nil {
+		return nil, err
+	}
 	return &version, nil
 }
 
 // AddSecretVersion deals with adding a new version for a specified secret.
 func (s *SecretManager) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
-	secret := req.Parent
-	versions, err := s.getVersions(secret)
+	secret, err := s.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{
+		Name: req.Parent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.getVersions(req.Parent)
 	if err != nil {
 		return nil, err
 	}
 	versionsDirectory := fmt.Sprintf("%s/%s", s.dataRootDir, req.Parent)
-	fmt.Println("versionsDirectory:", versionsDirectory)
-	version, err := s.addVersion(versions, versionsDirectory, req.Payload.Data)
+	version, err := s.addVersion(ctx, secret, versions, versionsDirectory, req.Payload.GetData())
 	if err != nil {
 		return nil, err
 	}
-	versionName := fmt.Sprintf("%s/versions/%d", req.Parent, versions.Next)
-	return &secretmanagerpb.SecretVersion{
-		Name:       versionName,
+	return secretVersionFromStored(req.Parent, version), nil
+}
+
+func secretVersionFromStored(secret string, version *Version) *secretmanagerpb.SecretVersion {
+	secretVersion := &secretmanagerpb.SecretVersion{
+		Name:       fmt.Sprintf("%s/versions/%d", secret, version.Number),
 		CreateTime: timestamppb.New(time.Unix(int64(version.CreateTime), 0)),
-	}, nil
+		State:      secretmanagerpb.SecretVersion_ENABLED,
+	}
+	if version.Encryption == secretEncryptionKMS {
+		secretVersion.ReplicationStatus = &secretmanagerpb.ReplicationStatus{
+			ReplicationStatus: &secretmanagerpb.ReplicationStatus_Automatic{
+				Automatic: &secretmanagerpb.ReplicationStatus_AutomaticStatus{
+					CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryptionStatus{
+						KmsKeyVersionName: version.KMSKeyVersionName,
+					},
+				},
+			},
+		}
+	}
+	return secretVersion
 }
 
 func (s *SecretManager) createSecretFilePath(name string) string {
@@ -272,9 +333,66 @@ func (*SecretManager) GetSecretVersion(context.Context, *secretmanagerpb.GetSecr
 	return nil, status.Errorf(codes.Unimplemented, "method GetSecretVersion not implemented")
 }
 
-// AccessSecretVersion deals with retrieving the raw data for a specified secret version.
-func (*SecretManager) AccessSecretVersion(context.Context, *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method AccessSecretVersion not implemented")
+// AccessSecretVersion deals with retrieving the raw data for a specified secret version,
+// the "latest" alias resolves to the most recently added version.
+func (s *SecretManager) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	secret, versionID, err := splitSecretVersionName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.getVersions(secret)
+	if err != nil {
+		return nil, err
+	}
+	version, ok := findSecretVersion(versions, versionID)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Secret version %s not found", req.Name)
+	}
+	filePath := fmt.Sprintf("%s/%s/%s", s.dataRootDir, secret, version.File)
+	stored, err := afero.ReadFile(s.fs, filePath)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := s.payloadCipher.decrypt(ctx, &version, stored)
+	if err != nil {
+		return nil, err
+	}
+	checksum := int64(crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name: fmt.Sprintf("%s/versions/%d", secret, version.Number),
+		Payload: &secretmanagerpb.SecretPayload{
+			Data:       payload,
+			DataCrc32C: &checksum,
+		},
+	}, nil
+}
+
+func splitSecretVersionName(name string) (string, string, error) {
+	pieces := strings.Split(name, "/")
+	if len(pieces) != 6 || pieces[0] != "projects" || pieces[2] != "secrets" || pieces[4] != "versions" {
+		return "", "", status.Errorf(codes.InvalidArgument, "Invalid secret version name: %s", name)
+	}
+	return strings.Join(pieces[:4], "/"), pieces[5], nil
+}
+
+func findSecretVersion(versions *Versions, versionID string) (Version, bool) {
+	if versionID == "latest" {
+		latest := Version{}
+		found := false
+		for number, version := range versions.Versions {
+			if !found || number > latest.Number {
+				latest = version
+				found = true
+			}
+		}
+		return latest, found
+	}
+	number, err := strconv.Atoi(versionID)
+	if err != nil {
+		return Version{}, false
+	}
+	version, ok := versions.Versions[number]
+	return version, ok
 }
 
 // DisableSecretVersion deals with disabling the specified secret version.
@@ -293,18 +411,46 @@ func (*SecretManager) DestroySecretVersion(context.Context, *secretmanagerpb.Des
 }
 
 // SetIamPolicy deals with setting an IAM policy for the specified secret.
-func (*SecretManager) SetIamPolicy(context.Context, *v1Iam.SetIamPolicyRequest) (*v1Iam.Policy, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method SetIamPolicy not implemented")
+func (s *SecretManager) SetIamPolicy(ctx context.Context, req *v1Iam.SetIamPolicyRequest) (*v1Iam.Policy, error) {
+	err := s.checkSecretPolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return s.iamPolicy.SetIamPolicy(ctx, req)
 }
 
 // GetIamPolicy retrieves the IAM policy for the specified secret.
-func (*SecretManager) GetIamPolicy(context.Context, *v1Iam.GetIamPolicyRequest) (*v1Iam.Policy, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetIamPolicy not implemented")
+func (s *SecretManager) GetIamPolicy(ctx context.Context, req *v1Iam.GetIamPolicyRequest) (*v1Iam.Policy, error) {
+	err := s.checkSecretPolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return s.iamPolicy.GetIamPolicy(ctx, req)
 }
 
 // TestIamPermissions checks the permissions the caller has for the specified secret.
-func (*SecretManager) TestIamPermissions(context.Context, *v1Iam.TestIamPermissionsRequest) (*v1Iam.TestIamPermissionsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method TestIamPermissions not implemented")
+func (s *SecretManager) TestIamPermissions(ctx context.Context, req *v1Iam.TestIamPermissionsRequest) (*v1Iam.TestIamPermissionsResponse, error) {
+	err := s.checkSecretPolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return s.iamPolicy.TestIamPermissions(ctx, req)
+}
+
+// checkSecretPolicyResource ensures IAM policies are managed by the emulator
+// and that the secret a policy is for exists.
+func (s *SecretManager) checkSecretPolicyResource(resource string) error {
+	if s.iamPolicy == nil {
+		return status.Errorf(codes.Unimplemented, "IAM policies are only supported when IAM is enabled")
+	}
+	exists, err := afero.Exists(s.fs, s.createSecretFilePath(resource))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return status.Errorf(codes.NotFound, "Secret [%s] not found", resource)
+	}
+	return nil
 }
 
 func validateUpdateMask(updateMask *fieldmaskpb.FieldMask) error {
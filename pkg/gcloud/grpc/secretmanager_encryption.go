@@ -0,0 +1,229 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+const (
+	secretEncryptionKeyFile = "keyfile"
+	secretEncryptionKMS     = "kms"
+	secretKeyFileKeySize    = 32
+)
+
+// SecretEncryption configures how the secret manager encrypts
+// version payloads at rest.
+type SecretEncryption struct {
+	// KeyFile is the path to a file holding a 256-bit AES key, either as raw bytes
+	// or base64 encoded, that is used for secrets without a customer-managed key.
+	// Payloads are stored in plain text when no key file is provided.
+	KeyFile string
+	// KMS is the key management service used for secrets
+	// that are configured with a customer-managed encryption key.
+	KMS kmspb.KeyManagementServiceServer
+}
+
+// secretPayloadCipher deals with encrypting and decrypting
+// secret version payloads.
+type secretPayloadCipher struct {
+	keyFileKey []byte
+	kms        kmspb.KeyManagementServiceServer
+}
+
+func newSecretPayloadCipher(encryption *SecretEncryption) (*secretPayloadCipher, error) {
+	payloadCipher := &secretPayloadCipher{}
+	if encryption == nil {
+		return payloadCipher, nil
+	}
+	payloadCipher.kms = encryption.KMS
+	if encryption.KeyFile != "" {
+		key, err := loadSecretKeyFile(encryption.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		payloadCipher.keyFileKey = key
+	}
+	return payloadCipher, nil
+}
+
+func loadSecretKeyFile(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) == secretKeyFileKeySize {
+		return contents, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != secretKeyFileKeySize {
+		return nil, fmt.Errorf(
+			"secret key file %s must contain a %d byte key as raw bytes or base64", path, secretKeyFileKeySize,
+		)
+	}
+	return key, nil
+}
+
+// customerManagedKeyName extracts the KMS key that should be used to encrypt
+// the payloads of a secret, the emulator keeps a single copy of each payload
+// so only the first user-managed replica with a key is taken into account.
+func customerManagedKeyName(secret *secretmanagerpb.Secret) string {
+	replication := secret.GetReplication()
+	if automatic := replication.GetAutomatic(); automatic != nil {
+		return automatic.GetCustomerManagedEncryption().GetKmsKeyName()
+	}
+	for _, replica := range replication.GetUserManaged().GetReplicas() {
+		if keyName := replica.GetCustomerManagedEncryption().GetKmsKeyName(); keyName != "" {
+			return keyName
+		}
+	}
+	return ""
+}
+
+// validateSecretEncryption ensures a secret's customer-managed key
+// can be used with the current configuration.
+func (c *secretPayloadCipher) validateSecretEncryption(secret *secretmanagerpb.Secret) error {
+	if customerManagedKeyName(secret) != "" && c.kms == nil {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"Customer-managed encryption requires the kms service to be enabled",
+		)
+	}
+	return nil
+}
+
+// encrypt deals with encrypting a payload for the provided secret, the encryption
+// method is recorded on the version so the payload can be decrypted when accessed.
+func (c *secretPayloadCipher) encrypt(ctx context.Context, secret *secretmanagerpb.Secret, version *Version, payload []byte) ([]byte, error) {
+	keyName := customerManagedKeyName(secret)
+	if keyName != "" {
+		err := c.validateSecretEncryption(secret)
+		if err != nil {
+			return nil, err
+		}
+		response, err := c.kms.Encrypt(ctx, &kmspb.EncryptRequest{
+			Name:      keyName,
+			Plaintext: payload,
+		})
+		if err != nil {
+			return nil, customerManagedKeyError(keyName, err)
+		}
+		version.Encryption = secretEncryptionKMS
+		version.KMSKeyName = keyName
+		version.KMSKeyVersionName = response.Name
+		return response.Ciphertext, nil
+	}
+	if c.keyFileKey != nil {
+		ciphertext, err := sealSecretPayload(c.keyFileKey, payload)
+		if err != nil {
+			return nil, err
+		}
+		version.Encryption = secretEncryptionKeyFile
+		return ciphertext, nil
+	}
+	return payload, nil
+}
+
+// decrypt deals with decrypting a stored payload with the method that was
+// used to encrypt it.
+func (c *secretPayloadCipher) decrypt(ctx context.Context, version *Version, stored []byte) ([]byte, error) {
+	switch version.Encryption {
+	case secretEncryptionKMS:
+		if c.kms == nil {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"The secret version was encrypted with %s but the kms service is not enabled", version.KMSKeyVersionName,
+			)
+		}
+		response, err := c.kms.Decrypt(ctx, &kmspb.DecryptRequest{
+			Name:       version.KMSKeyName,
+			Ciphertext: stored,
+		})
+		if err != nil {
+			return nil, customerManagedKeyError(version.KMSKeyVersionName, err)
+		}
+		return response.Plaintext, nil
+	case secretEncryptionKeyFile:
+		if c.keyFileKey == nil {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"The secret version was encrypted with a key file that is no longer configured",
+			)
+		}
+		return openSecretPayload(c.keyFileKey, stored)
+	}
+	return stored, nil
+}
+
+// customerManagedKeyError reports a key that can not be used as a failed precondition,
+// this mirrors how Secret Manager surfaces disabled or destroyed CMEK keys.
+func customerManagedKeyError(keyName string, err error) error {
+	code := status.Code(err)
+	if code == codes.FailedPrecondition || code == codes.NotFound || code == codes.InvalidArgument {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"The customer-managed encryption key %s can not be used: %s", keyName, status.Convert(err).Message(),
+		)
+	}
+	return err
+}
+
+func sealSecretPayload(key []byte, payload []byte) ([]byte, error) {
+	aead, err := newSecretPayloadAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, payload, nil), nil
+}
+
+func openSecretPayload(key []byte, sealed []byte) ([]byte, error) {
+	aead, err := newSecretPayloadAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("the stored secret payload is corrupted")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	payload, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"The secret version could not be decrypted with the configured key file",
+		)
+	}
+	return payload, nil
+}
+
+func newSecretPayloadAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	. "gopkg.in/check.v1"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+type SecretManagerSuite struct {
+	fs  afero.Fs
+	kms *KMS
+}
+
+var _ = Suite(&SecretManagerSuite{})
+
+const (
+	testSecretsRootDir = "/data/gcloud/secretmanager"
+	testSecretsProject = "projects/test-project"
+	testSecretKey      = "projects/test-project/locations/global/keyRings/secrets/cryptoKeys/payloads"
+)
+
+func (s *SecretManagerSuite) SetUpTest(c *C) {
+	s.fs = afero.NewMemMapFs()
+	kms, err := NewKMS("/data/gcloud/kms", s.fs, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+	s.kms = kms
+	_, err = kms.CreateKeyRing(context.Background(), &kmspb.CreateKeyRingRequest{
+		Parent:    "projects/test-project/locations/global",
+		KeyRingId: "secrets",
+	})
+	c.Assert(err, IsNil)
+	_, err = kms.CreateCryptoKey(context.Background(), &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/test-project/locations/global/keyRings/secrets",
+		CryptoKeyId: "payloads",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *SecretManagerSuite) Test_customer_managed_payloads_are_encrypted_with_kms(c *C) {
+	secretManager := s.newSecretManager(c, &SecretEncryption{KMS: s.kms})
+	s.createSecret(c, secretManager, "cmek-secret", &secretmanagerpb.Replication{
+		Replication: &secretmanagerpb.Replication_Automatic_{
+			Automatic: &secretmanagerpb.Replication_Automatic{
+				CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: testSecretKey},
+			},
+		},
+	})
+	version, err := secretManager.AddSecretVersion(context.Background(), &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  testSecretsProject + "/secrets/cmek-secret",
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("database-password")},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(
+		version.ReplicationStatus.GetAutomatic().CustomerManagedEncryption.KmsKeyVersionName,
+		Equals, testSecretKey+"/cryptoKeyVersions/1",
+	)
+	s.assertNoPlaintextStored(c, "cmek-secret", "database-password")
+
+	accessed, err := secretManager.AccessSecretVersion(context.Background(), &secretmanagerpb.AccessSecretVersionRequest{
+		Name: testSecretsProject + "/secrets/cmek-secret/versions/latest",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(accessed.Payload.Data), Equals, "database-password")
+}
+
+func (s *SecretManagerSuite) Test_access_fails_when_the_customer_managed_key_version_is_disabled(c *C) {
+	secretManager := s.newSecretManager(c, &SecretEncryption{KMS: s.kms})
+	s.createSecret(c, secretManager, "cmek-secret", &secretmanagerpb.Replication{
+		Replication: &secretmanagerpb.Replication_UserManaged_{
+			UserManaged: &secretmanagerpb.Replication_UserManaged{
+				Replicas: []*secretmanagerpb.Replication_UserManaged_Replica{
+					{
+						Location:                  "europe-west2",
+						CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: testSecretKey},
+					},
+				},
+			},
+		},
+	})
+	_, err := secretManager.AddSecretVersion(context.Background(), &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  testSecretsProject + "/secrets/cmek-secret",
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("database-password")},
+	})
+	c.Assert(err, IsNil)
+
+	_, err = s.kms.UpdateCryptoKeyVersion(context.Background(), &kmspb.UpdateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{
+			Name:  testSecretKey + "/cryptoKeyVersions/1",
+			State: kmspb.CryptoKeyVersion_DISABLED,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"state"}},
+	})
+	c.Assert(err, IsNil)
+	_, err = secretManager.AccessSecretVersion(context.Background(), &secretmanagerpb.AccessSecretVersionRequest{
+		Name: testSecretsProject + "/secrets/cmek-secret/versions/1",
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *SecretManagerSuite) Test_payloads_are_encrypted_with_the_key_file(c *C) {
+	keyFile := filepath.Join(c.MkDir(), "secrets.key")
+	key := bytes.Repeat([]byte{7}, secretKeyFileKeySize)
+	err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), os.ModePerm)
+	c.Assert(err, IsNil)
+
+	secretManager := s.newSecretManager(c, &SecretEncryption{KeyFile: keyFile})
+	s.createSecret(c, secretManager, "plain-secret", nil)
+	for _, payload := range []string{"first-password", "second-password"} {
+		_, err = secretManager.AddSecretVersion(context.Background(), &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  testSecretsProject + "/secrets/plain-secret",
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte(payload)},
+		})
+		c.Assert(err, IsNil)
+	}
+	s.assertNoPlaintextStored(c, "plain-secret", "password")
+
+	accessed, err := secretManager.AccessSecretVersion(context.Background(), &secretmanagerpb.AccessSecretVersionRequest{
+		Name: testSecretsProject + "/secrets/plain-secret/versions/1",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(accessed.Payload.Data), Equals, "first-password")
+	accessed, err = secretManager.AccessSecretVersion(context.Background(), &secretmanagerpb.AccessSecretVersionRequest{
+		Name: testSecretsProject + "/secrets/plain-secret/versions/latest",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(accessed.Name, Equals, testSecretsProject+"/secrets/plain-secret/versions/2")
+	c.Assert(string(accessed.Payload.Data), Equals, "second-password")
+}
+
+func (s *SecretManagerSuite) Test_customer_managed_secrets_require_kms(c *C) {
+	secretManager := s.newSecretManager(c, nil)
+	_, err := secretManager.CreateSecret(context.Background(), &secretmanagerpb.CreateSecretRequest{
+		Parent:   testSecretsProject,
+		SecretId: "cmek-secret",
+		Secret: &secretmanagerpb.Secret{
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{
+					Automatic: &secretmanagerpb.Replication_Automatic{
+						CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: testSecretKey},
+					},
+				},
+			},
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *SecretManagerSuite) newSecretManager(c *C, encryption *SecretEncryption) secretmanagerpb.SecretManagerServiceServer {
+	secretManager, err := NewSecretManager(testSecretsRootDir, s.fs, "127.0.0.1", &noopHostsService{}, encryption, nil)
+	c.Assert(err, IsNil)
+	return secretManager
+}
+
+func (s *SecretManagerSuite) createSecret(
+	c *C,
+	secretManager secretmanagerpb.SecretManagerServiceServer,
+	secretID string,
+	replication *secretmanagerpb.Replication,
+) {
+	_, err := secretManager.CreateSecret(context.Background(), &secretmanagerpb.CreateSecretRequest{
+		Parent:   testSecretsProject,
+		SecretId: secretID,
+		Secret:   &secretmanagerpb.Secret{Replication: replication},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *SecretManagerSuite) assertNoPlaintextStored(c *C, secretID string, plaintext string) {
+	secretDir := filepath.Join(testSecretsRootDir, testSecretsProject, "secrets", secretID)
+	err := afero.Walk(s.fs, secretDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		contents, err := afero.ReadFile(s.fs, path)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Contains(contents, []byte(plaintext)), Equals, false, Commentf("file: %s", path))
+		return nil
+	})
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"google.golang.org/grpc/codes"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// The helpers in this file are shared by the emulators that send
+// HTTP requests to user-provided targets, Cloud Tasks and Cloud Scheduler.
+
+// ParseLocalTargets parses a comma separated list of host=URL pairs that map the hosts
+// of HTTP targets and the services of App Engine targets onto local base URLs.
+// (e.g. "worker.example.com=http://localhost:8080,default=http://localhost:8081")
+func ParseLocalTargets(value string) (map[string]string, error) {
+	targets := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		keyAndURL := strings.SplitN(pair, "=", 2)
+		if len(keyAndURL) != 2 || keyAndURL[0] == "" {
+			return nil, fmt.Errorf("invalid target %q, expected host=URL", pair)
+		}
+		target, err := url.Parse(keyAndURL[1])
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid target URL %q, expected an absolute http or https URL", keyAndURL[1])
+		}
+		targets[keyAndURL[0]] = keyAndURL[1]
+	}
+	return targets, nil
+}
+
+// localTargetURL rewrites a URL when a local target has been configured
+// for its host, other URLs are used as they are.
+// (e.g. https://worker.example.com/jobs -> http://localhost:8080/jobs)
+func localTargetURL(targets map[string]string, rawURL string) (string, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	baseURL, ok := targets[target.Host]
+	if !ok {
+		baseURL, ok = targets[target.Hostname()]
+	}
+	if !ok {
+		return rawURL, nil
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	target.Scheme = base.Scheme
+	target.Host = base.Host
+	target.Path = strings.TrimSuffix(base.Path, "/") + target.Path
+	target.RawPath = ""
+	return target.String(), nil
+}
+
+// appEngineTargetURL produces the local URL for an App Engine service,
+// there is no App Engine emulator so a target must be configured for the service.
+func appEngineTargetURL(targets map[string]string, service string, relativeURI string) (string, error) {
+	if service == "" {
+		service = "default"
+	}
+	baseURL, ok := targets[service]
+	if !ok {
+		return "", fmt.Errorf("no local target has been configured for the App Engine service %s", service)
+	}
+	return strings.TrimSuffix(baseURL, "/") + relativeURI, nil
+}
+
+// addOIDCToken authorizes a request with an ID token minted by the local token service.
+func addOIDCToken(req *http.Request, tokenService *tokens.Service, serviceAccount string, audience string) error {
+	token, err := tokenService.IDToken(serviceAccount, audience, true, 0)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	return nil
+}
+
+// addOAuthToken authorizes a request with an access token minted by the local token
+// service, scopes are space separated and default to the cloud platform scope.
+func addOAuthToken(req *http.Request, tokenService *tokens.Service, serviceAccount string, scope string) error {
+	token, err := tokenService.AccessToken(serviceAccount, strings.Fields(scope), 0)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	return nil
+}
+
+// retryBackoff determines how long to wait before an attempt is retried, the interval
+// doubles max doublings times, then increases linearly by the last doubled interval
+// and never exceeds the max backoff.
+// (e.g. 10s min, 300s max and 3 doublings: 10s, 20s, 40s, 80s, 160s, 240s, 300s)
+func retryBackoff(minBackoff time.Duration, maxBackoff time.Duration, maxDoublings int32, attempts int32) time.Duration {
+	backoff := minBackoff
+	doublings := int32(0)
+	for doublings < maxDoublings && doublings < attempts-1 && backoff < maxBackoff {
+		backoff = backoff * 2
+		doublings = doublings + 1
+	}
+	if attempts-1 > maxDoublings && backoff < maxBackoff {
+		steps := time.Duration(attempts - maxDoublings)
+		if backoff > maxBackoff/steps {
+			backoff = maxBackoff
+		} else {
+			backoff = backoff * steps
+		}
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// attemptStatus converts the outcome of an HTTP attempt
+// into the status recorded for the attempt.
+func attemptStatus(responseCode int, attemptErr error) *statuspb.Status {
+	if attemptErr != nil {
+		code := codes.Unavailable
+		if errors.Is(attemptErr, context.DeadlineExceeded) {
+			code = codes.DeadlineExceeded
+		}
+		return &statuspb.Status{Code: int32(code), Message: attemptErr.Error()}
+	}
+	code := codes.Unknown
+	switch {
+	case responseCode >= 200 && responseCode < 300:
+		code = codes.OK
+	case responseCode == http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case responseCode == http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case responseCode == http.StatusForbidden:
+		code = codes.PermissionDenied
+	case responseCode == http.StatusNotFound:
+		code = codes.NotFound
+	case responseCode == http.StatusConflict:
+		code = codes.Aborted
+	case responseCode == http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case responseCode == http.StatusNotImplemented:
+		code = codes.Unimplemented
+	case responseCode == http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case responseCode == http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	case responseCode >= 400 && responseCode < 500:
+		code = codes.FailedPrecondition
+	case responseCode >= 500:
+		code = codes.Internal
+	}
+	return &statuspb.Status{Code: int32(code), Message: http.StatusText(responseCode)}
+}
+
+// waitUntilDone waits for every wait group to be done
+// or for the context to be done, whichever comes first.
+func waitUntilDone(ctx context.Context, groups ...*sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		for _, group := range groups {
+			group.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
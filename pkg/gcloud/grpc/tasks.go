@@ -0,0 +1,942 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+// Tasks provides a gRPC Cloud Tasks service that dispatches tasks
+// to local HTTP targets, queues and tasks are persisted to the configured
+// file system so tasks that have not been dispatched survive restarts.
+type Tasks struct {
+	mu           sync.Mutex
+	dataRootDir  string
+	fs           afero.Fs
+	tokenService *tokens.Service
+	// targets maps the hosts of HTTP targets and the services of App Engine
+	// targets onto the base URLs of local services.
+	targets   map[string]string
+	iamPolicy iampb.IAMPolicyServer
+	client    *http.Client
+	queues    map[string]*tasksQueue
+	// tombstones holds the time tasks were deleted or completed so the
+	// names of tasks can't be reused straight away, as per the deduplication
+	// provided by Cloud Tasks.
+	tombstones map[string]time.Time
+	// wake is used to let the dispatcher know tasks or queues have changed.
+	wake chan struct{}
+	// stop is closed to stop the dispatcher, loop and dispatches track
+	// the dispatcher and the dispatches that are in progress.
+	stop       chan struct{}
+	stopOnce   sync.Once
+	loop       sync.WaitGroup
+	dispatches sync.WaitGroup
+	now        func() time.Time
+}
+
+const (
+	tasksDefaultMaxDispatchesPerSecond  = 500
+	tasksMaxDispatchesPerSecond         = 500
+	tasksDefaultMaxConcurrentDispatches = 1000
+	tasksMaxConcurrentDispatches        = 5000
+	tasksDefaultMaxAttempts             = 100
+	tasksDefaultMinBackoff              = 100 * time.Millisecond
+	tasksDefaultMaxBackoff              = 3600 * time.Second
+	tasksDefaultMaxDoublings            = 16
+	tasksDefaultDispatchDeadline        = 10 * time.Minute
+	tasksMinDispatchDeadline            = 15 * time.Second
+	tasksMaxDispatchDeadline            = 30 * time.Minute
+	tasksMaxScheduleAhead               = 30 * 24 * time.Hour
+	tasksTombstoneRetention             = time.Hour
+	tasksQueueFile                      = "queue.json"
+	tasksTaskFile                       = "task.json"
+)
+
+var (
+	tasksLocalHost      = "cloudtasks.googleapis.local"
+	tasksQueueIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,100}$`)
+	tasksTaskIDPattern  = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,500}$`)
+)
+
+type tasksQueue struct {
+	queue *taskspb.Queue
+	tasks map[string]*tasksTask
+	// tokens and refilledAt make up the token bucket used to
+	// apply the dispatch rate limit of the queue.
+	tokens     float64
+	refilledAt time.Time
+	inFlight   int
+}
+
+type tasksTask struct {
+	task        *taskspb.Task
+	dispatching bool
+	// forced is set when a task should be dispatched straight away
+	// regardless of the state and rate limits of the queue.
+	forced bool
+	// previousResponse holds the HTTP status code of the last
+	// response received for the task.
+	previousResponse int
+}
+
+// NewTasks creates an instance of the Cloud::1 Cloud Tasks implementation,
+// the token service is used to mint OIDC and OAuth tokens for tasks that
+// require them and targets provides the local URLs tasks are dispatched to.
+func NewTasks(
+	dataRootDir string,
+	fs afero.Fs,
+	tokenService *tokens.Service,
+	targets map[string]string,
+	iamPolicy iampb.IAMPolicyServer,
+	ip string,
+	hostsService hosts.Service,
+) (*Tasks, error) {
+	err := fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &tasksLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &Tasks{
+		dataRootDir:  dataRootDir,
+		fs:           fs,
+		tokenService: tokenService,
+		targets:      targets,
+		iamPolicy:    iamPolicy,
+		client: &http.Client{
+			// Cloud Tasks treats redirects as a failed attempt.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queues:     map[string]*tasksQueue{},
+		tombstones: map[string]time.Time{},
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		now:        time.Now,
+	}
+	err = t.load()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Start deals with starting to dispatch tasks, tasks are only dispatched once
+// the local services they target have been started.
+func (t *Tasks) Start(ctx context.Context) error {
+	t.loop.Add(1)
+	go t.dispatchLoop()
+	return nil
+}
+
+// Stop deals with no longer dispatching tasks and waiting for the dispatches
+// in progress to be recorded, tasks that are still being dispatched
+// when the context is done are dispatched again after a restart.
+func (t *Tasks) Stop(ctx context.Context) error {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+	return waitUntilDone(ctx, &t.loop, &t.dispatches)
+}
+
+// ListQueues deals with listing the queues in a project location,
+// queues can be filtered by state. (e.g. "state: PAUSED")
+func (t *Tasks) ListQueues(ctx context.Context, req *taskspb.ListQueuesRequest) (*taskspb.ListQueuesResponse, error) {
+	if !isValidTasksName(req.Parent, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Parent)
+	}
+	state, err := parseQueueStateFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queues := []*taskspb.Queue{}
+	for _, name := range t.queueNamesLocked() {
+		queue := t.queues[name].queue
+		if tasksParentName(name) == req.Parent && (state == taskspb.Queue_STATE_UNSPECIFIED || queue.State == state) {
+			queues = append(queues, queue)
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(queues), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &taskspb.ListQueuesResponse{
+		Queues:        []*taskspb.Queue{},
+		NextPageToken: nextPageToken,
+	}
+	for _, queue := range queues[start:end] {
+		response.Queues = append(response.Queues, proto.Clone(queue).(*taskspb.Queue))
+	}
+	return response, nil
+}
+
+// GetQueue deals with retrieving a specified queue.
+func (t *Tasks) GetQueue(ctx context.Context, req *taskspb.GetQueueRequest) (*taskspb.Queue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, err := t.getQueueLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(q.queue).(*taskspb.Queue), nil
+}
+
+// CreateQueue deals with creating a queue, defaults are applied
+// for rate limits and retry configuration that are not provided.
+func (t *Tasks) CreateQueue(ctx context.Context, req *taskspb.CreateQueueRequest) (*taskspb.Queue, error) {
+	if !isValidTasksName(req.Parent, "locations") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid location name: %s", req.Parent)
+	}
+	if req.Queue == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A queue must be provided")
+	}
+	if tasksParentName(req.Queue.Name) != req.Parent || !isValidTasksName(req.Queue.Name, "queues") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid queue name: %s, must be in %s", req.Queue.Name, req.Parent)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.queues[req.Queue.Name]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Queue %s already exists", req.Queue.Name)
+	}
+	return t.createQueueLocked(req.Queue)
+}
+
+// UpdateQueue deals with updating the rate limits, retry configuration and routing
+// of a queue, as per Cloud Tasks the queue is created if it doesn't exist.
+func (t *Tasks) UpdateQueue(ctx context.Context, req *taskspb.UpdateQueueRequest) (*taskspb.Queue, error) {
+	if req.Queue == nil || !isValidTasksName(req.Queue.Name, "queues") {
+		return nil, status.Errorf(codes.InvalidArgument, "A queue with a valid name must be provided")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, exists := t.queues[req.Queue.Name]
+	if !exists {
+		return t.createQueueLocked(req.Queue)
+	}
+	queue := proto.Clone(q.queue).(*taskspb.Queue)
+	err := applyQueueUpdate(queue, req.Queue, req.UpdateMask.GetPaths())
+	if err != nil {
+		return nil, err
+	}
+	err = t.writeResourceLocked(queue.Name, tasksQueueFile, queue)
+	if err != nil {
+		return nil, err
+	}
+	q.queue = queue
+	if q.tokens > float64(queue.RateLimits.MaxBurstSize) {
+		q.tokens = float64(queue.RateLimits.MaxBurstSize)
+	}
+	t.wakeDispatcher()
+	return proto.Clone(queue).(*taskspb.Queue), nil
+}
+
+// DeleteQueue deals with deleting a queue along with all of its tasks.
+func (t *Tasks) DeleteQueue(ctx context.Context, req *taskspb.DeleteQueueRequest) (*emptypb.Empty, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.getQueueLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = t.fs.RemoveAll(t.resourceDir(req.Name))
+	if err != nil {
+		return nil, err
+	}
+	delete(t.queues, req.Name)
+	return &emptypb.Empty{}, nil
+}
+
+// PurgeQueue deals with deleting all the tasks in a queue.
+func (t *Tasks) PurgeQueue(ctx context.Context, req *taskspb.PurgeQueueRequest) (*taskspb.Queue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, err := t.getQueueLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	now := t.now()
+	for name := range q.tasks {
+		err = t.removeTaskLocked(q, name, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.updateQueueLocked(q, func(queue *taskspb.Queue) {
+		queue.PurgeTime = timestamppb.New(now)
+	})
+}
+
+// PauseQueue deals with pausing a queue, tasks can still be added
+// to a paused queue but they will not be dispatched until it is resumed.
+func (t *Tasks) PauseQueue(ctx context.Context, req *taskspb.PauseQueueRequest) (*taskspb.Queue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, err := t.getQueueLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return t.updateQueueLocked(q, func(queue *taskspb.Queue) {
+		queue.State = taskspb.Queue_PAUSED
+	})
+}
+
+// ResumeQueue deals with resuming the dispatch of tasks in a paused queue.
+func (t *Tasks) ResumeQueue(ctx context.Context, req *taskspb.ResumeQueueRequest) (*taskspb.Queue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, err := t.getQueueLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := t.updateQueueLocked(q, func(queue *taskspb.Queue) {
+		queue.State = taskspb.Queue_RUNNING
+	})
+	t.wakeDispatcher()
+	return queue, err
+}
+
+// GetIamPolicy retrieves the IAM policy for a queue.
+func (t *Tasks) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	err := t.checkQueuePolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return t.iamPolicy.GetIamPolicy(ctx, req)
+}
+
+// SetIamPolicy deals with setting the IAM policy for a queue.
+func (t *Tasks) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	err := t.checkQueuePolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return t.iamPolicy.SetIamPolicy(ctx, req)
+}
+
+// TestIamPermissions checks the permissions the caller has for a queue.
+func (t *Tasks) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	err := t.checkQueuePolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return t.iamPolicy.TestIamPermissions(ctx, req)
+}
+
+// ListTasks deals with listing the tasks in a queue in the order they are scheduled.
+func (t *Tasks) ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) (*taskspb.ListTasksResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, err := t.getQueueLocked(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	tasks := q.scheduledTasks()
+	start, end, nextPageToken, err := pagination.Page(len(tasks), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &taskspb.ListTasksResponse{
+		Tasks:         []*taskspb.Task{},
+		NextPageToken: nextPageToken,
+	}
+	for _, task := range tasks[start:end] {
+		response.Tasks = append(response.Tasks, taskView(task.task, req.ResponseView))
+	}
+	return response, nil
+}
+
+// GetTask deals with retrieving a specified task.
+func (t *Tasks) GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, task, err := t.getTaskLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return taskView(task.task, req.ResponseView), nil
+}
+
+// CreateTask deals with adding a task to a queue, tasks with a name are deduplicated
+// so a task can't be created with the name of an existing or recently deleted task.
+func (t *Tasks) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	if req.Task == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A task must be provided")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, err := t.getQueueLocked(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	now := t.now()
+	task := proto.Clone(req.Task).(*taskspb.Task)
+	if task.Name == "" {
+		task.Name, err = t.newTaskNameLocked(q)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = t.checkTaskNameLocked(q, task.Name, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.prepareTask(task, now)
+	if err != nil {
+		return nil, err
+	}
+	err = t.writeResourceLocked(task.Name, tasksTaskFile, task)
+	if err != nil {
+		return nil, err
+	}
+	q.tasks[task.Name] = &tasksTask{task: task}
+	t.wakeDispatcher()
+	return taskView(task, req.ResponseView), nil
+}
+
+// DeleteTask deals with deleting a task that has not yet succeeded or
+// permanently failed.
+func (t *Tasks) DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) (*emptypb.Empty, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, _, err := t.getTaskLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = t.removeTaskLocked(q, req.Name, t.now())
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// RunTask forces a task to be dispatched straight away, even when
+// the queue is paused or the task is waiting to be retried.
+func (t *Tasks) RunTask(ctx context.Context, req *taskspb.RunTaskRequest) (*taskspb.Task, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, task, err := t.getTaskLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !task.dispatching {
+		task.task.ScheduleTime = timestamppb.New(t.now())
+		err = t.writeResourceLocked(task.task.Name, tasksTaskFile, task.task)
+		if err != nil {
+			return nil, err
+		}
+		task.forced = true
+		t.wakeDispatcher()
+	}
+	return taskView(task.task, req.ResponseView), nil
+}
+
+// prepareTask validates the target of a new task and applies
+// defaults for the HTTP method, schedule time and dispatch deadline.
+func (t *Tasks) prepareTask(task *taskspb.Task, now time.Time) error {
+	switch {
+	case task.GetHttpRequest() != nil:
+		err := t.prepareHTTPRequest(task.GetHttpRequest())
+		if err != nil {
+			return err
+		}
+	case task.GetAppEngineHttpRequest() != nil:
+		err := prepareAppEngineHTTPRequest(task.GetAppEngineHttpRequest())
+		if err != nil {
+			return err
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "A task must have either an HTTP request or an App Engine HTTP request")
+	}
+	if task.ScheduleTime == nil {
+		task.ScheduleTime = timestamppb.New(now)
+	}
+	if task.ScheduleTime.AsTime().After(now.Add(tasksMaxScheduleAhead)) {
+		return status.Errorf(codes.InvalidArgument, "The schedule time of a task can not be more than 30 days in the future")
+	}
+	if task.DispatchDeadline == nil {
+		task.DispatchDeadline = durationpb.New(tasksDefaultDispatchDeadline)
+	}
+	deadline := task.DispatchDeadline.AsDuration()
+	if deadline < tasksMinDispatchDeadline || deadline > tasksMaxDispatchDeadline {
+		return status.Errorf(codes.InvalidArgument, "The dispatch deadline must be between 15 seconds and 30 minutes")
+	}
+	task.CreateTime = timestamppb.New(now)
+	task.DispatchCount = 0
+	task.ResponseCount = 0
+	task.FirstAttempt = nil
+	task.LastAttempt = nil
+	task.View = taskspb.Task_FULL
+	return nil
+}
+
+func (t *Tasks) prepareHTTPRequest(httpRequest *taskspb.HttpRequest) error {
+	target, err := url.Parse(httpRequest.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return status.Errorf(codes.InvalidArgument, "Invalid task URL: %s, must be an absolute http or https URL", httpRequest.Url)
+	}
+	if httpRequest.HttpMethod == taskspb.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+		httpRequest.HttpMethod = taskspb.HttpMethod_POST
+	}
+	err = validateTaskBody(httpRequest.HttpMethod, httpRequest.Body)
+	if err != nil {
+		return err
+	}
+	serviceAccount := httpRequest.GetOidcToken().GetServiceAccountEmail() + httpRequest.GetOauthToken().GetServiceAccountEmail()
+	usesToken := httpRequest.GetOidcToken() != nil || httpRequest.GetOauthToken() != nil
+	if usesToken && serviceAccount == "" {
+		return status.Errorf(codes.InvalidArgument, "A service account email must be provided for task tokens")
+	}
+	if usesToken && t.tokenService == nil {
+		return status.Errorf(codes.Unimplemented, "Task tokens are not supported without the token service")
+	}
+	return nil
+}
+
+func prepareAppEngineHTTPRequest(appEngineRequest *taskspb.AppEngineHttpRequest) error {
+	if appEngineRequest.RelativeUri == "" {
+		appEngineRequest.RelativeUri = "/"
+	}
+	if !strings.HasPrefix(appEngineRequest.RelativeUri, "/") {
+		return status.Errorf(codes.InvalidArgument, "The relative URI of a task must begin with \"/\"")
+	}
+	if appEngineRequest.HttpMethod == taskspb.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+		appEngineRequest.HttpMethod = taskspb.HttpMethod_POST
+	}
+	return validateTaskBody(appEngineRequest.HttpMethod, appEngineRequest.Body)
+}
+
+func validateTaskBody(method taskspb.HttpMethod, body []byte) error {
+	bodyAllowed := method == taskspb.HttpMethod_POST || method == taskspb.HttpMethod_PUT ||
+		method == taskspb.HttpMethod_PATCH
+	if len(body) > 0 && !bodyAllowed {
+		return status.Errorf(codes.InvalidArgument, "A body can only be provided for POST, PUT and PATCH requests")
+	}
+	return nil
+}
+
+// checkQueuePolicyResource ensures IAM policies are managed by
+// the emulator and that the queue exists.
+func (t *Tasks) checkQueuePolicyResource(resource string) error {
+	if t.iamPolicy == nil {
+		return status.Errorf(codes.Unimplemented, "IAM policies are only supported when IAM is enabled")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.getQueueLocked(resource)
+	return err
+}
+
+func (t *Tasks) createQueueLocked(provided *taskspb.Queue) (*taskspb.Queue, error) {
+	queue := &taskspb.Queue{Name: provided.Name, State: taskspb.Queue_RUNNING}
+	err := applyQueueUpdate(queue, provided, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = t.writeResourceLocked(queue.Name, tasksQueueFile, queue)
+	if err != nil {
+		return nil, err
+	}
+	t.queues[queue.Name] = &tasksQueue{
+		queue:      queue,
+		tasks:      map[string]*tasksTask{},
+		tokens:     float64(queue.RateLimits.MaxBurstSize),
+		refilledAt: t.now(),
+	}
+	return proto.Clone(queue).(*taskspb.Queue), nil
+}
+
+// updateQueueLocked applies a change to a copy of a queue which replaces
+// the queue once it has been persisted.
+func (t *Tasks) updateQueueLocked(q *tasksQueue, update func(*taskspb.Queue)) (*taskspb.Queue, error) {
+	queue := proto.Clone(q.queue).(*taskspb.Queue)
+	update(queue)
+	err := t.writeResourceLocked(queue.Name, tasksQueueFile, queue)
+	if err != nil {
+		return nil, err
+	}
+	q.queue = queue
+	return proto.Clone(queue).(*taskspb.Queue), nil
+}
+
+func (t *Tasks) getQueueLocked(name string) (*tasksQueue, error) {
+	if !isValidTasksName(name, "queues") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid queue name: %s", name)
+	}
+	q, ok := t.queues[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	return q, nil
+}
+
+func (t *Tasks) getTaskLocked(name string) (*tasksQueue, *tasksTask, error) {
+	if !isValidTasksName(name, "tasks") {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid task name: %s", name)
+	}
+	q, err := t.getQueueLocked(tasksParentName(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	task, ok := q.tasks[name]
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	return q, task, nil
+}
+
+// checkTaskNameLocked ensures the name provided for a new task belongs to the queue
+// and hasn't been used by a task that exists or was deleted recently.
+func (t *Tasks) checkTaskNameLocked(q *tasksQueue, name string, now time.Time) error {
+	if tasksParentName(name) != q.queue.Name || !isValidTasksName(name, "tasks") {
+		return status.Errorf(codes.InvalidArgument, "Invalid task name: %s, must be in %s", name, q.queue.Name)
+	}
+	for tombstoned, removedAt := range t.tombstones {
+		if now.Sub(removedAt) > tasksTombstoneRetention {
+			delete(t.tombstones, tombstoned)
+		}
+	}
+	_, removedRecently := t.tombstones[name]
+	if _, exists := q.tasks[name]; exists || removedRecently {
+		return status.Errorf(codes.AlreadyExists, "A task named %s exists or existed too recently", name)
+	}
+	return nil
+}
+
+// newTaskNameLocked generates a name for a task with a random 19 digit ID.
+func (t *Tasks) newTaskNameLocked(q *tasksQueue) (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(9000000000000000000))
+		if err != nil {
+			return "", err
+		}
+		n.Add(n, big.NewInt(1000000000000000000))
+		name := fmt.Sprintf("%s/tasks/%s", q.queue.Name, n.String())
+		if _, exists := q.tasks[name]; !exists {
+			return name, nil
+		}
+	}
+}
+
+// removeTaskLocked deletes a task that has been deleted, purged or has finished,
+// the name of the task is kept for deduplication.
+func (t *Tasks) removeTaskLocked(q *tasksQueue, name string, now time.Time) error {
+	err := t.fs.RemoveAll(t.resourceDir(name))
+	if err != nil {
+		return err
+	}
+	delete(q.tasks, name)
+	t.tombstones[name] = now
+	return nil
+}
+
+func (t *Tasks) queueNamesLocked() []string {
+	names := []string{}
+	for name := range t.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load deals with loading persisted queues and tasks when the emulator starts.
+func (t *Tasks) load() error {
+	queueNames := []string{}
+	taskNames := []string{}
+	walkFn := func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := strings.TrimPrefix(path.Dir(filePath), t.dataRootDir+"/")
+		switch info.Name() {
+		case tasksQueueFile:
+			queueNames = append(queueNames, name)
+		case tasksTaskFile:
+			taskNames = append(taskNames, name)
+		}
+		return nil
+	}
+	err := afero.Walk(t.fs, t.dataRootDir, walkFn)
+	if err != nil {
+		return err
+	}
+	for _, name := range queueNames {
+		queue := &taskspb.Queue{}
+		err = t.readResourceLocked(name, tasksQueueFile, queue)
+		if err != nil {
+			return err
+		}
+		t.queues[name] = &tasksQueue{
+			queue:      queue,
+			tasks:      map[string]*tasksTask{},
+			tokens:     float64(queue.GetRateLimits().GetMaxBurstSize()),
+			refilledAt: t.now(),
+		}
+	}
+	for _, name := range taskNames {
+		q, ok := t.queues[tasksParentName(name)]
+		if !ok {
+			continue
+		}
+		task := &taskspb.Task{}
+		err = t.readResourceLocked(name, tasksTaskFile, task)
+		if err != nil {
+			return err
+		}
+		q.tasks[name] = &tasksTask{task: task}
+	}
+	return nil
+}
+
+func (t *Tasks) resourceDir(name string) string {
+	return path.Join(t.dataRootDir, name)
+}
+
+func (t *Tasks) readResourceLocked(name string, fileName string, resource proto.Message) error {
+	bytes, err := afero.ReadFile(t.fs, path.Join(t.resourceDir(name), fileName))
+	if os.IsNotExist(err) {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(bytes, resource)
+}
+
+func (t *Tasks) writeResourceLocked(name string, fileName string, resource proto.Message) error {
+	err := t.fs.MkdirAll(t.resourceDir(name), 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := protojson.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(t.fs, path.Join(t.resourceDir(name), fileName), bytes, 0755)
+}
+
+// scheduledTasks produces the tasks in a queue ordered by schedule time.
+func (q *tasksQueue) scheduledTasks() []*tasksTask {
+	tasks := []*tasksTask{}
+	for _, task := range q.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		iTime := tasks[i].task.ScheduleTime.AsTime()
+		jTime := tasks[j].task.ScheduleTime.AsTime()
+		if iTime.Equal(jTime) {
+			return tasks[i].task.Name < tasks[j].task.Name
+		}
+		return iTime.Before(jTime)
+	})
+	return tasks
+}
+
+// applyQueueUpdate copies the fields in the provided paths from the update to the queue,
+// all the fields that can be configured are copied when no paths are provided.
+func applyQueueUpdate(queue *taskspb.Queue, update *taskspb.Queue, paths []string) error {
+	if len(paths) == 0 {
+		paths = []string{"app_engine_routing_override", "rate_limits", "retry_config", "stackdriver_logging_config"}
+	}
+	if queue.RateLimits == nil {
+		queue.RateLimits = &taskspb.RateLimits{}
+	}
+	if queue.RetryConfig == nil {
+		queue.RetryConfig = &taskspb.RetryConfig{}
+	}
+	for _, fieldPath := range paths {
+		switch fieldPath {
+		case "app_engine_routing_override":
+			queue.AppEngineRoutingOverride = update.AppEngineRoutingOverride
+		case "rate_limits":
+			queue.RateLimits = &taskspb.RateLimits{
+				MaxDispatchesPerSecond:  update.GetRateLimits().GetMaxDispatchesPerSecond(),
+				MaxConcurrentDispatches: update.GetRateLimits().GetMaxConcurrentDispatches(),
+			}
+		case "rate_limits.max_dispatches_per_second":
+			queue.RateLimits.MaxDispatchesPerSecond = update.GetRateLimits().GetMaxDispatchesPerSecond()
+		case "rate_limits.max_concurrent_dispatches":
+			queue.RateLimits.MaxConcurrentDispatches = update.GetRateLimits().GetMaxConcurrentDispatches()
+		case "retry_config":
+			queue.RetryConfig = &taskspb.RetryConfig{}
+			if update.RetryConfig != nil {
+				queue.RetryConfig = proto.Clone(update.RetryConfig).(*taskspb.RetryConfig)
+			}
+		case "retry_config.max_attempts":
+			queue.RetryConfig.MaxAttempts = update.GetRetryConfig().GetMaxAttempts()
+		case "retry_config.max_retry_duration":
+			queue.RetryConfig.MaxRetryDuration = update.GetRetryConfig().GetMaxRetryDuration()
+		case "retry_config.min_backoff":
+			queue.RetryConfig.MinBackoff = update.GetRetryConfig().GetMinBackoff()
+		case "retry_config.max_backoff":
+			queue.RetryConfig.MaxBackoff = update.GetRetryConfig().GetMaxBackoff()
+		case "retry_config.max_doublings":
+			queue.RetryConfig.MaxDoublings = update.GetRetryConfig().GetMaxDoublings()
+		case "stackdriver_logging_config", "stackdriver_logging_config.sampling_ratio":
+			queue.StackdriverLoggingConfig = update.StackdriverLoggingConfig
+		default:
+			return status.Errorf(codes.InvalidArgument, "Unsupported update mask path: %s", fieldPath)
+		}
+	}
+	return applyQueueDefaults(queue)
+}
+
+// applyQueueDefaults fills in the rate limits and retry configuration that
+// have not been set and validates the ones that have.
+func applyQueueDefaults(queue *taskspb.Queue) error {
+	rateLimits := queue.RateLimits
+	if rateLimits.MaxDispatchesPerSecond == 0 {
+		rateLimits.MaxDispatchesPerSecond = tasksDefaultMaxDispatchesPerSecond
+	}
+	if rateLimits.MaxDispatchesPerSecond < 0 || rateLimits.MaxDispatchesPerSecond > tasksMaxDispatchesPerSecond {
+		return status.Errorf(codes.InvalidArgument, "The max dispatches per second must be between 0 and 500")
+	}
+	if rateLimits.MaxConcurrentDispatches == 0 {
+		rateLimits.MaxConcurrentDispatches = tasksDefaultMaxConcurrentDispatches
+	}
+	if rateLimits.MaxConcurrentDispatches < 0 || rateLimits.MaxConcurrentDispatches > tasksMaxConcurrentDispatches {
+		return status.Errorf(codes.InvalidArgument, "The max concurrent dispatches must be between 1 and 5000")
+	}
+	// The burst size is derived from the dispatch rate in the same way as Cloud Tasks,
+	// which allows 100 tasks to be dispatched at once for the default rate.
+	rateLimits.MaxBurstSize = int32(rateLimits.MaxDispatchesPerSecond / 5)
+	if rateLimits.MaxBurstSize < 1 {
+		rateLimits.MaxBurstSize = 1
+	}
+
+	retryConfig := queue.RetryConfig
+	if retryConfig.MaxAttempts == 0 {
+		retryConfig.MaxAttempts = tasksDefaultMaxAttempts
+	}
+	if retryConfig.MaxAttempts < -1 {
+		return status.Errorf(codes.InvalidArgument, "The max attempts must be -1 for unlimited attempts or greater than 0")
+	}
+	if retryConfig.MaxRetryDuration.AsDuration() < 0 {
+		return status.Errorf(codes.InvalidArgument, "The max retry duration can not be negative")
+	}
+	if retryConfig.MinBackoff == nil {
+		retryConfig.MinBackoff = durationpb.New(tasksDefaultMinBackoff)
+	}
+	if retryConfig.MaxBackoff == nil {
+		retryConfig.MaxBackoff = durationpb.New(tasksDefaultMaxBackoff)
+	}
+	if retryConfig.MinBackoff.AsDuration() < 0 || retryConfig.MinBackoff.AsDuration() > retryConfig.MaxBackoff.AsDuration() {
+		return status.Errorf(codes.InvalidArgument, "The min backoff must not be negative or greater than the max backoff")
+	}
+	if retryConfig.MaxDoublings == 0 {
+		retryConfig.MaxDoublings = tasksDefaultMaxDoublings
+	}
+	if retryConfig.MaxDoublings < 0 {
+		return status.Errorf(codes.InvalidArgument, "The max doublings can not be negative")
+	}
+	return nil
+}
+
+// taskView produces a copy of a task for the provided view,
+// the basic view omits the headers and body of the request.
+func taskView(task *taskspb.Task, view taskspb.Task_View) *taskspb.Task {
+	viewed := proto.Clone(task).(*taskspb.Task)
+	if view == taskspb.Task_FULL {
+		return viewed
+	}
+	viewed.View = taskspb.Task_BASIC
+	if httpRequest := viewed.GetHttpRequest(); httpRequest != nil {
+		httpRequest.Headers = nil
+		httpRequest.Body = nil
+	}
+	if appEngineRequest := viewed.GetAppEngineHttpRequest(); appEngineRequest != nil {
+		appEngineRequest.Headers = nil
+		appEngineRequest.Body = nil
+	}
+	return viewed
+}
+
+func parseQueueStateFilter(filter string) (taskspb.Queue_State, error) {
+	if strings.TrimSpace(filter) == "" {
+		return taskspb.Queue_STATE_UNSPECIFIED, nil
+	}
+	fieldAndValue := strings.SplitN(filter, ":", 2)
+	if len(fieldAndValue) == 2 && strings.TrimSpace(fieldAndValue[0]) == "state" {
+		state, ok := taskspb.Queue_State_value[strings.TrimSpace(fieldAndValue[1])]
+		if ok {
+			return taskspb.Queue_State(state), nil
+		}
+	}
+	return taskspb.Queue_STATE_UNSPECIFIED, status.Errorf(codes.InvalidArgument, "Unsupported filter: %s, only state filters are supported", filter)
+}
+
+// isValidTasksName checks that a resource name is made up of the
+// expected collection/ID pairs up to and including the provided collection.
+func isValidTasksName(name string, collection string) bool {
+	expected := []string{"projects", "locations", "queues", "tasks"}
+	pieces := strings.Split(name, "/")
+	if len(pieces)%2 != 0 || len(pieces) > len(expected)*2 {
+		return false
+	}
+	for i := 0; i < len(pieces); i = i + 2 {
+		if pieces[i] != expected[i/2] || pieces[i+1] == "" || strings.Contains(pieces[i+1], "..") {
+			return false
+		}
+	}
+	if len(pieces) < 2 || pieces[len(pieces)-2] != collection {
+		return false
+	}
+	switch collection {
+	case "queues":
+		return tasksQueueIDPattern.MatchString(pieces[5])
+	case "tasks":
+		return tasksQueueIDPattern.MatchString(pieces[5]) && tasksTaskIDPattern.MatchString(pieces[7])
+	}
+	return true
+}
+
+func tasksParentName(name string) string {
+	pieces := strings.Split(name, "/")
+	if len(pieces) < 2 {
+		return ""
+	}
+	return strings.Join(pieces[:len(pieces)-2], "/")
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+const (
+	tasksIdleWait  = time.Minute
+	tasksUserAgent = "Google-Cloud-Tasks"
+)
+
+// dispatchLoop dispatches tasks as they become due, waking up early
+// whenever tasks or queues change.
+func (t *Tasks) dispatchLoop() {
+	defer t.loop.Done()
+	for {
+		wait := t.dispatchDueTasks()
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.wake:
+		case <-timer.C:
+		case <-t.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func (t *Tasks) wakeDispatcher() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchDueTasks starts dispatching the tasks that are due in running queues,
+// as allowed by the rate limits of each queue, and determines how long to wait
+// before the next task becomes due.
+func (t *Tasks) dispatchDueTasks() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	wait := tasksIdleWait
+	for _, name := range t.queueNamesLocked() {
+		q := t.queues[name]
+		q.refill(now)
+		running := q.queue.State == taskspb.Queue_RUNNING
+		for _, task := range q.scheduledTasks() {
+			if task.dispatching {
+				continue
+			}
+			if task.forced {
+				t.startDispatchLocked(q, task)
+				continue
+			}
+			scheduleTime := task.task.ScheduleTime.AsTime()
+			if !running || q.inFlight >= int(q.queue.RateLimits.MaxConcurrentDispatches) {
+				continue
+			}
+			if scheduleTime.After(now) {
+				wait = minDuration(wait, scheduleTime.Sub(now))
+				continue
+			}
+			if q.tokens < 1 {
+				wait = minDuration(wait, q.nextTokenIn())
+				continue
+			}
+			q.tokens = q.tokens - 1
+			t.startDispatchLocked(q, task)
+		}
+	}
+	return wait
+}
+
+// startDispatchLocked marks a task as being dispatched and sends
+// its request in the background.
+func (t *Tasks) startDispatchLocked(q *tasksQueue, task *tasksTask) {
+	task.dispatching = true
+	task.forced = false
+	q.inFlight = q.inFlight + 1
+	t.dispatches.Add(1)
+	var routingOverride *taskspb.AppEngineRouting
+	if q.queue.AppEngineRoutingOverride != nil {
+		routingOverride = proto.Clone(q.queue.AppEngineRoutingOverride).(*taskspb.AppEngineRouting)
+	}
+	go t.dispatch(q.queue.Name, proto.Clone(task.task).(*taskspb.Task), routingOverride, task.previousResponse)
+}
+
+// dispatch sends the request for a task and records the outcome of the attempt.
+func (t *Tasks) dispatch(queueName string, task *taskspb.Task, routingOverride *taskspb.AppEngineRouting, previousResponse int) {
+	defer t.dispatches.Done()
+	dispatchTime := t.now()
+	responseCode := 0
+	req, err := t.dispatchRequest(task, routingOverride, previousResponse)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), task.DispatchDeadline.AsDuration())
+		var resp *http.Response
+		resp, err = t.client.Do(req.WithContext(ctx))
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			responseCode = resp.StatusCode
+		}
+		cancel()
+	}
+	t.completeDispatch(queueName, task.Name, dispatchTime, responseCode, err)
+}
+
+// completeDispatch records an attempt for a task, tasks that succeed or run out of
+// attempts are removed while the others are scheduled to be retried after a backoff.
+func (t *Tasks) completeDispatch(queueName string, taskName string, dispatchTime time.Time, responseCode int, dispatchErr error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.wakeDispatcher()
+	q, ok := t.queues[queueName]
+	if !ok {
+		return
+	}
+	q.inFlight = q.inFlight - 1
+	task, ok := q.tasks[taskName]
+	if !ok {
+		// The task was deleted or purged while it was being dispatched.
+		return
+	}
+	task.dispatching = false
+	now := t.now()
+	attempt := &taskspb.Attempt{
+		ScheduleTime:   task.task.ScheduleTime,
+		DispatchTime:   timestamppb.New(dispatchTime),
+		ResponseStatus: attemptStatus(responseCode, dispatchErr),
+	}
+	task.task.DispatchCount = task.task.DispatchCount + 1
+	if responseCode != 0 {
+		attempt.ResponseTime = timestamppb.New(now)
+		task.task.ResponseCount = task.task.ResponseCount + 1
+		task.previousResponse = responseCode
+	}
+	if task.task.FirstAttempt == nil {
+		task.task.FirstAttempt = &taskspb.Attempt{DispatchTime: attempt.DispatchTime}
+	}
+	task.task.LastAttempt = attempt
+	if (responseCode >= 200 && responseCode < 300) || q.retriesExhausted(task.task, now) {
+		t.removeTaskLocked(q, taskName, now)
+		return
+	}
+	retryConfig := q.queue.RetryConfig
+	backoff := retryBackoff(
+		retryConfig.MinBackoff.AsDuration(),
+		retryConfig.MaxBackoff.AsDuration(),
+		retryConfig.MaxDoublings,
+		task.task.DispatchCount,
+	)
+	task.task.ScheduleTime = timestamppb.New(now.Add(backoff))
+	t.writeResourceLocked(taskName, tasksTaskFile, task.task)
+}
+
+// dispatchRequest builds the HTTP request for a task, targets are rewritten
+// to local URLs and the headers set by Cloud Tasks are added.
+func (t *Tasks) dispatchRequest(task *taskspb.Task, routingOverride *taskspb.AppEngineRouting, previousResponse int) (*http.Request, error) {
+	taskPieces := strings.Split(task.Name, "/")
+	queueID := taskPieces[5]
+	taskID := taskPieces[7]
+	headerPrefix := "X-CloudTasks-"
+	var method taskspb.HttpMethod
+	var target string
+	var headers map[string]string
+	var body []byte
+	if httpRequest := task.GetHttpRequest(); httpRequest != nil {
+		localURL, err := localTargetURL(t.targets, httpRequest.Url)
+		if err != nil {
+			return nil, err
+		}
+		method, target, headers, body = httpRequest.HttpMethod, localURL, httpRequest.Headers, httpRequest.Body
+	} else {
+		appEngineRequest := task.GetAppEngineHttpRequest()
+		routing := appEngineRequest.AppEngineRouting
+		if routingOverride != nil {
+			routing = routingOverride
+		}
+		localURL, err := appEngineTargetURL(t.targets, routing.GetService(), appEngineRequest.RelativeUri)
+		if err != nil {
+			return nil, err
+		}
+		headerPrefix = "X-AppEngine-"
+		method = appEngineRequest.HttpMethod
+		target = localURL
+		headers, body = appEngineRequest.Headers, appEngineRequest.Body
+	}
+
+	req, err := http.NewRequest(method.String(), target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if len(body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	req.Header.Set("User-Agent", tasksUserAgent)
+	req.Header.Set(headerPrefix+"QueueName", queueID)
+	req.Header.Set(headerPrefix+"TaskName", taskID)
+	req.Header.Set(headerPrefix+"TaskRetryCount", strconv.Itoa(int(task.DispatchCount)))
+	req.Header.Set(headerPrefix+"TaskExecutionCount", strconv.Itoa(int(task.ResponseCount)))
+	eta := float64(task.ScheduleTime.AsTime().UnixNano()) / float64(time.Second)
+	req.Header.Set(headerPrefix+"TaskETA", strconv.FormatFloat(eta, 'f', 6, 64))
+	if previousResponse != 0 {
+		req.Header.Set(headerPrefix+"TaskPreviousResponse", strconv.Itoa(previousResponse))
+	}
+
+	err = t.authorize(req, task.GetHttpRequest())
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// authorize adds the OIDC or OAuth token requested for an HTTP task to its request,
+// the audience of OIDC tokens defaults to the URL of the task before it is rewritten.
+func (t *Tasks) authorize(req *http.Request, httpRequest *taskspb.HttpRequest) error {
+	if oidcToken := httpRequest.GetOidcToken(); oidcToken != nil {
+		audience := oidcToken.Audience
+		if audience == "" {
+			audience = httpRequest.Url
+		}
+		return addOIDCToken(req, t.tokenService, oidcToken.ServiceAccountEmail, audience)
+	}
+	if oauthToken := httpRequest.GetOauthToken(); oauthToken != nil {
+		return addOAuthToken(req, t.tokenService, oauthToken.ServiceAccountEmail, oauthToken.Scope)
+	}
+	return nil
+}
+
+// refill adds the tokens accrued since the bucket was last
+// refilled, up to the burst size of the queue.
+func (q *tasksQueue) refill(now time.Time) {
+	rateLimits := q.queue.RateLimits
+	elapsed := now.Sub(q.refilledAt).Seconds()
+	if elapsed > 0 {
+		q.tokens = q.tokens + elapsed*rateLimits.MaxDispatchesPerSecond
+	}
+	if q.tokens > float64(rateLimits.MaxBurstSize) {
+		q.tokens = float64(rateLimits.MaxBurstSize)
+	}
+	q.refilledAt = now
+}
+
+func (q *tasksQueue) nextTokenIn() time.Duration {
+	missing := 1 - q.tokens
+	return time.Duration(missing / q.queue.RateLimits.MaxDispatchesPerSecond * float64(time.Second))
+}
+
+// retriesExhausted determines whether a task that failed should not be retried,
+// when both limits are set a task is retried until both have been reached.
+func (q *tasksQueue) retriesExhausted(task *taskspb.Task, now time.Time) bool {
+	retryConfig := q.queue.RetryConfig
+	attemptsLimited := retryConfig.MaxAttempts > 0
+	durationLimited := retryConfig.MaxRetryDuration.AsDuration() > 0
+	if !attemptsLimited && !durationLimited {
+		return false
+	}
+	attemptsReached := !attemptsLimited || task.DispatchCount >= retryConfig.MaxAttempts
+	age := now.Sub(task.FirstAttempt.DispatchTime.AsTime())
+	durationReached := !durationLimited || age >= retryConfig.MaxRetryDuration.AsDuration()
+	return attemptsReached && durationReached
+}
@@ -0,0 +1,430 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package grpc
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	. "gopkg.in/check.v1"
+
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+)
+
+type TasksSuite struct {
+	fs           afero.Fs
+	tokens       *tokens.Service
+	tasks        *Tasks
+	worker       *httptest.Server
+	received     chan *receivedTaskRequest
+	responseCode int
+	// release holds requests to the worker until it is closed, when set.
+	release chan struct{}
+}
+
+type receivedTaskRequest struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+var _ = Suite(&TasksSuite{})
+
+const (
+	testTasksLocation       = "projects/test-project/locations/europe-west2"
+	testTasksQueue          = testTasksLocation + "/queues/jobs"
+	testTasksServiceAccount = "tasks@test-project.iam.gserviceaccount.com"
+)
+
+func (s *TasksSuite) SetUpTest(c *C) {
+	s.received = make(chan *receivedTaskRequest, 10)
+	s.responseCode = http.StatusOK
+	s.release = nil
+	s.worker = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.received <- &receivedTaskRequest{path: r.URL.RequestURI(), headers: r.Header, body: string(body)}
+		if s.release != nil {
+			<-s.release
+		}
+		w.WriteHeader(s.responseCode)
+	}))
+	s.fs = afero.NewMemMapFs()
+	tokenService, err := tokens.New("/data/gcloud/tokens", s.fs)
+	c.Assert(err, IsNil)
+	s.tokens = tokenService
+	s.tasks = s.newTasks(c)
+	c.Assert(s.tasks.Start(context.Background()), IsNil)
+	_, err = s.tasks.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: testTasksLocation,
+		Queue: &taskspb.Queue{
+			Name: testTasksQueue,
+			RetryConfig: &taskspb.RetryConfig{
+				MaxAttempts: 3,
+				MinBackoff:  durationpb.New(10 * time.Millisecond),
+				MaxBackoff:  durationpb.New(50 * time.Millisecond),
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *TasksSuite) TearDownTest(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(s.tasks.Stop(ctx), IsNil)
+	s.worker.Close()
+}
+
+func (s *TasksSuite) newTasks(c *C) *Tasks {
+	tasks, err := NewTasks(
+		"/data/gcloud/tasks",
+		s.fs,
+		s.tokens,
+		map[string]string{"worker.example.com": s.worker.URL, "default": s.worker.URL + "/appengine"},
+		nil,
+		"127.0.0.1",
+		&noopHostsService{},
+	)
+	c.Assert(err, IsNil)
+	return tasks
+}
+
+func (s *TasksSuite) nextRequest(c *C) *receivedTaskRequest {
+	select {
+	case req := <-s.received:
+		return req
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the task to be dispatched")
+	}
+	return nil
+}
+
+func (s *TasksSuite) expectNoRequest(c *C) {
+	select {
+	case req := <-s.received:
+		c.Fatalf("unexpected task request for %s", req.path)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// waitForTaskRemoval waits for the outcome of the last attempt
+// for a task to be recorded, which removes the task.
+func (s *TasksSuite) waitForTaskRemoval(c *C, name string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := s.tasks.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: name})
+		if status.Code(err) == codes.NotFound {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %s to be removed", name)
+}
+
+func (s *TasksSuite) Test_dispatches_http_tasks_to_local_targets_with_oidc_tokens(c *C) {
+	task, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url:     "https://worker.example.com/jobs/resize?size=small",
+				Headers: map[string]string{"Content-Type": "application/json"},
+				Body:    []byte(`{"image":"cat.png"}`),
+				AuthorizationHeader: &taskspb.HttpRequest_OidcToken{OidcToken: &taskspb.OidcToken{
+					ServiceAccountEmail: testTasksServiceAccount,
+				}},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(task.Name, Matches, testTasksQueue+`/tasks/[0-9]{19}`)
+	c.Assert(task.View, Equals, taskspb.Task_BASIC)
+	c.Assert(task.GetHttpRequest().Body, IsNil)
+
+	req := s.nextRequest(c)
+	c.Assert(req.path, Equals, "/jobs/resize?size=small")
+	c.Assert(req.body, Equals, `{"image":"cat.png"}`)
+	c.Assert(req.headers.Get("Content-Type"), Equals, "application/json")
+	c.Assert(req.headers.Get("X-CloudTasks-QueueName"), Equals, "jobs")
+	c.Assert(req.headers.Get("X-CloudTasks-TaskName"), Equals, task.Name[strings.LastIndex(task.Name, "/")+1:])
+	c.Assert(req.headers.Get("X-CloudTasks-TaskRetryCount"), Equals, "0")
+	c.Assert(req.headers.Get("X-CloudTasks-TaskExecutionCount"), Equals, "0")
+	c.Assert(req.headers.Get("X-CloudTasks-TaskETA"), Matches, `[0-9]+\.[0-9]{6}`)
+	claims, err := s.tokens.Validate(strings.TrimPrefix(req.headers.Get("Authorization"), "Bearer "))
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testTasksServiceAccount)
+	c.Assert(claims.Audience, Equals, "https://worker.example.com/jobs/resize?size=small")
+}
+
+func (s *TasksSuite) Test_dispatches_app_engine_tasks_to_the_target_for_the_service(c *C) {
+	_, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_AppEngineHttpRequest{AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+				RelativeUri: "/tasks/email",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	req := s.nextRequest(c)
+	c.Assert(req.path, Equals, "/appengine/tasks/email")
+	c.Assert(req.headers.Get("X-AppEngine-QueueName"), Equals, "jobs")
+	c.Assert(req.headers.Get("X-AppEngine-TaskRetryCount"), Equals, "0")
+}
+
+func (s *TasksSuite) Test_failed_tasks_are_retried_until_max_attempts_is_reached(c *C) {
+	s.responseCode = http.StatusInternalServerError
+	task, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			Name: testTasksQueue + "/tasks/flaky",
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://worker.example.com/flaky",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i = i + 1 {
+		req := s.nextRequest(c)
+		c.Assert(req.headers.Get("X-CloudTasks-TaskRetryCount"), Equals, string(rune('0'+i)))
+		if i > 0 {
+			c.Assert(req.headers.Get("X-CloudTasks-TaskPreviousResponse"), Equals, "500")
+		}
+	}
+	s.expectNoRequest(c)
+	s.waitForTaskRemoval(c, task.Name)
+
+	// Task names can't be reused straight away.
+	_, err = s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task:   task,
+	})
+	c.Assert(status.Code(err), Equals, codes.AlreadyExists)
+}
+
+func (s *TasksSuite) Test_paused_queues_only_dispatch_tasks_once_resumed(c *C) {
+	_, err := s.tasks.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: testTasksQueue})
+	c.Assert(err, IsNil)
+	task, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://worker.example.com/paused",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	s.expectNoRequest(c)
+
+	queue, err := s.tasks.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: testTasksQueue})
+	c.Assert(err, IsNil)
+	c.Assert(queue.State, Equals, taskspb.Queue_RUNNING)
+	c.Assert(s.nextRequest(c).path, Equals, "/paused")
+	s.waitForTaskRemoval(c, task.Name)
+}
+
+func (s *TasksSuite) Test_run_task_dispatches_scheduled_tasks_straight_away(c *C) {
+	task, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://worker.example.com/later",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	s.expectNoRequest(c)
+	_, err = s.tasks.RunTask(context.Background(), &taskspb.RunTaskRequest{Name: task.Name})
+	c.Assert(err, IsNil)
+	c.Assert(s.nextRequest(c).path, Equals, "/later")
+}
+
+func (s *TasksSuite) Test_purging_a_queue_deletes_its_tasks(c *C) {
+	_, err := s.tasks.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: testTasksQueue})
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i = i + 1 {
+		_, err = s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: testTasksQueue,
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+					Url: "https://worker.example.com/purged",
+				}},
+			},
+		})
+		c.Assert(err, IsNil)
+	}
+	tasks, err := s.tasks.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: testTasksQueue, PageSize: 2})
+	c.Assert(err, IsNil)
+	c.Assert(tasks.Tasks, HasLen, 2)
+	c.Assert(tasks.NextPageToken, Equals, "2")
+
+	queue, err := s.tasks.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: testTasksQueue})
+	c.Assert(err, IsNil)
+	c.Assert(queue.PurgeTime, NotNil)
+	tasks, err = s.tasks.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: testTasksQueue})
+	c.Assert(err, IsNil)
+	c.Assert(tasks.Tasks, HasLen, 0)
+}
+
+func (s *TasksSuite) Test_queues_are_created_with_defaults_and_updated_with_a_mask(c *C) {
+	queue, err := s.tasks.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{Name: testTasksLocation + "/queues/emails"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(queue.State, Equals, taskspb.Queue_RUNNING)
+	c.Assert(queue.RateLimits.MaxDispatchesPerSecond, Equals, float64(500))
+	c.Assert(queue.RateLimits.MaxBurstSize, Equals, int32(100))
+	c.Assert(queue.RetryConfig.MaxAttempts, Equals, int32(100))
+	c.Assert(queue.RetryConfig.MaxDoublings, Equals, int32(16))
+
+	queue, err = s.tasks.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:        queue.Name,
+			RateLimits:  &taskspb.RateLimits{MaxDispatchesPerSecond: 2},
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 5},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"rate_limits.max_dispatches_per_second"}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(queue.RateLimits.MaxDispatchesPerSecond, Equals, float64(2))
+	c.Assert(queue.RateLimits.MaxBurstSize, Equals, int32(1))
+	c.Assert(queue.RetryConfig.MaxAttempts, Equals, int32(100))
+
+	_, err = s.tasks.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue:      &taskspb.Queue{Name: queue.Name, RateLimits: &taskspb.RateLimits{MaxDispatchesPerSecond: 1000}},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"rate_limits"}},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	queues, err := s.tasks.ListQueues(context.Background(), &taskspb.ListQueuesRequest{Parent: testTasksLocation})
+	c.Assert(err, IsNil)
+	c.Assert(queues.Queues, HasLen, 2)
+}
+
+func (s *TasksSuite) Test_queues_and_tasks_are_loaded_when_the_emulator_starts(c *C) {
+	_, err := s.tasks.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: testTasksQueue})
+	c.Assert(err, IsNil)
+	task, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://worker.example.com/restored",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	restarted := s.newTasks(c)
+	queue, err := restarted.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: testTasksQueue})
+	c.Assert(err, IsNil)
+	c.Assert(queue.State, Equals, taskspb.Queue_PAUSED)
+	restored, err := restarted.GetTask(context.Background(), &taskspb.GetTaskRequest{
+		Name:         task.Name,
+		ResponseView: taskspb.Task_FULL,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(restored.GetHttpRequest().Url, Equals, "https://worker.example.com/restored")
+}
+
+func (s *TasksSuite) Test_stop_waits_for_dispatches_in_progress_to_be_recorded(c *C) {
+	s.release = make(chan struct{})
+	task, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://worker.example.com/slow",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	s.nextRequest(c)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- s.tasks.Stop(ctx)
+	}()
+	select {
+	case <-stopped:
+		c.Fatal("expected stopping to wait for the dispatch in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(s.release)
+	c.Assert(<-stopped, IsNil)
+	_, err = s.tasks.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.Name})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
+func (s *TasksSuite) Test_stop_gives_up_waiting_for_dispatches_when_the_context_is_done(c *C) {
+	s.release = make(chan struct{})
+	defer close(s.release)
+	_, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://worker.example.com/slow",
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	s.nextRequest(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(s.tasks.Stop(ctx), Equals, context.DeadlineExceeded)
+}
+
+func (s *TasksSuite) Test_retry_backoff_doubles_then_increases_linearly(c *C) {
+	backoffs := []time.Duration{}
+	for attempts := int32(1); attempts <= 8; attempts = attempts + 1 {
+		backoffs = append(backoffs, retryBackoff(10*time.Second, 300*time.Second, 3, attempts))
+	}
+	c.Assert(backoffs, DeepEquals, []time.Duration{
+		10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second,
+		160 * time.Second, 240 * time.Second, 300 * time.Second, 300 * time.Second,
+	})
+}
+
+func (s *TasksSuite) Test_rejects_invalid_tasks(c *C) {
+	_, err := s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url:        "https://worker.example.com/get",
+				HttpMethod: taskspb.HttpMethod_GET,
+				Body:       []byte("body"),
+			}},
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksQueue,
+		Task:   &taskspb.Task{},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.tasks.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: testTasksLocation + "/queues/missing",
+		Task:   &taskspb.Task{},
+	})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+)
+
+// SignBlob is deprecated in favour of the IAM Credentials API.
+func (*Service) SignBlob(context.Context, *adminpb.SignBlobRequest) (*adminpb.SignBlobResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SignBlob not implemented, use the IAM Credentials API")
+}
+
+// SignJwt is deprecated in favour of the IAM Credentials API.
+func (*Service) SignJwt(context.Context, *adminpb.SignJwtRequest) (*adminpb.SignJwtResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SignJwt not implemented, use the IAM Credentials API")
+}
+
+// QueryAuditableServices deals with listing the services that support audit logs.
+func (*Service) QueryAuditableServices(
+	context.Context,
+	*adminpb.QueryAuditableServicesRequest,
+) (*adminpb.QueryAuditableServicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAuditableServices not implemented")
+}
+
+// LintPolicy deals with validating the conditions of an IAM policy.
+func (*Service) LintPolicy(context.Context, *adminpb.LintPolicyRequest) (*adminpb.LintPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LintPolicy not implemented")
+}
+
+// projectName extracts the project from a resource name
+// in the format projects/{project}.
+func projectName(name string) (string, bool) {
+	segments := strings.Split(name, "/")
+	if len(segments) < 2 || segments[0] != "projects" || !isValidNameSegment(segments[1]) {
+		return "", false
+	}
+	return "projects/" + segments[1], true
+}
+
+// resourceFromFullName extracts the relative resource name from a full resource name.
+// (e.g. //cloudresourcemanager.googleapis.com/projects/p -> projects/p)
+func resourceFromFullName(fullResourceName string) (string, bool) {
+	if !strings.HasPrefix(fullResourceName, "//") {
+		return "", false
+	}
+	serviceAndResource := strings.SplitN(strings.TrimPrefix(fullResourceName, "//"), "/", 2)
+	if len(serviceAndResource) != 2 || serviceAndResource[1] == "" {
+		return "", false
+	}
+	return serviceAndResource[1], true
+}
+
+func isValidNameSegment(segment string) bool {
+	return segment != "" && segment != "." && segment != ".." && !strings.ContainsAny(segment, "/\\")
+}
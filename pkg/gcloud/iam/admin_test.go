@@ -0,0 +1,213 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package iam
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/oauth2"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+type AdminSuite struct {
+	service *Service
+}
+
+var _ = Suite(&AdminSuite{})
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	fs := afero.NewMemMapFs()
+	tokenService, err := tokens.New("/data/gcloud/tokens", fs)
+	c.Assert(err, IsNil)
+	service, err := New("/data/gcloud/iam", fs, tokenService, testProject, testOwner, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+	s.service = service
+}
+
+func (s *AdminSuite) Test_key_files_authenticate_their_service_account_until_it_is_disabled(c *C) {
+	account := s.createServiceAccount(c, "deployer")
+	c.Assert(account.Email, Equals, "deployer@test-project.iam.gserviceaccount.com")
+	c.Assert(account.UniqueId, Equals, tokens.UniqueID(account.Email))
+
+	key, err := s.service.CreateServiceAccountKey(context.Background(), &adminpb.CreateServiceAccountKeyRequest{
+		Name: "projects/-/serviceAccounts/" + account.Email,
+	})
+	c.Assert(err, IsNil)
+	keyFile := &credentialsFile{}
+	c.Assert(json.Unmarshal(key.PrivateKeyData, keyFile), IsNil)
+	c.Assert(keyFile.ClientEmail, Equals, account.Email)
+	c.Assert(keyFile.TokenURI, Equals, oauth2.TokenURI)
+	c.Assert(key.Name, Equals, account.Name+"/keys/"+keyFile.PrivateKeyID)
+
+	// The private key is only available from the key file.
+	stored, err := s.service.GetServiceAccountKey(context.Background(), &adminpb.GetServiceAccountKeyRequest{
+		Name:          key.Name,
+		PublicKeyType: adminpb.ServiceAccountPublicKeyType_TYPE_X509_PEM_FILE,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(stored.PrivateKeyData, IsNil)
+	c.Assert(string(stored.PublicKeyData), Matches, "(?s)-----BEGIN CERTIFICATE-----.*")
+
+	jwt := selfSignedJWT(c, keyFile)
+	member, err := s.service.Authenticate("Bearer " + jwt)
+	c.Assert(err, IsNil)
+	c.Assert(member, Equals, "serviceAccount:"+account.Email)
+
+	_, err = s.service.DisableServiceAccount(context.Background(), &adminpb.DisableServiceAccountRequest{Name: account.Name})
+	c.Assert(err, IsNil)
+	_, err = s.service.Authenticate("Bearer " + jwt)
+	c.Assert(status.Code(err), Equals, codes.Unauthenticated)
+	_, _, err = s.service.ServiceAccountPublicKey(account.Email, keyFile.PrivateKeyID)
+	c.Assert(err, NotNil)
+
+	_, err = s.service.EnableServiceAccount(context.Background(), &adminpb.EnableServiceAccountRequest{Name: account.Name})
+	c.Assert(err, IsNil)
+	_, err = s.service.DeleteServiceAccountKey(context.Background(), &adminpb.DeleteServiceAccountKeyRequest{Name: key.Name})
+	c.Assert(err, IsNil)
+	_, err = s.service.Authenticate("Bearer " + jwt)
+	c.Assert(status.Code(err), Equals, codes.Unauthenticated)
+}
+
+func (s *AdminSuite) Test_deleted_service_accounts_can_be_restored_by_unique_id(c *C) {
+	account := s.createServiceAccount(c, "short-lived")
+	_, err := s.service.DeleteServiceAccount(context.Background(), &adminpb.DeleteServiceAccountRequest{Name: account.Name})
+	c.Assert(err, IsNil)
+	_, err = s.service.GetServiceAccount(context.Background(), &adminpb.GetServiceAccountRequest{Name: account.Name})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	restored, err := s.service.UndeleteServiceAccount(context.Background(), &adminpb.UndeleteServiceAccountRequest{
+		Name: "projects/-/serviceAccounts/" + account.UniqueId,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(restored.RestoredAccount.Email, Equals, account.Email)
+	fetched, err := s.service.GetServiceAccount(context.Background(), &adminpb.GetServiceAccountRequest{
+		Name: "projects/-/serviceAccounts/" + account.UniqueId,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(fetched.Name, Equals, account.Name)
+}
+
+func (s *AdminSuite) Test_custom_roles_grant_their_permissions_until_deleted(c *C) {
+	_, err := s.service.CreateRole(context.Background(), &adminpb.CreateRoleRequest{
+		Parent: "projects/" + testProject,
+		RoleId: "secretReader",
+		Role: &adminpb.Role{
+			IncludedPermissions: []string{"secretmanager.versions.access", "made.up.permission"},
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+
+	customRole, err := s.service.CreateRole(context.Background(), &adminpb.CreateRoleRequest{
+		Parent: "projects/" + testProject,
+		RoleId: "secretReader",
+		Role: &adminpb.Role{
+			Title:               "Secret Reader",
+			IncludedPermissions: []string{"secretmanager.versions.access"},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(customRole.Name, Equals, "projects/test-project/roles/secretReader")
+
+	_, err = s.service.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: testSecret,
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{{Role: customRole.Name, Members: []string{"serviceAccount:" + testAccessor}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	ctx := ContextWithPrincipal(context.Background(), "serviceAccount:"+testAccessor)
+	access := secretManagerService + "AccessSecretVersion"
+	c.Assert(s.service.AuthorizeMethod(ctx, access, testSecret+"/versions/1"), IsNil)
+	err = s.service.AuthorizeMethod(ctx, secretManagerService+"GetSecret", testSecret)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+
+	_, err = s.service.DeleteRole(context.Background(), &adminpb.DeleteRoleRequest{Name: customRole.Name})
+	c.Assert(err, IsNil)
+	err = s.service.AuthorizeMethod(ctx, access, testSecret+"/versions/1")
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+
+	roles, err := s.service.ListRoles(context.Background(), &adminpb.ListRolesRequest{
+		Parent:      "projects/" + testProject,
+		ShowDeleted: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(roles.Roles, HasLen, 1)
+	c.Assert(roles.Roles[0].Deleted, Equals, true)
+}
+
+func (s *AdminSuite) Test_predefined_roles_are_listed_with_their_permissions(c *C) {
+	role, err := s.service.GetRole(context.Background(), &adminpb.GetRoleRequest{Name: "roles/secretmanager.secretAccessor"})
+	c.Assert(err, IsNil)
+	c.Assert(role.Title, Equals, "Secret Manager Secret Accessor")
+	c.Assert(role.IncludedPermissions, DeepEquals, []string{"secretmanager.versions.access"})
+
+	roles, err := s.service.ListRoles(context.Background(), &adminpb.ListRolesRequest{PageSize: 2})
+	c.Assert(err, IsNil)
+	c.Assert(roles.Roles, HasLen, 2)
+	c.Assert(roles.Roles[0].IncludedPermissions, IsNil)
+	c.Assert(roles.NextPageToken, Equals, "2")
+
+	_, err = s.service.UpdateRole(context.Background(), &adminpb.UpdateRoleRequest{
+		Name: "roles/owner",
+		Role: &adminpb.Role{Title: "Not the owner"},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+}
+
+func (s *AdminSuite) createServiceAccount(c *C, accountID string) *adminpb.ServiceAccount {
+	account, err := s.service.CreateServiceAccount(context.Background(), &adminpb.CreateServiceAccountRequest{
+		Name:      "projects/" + testProject,
+		AccountId: accountID,
+	})
+	c.Assert(err, IsNil)
+	return account
+}
+
+// selfSignedJWT creates a JWT signed with the private key of a key file
+// in the same way client libraries authenticate without the token endpoint.
+func selfSignedJWT(c *C, keyFile *credentialsFile) string {
+	block, _ := pem.Decode([]byte(keyFile.PrivateKey))
+	c.Assert(block, NotNil)
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	c.Assert(err, IsNil)
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyFile.PrivateKeyID})
+	c.Assert(err, IsNil)
+	payload, err := json.Marshal(map[string]interface{}{
+		"iss": keyFile.ClientEmail,
+		"sub": keyFile.ClientEmail,
+		"aud": "https://secretmanager.googleapis.com/",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	c.Assert(err, IsNil)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, parsedKey.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	c.Assert(err, IsNil)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
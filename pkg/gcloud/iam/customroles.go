@@ -0,0 +1,445 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+)
+
+const (
+	customRoleFile = "role.json"
+)
+
+var (
+	customRoleIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_.]{3,64}$`)
+)
+
+// ListRoles deals with listing the predefined roles when a parent is not provided
+// or the custom roles of a project.
+func (s *Service) ListRoles(ctx context.Context, req *adminpb.ListRolesRequest) (*adminpb.ListRolesResponse, error) {
+	roles := []*adminpb.Role{}
+	if req.Parent == "" || req.Parent == "roles" {
+		for _, name := range predefinedRoleNames() {
+			roles = append(roles, predefinedRoleProto(name, req.View))
+		}
+	} else {
+		project, ok := projectName(req.Parent)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid parent %s, only project roles are supported", req.Parent)
+		}
+		s.mu.Lock()
+		customRoles, err := s.listCustomRolesLocked(project)
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, customRole := range customRoles {
+			if !customRole.Deleted || req.ShowDeleted {
+				roles = append(roles, customRoleView(customRole, req.View))
+			}
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(roles), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.ListRolesResponse{
+		Roles:         roles[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// GetRole retrieves a predefined role or a custom role of a project.
+func (s *Service) GetRole(ctx context.Context, req *adminpb.GetRoleRequest) (*adminpb.Role, error) {
+	if _, ok := predefinedRoles[req.Name]; ok {
+		return predefinedRoleProto(req.Name, adminpb.RoleView_FULL), nil
+	}
+	if !isCustomRoleName(req.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid role name %s", req.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getCustomRoleLocked(req.Name)
+}
+
+// CreateRole deals with creating a custom role in a project,
+// only permissions known to the emulators can be included.
+func (s *Service) CreateRole(ctx context.Context, req *adminpb.CreateRoleRequest) (*adminpb.Role, error) {
+	project, ok := projectName(req.Parent)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parent %s, only project roles are supported", req.Parent)
+	}
+	if !customRoleIDPattern.MatchString(req.RoleId) {
+		return nil, status.Errorf(codes.InvalidArgument, "The role ID %s is invalid", req.RoleId)
+	}
+	if req.Role == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A role must be provided")
+	}
+	err := validateRolePermissions(req.Role.IncludedPermissions)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := fmt.Sprintf("%s/roles/%s", project, req.RoleId)
+	exists, err := afero.Exists(s.fs, s.customRolePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, status.Errorf(codes.AlreadyExists, "A role named %s in %s already exists.", req.RoleId, project)
+	}
+	customRole := proto.Clone(req.Role).(*adminpb.Role)
+	customRole.Name = name
+	customRole.Deleted = false
+	return s.writeCustomRoleLocked(customRole)
+}
+
+// UpdateRole deals with updating the fields of a custom role in the update mask,
+// all of the updatable fields are replaced when a mask is not provided.
+func (s *Service) UpdateRole(ctx context.Context, req *adminpb.UpdateRoleRequest) (*adminpb.Role, error) {
+	if req.Role == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A role must be provided")
+	}
+	paths := []string{"title", "description", "included_permissions", "stage"}
+	if len(req.UpdateMask.GetPaths()) > 0 {
+		paths = req.UpdateMask.GetPaths()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customRole, err := s.getMutableCustomRoleLocked(req.Name, req.Role.Etag)
+	if err != nil {
+		return nil, err
+	}
+	for _, fieldPath := range paths {
+		switch fieldPath {
+		case "title":
+			customRole.Title = req.Role.Title
+		case "description":
+			customRole.Description = req.Role.Description
+		case "included_permissions", "includedPermissions":
+			err = validateRolePermissions(req.Role.IncludedPermissions)
+			if err != nil {
+				return nil, err
+			}
+			customRole.IncludedPermissions = req.Role.IncludedPermissions
+		case "stage":
+			customRole.Stage = req.Role.Stage
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask path %s", fieldPath)
+		}
+	}
+	return s.writeCustomRoleLocked(customRole)
+}
+
+// DeleteRole deals with soft deleting a custom role, deleted roles remain in
+// the policies they are bound in but no longer grant any permissions.
+func (s *Service) DeleteRole(ctx context.Context, req *adminpb.DeleteRoleRequest) (*adminpb.Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customRole, err := s.getMutableCustomRoleLocked(req.Name, req.Etag)
+	if err != nil {
+		return nil, err
+	}
+	customRole.Deleted = true
+	return s.writeCustomRoleLocked(customRole)
+}
+
+// UndeleteRole deals with restoring a custom role that has been deleted.
+func (s *Service) UndeleteRole(ctx context.Context, req *adminpb.UndeleteRoleRequest) (*adminpb.Role, error) {
+	if !isCustomRoleName(req.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid role name %s", req.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customRole, err := s.getCustomRoleLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Etag) > 0 && !bytes.Equal(req.Etag, customRole.Etag) {
+		return nil, status.Errorf(codes.Aborted, "The etag provided for role %s is stale.", req.Name)
+	}
+	if !customRole.Deleted {
+		return nil, status.Errorf(codes.FailedPrecondition, "The role %s has not been deleted.", req.Name)
+	}
+	customRole.Deleted = false
+	return s.writeCustomRoleLocked(customRole)
+}
+
+// QueryGrantableRoles deals with listing the roles that can be granted on a resource,
+// the predefined roles are returned along with the custom roles of the resource's project.
+func (s *Service) QueryGrantableRoles(ctx context.Context, req *adminpb.QueryGrantableRolesRequest) (*adminpb.QueryGrantableRolesResponse, error) {
+	resource, ok := resourceFromFullName(req.FullResourceName)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid full resource name %s", req.FullResourceName)
+	}
+	roles := []*adminpb.Role{}
+	for _, name := range predefinedRoleNames() {
+		roles = append(roles, predefinedRoleProto(name, req.View))
+	}
+	if project, ok := projectName(resource); ok {
+		s.mu.Lock()
+		customRoles, err := s.listCustomRolesLocked(project)
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, customRole := range customRoles {
+			if !customRole.Deleted {
+				roles = append(roles, customRoleView(customRole, req.View))
+			}
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(roles), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.QueryGrantableRolesResponse{
+		Roles:         roles[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// QueryTestablePermissions deals with listing the permissions
+// checked by the emulators that can be included in custom roles.
+func (s *Service) QueryTestablePermissions(
+	ctx context.Context,
+	req *adminpb.QueryTestablePermissionsRequest,
+) (*adminpb.QueryTestablePermissionsResponse, error) {
+	if _, ok := resourceFromFullName(req.FullResourceName); !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid full resource name %s", req.FullResourceName)
+	}
+	permissions := knownPermissions()
+	start, end, nextPageToken, err := pagination.Page(len(permissions), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	response := &adminpb.QueryTestablePermissionsResponse{
+		Permissions:   []*adminpb.Permission{},
+		NextPageToken: nextPageToken,
+	}
+	for _, permission := range permissions[start:end] {
+		response.Permissions = append(response.Permissions, &adminpb.Permission{
+			Name:                    permission,
+			Stage:                   adminpb.Permission_GA,
+			CustomRolesSupportLevel: adminpb.Permission_SUPPORTED,
+		})
+	}
+	return response, nil
+}
+
+func (s *Service) roleExistsLocked(roleName string) (bool, error) {
+	if _, ok := predefinedRoles[roleName]; ok {
+		return true, nil
+	}
+	if !isCustomRoleName(roleName) {
+		return false, nil
+	}
+	customRole, err := s.readCustomRoleLocked(roleName)
+	if err != nil || customRole == nil {
+		return false, err
+	}
+	return !customRole.Deleted, nil
+}
+
+// roleHasPermissionLocked determines whether a predefined or custom role grants
+// a permission, deleted and disabled custom roles don't grant any permissions.
+func (s *Service) roleHasPermissionLocked(roleName string, permission string) (bool, error) {
+	if r, ok := predefinedRoles[roleName]; ok {
+		return predefinedRoleHasPermission(r, permission), nil
+	}
+	if !isCustomRoleName(roleName) {
+		return false, nil
+	}
+	customRole, err := s.readCustomRoleLocked(roleName)
+	if err != nil || customRole == nil {
+		return false, err
+	}
+	if customRole.Deleted || customRole.Stage == adminpb.Role_DISABLED {
+		return false, nil
+	}
+	for _, includedPermission := range customRole.IncludedPermissions {
+		if includedPermission == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) getCustomRoleLocked(name string) (*adminpb.Role, error) {
+	customRole, err := s.readCustomRoleLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if customRole == nil {
+		return nil, status.Errorf(codes.NotFound, "The role named %s was not found.", name)
+	}
+	return customRole, nil
+}
+
+// getMutableCustomRoleLocked retrieves a custom role that is about to be modified,
+// predefined roles, deleted roles and stale etags are rejected.
+func (s *Service) getMutableCustomRoleLocked(name string, etag []byte) (*adminpb.Role, error) {
+	if _, ok := predefinedRoles[name]; ok {
+		return nil, status.Errorf(codes.InvalidArgument, "The predefined role %s can not be modified.", name)
+	}
+	if !isCustomRoleName(name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid role name %s", name)
+	}
+	customRole, err := s.getCustomRoleLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(etag) > 0 && !bytes.Equal(etag, customRole.Etag) {
+		return nil, status.Errorf(codes.Aborted, "The etag provided for role %s is stale.", name)
+	}
+	if customRole.Deleted {
+		return nil, status.Errorf(codes.FailedPrecondition, "You can't modify the deleted role %s.", name)
+	}
+	return customRole, nil
+}
+
+func (s *Service) customRolePath(name string) string {
+	return path.Join(s.dataRootDir, name, customRoleFile)
+}
+
+// readCustomRoleLocked reads a custom role, nil is returned
+// when the role doesn't exist.
+func (s *Service) readCustomRoleLocked(name string) (*adminpb.Role, error) {
+	roleBytes, err := afero.ReadFile(s.fs, s.customRolePath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	customRole := &adminpb.Role{}
+	err = protojson.Unmarshal(roleBytes, customRole)
+	if err != nil {
+		return nil, err
+	}
+	return customRole, nil
+}
+
+func (s *Service) writeCustomRoleLocked(customRole *adminpb.Role) (*adminpb.Role, error) {
+	customRole.Etag = nil
+	customRole.Etag = messageEtag(customRole)
+	roleBytes, err := protojson.Marshal(customRole)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.MkdirAll(path.Join(s.dataRootDir, customRole.Name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = afero.WriteFile(s.fs, s.customRolePath(customRole.Name), roleBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return customRole, nil
+}
+
+func (s *Service) listCustomRolesLocked(project string) ([]*adminpb.Role, error) {
+	entries, err := afero.ReadDir(s.fs, path.Join(s.dataRootDir, project, "roles"))
+	if os.IsNotExist(err) {
+		return []*adminpb.Role{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	customRoles := []*adminpb.Role{}
+	for _, entry := range entries {
+		customRole, err := s.readCustomRoleLocked(fmt.Sprintf("%s/roles/%s", project, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if customRole != nil {
+			customRoles = append(customRoles, customRole)
+		}
+	}
+	sort.Slice(customRoles, func(i, j int) bool {
+		return customRoles[i].Name < customRoles[j].Name
+	})
+	return customRoles, nil
+}
+
+func customRoleView(customRole *adminpb.Role, view adminpb.RoleView) *adminpb.Role {
+	if view == adminpb.RoleView_FULL {
+		return customRole
+	}
+	basic := proto.Clone(customRole).(*adminpb.Role)
+	basic.IncludedPermissions = nil
+	return basic
+}
+
+func predefinedRoleNames() []string {
+	names := []string{}
+	for name := range predefinedRoles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// predefinedRoleProto expands the permission patterns of a predefined role
+// into the known permissions it grants for the full view.
+func predefinedRoleProto(name string, view adminpb.RoleView) *adminpb.Role {
+	r := predefinedRoles[name]
+	predefinedRole := &adminpb.Role{
+		Name:  name,
+		Title: r.title,
+		Stage: adminpb.Role_GA,
+		Etag:  []byte(name),
+	}
+	if view == adminpb.RoleView_FULL {
+		for _, permission := range knownPermissions() {
+			if predefinedRoleHasPermission(r, permission) {
+				predefinedRole.IncludedPermissions = append(predefinedRole.IncludedPermissions, permission)
+			}
+		}
+	}
+	return predefinedRole
+}
+
+func validateRolePermissions(permissions []string) error {
+	known := map[string]bool{}
+	for _, permission := range knownPermissions() {
+		known[permission] = true
+	}
+	for _, permission := range permissions {
+		if !known[permission] {
+			return status.Errorf(codes.InvalidArgument, "Permission %s is not valid.", permission)
+		}
+	}
+	return nil
+}
+
+// isCustomRoleName checks whether a role name is in the format
+// of a project's custom role. (projects/{project}/roles/{role})
+func isCustomRoleName(name string) bool {
+	segments := strings.Split(name, "/")
+	return len(segments) == 4 && segments[0] == "projects" && segments[2] == "roles" &&
+		isValidNameSegment(segments[1]) && customRoleIDPattern.MatchString(segments[3])
+}
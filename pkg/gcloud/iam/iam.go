@@ -0,0 +1,354 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+// Service authenticates callers of the Google Cloud emulators with tokens
+// minted by the token service and authorises them against the IAM policies
+// of the resources they access, it also serves the IAMPolicy API used to
+// manage those policies and the IAM Admin API used to manage service accounts,
+// their keys and custom roles.
+type Service struct {
+	mu          sync.Mutex
+	dataRootDir string
+	fs          afero.Fs
+	tokens      *tokens.Service
+	owner       string
+	parents     ResourceParents
+	now         func() time.Time
+}
+
+// ResourceParents provides the parents of projects and folders
+// so they inherit the policies of the folders and organizations above them.
+type ResourceParents interface {
+	// ResourceParent retrieves the folder or organization a project or folder
+	// belongs to, an empty string is returned when it doesn't have a parent.
+	ResourceParent(resource string) (string, error)
+}
+
+type principalKey struct{}
+
+var (
+	iamLocalHost = "iam.googleapis.local"
+)
+
+// New creates an IAM service, the owner is granted the owner role on the provided
+// project when the project doesn't have a policy yet so the emulators can be
+// used as soon as IAM is enabled. Organizations are not emulated so the owner
+// is also granted the owner role on organizations without a policy.
+func New(
+	dataRootDir string,
+	fs afero.Fs,
+	tokenService *tokens.Service,
+	projectID string,
+	owner string,
+	ip string,
+	hostsService hosts.Service,
+) (*Service, error) {
+	err := fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &iamLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	service := &Service{
+		dataRootDir: dataRootDir,
+		fs:          fs,
+		tokens:      tokenService,
+		owner:       MemberForEmail(owner),
+		now:         time.Now,
+	}
+	err = service.seedProjectPolicy(fmt.Sprintf("projects/%s", projectID), service.owner)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// SetResourceParents sets where the parents of projects and folders are resolved from,
+// without them projects and folders don't inherit the policies of folders and organizations.
+func (s *Service) SetResourceParents(parents ResourceParents) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parents = parents
+}
+
+func (s *Service) seedProjectPolicy(project string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exists, err := afero.Exists(s.fs, s.policyPath(project))
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.writePolicyLocked(project, &iampb.Policy{
+		Version: 1,
+		Bindings: []*iampb.Binding{
+			{
+				Role:    "roles/owner",
+				Members: []string{owner},
+			},
+		},
+	})
+	return err
+}
+
+// Authenticate deals with validating the bearer token in an authorization header
+// and resolving the IAM member of the principal the token was issued to.
+// Tokens minted by the token service are accepted along with self-signed JWTs
+// created with the keys of service accounts managed by the emulator,
+// tokens for disabled service accounts are rejected.
+func (s *Service) Authenticate(authorization string) (string, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if authorization == "" || token == authorization {
+		return "", status.Errorf(
+			codes.Unauthenticated,
+			"Request is missing required authentication credential. Expected OAuth 2 access token.",
+		)
+	}
+	invalidCredentials := status.Errorf(
+		codes.Unauthenticated,
+		"Request had invalid authentication credentials. Expected OAuth 2 access token.",
+	)
+	email, ok := s.accessTokenPrincipal(token)
+	if !ok {
+		email, ok = s.selfSignedJWTPrincipal(token)
+	}
+	if !ok {
+		return "", invalidCredentials
+	}
+	disabled, err := s.serviceAccountDisabled(email)
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return "", invalidCredentials
+	}
+	return MemberForEmail(email), nil
+}
+
+func (s *Service) accessTokenPrincipal(token string) (string, bool) {
+	claims, err := s.tokens.Validate(token)
+	if err != nil || claims.TokenUse != tokens.TokenUseAccess || claims.Email == "" {
+		return "", false
+	}
+	return claims.Email, true
+}
+
+// selfSignedJWTPrincipal deals with validating a JWT that a client library has
+// signed with a service account key in place of exchanging it for an access token.
+func (s *Service) selfSignedJWTPrincipal(token string) (string, bool) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return "", false
+	}
+	claims := &tokens.Claims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil || claims.Issuer == "" || claims.Issuer != claims.Subject || s.now().Unix() >= claims.Expiry {
+		return "", false
+	}
+	publicKey, managed, err := s.ServiceAccountPublicKey(claims.Issuer, tokens.TokenKeyID(token))
+	if err != nil || !managed {
+		return "", false
+	}
+	_, err = tokens.VerifyWithKey(token, publicKey)
+	if err != nil {
+		return "", false
+	}
+	return claims.Issuer, true
+}
+
+// AuthorizeMethod deals with checking the principal in the provided context has
+// the permission required to call a gRPC method on the provided resource.
+// Methods that only report on the caller's own access and the resources outside
+// of the resource hierarchy that are explicitly allowed only require the caller to be
+// authenticated, methods without a known permission and any other resources are denied.
+func (s *Service) AuthorizeMethod(ctx context.Context, fullMethod string, resource string) error {
+	resource, err := s.normaliseResource(resource)
+	if err != nil {
+		return err
+	}
+	if authenticatedMethods[fullMethod] || isUnscopedResource(fullMethod, resource) {
+		if _, ok := PrincipalFromContext(ctx); !ok {
+			return status.Errorf(codes.Unauthenticated, "Request is missing required authentication credential.")
+		}
+		return nil
+	}
+	permission, ok := methodPermission(fullMethod, resource)
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "Permission to call '%s' denied.", strings.TrimPrefix(fullMethod, "/"))
+	}
+	if !isHierarchyResource(resource) {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"Permission '%s' denied on resource '%s' (or it may not exist).", permission, resource,
+		)
+	}
+	return s.Authorize(ctx, permission, resource)
+}
+
+// Authorize deals with checking the principal in the provided context has been granted
+// the permission on the resource or one of its ancestors.
+func (s *Service) Authorize(ctx context.Context, permission string, resource string) error {
+	member, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "Request is missing required authentication credential.")
+	}
+	granted, err := s.hasPermission(member, permission, resource)
+	if err != nil {
+		return err
+	}
+	if !granted {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"Permission '%s' denied on resource '%s' (or it may not exist).", permission, resource,
+		)
+	}
+	return nil
+}
+
+func (s *Service) hasPermission(member string, permission string, resource string) (bool, error) {
+	// The hierarchy is resolved before locking as the resource manager
+	// holds its own lock while it seeds the policies of new projects.
+	hierarchy, err := s.resourceHierarchy(resource)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ancestor := range hierarchy {
+		policy, err := s.readPolicyLocked(ancestor)
+		if err != nil {
+			return false, err
+		}
+		granted, err := s.policyGrantsLocked(policy, member, permission)
+		if err != nil || granted {
+			return granted, err
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) policyGrantsLocked(policy *iampb.Policy, member string, permission string) (bool, error) {
+	for _, binding := range policy.Bindings {
+		// Conditions are not evaluated, so conditional bindings never grant access
+		// rather than granting more access than a real policy would.
+		if binding.Condition != nil || !bindingHasMember(binding, member) {
+			continue
+		}
+		granted, err := s.roleHasPermissionLocked(binding.Role, permission)
+		if err != nil || granted {
+			return granted, err
+		}
+	}
+	return false, nil
+}
+
+func bindingHasMember(binding *iampb.Binding, member string) bool {
+	for _, bindingMember := range binding.Members {
+		if memberMatches(bindingMember, member) {
+			return true
+		}
+	}
+	return false
+}
+
+func memberMatches(bindingMember string, member string) bool {
+	if bindingMember == member || bindingMember == "allUsers" || bindingMember == "allAuthenticatedUsers" {
+		return true
+	}
+	if strings.HasPrefix(bindingMember, "domain:") {
+		return strings.HasSuffix(member, "@"+strings.TrimPrefix(bindingMember, "domain:"))
+	}
+	return false
+}
+
+// resourceHierarchy expands a resource name into the resources that policies
+// can be inherited from, starting with the organization and folders the project
+// or folder at the top of the name belongs to.
+// (e.g. projects/p/secrets/s -> [organizations/o, folders/f, projects/p, projects/p/secrets/s])
+func (s *Service) resourceHierarchy(resource string) ([]string, error) {
+	segments := strings.Split(resource, "/")
+	hierarchy := []string{}
+	i := 2
+	for i <= len(segments) {
+		hierarchy = append(hierarchy, strings.Join(segments[:i], "/"))
+		i = i + 2
+	}
+	s.mu.Lock()
+	parents := s.parents
+	s.mu.Unlock()
+	if parents == nil || len(hierarchy) == 0 {
+		return hierarchy, nil
+	}
+	seen := map[string]bool{hierarchy[0]: true}
+	for {
+		parent, err := parents.ResourceParent(hierarchy[0])
+		if err != nil {
+			return nil, err
+		}
+		if parent == "" || seen[parent] {
+			return hierarchy, nil
+		}
+		seen[parent] = true
+		hierarchy = append([]string{parent}, hierarchy...)
+	}
+}
+
+// isHierarchyResource determines whether a resource belongs to
+// a project, folder or organization that policies can be set on.
+func isHierarchyResource(resource string) bool {
+	return strings.HasPrefix(resource, "projects/") ||
+		strings.HasPrefix(resource, "folders/") ||
+		strings.HasPrefix(resource, "organizations/")
+}
+
+// MemberForEmail provides the IAM member identifier for a principal's email address.
+func MemberForEmail(email string) string {
+	if strings.HasSuffix(email, ".gserviceaccount.com") {
+		return "serviceAccount:" + email
+	}
+	return "user:" + email
+}
+
+// ContextWithPrincipal provides a context that carries the IAM member of an authenticated caller.
+func ContextWithPrincipal(ctx context.Context, member string) context.Context {
+	return context.WithValue(ctx, principalKey{}, member)
+}
+
+// PrincipalFromContext retrieves the IAM member of the authenticated caller.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	member, ok := ctx.Value(principalKey{}).(string)
+	return member, ok
+}
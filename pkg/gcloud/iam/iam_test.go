@@ -0,0 +1,253 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package iam
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+
+	resourcemanagerpb "google.golang.org/genproto/googleapis/cloud/resourcemanager/v3"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type IAMSuite struct {
+	tokens  *tokens.Service
+	service *Service
+}
+
+var _ = Suite(&IAMSuite{})
+
+const (
+	testProject  = "test-project"
+	testOwner    = "clouduno@test-project.iam.gserviceaccount.com"
+	testAccessor = "worker@test-project.iam.gserviceaccount.com"
+	testSecret   = "projects/test-project/secrets/db-password"
+)
+
+func (s *IAMSuite) SetUpTest(c *C) {
+	fs := afero.NewMemMapFs()
+	tokenService, err := tokens.New("/data/gcloud/tokens", fs)
+	c.Assert(err, IsNil)
+	s.tokens = tokenService
+	service, err := New("/data/gcloud/iam", fs, tokenService, testProject, testOwner, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+	s.service = service
+}
+
+func (s *IAMSuite) Test_the_configured_service_account_owns_the_project(c *C) {
+	_, err := s.callUnary(c, testOwner, secretManagerService+"AccessSecretVersion", &secretmanagerpb.AccessSecretVersionRequest{
+		Name: testSecret + "/versions/latest",
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *IAMSuite) Test_permissions_are_inherited_from_resource_policies(c *C) {
+	access := &secretmanagerpb.AccessSecretVersionRequest{Name: testSecret + "/versions/1"}
+	_, err := s.callUnary(c, testAccessor, secretManagerService+"AccessSecretVersion", access)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+
+	_, err = s.callUnary(c, testOwner, iamPolicyService+"SetIamPolicy", &iampb.SetIamPolicyRequest{
+		Resource: testSecret,
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{
+				{
+					Role:    "roles/secretmanager.secretAccessor",
+					Members: []string{"serviceAccount:" + testAccessor},
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	_, err = s.callUnary(c, testAccessor, secretManagerService+"AccessSecretVersion", access)
+	c.Assert(err, IsNil)
+	// The accessor role doesn't allow the secret to be managed or accessed on other secrets.
+	_, err = s.callUnary(c, testAccessor, secretManagerService+"DeleteSecret", &secretmanagerpb.DeleteSecretRequest{
+		Name: testSecret,
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.callUnary(c, testAccessor, secretManagerService+"AccessSecretVersion", &secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/test-project/secrets/other/versions/1",
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	// Only the owner can change the policy.
+	_, err = s.callUnary(c, testAccessor, iamPolicyService+"SetIamPolicy", &iampb.SetIamPolicyRequest{
+		Resource: testSecret,
+		Policy:   &iampb.Policy{},
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+}
+
+func (s *IAMSuite) Test_service_account_policies_apply_to_wildcard_project_names(c *C) {
+	_, err := s.service.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: "projects/test-project/serviceAccounts/" + testAccessor,
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{
+				{
+					Role:    "roles/iam.serviceAccountOpenIdTokenCreator",
+					Members: []string{"user:developer@example.com"},
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	_, err = s.callUnary(c, "developer@example.com", iamCredentialsService+"GenerateIdToken", &credentialspb.GenerateIdTokenRequest{
+		Name:     "projects/-/serviceAccounts/" + testAccessor,
+		Audience: "https://backend.local",
+	})
+	c.Assert(err, IsNil)
+	_, err = s.callUnary(c, "developer@example.com", iamCredentialsService+"GenerateAccessToken", &credentialspb.GenerateAccessTokenRequest{
+		Name:  "projects/-/serviceAccounts/" + testAccessor,
+		Scope: []string{tokens.CloudPlatformScope},
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+}
+
+func (s *IAMSuite) Test_methods_without_a_known_permission_are_denied(c *C) {
+	_, err := s.callUnary(c, testOwner, secretManagerService+"RotateSecret", &secretmanagerpb.GetSecretRequest{
+		Name: testSecret,
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	// Resources outside of the resource hierarchy are denied unless they are allowed for the method.
+	_, err = s.callUnary(c, testOwner, iamPolicyService+"SetIamPolicy", &iampb.SetIamPolicyRequest{
+		Resource: "billingAccounts/012345-6789AB-CDEF01",
+		Policy:   &iampb.Policy{},
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.callUnary(c, testAccessor, iamAdminService+"GetRole", &adminpb.GetRoleRequest{Name: "roles/owner"})
+	c.Assert(err, IsNil)
+	_, err = s.callUnary(c, testAccessor, secretManagerService+"TestIamPermissions", &iampb.TestIamPermissionsRequest{
+		Resource:    testSecret,
+		Permissions: []string{"secretmanager.secrets.get"},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *IAMSuite) Test_folder_permissions_are_checked_against_the_folder_and_its_ancestors(c *C) {
+	s.service.SetResourceParents(&stubResourceParents{parents: map[string]string{
+		"folders/111111111111":  "organizations/999999999999",
+		"projects/test-project": "folders/111111111111",
+	}})
+	deleteFolder := &resourcemanagerpb.DeleteFolderRequest{Name: "folders/111111111111"}
+	createProject := &resourcemanagerpb.CreateProjectRequest{
+		Project: &resourcemanagerpb.Project{ProjectId: "other-project", Parent: "folders/111111111111"},
+	}
+	grantEditor := &iampb.SetIamPolicyRequest{
+		Resource: "folders/111111111111",
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{{Role: "roles/editor", Members: []string{"serviceAccount:" + testAccessor}}},
+		},
+	}
+	_, err := s.callUnary(c, testAccessor, foldersService+"DeleteFolder", deleteFolder)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.callUnary(c, testAccessor, projectsService+"CreateProject", createProject)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.callUnary(c, testAccessor, foldersService+"SetIamPolicy", grantEditor)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+
+	// The owner owns the organization the folder belongs to.
+	_, err = s.callUnary(c, testOwner, foldersService+"SetIamPolicy", grantEditor)
+	c.Assert(err, IsNil)
+
+	_, err = s.callUnary(c, testAccessor, foldersService+"DeleteFolder", deleteFolder)
+	c.Assert(err, IsNil)
+	_, err = s.callUnary(c, testAccessor, projectsService+"CreateProject", createProject)
+	c.Assert(err, IsNil)
+	// Projects in the folder inherit its policy.
+	_, err = s.callUnary(c, testAccessor, secretManagerService+"GetSecret", &secretmanagerpb.GetSecretRequest{Name: testSecret})
+	c.Assert(err, IsNil)
+	// Editors can't change policies.
+	_, err = s.callUnary(c, testAccessor, foldersService+"SetIamPolicy", grantEditor)
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+}
+
+func (s *IAMSuite) Test_requests_without_a_valid_access_token_are_unauthenticated(c *C) {
+	interceptor := s.service.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: secretManagerService + "GetSecret"}
+	_, err := interceptor(context.Background(), &secretmanagerpb.GetSecretRequest{Name: testSecret}, info, noopHandler)
+	c.Assert(status.Code(err), Equals, codes.Unauthenticated)
+
+	idToken, err := s.tokens.IDToken(testOwner, "https://backend.local", true, 0)
+	c.Assert(err, IsNil)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+idToken.Value))
+	_, err = interceptor(ctx, &secretmanagerpb.GetSecretRequest{Name: testSecret}, info, noopHandler)
+	c.Assert(status.Code(err), Equals, codes.Unauthenticated)
+}
+
+func (s *IAMSuite) Test_policies_are_rejected_when_the_etag_is_stale(c *C) {
+	policy, err := s.service.GetIamPolicy(context.Background(), &iampb.GetIamPolicyRequest{Resource: testSecret})
+	c.Assert(err, IsNil)
+	policy.Bindings = []*iampb.Binding{{Role: "roles/secretmanager.viewer", Members: []string{"user:a@example.com"}}}
+	_, err = s.service.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{Resource: testSecret, Policy: policy})
+	c.Assert(err, IsNil)
+	_, err = s.service.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{Resource: testSecret, Policy: policy})
+	c.Assert(status.Code(err), Equals, codes.Aborted)
+
+	_, err = s.service.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: testSecret,
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{{Role: "roles/made.up", Members: []string{"user:a@example.com"}}},
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+}
+
+func (s *IAMSuite) callUnary(c *C, principal string, fullMethod string, req interface{}) (interface{}, error) {
+	token, err := s.tokens.AccessToken(principal, nil, 0)
+	c.Assert(err, IsNil)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token.Value))
+	handler := noopHandler
+	if strings.HasSuffix(fullMethod, "/SetIamPolicy") {
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.service.SetIamPolicy(ctx, req.(*iampb.SetIamPolicyRequest))
+		}
+	}
+	return s.service.UnaryServerInterceptor()(ctx, req, &grpc.UnaryServerInfo{FullMethod: fullMethod}, handler)
+}
+
+func noopHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+type stubResourceParents struct {
+	parents map[string]string
+}
+
+func (m *stubResourceParents) ResourceParent(resource string) (string, error) {
+	return m.parents[resource], nil
+}
+
+type noopHostsService struct{}
+
+func (m *noopHostsService) Add(params *hosts.Params) error {
+	return nil
+}
+
+func (m *noopHostsService) Remove(params *hosts.Params) error {
+	return nil
+}
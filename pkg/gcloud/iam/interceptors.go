@@ -0,0 +1,103 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// UnaryServerInterceptor provides a gRPC interceptor that authenticates callers
+// of the Google Cloud APIs and checks they have the permission required for
+// the method on the resource in the request.
+func (s *Service) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !isGoogleCloudMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, err := s.authenticateContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = s.AuthorizeMethod(ctx, info.FullMethod, requestResource(info.FullMethod, req))
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor provides a gRPC interceptor that authenticates callers of
+// streaming Google Cloud APIs, the caller is authorised when the first message is
+// received as that is the message that identifies the resource.
+func (s *Service) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !isGoogleCloudMethod(info.FullMethod) {
+			return handler(srv, stream)
+		}
+		ctx, err := s.authenticateContext(stream.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedServerStream{
+			ServerStream: stream,
+			ctx:          ctx,
+			fullMethod:   info.FullMethod,
+			iam:          s,
+		})
+	}
+}
+
+func (s *Service) authenticateContext(ctx context.Context) (context.Context, error) {
+	authorization := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	member, err := s.Authenticate(authorization)
+	if err != nil {
+		return nil, err
+	}
+	return ContextWithPrincipal(ctx, member), nil
+}
+
+func isGoogleCloudMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/google.")
+}
+
+// authorizedServerStream wraps a server stream to carry the authenticated
+// principal and authorise the caller against the first received message.
+type authorizedServerStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	fullMethod string
+	iam        *Service
+	authorized bool
+}
+
+func (s *authorizedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authorizedServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil || s.authorized {
+		return err
+	}
+	err = s.iam.AuthorizeMethod(s.ctx, s.fullMethod, requestResource(s.fullMethod, m))
+	if err != nil {
+		return err
+	}
+	s.authorized = true
+	return nil
+}
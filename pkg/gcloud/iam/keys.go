@@ -0,0 +1,424 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/oauth2"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+)
+
+const (
+	serviceAccountKeyFile = "key.json"
+)
+
+var (
+	// keyValidBefore is the expiry time Google gives user-managed keys
+	// when an expiry has not been set by an organisation policy.
+	keyValidBefore = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// credentialsFile provides the JSON key file for a service account key
+// in the format used by Google Cloud client libraries and the gcloud CLI.
+type credentialsFile struct {
+	Type                    string `json:"type"`
+	ProjectID               string `json:"project_id"`
+	PrivateKeyID            string `json:"private_key_id"`
+	PrivateKey              string `json:"private_key"`
+	ClientEmail             string `json:"client_email"`
+	ClientID                string `json:"client_id"`
+	AuthURI                 string `json:"auth_uri"`
+	TokenURI                string `json:"token_uri"`
+	AuthProviderX509CertURL string `json:"auth_provider_x509_cert_url"`
+	ClientX509CertURL       string `json:"client_x509_cert_url"`
+}
+
+// ListServiceAccountKeys deals with listing the keys of a service account,
+// all keys are user-managed as the emulator signs tokens with its own key.
+func (s *Service) ListServiceAccountKeys(
+	ctx context.Context,
+	req *adminpb.ListServiceAccountKeysRequest,
+) (*adminpb.ListServiceAccountKeysResponse, error) {
+	includeUserManaged := len(req.KeyTypes) == 0
+	for _, keyType := range req.KeyTypes {
+		if keyType == adminpb.ListServiceAccountKeysRequest_USER_MANAGED {
+			includeUserManaged = true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	response := &adminpb.ListServiceAccountKeysResponse{
+		Keys: []*adminpb.ServiceAccountKey{},
+	}
+	if !includeUserManaged {
+		return response, nil
+	}
+	entries, err := afero.ReadDir(s.fs, path.Join(s.serviceAccountDir(account.ProjectId, account.Email), "keys"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		key, err := s.readServiceAccountKeyLocked(account, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			response.Keys = append(response.Keys, key)
+		}
+	}
+	return response, nil
+}
+
+// GetServiceAccountKey retrieves a service account key, the public key is only
+// included when a public key type is requested.
+func (s *Service) GetServiceAccountKey(
+	ctx context.Context,
+	req *adminpb.GetServiceAccountKeyRequest,
+) (*adminpb.ServiceAccountKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, err := s.getServiceAccountKeyLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	switch req.PublicKeyType {
+	case adminpb.ServiceAccountPublicKeyType_TYPE_NONE:
+		key.PublicKeyData = nil
+	case adminpb.ServiceAccountPublicKeyType_TYPE_RAW_PUBLIC_KEY:
+		publicKey, err := publicKeyFromCertificate(key.PublicKeyData)
+		if err != nil {
+			return nil, err
+		}
+		publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		key.PublicKeyData = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})
+	}
+	return key, nil
+}
+
+// CreateServiceAccountKey deals with creating a key for a service account, the private key
+// is only returned in the response as a JSON key file that targets the local token endpoint.
+func (s *Service) CreateServiceAccountKey(
+	ctx context.Context,
+	req *adminpb.CreateServiceAccountKeyRequest,
+) (*adminpb.ServiceAccountKey, error) {
+	if req.PrivateKeyType == adminpb.ServiceAccountPrivateKeyType_TYPE_PKCS12_FILE {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"PKCS12 key files are not supported by Cloud::1, use TYPE_GOOGLE_CREDENTIALS_FILE",
+		)
+	}
+	keyBits := 2048
+	if req.KeyAlgorithm == adminpb.ServiceAccountKeyAlgorithm_KEY_ALG_RSA_1024 {
+		keyBits = 1024
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	certificate, err := selfSignedCertificate(account.Email, privateKey, now)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := publicKeyID(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key := &adminpb.ServiceAccountKey{
+		Name:            account.Name + "/keys/" + keyID,
+		PrivateKeyType:  adminpb.ServiceAccountPrivateKeyType_TYPE_GOOGLE_CREDENTIALS_FILE,
+		KeyAlgorithm:    keyAlgorithm(keyBits),
+		PublicKeyData:   certificate,
+		ValidAfterTime:  timestamppb.New(now),
+		ValidBeforeTime: timestamppb.New(keyValidBefore),
+		KeyOrigin:       adminpb.ServiceAccountKeyOrigin_GOOGLE_PROVIDED,
+		KeyType:         adminpb.ListServiceAccountKeysRequest_USER_MANAGED,
+	}
+	err = s.writeServiceAccountKeyLocked(account, keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := json.MarshalIndent(&credentialsFile{
+		Type:                    "service_account",
+		ProjectID:               account.ProjectId,
+		PrivateKeyID:            keyID,
+		PrivateKey:              string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDER})),
+		ClientEmail:             account.Email,
+		ClientID:                account.UniqueId,
+		AuthURI:                 "https://accounts.google.com/o/oauth2/auth",
+		TokenURI:                oauth2.TokenURI,
+		AuthProviderX509CertURL: "https://www.googleapis.com/oauth2/v1/certs",
+		ClientX509CertURL:       "https://www.googleapis.com/robot/v1/metadata/x509/" + account.Email,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	response := proto.Clone(key).(*adminpb.ServiceAccountKey)
+	response.PrivateKeyData = keyFile
+	return response, nil
+}
+
+// UploadServiceAccountKey deals with adding a key to a service account from
+// a PEM encoded X.509 certificate of an RSA key pair held by the caller.
+func (s *Service) UploadServiceAccountKey(
+	ctx context.Context,
+	req *adminpb.UploadServiceAccountKeyRequest,
+) (*adminpb.ServiceAccountKey, error) {
+	block, _ := pem.Decode(req.PublicKeyData)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, status.Errorf(codes.InvalidArgument, "The public key data must be a PEM encoded X.509 certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "The public key data must be a PEM encoded X.509 certificate")
+	}
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Only RSA keys are supported")
+	}
+	keyID, err := publicKeyID(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.readServiceAccountKeyLocked(account, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "The key %s has already been uploaded.", existing.Name)
+	}
+	key := &adminpb.ServiceAccountKey{
+		Name:            account.Name + "/keys/" + keyID,
+		KeyAlgorithm:    keyAlgorithm(publicKey.N.BitLen()),
+		PublicKeyData:   req.PublicKeyData,
+		ValidAfterTime:  timestamppb.New(certificate.NotBefore),
+		ValidBeforeTime: timestamppb.New(certificate.NotAfter),
+		KeyOrigin:       adminpb.ServiceAccountKeyOrigin_USER_PROVIDED,
+		KeyType:         adminpb.ListServiceAccountKeysRequest_USER_MANAGED,
+	}
+	err = s.writeServiceAccountKeyLocked(account, keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeleteServiceAccountKey deals with deleting a service account key,
+// assertions signed with the key are rejected from then on.
+func (s *Service) DeleteServiceAccountKey(
+	ctx context.Context,
+	req *adminpb.DeleteServiceAccountKeyRequest,
+) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, err := s.getServiceAccountKeyLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.RemoveAll(path.Join(s.dataRootDir, key.Name))
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// ServiceAccountPublicKey retrieves the public key of a service account key so the token
+// endpoint can verify assertions, managed is false when the service account is not managed
+// by the emulator. An error is returned when the service account is disabled or the key
+// doesn't exist or has expired.
+func (s *Service) ServiceAccountPublicKey(email string, keyID string) (*rsa.PublicKey, bool, error) {
+	projectID, ok := serviceAccountProject(email)
+	if !ok {
+		return nil, false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.readServiceAccountLocked(projectID, email)
+	if err != nil || account == nil {
+		return nil, false, err
+	}
+	if account.Disabled {
+		return nil, true, status.Errorf(codes.FailedPrecondition, "Service account %s is disabled.", email)
+	}
+	key, err := s.readServiceAccountKeyLocked(account, keyID)
+	if err != nil {
+		return nil, true, err
+	}
+	now := s.now()
+	if key == nil || now.Before(key.ValidAfterTime.AsTime()) || now.After(key.ValidBeforeTime.AsTime()) {
+		return nil, true, status.Errorf(codes.NotFound, "Key %s of service account %s does not exist or has expired.", keyID, email)
+	}
+	publicKey, err := publicKeyFromCertificate(key.PublicKeyData)
+	if err != nil {
+		return nil, true, err
+	}
+	return publicKey, true, nil
+}
+
+func (s *Service) getServiceAccountKeyLocked(name string) (*adminpb.ServiceAccountKey, error) {
+	segments := strings.Split(name, "/")
+	if len(segments) != 6 || segments[4] != "keys" {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid service account key name %s", name)
+	}
+	account, err := s.getServiceAccountLocked(strings.Join(segments[:4], "/"))
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.readServiceAccountKeyLocked(account, segments[5])
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, status.Errorf(codes.NotFound, "Service account key %s does not exist.", name)
+	}
+	return key, nil
+}
+
+// readServiceAccountKeyLocked reads a key of a service account, nil is returned
+// when the key doesn't exist.
+func (s *Service) readServiceAccountKeyLocked(account *adminpb.ServiceAccount, keyID string) (*adminpb.ServiceAccountKey, error) {
+	if !isValidNameSegment(keyID) {
+		return nil, nil
+	}
+	keyPath := path.Join(s.serviceAccountDir(account.ProjectId, account.Email), "keys", keyID, serviceAccountKeyFile)
+	keyBytes, err := afero.ReadFile(s.fs, keyPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := &adminpb.ServiceAccountKey{}
+	err = protojson.Unmarshal(keyBytes, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *Service) writeServiceAccountKeyLocked(
+	account *adminpb.ServiceAccount,
+	keyID string,
+	key *adminpb.ServiceAccountKey,
+) error {
+	keyDir := path.Join(s.serviceAccountDir(account.ProjectId, account.Email), "keys", keyID)
+	err := s.fs.MkdirAll(keyDir, 0755)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := protojson.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(s.fs, path.Join(keyDir, serviceAccountKeyFile), keyBytes, 0644)
+}
+
+// selfSignedCertificate produces the PEM encoded X.509 certificate Google provides
+// as the public key data of the keys it creates.
+func selfSignedCertificate(email string, privateKey *rsa.PrivateKey, now time.Time) ([]byte, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: email},
+		NotBefore:    now,
+		NotAfter:     keyValidBefore,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}), nil
+}
+
+func publicKeyFromCertificate(certificatePEM []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return nil, status.Errorf(codes.Internal, "Stored public key data is not PEM encoded")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "Stored public key is not an RSA key")
+	}
+	return publicKey, nil
+}
+
+// publicKeyID derives the 40 character hex key ID Google uses for
+// service account keys from the public key.
+func publicKeyID(publicKey *rsa.PublicKey) (string, error) {
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(publicKeyDER)
+	return hex.EncodeToString(digest[:20]), nil
+}
+
+func keyAlgorithm(keyBits int) adminpb.ServiceAccountKeyAlgorithm {
+	switch keyBits {
+	case 1024:
+		return adminpb.ServiceAccountKeyAlgorithm_KEY_ALG_RSA_1024
+	case 2048:
+		return adminpb.ServiceAccountKeyAlgorithm_KEY_ALG_RSA_2048
+	}
+	return adminpb.ServiceAccountKeyAlgorithm_KEY_ALG_UNSPECIFIED
+}
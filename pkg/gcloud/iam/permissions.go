@@ -0,0 +1,372 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	secretManagerService  = "/google.cloud.secretmanager.v1.SecretManagerService/"
+	kmsService            = "/google.cloud.kms.v1.KeyManagementService/"
+	publisherService      = "/google.pubsub.v1.Publisher/"
+	subscriberService     = "/google.pubsub.v1.Subscriber/"
+	iamPolicyService      = "/google.iam.v1.IAMPolicy/"
+	iamCredentialsService = "/google.iam.credentials.v1.IAMCredentials/"
+	iamAdminService       = "/google.iam.admin.v1.IAM/"
+	projectsService       = "/google.cloud.resourcemanager.v3.Projects/"
+	foldersService        = "/google.cloud.resourcemanager.v3.Folders/"
+	tasksService          = "/google.cloud.tasks.v2.CloudTasks/"
+	schedulerService      = "/google.cloud.scheduler.v1.CloudScheduler/"
+
+	// Permissions that start with a "." are appended to the permission
+	// prefix of the resource type, they are used for the IAM policy methods
+	// that are shared by all resource types.
+	setIamPolicyPermission = ".setIamPolicy"
+	getIamPolicyPermission = ".getIamPolicy"
+)
+
+// requiredPermission provides the permission required to call a method
+// along with the request field that holds the resource it applies to.
+type requiredPermission struct {
+	permission    string
+	resourceField string
+}
+
+var methodPermissions = map[string]requiredPermission{
+	secretManagerService + "ListSecrets":          {"secretmanager.secrets.list", "parent"},
+	secretManagerService + "CreateSecret":         {"secretmanager.secrets.create", "parent"},
+	secretManagerService + "AddSecretVersion":     {"secretmanager.versions.add", "parent"},
+	secretManagerService + "GetSecret":            {"secretmanager.secrets.get", "name"},
+	secretManagerService + "UpdateSecret":         {"secretmanager.secrets.update", "secret.name"},
+	secretManagerService + "DeleteSecret":         {"secretmanager.secrets.delete", "name"},
+	secretManagerService + "ListSecretVersions":   {"secretmanager.versions.list", "parent"},
+	secretManagerService + "GetSecretVersion":     {"secretmanager.versions.get", "name"},
+	secretManagerService + "AccessSecretVersion":  {"secretmanager.versions.access", "name"},
+	secretManagerService + "DisableSecretVersion": {"secretmanager.versions.disable", "name"},
+	secretManagerService + "EnableSecretVersion":  {"secretmanager.versions.enable", "name"},
+	secretManagerService + "DestroySecretVersion": {"secretmanager.versions.destroy", "name"},
+	secretManagerService + "SetIamPolicy":         {setIamPolicyPermission, "resource"},
+	secretManagerService + "GetIamPolicy":         {getIamPolicyPermission, "resource"},
+
+	kmsService + "ListKeyRings":                  {"cloudkms.keyRings.list", "parent"},
+	kmsService + "ListCryptoKeys":                {"cloudkms.cryptoKeys.list", "parent"},
+	kmsService + "ListCryptoKeyVersions":         {"cloudkms.cryptoKeyVersions.list", "parent"},
+	kmsService + "ListImportJobs":                {"cloudkms.importJobs.list", "parent"},
+	kmsService + "GetKeyRing":                    {"cloudkms.keyRings.get", "name"},
+	kmsService + "GetCryptoKey":                  {"cloudkms.cryptoKeys.get", "name"},
+	kmsService + "GetCryptoKeyVersion":           {"cloudkms.cryptoKeyVersions.get", "name"},
+	kmsService + "GetPublicKey":                  {"cloudkms.cryptoKeyVersions.viewPublicKey", "name"},
+	kmsService + "GetImportJob":                  {"cloudkms.importJobs.get", "name"},
+	kmsService + "CreateKeyRing":                 {"cloudkms.keyRings.create", "parent"},
+	kmsService + "CreateCryptoKey":               {"cloudkms.cryptoKeys.create", "parent"},
+	kmsService + "CreateCryptoKeyVersion":        {"cloudkms.cryptoKeyVersions.create", "parent"},
+	kmsService + "ImportCryptoKeyVersion":        {"cloudkms.cryptoKeyVersions.create", "parent"},
+	kmsService + "CreateImportJob":               {"cloudkms.importJobs.create", "parent"},
+	kmsService + "UpdateCryptoKey":               {"cloudkms.cryptoKeys.update", "crypto_key.name"},
+	kmsService + "UpdateCryptoKeyVersion":        {"cloudkms.cryptoKeyVersions.update", "crypto_key_version.name"},
+	kmsService + "UpdateCryptoKeyPrimaryVersion": {"cloudkms.cryptoKeys.update", "name"},
+	kmsService + "DestroyCryptoKeyVersion":       {"cloudkms.cryptoKeyVersions.destroy", "name"},
+	kmsService + "RestoreCryptoKeyVersion":       {"cloudkms.cryptoKeyVersions.restore", "name"},
+	kmsService + "Encrypt":                       {"cloudkms.cryptoKeyVersions.useToEncrypt", "name"},
+	kmsService + "Decrypt":                       {"cloudkms.cryptoKeyVersions.useToDecrypt", "name"},
+	kmsService + "AsymmetricSign":                {"cloudkms.cryptoKeyVersions.useToSign", "name"},
+	kmsService + "AsymmetricDecrypt":             {"cloudkms.cryptoKeyVersions.useToDecrypt", "name"},
+	kmsService + "MacSign":                       {"cloudkms.cryptoKeyVersions.useToSign", "name"},
+	kmsService + "MacVerify":                     {"cloudkms.cryptoKeyVersions.useToVerify", "name"},
+	kmsService + "GenerateRandomBytes":           {"cloudkms.locations.generateRandomBytes", "location"},
+
+	publisherService + "CreateTopic":            {"pubsub.topics.create", "name"},
+	publisherService + "UpdateTopic":            {"pubsub.topics.update", "topic.name"},
+	publisherService + "Publish":                {"pubsub.topics.publish", "topic"},
+	publisherService + "GetTopic":               {"pubsub.topics.get", "topic"},
+	publisherService + "ListTopics":             {"pubsub.topics.list", "project"},
+	publisherService + "ListTopicSubscriptions": {"pubsub.topics.get", "topic"},
+	publisherService + "ListTopicSnapshots":     {"pubsub.topics.get", "topic"},
+	publisherService + "DeleteTopic":            {"pubsub.topics.delete", "topic"},
+	publisherService + "DetachSubscription":     {"pubsub.topics.detachSubscription", "subscription"},
+
+	subscriberService + "CreateSubscription": {"pubsub.subscriptions.create", "name"},
+	subscriberService + "GetSubscription":    {"pubsub.subscriptions.get", "subscription"},
+	subscriberService + "UpdateSubscription": {"pubsub.subscriptions.update", "subscription.name"},
+	subscriberService + "ListSubscriptions":  {"pubsub.subscriptions.list", "project"},
+	subscriberService + "DeleteSubscription": {"pubsub.subscriptions.delete", "subscription"},
+	subscriberService + "ModifyAckDeadline":  {"pubsub.subscriptions.consume", "subscription"},
+	subscriberService + "Acknowledge":        {"pubsub.subscriptions.consume", "subscription"},
+	subscriberService + "Pull":               {"pubsub.subscriptions.consume", "subscription"},
+	subscriberService + "StreamingPull":      {"pubsub.subscriptions.consume", "subscription"},
+	subscriberService + "ModifyPushConfig":   {"pubsub.subscriptions.update", "subscription"},
+	subscriberService + "GetSnapshot":        {"pubsub.snapshots.get", "snapshot"},
+	subscriberService + "ListSnapshots":      {"pubsub.snapshots.list", "project"},
+	subscriberService + "CreateSnapshot":     {"pubsub.snapshots.create", "name"},
+	subscriberService + "UpdateSnapshot":     {"pubsub.snapshots.update", "snapshot.name"},
+	subscriberService + "DeleteSnapshot":     {"pubsub.snapshots.delete", "snapshot"},
+	subscriberService + "Seek":               {"pubsub.subscriptions.consume", "subscription"},
+
+	iamPolicyService + "SetIamPolicy": {setIamPolicyPermission, "resource"},
+	iamPolicyService + "GetIamPolicy": {getIamPolicyPermission, "resource"},
+
+	iamCredentialsService + "GenerateAccessToken": {"iam.serviceAccounts.getAccessToken", "name"},
+	iamCredentialsService + "GenerateIdToken":     {"iam.serviceAccounts.getOpenIdToken", "name"},
+	iamCredentialsService + "SignBlob":            {"iam.serviceAccounts.signBlob", "name"},
+	iamCredentialsService + "SignJwt":             {"iam.serviceAccounts.signJwt", "name"},
+
+	iamAdminService + "ListServiceAccounts":     {"iam.serviceAccounts.list", "name"},
+	iamAdminService + "GetServiceAccount":       {"iam.serviceAccounts.get", "name"},
+	iamAdminService + "CreateServiceAccount":    {"iam.serviceAccounts.create", "name"},
+	iamAdminService + "UpdateServiceAccount":    {"iam.serviceAccounts.update", "name"},
+	iamAdminService + "PatchServiceAccount":     {"iam.serviceAccounts.update", "service_account.name"},
+	iamAdminService + "DeleteServiceAccount":    {"iam.serviceAccounts.delete", "name"},
+	iamAdminService + "UndeleteServiceAccount":  {"iam.serviceAccounts.undelete", "name"},
+	iamAdminService + "EnableServiceAccount":    {"iam.serviceAccounts.enable", "name"},
+	iamAdminService + "DisableServiceAccount":   {"iam.serviceAccounts.disable", "name"},
+	iamAdminService + "ListServiceAccountKeys":  {"iam.serviceAccountKeys.list", "name"},
+	iamAdminService + "GetServiceAccountKey":    {"iam.serviceAccountKeys.get", "name"},
+	iamAdminService + "CreateServiceAccountKey": {"iam.serviceAccountKeys.create", "name"},
+	iamAdminService + "UploadServiceAccountKey": {"iam.serviceAccountKeys.create", "name"},
+	iamAdminService + "DeleteServiceAccountKey": {"iam.serviceAccountKeys.delete", "name"},
+	iamAdminService + "SignBlob":                {"iam.serviceAccounts.signBlob", "name"},
+	iamAdminService + "SignJwt":                 {"iam.serviceAccounts.signJwt", "name"},
+	iamAdminService + "SetIamPolicy":            {setIamPolicyPermission, "resource"},
+	iamAdminService + "GetIamPolicy":            {getIamPolicyPermission, "resource"},
+	iamAdminService + "ListRoles":               {"iam.roles.list", "parent"},
+	iamAdminService + "GetRole":                 {"iam.roles.get", "name"},
+	iamAdminService + "CreateRole":              {"iam.roles.create", "parent"},
+	iamAdminService + "UpdateRole":              {"iam.roles.update", "name"},
+	iamAdminService + "DeleteRole":              {"iam.roles.delete", "name"},
+	iamAdminService + "UndeleteRole":            {"iam.roles.undelete", "name"},
+
+	projectsService + "GetProject":      {"resourcemanager.projects.get", "name"},
+	projectsService + "ListProjects":    {"resourcemanager.projects.list", "parent"},
+	projectsService + "CreateProject":   {"resourcemanager.projects.create", "project.parent"},
+	projectsService + "UpdateProject":   {"resourcemanager.projects.update", "project.name"},
+	projectsService + "MoveProject":     {"resourcemanager.projects.move", "name"},
+	projectsService + "DeleteProject":   {"resourcemanager.projects.delete", "name"},
+	projectsService + "UndeleteProject": {"resourcemanager.projects.undelete", "name"},
+	projectsService + "SetIamPolicy":    {setIamPolicyPermission, "resource"},
+	projectsService + "GetIamPolicy":    {getIamPolicyPermission, "resource"},
+
+	foldersService + "GetFolder":      {"resourcemanager.folders.get", "name"},
+	foldersService + "ListFolders":    {"resourcemanager.folders.list", "parent"},
+	foldersService + "CreateFolder":   {"resourcemanager.folders.create", "folder.parent"},
+	foldersService + "UpdateFolder":   {"resourcemanager.folders.update", "folder.name"},
+	foldersService + "MoveFolder":     {"resourcemanager.folders.move", "name"},
+	foldersService + "DeleteFolder":   {"resourcemanager.folders.delete", "name"},
+	foldersService + "UndeleteFolder": {"resourcemanager.folders.undelete", "name"},
+	foldersService + "SetIamPolicy":   {setIamPolicyPermission, "resource"},
+	foldersService + "GetIamPolicy":   {getIamPolicyPermission, "resource"},
+
+	tasksService + "ListQueues":   {"cloudtasks.queues.list", "parent"},
+	tasksService + "GetQueue":     {"cloudtasks.queues.get", "name"},
+	tasksService + "CreateQueue":  {"cloudtasks.queues.create", "parent"},
+	tasksService + "UpdateQueue":  {"cloudtasks.queues.update", "queue.name"},
+	tasksService + "DeleteQueue":  {"cloudtasks.queues.delete", "name"},
+	tasksService + "PurgeQueue":   {"cloudtasks.queues.purge", "name"},
+	tasksService + "PauseQueue":   {"cloudtasks.queues.pause", "name"},
+	tasksService + "ResumeQueue":  {"cloudtasks.queues.resume", "name"},
+	tasksService + "ListTasks":    {"cloudtasks.tasks.list", "parent"},
+	tasksService + "GetTask":      {"cloudtasks.tasks.get", "name"},
+	tasksService + "CreateTask":   {"cloudtasks.tasks.create", "parent"},
+	tasksService + "DeleteTask":   {"cloudtasks.tasks.delete", "name"},
+	tasksService + "RunTask":      {"cloudtasks.tasks.run", "name"},
+	tasksService + "SetIamPolicy": {setIamPolicyPermission, "resource"},
+	tasksService + "GetIamPolicy": {getIamPolicyPermission, "resource"},
+
+	schedulerService + "ListJobs":  {"cloudscheduler.jobs.list", "parent"},
+	schedulerService + "GetJob":    {"cloudscheduler.jobs.get", "name"},
+	schedulerService + "CreateJob": {"cloudscheduler.jobs.create", "parent"},
+	schedulerService + "UpdateJob": {"cloudscheduler.jobs.update", "job.name"},
+	schedulerService + "DeleteJob": {"cloudscheduler.jobs.delete", "name"},
+	schedulerService + "PauseJob":  {"cloudscheduler.jobs.pause", "name"},
+	schedulerService + "ResumeJob": {"cloudscheduler.jobs.resume", "name"},
+	schedulerService + "RunJob":    {"cloudscheduler.jobs.run", "name"},
+
+	// Cloud DNS only has a REST API so its methods are identified by the
+	// method IDs from its discovery document and are only checked over HTTP.
+	"dns.managedZones.list":         {"dns.managedZones.list", ""},
+	"dns.managedZones.get":          {"dns.managedZones.get", ""},
+	"dns.managedZones.create":       {"dns.managedZones.create", ""},
+	"dns.managedZones.patch":        {"dns.managedZones.update", ""},
+	"dns.managedZones.update":       {"dns.managedZones.update", ""},
+	"dns.managedZones.delete":       {"dns.managedZones.delete", ""},
+	"dns.changes.list":              {"dns.changes.list", ""},
+	"dns.changes.get":               {"dns.changes.get", ""},
+	"dns.changes.create":            {"dns.changes.create", ""},
+	"dns.resourceRecordSets.list":   {"dns.resourceRecordSets.list", ""},
+	"dns.resourceRecordSets.get":    {"dns.resourceRecordSets.get", ""},
+	"dns.resourceRecordSets.create": {"dns.resourceRecordSets.create", ""},
+	"dns.resourceRecordSets.patch":  {"dns.resourceRecordSets.update", ""},
+	"dns.resourceRecordSets.delete": {"dns.resourceRecordSets.delete", ""},
+}
+
+// authenticatedMethods holds the methods any authenticated caller can call as they
+// don't act on a resource or only report on the caller's own access, every other
+// method without a known permission is denied.
+var authenticatedMethods = map[string]bool{
+	secretManagerService + "TestIamPermissions":  true,
+	iamPolicyService + "TestIamPermissions":      true,
+	iamAdminService + "TestIamPermissions":       true,
+	iamAdminService + "QueryGrantableRoles":      true,
+	iamAdminService + "QueryTestablePermissions": true,
+	iamAdminService + "QueryAuditableServices":   true,
+	iamAdminService + "LintPolicy":               true,
+	projectsService + "SearchProjects":           true,
+	projectsService + "TestIamPermissions":       true,
+	foldersService + "SearchFolders":             true,
+	foldersService + "TestIamPermissions":        true,
+	tasksService + "TestIamPermissions":          true,
+}
+
+// unscopedResources holds the resources outside of the resource hierarchy any
+// authenticated caller can call a method on, by the prefix of their names, so
+// projects can be created without a parent and predefined roles can be read.
+// An empty prefix only allows requests without a resource.
+var unscopedResources = map[string][]string{
+	projectsService + "CreateProject": {""},
+	iamAdminService + "ListRoles":     {""},
+	iamAdminService + "GetRole":       {"roles/"},
+}
+
+// resourceTypePermissionPrefixes maps the collection a resource belongs
+// to onto the prefix of the permissions for that type of resource.
+var resourceTypePermissionPrefixes = map[string]string{
+	"projects":        "resourcemanager.projects",
+	"folders":         "resourcemanager.folders",
+	"organizations":   "resourcemanager.organizations",
+	"secrets":         "secretmanager.secrets",
+	"keyRings":        "cloudkms.keyRings",
+	"cryptoKeys":      "cloudkms.cryptoKeys",
+	"importJobs":      "cloudkms.importJobs",
+	"topics":          "pubsub.topics",
+	"subscriptions":   "pubsub.subscriptions",
+	"snapshots":       "pubsub.snapshots",
+	"serviceAccounts": "iam.serviceAccounts",
+	"queues":          "cloudtasks.queues",
+}
+
+// knownPermissions produces the sorted permissions checked by the emulators
+// along with those granted by name in predefined roles.
+func knownPermissions() []string {
+	permissionSet := map[string]bool{}
+	for _, required := range methodPermissions {
+		if !strings.HasPrefix(required.permission, ".") {
+			permissionSet[required.permission] = true
+		}
+	}
+	for _, prefix := range resourceTypePermissionPrefixes {
+		permissionSet[prefix+setIamPolicyPermission] = true
+		permissionSet[prefix+getIamPolicyPermission] = true
+	}
+	for _, r := range predefinedRoles {
+		for _, pattern := range r.includes {
+			if !strings.Contains(pattern, "*") {
+				permissionSet[pattern] = true
+			}
+		}
+	}
+	permissions := []string{}
+	for permission := range permissionSet {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// methodPermission resolves the permission required to call
+// a gRPC method on the provided resource.
+func methodPermission(fullMethod string, resource string) (string, bool) {
+	required, ok := methodPermissions[fullMethod]
+	if !ok {
+		return "", false
+	}
+	if !strings.HasPrefix(required.permission, ".") {
+		return required.permission, true
+	}
+	segments := strings.Split(resource, "/")
+	collection := ""
+	if len(segments) >= 2 {
+		collection = segments[len(segments)-2]
+	}
+	prefix, ok := resourceTypePermissionPrefixes[collection]
+	if !ok {
+		prefix = collection
+	}
+	return prefix + required.permission, true
+}
+
+// isUnscopedResource determines whether any authenticated caller
+// can call a method on a resource outside of a project.
+func isUnscopedResource(fullMethod string, resource string) bool {
+	for _, prefix := range unscopedResources[fullMethod] {
+		if (prefix == "" && resource == "") || (prefix != "" && strings.HasPrefix(resource, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestResource extracts the name of the resource a gRPC request applies to,
+// an empty string is returned for methods without a known permission.
+func requestResource(fullMethod string, req interface{}) string {
+	required, ok := methodPermissions[fullMethod]
+	if !ok {
+		return ""
+	}
+	message, ok := req.(proto.Message)
+	if !ok {
+		return ""
+	}
+	reflected := message.ProtoReflect()
+	fieldNames := strings.Split(required.resourceField, ".")
+	for i, fieldName := range fieldNames {
+		field := reflected.Descriptor().Fields().ByName(protoreflect.Name(fieldName))
+		if field == nil {
+			return ""
+		}
+		if i == len(fieldNames)-1 {
+			return reflected.Get(field).String()
+		}
+		if field.Message() == nil || !reflected.Has(field) {
+			return ""
+		}
+		reflected = reflected.Get(field).Message()
+	}
+	return ""
+}
+
+// normaliseResource deals with replacing the project wildcard in service account
+// names with the project the service account belongs to so policies on the project
+// are inherited. (e.g. projects/-/serviceAccounts/sa@project.iam.gserviceaccount.com)
+// Service accounts identified by their unique ID, including those that have been
+// deleted, are looked up to find their email.
+func (s *Service) normaliseResource(resource string) (string, error) {
+	const wildcardPrefix = "projects/-/serviceAccounts/"
+	if !strings.HasPrefix(resource, wildcardPrefix) {
+		return resource, nil
+	}
+	nameAndChildren := strings.SplitN(strings.TrimPrefix(resource, wildcardPrefix), "/", 2)
+	email := nameAndChildren[0]
+	if !strings.Contains(email, "@") {
+		account, err := s.serviceAccountByUniqueID(email)
+		if err != nil || account == nil {
+			return resource, err
+		}
+		email = account.Email
+	}
+	project, ok := serviceAccountProject(email)
+	if !ok {
+		return resource, nil
+	}
+	nameAndChildren[0] = email
+	return "projects/" + project + "/serviceAccounts/" + strings.Join(nameAndChildren, "/"), nil
+}
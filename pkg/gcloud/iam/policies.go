@@ -0,0 +1,227 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+)
+
+const (
+	policyFile = "policy.json"
+)
+
+var (
+	memberPrefixes = []string{"user:", "serviceAccount:", "group:", "domain:"}
+)
+
+// SetIamPolicy deals with replacing the IAM policy of a resource, the request is rejected
+// when an etag is provided that doesn't match the current policy.
+func (s *Service) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	err := validatePolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if req.Policy == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A policy must be provided")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.validatePolicyLocked(req.Policy)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.readPolicyLocked(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Policy.Etag) > 0 && !bytes.Equal(req.Policy.Etag, current.Etag) {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"There were concurrent policy changes. Please retry the whole read-modify-write with exponential backoff.",
+		)
+	}
+	policy := proto.Clone(req.Policy).(*iampb.Policy)
+	if policy.Version == 0 {
+		policy.Version = 1
+	}
+	for _, binding := range policy.Bindings {
+		sort.Strings(binding.Members)
+	}
+	return s.writePolicyLocked(req.Resource, policy)
+}
+
+// GetIamPolicy retrieves the IAM policy of a resource, an empty policy
+// is returned for resources that a policy has not been set for.
+func (s *Service) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	err := validatePolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readPolicyLocked(req.Resource)
+}
+
+// TestIamPermissions deals with determining which of the provided permissions
+// the caller has been granted on the resource.
+func (s *Service) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	err := validatePolicyResource(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	response := &iampb.TestIamPermissionsResponse{
+		Permissions: []string{},
+	}
+	member, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return response, nil
+	}
+	for _, permission := range req.Permissions {
+		granted, err := s.hasPermission(member, permission, req.Resource)
+		if err != nil {
+			return nil, err
+		}
+		if granted {
+			response.Permissions = append(response.Permissions, permission)
+		}
+	}
+	return response, nil
+}
+
+func (s *Service) policyPath(resource string) string {
+	return path.Join(s.dataRootDir, resource, policyFile)
+}
+
+func (s *Service) readPolicyLocked(resource string) (*iampb.Policy, error) {
+	exists, err := afero.Exists(s.fs, s.policyPath(resource))
+	if err != nil {
+		return nil, err
+	}
+	if !exists && strings.HasPrefix(resource, "organizations/") {
+		// Organizations are not emulated so nobody could be granted access
+		// to them without the owner having control of their policies.
+		return s.organizationPolicy(), nil
+	}
+	if !exists {
+		return emptyPolicy(), nil
+	}
+	policyBytes, err := afero.ReadFile(s.fs, s.policyPath(resource))
+	if err != nil {
+		return nil, err
+	}
+	policy := &iampb.Policy{}
+	err = protojson.Unmarshal(policyBytes, policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (s *Service) writePolicyLocked(resource string, policy *iampb.Policy) (*iampb.Policy, error) {
+	policy.Etag = nil
+	policy.Etag = messageEtag(policy)
+	policyBytes, err := protojson.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.MkdirAll(path.Join(s.dataRootDir, resource), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = afero.WriteFile(s.fs, s.policyPath(resource), policyBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (s *Service) organizationPolicy() *iampb.Policy {
+	policy := &iampb.Policy{
+		Version:  1,
+		Bindings: []*iampb.Binding{{Role: "roles/owner", Members: []string{s.owner}}},
+	}
+	policy.Etag = messageEtag(policy)
+	return policy
+}
+
+func emptyPolicy() *iampb.Policy {
+	policy := &iampb.Policy{Version: 1}
+	policy.Etag = messageEtag(policy)
+	return policy
+}
+
+// messageEtag derives an etag from the contents of a policy
+// or role without an etag.
+func messageEtag(message proto.Message) []byte {
+	messageBytes, _ := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	digest := sha256.Sum256(messageBytes)
+	return digest[:8]
+}
+
+func validatePolicyResource(resource string) error {
+	segments := strings.Split(resource, "/")
+	if len(segments) < 2 || len(segments)%2 != 0 {
+		return status.Errorf(codes.InvalidArgument, "Invalid resource name %s", resource)
+	}
+	for _, segment := range segments {
+		if !isValidNameSegment(segment) {
+			return status.Errorf(codes.InvalidArgument, "Invalid resource name %s", resource)
+		}
+	}
+	return nil
+}
+
+func (s *Service) validatePolicyLocked(policy *iampb.Policy) error {
+	for _, binding := range policy.Bindings {
+		exists, err := s.roleExistsLocked(binding.Role)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"Role (%s) does not exist in the resource's hierarchy.", binding.Role,
+			)
+		}
+		if len(binding.Members) == 0 {
+			return status.Errorf(codes.InvalidArgument, "Binding for role %s must have at least one member", binding.Role)
+		}
+		for _, member := range binding.Members {
+			if !isValidMember(member) {
+				return status.Errorf(codes.InvalidArgument, "Invalid member: %s", member)
+			}
+		}
+	}
+	return nil
+}
+
+func isValidMember(member string) bool {
+	if member == "allUsers" || member == "allAuthenticatedUsers" {
+		return true
+	}
+	for _, prefix := range memberPrefixes {
+		if strings.HasPrefix(member, prefix) && len(member) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import "strings"
+
+// role provides the permissions granted by a predefined role as patterns,
+// a pattern is either an exact permission, "*" for all permissions,
+// "{prefix}.*" or "*.{verb}".
+type role struct {
+	title    string
+	includes []string
+	excludes []string
+}
+
+// predefinedRoles holds the basic roles along with the predefined roles
+// for the services Cloud::1 emulates.
+var predefinedRoles = map[string]*role{
+	"roles/owner": {
+		title:    "Owner",
+		includes: []string{"*"},
+	},
+	"roles/editor": {
+		title:    "Editor",
+		includes: []string{"*"},
+		excludes: []string{"*.setIamPolicy", "*.getAccessToken", "*.getOpenIdToken", "*.signBlob", "*.signJwt"},
+	},
+	"roles/viewer": {
+		title:    "Viewer",
+		includes: []string{"*.get", "*.list"},
+	},
+
+	"roles/browser": {
+		title: "Browser",
+		includes: []string{
+			"resourcemanager.projects.get",
+			"resourcemanager.projects.list",
+			"resourcemanager.folders.get",
+			"resourcemanager.folders.list",
+		},
+	},
+	"roles/resourcemanager.projectIamAdmin": {
+		title:    "Project IAM Admin",
+		includes: []string{"resourcemanager.projects.getIamPolicy", "resourcemanager.projects.setIamPolicy"},
+	},
+	"roles/resourcemanager.projectDeleter": {
+		title:    "Project Deleter",
+		includes: []string{"resourcemanager.projects.delete"},
+	},
+	"roles/resourcemanager.folderViewer": {
+		title:    "Folder Viewer",
+		includes: []string{"resourcemanager.folders.get", "resourcemanager.folders.list"},
+	},
+
+	"roles/secretmanager.admin": {
+		title:    "Secret Manager Admin",
+		includes: []string{"secretmanager.*"},
+	},
+	"roles/secretmanager.secretAccessor": {
+		title:    "Secret Manager Secret Accessor",
+		includes: []string{"secretmanager.versions.access"},
+	},
+	"roles/secretmanager.secretVersionAdder": {
+		title:    "Secret Manager Secret Version Adder",
+		includes: []string{"secretmanager.versions.add"},
+	},
+	"roles/secretmanager.secretVersionManager": {
+		title: "Secret Manager Secret Version Manager",
+		includes: []string{
+			"secretmanager.versions.add",
+			"secretmanager.versions.enable",
+			"secretmanager.versions.disable",
+			"secretmanager.versions.destroy",
+			"secretmanager.versions.get",
+			"secretmanager.versions.list",
+		},
+	},
+	"roles/secretmanager.viewer": {
+		title: "Secret Manager Viewer",
+		includes: []string{
+			"secretmanager.secrets.get",
+			"secretmanager.secrets.list",
+			"secretmanager.secrets.getIamPolicy",
+			"secretmanager.versions.get",
+			"secretmanager.versions.list",
+		},
+	},
+
+	"roles/cloudkms.admin": {
+		title:    "Cloud KMS Admin",
+		includes: []string{"cloudkms.*"},
+		excludes: []string{"*.useToEncrypt", "*.useToDecrypt", "*.useToSign", "*.useToVerify"},
+	},
+	"roles/cloudkms.cryptoKeyEncrypterDecrypter": {
+		title:    "Cloud KMS CryptoKey Encrypter/Decrypter",
+		includes: []string{"cloudkms.cryptoKeyVersions.useToEncrypt", "cloudkms.cryptoKeyVersions.useToDecrypt"},
+	},
+	"roles/cloudkms.cryptoKeyEncrypter": {
+		title:    "Cloud KMS CryptoKey Encrypter",
+		includes: []string{"cloudkms.cryptoKeyVersions.useToEncrypt"},
+	},
+	"roles/cloudkms.cryptoKeyDecrypter": {
+		title:    "Cloud KMS CryptoKey Decrypter",
+		includes: []string{"cloudkms.cryptoKeyVersions.useToDecrypt"},
+	},
+	"roles/cloudkms.signerVerifier": {
+		title: "Cloud KMS CryptoKey Signer/Verifier",
+		includes: []string{
+			"cloudkms.cryptoKeyVersions.useToSign",
+			"cloudkms.cryptoKeyVersions.useToVerify",
+			"cloudkms.cryptoKeyVersions.viewPublicKey",
+		},
+	},
+	"roles/cloudkms.signer": {
+		title:    "Cloud KMS CryptoKey Signer",
+		includes: []string{"cloudkms.cryptoKeyVersions.useToSign"},
+	},
+	"roles/cloudkms.publicKeyViewer": {
+		title:    "Cloud KMS CryptoKey Public Key Viewer",
+		includes: []string{"cloudkms.cryptoKeyVersions.viewPublicKey"},
+	},
+	"roles/cloudkms.viewer": {
+		title: "Cloud KMS Viewer",
+		includes: []string{
+			"cloudkms.keyRings.get",
+			"cloudkms.keyRings.list",
+			"cloudkms.cryptoKeys.get",
+			"cloudkms.cryptoKeys.list",
+			"cloudkms.cryptoKeyVersions.get",
+			"cloudkms.cryptoKeyVersions.list",
+			"cloudkms.importJobs.get",
+			"cloudkms.importJobs.list",
+		},
+	},
+
+	"roles/pubsub.admin": {
+		title:    "Pub/Sub Admin",
+		includes: []string{"pubsub.*"},
+	},
+	"roles/pubsub.editor": {
+		title:    "Pub/Sub Editor",
+		includes: []string{"pubsub.*"},
+		excludes: []string{"*.setIamPolicy"},
+	},
+	"roles/pubsub.publisher": {
+		title:    "Pub/Sub Publisher",
+		includes: []string{"pubsub.topics.publish"},
+	},
+	"roles/pubsub.subscriber": {
+		title:    "Pub/Sub Subscriber",
+		includes: []string{"pubsub.subscriptions.consume", "pubsub.topics.attachSubscription", "pubsub.snapshots.seek"},
+	},
+	"roles/pubsub.viewer": {
+		title: "Pub/Sub Viewer",
+		includes: []string{
+			"pubsub.topics.get",
+			"pubsub.topics.list",
+			"pubsub.subscriptions.get",
+			"pubsub.subscriptions.list",
+			"pubsub.snapshots.get",
+			"pubsub.snapshots.list",
+		},
+	},
+
+	"roles/cloudtasks.admin": {
+		title:    "Cloud Tasks Admin",
+		includes: []string{"cloudtasks.*"},
+	},
+	"roles/cloudtasks.queueAdmin": {
+		title:    "Cloud Tasks Queue Admin",
+		includes: []string{"cloudtasks.queues.*", "cloudtasks.tasks.delete"},
+		excludes: []string{"*.setIamPolicy"},
+	},
+	"roles/cloudtasks.enqueuer": {
+		title:    "Cloud Tasks Enqueuer",
+		includes: []string{"cloudtasks.tasks.create"},
+	},
+	"roles/cloudtasks.taskRunner": {
+		title:    "Cloud Tasks Task Runner",
+		includes: []string{"cloudtasks.tasks.run"},
+	},
+	"roles/cloudtasks.taskDeleter": {
+		title:    "Cloud Tasks Task Deleter",
+		includes: []string{"cloudtasks.tasks.delete"},
+	},
+	"roles/cloudtasks.viewer": {
+		title: "Cloud Tasks Viewer",
+		includes: []string{
+			"cloudtasks.queues.get",
+			"cloudtasks.queues.list",
+			"cloudtasks.tasks.get",
+			"cloudtasks.tasks.list",
+		},
+	},
+
+	"roles/cloudscheduler.admin": {
+		title:    "Cloud Scheduler Admin",
+		includes: []string{"cloudscheduler.*"},
+	},
+	"roles/cloudscheduler.jobRunner": {
+		title:    "Cloud Scheduler Job Runner",
+		includes: []string{"cloudscheduler.jobs.run"},
+	},
+	"roles/cloudscheduler.viewer": {
+		title:    "Cloud Scheduler Viewer",
+		includes: []string{"cloudscheduler.jobs.get", "cloudscheduler.jobs.list"},
+	},
+
+	"roles/dns.admin": {
+		title:    "DNS Administrator",
+		includes: []string{"dns.*"},
+	},
+	"roles/dns.reader": {
+		title: "DNS Reader",
+		includes: []string{
+			"dns.changes.get",
+			"dns.changes.list",
+			"dns.managedZones.get",
+			"dns.managedZones.list",
+			"dns.resourceRecordSets.get",
+			"dns.resourceRecordSets.list",
+		},
+	},
+
+	"roles/iam.serviceAccountTokenCreator": {
+		title: "Service Account Token Creator",
+		includes: []string{
+			"iam.serviceAccounts.getAccessToken",
+			"iam.serviceAccounts.getOpenIdToken",
+			"iam.serviceAccounts.signBlob",
+			"iam.serviceAccounts.signJwt",
+		},
+	},
+	"roles/iam.serviceAccountOpenIdTokenCreator": {
+		title:    "Service Account OpenID Connect Identity Token Creator",
+		includes: []string{"iam.serviceAccounts.getOpenIdToken"},
+	},
+	"roles/iam.serviceAccountAdmin": {
+		title:    "Service Account Admin",
+		includes: []string{"iam.serviceAccounts.*"},
+		excludes: []string{"*.actAs", "*.getAccessToken", "*.getOpenIdToken", "*.signBlob", "*.signJwt"},
+	},
+	"roles/iam.serviceAccountKeyAdmin": {
+		title:    "Service Account Key Admin",
+		includes: []string{"iam.serviceAccountKeys.*", "iam.serviceAccounts.get", "iam.serviceAccounts.list"},
+	},
+	"roles/iam.serviceAccountUser": {
+		title:    "Service Account User",
+		includes: []string{"iam.serviceAccounts.actAs", "iam.serviceAccounts.get", "iam.serviceAccounts.list"},
+	},
+	"roles/iam.serviceAccountViewer": {
+		title: "View Service Accounts",
+		includes: []string{
+			"iam.serviceAccounts.get",
+			"iam.serviceAccounts.list",
+			"iam.serviceAccountKeys.get",
+			"iam.serviceAccountKeys.list",
+		},
+	},
+	"roles/iam.roleAdmin": {
+		title:    "Role Administrator",
+		includes: []string{"iam.roles.*"},
+	},
+	"roles/iam.roleViewer": {
+		title:    "Role Viewer",
+		includes: []string{"iam.roles.get", "iam.roles.list"},
+	},
+}
+
+func predefinedRoleHasPermission(r *role, permission string) bool {
+	for _, pattern := range r.excludes {
+		if permissionMatches(pattern, permission) {
+			return false
+		}
+	}
+	for _, pattern := range r.includes {
+		if permissionMatches(pattern, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+func permissionMatches(pattern string, permission string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, ".*"):
+		return strings.HasPrefix(permission, strings.TrimSuffix(pattern, "*"))
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(permission, strings.TrimPrefix(pattern, "*"))
+	}
+	return pattern == permission
+}
@@ -0,0 +1,466 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package iam
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/pagination"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/spf13/afero"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
+)
+
+const (
+	serviceAccountFile         = "serviceAccount.json"
+	serviceAccountDomainSuffix = ".iam.gserviceaccount.com"
+	deletedServiceAccountsDir  = "deletedServiceAccounts"
+)
+
+var (
+	serviceAccountIDPattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{4,28}[a-z0-9])$`)
+)
+
+// ListServiceAccounts deals with listing the service accounts of a project.
+func (s *Service) ListServiceAccounts(
+	ctx context.Context,
+	req *adminpb.ListServiceAccountsRequest,
+) (*adminpb.ListServiceAccountsResponse, error) {
+	project, ok := projectName(req.Name)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid project name %s", req.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := afero.ReadDir(s.fs, path.Join(s.dataRootDir, project, "serviceAccounts"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	accounts := []*adminpb.ServiceAccount{}
+	for _, entry := range entries {
+		account, err := s.readServiceAccountLocked(strings.TrimPrefix(project, "projects/"), entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if account != nil {
+			accounts = append(accounts, account)
+		}
+	}
+	start, end, nextPageToken, err := pagination.Page(len(accounts), int64(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.ListServiceAccountsResponse{
+		Accounts:      accounts[start:end],
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// GetServiceAccount retrieves a service account by its email or unique ID.
+func (s *Service) GetServiceAccount(ctx context.Context, req *adminpb.GetServiceAccountRequest) (*adminpb.ServiceAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getServiceAccountLocked(req.Name)
+}
+
+// CreateServiceAccount deals with creating a service account in a project,
+// the email of the service account is derived from the account ID.
+func (s *Service) CreateServiceAccount(
+	ctx context.Context,
+	req *adminpb.CreateServiceAccountRequest,
+) (*adminpb.ServiceAccount, error) {
+	project, ok := projectName(req.Name)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid project name %s", req.Name)
+	}
+	if !serviceAccountIDPattern.MatchString(req.AccountId) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"Account ID %s must be between 6 and 30 characters, start with a lowercase letter"+
+				" and only contain lowercase letters, digits and hyphens.",
+			req.AccountId,
+		)
+	}
+	projectID := strings.TrimPrefix(project, "projects/")
+	email := fmt.Sprintf("%s@%s%s", req.AccountId, projectID, serviceAccountDomainSuffix)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, err := s.readServiceAccountLocked(projectID, email)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "Service account %s already exists within project %s.", req.AccountId, project)
+	}
+	uniqueID, err := s.newServiceAccountUniqueIDLocked(email)
+	if err != nil {
+		return nil, err
+	}
+	account := &adminpb.ServiceAccount{
+		Name:           fmt.Sprintf("%s/serviceAccounts/%s", project, email),
+		ProjectId:      projectID,
+		UniqueId:       uniqueID,
+		Email:          email,
+		Oauth2ClientId: uniqueID,
+	}
+	if req.ServiceAccount != nil {
+		account.DisplayName = req.ServiceAccount.DisplayName
+		account.Description = req.ServiceAccount.Description
+	}
+	err = s.writeServiceAccountLocked(account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// UpdateServiceAccount deals with updating the display name and description of a service account.
+func (s *Service) UpdateServiceAccount(ctx context.Context, req *adminpb.ServiceAccount) (*adminpb.ServiceAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	account.DisplayName = req.DisplayName
+	account.Description = req.Description
+	err = s.writeServiceAccountLocked(account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// PatchServiceAccount deals with updating the fields of a service account in the update mask.
+func (s *Service) PatchServiceAccount(
+	ctx context.Context,
+	req *adminpb.PatchServiceAccountRequest,
+) (*adminpb.ServiceAccount, error) {
+	if req.ServiceAccount == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "A service account must be provided")
+	}
+	if len(req.UpdateMask.GetPaths()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "An update mask must be provided")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(req.ServiceAccount.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, fieldPath := range req.UpdateMask.GetPaths() {
+		switch fieldPath {
+		case "display_name", "displayName":
+			account.DisplayName = req.ServiceAccount.DisplayName
+		case "description":
+			account.Description = req.ServiceAccount.Description
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask path %s", fieldPath)
+		}
+	}
+	err = s.writeServiceAccountLocked(account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// DeleteServiceAccount deals with deleting a service account along with its keys and IAM policy,
+// the service account is kept so it can be restored by its unique ID with UndeleteServiceAccount.
+func (s *Service) DeleteServiceAccount(ctx context.Context, req *adminpb.DeleteServiceAccountRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	accountBytes, err := protojson.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.MkdirAll(path.Join(s.dataRootDir, deletedServiceAccountsDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = afero.WriteFile(s.fs, s.deletedServiceAccountPath(account.UniqueId), accountBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.RemoveAll(s.serviceAccountDir(account.ProjectId, account.Email))
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// UndeleteServiceAccount deals with restoring a deleted service account by its unique ID,
+// keys and IAM policies of the service account are not restored.
+func (s *Service) UndeleteServiceAccount(
+	ctx context.Context,
+	req *adminpb.UndeleteServiceAccountRequest,
+) (*adminpb.UndeleteServiceAccountResponse, error) {
+	_, uniqueID, ok := splitServiceAccountName(req.Name)
+	if !ok || strings.Contains(uniqueID, "@") {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid service account name %s, the unique ID must be used", req.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.readDeletedServiceAccountLocked(uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, status.Errorf(codes.NotFound, "Deleted service account %s does not exist.", uniqueID)
+	}
+	existing, err := s.readServiceAccountLocked(account.ProjectId, account.Email)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"Service account %s can not be restored as a service account with the same email exists.",
+			account.Email,
+		)
+	}
+	err = s.writeServiceAccountLocked(account)
+	if err != nil {
+		return nil, err
+	}
+	err = s.fs.Remove(s.deletedServiceAccountPath(uniqueID))
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.UndeleteServiceAccountResponse{RestoredAccount: account}, nil
+}
+
+// EnableServiceAccount deals with enabling a service account that has been disabled.
+func (s *Service) EnableServiceAccount(ctx context.Context, req *adminpb.EnableServiceAccountRequest) (*emptypb.Empty, error) {
+	return s.setServiceAccountDisabled(req.Name, false)
+}
+
+// DisableServiceAccount deals with disabling a service account, tokens for a disabled
+// service account are rejected and its keys can't be used to obtain new tokens.
+func (s *Service) DisableServiceAccount(ctx context.Context, req *adminpb.DisableServiceAccountRequest) (*emptypb.Empty, error) {
+	return s.setServiceAccountDisabled(req.Name, true)
+}
+
+func (s *Service) setServiceAccountDisabled(name string, disabled bool) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.getServiceAccountLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	account.Disabled = disabled
+	err = s.writeServiceAccountLocked(account)
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// serviceAccountDisabled determines whether the principal with the provided email
+// is a service account managed by the emulator that has been disabled.
+func (s *Service) serviceAccountDisabled(email string) (bool, error) {
+	projectID, ok := serviceAccountProject(email)
+	if !ok {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.readServiceAccountLocked(projectID, email)
+	if err != nil || account == nil {
+		return false, err
+	}
+	return account.Disabled, nil
+}
+
+// getServiceAccountLocked retrieves a service account from a resource name that identifies
+// the service account by its email or unique ID, the project can be the "-" wildcard.
+// (e.g. projects/-/serviceAccounts/sa@project.iam.gserviceaccount.com)
+func (s *Service) getServiceAccountLocked(name string) (*adminpb.ServiceAccount, error) {
+	project, accountID, ok := splitServiceAccountName(name)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid service account name %s", name)
+	}
+	notFound := status.Errorf(codes.NotFound, "Service account %s does not exist.", name)
+	if !strings.Contains(accountID, "@") {
+		account, err := s.findServiceAccountByUniqueIDLocked(project, accountID)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			return nil, notFound
+		}
+		return account, nil
+	}
+	projectID, ok := serviceAccountProject(accountID)
+	if !ok || (project != "-" && project != projectID) {
+		return nil, notFound
+	}
+	account, err := s.readServiceAccountLocked(projectID, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, notFound
+	}
+	return account, nil
+}
+
+func (s *Service) serviceAccountByUniqueID(uniqueID string) (*adminpb.ServiceAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, err := s.findServiceAccountByUniqueIDLocked("-", uniqueID)
+	if err != nil || account != nil {
+		return account, err
+	}
+	return s.readDeletedServiceAccountLocked(uniqueID)
+}
+
+func (s *Service) findServiceAccountByUniqueIDLocked(project string, uniqueID string) (*adminpb.ServiceAccount, error) {
+	projectIDs := []string{project}
+	if project == "-" {
+		entries, err := afero.ReadDir(s.fs, path.Join(s.dataRootDir, "projects"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		projectIDs = []string{}
+		for _, entry := range entries {
+			projectIDs = append(projectIDs, entry.Name())
+		}
+	}
+	for _, projectID := range projectIDs {
+		entries, err := afero.ReadDir(s.fs, path.Join(s.dataRootDir, "projects", projectID, "serviceAccounts"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			account, err := s.readServiceAccountLocked(projectID, entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			if account != nil && account.UniqueId == uniqueID {
+				return account, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// newServiceAccountUniqueIDLocked derives the unique ID of a new service account from its email
+// so it matches the subject of tokens minted for the service account, a deleted service account
+// with the same email keeps its unique ID so a new one is derived in that case.
+func (s *Service) newServiceAccountUniqueIDLocked(email string) (string, error) {
+	uniqueID := tokens.UniqueID(email)
+	deleted, err := afero.Exists(s.fs, s.deletedServiceAccountPath(uniqueID))
+	if err != nil || !deleted {
+		return uniqueID, err
+	}
+	return tokens.UniqueID(fmt.Sprintf("%s/%d", email, s.now().UnixNano())), nil
+}
+
+func (s *Service) serviceAccountDir(projectID string, email string) string {
+	return path.Join(s.dataRootDir, "projects", projectID, "serviceAccounts", email)
+}
+
+func (s *Service) deletedServiceAccountPath(uniqueID string) string {
+	return path.Join(s.dataRootDir, deletedServiceAccountsDir, uniqueID+".json")
+}
+
+// readServiceAccountLocked reads a service account, nil is returned
+// when the service account doesn't exist.
+func (s *Service) readServiceAccountLocked(projectID string, email string) (*adminpb.ServiceAccount, error) {
+	if !isValidNameSegment(projectID) || !isValidNameSegment(email) {
+		return nil, nil
+	}
+	accountBytes, err := afero.ReadFile(s.fs, path.Join(s.serviceAccountDir(projectID, email), serviceAccountFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	account := &adminpb.ServiceAccount{}
+	err = protojson.Unmarshal(accountBytes, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// readDeletedServiceAccountLocked reads a service account that has been deleted,
+// nil is returned when there isn't a deleted service account with the unique ID.
+func (s *Service) readDeletedServiceAccountLocked(uniqueID string) (*adminpb.ServiceAccount, error) {
+	if !isValidNameSegment(uniqueID) {
+		return nil, nil
+	}
+	accountBytes, err := afero.ReadFile(s.fs, s.deletedServiceAccountPath(uniqueID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	account := &adminpb.ServiceAccount{}
+	err = protojson.Unmarshal(accountBytes, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *Service) writeServiceAccountLocked(account *adminpb.ServiceAccount) error {
+	accountDir := s.serviceAccountDir(account.ProjectId, account.Email)
+	err := s.fs.MkdirAll(accountDir, 0755)
+	if err != nil {
+		return err
+	}
+	accountBytes, err := protojson.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(s.fs, path.Join(accountDir, serviceAccountFile), accountBytes, 0644)
+}
+
+// splitServiceAccountName splits a service account resource name
+// into its project and email or unique ID.
+func splitServiceAccountName(name string) (string, string, bool) {
+	segments := strings.Split(name, "/")
+	if len(segments) != 4 || segments[0] != "projects" || segments[2] != "serviceAccounts" ||
+		!isValidNameSegment(segments[1]) || !isValidNameSegment(segments[3]) {
+		return "", "", false
+	}
+	return segments[1], segments[3], true
+}
+
+// serviceAccountProject extracts the ID of the project a service account
+// belongs to from its email.
+func serviceAccountProject(email string) (string, bool) {
+	emailParts := strings.SplitN(email, "@", 2)
+	if len(emailParts) != 2 || !strings.HasSuffix(emailParts[1], serviceAccountDomainSuffix) {
+		return "", false
+	}
+	projectID := strings.TrimSuffix(emailParts[1], serviceAccountDomainSuffix)
+	return projectID, isValidNameSegment(projectID)
+}
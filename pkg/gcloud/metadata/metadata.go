@@ -0,0 +1,95 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package metadata
+
+import (
+	"fmt"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+)
+
+const (
+	// DefaultAccount is the alias client libraries use
+	// for the instance's default service account.
+	DefaultAccount = "default"
+	// Zone is the zone reported for the emulated instance.
+	Zone = "local-a"
+)
+
+var (
+	metadataLocalHost = "metadata.google.internal"
+)
+
+// Service provides the data served by the emulated Compute Engine
+// metadata server, it allows client libraries to discover the project
+// and obtain credentials through Application Default Credentials.
+type Service struct {
+	projectID      string
+	serviceAccount string
+	tokens         *tokens.Service
+}
+
+// New creates a metadata service for the provided project, when no service account
+// is provided a default account in the project is used.
+func New(projectID string, serviceAccount string, tokenService *tokens.Service, ip string, hostsService hosts.Service) (*Service, error) {
+	err := hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &metadataLocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serviceAccount == "" {
+		serviceAccount = tokens.DefaultServiceAccount(projectID)
+	}
+	return &Service{
+		projectID:      projectID,
+		serviceAccount: serviceAccount,
+		tokens:         tokenService,
+	}, nil
+}
+
+// ProjectID retrieves the ID of the project the instance belongs to.
+func (s *Service) ProjectID() string {
+	return s.projectID
+}
+
+// NumericProjectID retrieves a stable project number derived from the project ID.
+func (s *Service) NumericProjectID() string {
+	// Project numbers are 12 digits, the last 12 digits of the unique ID
+	// derived for the project keep the number stable across restarts.
+	uniqueID := tokens.UniqueID(s.projectID)
+	return uniqueID[len(uniqueID)-12:]
+}
+
+// InstanceID retrieves the numeric ID of the emulated instance.
+func (s *Service) InstanceID() string {
+	return tokens.UniqueID(fmt.Sprintf("%s/instances/clouduno", s.projectID))
+}
+
+// ServiceAccountEmail resolves the email address of the provided account,
+// accounts can be referenced by the default alias or their email address.
+func (s *Service) ServiceAccountEmail(account string) (string, bool) {
+	if account == DefaultAccount || account == s.serviceAccount {
+		return s.serviceAccount, true
+	}
+	return "", false
+}
+
+// AccessToken deals with minting an access token for the instance's service account.
+func (s *Service) AccessToken(scopes []string) (*tokens.Token, error) {
+	return s.tokens.AccessToken(s.serviceAccount, scopes, tokens.DefaultLifetime)
+}
+
+// IdentityToken deals with minting an ID token for the instance's service account,
+// the email claims are only included for the full format.
+func (s *Service) IdentityToken(audience string, fullFormat bool) (*tokens.Token, error) {
+	return s.tokens.IDToken(s.serviceAccount, audience, fullFormat, tokens.DefaultLifetime)
+}
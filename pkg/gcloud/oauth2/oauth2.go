@@ -0,0 +1,294 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package oauth2
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+)
+
+const (
+	// TokenURI is the URI of the local token endpoint, it is used as the
+	// token_uri of the service account key files created by Cloud::1.
+	TokenURI = "http://oauth2.googleapis.local:5988/token"
+	// GrantTypeJWTBearer is the grant type used to exchange
+	// a service account JWT assertion for a token.
+	GrantTypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	// GrantTypeRefreshToken is the grant type used to exchange
+	// a refresh token for an access token.
+	GrantTypeRefreshToken = "refresh_token"
+
+	// maxAssertionLifetime is the longest period between the issue
+	// and expiry times of an assertion that Google will accept.
+	maxAssertionLifetime = time.Hour
+	// assertionClockSkew allows for assertions created on a machine
+	// with a clock that is slightly ahead of the emulator.
+	assertionClockSkew = 5 * time.Minute
+	// serviceAccountDomainSuffix is the suffix of the domain
+	// of every user-managed service account email.
+	serviceAccountDomainSuffix = ".iam.gserviceaccount.com"
+)
+
+var (
+	oauth2LocalHost = "oauth2.googleapis.local"
+
+	// tokenAudienceHosts are the hosts of the token endpoints client
+	// libraries set as the audience of their assertions.
+	tokenAudienceHosts = []string{
+		"oauth2.googleapis.com",
+		"www.googleapis.com",
+		"accounts.google.com",
+		oauth2LocalHost,
+	}
+)
+
+// Error provides an OAuth2 error response as described in RFC 6749.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// Response provides the successful response of the token endpoint,
+// an ID token is returned in place of an access token when an
+// assertion requests a target audience.
+type Response struct {
+	AccessToken string `json:"access_token,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	TokenType   string `json:"token_type,omitempty"`
+}
+
+// assertionClaims provides the claims of a service account JWT
+// assertion as described in RFC 7523.
+type assertionClaims struct {
+	Issuer         string `json:"iss"`
+	Subject        string `json:"sub"`
+	Audience       string `json:"aud"`
+	Scope          string `json:"scope"`
+	TargetAudience string `json:"target_audience"`
+	IssuedAt       int64  `json:"iat"`
+	Expiry         int64  `json:"exp"`
+}
+
+type assertionHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// ServiceAccountKeys provides the public keys of the service accounts
+// managed by the IAM emulator.
+type ServiceAccountKeys interface {
+	// ServiceAccountPublicKey retrieves the public key of a service account key,
+	// managed is false when the service account is not managed by the emulator.
+	// An error is returned when the service account is disabled or the key doesn't exist.
+	ServiceAccountPublicKey(email string, keyID string) (publicKey *rsa.PublicKey, managed bool, err error)
+}
+
+// Service provides the local OAuth2 token endpoint that exchanges
+// credentials from client libraries for tokens minted by the token service.
+type Service struct {
+	tokens           *tokens.Service
+	keys             ServiceAccountKeys
+	defaultPrincipal string
+	now              func() time.Time
+}
+
+// New creates an OAuth2 service, refresh tokens are exchanged for tokens
+// that represent the provided default principal.
+// Service account keys are provided when IAM is enforced, assertions must then
+// be signed with a key of a managed service account or by the token service.
+func New(
+	tokenService *tokens.Service,
+	keys ServiceAccountKeys,
+	defaultPrincipal string,
+	ip string,
+	hostsService hosts.Service,
+) (*Service, error) {
+	err := hostsService.Add(&hosts.Params{
+		IP:    &ip,
+		Hosts: &oauth2LocalHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		tokens:           tokenService,
+		keys:             keys,
+		defaultPrincipal: defaultPrincipal,
+		now:              time.Now,
+	}, nil
+}
+
+// Token deals with carrying out a token request for the provided grant type,
+// the parameters are the form values of the request.
+func (s *Service) Token(grantType string, params url.Values) (*Response, error) {
+	switch grantType {
+	case GrantTypeJWTBearer:
+		return s.exchangeAssertion(params.Get("assertion"))
+	case GrantTypeRefreshToken:
+		return s.exchangeRefreshToken(params.Get("refresh_token"), params.Get("scope"))
+	case "":
+		return nil, &Error{Code: "invalid_request", Description: "Missing required parameter: grant_type"}
+	}
+	return nil, &Error{Code: "unsupported_grant_type", Description: "Invalid grant_type: " + grantType}
+}
+
+// exchangeAssertion deals with exchanging a service account JWT assertion.
+// Assertions signed by the token service, such as those produced by SignJwt,
+// or with the keys of service accounts managed by the IAM emulator have their
+// signatures verified. Keys of other service accounts are not held by the emulator
+// so assertions signed with them are only accepted based on their claims
+// when IAM isn't enforced.
+func (s *Service) exchangeAssertion(assertion string) (*Response, error) {
+	if assertion == "" {
+		return nil, &Error{Code: "invalid_request", Description: "Missing required parameter: assertion"}
+	}
+	claims, err := s.parseAssertion(assertion)
+	if err != nil {
+		return nil, err
+	}
+	principal := claims.Issuer
+	if claims.Subject != "" {
+		// Domain-wide delegation is emulated by acting as the subject directly.
+		principal = claims.Subject
+	}
+	if claims.TargetAudience != "" {
+		token, err := s.tokens.IDToken(principal, claims.TargetAudience, true, tokens.DefaultLifetime)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{IDToken: token.Value}, nil
+	}
+	if claims.Scope == "" {
+		return nil, &Error{Code: "invalid_scope", Description: "Invalid OAuth scope or ID token audience provided."}
+	}
+	return s.accessTokenResponse(principal, strings.Fields(claims.Scope))
+}
+
+func (s *Service) parseAssertion(assertion string) (*assertionClaims, error) {
+	invalidGrant := &Error{Code: "invalid_grant", Description: "Invalid JWT Signature."}
+	segments := strings.Split(assertion, ".")
+	if len(segments) != 3 {
+		return nil, invalidGrant
+	}
+	header := &assertionHeader{}
+	if !decodeSegment(segments[0], header) || header.Algorithm != "RS256" {
+		return nil, invalidGrant
+	}
+	claims := &assertionClaims{}
+	if !decodeSegment(segments[1], claims) {
+		return nil, &Error{Code: "invalid_grant", Description: "Invalid JWT: claims could not be decoded."}
+	}
+	if !isServiceAccountEmail(claims.Issuer) {
+		return nil, &Error{Code: "invalid_grant", Description: "Invalid JWT: iss must be a service account email."}
+	}
+	if !s.verifyAssertionSignature(assertion, header.KeyID, claims.Issuer) {
+		return nil, invalidGrant
+	}
+	if !isTokenAudience(claims.Audience) {
+		return nil, &Error{Code: "invalid_grant", Description: "Invalid JWT audience: " + claims.Audience}
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	expiry := time.Unix(claims.Expiry, 0)
+	now := s.now()
+	if claims.IssuedAt == 0 || claims.Expiry == 0 ||
+		expiry.Sub(issuedAt) > maxAssertionLifetime ||
+		issuedAt.After(now.Add(assertionClockSkew)) ||
+		!expiry.After(now) {
+		return nil, &Error{
+			Code:        "invalid_grant",
+			Description: "Invalid JWT: Token must be a short-lived token (60 minutes) and in a reasonable timeframe.",
+		}
+	}
+	return claims, nil
+}
+
+func (s *Service) verifyAssertionSignature(assertion string, keyID string, issuer string) bool {
+	if keyID == s.tokens.KeyID() {
+		_, err := s.tokens.Verify(assertion)
+		return err == nil
+	}
+	if s.keys == nil {
+		return true
+	}
+	publicKey, managed, err := s.keys.ServiceAccountPublicKey(issuer, keyID)
+	if err != nil || !managed {
+		return false
+	}
+	_, err = tokens.VerifyWithKey(assertion, publicKey)
+	return err == nil
+}
+
+// exchangeRefreshToken deals with exchanging a refresh token, the emulator does not
+// issue refresh tokens so those created for user credentials, such as with
+// `gcloud auth application-default login`, act as the default principal.
+func (s *Service) exchangeRefreshToken(refreshToken string, scope string) (*Response, error) {
+	if refreshToken == "" {
+		return nil, &Error{Code: "invalid_request", Description: "Missing required parameter: refresh_token"}
+	}
+	return s.accessTokenResponse(s.defaultPrincipal, strings.Fields(scope))
+}
+
+func (s *Service) accessTokenResponse(principal string, scopes []string) (*Response, error) {
+	token, err := s.tokens.AccessToken(principal, scopes, tokens.DefaultLifetime)
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) == 0 {
+		scopes = []string{tokens.CloudPlatformScope}
+	}
+	return &Response{
+		AccessToken: token.Value,
+		ExpiresIn:   int64(token.Expiry.Sub(s.now()).Seconds()),
+		Scope:       strings.Join(scopes, " "),
+		TokenType:   "Bearer",
+	}, nil
+}
+
+// isServiceAccountEmail determines whether the provided email is that of
+// a user-managed service account, as opposed to a user or a group.
+func isServiceAccountEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	return at > 0 && len(domain) > len(serviceAccountDomainSuffix) &&
+		strings.HasSuffix(domain, serviceAccountDomainSuffix)
+}
+
+func isTokenAudience(audience string) bool {
+	audienceURL, err := url.Parse(audience)
+	if err != nil {
+		return false
+	}
+	for _, host := range tokenAudienceHosts {
+		if audienceURL.Hostname() == host {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, target interface{}) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(decoded, target) == nil
+}
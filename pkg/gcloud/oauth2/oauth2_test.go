@@ -0,0 +1,225 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package oauth2
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/spf13/afero"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type OAuth2Suite struct {
+	tokens  *tokens.Service
+	service *Service
+	key     *rsa.PrivateKey
+}
+
+var _ = Suite(&OAuth2Suite{})
+
+const (
+	testServiceAccount = "worker@test-project.iam.gserviceaccount.com"
+	testDefaultAccount = "clouduno@test-project.iam.gserviceaccount.com"
+)
+
+func (s *OAuth2Suite) SetUpSuite(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	s.key = key
+}
+
+func (s *OAuth2Suite) SetUpTest(c *C) {
+	tokenService, err := tokens.New("/data/gcloud/tokens", afero.NewMemMapFs())
+	c.Assert(err, IsNil)
+	s.tokens = tokenService
+	service, err := New(tokenService, nil, testDefaultAccount, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+	s.service = service
+}
+
+func (s *OAuth2Suite) Test_exchanges_service_account_assertions_for_access_tokens(c *C) {
+	response, err := s.service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "service-account-key", map[string]interface{}{
+			"scope": "https://www.googleapis.com/auth/pubsub",
+		})},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(response.TokenType, Equals, "Bearer")
+	claims, err := s.tokens.Validate(response.AccessToken)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testServiceAccount)
+	c.Assert(claims.Scope, Equals, "https://www.googleapis.com/auth/pubsub")
+}
+
+func (s *OAuth2Suite) Test_exchanges_assertions_with_a_target_audience_for_id_tokens(c *C) {
+	response, err := s.service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "service-account-key", map[string]interface{}{
+			"target_audience": "https://backend.local",
+		})},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(response.AccessToken, Equals, "")
+	claims, err := s.tokens.Validate(response.IDToken)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Audience, Equals, "https://backend.local")
+	c.Assert(claims.Email, Equals, testServiceAccount)
+}
+
+func (s *OAuth2Suite) Test_rejects_expired_assertions_and_forged_emulator_signatures(c *C) {
+	_, err := s.service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "service-account-key", map[string]interface{}{
+			"scope": tokens.CloudPlatformScope,
+			"iat":   time.Now().Add(-2 * time.Hour).Unix(),
+			"exp":   time.Now().Add(-time.Hour).Unix(),
+		})},
+	})
+	c.Assert(err.(*Error).Code, Equals, "invalid_grant")
+
+	// An assertion claiming to be signed by the emulator's key must carry a valid signature.
+	_, err = s.service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, s.tokens.KeyID(), map[string]interface{}{
+			"scope": tokens.CloudPlatformScope,
+		})},
+	})
+	c.Assert(err.(*Error).Code, Equals, "invalid_grant")
+}
+
+func (s *OAuth2Suite) Test_verifies_assertions_for_managed_service_account_keys(c *C) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	service, err := New(s.tokens, &stubServiceAccountKeys{
+		keys: map[string]*rsa.PublicKey{
+			"managed-key": &s.key.PublicKey,
+			"other-key":   &otherKey.PublicKey,
+		},
+	}, testDefaultAccount, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+
+	_, err = service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "managed-key", map[string]interface{}{"scope": tokens.CloudPlatformScope})},
+	})
+	c.Assert(err, IsNil)
+
+	_, err = service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "other-key", map[string]interface{}{"scope": tokens.CloudPlatformScope})},
+	})
+	c.Assert(err.(*Error).Code, Equals, "invalid_grant")
+
+	_, err = service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "deleted-key", map[string]interface{}{"scope": tokens.CloudPlatformScope})},
+	})
+	c.Assert(err.(*Error).Code, Equals, "invalid_grant")
+}
+
+func (s *OAuth2Suite) Test_rejects_assertions_that_are_not_for_service_accounts(c *C) {
+	for _, issuer := range []string{"owner@example.com", "owner@gserviceaccount.com.example.com", "@test-project.iam.gserviceaccount.com"} {
+		_, err := s.service.Token(GrantTypeJWTBearer, url.Values{
+			"assertion": {s.assertion(c, "any-key", map[string]interface{}{
+				"iss":   issuer,
+				"scope": tokens.CloudPlatformScope,
+			})},
+		})
+		c.Assert(err, NotNil)
+		c.Assert(err.(*Error).Code, Equals, "invalid_grant")
+	}
+}
+
+func (s *OAuth2Suite) Test_rejects_assertions_for_unmanaged_service_accounts_when_iam_is_enforced(c *C) {
+	service, err := New(s.tokens, &stubServiceAccountKeys{keys: map[string]*rsa.PublicKey{}}, testDefaultAccount, "127.0.0.1", &noopHostsService{})
+	c.Assert(err, IsNil)
+
+	_, err = service.Token(GrantTypeJWTBearer, url.Values{
+		"assertion": {s.assertion(c, "any-key", map[string]interface{}{
+			"iss":   "unmanaged@test-project.iam.gserviceaccount.com",
+			"scope": tokens.CloudPlatformScope,
+		})},
+	})
+	c.Assert(err, NotNil)
+	c.Assert(err.(*Error).Code, Equals, "invalid_grant")
+}
+
+func (s *OAuth2Suite) Test_refresh_tokens_act_as_the_default_principal(c *C) {
+	response, err := s.service.Token(GrantTypeRefreshToken, url.Values{
+		"refresh_token": {"1//user-refresh-token"},
+	})
+	c.Assert(err, IsNil)
+	claims, err := s.tokens.Validate(response.AccessToken)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testDefaultAccount)
+	c.Assert(response.Scope, Equals, tokens.CloudPlatformScope)
+
+	_, err = s.service.Token("password", url.Values{})
+	c.Assert(err.(*Error).Code, Equals, "unsupported_grant_type")
+}
+
+// assertion creates a service account assertion signed with a key
+// that is unknown to the emulator.
+func (s *OAuth2Suite) assertion(c *C, keyID string, extraClaims map[string]interface{}) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": testServiceAccount,
+		"aud": "https://oauth2.googleapis.com/token",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for name, value := range extraClaims {
+		claims[name] = value
+	}
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	c.Assert(err, IsNil)
+	payload, err := json.Marshal(claims)
+	c.Assert(err, IsNil)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	c.Assert(err, IsNil)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+type noopHostsService struct{}
+
+func (m *noopHostsService) Add(params *hosts.Params) error {
+	return nil
+}
+
+func (m *noopHostsService) Remove(params *hosts.Params) error {
+	return nil
+}
+
+type stubServiceAccountKeys struct {
+	keys map[string]*rsa.PublicKey
+}
+
+func (m *stubServiceAccountKeys) ServiceAccountPublicKey(email string, keyID string) (*rsa.PublicKey, bool, error) {
+	if email != testServiceAccount {
+		return nil, false, nil
+	}
+	publicKey, exists := m.keys[keyID]
+	if !exists {
+		return nil, true, errors.New("key not found")
+	}
+	return publicKey, true, nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package pagination
+
+import (
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Page works out the range of results for a page, page tokens are the offset
+// of the first result in the page. A page size of zero or less includes every
+// result that follows the offset.
+func Page(total int, pageSize int64, pageToken string) (int, int, string, error) {
+	start := 0
+	if pageToken != "" {
+		offset, err := strconv.Atoi(pageToken)
+		if err != nil || offset < 0 {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "Invalid page token: %s", pageToken)
+		}
+		start = offset
+	}
+	if start > total {
+		start = total
+	}
+	end := total
+	if pageSize > 0 && int64(start)+pageSize < int64(total) {
+		end = start + int(pageSize)
+	}
+	nextPageToken := ""
+	if end < total {
+		nextPageToken = strconv.Itoa(end)
+	}
+	return start, end, nextPageToken, nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package pagination
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PaginationSuite struct{}
+
+var _ = Suite(&PaginationSuite{})
+
+func (s *PaginationSuite) Test_pages_through_results(c *C) {
+	start, end, nextPageToken, err := Page(5, 2, "")
+	c.Assert(err, IsNil)
+	c.Assert([]int{start, end}, DeepEquals, []int{0, 2})
+	c.Assert(nextPageToken, Equals, "2")
+
+	start, end, nextPageToken, err = Page(5, 2, "4")
+	c.Assert(err, IsNil)
+	c.Assert([]int{start, end}, DeepEquals, []int{4, 5})
+	c.Assert(nextPageToken, Equals, "")
+}
+
+func (s *PaginationSuite) Test_includes_every_result_without_a_page_size(c *C) {
+	start, end, nextPageToken, err := Page(5, 0, "1")
+	c.Assert(err, IsNil)
+	c.Assert([]int{start, end}, DeepEquals, []int{1, 5})
+	c.Assert(nextPageToken, Equals, "")
+}
+
+func (s *PaginationSuite) Test_offsets_past_the_end_produce_an_empty_page(c *C) {
+	start, end, nextPageToken, err := Page(5, 2, "8")
+	c.Assert(err, IsNil)
+	c.Assert([]int{start, end}, DeepEquals, []int{5, 5})
+	c.Assert(nextPageToken, Equals, "")
+}
+
+func (s *PaginationSuite) Test_fails_for_invalid_page_tokens(c *C) {
+	for _, pageToken := range []string{"next", "-1"} {
+		_, _, _, err := Page(5, 2, pageToken)
+		c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	}
+}
@@ -10,18 +10,25 @@ package gcloud
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/docker/docker/client"
 	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/dns"
 	"github.com/freshwebio/cloud-uno/pkg/gcloud/grpc"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/iam"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/metadata"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/oauth2"
 	"github.com/freshwebio/cloud-uno/pkg/gcloud/storage"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud/tokens"
 	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
 	"github.com/freshwebio/cloud-uno/pkg/netutils"
 	"github.com/freshwebio/cloud-uno/pkg/types"
 	"github.com/freshwebio/cloud-uno/pkg/utils"
 	"github.com/spf13/afero"
 	"google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
 )
 
 const (
@@ -31,64 +38,330 @@ const (
 	// GCloudStorageName provides the name used to identify
 	// the google cloud storage service.
 	GCloudStorageName = "storage"
+	// GCloudPubSubName provides the name used to identify
+	// the google cloud pub/sub service.
+	GCloudPubSubName = "pubsub"
+	// GCloudKMSName provides the name used to identify
+	// the google cloud key management service.
+	GCloudKMSName = "kms"
+	// GCloudMetadataName provides the name used to identify
+	// the compute engine metadata server.
+	GCloudMetadataName = "metadata"
+	// GCloudResourceManagerName provides the name used to identify
+	// the google cloud resource manager service.
+	GCloudResourceManagerName = "resourcemanager"
+	// GCloudTasksName provides the name used to identify
+	// the google cloud tasks service.
+	GCloudTasksName = "tasks"
+	// GCloudSchedulerName provides the name used to identify
+	// the google cloud scheduler service.
+	GCloudSchedulerName = "scheduler"
+	// GCloudDNSName provides the name used to identify
+	// the google cloud dns service.
+	GCloudDNSName = "dns"
 )
 
-// RegisterServices deals with registering google cloud
-// services to be used for handling gRPC and HTTP requests.
-func RegisterServices(resolver types.Resolver) (err error) {
-	cfg, ok := resolver.Get("config").(*config.Config)
-	if !ok {
-		return config.ErrMissingOrInvalidConfigService
-	}
-
-	hostsService, ok := resolver.Get("hosts").(hosts.Service)
-	if !ok {
-		return hosts.ErrMissingOrInvalidHostsService
-	}
+var (
+	// TokensKey provides the key the token service shared by the Google Cloud
+	// emulators is provided under in the service registry.
+	TokensKey = types.NewKey[*tokens.Service]("gcloud.tokens")
+	// MetadataKey provides the key the compute engine metadata server is provided under.
+	MetadataKey = types.NewKey[*metadata.Service]("gcloud.metadata")
+	// IAMKey provides the key the google cloud IAM service is provided under.
+	IAMKey = types.NewKey[*iam.Service]("gcloud.iam")
+	// OAuth2Key provides the key the google oauth2 token endpoint is provided under.
+	OAuth2Key = types.NewKey[*oauth2.Service]("gcloud.oauth2")
+	// IAMCredentialsKey provides the key the google cloud IAM credentials service is provided under.
+	IAMCredentialsKey = types.NewKey[*grpc.IAMCredentials]("gcloud.iamcredentials")
+	// ResourceManagerKey provides the key the google cloud resource manager service is provided under.
+	ResourceManagerKey = types.NewKey[*grpc.ResourceManager]("gcloud.resourcemanager")
+	// KMSKey provides the key the google cloud key management service is provided under.
+	KMSKey = types.NewKey[*grpc.KMS]("gcloud.kms")
+	// SecretManagerKey provides the key the google cloud secret manager service is provided under.
+	SecretManagerKey = types.NewKey[secretmanager.SecretManagerServiceServer]("gcloud.secretmanager")
+	// PubSubKey provides the key the google cloud pub/sub service is provided under.
+	PubSubKey = types.NewKey[*grpc.PubSub]("gcloud.pubsub")
+	// TasksKey provides the key the google cloud tasks service is provided under.
+	TasksKey = types.NewKey[*grpc.Tasks]("gcloud.tasks")
+	// SchedulerKey provides the key the google cloud scheduler service is provided under.
+	SchedulerKey = types.NewKey[*grpc.Scheduler]("gcloud.scheduler")
+	// DNSKey provides the key the google cloud dns service is provided under.
+	DNSKey = types.NewKey[*dns.Service]("gcloud.dns")
+	// StorageKey provides the key the google cloud storage service is provided under.
+	StorageKey = types.NewKey[storage.Storage]("gcloud.storage")
+)
 
-	fs := resolver.Get("fs").(afero.Fs)
-	// if !ok {
-	// 	return coresvc.ErrMissingOrInvalidFS
-	// }
+// emulatorDependencies provides the services every emulator is created with.
+var emulatorDependencies = []types.Dependency{config.Key, utils.FileSystemKey, hosts.Key}
 
+// emulator provides the config and services every emulator is created with.
+type emulator struct {
+	cfg          *config.Config
+	fs           afero.Fs
+	hostsService hosts.Service
 	// Configuration will always contain the user-provided server IP,
 	// we need to do a little more work to make sure the correct server IP
 	// is selected based on the way in which the application is being run
 	// as well as providing some validation.
+	serverIP string
+}
+
+func newEmulator(r *types.Registry) (*emulator, error) {
+	cfg := types.MustGet(r, config.Key)
 	serverIP, err := netutils.SelectServerIP(cfg)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return &emulator{
+		cfg:          cfg,
+		fs:           types.MustGet(r, utils.FileSystemKey),
+		hostsService: types.MustGet(r, hosts.Key),
+		serverIP:     serverIP,
+	}, nil
+}
 
-	// Docker is used to orchestrate and manage both vendor-managed
-	// emulators and open source software used as the backend for some cloud services.
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		log.Fatal(err)
+// enabled determines whether a service is in the google cloud services config.
+func (e *emulator) enabled(name string) bool {
+	return utils.CommaSeparatedListContains(*e.cfg.GCloudServices, name)
+}
+
+// dataDir provides the directory in the data directory
+// a service keeps its data in.
+func (e *emulator) dataDir(name string) string {
+	return fmt.Sprintf("%s/gcloud/%s", *e.cfg.DataDirectory, name)
+}
+
+func (e *emulator) serviceAccount() string {
+	if *e.cfg.GCloudServiceAccount != "" {
+		return *e.cfg.GCloudServiceAccount
 	}
+	return tokens.DefaultServiceAccount(*e.cfg.GCloudProjectID)
+}
+
+// provide registers the provider of an emulator, the emulator is disabled
+// when the create func reports it isn't enabled.
+func provide[T any](
+	r *types.Registry,
+	key types.Key[T],
+	create func(r *types.Registry, e *emulator) (T, bool, error),
+	options ...types.ProviderOption,
+) {
+	options = append(options, types.Requires(emulatorDependencies...))
+	types.Provide(r, key, func(r *types.Registry) (T, error) {
+		var service T
+		e, err := newEmulator(r)
+		if err != nil {
+			return service, err
+		}
+		service, enabled, err := create(r, e)
+		if err == nil && !enabled {
+			err = types.ErrDisabled
+		}
+		return service, err
+	}, options...)
+}
+
+// iamPolicy provides the IAM service for emulators that enforce IAM policies
+// on their resources when IAM is enabled.
+func iamPolicy(r *types.Registry) iampb.IAMPolicyServer {
+	if iamService, ok := types.Get(r, IAMKey); ok {
+		return iamService
+	}
+	return nil
+}
+
+// RegisterServices deals with registering the providers of google cloud
+// services to be used for handling gRPC and HTTP requests. Services that
+// are not enabled are disabled in the registry.
+func RegisterServices(r *types.Registry) {
+	// The token service is shared by the metadata server, the IAM services,
+	// Cloud Tasks and Cloud Scheduler so tokens minted by one can be verified
+	// by the others.
+	provide(r, TokensKey, func(r *types.Registry, e *emulator) (*tokens.Service, bool, error) {
+		if !e.enabled(GCloudMetadataName) && !*e.cfg.GCloudIAM && !e.enabled(GCloudTasksName) && !e.enabled(GCloudSchedulerName) {
+			return nil, false, nil
+		}
+		tokenService, err := tokens.New(e.dataDir("tokens"), e.fs)
+		return tokenService, true, err
+	})
+
+	provide(r, MetadataKey, func(r *types.Registry, e *emulator) (*metadata.Service, bool, error) {
+		if !e.enabled(GCloudMetadataName) {
+			return nil, false, nil
+		}
+		metadataService, err := metadata.New(
+			*e.cfg.GCloudProjectID,
+			e.serviceAccount(),
+			types.MustGet(r, TokensKey),
+			e.serverIP,
+			e.hostsService,
+		)
+		return metadataService, true, err
+	}, types.Requires(TokensKey))
+
+	// The configured service account owns the project so clients using
+	// Application Default Credentials keep working when IAM is enabled.
+	provide(r, IAMKey, func(r *types.Registry, e *emulator) (*iam.Service, bool, error) {
+		if !*e.cfg.GCloudIAM {
+			return nil, false, nil
+		}
+		iamService, err := iam.New(
+			e.dataDir("iam"),
+			e.fs,
+			types.MustGet(r, TokensKey),
+			*e.cfg.GCloudProjectID,
+			e.serviceAccount(),
+			e.serverIP,
+			e.hostsService,
+		)
+		return iamService, true, err
+	}, types.Requires(TokensKey))
+
+	// Assertions for service accounts created with the IAM Admin API
+	// must be signed with one of the keys created for them.
+	provide(r, OAuth2Key, func(r *types.Registry, e *emulator) (*oauth2.Service, bool, error) {
+		oauth2Service, err := oauth2.New(
+			types.MustGet(r, TokensKey),
+			types.MustGet(r, IAMKey),
+			e.serviceAccount(),
+			e.serverIP,
+			e.hostsService,
+		)
+		return oauth2Service, true, err
+	}, types.Requires(TokensKey, IAMKey))
+
+	provide(r, IAMCredentialsKey, func(r *types.Registry, e *emulator) (*grpc.IAMCredentials, bool, error) {
+		iamCredentials, err := grpc.NewIAMCredentials(types.MustGet(r, TokensKey), e.serverIP, e.hostsService)
+		return iamCredentials, true, err
+	}, types.Requires(TokensKey, IAMKey))
 
 	// Given gRPC is a fantastic representation of a service that is usually
-	// abstracted away from a REST API route handler, the default resolver will use
+	// abstracted away from a REST API route handler, the default registry will use
 	// the gRPC services for Google Cloud APIs that support gRPC.
-	if utils.CommaSeparatedListContains(*cfg.GCloudServices, GCloudSecretManagerName) {
+
+	provide(r, ResourceManagerKey, func(r *types.Registry, e *emulator) (*grpc.ResourceManager, bool, error) {
+		if !e.enabled(GCloudResourceManagerName) {
+			return nil, false, nil
+		}
+		resourceManager, err := grpc.NewResourceManager(
+			e.dataDir("resourcemanager"),
+			e.fs,
+			*e.cfg.GCloudProjectID,
+			*e.cfg.GCloudStrictProjects,
+			iamPolicy(r),
+			e.serverIP,
+			e.hostsService,
+		)
+		if err != nil {
+			return nil, true, err
+		}
+		// Policies set on folders are inherited by the folders
+		// and projects that belong to them.
+		if iamService, ok := types.Get(r, IAMKey); ok {
+			iamService.SetResourceParents(resourceManager)
+		}
+		return resourceManager, true, nil
+	}, types.Optional(IAMKey))
+
+	provide(r, KMSKey, func(r *types.Registry, e *emulator) (*grpc.KMS, bool, error) {
+		if !e.enabled(GCloudKMSName) {
+			return nil, false, nil
+		}
+		kms, err := grpc.NewKMS(e.dataDir("kms"), e.fs, e.serverIP, e.hostsService)
+		return kms, true, err
+	})
+
+	// The secret manager uses KMS for secrets with
+	// customer-managed encryption keys when it is enabled.
+	provide(r, SecretManagerKey, func(r *types.Registry, e *emulator) (secretmanager.SecretManagerServiceServer, bool, error) {
+		if !e.enabled(GCloudSecretManagerName) {
+			return nil, false, nil
+		}
 		fmt.Println("Registering secret manager!")
-		smRootDir := fmt.Sprintf("%s/gcloud/secretmanager", *cfg.DataDirectory)
-		var secretmgr secretmanager.SecretManagerServiceServer
-		secretmgr, err = grpc.NewSecretManager(smRootDir, fs, serverIP, hostsService)
+		encryption := &grpc.SecretEncryption{
+			KeyFile: *e.cfg.GCloudSecretKeyFile,
+		}
+		if kms, ok := types.Get(r, KMSKey); ok {
+			encryption.KMS = kms
+		}
+		secretmgr, err := grpc.NewSecretManager(e.dataDir("secretmanager"), e.fs, e.serverIP, e.hostsService, encryption, iamPolicy(r))
+		return secretmgr, true, err
+	}, types.Optional(KMSKey, IAMKey))
+
+	provide(r, PubSubKey, func(r *types.Registry, e *emulator) (*grpc.PubSub, bool, error) {
+		if !e.enabled(GCloudPubSubName) {
+			return nil, false, nil
+		}
+		pubsub, err := grpc.NewPubSub(e.serverIP, e.hostsService)
+		return pubsub, true, err
+	})
+
+	provide(r, TasksKey, func(r *types.Registry, e *emulator) (*grpc.Tasks, bool, error) {
+		if !e.enabled(GCloudTasksName) {
+			return nil, false, nil
+		}
+		targets, err := grpc.ParseLocalTargets(*e.cfg.GCloudTaskTargets)
 		if err != nil {
-			return
+			return nil, true, err
 		}
-		resolver.Set("gcloud.secretmanager", secretmgr)
-	}
+		tasks, err := grpc.NewTasks(
+			e.dataDir("tasks"),
+			e.fs,
+			types.MustGet(r, TokensKey),
+			targets,
+			iamPolicy(r),
+			e.serverIP,
+			e.hostsService,
+		)
+		return tasks, true, err
+	}, types.Requires(TokensKey), types.Optional(IAMKey))
 
-	if utils.CommaSeparatedListContains(*cfg.GCloudServices, GCloudStorageName) {
-		var storageService storage.Storage
-		storageService, err = storage.New(dockerClient)
+	// Jobs with Pub/Sub targets can only be created
+	// when the Pub/Sub emulator is enabled.
+	provide(r, SchedulerKey, func(r *types.Registry, e *emulator) (*grpc.Scheduler, bool, error) {
+		if !e.enabled(GCloudSchedulerName) {
+			return nil, false, nil
+		}
+		targets, err := grpc.ParseLocalTargets(*e.cfg.GCloudTaskTargets)
 		if err != nil {
-			return
+			return nil, true, err
 		}
-		resolver.Set("gcloud.storage", storageService)
-	}
+		var publisher pubsubpb.PublisherServer
+		if pubsub, ok := types.Get(r, PubSubKey); ok {
+			publisher = pubsub
+		}
+		scheduler, err := grpc.NewScheduler(
+			e.dataDir("scheduler"),
+			e.fs,
+			types.MustGet(r, TokensKey),
+			targets,
+			publisher,
+			grpc.SystemClock(),
+			e.serverIP,
+			e.hostsService,
+		)
+		return scheduler, true, err
+	}, types.Requires(TokensKey), types.Optional(PubSubKey))
 
-	return
+	provide(r, DNSKey, func(r *types.Registry, e *emulator) (*dns.Service, bool, error) {
+		if !e.enabled(GCloudDNSName) {
+			return nil, false, nil
+		}
+		dnsService, err := dns.New(e.dataDir("dns"), e.fs, e.serverIP, e.hostsService, types.MustGet(r, logging.Key))
+		return dnsService, true, err
+	}, types.Requires(logging.Key))
+
+	// Docker is used to orchestrate and manage both vendor-managed
+	// emulators and open source software used as the backend for some cloud services.
+	provide(r, StorageKey, func(r *types.Registry, e *emulator) (storage.Storage, bool, error) {
+		if !e.enabled(GCloudStorageName) {
+			return nil, false, nil
+		}
+		dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+		if err != nil {
+			return nil, true, err
+		}
+		storageService, err := storage.New(dockerClient)
+		return storageService, true, err
+	})
 }
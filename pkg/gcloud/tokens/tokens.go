@@ -0,0 +1,329 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package tokens
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// Issuer is the issuer of all tokens minted by the local token service.
+	Issuer = "http://oauth2.googleapis.local"
+	// DefaultLifetime is the lifetime of tokens when no lifetime is requested.
+	DefaultLifetime = time.Hour
+	// CloudPlatformScope is the OAuth2 scope that grants access to all Google Cloud APIs.
+	CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// TokenUseAccess identifies OAuth2 access tokens.
+	TokenUseAccess = "access"
+	// TokenUseID identifies OpenID Connect ID tokens.
+	TokenUseID = "id"
+
+	signingKeyFile = "signing-key.pem"
+	signingKeyBits = 2048
+)
+
+var (
+	// ErrInvalidToken is returned when a token is malformed, expired
+	// or was not signed by the local token service.
+	ErrInvalidToken = errors.New("token is invalid or has expired")
+)
+
+// Service mints and validates the access tokens and ID tokens used by the
+// Google Cloud emulators, every token is a JWT signed with an RSA key that
+// is held by the emulator so tokens can be verified without a network call.
+type Service struct {
+	key   *rsa.PrivateKey
+	keyID string
+	now   func() time.Time
+}
+
+// Claims provides the JWT claims for tokens minted by the token service.
+type Claims struct {
+	Issuer          string `json:"iss"`
+	Subject         string `json:"sub"`
+	Audience        string `json:"aud,omitempty"`
+	AuthorizedParty string `json:"azp,omitempty"`
+	Email           string `json:"email,omitempty"`
+	EmailVerified   bool   `json:"email_verified,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	TokenUse        string `json:"token_use,omitempty"`
+	IssuedAt        int64  `json:"iat"`
+	Expiry          int64  `json:"exp"`
+}
+
+// Token provides a signed token along with the time it expires.
+type Token struct {
+	Value  string
+	Expiry time.Time
+}
+
+// New creates a token service, the signing key is loaded from the data directory
+// so tokens remain valid across restarts, a new key is generated if one doesn't exist.
+func New(dataRootDir string, fs afero.Fs) (*Service, error) {
+	err := fs.MkdirAll(dataRootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateSigningKey(path.Join(dataRootDir, signingKeyFile), fs)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyIDHash := sha256.Sum256(publicKeyDER)
+	return &Service{
+		key:   key,
+		keyID: hex.EncodeToString(keyIDHash[:20]),
+		now:   time.Now,
+	}, nil
+}
+
+func loadOrCreateSigningKey(keyPath string, fs afero.Fs) (*rsa.PrivateKey, error) {
+	exists, err := afero.Exists(fs, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		keyPEM, err := afero.ReadFile(fs, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("signing key %s is not PEM encoded", keyPath)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	err = afero.WriteFile(fs, keyPath, keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AccessToken deals with minting an OAuth2 access token for the provided principal.
+func (s *Service) AccessToken(principal string, scopes []string, lifetime time.Duration) (*Token, error) {
+	if len(scopes) == 0 {
+		scopes = []string{CloudPlatformScope}
+	}
+	return s.mint(&Claims{
+		Subject:  UniqueID(principal),
+		Email:    principal,
+		Scope:    strings.Join(scopes, " "),
+		TokenUse: TokenUseAccess,
+	}, lifetime)
+}
+
+// IDToken deals with minting an OpenID Connect ID token for the provided principal,
+// the email claims are only included when includeEmail is set.
+func (s *Service) IDToken(principal string, audience string, includeEmail bool, lifetime time.Duration) (*Token, error) {
+	claims := &Claims{
+		Subject:         UniqueID(principal),
+		Audience:        audience,
+		AuthorizedParty: UniqueID(principal),
+		TokenUse:        TokenUseID,
+	}
+	if includeEmail {
+		claims.Email = principal
+		claims.EmailVerified = true
+	}
+	return s.mint(claims, lifetime)
+}
+
+func (s *Service) mint(claims *Claims, lifetime time.Duration) (*Token, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	now := s.now()
+	expiry := now.Add(lifetime)
+	claims.Issuer = Issuer
+	claims.IssuedAt = now.Unix()
+	claims.Expiry = expiry.Unix()
+	value, err := s.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Value:  value,
+		Expiry: expiry,
+	}, nil
+}
+
+// Sign deals with producing an RS256 signed JWT for the provided claims.
+func (s *Service) Sign(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encodeSegment(signature), nil
+}
+
+// Validate deals with checking the signature and expiry of a token
+// minted by the token service and extracting its claims.
+func (s *Service) Validate(token string) (*Claims, error) {
+	payload, err := s.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	claims := &Claims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != Issuer || s.now().Unix() >= claims.Expiry {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Verify deals with checking a JWT was signed by the token service,
+// the decoded payload is returned without any of the claims being checked.
+func (s *Service) Verify(token string) ([]byte, error) {
+	return VerifyWithKey(token, &s.key.PublicKey)
+}
+
+// VerifyWithKey deals with checking an RS256 JWT was signed with the private key
+// for the provided public key, such as a service account key, the decoded payload
+// is returned without any of the claims being checked.
+func VerifyWithKey(token string, publicKey *rsa.PublicKey) ([]byte, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return payload, nil
+}
+
+// KeyID retrieves the ID of the key used to sign tokens.
+func (s *Service) KeyID() string {
+	return s.keyID
+}
+
+// TokenKeyID retrieves the ID of the key a JWT claims to have been signed with
+// from its header, an empty string is returned for malformed tokens.
+func TokenKeyID(token string) string {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return ""
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err != nil {
+		return ""
+	}
+	header := struct {
+		KeyID string `json:"kid"`
+	}{}
+	if json.Unmarshal(headerBytes, &header) != nil {
+		return ""
+	}
+	return header.KeyID
+}
+
+// JSONWebKey provides the public part of a signing key in the JWK format.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JSONWebKeySet provides a set of public keys that can be used
+// to verify tokens offline.
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// JWKS retrieves the public key set for the keys used to sign tokens.
+func (s *Service) JWKS() *JSONWebKeySet {
+	return &JSONWebKeySet{
+		Keys: []*JSONWebKey{
+			{
+				KeyType:   "RSA",
+				Algorithm: "RS256",
+				Use:       "sig",
+				KeyID:     s.keyID,
+				Modulus:   encodeSegment(s.key.PublicKey.N.Bytes()),
+				Exponent:  encodeSegment(big.NewInt(int64(s.key.PublicKey.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// DefaultServiceAccount provides the email of the service account used
+// for a project when one has not been configured.
+func DefaultServiceAccount(projectID string) string {
+	return fmt.Sprintf("clouduno@%s.iam.gserviceaccount.com", projectID)
+}
+
+// UniqueID derives a stable numeric ID for a principal in the same
+// format Google uses for service account unique IDs.
+func UniqueID(principal string) string {
+	digest := sha256.Sum256([]byte(principal))
+	return fmt.Sprintf("1%020d", binary.BigEndian.Uint64(digest[:8]))
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package tokens
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type TokensSuite struct {
+	fs afero.Fs
+}
+
+var _ = Suite(&TokensSuite{})
+
+const testServiceAccount = "clouduno@test-project.iam.gserviceaccount.com"
+
+func (s *TokensSuite) SetUpTest(c *C) {
+	s.fs = afero.NewMemMapFs()
+}
+
+func (s *TokensSuite) Test_tokens_remain_valid_across_restarts(c *C) {
+	service, err := New("/data/gcloud/tokens", s.fs)
+	c.Assert(err, IsNil)
+	token, err := service.AccessToken(testServiceAccount, nil, 0)
+	c.Assert(err, IsNil)
+
+	restarted, err := New("/data/gcloud/tokens", s.fs)
+	c.Assert(err, IsNil)
+	claims, err := restarted.Validate(token.Value)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testServiceAccount)
+	c.Assert(claims.Scope, Equals, CloudPlatformScope)
+	c.Assert(claims.TokenUse, Equals, TokenUseAccess)
+	c.Assert(claims.Subject, Equals, UniqueID(testServiceAccount))
+}
+
+func (s *TokensSuite) Test_id_tokens_only_include_email_when_requested(c *C) {
+	service, err := New("/data/gcloud/tokens", s.fs)
+	c.Assert(err, IsNil)
+
+	token, err := service.IDToken(testServiceAccount, "https://service.local", false, time.Minute)
+	c.Assert(err, IsNil)
+	claims, err := service.Validate(token.Value)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Audience, Equals, "https://service.local")
+	c.Assert(claims.Email, Equals, "")
+
+	token, err = service.IDToken(testServiceAccount, "https://service.local", true, time.Minute)
+	c.Assert(err, IsNil)
+	claims, err = service.Validate(token.Value)
+	c.Assert(err, IsNil)
+	c.Assert(claims.Email, Equals, testServiceAccount)
+	c.Assert(claims.EmailVerified, Equals, true)
+}
+
+func (s *TokensSuite) Test_expired_and_tampered_tokens_are_rejected(c *C) {
+	service, err := New("/data/gcloud/tokens", s.fs)
+	c.Assert(err, IsNil)
+	token, err := service.AccessToken(testServiceAccount, nil, time.Minute)
+	c.Assert(err, IsNil)
+
+	_, err = service.Validate(token.Value + "x")
+	c.Assert(err, Equals, ErrInvalidToken)
+
+	service.now = func() time.Time {
+		return time.Now().Add(2 * time.Minute)
+	}
+	_, err = service.Validate(token.Value)
+	c.Assert(err, Equals, ErrInvalidToken)
+}
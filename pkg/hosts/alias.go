@@ -0,0 +1,77 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/netutils"
+	"github.com/freshwebio/cloud-uno/pkg/utils"
+)
+
+var (
+	// Replaced in tests so the loopback interface of the machine
+	// running the tests is never changed.
+	createLoopBackAlias = netutils.CreateLoopBackAlias
+	removeLoopBackAlias = netutils.RemoveLoopBackAlias
+)
+
+// gcloudMetadataService is the name the Google Cloud metadata server
+// is enabled by in the gcloud services config.
+const gcloudMetadataService = "metadata"
+
+// createServerIPAliases makes sure that when the Cloud::1 server is running in Docker
+// with a static IP, it can be accessed from the host by that IP.
+// (e.g. opening the cloud uno console in the browser)
+// When the metadata server is enabled, the link-local metadata IP is aliased as well
+// so client libraries that fall back to it reach Cloud::1 instead of timing out.
+// Only the aliases that were added are returned so an alias
+// that was already there is left in place on shutdown.
+func createServerIPAliases(cfg *config.Config) ([]string, error) {
+	ips := []string{}
+	if cfg.RunOnHost == nil || !*cfg.RunOnHost {
+		serverIP, err := netutils.SelectServerIP(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, serverIP)
+	}
+	if cfg.GCloudServices != nil && utils.CommaSeparatedListContains(*cfg.GCloudServices, gcloudMetadataService) {
+		ips = append(ips, netutils.MetadataIP)
+	}
+	aliases := []string{}
+	for _, ip := range ips {
+		added, err := createLoopBackAlias(ip)
+		if err != nil {
+			removeServerIPAliases(aliases)
+			return nil, err
+		}
+		if added {
+			aliases = append(aliases, ip)
+		}
+	}
+	return aliases, nil
+}
+
+// removeServerIPAliases removes the loopback aliases added by createServerIPAliases.
+func removeServerIPAliases(aliases []string) error {
+	failures := []string{}
+	for _, ip := range aliases {
+		err := removeLoopBackAlias(ip)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ", "))
+	}
+	return nil
+}
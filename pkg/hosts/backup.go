@@ -0,0 +1,118 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHostsBackups is the number of hosts file backups
+	// kept when a number hasn't been configured.
+	DefaultHostsBackups = 10
+	backupPrefix        = "hosts-"
+	// Backups are named with a UTC timestamp so sorting them
+	// by name also sorts them from oldest to newest.
+	backupTimeFormat = "20060102T150405.000000000Z"
+)
+
+var (
+	// ErrBackupNotFound is returned when the hosts file backup to restore
+	// does not exist or there are no backups to restore from.
+	ErrBackupNotFound = errors.New("hosts file backup not found")
+)
+
+// Restore the hosts file from the backup with the given name,
+// the most recent backup is restored when the name is empty.
+// A backup of the hosts file is taken before it is restored so
+// a restore can be rolled back in the same way.
+func (m *Manager) Restore(backup string) error {
+	return m.update(func(current []byte) ([]byte, error) {
+		backups, err := m.backups()
+		if err != nil {
+			return nil, err
+		}
+		if backup == "" && len(backups) > 0 {
+			backup = backups[len(backups)-1]
+		}
+		// Only names from the backup directory listing are accepted
+		// so a backup name can't be used to read any other file.
+		if !itemInSlice(backup, backups) {
+			return nil, ErrBackupNotFound
+		}
+		return ioutil.ReadFile(filepath.Join(m.backupDir, backup))
+	})
+}
+
+// backupLocked saves a copy of the hosts file contents to the backup directory,
+// the oldest backups are removed once there are more than the number to keep.
+// No backup is taken when the contents match the most recent backup.
+func (m *Manager) backupLocked(data []byte) error {
+	if m.backupCount <= 0 {
+		return nil
+	}
+	err := os.MkdirAll(m.backupDir, 0755)
+	if err != nil {
+		return err
+	}
+	backups, err := m.backups()
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 {
+		latest, err := ioutil.ReadFile(filepath.Join(m.backupDir, backups[len(backups)-1]))
+		if err == nil && bytes.Equal(latest, data) {
+			return nil
+		}
+	}
+
+	name := backupPrefix + m.now().UTC().Format(backupTimeFormat)
+	err = ioutil.WriteFile(filepath.Join(m.backupDir, name), data, 0644)
+	if err != nil {
+		return err
+	}
+	backups = append(backups, name)
+	for len(backups) > m.backupCount {
+		err = os.Remove(filepath.Join(m.backupDir, backups[0]))
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups lists the names of the hosts file backups from oldest to newest.
+func (m *Manager) backups() ([]string, error) {
+	files, err := ioutil.ReadDir(m.backupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	backups := []string{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+		_, err := time.Parse(backupTimeFormat, strings.TrimPrefix(name, backupPrefix))
+		if err == nil {
+			backups = append(backups, name)
+		}
+	}
+	return backups, nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/sirupsen/logrus"
+	. "gopkg.in/check.v1"
+)
+
+type BackupSuite struct {
+	hostsPath string
+	backupDir string
+	manager   *Manager
+	clock     time.Time
+}
+
+var _ = Suite(&BackupSuite{})
+
+const backupTestHosts = "127.0.0.1 localhost\n::1 localhost\n"
+
+func (s *BackupSuite) SetUpTest(c *C) {
+	dir := c.MkDir()
+	s.hostsPath = filepath.Join(dir, "hosts")
+	s.backupDir = filepath.Join(dir, "backups")
+	s.clock = time.Date(2022, time.March, 1, 10, 0, 0, 0, time.UTC)
+	err := ioutil.WriteFile(s.hostsPath, []byte(backupTestHosts), 0640)
+	c.Assert(err, IsNil)
+	s.manager = s.newManager(c, 2)
+}
+
+func (s *BackupSuite) TearDownTest(c *C) {
+	c.Assert(s.manager.Shutdown(), IsNil)
+}
+
+func (s *BackupSuite) newManager(c *C, backups int) *Manager {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	service, err := NewManager(&config.Config{
+		HostsPath:      &s.hostsPath,
+		HostsBackupDir: &s.backupDir,
+		HostsBackups:   &backups,
+	}, logrus.NewEntry(logger))
+	c.Assert(err, IsNil)
+	manager := service.(*Manager)
+	manager.now = func() time.Time {
+		s.clock = s.clock.Add(time.Second)
+		return s.clock
+	}
+	return manager
+}
+
+func (s *BackupSuite) add(c *C, ip string, hosts string) {
+	err := s.manager.Add(&Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+}
+
+func (s *BackupSuite) readHosts(c *C) string {
+	data, err := ioutil.ReadFile(s.hostsPath)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *BackupSuite) Test_keeps_a_bounded_number_of_backups(c *C) {
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+	s.add(c, "172.18.0.23", "pubsub.googleapis.local")
+	beforeLastAdd := s.readHosts(c)
+	s.add(c, "172.18.0.24", "secretmanager.googleapis.local")
+
+	backups, err := s.manager.backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, DeepEquals, []string{
+		"hosts-20220301T100002.000000000Z",
+		"hosts-20220301T100003.000000000Z",
+	})
+	latest, err := ioutil.ReadFile(filepath.Join(s.backupDir, backups[1]))
+	c.Assert(err, IsNil)
+	c.Assert(string(latest), Equals, beforeLastAdd)
+}
+
+func (s *BackupSuite) Test_does_not_write_or_back_up_when_nothing_changes(c *C) {
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+
+	backups, err := s.manager.backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 1)
+}
+
+func (s *BackupSuite) Test_does_not_back_up_when_backups_are_disabled(c *C) {
+	s.manager.Shutdown()
+	s.manager = s.newManager(c, 0)
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+
+	_, err := os.Stat(s.backupDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *BackupSuite) Test_restores_the_most_recent_backup(c *C) {
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+	s.add(c, "172.18.0.23", "pubsub.googleapis.local")
+	afterFirstAdd := strings.Replace(s.readHosts(c), "172.18.0.23 pubsub.googleapis.local\n", "", 1)
+
+	err := s.manager.Restore("")
+	c.Assert(err, IsNil)
+	c.Assert(s.readHosts(c), Equals, afterFirstAdd)
+	c.Assert(s.manager.Entries, HasLen, len(strings.Split(strings.TrimSpace(afterFirstAdd), "\n")))
+}
+
+func (s *BackupSuite) Test_restores_a_chosen_backup(c *C) {
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+	s.add(c, "172.18.0.23", "pubsub.googleapis.local")
+
+	err := s.manager.Restore("hosts-20220301T100001.000000000Z")
+	c.Assert(err, IsNil)
+	c.Assert(s.readHosts(c), Equals, backupTestHosts)
+}
+
+func (s *BackupSuite) Test_fails_to_restore_a_backup_that_does_not_exist(c *C) {
+	c.Assert(s.manager.Restore(""), Equals, ErrBackupNotFound)
+
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+	c.Assert(s.manager.Restore("../hosts"), Equals, ErrBackupNotFound)
+	c.Assert(s.manager.Restore("hosts-20220301T100005.000000000Z"), Equals, ErrBackupNotFound)
+}
+
+func (s *BackupSuite) Test_keeps_line_endings_and_mode_of_hosts_file(c *C) {
+	crlfHosts := strings.Replace(backupTestHosts, "\n", "\r\n", -1)
+	err := ioutil.WriteFile(s.hostsPath, []byte(crlfHosts), 0640)
+	c.Assert(err, IsNil)
+	s.add(c, "172.18.0.22", "storage.googleapis.local")
+
+	hosts := s.readHosts(c)
+	c.Assert(strings.Count(hosts, "\n"), Equals, strings.Count(hosts, "\r\n"))
+	c.Assert(hosts, Matches, "(?s).*172.18.0.22 storage.googleapis.local\r\n.*")
+	info, err := os.Stat(s.hostsPath)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0640))
+
+	// The temporary file used to replace the hosts file
+	// should not be left behind.
+	files, err := ioutil.ReadDir(filepath.Dir(s.hostsPath))
+	c.Assert(err, IsNil)
+	for _, file := range files {
+		c.Assert(strings.HasPrefix(file.Name(), ".hosts-cloud-uno-"), Equals, false)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/netutils"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// resolvConfPath provides the location of the resolver configuration
+	// the upstream name servers are read from when none are configured.
+	resolvConfPath = "/etc/resolv.conf"
+	// hostTTL is the TTL of the records served for hosts added to the server,
+	// it's kept short as hosts come and go with the emulators.
+	hostTTL = 60
+	// maxCNAMEDepth is the number of CNAME records that will be
+	// followed within the zones served before giving up.
+	maxCNAMEDepth = 8
+)
+
+var (
+	// LocalDomains provides the domains that every name under
+	// resolves to the IP the Cloud::1 server is running on.
+	LocalDomains = []string{"googleapis.local.", "clouduno.local."}
+)
+
+// DNSServer provides an authoritative DNS server, embedded in the Cloud::1 server
+// or host agent, that can be used in place of the os hosts file.
+// Hosts added to the server are answered with the IP they were added for,
+// every other name under the local domains is answered with the IP of the
+// Cloud::1 server and zones such as Cloud DNS private zones are served in full.
+// Queries for any other name are forwarded to the upstream name servers.
+type DNSServer struct {
+	mu                 sync.RWMutex
+	serverIP           net.IP
+	aliases            []string
+	upstreams          []string
+	hosts              map[string][]net.IP
+	zones              map[string]map[string][]dns.RR
+	resolvedConfigPath string
+	udpServer          *dns.Server
+	tcpServer          *dns.Server
+	udpClient          *dns.Client
+	tcpClient          *dns.Client
+	logger             *logrus.Entry
+}
+
+// NewDNSServer creates a DNS server that listens on the configured address over
+// UDP and TCP, the server is serving queries by the time it is returned.
+func NewDNSServer(cfg *config.Config, logger *logrus.Entry) (*DNSServer, error) {
+	serverIP, err := netutils.SelectServerIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// As with the hosts manager, the static IP of the Cloud::1 container
+	// needs to be reachable from the host for the answers to be of any use.
+	aliases, err := createServerIPAliases(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upstreams, err := dnsUpstreams(*cfg.DNSUpstreams)
+	if err != nil {
+		removeServerIPAliases(aliases)
+		return nil, err
+	}
+	s := &DNSServer{
+		serverIP:  net.ParseIP(serverIP),
+		aliases:   aliases,
+		upstreams: upstreams,
+		hosts:     map[string][]net.IP{},
+		zones:     map[string]map[string][]dns.RR{},
+		udpClient: &dns.Client{Net: "udp"},
+		tcpClient: &dns.Client{Net: "tcp"},
+		logger:    logger,
+	}
+	if *cfg.DNSConfigureResolved {
+		s.resolvedConfigPath = ResolvedConfigPath
+	}
+	err = s.listen(*cfg.DNSServerAddr)
+	if err != nil {
+		removeServerIPAliases(aliases)
+		return nil, err
+	}
+	err = s.configureResolved()
+	if err != nil {
+		s.Shutdown()
+		return nil, err
+	}
+	return s, nil
+}
+
+// listen binds to the address over UDP and then TCP on the same port,
+// so a port of 0 can be used to pick a free port.
+func (s *DNSServer) listen(addr string) error {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+	s.udpServer = &dns.Server{PacketConn: packetConn, Handler: s}
+	s.tcpServer = &dns.Server{Listener: listener, Handler: s}
+	for _, server := range []*dns.Server{s.udpServer, s.tcpServer} {
+		go func(server *dns.Server) {
+			err := server.ActivateAndServe()
+			if err != nil {
+				s.logger.Error(err)
+			}
+		}(server)
+	}
+	return nil
+}
+
+// Addr provides the address the DNS server is listening on.
+func (s *DNSServer) Addr() string {
+	return s.udpServer.PacketConn.LocalAddr().String()
+}
+
+// Start does nothing as the DNS server starts serving when it is created,
+// so the hosts of other services resolve as soon as they are added.
+func (s *DNSServer) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop deals with shutting down the DNS server, the hosts it answers
+// queries for are only held in memory so they go with it.
+func (s *DNSServer) Stop(ctx context.Context) error {
+	return s.Shutdown()
+}
+
+// Shutdown deals with stopping the DNS server and removing
+// the loopback aliases created by the server.
+func (s *DNSServer) Shutdown() error {
+	udpErr := s.udpServer.Shutdown()
+	tcpErr := s.tcpServer.Shutdown()
+	aliasErr := removeServerIPAliases(s.aliases)
+	s.aliases = nil
+	if udpErr != nil {
+		return udpErr
+	}
+	if tcpErr != nil {
+		return tcpErr
+	}
+	return aliasErr
+}
+
+// Add deals with answering queries for one or more hosts with one IP, or an IPv4 and
+// an IPv6 address. As with the hosts manager, a host can have one IPv4 and one IPv6
+// address so adding a host replaces any address it already has of the same type.
+func (s *DNSServer) Add(params *Params) error {
+	return s.Apply(nil, []*Params{params})
+}
+
+// Remove deals with no longer answering queries for one or more hosts
+// with one IP, or an IPv4 and an IPv6 address.
+func (s *DNSServer) Remove(params *Params) error {
+	return s.Apply([]*Params{params}, nil)
+}
+
+// Apply deals with removing and adding hosts at once, queries are
+// never answered with only some of the changes applied.
+func (s *DNSServer) Apply(removals []*Params, additions []*Params) error {
+	removalIPs, err := paramsIPs(removals)
+	if err != nil {
+		return err
+	}
+	additionIPs, err := paramsIPs(additions)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, params := range removals {
+		s.removeHostsLocked(removalIPs[i], strings.Split(*params.Hosts, ","))
+	}
+	for i, params := range additions {
+		s.addHostsLocked(additionIPs[i], strings.Split(*params.Hosts, ","))
+	}
+	return nil
+}
+
+// List the hosts that have been added to the DNS server.
+func (s *DNSServer) List() ([]*HostMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hostIPs := map[string][]string{}
+	for name, ips := range s.hosts {
+		host := strings.TrimSuffix(name, ".")
+		for _, ip := range ips {
+			hostIPs[host] = append(hostIPs[host], ip.String())
+		}
+	}
+	return hostMappings(hostIPs), nil
+}
+
+func (s *DNSServer) addHostsLocked(ips []string, hosts []string) {
+	for _, host := range hosts {
+		name := dns.Fqdn(strings.ToLower(strings.TrimSpace(host)))
+		hostIPs := []net.IP{}
+		for _, ip := range ips {
+			hostIPs = append(hostIPs, net.ParseIP(ip))
+		}
+		for _, existing := range s.hosts[name] {
+			if !hasIPOfSameType(hostIPs, existing) {
+				hostIPs = append(hostIPs, existing)
+			}
+		}
+		s.hosts[name] = hostIPs
+	}
+}
+
+func (s *DNSServer) removeHostsLocked(ips []string, hosts []string) {
+	for _, host := range hosts {
+		name := dns.Fqdn(strings.ToLower(strings.TrimSpace(host)))
+		hostIPs := []net.IP{}
+		for _, existing := range s.hosts[name] {
+			removed := false
+			for _, ip := range ips {
+				removed = removed || existing.Equal(net.ParseIP(ip))
+			}
+			if !removed {
+				hostIPs = append(hostIPs, existing)
+			}
+		}
+		if len(hostIPs) == 0 {
+			delete(s.hosts, name)
+		} else {
+			s.hosts[name] = hostIPs
+		}
+	}
+}
+
+// SetZone deals with serving the records of a zone, replacing any records
+// that were previously served for it. Records that can't be parsed are skipped
+// so a single unsupported record doesn't prevent the rest of the zone being served.
+func (s *DNSServer) SetZone(name string, records []*Record) error {
+	zone := dns.Fqdn(strings.ToLower(name))
+	owners := map[string][]dns.RR{}
+	for _, record := range records {
+		for _, data := range record.Data {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, record.Type, data))
+			if err != nil || rr == nil {
+				s.logger.Warnf("Skipping %s record for %s in zone %s: %v", record.Type, record.Name, zone, err)
+				continue
+			}
+			owner := strings.ToLower(rr.Header().Name)
+			rr.Header().Name = owner
+			owners[owner] = append(owners[owner], rr)
+		}
+	}
+	s.mu.Lock()
+	_, existed := s.zones[zone]
+	s.zones[zone] = owners
+	s.mu.Unlock()
+	if existed {
+		return nil
+	}
+	return s.configureResolved()
+}
+
+// RemoveZone deals with no longer serving the records of a zone.
+func (s *DNSServer) RemoveZone(name string) error {
+	zone := dns.Fqdn(strings.ToLower(name))
+	s.mu.Lock()
+	_, existed := s.zones[zone]
+	delete(s.zones, zone)
+	s.mu.Unlock()
+	if !existed {
+		return nil
+	}
+	return s.configureResolved()
+}
+
+// ServeDNS deals with answering a query, queries that can't be
+// answered locally are forwarded to the upstream name servers.
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		msg := &dns.Msg{}
+		msg.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(msg)
+		return
+	}
+	network := w.RemoteAddr().Network()
+	s.mu.RLock()
+	msg, answered := s.answerLocked(req)
+	s.mu.RUnlock()
+	if !answered {
+		msg = s.forward(req, network)
+	} else if network == "udp" {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		msg.Truncate(size)
+	}
+	err := w.WriteMsg(msg)
+	if err != nil {
+		s.logger.Debug(err)
+	}
+}
+
+// answerLocked answers a query from the hosts that have been added, then the
+// zones being served and then the local domains in that order.
+func (s *DNSServer) answerLocked(req *dns.Msg) (*dns.Msg, bool) {
+	question := req.Question[0]
+	name := strings.ToLower(question.Name)
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	msg.Authoritative = true
+	msg.RecursionAvailable = len(s.upstreams) > 0
+
+	if ips, ok := s.hosts[name]; ok {
+		msg.Answer = addressRecords(question.Name, ips, question.Qtype)
+		return msg, true
+	}
+	if zone := s.zoneForLocked(name); zone != "" {
+		answer, exists := s.zoneAnswerLocked(zone, name, question.Qtype, 0)
+		msg.Answer = answer
+		if len(answer) == 0 {
+			if !exists {
+				msg.Rcode = dns.RcodeNameError
+			}
+			for _, rr := range s.zones[zone][zone] {
+				if rr.Header().Rrtype == dns.TypeSOA {
+					msg.Ns = append(msg.Ns, dns.Copy(rr))
+				}
+			}
+		}
+		return msg, true
+	}
+	for _, domain := range LocalDomains {
+		if strings.HasSuffix(name, "."+domain) {
+			msg.Answer = addressRecords(question.Name, []net.IP{s.serverIP}, question.Qtype)
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+// zoneForLocked finds the most specific zone being served that a name belongs to.
+func (s *DNSServer) zoneForLocked(name string) string {
+	match := ""
+	for zone := range s.zones {
+		if (name == zone || strings.HasSuffix(name, "."+zone)) && len(zone) > len(match) {
+			match = zone
+		}
+	}
+	return match
+}
+
+// zoneAnswerLocked finds the records in a zone that answer a query for a name and type,
+// CNAME records are followed when their target is served by Cloud::1.
+// The returned boolean reports whether the name exists in the zone at all.
+func (s *DNSServer) zoneAnswerLocked(zone string, name string, qtype uint16, depth int) ([]dns.RR, bool) {
+	rrs, exists := s.zones[zone][name]
+	if !exists {
+		rrs, exists = s.wildcardLocked(zone, name)
+	}
+	if !exists {
+		return nil, false
+	}
+	answer := []dns.RR{}
+	cnames := []dns.RR{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			answer = append(answer, copyWithName(rr, name))
+		} else if rr.Header().Rrtype == dns.TypeCNAME {
+			cnames = append(cnames, copyWithName(rr, name))
+		}
+	}
+	if len(answer) > 0 || len(cnames) == 0 || depth >= maxCNAMEDepth {
+		return answer, true
+	}
+	answer = cnames
+	target := strings.ToLower(cnames[0].(*dns.CNAME).Target)
+	if ips, ok := s.hosts[target]; ok {
+		return append(answer, addressRecords(target, ips, qtype)...), true
+	}
+	if targetZone := s.zoneForLocked(target); targetZone != "" {
+		targetAnswer, _ := s.zoneAnswerLocked(targetZone, target, qtype, depth+1)
+		answer = append(answer, targetAnswer...)
+	}
+	return answer, true
+}
+
+// wildcardLocked finds the records of the closest wildcard name
+// in a zone that covers the provided name.
+func (s *DNSServer) wildcardLocked(zone string, name string) ([]dns.RR, bool) {
+	parent := name
+	for parent != zone {
+		labelEnd := strings.Index(parent, ".")
+		if labelEnd < 0 || labelEnd == len(parent)-1 {
+			return nil, false
+		}
+		parent = parent[labelEnd+1:]
+		if rrs, ok := s.zones[zone]["*."+parent]; ok {
+			return rrs, true
+		}
+	}
+	return nil, false
+}
+
+// forward deals with sending a query to the upstream name servers
+// over the same network it was received on.
+func (s *DNSServer) forward(req *dns.Msg, network string) *dns.Msg {
+	client := s.udpClient
+	if network == "tcp" {
+		client = s.tcpClient
+	}
+	for _, upstream := range s.upstreams {
+		response, _, err := client.Exchange(req, upstream)
+		if err == nil {
+			return response
+		}
+		s.logger.Debugf("Failed to forward query to %s: %v", upstream, err)
+	}
+	msg := &dns.Msg{}
+	msg.SetRcode(req, dns.RcodeServerFailure)
+	return msg
+}
+
+// configureResolved deals with routing queries for the local domains and the zones
+// being served to the DNS server through systemd-resolved when it's enabled.
+func (s *DNSServer) configureResolved() error {
+	if s.resolvedConfigPath == "" {
+		return nil
+	}
+	s.mu.RLock()
+	domains := append([]string{}, LocalDomains...)
+	for zone := range s.zones {
+		domains = append(domains, zone)
+	}
+	s.mu.RUnlock()
+	sort.Strings(domains)
+	return ConfigureSystemdResolved(s.resolvedConfigPath, s.Addr(), domains)
+}
+
+func addressRecords(name string, ips []net.IP, qtype uint16) []dns.RR {
+	records := []dns.RR{}
+	for _, ip := range ips {
+		header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: hostTTL}
+		if ipv4 := ip.To4(); ipv4 != nil && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+			header.Rrtype = dns.TypeA
+			records = append(records, &dns.A{Hdr: header, A: ipv4})
+		} else if ipv4 == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+			header.Rrtype = dns.TypeAAAA
+			records = append(records, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return records
+}
+
+func hasIPOfSameType(ips []net.IP, ip net.IP) bool {
+	for _, existing := range ips {
+		if (existing.To4() == nil) == (ip.To4() == nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyWithName(rr dns.RR, name string) dns.RR {
+	copied := dns.Copy(rr)
+	copied.Header().Name = name
+	return copied
+}
+
+// dnsUpstreams parses a comma separated list of upstream name servers,
+// the name servers in resolv.conf are used when none are provided.
+func dnsUpstreams(value string) ([]string, error) {
+	upstreams := []string{}
+	if strings.TrimSpace(value) == "" {
+		clientConfig, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			// Without a resolv.conf there is nowhere to forward queries to,
+			// the server will still answer for emulator hosts.
+			return upstreams, nil
+		}
+		for _, server := range clientConfig.Servers {
+			upstreams = append(upstreams, net.JoinHostPort(server, clientConfig.Port))
+		}
+		return upstreams, nil
+	}
+	for _, upstream := range strings.Split(value, ",") {
+		upstream = strings.TrimSpace(upstream)
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		host, _, _ := net.SplitHostPort(upstream)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%q is an invalid DNS upstream, an IP address is required", upstream)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	. "gopkg.in/check.v1"
+)
+
+type DNSServerSuite struct {
+	server   *DNSServer
+	upstream *dns.Server
+}
+
+var _ = Suite(&DNSServerSuite{})
+
+func (s *DNSServerSuite) SetUpTest(c *C) {
+	// A fake upstream that answers every A query with the same address
+	// so forwarded queries can be told apart from local answers.
+	upstreamConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.upstream = &dns.Server{
+		PacketConn: upstreamConn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			msg := &dns.Msg{}
+			msg.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 203.0.113.10")
+			msg.Answer = []dns.RR{rr}
+			w.WriteMsg(msg)
+		}),
+	}
+	started := make(chan struct{})
+	s.upstream.NotifyStartedFunc = func() { close(started) }
+	go s.upstream.ActivateAndServe()
+	<-started
+
+	runOnHost := true
+	serverIP := "127.0.0.2"
+	addr := "127.0.0.1:0"
+	upstreams := upstreamConn.LocalAddr().String()
+	configureResolved := false
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	server, err := NewDNSServer(&config.Config{
+		RunOnHost:            &runOnHost,
+		ServerIP:             &serverIP,
+		DNSServerAddr:        &addr,
+		DNSUpstreams:         &upstreams,
+		DNSConfigureResolved: &configureResolved,
+	}, logrus.NewEntry(logger))
+	c.Assert(err, IsNil)
+	s.server = server
+}
+
+func (s *DNSServerSuite) TearDownTest(c *C) {
+	s.server.Shutdown()
+	s.upstream.Shutdown()
+}
+
+func (s *DNSServerSuite) query(c *C, network string, name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	client := &dns.Client{Net: network}
+	response, _, err := client.Exchange(req, s.server.Addr())
+	c.Assert(err, IsNil)
+	return response
+}
+
+func answerData(msg *dns.Msg) []string {
+	data := []string{}
+	for _, rr := range msg.Answer {
+		data = append(data, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return data
+}
+
+func (s *DNSServerSuite) Test_answers_added_hosts_over_udp_and_tcp(c *C) {
+	ip := "10.0.0.5"
+	ipv6 := "fd00::5"
+	hosts := "api.example.com,web.example.com"
+	c.Assert(s.server.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	c.Assert(s.server.Add(&Params{IP: &ipv6, Hosts: &hosts}), IsNil)
+
+	for _, network := range []string{"udp", "tcp"} {
+		response := s.query(c, network, "API.example.com", dns.TypeA)
+		c.Assert(response.Authoritative, Equals, true)
+		c.Assert(answerData(response), DeepEquals, []string{"10.0.0.5"})
+	}
+	c.Assert(answerData(s.query(c, "udp", "web.example.com", dns.TypeAAAA)), DeepEquals, []string{"fd00::5"})
+
+	c.Assert(s.server.Remove(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	response := s.query(c, "udp", "api.example.com", dns.TypeA)
+	c.Assert(response.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(response.Answer, HasLen, 0)
+	c.Assert(answerData(s.query(c, "udp", "api.example.com", dns.TypeAAAA)), DeepEquals, []string{"fd00::5"})
+
+	c.Assert(s.server.Remove(&Params{IP: &ipv6, Hosts: &hosts}), IsNil)
+	c.Assert(answerData(s.query(c, "udp", "api.example.com", dns.TypeA)), DeepEquals, []string{"203.0.113.10"})
+}
+
+func (s *DNSServerSuite) Test_answers_hosts_added_with_ipv4_and_ipv6_address_pair(c *C) {
+	ips := "10.0.0.5,fd00::5"
+	hosts := "api.example.com"
+	c.Assert(s.server.Add(&Params{IP: &ips, Hosts: &hosts}), IsNil)
+	c.Assert(answerData(s.query(c, "udp", "api.example.com", dns.TypeA)), DeepEquals, []string{"10.0.0.5"})
+	c.Assert(answerData(s.query(c, "udp", "api.example.com", dns.TypeAAAA)), DeepEquals, []string{"fd00::5"})
+
+	ip := "10.0.0.6"
+	c.Assert(s.server.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	c.Assert(answerData(s.query(c, "udp", "api.example.com", dns.TypeA)), DeepEquals, []string{"10.0.0.6"})
+	c.Assert(answerData(s.query(c, "udp", "api.example.com", dns.TypeAAAA)), DeepEquals, []string{"fd00::5"})
+
+	invalid := "10.0.0.5,10.0.0.6"
+	c.Assert(s.server.Add(&Params{IP: &invalid, Hosts: &hosts}), NotNil)
+
+	mappings, err := s.server.List()
+	c.Assert(err, IsNil)
+	c.Assert(mappings, DeepEquals, []*HostMapping{{Host: "api.example.com", IPs: []string{"10.0.0.6", "fd00::5"}}})
+}
+
+func (s *DNSServerSuite) Test_answers_local_domains_with_server_ip(c *C) {
+	for _, name := range []string{"secretmanager.googleapis.local", "console.clouduno.local", "a.b.clouduno.local"} {
+		response := s.query(c, "udp", name, dns.TypeA)
+		c.Assert(answerData(response), DeepEquals, []string{"127.0.0.2"}, Commentf(name))
+	}
+	response := s.query(c, "udp", "pubsub.googleapis.local", dns.TypeAAAA)
+	c.Assert(response.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(response.Answer, HasLen, 0)
+}
+
+func (s *DNSServerSuite) Test_serves_zones(c *C) {
+	err := s.server.SetZone("internal.example.com.", []*Record{
+		{Name: "internal.example.com.", Type: "SOA", TTL: 21600, Data: []string{
+			"ns-gcp-private.googledomains.com. cloud-dns-hostmaster.google.com. 1 21600 3600 259200 300",
+		}},
+		{Name: "api.internal.example.com.", Type: "A", TTL: 300, Data: []string{"10.0.0.5", "10.0.0.6"}},
+		{Name: "api.internal.example.com.", Type: "TXT", TTL: 300, Data: []string{"\"version=2\""}},
+		{Name: "www.internal.example.com.", Type: "CNAME", TTL: 300, Data: []string{"api.internal.example.com."}},
+		{Name: "*.apps.internal.example.com.", Type: "AAAA", TTL: 300, Data: []string{"fd00::7"}},
+		{Name: "_grpc._tcp.internal.example.com.", Type: "SRV", TTL: 300, Data: []string{"10 5 8443 api.internal.example.com."}},
+		{Name: "bad.internal.example.com.", Type: "A", TTL: 300, Data: []string{"not-an-ip"}},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(answerData(s.query(c, "udp", "api.internal.example.com", dns.TypeA)), DeepEquals, []string{"10.0.0.5", "10.0.0.6"})
+	c.Assert(answerData(s.query(c, "tcp", "api.internal.example.com", dns.TypeTXT)), DeepEquals, []string{"\"version=2\""})
+	c.Assert(
+		answerData(s.query(c, "udp", "www.internal.example.com", dns.TypeA)),
+		DeepEquals,
+		[]string{"api.internal.example.com.", "10.0.0.5", "10.0.0.6"},
+	)
+	c.Assert(answerData(s.query(c, "udp", "web.apps.internal.example.com", dns.TypeAAAA)), DeepEquals, []string{"fd00::7"})
+	c.Assert(
+		answerData(s.query(c, "udp", "_grpc._tcp.internal.example.com", dns.TypeSRV)),
+		DeepEquals,
+		[]string{"10 5 8443 api.internal.example.com."},
+	)
+
+	missing := s.query(c, "udp", "missing.internal.example.com", dns.TypeA)
+	c.Assert(missing.Rcode, Equals, dns.RcodeNameError)
+	c.Assert(missing.Ns, HasLen, 1)
+	noData := s.query(c, "udp", "api.internal.example.com", dns.TypeAAAA)
+	c.Assert(noData.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(noData.Answer, HasLen, 0)
+	c.Assert(s.query(c, "udp", "bad.internal.example.com", dns.TypeA).Rcode, Equals, dns.RcodeNameError)
+
+	c.Assert(s.server.RemoveZone("internal.example.com."), IsNil)
+	c.Assert(answerData(s.query(c, "udp", "api.internal.example.com", dns.TypeA)), DeepEquals, []string{"203.0.113.10"})
+}
+
+func (s *DNSServerSuite) Test_renders_resolved_config(c *C) {
+	config, err := ResolvedConfig("0.0.0.0:5353", []string{"clouduno.local.", "googleapis.local.", "internal.example.com."})
+	c.Assert(err, IsNil)
+	c.Assert(config, Equals, "# Added by Cloud::1\n"+
+		"[Resolve]\n"+
+		"DNS=127.0.0.1:5353\n"+
+		"Domains=~clouduno.local ~googleapis.local ~internal.example.com\n")
+}
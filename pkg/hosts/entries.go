@@ -67,6 +67,10 @@ func (e *Entry) Export() string {
 	if e.IsComment() { //Whole line is comment
 		return e.Raw
 	}
+	if e.IP == "" && len(e.Hosts) == 0 && e.Comment == "" {
+		// Keep blank lines as they are.
+		return strings.TrimSpace(e.Raw)
+	}
 
 	if e.Comment != "" {
 		comment = fmt.Sprintf(" %s%s", commentChar, e.Comment)
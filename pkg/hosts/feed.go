@@ -0,0 +1,199 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// HostChangeType provides the kind of change made to a host.
+type HostChangeType int
+
+const (
+	// HostAdded is used when a host that had no IPs has been added.
+	HostAdded HostChangeType = iota + 1
+	// HostUpdated is used when the IPs for a host have changed.
+	HostUpdated
+	// HostRemoved is used when a host no longer has any IPs.
+	HostRemoved
+)
+
+// HostChange provides a change made to a host, for removed hosts
+// the mapping holds the IPs the host had before it was removed.
+type HostChange struct {
+	Type    HostChangeType
+	Mapping *HostMapping
+}
+
+var (
+	// ErrRestoreNotSupported is returned when restoring the hosts
+	// file is not supported by the hosts service in use.
+	ErrRestoreNotSupported = errors.New("the hosts service does not support restoring backups")
+	// ErrPlanNotSupported is returned when planning changes to the
+	// hosts file is not supported by the hosts service in use.
+	ErrPlanNotSupported = errors.New("the hosts service does not support planning changes")
+)
+
+// watchBuffer is the number of changes that can be waiting to be
+// sent to a watcher before it is considered too slow and dropped.
+const watchBuffer = 100
+
+// ChangeFeed provides a hosts service that wraps the hosts service the host agent
+// uses and tells watchers about the hosts added, updated and removed through it.
+type ChangeFeed struct {
+	impl     ListService
+	mu       sync.Mutex
+	last     map[string]*HostMapping
+	watchers map[chan *HostChange]struct{}
+}
+
+// NewChangeFeed creates a new change feed for the provided hosts service.
+func NewChangeFeed(impl ListService) (*ChangeFeed, error) {
+	mappings, err := impl.List()
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeFeed{
+		impl:     impl,
+		last:     mappingsByHost(mappings),
+		watchers: map[chan *HostChange]struct{}{},
+	}, nil
+}
+
+// Add deals with adding hosts and telling watchers about the changes.
+func (f *ChangeFeed) Add(params *Params) error {
+	return f.Apply(nil, []*Params{params})
+}
+
+// Remove deals with removing hosts and telling watchers about the changes.
+func (f *ChangeFeed) Remove(params *Params) error {
+	return f.Apply([]*Params{params}, nil)
+}
+
+// Apply deals with removing and adding hosts at once when the wrapped
+// hosts service supports it and telling watchers about the changes.
+func (f *ChangeFeed) Apply(removals []*Params, additions []*Params) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := applyChanges(f.impl, removals, additions)
+	f.publishLocked()
+	return err
+}
+
+// Restore deals with restoring the hosts file from a backup
+// and telling watchers about the changes.
+func (f *ChangeFeed) Restore(backup string) error {
+	backupService, ok := f.impl.(BackupService)
+	if !ok {
+		return ErrRestoreNotSupported
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := backupService.Restore(backup)
+	f.publishLocked()
+	return err
+}
+
+// Plan the changes to the hosts file with the wrapped hosts service,
+// nothing is changed so there is nothing to tell watchers about.
+func (f *ChangeFeed) Plan(removals []*Params, additions []*Params) (string, error) {
+	planService, ok := f.impl.(PlanService)
+	if !ok {
+		return "", ErrPlanNotSupported
+	}
+	return planService.Plan(removals, additions)
+}
+
+// List the hosts managed by the wrapped hosts service.
+func (f *ChangeFeed) List() ([]*HostMapping, error) {
+	return f.impl.List()
+}
+
+// Watch provides the current hosts along with a channel the changes made after
+// them are sent to, the channel is closed when the watcher falls too far behind.
+// The returned function must be called once the watcher is done.
+func (f *ChangeFeed) Watch() ([]*HostMapping, <-chan *HostChange, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changes := make(chan *HostChange, watchBuffer)
+	f.watchers[changes] = struct{}{}
+	mappings := []*HostMapping{}
+	for _, host := range sortedMappingHosts(f.last) {
+		mappings = append(mappings, f.last[host])
+	}
+	stop := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.watchers[changes]; ok {
+			delete(f.watchers, changes)
+			close(changes)
+		}
+	}
+	return mappings, changes, stop
+}
+
+// publishLocked works out what has changed since the hosts were last listed
+// and sends the changes to every watcher.
+func (f *ChangeFeed) publishLocked() {
+	mappings, err := f.impl.List()
+	if err != nil {
+		// The changes will be picked up the next time
+		// the hosts can be listed.
+		return
+	}
+	current := mappingsByHost(mappings)
+	changes := []*HostChange{}
+	for _, host := range sortedMappingHosts(current) {
+		previous, existed := f.last[host]
+		if !existed {
+			changes = append(changes, &HostChange{Type: HostAdded, Mapping: current[host]})
+		} else if !equalLines(previous.IPs, current[host].IPs) {
+			changes = append(changes, &HostChange{Type: HostUpdated, Mapping: current[host]})
+		}
+	}
+	for _, host := range sortedMappingHosts(f.last) {
+		if _, exists := current[host]; !exists {
+			changes = append(changes, &HostChange{Type: HostRemoved, Mapping: f.last[host]})
+		}
+	}
+	f.last = current
+
+	for watcher := range f.watchers {
+		for _, change := range changes {
+			select {
+			case watcher <- change:
+			default:
+				delete(f.watchers, watcher)
+				close(watcher)
+			}
+			if _, ok := f.watchers[watcher]; !ok {
+				break
+			}
+		}
+	}
+}
+
+func mappingsByHost(mappings []*HostMapping) map[string]*HostMapping {
+	byHost := map[string]*HostMapping{}
+	for _, mapping := range mappings {
+		byHost[mapping.Host] = mapping
+	}
+	return byHost
+}
+
+func sortedMappingHosts(byHost map[string]*HostMapping) []string {
+	hosts := []string{}
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+type ChangeFeedSuite struct {
+	service *recordingService
+	feed    *ChangeFeed
+}
+
+var _ = Suite(&ChangeFeedSuite{})
+
+func (s *ChangeFeedSuite) SetUpTest(c *C) {
+	s.service = &recordingService{ipHosts: map[string]map[string]bool{}}
+	ip := "172.18.0.22"
+	hosts := "storage.googleapis.local"
+	c.Assert(s.service.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	feed, err := NewChangeFeed(s.service)
+	c.Assert(err, IsNil)
+	s.feed = feed
+}
+
+func (s *ChangeFeedSuite) Test_sends_current_hosts_and_changes_to_watchers(c *C) {
+	mappings, changes, stop := s.feed.Watch()
+	defer stop()
+	c.Assert(mappings, DeepEquals, []*HostMapping{
+		{Host: "storage.googleapis.local", IPs: []string{"172.18.0.22"}},
+	})
+
+	ips := "172.18.0.23,fd00::23"
+	hosts := "pubsub.googleapis.local"
+	c.Assert(s.feed.Add(&Params{IP: &ips, Hosts: &hosts}), IsNil)
+	ipv6 := "fd00::22"
+	storage := "storage.googleapis.local"
+	c.Assert(s.feed.Add(&Params{IP: &ipv6, Hosts: &storage}), IsNil)
+	ip := "172.18.0.23"
+	c.Assert(s.feed.Remove(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	ipv6 = "fd00::23"
+	c.Assert(s.feed.Remove(&Params{IP: &ipv6, Hosts: &hosts}), IsNil)
+
+	c.Assert(<-changes, DeepEquals, &HostChange{
+		Type:    HostAdded,
+		Mapping: &HostMapping{Host: "pubsub.googleapis.local", IPs: []string{"172.18.0.23", "fd00::23"}},
+	})
+	c.Assert(<-changes, DeepEquals, &HostChange{
+		Type:    HostUpdated,
+		Mapping: &HostMapping{Host: "storage.googleapis.local", IPs: []string{"172.18.0.22", "fd00::22"}},
+	})
+	c.Assert(<-changes, DeepEquals, &HostChange{
+		Type:    HostUpdated,
+		Mapping: &HostMapping{Host: "pubsub.googleapis.local", IPs: []string{"fd00::23"}},
+	})
+	c.Assert(<-changes, DeepEquals, &HostChange{
+		Type:    HostRemoved,
+		Mapping: &HostMapping{Host: "pubsub.googleapis.local", IPs: []string{"fd00::23"}},
+	})
+	c.Assert(changes, HasLen, 0)
+}
+
+func (s *ChangeFeedSuite) Test_drops_watchers_that_fall_behind(c *C) {
+	_, changes, stop := s.feed.Watch()
+	defer stop()
+	for i := 0; i <= watchBuffer; i = i + 1 {
+		ip := "172.18.0.22"
+		hosts := fmt.Sprintf("host-%d.googleapis.local", i)
+		c.Assert(s.feed.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	}
+	received := 0
+	for range changes {
+		received = received + 1
+	}
+	c.Assert(received, Equals, watchBuffer)
+}
+
+func (s *ChangeFeedSuite) Test_restore_fails_when_hosts_service_has_no_backups(c *C) {
+	c.Assert(s.feed.Restore(""), Equals, ErrRestoreNotSupported)
+}
@@ -11,10 +11,19 @@ package hosts
 import (
 	context "context"
 	"errors"
+	"io"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var (
@@ -24,87 +33,264 @@ var (
 )
 
 // NewGRPCClient creates a client to connect to the hosts
-// agent over gRPC.
-func NewGRPCClient(hostAgentAddr string) (Service, error) {
+// agent over gRPC, using the same host agent address, auth
+// and credentials directory as the host agent is configured with.
+func NewGRPCClient(cfg *config.Config, logger *logrus.Entry) (*GRPCClient, error) {
+	// We'll block at this point as at times the host agent won't be available
+	// at start up and without blocking the RPC requests will error out.
+	conn, err := DialHostAgent(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newGRPCClient(NewManagerClient(conn), logger)
+	go client.keepAlive()
+	return client, nil
+}
+
+func newGRPCClient(mgrClient ManagerClient, logger *logrus.Entry) *GRPCClient {
+	return &GRPCClient{
+		client:   mgrClient,
+		owner:    uuid.New().String(),
+		leaseTTL: DefaultLeaseTTL,
+		hosts:    ownedHosts{},
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+}
+
+// DialHostAgent connects to the host agent, using the same host agent address,
+// auth and credentials directory as the host agent is configured with.
+// This blocks until the host agent is available or the context is done.
+func DialHostAgent(ctx context.Context, cfg *config.Config) (*grpc.ClientConn, error) {
+	target, opts, err := dialOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
 	// Add some retry behaviour as hosts agent is not guaranteed
 	// to be running as the server starts up.
-
-	conn, err := grpc.Dial(
-		hostAgentAddr,
-		// This is designed for a developer's local machine, so insecure gRPC
-		// is acceptable as long as this software is not used on a public network!
-		grpc.WithInsecure(),
+	opts = append(
+		opts,
 		grpc.WithConnectParams(
 			grpc.ConnectParams{
 				MinConnectTimeout: GRPCMinConnectTimeout,
 				Backoff:           backoff.DefaultConfig,
 			},
 		),
-		// We'll block at this point as at times the host agent won't be available
-		// at start up and without blocking the RPC requests will error out.
 		grpc.WithBlock(),
 	)
-	if err != nil {
-		return nil, err
-	}
-
-	mgrClient := NewManagerClient(conn)
-	return &GRPCClient{
-		client: mgrClient,
-	}, nil
+	return grpc.DialContext(ctx, target, opts...)
 }
 
 // GRPCClient is an implementation of a client that the server uses
-// to communicate with the hosts agent.
+// to communicate with the hosts agent. Hosts are added with a lease that
+// the client keeps renewing, so the host agent removes them if the server dies.
 type GRPCClient struct {
-	client ManagerClient
+	client   ManagerClient
+	owner    string
+	leaseTTL time.Duration
+	mu       sync.Mutex
+	hosts    ownedHosts
+	logger   *logrus.Entry
+	done     chan struct{}
 }
 
-var (
-	// ErrFailedToAddHosts is returned when the hosts agent failed to
-	// to add hosts due to an error that has been handled on the hosts agent
-	// side.
-	ErrFailedToAddHosts = errors.New("failed to add the provided hosts to the given IP")
-	// ErrFailedToRemoveHosts is returned when the hosts agent failed to
-	// to remove hosts from an IP due to an error that has been handled on the hosts agent
-	// side.
-	ErrFailedToRemoveHosts = errors.New("failed to remove the provided hosts from the given IP")
-)
-
 // Add deals with making a request to a gRPC server
 // to add a list of hosts to a given IP for local
 // DNS emulation.
-func (m *GRPCClient) Add(params *Params) (err error) {
-	response, err := m.client.Add(context.Background(), &HostsRequest{
-		Ip:    *params.IP,
-		Hosts: *params.Hosts,
-	})
+func (m *GRPCClient) Add(params *Params) error {
+	ips, err := splitIPs(*params.IP)
 	if err != nil {
-		return
+		return err
 	}
-	if !response.GetApplied() {
-		return ErrFailedToAddHosts
+	hosts := strings.Split(*params.Hosts, ",")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.client.Add(context.Background(), m.hostsRequest(ips, hosts))
+	if err != nil {
+		return err
 	}
+	m.hosts.add(ips, hosts)
 	return nil
 }
 
 // Remove deals with making a request to a gRPC server
 // to remove a list of hosts from a given IP for
 // local DNS emulation.
-func (m *GRPCClient) Remove(params *Params) (err error) {
-	response, err := m.client.Remove(context.Background(), &HostsRequest{
-		Ip:    *params.IP,
-		Hosts: *params.Hosts,
+func (m *GRPCClient) Remove(params *Params) error {
+	ips, err := splitIPs(*params.IP)
+	if err != nil {
+		return err
+	}
+	hosts := strings.Split(*params.Hosts, ",")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.client.Remove(context.Background(), m.hostsRequest(ips, hosts))
+	if err != nil {
+		return err
+	}
+	m.hosts.remove(ips, hosts)
+	return nil
+}
+
+// Restore deals with making a request to a gRPC server
+// to restore the hosts file from a backup.
+func (m *GRPCClient) Restore(backup string) error {
+	_, err := m.client.Restore(context.Background(), &RestoreRequest{
+		Backup: backup,
 	})
+	return err
+}
+
+// List deals with making a request to a gRPC server to list
+// the hosts managed by the host agent for every client.
+func (m *GRPCClient) List() ([]*HostMapping, error) {
+	response, err := m.client.List(context.Background(), &ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	mappings := []*HostMapping{}
+	for _, entry := range response.GetEntries() {
+		mappings = append(mappings, &HostMapping{
+			Host: entry.GetHost(),
+			IPs:  entry.GetIps(),
+		})
+	}
+	return mappings, nil
+}
+
+// Plan deals with making a request to a gRPC server to show the
+// changes removing and then adding hosts would make to the hosts file.
+func (m *GRPCClient) Plan(removals []*Params, additions []*Params) (string, error) {
+	req := &PlanRequest{}
+	for _, params := range removals {
+		ips, err := splitIPs(*params.IP)
+		if err != nil {
+			return "", err
+		}
+		req.Removals = append(req.Removals, &HostsRequest{Ips: ips, Hosts: strings.Split(*params.Hosts, ",")})
+	}
+	for _, params := range additions {
+		ips, err := splitIPs(*params.IP)
+		if err != nil {
+			return "", err
+		}
+		req.Additions = append(req.Additions, &HostsRequest{Ips: ips, Hosts: strings.Split(*params.Hosts, ",")})
+	}
+	response, err := m.client.Plan(context.Background(), req)
 	if err != nil {
-		return
+		return "", err
 	}
-	if !response.GetApplied() {
-		return ErrFailedToRemoveHosts
+	return response.GetDiff(), nil
+}
+
+func (m *GRPCClient) hostsRequest(ips []string, hosts []string) *HostsRequest {
+	return &HostsRequest{
+		Ips:          ips,
+		Hosts:        hosts,
+		Owner:        m.owner,
+		LeaseSeconds: int64(m.leaseTTL / time.Second),
 	}
+}
+
+// Start does nothing as the client renews the lease on its hosts from
+// when it is created, so hosts added by other services are kept.
+func (m *GRPCClient) Start(ctx context.Context) error {
 	return nil
 }
 
+// Stop deals with asking the host agent to remove every host the client
+// has added, hosts other clients still have are kept, and then stopping
+// the renewal of the client's lease.
+func (m *GRPCClient) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	_, err := m.client.Sync(ctx, &SyncRequest{
+		Owner:        m.owner,
+		Entries:      []*HostEntry{},
+		LeaseSeconds: int64(m.leaseTTL / time.Second),
+	})
+	if err == nil {
+		m.hosts = ownedHosts{}
+	}
+	m.mu.Unlock()
+	m.Shutdown()
+	return err
+}
+
+// Shutdown deals with stopping the renewal of the lease on the hosts
+// the client has added, the host agent removes them once the lease lapses.
+func (m *GRPCClient) Shutdown() {
+	close(m.done)
+}
+
+// keepAlive renews the lease on the hosts the client has added a few times
+// per lease TTL, reconnecting when the stream to the host agent breaks.
+func (m *GRPCClient) keepAlive() {
+	interval := m.leaseTTL / 3
+	for {
+		err := m.renewLease(interval)
+		if err == nil {
+			return
+		}
+		m.logger.Warnf("failed to renew the lease on hosts with the host agent: %s", err)
+		select {
+		case <-m.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// renewLease sends heartbeats to the host agent over a stream until the client
+// is shut down. When the host agent no longer has a lease for the client, such as
+// after it has restarted, the client's hosts are synced again.
+func (m *GRPCClient) renewLease(interval time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := m.client.KeepAlive(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err = stream.Send(&KeepAliveRequest{Owner: m.owner})
+		if err != nil {
+			return err
+		}
+		response, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if !response.GetRenewed() {
+			err = m.sync()
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case <-m.done:
+			return stream.CloseSend()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *GRPCClient) sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []*HostEntry{}
+	for host, ips := range m.hosts {
+		entries = append(entries, &HostEntry{Host: host, Ips: ips})
+	}
+	_, err := m.client.Sync(context.Background(), &SyncRequest{
+		Owner:        m.owner,
+		Entries:      entries,
+		LeaseSeconds: int64(m.leaseTTL / time.Second),
+	})
+	return err
+}
+
 // GRPCServer provides the gRPC service running in the hosts agent.
 type GRPCServer struct {
 	// We must embed the unimplemented interface
@@ -112,30 +298,342 @@ type GRPCServer struct {
 	UnimplementedManagerServer
 	// This is the real implementation.
 	Impl Service
+	// Leases on hosts added with an owner, when not set
+	// hosts are kept until they are removed.
+	Leases *Leases
+	// The feed of changes made through Impl for watchers,
+	// when not set changes can't be watched.
+	Feed *ChangeFeed
+	// The hosts and IPs that can be added,
+	// when not set any host can be added.
+	Policy *Policy
 }
 
 // Add deals with adding a list of hosts to a given IP for local
 // DNS emulation.
 func (m *GRPCServer) Add(ctx context.Context, req *HostsRequest) (*HostsResponse, error) {
-	err := m.Impl.Add(&Params{
-		IP:    &req.Ip,
-		Hosts: &req.Hosts,
-	})
+	params, err := hostsParams(req)
 	if err != nil {
 		return nil, err
 	}
-	return &HostsResponse{Applied: true}, nil
+	err = m.authorize(ctx, "Add", req.Owner, strings.Split(*params.IP, ","), strings.Split(*params.Hosts, ","))
+	if err != nil {
+		return nil, err
+	}
+	if req.Owner == "" || m.Leases == nil {
+		err = m.Impl.Add(params)
+		if err != nil {
+			return nil, statusFromError(err)
+		}
+		return &HostsResponse{}, nil
+	}
+
+	ttl := leaseTTL(req.LeaseSeconds)
+	err = m.Leases.Add(req.Owner, ttl, params)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &HostsResponse{LeaseSeconds: int64(ttl / time.Second)}, nil
 }
 
 // Remove deals with removing a list of hosts from a given IP for
 // local DNS emulation.
 func (m *GRPCServer) Remove(ctx context.Context, req *HostsRequest) (*HostsResponse, error) {
-	err := m.Impl.Remove(&Params{
-		IP:    &req.Ip,
-		Hosts: &req.Hosts,
-	})
+	params, err := hostsParams(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.authorize(ctx, "Remove", req.Owner, strings.Split(*params.IP, ","), strings.Split(*params.Hosts, ","))
 	if err != nil {
 		return nil, err
 	}
-	return &HostsResponse{Applied: true}, nil
+	if req.Owner == "" || m.Leases == nil {
+		err = m.Impl.Remove(params)
+	} else {
+		err = m.Leases.Remove(req.Owner, params)
+	}
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &HostsResponse{}, nil
+}
+
+// Restore deals with restoring the hosts file from a backup,
+// this is only supported when the hosts file is being managed.
+func (m *GRPCServer) Restore(ctx context.Context, req *RestoreRequest) (*HostsResponse, error) {
+	backupService, ok := m.Impl.(BackupService)
+	if !ok {
+		return nil, statusFromError(ErrRestoreNotSupported)
+	}
+	err := backupService.Restore(req.Backup)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &HostsResponse{}, nil
+}
+
+// KeepAlive deals with renewing the lease for an owner
+// every time the owner sends a heartbeat.
+func (m *GRPCServer) KeepAlive(stream Manager_KeepAliveServer) error {
+	if m.Leases == nil {
+		return status.Error(codes.FailedPrecondition, "the host agent is not granting leases on hosts")
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ttl, renewed := m.Leases.Renew(req.Owner)
+		err = stream.Send(&KeepAliveResponse{
+			Renewed:      renewed,
+			LeaseSeconds: int64(ttl / time.Second),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// List deals with listing the hosts managed by the host agent
+// along with the leases clients have on them.
+func (m *GRPCServer) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	mappings, err := m.listMappings()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*HostEntry{}
+	for _, mapping := range mappings {
+		entries = append(entries, m.hostEntry(mapping))
+	}
+	return &ListResponse{Entries: entries}, nil
+}
+
+// Get deals with retrieving the IPs for a single host
+// along with the leases clients have on it.
+func (m *GRPCServer) Get(ctx context.Context, req *GetRequest) (*HostEntry, error) {
+	mappings, err := m.listMappings()
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		if strings.EqualFold(mapping.Host, req.Host) {
+			return m.hostEntry(mapping), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "host %q is not managed by the host agent", req.Host)
+}
+
+// Watch deals with sending the current hosts to a watcher
+// followed by the changes made through the host agent.
+func (m *GRPCServer) Watch(req *WatchRequest, stream Manager_WatchServer) error {
+	if m.Feed == nil {
+		return status.Error(codes.FailedPrecondition, "the host agent does not support watching hosts")
+	}
+	mappings, changes, stop := m.Feed.Watch()
+	defer stop()
+	for _, mapping := range mappings {
+		err := stream.Send(&WatchEvent{Type: WatchEvent_ADDED, Entry: m.hostEntry(mapping)})
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case change, ok := <-changes:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "the watcher fell too far behind the changes to hosts")
+			}
+			err := stream.Send(&WatchEvent{
+				Type:  watchEventTypes[change.Type],
+				Entry: m.hostEntry(change.Mapping),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Sync deals with replacing the full set of hosts an owner has.
+func (m *GRPCServer) Sync(ctx context.Context, req *SyncRequest) (*HostsResponse, error) {
+	if m.Leases == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the host agent is not granting leases on hosts")
+	}
+	if req.Owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "an owner must be provided to sync hosts")
+	}
+	mappings := []*HostMapping{}
+	for _, entry := range req.Entries {
+		ips, err := splitIPs(strings.Join(entry.Ips, ","))
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		host := strings.TrimSpace(entry.Host)
+		if host == "" {
+			return nil, status.Error(codes.InvalidArgument, "a host must be provided for every entry")
+		}
+		err = validateHost(host)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		err = m.authorize(ctx, "Sync", req.Owner, ips, []string{host})
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, &HostMapping{Host: host, IPs: ips})
+	}
+	ttl := leaseTTL(req.LeaseSeconds)
+	err := m.Leases.Sync(req.Owner, ttl, mappings)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &HostsResponse{LeaseSeconds: int64(ttl / time.Second)}, nil
+}
+
+// Plan deals with showing the changes removing and then adding hosts would make
+// to the hosts file, as Remove and Add without an owner, without making them.
+func (m *GRPCServer) Plan(ctx context.Context, req *PlanRequest) (*PlanResponse, error) {
+	planService, ok := m.Impl.(PlanService)
+	if !ok {
+		return nil, statusFromError(ErrPlanNotSupported)
+	}
+	removals := []*Params{}
+	for _, removal := range req.Removals {
+		params, err := hostsParams(removal)
+		if err != nil {
+			return nil, err
+		}
+		err = m.authorize(ctx, "Plan", removal.Owner, strings.Split(*params.IP, ","), strings.Split(*params.Hosts, ","))
+		if err != nil {
+			return nil, err
+		}
+		removals = append(removals, params)
+	}
+	additions := []*Params{}
+	for _, addition := range req.Additions {
+		params, err := hostsParams(addition)
+		if err != nil {
+			return nil, err
+		}
+		err = m.authorize(ctx, "Plan", addition.Owner, strings.Split(*params.IP, ","), strings.Split(*params.Hosts, ","))
+		if err != nil {
+			return nil, err
+		}
+		additions = append(additions, params)
+	}
+	diff, err := planService.Plan(removals, additions)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &PlanResponse{Diff: diff}, nil
+}
+
+func (m *GRPCServer) authorize(ctx context.Context, method string, owner string, ips []string, hosts []string) error {
+	if m.Policy == nil {
+		return nil
+	}
+	err := m.Policy.Authorize(ctx, method, owner, ips, hosts)
+	if err != nil {
+		return statusFromError(err)
+	}
+	return nil
+}
+
+func (m *GRPCServer) listMappings() ([]*HostMapping, error) {
+	listService, ok := m.Impl.(ListService)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "the hosts service does not support listing hosts")
+	}
+	mappings, err := listService.List()
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return mappings, nil
+}
+
+func (m *GRPCServer) hostEntry(mapping *HostMapping) *HostEntry {
+	entry := &HostEntry{
+		Host:   mapping.Host,
+		Ips:    mapping.IPs,
+		Leases: []*Lease{},
+	}
+	if m.Leases == nil {
+		return entry
+	}
+	for _, lease := range m.Leases.ForHost(mapping.Host) {
+		entry.Leases = append(entry.Leases, &Lease{
+			Owner:        lease.Owner,
+			Ips:          lease.IPs,
+			LeaseSeconds: int64(lease.TTL / time.Second),
+			ExpireTime:   timestamppb.New(lease.Expires),
+		})
+	}
+	return entry
+}
+
+var watchEventTypes = map[HostChangeType]WatchEvent_Type{
+	HostAdded:   WatchEvent_ADDED,
+	HostUpdated: WatchEvent_UPDATED,
+	HostRemoved: WatchEvent_REMOVED,
+}
+
+// hostsParams validates a request to add or remove hosts, for clients that
+// predate repeated fields a single comma separated value is also accepted.
+func hostsParams(req *HostsRequest) (*Params, error) {
+	ips, err := splitIPs(strings.Join(req.Ips, ","))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	hosts := []string{}
+	for _, value := range req.Hosts {
+		for _, host := range strings.Split(value, ",") {
+			host = strings.TrimSpace(host)
+			if host == "" {
+				continue
+			}
+			err = validateHost(host)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one host must be provided")
+	}
+	ip := strings.Join(ips, ",")
+	hostsValue := strings.Join(hosts, ",")
+	return &Params{
+		IP:    &ip,
+		Hosts: &hostsValue,
+	}, nil
+}
+
+func leaseTTL(leaseSeconds int64) time.Duration {
+	if leaseSeconds <= 0 {
+		return DefaultLeaseTTL
+	}
+	return time.Duration(leaseSeconds) * time.Second
+}
+
+// statusFromError converts errors from hosts services into gRPC status errors.
+func statusFromError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, ErrBackupNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrRestoreNotSupported), errors.Is(err, ErrPlanNotSupported):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrHostNotAllowed):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
 }
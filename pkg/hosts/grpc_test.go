@@ -12,12 +12,19 @@ package hosts
 
 import (
 	context "context"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/sirupsen/logrus"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 	. "gopkg.in/check.v1"
 )
@@ -63,15 +70,14 @@ func (s *GRPCSuite) Test_add_hosts_for_ip(c *C) {
 	}
 	defer conn.Close()
 	client := NewManagerClient(conn)
-	resp, err := client.Add(ctx, &HostsRequest{
-		Ip:    "172.1.0.22",
-		Hosts: "api.google.local,api.aws.local,api.azure.local,api.example.local",
+	_, err = client.Add(ctx, &HostsRequest{
+		Ips:   []string{"172.1.0.22"},
+		Hosts: []string{"api.google.local", "api.aws.local", "api.azure.local", "api.example.local"},
 	})
 	if err != nil {
 		c.Error(err)
 		c.FailNow()
 	}
-	c.Assert(resp.GetApplied(), Equals, true)
 	c.Assert(s.ipHostsMap["172.1.0.22"], Equals, "api.google.local,api.aws.local,api.azure.local,api.example.local")
 }
 
@@ -85,22 +91,269 @@ func (s *GRPCSuite) Test_remove_hosts_from_ip(c *C) {
 	defer conn.Close()
 	client := NewManagerClient(conn)
 	_, err = client.Add(ctx, &HostsRequest{
-		Ip:    "172.1.0.23",
-		Hosts: "api.google.local,api.aws.local,api.azure.local,api.example.local",
+		Ips:   []string{"172.1.0.23"},
+		Hosts: []string{"api.google.local", "api.aws.local", "api.azure.local", "api.example.local"},
 	})
 	if err != nil {
 		c.Error(err)
 		c.FailNow()
 	}
 
-	resp, err := client.Remove(ctx, &HostsRequest{
-		Ip:    "172.1.0.23",
-		Hosts: "api.google.local,api.azure.local",
+	_, err = client.Remove(ctx, &HostsRequest{
+		Ips:   []string{"172.1.0.23"},
+		Hosts: []string{"api.google.local", "api.azure.local"},
 	})
-	c.Assert(resp.GetApplied(), Equals, true)
+	c.Assert(err, IsNil)
 	c.Assert(s.ipHostsMap["172.1.0.23"], Equals, "api.aws.local,api.example.local")
 }
 
+func (s *GRPCSuite) Test_restore_fails_when_hosts_service_has_no_backups(c *C) {
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(s.bufDialer), grpc.WithInsecure())
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	defer conn.Close()
+	client := NewManagerClient(conn)
+	_, err = client.Restore(ctx, &RestoreRequest{Backup: "hosts-20220301T100001.000000000Z"})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *GRPCSuite) Test_restore_hosts_file_backup(c *C) {
+	restored := []string{}
+	server := &GRPCServer{
+		Impl: &mockBackupManager{restored: &restored},
+	}
+	_, err := server.Restore(context.Background(), &RestoreRequest{Backup: "hosts-20220301T100001.000000000Z"})
+	c.Assert(err, IsNil)
+	c.Assert(restored, DeepEquals, []string{"hosts-20220301T100001.000000000Z"})
+
+	_, err = server.Restore(context.Background(), &RestoreRequest{Backup: "missing"})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
+func (s *GRPCSuite) Test_plan_fails_when_hosts_service_cannot_plan(c *C) {
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(s.bufDialer), grpc.WithInsecure())
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	defer conn.Close()
+	client := NewManagerClient(conn)
+	_, err = client.Plan(ctx, &PlanRequest{
+		Additions: []*HostsRequest{{Ips: []string{"172.1.0.22"}, Hosts: []string{"api.example.local"}}},
+	})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *GRPCSuite) Test_plan_hosts_changes(c *C) {
+	planned := []string{}
+	server := &GRPCServer{
+		Impl: &mockPlanManager{planned: &planned},
+	}
+	response, err := server.Plan(context.Background(), &PlanRequest{
+		Removals: []*HostsRequest{{Ips: []string{"172.1.0.22", "fd00::22"}, Hosts: []string{"api.example.local"}}},
+		Additions: []*HostsRequest{
+			{Ips: []string{"172.1.0.23"}, Hosts: []string{"api.example.local", "app.example.local"}},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(response.Diff, Equals, "+172.1.0.23 api.example.local app.example.local\n")
+	c.Assert(planned, DeepEquals, []string{
+		"remove 172.1.0.22,fd00::22=api.example.local",
+		"add 172.1.0.23=api.example.local,app.example.local",
+	})
+
+	_, err = server.Plan(context.Background(), &PlanRequest{
+		Additions: []*HostsRequest{{Ips: []string{"not-an-ip"}, Hosts: []string{"api.example.local"}}},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+}
+
+type GRPCAPISuite struct {
+	service *recordingService
+	leases  *Leases
+	server  *grpc.Server
+	conn    *grpc.ClientConn
+	client  ManagerClient
+}
+
+var _ = Suite(&GRPCAPISuite{})
+
+func (s *GRPCAPISuite) SetUpTest(c *C) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	s.service = &recordingService{ipHosts: map[string]map[string]bool{}}
+	feed, err := NewChangeFeed(s.service)
+	c.Assert(err, IsNil)
+	s.leases = NewLeases(feed, logrus.NewEntry(logger))
+
+	listener := bufconn.Listen(1024 * 1024)
+	s.server = grpc.NewServer()
+	policy, err := NewPolicy(&config.Config{}, logrus.NewEntry(logger))
+	c.Assert(err, IsNil)
+	RegisterManagerServer(s.server, &GRPCServer{Impl: feed, Leases: s.leases, Feed: feed, Policy: policy})
+	go s.server.Serve(listener)
+	s.conn, err = grpc.DialContext(
+		context.Background(),
+		"bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	c.Assert(err, IsNil)
+	s.client = NewManagerClient(s.conn)
+}
+
+func (s *GRPCAPISuite) TearDownTest(c *C) {
+	s.conn.Close()
+	s.server.Stop()
+	s.leases.Shutdown()
+}
+
+func (s *GRPCAPISuite) Test_list_and_get_hosts_with_leases(c *C) {
+	ctx := context.Background()
+	response, err := s.client.Add(ctx, &HostsRequest{
+		Ips:          []string{"172.18.0.22", "fd00::22"},
+		Hosts:        []string{"storage.googleapis.local"},
+		Owner:        "server-a",
+		LeaseSeconds: 60,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(response.LeaseSeconds, Equals, int64(60))
+	_, err = s.client.Add(ctx, &HostsRequest{
+		Ips:   []string{"172.18.0.23"},
+		Hosts: []string{"console.clouduno.local"},
+	})
+	c.Assert(err, IsNil)
+
+	list, err := s.client.List(ctx, &ListRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 2)
+	c.Assert(list.Entries[0].Host, Equals, "console.clouduno.local")
+	c.Assert(list.Entries[0].Leases, HasLen, 0)
+	c.Assert(list.Entries[1].Host, Equals, "storage.googleapis.local")
+	c.Assert(list.Entries[1].Ips, DeepEquals, []string{"172.18.0.22", "fd00::22"})
+	c.Assert(list.Entries[1].Leases, HasLen, 1)
+	c.Assert(list.Entries[1].Leases[0].Owner, Equals, "server-a")
+	c.Assert(list.Entries[1].Leases[0].LeaseSeconds, Equals, int64(60))
+	c.Assert(list.Entries[1].Leases[0].ExpireTime.AsTime().After(time.Now()), Equals, true)
+
+	entry, err := s.client.Get(ctx, &GetRequest{Host: "storage.googleapis.local"})
+	c.Assert(err, IsNil)
+	c.Assert(entry.Ips, DeepEquals, []string{"172.18.0.22", "fd00::22"})
+	_, err = s.client.Get(ctx, &GetRequest{Host: "missing.googleapis.local"})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
+func (s *GRPCAPISuite) Test_watch_hosts(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := s.client.Add(ctx, &HostsRequest{Ips: []string{"172.18.0.22"}, Hosts: []string{"storage.googleapis.local"}})
+	c.Assert(err, IsNil)
+
+	stream, err := s.client.Watch(ctx, &WatchRequest{})
+	c.Assert(err, IsNil)
+	event, err := stream.Recv()
+	c.Assert(err, IsNil)
+	c.Assert(event.Type, Equals, WatchEvent_ADDED)
+	c.Assert(event.Entry.Host, Equals, "storage.googleapis.local")
+
+	_, err = s.client.Add(ctx, &HostsRequest{Ips: []string{"fd00::22"}, Hosts: []string{"storage.googleapis.local"}})
+	c.Assert(err, IsNil)
+	event, err = stream.Recv()
+	c.Assert(err, IsNil)
+	c.Assert(event.Type, Equals, WatchEvent_UPDATED)
+	c.Assert(event.Entry.Ips, DeepEquals, []string{"172.18.0.22", "fd00::22"})
+
+	_, err = s.client.Remove(ctx, &HostsRequest{Ips: []string{"172.18.0.22", "fd00::22"}, Hosts: []string{"storage.googleapis.local"}})
+	c.Assert(err, IsNil)
+	event, err = stream.Recv()
+	c.Assert(err, IsNil)
+	c.Assert(event.Type, Equals, WatchEvent_REMOVED)
+	c.Assert(event.Entry.Host, Equals, "storage.googleapis.local")
+}
+
+func (s *GRPCAPISuite) Test_sync_replaces_hosts_for_owner(c *C) {
+	ctx := context.Background()
+	_, err := s.client.Add(ctx, &HostsRequest{
+		Ips:   []string{"172.18.0.22"},
+		Hosts: []string{"storage.googleapis.local", "pubsub.googleapis.local"},
+		Owner: "server-a",
+	})
+	c.Assert(err, IsNil)
+	_, err = s.client.Add(ctx, &HostsRequest{
+		Ips:   []string{"172.18.0.22"},
+		Hosts: []string{"pubsub.googleapis.local"},
+		Owner: "server-b",
+	})
+	c.Assert(err, IsNil)
+
+	_, err = s.client.Sync(ctx, &SyncRequest{
+		Owner: "server-a",
+		Entries: []*HostEntry{
+			{Host: "storage.googleapis.local", Ips: []string{"172.18.0.24"}},
+			{Host: "tasks.googleapis.local", Ips: []string{"172.18.0.24", "fd00::24"}},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"pubsub.googleapis.local"})
+	c.Assert(s.service.hosts("172.18.0.24"), DeepEquals, []string{"storage.googleapis.local", "tasks.googleapis.local"})
+	c.Assert(s.service.hosts("fd00::24"), DeepEquals, []string{"tasks.googleapis.local"})
+	leases := s.leases.ForHost("tasks.googleapis.local")
+	c.Assert(leases, HasLen, 1)
+	c.Assert(leases[0].Owner, Equals, "server-a")
+}
+
+func (s *GRPCAPISuite) Test_invalid_requests_return_invalid_argument(c *C) {
+	ctx := context.Background()
+	_, err := s.client.Add(ctx, &HostsRequest{Ips: []string{"172.18.0.22", "172.18.0.23"}, Hosts: []string{"storage.googleapis.local"}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.client.Remove(ctx, &HostsRequest{Ips: []string{"not-an-ip"}, Hosts: []string{"storage.googleapis.local"}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.client.Add(ctx, &HostsRequest{Ips: []string{"172.18.0.22"}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.client.Sync(ctx, &SyncRequest{Entries: []*HostEntry{{Host: "storage.googleapis.local", Ips: []string{"172.18.0.22"}}}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.client.Add(ctx, &HostsRequest{Ips: []string{"172.18.0.22"}, Hosts: []string{"storage.googleapis.local\n1.2.3.4 github.com"}})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.client.Restore(ctx, &RestoreRequest{})
+	c.Assert(status.Code(err), Equals, codes.FailedPrecondition)
+}
+
+func (s *GRPCAPISuite) Test_hosts_outside_the_policy_return_permission_denied(c *C) {
+	ctx := context.Background()
+	_, err := s.client.Add(ctx, &HostsRequest{Ips: []string{"172.18.0.22"}, Hosts: []string{"storage.googleapis.local", "github.com"}})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.client.Add(ctx, &HostsRequest{Ips: []string{"140.82.121.4"}, Hosts: []string{"storage.googleapis.local"}})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.client.Sync(ctx, &SyncRequest{
+		Owner:   "server-a",
+		Entries: []*HostEntry{{Host: "github.com", Ips: []string{"172.18.0.22"}}},
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	c.Assert(s.service.hosts("172.18.0.22"), HasLen, 0)
+}
+
+func (s *GRPCAPISuite) Test_removing_hosts_outside_the_policy_returns_permission_denied(c *C) {
+	ip := "127.0.0.1"
+	hosts := "localhost"
+	c.Assert(s.service.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+
+	ctx := context.Background()
+	_, err := s.client.Remove(ctx, &HostsRequest{Ips: []string{"127.0.0.1"}, Hosts: []string{"localhost"}})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	_, err = s.client.Plan(ctx, &PlanRequest{
+		Removals: []*HostsRequest{{Ips: []string{"127.0.0.1"}, Hosts: []string{"localhost"}}},
+	})
+	c.Assert(status.Code(err), Equals, codes.PermissionDenied)
+	c.Assert(s.service.hosts("127.0.0.1"), DeepEquals, []string{"localhost"})
+}
+
 type mockManager struct {
 	ipHostsMap map[string]string
 }
@@ -123,3 +376,33 @@ func (m *mockManager) Remove(params *Params) error {
 	m.ipHostsMap[*params.IP] = strings.Join(finalHosts, ",")
 	return nil
 }
+
+type mockBackupManager struct {
+	mockManager
+	restored *[]string
+}
+
+func (m *mockBackupManager) Restore(backup string) error {
+	if backup == "missing" {
+		return ErrBackupNotFound
+	}
+	*m.restored = append(*m.restored, backup)
+	return nil
+}
+
+type mockPlanManager struct {
+	mockManager
+	planned *[]string
+}
+
+func (m *mockPlanManager) Plan(removals []*Params, additions []*Params) (string, error) {
+	diff := ""
+	for _, params := range removals {
+		*m.planned = append(*m.planned, fmt.Sprintf("remove %s=%s", *params.IP, *params.Hosts))
+	}
+	for _, params := range additions {
+		*m.planned = append(*m.planned, fmt.Sprintf("add %s=%s", *params.IP, *params.Hosts))
+		diff += fmt.Sprintf("+%s %s\n", *params.IP, strings.Replace(*params.Hosts, ",", " ", -1))
+	}
+	return diff, nil
+}
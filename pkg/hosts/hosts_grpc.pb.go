@@ -28,6 +28,17 @@ const _ = grpc.SupportPackageIsVersion7
 type ManagerClient interface {
 	Add(ctx context.Context, in *HostsRequest, opts ...grpc.CallOption) (*HostsResponse, error)
 	Remove(ctx context.Context, in *HostsRequest, opts ...grpc.CallOption) (*HostsResponse, error)
+	Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*HostsResponse, error)
+	KeepAlive(ctx context.Context, opts ...grpc.CallOption) (Manager_KeepAliveClient, error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*HostEntry, error)
+	// Watch sends an ADDED event for every current host followed by
+	// events for the changes made through the host agent.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Manager_WatchClient, error)
+	Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (*HostsResponse, error)
+	// Plan shows the changes removing then adding hosts would make
+	// to the hosts file as a unified diff without making them.
+	Plan(ctx context.Context, in *PlanRequest, opts ...grpc.CallOption) (*PlanResponse, error)
 }
 
 type managerClient struct {
@@ -56,12 +67,131 @@ func (c *managerClient) Remove(ctx context.Context, in *HostsRequest, opts ...gr
 	return out, nil
 }
 
+func (c *managerClient) Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*HostsResponse, error) {
+	out := new(HostsResponse)
+	err := c.cc.Invoke(ctx, "/hosts.Manager/Restore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) KeepAlive(ctx context.Context, opts ...grpc.CallOption) (Manager_KeepAliveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Manager_ServiceDesc.Streams[0], "/hosts.Manager/KeepAlive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managerKeepAliveClient{stream}
+	return x, nil
+}
+
+type Manager_KeepAliveClient interface {
+	Send(*KeepAliveRequest) error
+	Recv() (*KeepAliveResponse, error)
+	grpc.ClientStream
+}
+
+type managerKeepAliveClient struct {
+	grpc.ClientStream
+}
+
+func (x *managerKeepAliveClient) Send(m *KeepAliveRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *managerKeepAliveClient) Recv() (*KeepAliveResponse, error) {
+	m := new(KeepAliveResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *managerClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/hosts.Manager/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*HostEntry, error) {
+	out := new(HostEntry)
+	err := c.cc.Invoke(ctx, "/hosts.Manager/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Manager_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Manager_ServiceDesc.Streams[1], "/hosts.Manager/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managerWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Manager_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type managerWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *managerWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *managerClient) Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (*HostsResponse, error) {
+	out := new(HostsResponse)
+	err := c.cc.Invoke(ctx, "/hosts.Manager/Sync", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) Plan(ctx context.Context, in *PlanRequest, opts ...grpc.CallOption) (*PlanResponse, error) {
+	out := new(PlanResponse)
+	err := c.cc.Invoke(ctx, "/hosts.Manager/Plan", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ManagerServer is the server API for Manager service.
 // All implementations must embed UnimplementedManagerServer
 // for forward compatibility
 type ManagerServer interface {
 	Add(context.Context, *HostsRequest) (*HostsResponse, error)
 	Remove(context.Context, *HostsRequest) (*HostsResponse, error)
+	Restore(context.Context, *RestoreRequest) (*HostsResponse, error)
+	KeepAlive(Manager_KeepAliveServer) error
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	Get(context.Context, *GetRequest) (*HostEntry, error)
+	// Watch sends an ADDED event for every current host followed by
+	// events for the changes made through the host agent.
+	Watch(*WatchRequest, Manager_WatchServer) error
+	Sync(context.Context, *SyncRequest) (*HostsResponse, error)
+	// Plan shows the changes removing then adding hosts would make
+	// to the hosts file as a unified diff without making them.
+	Plan(context.Context, *PlanRequest) (*PlanResponse, error)
 	mustEmbedUnimplementedManagerServer()
 }
 
@@ -75,6 +205,27 @@ func (UnimplementedManagerServer) Add(context.Context, *HostsRequest) (*HostsRes
 func (UnimplementedManagerServer) Remove(context.Context, *HostsRequest) (*HostsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Remove not implemented")
 }
+func (UnimplementedManagerServer) Restore(context.Context, *RestoreRequest) (*HostsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedManagerServer) KeepAlive(Manager_KeepAliveServer) error {
+	return status.Errorf(codes.Unimplemented, "method KeepAlive not implemented")
+}
+func (UnimplementedManagerServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedManagerServer) Get(context.Context, *GetRequest) (*HostEntry, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedManagerServer) Watch(*WatchRequest, Manager_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedManagerServer) Sync(context.Context, *SyncRequest) (*HostsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sync not implemented")
+}
+func (UnimplementedManagerServer) Plan(context.Context, *PlanRequest) (*PlanResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Plan not implemented")
+}
 func (UnimplementedManagerServer) mustEmbedUnimplementedManagerServer() {}
 
 // UnsafeManagerServer may be embedded to opt out of forward compatibility for this service.
@@ -124,6 +275,143 @@ func _Manager_Remove_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Manager_Restore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).Restore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hosts.Manager/Restore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).Restore(ctx, req.(*RestoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_KeepAlive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ManagerServer).KeepAlive(&managerKeepAliveServer{stream})
+}
+
+type Manager_KeepAliveServer interface {
+	Send(*KeepAliveResponse) error
+	Recv() (*KeepAliveRequest, error)
+	grpc.ServerStream
+}
+
+type managerKeepAliveServer struct {
+	grpc.ServerStream
+}
+
+func (x *managerKeepAliveServer) Send(m *KeepAliveResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *managerKeepAliveServer) Recv() (*KeepAliveRequest, error) {
+	m := new(KeepAliveRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Manager_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hosts.Manager/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hosts.Manager/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManagerServer).Watch(m, &managerWatchServer{stream})
+}
+
+type Manager_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type managerWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *managerWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Manager_Sync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).Sync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hosts.Manager/Sync",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).Sync(ctx, req.(*SyncRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_Plan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).Plan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hosts.Manager/Plan",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).Plan(ctx, req.(*PlanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Manager_ServiceDesc is the grpc.ServiceDesc for Manager service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -139,7 +427,39 @@ var Manager_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Remove",
 			Handler:    _Manager_Remove_Handler,
 		},
+		{
+			MethodName: "Restore",
+			Handler:    _Manager_Restore_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Manager_List_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Manager_Get_Handler,
+		},
+		{
+			MethodName: "Sync",
+			Handler:    _Manager_Sync_Handler,
+		},
+		{
+			MethodName: "Plan",
+			Handler:    _Manager_Plan_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "KeepAlive",
+			Handler:       _Manager_KeepAlive_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Manager_Watch_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "hosts.proto",
 }
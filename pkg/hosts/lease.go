@@ -0,0 +1,398 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// DefaultLeaseTTL is how long hosts added by a client of the host agent are
+	// kept without the lease being renewed when the client doesn't ask for a TTL.
+	DefaultLeaseTTL = 30 * time.Second
+	// LeaseCheckInterval is how often the host agent checks for lapsed leases.
+	LeaseCheckInterval = time.Second
+)
+
+// Leases grants leases on the hosts that clients of the host agent add. Hosts are
+// tagged with the client that owns them and are removed when the owner's lease lapses,
+// so the hosts for a Cloud::1 server that was killed don't point at a dead IP forever.
+// Several Cloud::1 servers can share a host agent, a host is only removed from an IP
+// once no other owner with a live lease has it.
+type Leases struct {
+	mu     sync.Mutex
+	impl   Service
+	owners map[string]*lease
+	now    func() time.Time
+	logger *logrus.Entry
+	done   chan struct{}
+}
+
+type lease struct {
+	ttl     time.Duration
+	expires time.Time
+	hosts   ownedHosts
+}
+
+// NewLeases creates a new service that grants leases on hosts added to the
+// provided hosts service and removes hosts once their owner's lease lapses.
+func NewLeases(impl Service, logger *logrus.Entry) *Leases {
+	leases := &Leases{
+		impl:   impl,
+		owners: map[string]*lease{},
+		now:    time.Now,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	go leases.run(LeaseCheckInterval)
+	return leases
+}
+
+// Add deals with adding hosts for an owner and granting or extending the
+// owner's lease, the default TTL is used when the TTL is not positive.
+func (l *Leases) Add(owner string, ttl time.Duration, params *Params) error {
+	ips, err := splitIPs(*params.IP)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err = l.impl.Add(params)
+	if err != nil {
+		return err
+	}
+	ownerLease, ok := l.owners[owner]
+	if !ok {
+		ownerLease = &lease{hosts: ownedHosts{}}
+		l.owners[owner] = ownerLease
+	}
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	ownerLease.ttl = ttl
+	ownerLease.expires = l.now().Add(ttl)
+	ownerLease.hosts.add(ips, strings.Split(*params.Hosts, ","))
+	return nil
+}
+
+// Remove deals with removing hosts for an owner, hosts that
+// other owners still have for the same IP are kept.
+func (l *Leases) Remove(owner string, params *Params) error {
+	ips, err := splitIPs(*params.IP)
+	if err != nil {
+		return err
+	}
+	hosts := strings.Split(*params.Hosts, ",")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ownerLease, ok := l.owners[owner]; ok {
+		ownerLease.hosts.remove(ips, hosts)
+	}
+	return l.removeUnclaimedLocked(owner, ips, hosts)
+}
+
+// Sync replaces the hosts an owner has with the provided hosts and grants or extends
+// the owner's lease. Hosts the owner no longer has are removed unless another owner
+// still has them, the changes are applied at once when the hosts service supports it.
+func (l *Leases) Sync(owner string, ttl time.Duration, mappings []*HostMapping) error {
+	desired := ownedHosts{}
+	for _, mapping := range mappings {
+		ips, err := splitIPs(strings.Join(mapping.IPs, ","))
+		if err != nil {
+			return err
+		}
+		desired.add(ips, []string{mapping.Host})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := ownedHosts{}
+	if ownerLease, ok := l.owners[owner]; ok {
+		current = ownerLease.hosts
+	}
+	removalsByIP := map[string][]string{}
+	for host, ips := range current {
+		for _, ip := range ips {
+			if !itemInSlice(ip, desired[host]) && !l.claimedLocked(owner, host, ip) {
+				removalsByIP[ip] = append(removalsByIP[ip], host)
+			}
+		}
+	}
+	additionsByIPs := map[string][]string{}
+	for host, ips := range desired {
+		key := strings.Join(ips, ",")
+		additionsByIPs[key] = append(additionsByIPs[key], host)
+	}
+	removals := []*Params{}
+	for _, ip := range sortedIPs(removalsByIP) {
+		removals = append(removals, newParams(ip, removalsByIP[ip]))
+	}
+	additions := []*Params{}
+	for _, ips := range sortedIPs(additionsByIPs) {
+		additions = append(additions, newParams(ips, additionsByIPs[ips]))
+	}
+	err := applyChanges(l.impl, removals, additions)
+	if err != nil {
+		return err
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	l.owners[owner] = &lease{
+		ttl:     ttl,
+		expires: l.now().Add(ttl),
+		hosts:   desired,
+	}
+	return nil
+}
+
+// LeaseInfo provides the lease an owner has on the IPs for a host.
+type LeaseInfo struct {
+	Owner   string
+	IPs     []string
+	TTL     time.Duration
+	Expires time.Time
+}
+
+// ForHost lists the leases owners have on a host sorted by owner.
+func (l *Leases) ForHost(host string) []*LeaseInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	leases := []*LeaseInfo{}
+	for owner, ownerLease := range l.owners {
+		ips, ok := ownerLease.hosts[host]
+		if !ok {
+			continue
+		}
+		leases = append(leases, &LeaseInfo{
+			Owner:   owner,
+			IPs:     append([]string{}, ips...),
+			TTL:     ownerLease.ttl,
+			Expires: ownerLease.expires,
+		})
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Owner < leases[j].Owner
+	})
+	return leases
+}
+
+// Renew extends the lease for an owner by its TTL, false is returned when the
+// owner has no lease, such as when the host agent has restarted or the lease lapsed,
+// in which case the owner should add its hosts again.
+func (l *Leases) Renew(owner string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ownerLease, ok := l.owners[owner]
+	// A lapsed lease is kept until its hosts have been removed,
+	// some of them may already be gone so it can't be renewed.
+	if !ok || !l.now().Before(ownerLease.expires) {
+		return 0, false
+	}
+	ownerLease.expires = l.now().Add(ownerLease.ttl)
+	return ownerLease.ttl, true
+}
+
+// Expire removes the hosts of every owner whose lease has lapsed. A lapsed lease
+// is only dropped once all of its hosts have been removed, so hosts that fail to be
+// removed are tried again the next time leases are checked.
+func (l *Leases) Expire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	owners := []string{}
+	for owner := range l.owners {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	failures := []string{}
+	for _, owner := range owners {
+		ownerLease := l.owners[owner]
+		if now.Before(ownerLease.expires) {
+			continue
+		}
+		l.logger.Infof("the lease for %s has lapsed, removing its hosts", owner)
+		byIP := ownerLease.hosts.byIP()
+		for _, ip := range sortedIPs(byIP) {
+			err := l.removeUnclaimedLocked(owner, []string{ip}, byIP[ip])
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("failed to remove the hosts of %s for %s: %s", owner, ip, err))
+				continue
+			}
+			ownerLease.hosts.remove([]string{ip}, byIP[ip])
+		}
+		if len(ownerLease.hosts) == 0 {
+			delete(l.owners, owner)
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Shutdown deals with stopping the checks for lapsed leases.
+func (l *Leases) Shutdown() {
+	close(l.done)
+}
+
+func (l *Leases) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			err := l.Expire()
+			if err != nil {
+				l.logger.Errorf("failed to remove hosts for lapsed leases: %s", err)
+			}
+		}
+	}
+}
+
+// removeUnclaimedLocked removes hosts from IPs unless an owner
+// other than the provided owner still has them.
+func (l *Leases) removeUnclaimedLocked(owner string, ips []string, hosts []string) error {
+	for _, ip := range ips {
+		unclaimed := []string{}
+		for _, host := range hosts {
+			if !l.claimedLocked(owner, host, ip) {
+				unclaimed = append(unclaimed, host)
+			}
+		}
+		if len(unclaimed) == 0 {
+			continue
+		}
+		err := l.impl.Remove(newParams(ip, unclaimed))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimedLocked determines whether an owner other than
+// the provided owner has a host for an IP.
+func (l *Leases) claimedLocked(owner string, host string, ip string) bool {
+	for otherOwner, ownerLease := range l.owners {
+		if otherOwner != owner && itemInSlice(ip, ownerLease.hosts[host]) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyChanges removes and adds hosts at once when
+// the hosts service supports it, otherwise one by one.
+func applyChanges(service Service, removals []*Params, additions []*Params) error {
+	if batchService, ok := service.(BatchService); ok {
+		return batchService.Apply(removals, additions)
+	}
+	for _, params := range removals {
+		err := service.Remove(params)
+		if err != nil {
+			return err
+		}
+	}
+	for _, params := range additions {
+		err := service.Add(params)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newParams(ip string, hosts []string) *Params {
+	sortedHosts := append([]string{}, hosts...)
+	sort.Strings(sortedHosts)
+	hostsValue := strings.Join(sortedHosts, ",")
+	return &Params{
+		IP:    &ip,
+		Hosts: &hostsValue,
+	}
+}
+
+// ownedHosts keeps track of the IPs a client has added hosts for, as with
+// hosts services a host has at most one IPv4 and one IPv6 address.
+type ownedHosts map[string][]string
+
+func (o ownedHosts) add(ips []string, hosts []string) {
+	for _, host := range hosts {
+		kept := []string{}
+		for _, existing := range o[host] {
+			if !hasIPOfSameType(parseIPs(ips), net.ParseIP(existing)) {
+				kept = append(kept, existing)
+			}
+		}
+		o[host] = append(kept, ips...)
+	}
+}
+
+func (o ownedHosts) remove(ips []string, hosts []string) {
+	for _, host := range hosts {
+		kept := []string{}
+		for _, existing := range o[host] {
+			if !itemInSlice(existing, ips) {
+				kept = append(kept, existing)
+			}
+		}
+		if len(kept) == 0 {
+			delete(o, host)
+		} else {
+			o[host] = kept
+		}
+	}
+}
+
+// byIP groups hosts by the IP they have been added for.
+func (o ownedHosts) byIP() map[string][]string {
+	byIP := map[string][]string{}
+	for host, ips := range o {
+		for _, ip := range ips {
+			byIP[ip] = append(byIP[ip], host)
+		}
+	}
+	for _, hosts := range byIP {
+		sort.Strings(hosts)
+	}
+	return byIP
+}
+
+func parseIPs(ips []string) []net.IP {
+	parsed := []net.IP{}
+	for _, ip := range ips {
+		parsed = append(parsed, net.ParseIP(ip))
+	}
+	return parsed
+}
+
+func sortedIPs(byIP map[string][]string) []string {
+	ips := []string{}
+	for ip := range byIP {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
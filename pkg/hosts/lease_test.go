@@ -0,0 +1,265 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	context "context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	. "gopkg.in/check.v1"
+)
+
+type LeaseSuite struct {
+	service *recordingService
+	leases  *Leases
+	clock   time.Time
+	logger  *logrus.Entry
+}
+
+var _ = Suite(&LeaseSuite{})
+
+func (s *LeaseSuite) SetUpTest(c *C) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	s.logger = logrus.NewEntry(logger)
+	s.service = &recordingService{ipHosts: map[string]map[string]bool{}}
+	s.clock = time.Date(2022, time.March, 1, 10, 0, 0, 0, time.UTC)
+	s.leases = s.newLeases()
+}
+
+func (s *LeaseSuite) TearDownTest(c *C) {
+	s.leases.Shutdown()
+}
+
+func (s *LeaseSuite) newLeases() *Leases {
+	leases := NewLeases(s.service, s.logger)
+	leases.now = func() time.Time {
+		return s.clock
+	}
+	return leases
+}
+
+func (s *LeaseSuite) add(c *C, owner string, ip string, hosts string) {
+	err := s.leases.Add(owner, 30*time.Second, &Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+}
+
+func (s *LeaseSuite) Test_removes_hosts_when_lease_lapses(c *C) {
+	s.add(c, "server-a", "172.18.0.22,fd00::22", "storage.googleapis.local,pubsub.googleapis.local")
+
+	s.clock = s.clock.Add(29 * time.Second)
+	c.Assert(s.leases.Expire(), IsNil)
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"pubsub.googleapis.local", "storage.googleapis.local"})
+
+	s.clock = s.clock.Add(time.Second)
+	c.Assert(s.leases.Expire(), IsNil)
+	c.Assert(s.service.hosts("172.18.0.22"), HasLen, 0)
+	c.Assert(s.service.hosts("fd00::22"), HasLen, 0)
+
+	_, renewed := s.leases.Renew("server-a")
+	c.Assert(renewed, Equals, false)
+}
+
+func (s *LeaseSuite) Test_retries_removing_hosts_for_a_lapsed_lease_when_removing_them_fails(c *C) {
+	s.add(c, "server-a", "172.18.0.22", "storage.googleapis.local")
+	s.add(c, "server-b", "172.18.0.23", "pubsub.googleapis.local")
+	s.service.removeErrs = map[string]error{"172.18.0.22": errors.New("hosts file is locked")}
+
+	s.clock = s.clock.Add(30 * time.Second)
+	err := s.leases.Expire()
+	c.Assert(err, ErrorMatches, "failed to remove the hosts of server-a for 172.18.0.22: hosts file is locked")
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"storage.googleapis.local"})
+	// The failure doesn't stop the hosts of other lapsed leases being removed.
+	c.Assert(s.service.hosts("172.18.0.23"), HasLen, 0)
+	_, renewed := s.leases.Renew("server-a")
+	c.Assert(renewed, Equals, false)
+
+	s.service.removeErrs = nil
+	c.Assert(s.leases.Expire(), IsNil)
+	c.Assert(s.service.hosts("172.18.0.22"), HasLen, 0)
+	c.Assert(s.leases.ForHost("storage.googleapis.local"), HasLen, 0)
+}
+
+func (s *LeaseSuite) Test_renewing_a_lease_keeps_hosts(c *C) {
+	s.add(c, "server-a", "172.18.0.22", "storage.googleapis.local")
+
+	s.clock = s.clock.Add(20 * time.Second)
+	ttl, renewed := s.leases.Renew("server-a")
+	c.Assert(renewed, Equals, true)
+	c.Assert(ttl, Equals, 30*time.Second)
+
+	s.clock = s.clock.Add(20 * time.Second)
+	c.Assert(s.leases.Expire(), IsNil)
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"storage.googleapis.local"})
+}
+
+func (s *LeaseSuite) Test_keeps_hosts_other_owners_still_have(c *C) {
+	s.add(c, "server-a", "172.18.0.22", "storage.googleapis.local,pubsub.googleapis.local")
+	s.clock = s.clock.Add(10 * time.Second)
+	s.add(c, "server-b", "172.18.0.22", "storage.googleapis.local")
+
+	hosts := "storage.googleapis.local"
+	ip := "172.18.0.22"
+	err := s.leases.Remove("server-b", &Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"pubsub.googleapis.local", "storage.googleapis.local"})
+
+	s.add(c, "server-b", "172.18.0.22", "storage.googleapis.local")
+	s.clock = s.clock.Add(25 * time.Second)
+	c.Assert(s.leases.Expire(), IsNil)
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"storage.googleapis.local"})
+}
+
+func (s *LeaseSuite) Test_client_renews_lease_and_adds_hosts_again_after_agent_restarts(c *C) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	grpcServer := &GRPCServer{Impl: s.service, Leases: s.leases}
+	RegisterManagerServer(server, grpcServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(
+		context.Background(),
+		"bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	client := newGRPCClient(NewManagerClient(conn), s.logger)
+	client.leaseTTL = 3 * time.Second
+
+	ip := "172.18.0.22,fd00::22"
+	hosts := "storage.googleapis.local"
+	c.Assert(client.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	ttl, renewed := s.leases.Renew(client.owner)
+	c.Assert(renewed, Equals, true)
+	c.Assert(ttl, Equals, 3*time.Second)
+
+	// A restarted host agent has no leases and the hosts file
+	// may have been cleaned up while it was down.
+	s.leases.Shutdown()
+	s.leases = s.newLeases()
+	grpcServer.Leases = s.leases
+	s.service.ipHosts = map[string]map[string]bool{}
+
+	go client.keepAlive()
+	defer client.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.service.hosts("fd00::22")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"storage.googleapis.local"})
+	c.Assert(s.service.hosts("fd00::22"), DeepEquals, []string{"storage.googleapis.local"})
+	_, renewed = s.leases.Renew(client.owner)
+	c.Assert(renewed, Equals, true)
+}
+
+func (s *LeaseSuite) Test_stopping_a_client_removes_its_hosts(c *C) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	RegisterManagerServer(server, &GRPCServer{Impl: s.service, Leases: s.leases})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(
+		context.Background(),
+		"bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	client := newGRPCClient(NewManagerClient(conn), s.logger)
+	other := newGRPCClient(NewManagerClient(conn), s.logger)
+
+	ip := "172.18.0.22"
+	hosts := "pubsub.googleapis.local,storage.googleapis.local"
+	otherHosts := "storage.googleapis.local"
+	c.Assert(client.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	c.Assert(other.Add(&Params{IP: &ip, Hosts: &otherHosts}), IsNil)
+
+	c.Assert(client.Stop(context.Background()), IsNil)
+	// Hosts other clients still have are kept.
+	c.Assert(s.service.hosts("172.18.0.22"), DeepEquals, []string{"storage.googleapis.local"})
+}
+
+// recordingService keeps track of the hosts added for each IP,
+// removing hosts from the IPs in removeErrs fails.
+type recordingService struct {
+	mu         sync.Mutex
+	ipHosts    map[string]map[string]bool
+	removeErrs map[string]error
+}
+
+func (r *recordingService) Add(params *Params) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ip := range strings.Split(*params.IP, ",") {
+		if r.ipHosts[ip] == nil {
+			r.ipHosts[ip] = map[string]bool{}
+		}
+		for _, host := range strings.Split(*params.Hosts, ",") {
+			r.ipHosts[ip][host] = true
+		}
+	}
+	return nil
+}
+
+func (r *recordingService) Remove(params *Params) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.removeErrs[*params.IP]; err != nil {
+		return err
+	}
+	for _, ip := range strings.Split(*params.IP, ",") {
+		for _, host := range strings.Split(*params.Hosts, ",") {
+			delete(r.ipHosts[ip], host)
+		}
+	}
+	return nil
+}
+
+func (r *recordingService) hosts(ip string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := []string{}
+	for host := range r.ipHosts[ip] {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (r *recordingService) List() ([]*HostMapping, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hostIPs := map[string][]string{}
+	for ip, hosts := range r.ipHosts {
+		for host := range hosts {
+			hostIPs[host] = append(hostIPs[host], ip)
+		}
+	}
+	return hostMappings(hostIPs), nil
+}
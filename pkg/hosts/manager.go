@@ -10,15 +10,18 @@ package hosts
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"net"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dimchansky/utfbom"
 	"github.com/freshwebio/cloud-uno/pkg/config"
-	"github.com/freshwebio/cloud-uno/pkg/netutils"
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 )
 
@@ -26,6 +29,12 @@ const cloudUnoOpenComment = "Added by Cloud::1"
 const cloudUnoCloseComment = "End of Cloud::1 section"
 const cloudUnoEntryMark = "cloud::1"
 
+// lockFileSuffix is added to the path of the hosts file to get the file
+// used to coordinate changes to the hosts file between Cloud::1 processes.
+// The lock file also holds a digest of the Cloud::1 section last written
+// by a Cloud::1 process so their changes aren't mistaken for hand edits.
+const lockFileSuffix = ".cloud-uno.lock"
+
 // Manager provides a service that deals with managing
 // hosts on the host machine as a part of cloud DNS emulation.
 type Manager struct {
@@ -33,6 +42,19 @@ type Manager struct {
 	Entries            []Entry
 	logger             *logrus.Entry
 	hasCloudUnoSection bool
+	lineEnding         string
+	backupDir          string
+	backupCount        int
+	readOnly           bool
+	now                func() time.Time
+	known              []byte
+	section            []string
+	watcher            *fsnotify.Watcher
+	aliases            []string
+	lockHandle         *os.File
+	owned              ownedHosts
+	closed             bool
+	mu                 sync.Mutex
 }
 
 // NewManager creates a new instance of a service that deals with managing
@@ -42,33 +64,81 @@ func NewManager(cfg *config.Config, logger *logrus.Entry) (Service, error) {
 	if *cfg.HostsPath != "" {
 		osHostsFilePath = os.ExpandEnv(filepath.FromSlash(*cfg.HostsPath))
 	}
+	backupDir := filepath.Join(filepath.Dir(osHostsFilePath), "cloud-uno-backups")
+	if cfg.HostsBackupDir != nil && *cfg.HostsBackupDir != "" {
+		backupDir = os.ExpandEnv(filepath.FromSlash(*cfg.HostsBackupDir))
+	}
+	backupCount := DefaultHostsBackups
+	if cfg.HostsBackups != nil {
+		backupCount = *cfg.HostsBackups
+	}
+	readOnly := cfg.HostsReadOnly != nil && *cfg.HostsReadOnly
 
 	mgr := &Manager{
-		Path:    osHostsFilePath,
-		Entries: []Entry{},
-		logger:  logger,
+		Path:        osHostsFilePath,
+		Entries:     []Entry{},
+		logger:      logger,
+		lineEnding:  eol,
+		backupDir:   backupDir,
+		backupCount: backupCount,
+		readOnly:    readOnly,
+		now:         time.Now,
+		owned:       ownedHosts{},
+	}
+	if readOnly {
+		// Nothing on the machine is changed in read-only mode,
+		// so there is no need for a loopback alias or a watch.
+		logger.Infof("managing %s in read-only mode, changes will be logged instead of written", osHostsFilePath)
+		data, err := mgr.load()
+		if err != nil {
+			return mgr, err
+		}
+		mgr.remember(data)
+		return mgr, nil
 	}
-	if err := mgr.load(); err != nil {
+	// The first thing a host manager does is to make sure there are aliases
+	// to the loopback address for the IPs the Cloud::1 server is reached by.
+	aliases, err := createServerIPAliases(cfg)
+	if err != nil {
+		return mgr, err
+	}
+	mgr.aliases = aliases
+	data, err := mgr.load()
+	if err != nil {
+		removeServerIPAliases(aliases)
 		return mgr, err
 	}
+	mgr.remember(data)
+	// Without a watch, edits made outside of the manager are still
+	// picked up the next time the manager changes the hosts file.
+	err = mgr.watch()
+	if err != nil {
+		logger.Warnf("failed to watch the hosts file for changes: %s", err)
+	}
 	return mgr, nil
 }
 
-func (m *Manager) load() error {
-	// The first thing a host manager does is to make sure there is an alias
-	// to the loopback address so that when the server is running in Docker
-	// with a static IP that it can be accessed from the host by that IP.
-	// (e.g. opening the cloud uno console in the browser)
-	err := netutils.CreateLoopBackAlias(netutils.DefaultContainerServerIP)
+// load reads the hosts file and parses its entries,
+// the raw contents of the hosts file are returned.
+func (m *Manager) load() ([]byte, error) {
+	data, err := ioutil.ReadFile(m.Path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	file, err := os.Open(m.Path)
-	if err != nil {
-		return err
+	return data, m.parse(data)
+}
+
+func (m *Manager) parse(data []byte) error {
+	// Line endings are kept as they are in the hosts file
+	// regardless of the os default.
+	m.lineEnding = eol
+	if bytes.Contains(data, []byte("\r\n")) {
+		m.lineEnding = "\r\n"
+	} else if len(data) > 0 {
+		m.lineEnding = "\n"
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(utfbom.SkipOnly(file))
+	m.Entries = []Entry{}
+	scanner := bufio.NewScanner(utfbom.SkipOnly(bytes.NewReader(data)))
 	inSection := false
 	hasOpenComment := false
 	hasCloseComment := false
@@ -96,6 +166,71 @@ func (m *Manager) load() error {
 	return nil
 }
 
+// update applies a change to the hosts file while holding the lock for it,
+// the hosts file is loaded and reconciled first so changes made by other processes
+// since it was last read are not lost. A backup of the hosts file is taken before it is written.
+func (m *Manager) update(change func(current []byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readOnly {
+		return m.dryRunLocked(change)
+	}
+
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := m.load()
+	if err != nil {
+		return err
+	}
+	current, err = m.reconcileLocked(current)
+	if err != nil {
+		return err
+	}
+	updated, err := change(current)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(updated, current) {
+		return m.parse(current)
+	}
+	err = m.backupLocked(current)
+	if err != nil {
+		return err
+	}
+	err = m.writeLocked(updated)
+	if err != nil {
+		return err
+	}
+	err = m.parse(updated)
+	if err != nil {
+		return err
+	}
+	m.remember(updated)
+	return m.recordSectionLocked()
+}
+
+func (m *Manager) lock() (func(), error) {
+	file, err := os.OpenFile(m.Path+lockFileSuffix, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	m.lockHandle = file
+	return func() {
+		m.lockHandle = nil
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
 func (m *Manager) getIPPosition(ip string) int {
 	position := -1
 	i := 0
@@ -109,19 +244,92 @@ func (m *Manager) getIPPosition(ip string) int {
 	return position
 }
 
-// Add one or more host entries.
+// Add one or more host entries, a host can be mapped to
+// one IPv4 address and one IPv6 address at the same time.
 func (m *Manager) Add(params *Params) error {
-	if net.ParseIP(*params.IP) == nil {
-		return fmt.Errorf("%q is an invalid IP address", *params.IP)
+	return m.Apply(nil, []*Params{params})
+}
+
+// Remove one or more host entries from one IP or
+// from an IPv4 and an IPv6 address.
+func (m *Manager) Remove(params *Params) error {
+	return m.Apply([]*Params{params}, nil)
+}
+
+// Apply removes and adds host entries with a single write to the hosts file.
+func (m *Manager) Apply(removals []*Params, additions []*Params) error {
+	removalIPs, err := paramsIPs(removals)
+	if err != nil {
+		return err
+	}
+	additionIPs, err := paramsIPs(additions)
+	if err != nil {
+		return err
+	}
+
+	err = m.update(func(current []byte) ([]byte, error) {
+		m.applyChanges(removals, removalIPs, additions, additionIPs)
+		return m.render(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, params := range removals {
+		m.owned.remove(removalIPs[i], strings.Split(*params.Hosts, ","))
 	}
-	hostsList := strings.Split(*params.Hosts, ",")
+	for i, params := range additions {
+		m.owned.add(additionIPs[i], strings.Split(*params.Hosts, ","))
+	}
+	return nil
+}
+
+func (m *Manager) applyChanges(removals []*Params, removalIPs [][]string, additions []*Params, additionIPs [][]string) {
+	for i, params := range removals {
+		m.removeHosts(removalIPs[i], strings.Split(*params.Hosts, ","))
+	}
+	for i, params := range additions {
+		m.addHosts(additionIPs[i], strings.Split(*params.Hosts, ","))
+	}
+}
+
+// List the hosts in the Cloud::1 section of the hosts file.
+func (m *Manager) List() ([]*HostMapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hostIPs := map[string][]string{}
+	for _, entry := range m.Entries {
+		if entry.IsComment() || entry.IP == "" || !entry.IsMarkedWith(cloudUnoEntryMark) {
+			continue
+		}
+		for _, host := range entry.Hosts {
+			hostIPs[host] = append(hostIPs[host], entry.IP)
+		}
+	}
+	return hostMappings(hostIPs), nil
+}
+
+func (m *Manager) addHosts(ips []string, hostsList []string) {
+	for _, ip := range ips {
+		m.addHostsToIP(ip, hostsList)
+	}
+	m.clean()
+	// Each host can only be configured to work for a single IPv4 and
+	// a single IPv6 address at a time, to ensure the provided IPs are used
+	// we need to make sure we clear all other references to the same hosts
+	// for the same type of address.
+	m.removeHostsFromOtherIPs(ips, hostsList)
+}
 
-	position := m.getIPPosition(*params.IP)
+func (m *Manager) addHostsToIP(ip string, hostsList []string) {
+	position := m.getIPPosition(ip)
 	if position == -1 {
 		// ip not already in hostsfile inside the cloud uno secton.
 		entry := Entry{
-			Raw:   buildRawLine(*params.IP, hostsList),
-			IP:    *params.IP,
+			Raw:   buildRawLine(ip, hostsList),
+			IP:    ip,
 			Hosts: hostsList,
 		}
 		entry.Mark(cloudUnoEntryMark)
@@ -142,13 +350,6 @@ func (m *Manager) Add(params *Params) error {
 		m.Entries[position].Hosts = hostsCopy
 		m.Entries[position].Raw = m.Entries[position].Export() // reset raw
 	}
-	m.clean()
-	// Each host can only be configured to work for a single IP at a time,
-	// to ensure the provided IP is used we need to make sure
-	// we clear all other references to the same hosts.
-	m.removeHostsFromOtherIPs(*params.IP, hostsList)
-	err := m.flush()
-	return err
 }
 
 func (m *Manager) addEntryInNewCloudUnoSection(entry Entry) {
@@ -164,9 +365,30 @@ func (m *Manager) addEntryInNewCloudUnoSection(entry Entry) {
 	)
 }
 
+// addEntryToCloudUnoSection renders IPv4 entries ahead of IPv6 entries
+// in the cloud uno section so the two mappings for a host are easy to spot.
 func (m *Manager) addEntryToCloudUnoSection(entry Entry) {
-	cloudUnoSectionClosePos := m.getCloseCloudUnoSectionPosition()
-	m.Entries = InsertIntoSlice(m.Entries, cloudUnoSectionClosePos, entry)
+	position := m.getCloseCloudUnoSectionPosition()
+	if isIPv4(entry.IP) {
+		firstIPv6Pos := m.getFirstCloudUnoIPv6Position()
+		if firstIPv6Pos != -1 {
+			position = firstIPv6Pos
+		}
+	}
+	m.Entries = InsertIntoSlice(m.Entries, position, entry)
+}
+
+func (m *Manager) getFirstCloudUnoIPv6Position() int {
+	position := -1
+	i := 0
+	for position == -1 && i < len(m.Entries) {
+		entry := m.Entries[i]
+		if !entry.IsComment() && entry.IsMarkedWith(cloudUnoEntryMark) && entry.IP != "" && !isIPv4(entry.IP) {
+			position = i
+		}
+		i++
+	}
+	return position
 }
 
 func (m *Manager) getCloseCloudUnoSectionPosition() int {
@@ -181,18 +403,12 @@ func (m *Manager) getCloseCloudUnoSectionPosition() int {
 	return position
 }
 
-// Remove one or more host entries.
-func (m *Manager) Remove(params *Params) error {
+func (m *Manager) removeHosts(ips []string, hostsList []string) {
 	var outputEntries []Entry
-	hostsList := strings.Split(*params.Hosts, ",")
-	if net.ParseIP(*params.IP) == nil {
-		return fmt.Errorf("%q is an invalid IP address", *params.IP)
-	}
-
 	for _, entry := range m.Entries {
 		// Bad lines, comments and entries outside of
 		// the cloud uno section just get re-added.
-		if entry.Err != nil || !entry.IsMarkedWith(cloudUnoEntryMark) || entry.IsComment() || entry.IP != *params.IP {
+		if entry.Err != nil || !entry.IsMarkedWith(cloudUnoEntryMark) || entry.IsComment() || !itemInSlice(entry.IP, ips) {
 			outputEntries = append(outputEntries, entry)
 		} else {
 			newHosts := removeEntryHosts(entry, hostsList)
@@ -201,6 +417,9 @@ func (m *Manager) Remove(params *Params) error {
 			if len(newHosts) > 0 {
 				newLineRaw := addHostsToLine(entry, newHosts)
 				newEntry := NewEntry(newLineRaw)
+				// Keep the entry in the cloud uno section, otherwise removing
+				// hosts from every remaining entry drops the section markers.
+				newEntry.Mark(cloudUnoEntryMark)
 				outputEntries = append(outputEntries, newEntry)
 			}
 		}
@@ -210,10 +429,9 @@ func (m *Manager) Remove(params *Params) error {
 	hasMarkedEntries := m.hasMarkedEntries()
 	if !hasMarkedEntries {
 		m.removeCloudUnoSection()
+		m.hasCloudUnoSection = false
 	}
 	m.clean()
-	err := m.flush()
-	return err
 }
 
 func (m *Manager) removeCloudUnoSection() {
@@ -244,19 +462,42 @@ func (m *Manager) hasMarkedEntries() bool {
 	return hasMarkedEntry
 }
 
-func (m *Manager) removeHostsFromOtherIPs(keepForIP string, hosts []string) {
-	for _, host := range hosts {
-		for pos, entry := range m.Entries {
-			if itemInSlice(host, entry.Hosts) && entry.IP != keepForIP {
-				entry.Hosts = removeFromSlice(host, entry.Hosts)
+// removeHostsFromOtherIPs removes hosts from the entries for addresses of the same
+// type as the IPs being kept, entries in the cloud uno section that are
+// left without any hosts are removed.
+func (m *Manager) removeHostsFromOtherIPs(keepForIPs []string, hosts []string) {
+	keepIPv4 := false
+	keepIPv6 := false
+	for _, ip := range keepForIPs {
+		keepIPv4 = keepIPv4 || isIPv4(ip)
+		keepIPv6 = keepIPv6 || !isIPv4(ip)
+	}
+	newEntries := []Entry{}
+	for _, entry := range m.Entries {
+		sameType := entry.IP != "" && ((isIPv4(entry.IP) && keepIPv4) || (!isIPv4(entry.IP) && keepIPv6))
+		if sameType && !itemInSlice(entry.IP, keepForIPs) {
+			for _, host := range hosts {
+				if itemInSlice(host, entry.Hosts) {
+					entry.Hosts = removeFromSlice(host, entry.Hosts)
+					entry.Raw = entry.Export()
+				}
+			}
+			if len(entry.Hosts) == 0 && entry.IsMarkedWith(cloudUnoEntryMark) {
+				continue
 			}
-			m.Entries[pos] = entry
 		}
+		newEntries = append(newEntries, entry)
 	}
+	m.Entries = newEntries
 }
 
+// clean tidies up the entries in the cloud uno section,
+// entries outside of it are left as they were written.
 func (m *Manager) clean() {
 	for pos, entry := range m.Entries {
+		if !entry.IsMarkedWith(cloudUnoEntryMark) || entry.IsComment() {
+			continue
+		}
 		entry.RemoveDuplicateHosts()
 		entry.SortHosts()
 		m.Entries[pos] = entry
@@ -288,40 +529,71 @@ func (m *Manager) hostsPerLine(count int) {
 	m.Entries = newEntries
 }
 
-// Flush any changes made to the hosts file.
-func (m *Manager) flush() error {
-	file, err := os.Create(m.Path)
+// render produces the contents of the hosts file from its entries.
+func (m *Manager) render() []byte {
+	var buf bytes.Buffer
+	for _, entry := range m.Entries {
+		m.logger.Debug(entry.Export())
+		buf.WriteString(entry.Export())
+		buf.WriteString(m.lineEnding)
+	}
+	return buf.Bytes()
+}
+
+// writeLocked replaces the hosts file by writing to a temporary file in the same
+// directory and renaming it over the hosts file, so the hosts file is never left
+// partially written. The ownership and mode of the hosts file are kept.
+// Renaming fails when the hosts file is a mount point, such as in a Docker container,
+// in which case the hosts file is written in place.
+func (m *Manager) writeLocked(data []byte) error {
+	path, err := filepath.EvalSymlinks(m.Path)
 	if err != nil {
 		return err
 	}
-	// Ensure we empty the file contents before writing
-	// the new hosts structure.
-	err = file.Truncate(0)
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	_, err = file.Seek(0, 0)
+	err = replaceFile(path, data, info)
 	if err != nil {
-		return err
+		m.logger.Warnf("failed to replace the hosts file atomically, writing in place instead: %s", err)
+		return ioutil.WriteFile(path, data, info.Mode().Perm())
 	}
+	return nil
+}
 
-	defer file.Close()
-
-	w := bufio.NewWriter(file)
-
-	for _, entry := range m.Entries {
-		m.logger.Info(entry.Export())
-		if _, err := fmt.Fprintf(w, "%s%s", entry.Export(), eol); err != nil {
-			return err
-		}
+func replaceFile(path string, data []byte, info os.FileInfo) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), ".hosts-cloud-uno-")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	err = writeAndClose(tempFile, data)
+	if err == nil {
+		err = os.Chmod(tempPath, info.Mode().Perm())
 	}
+	if err == nil {
+		err = chownLike(tempPath, info)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
 
-	err = w.Flush()
+func writeAndClose(file *os.File, data []byte) error {
+	_, err := file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
 	if err != nil {
 		return err
 	}
-
-	return m.load()
+	return closeErr
 }
 
 func normaliseComment(rawComment string) string {
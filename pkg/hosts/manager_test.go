@@ -13,14 +13,18 @@ package hosts
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sort"
 	"strings"
 
 	"github.com/dimchansky/utfbom"
 	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/netutils"
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	. "gopkg.in/check.v1"
 )
 
@@ -31,6 +35,44 @@ type ManagerSuite struct {
 
 var _ = Suite(&ManagerSuite{})
 
+func init() {
+	// Loopback aliases are tested in a network namespace in the netutils
+	// package, hosts tests never change the machine they run on.
+	createLoopBackAlias = func(ip string) (bool, error) {
+		return false, nil
+	}
+	removeLoopBackAlias = func(ip string) error {
+		return nil
+	}
+}
+
+// loopBackAliases records the loopback aliases created and removed
+// by a hosts service in place of changing the loopback interface.
+type loopBackAliases struct {
+	existing []string
+	created  []string
+	removed  []string
+}
+
+// install replaces the loopback alias funcs until the returned func is called.
+func (a *loopBackAliases) install() func() {
+	createOriginal, removeOriginal := createLoopBackAlias, removeLoopBackAlias
+	createLoopBackAlias = func(ip string) (bool, error) {
+		if itemInSlice(ip, a.existing) {
+			return false, nil
+		}
+		a.created = append(a.created, ip)
+		return true, nil
+	}
+	removeLoopBackAlias = func(ip string) error {
+		a.removed = append(a.removed, ip)
+		return nil
+	}
+	return func() {
+		createLoopBackAlias, removeLoopBackAlias = createOriginal, removeOriginal
+	}
+}
+
 type hostsManagerTestFixture struct {
 	expected string
 	input    string
@@ -45,8 +87,11 @@ func (s *ManagerSuite) SetUpSuite(c *C) {
 		"add1",
 		"add2",
 		"add3",
+		"add4",
+		"add5",
 		"remove1",
 		"remove2",
+		"remove3",
 	}
 	for _, prefix := range fixtureFilePrefixes {
 		expectedFilePath := fmt.Sprintf("testdata/manager/%s-expected.txt", prefix)
@@ -80,6 +125,32 @@ func (s *ManagerSuite) Test_add_entry_for_new_ip(c *C) {
 	s.addHostsTest(c, "add3", "172.18.0.24", "somethingnew.googleapis.local")
 }
 
+func (s *ManagerSuite) Test_add_entries_for_ipv4_and_ipv6_address_pair(c *C) {
+	s.addHostsTest(c, "add4", "172.18.0.24,fd00::24", "something.googleapis.local,dual.googleapis.local")
+}
+
+func (s *ManagerSuite) Test_add_ipv4_entry_keeps_existing_ipv6_entry_for_hosts(c *C) {
+	s.addHostsTest(c, "add5", "172.18.0.23", "secretmanager.googleapis.local,storage.googleapis.local")
+}
+
+func (s *ManagerSuite) Test_add_fails_for_more_than_one_address_of_the_same_type(c *C) {
+	hostsPath := fmt.Sprintf("%s/add-invalid-hosts", s.dir)
+	manager, err := s.setUpManagerForTest(hostsPath, "add3")
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	defer manager.(*Manager).Shutdown()
+
+	ip := "172.18.0.24,172.18.0.25"
+	hosts := "somethingnew.googleapis.local"
+	err = manager.Add(&Params{
+		IP:    &ip,
+		Hosts: &hosts,
+	})
+	c.Assert(err, ErrorMatches, ".*can only contain one IPv4 and one IPv6 address")
+}
+
 func (s *ManagerSuite) addHostsTest(c *C, fixtureName string, ip string, hosts string) {
 	hostsPath := fmt.Sprintf("%s/%s-hosts", s.dir, fixtureName)
 	manager, err := s.setUpManagerForTest(hostsPath, fixtureName)
@@ -87,6 +158,7 @@ func (s *ManagerSuite) addHostsTest(c *C, fixtureName string, ip string, hosts s
 		c.Error(err)
 		c.FailNow()
 	}
+	defer manager.(*Manager).Shutdown()
 
 	err = manager.Add(&Params{
 		IP:    &ip,
@@ -108,6 +180,144 @@ func (s *ManagerSuite) Test_remove_last_cloud_uno_host_entry(c *C) {
 	s.removeHostsTest(c, "remove2", "172.18.0.23", "storage.googleapis.local")
 }
 
+func (s *ManagerSuite) Test_remove_host_from_ipv4_and_ipv6_entries(c *C) {
+	s.removeHostsTest(c, "remove3", "172.18.0.22,fd00::22", "storage.googleapis.local")
+}
+
+func (s *ManagerSuite) Test_list_cloud_uno_hosts(c *C) {
+	hostsPath := fmt.Sprintf("%s/list-hosts", s.dir)
+	manager, err := s.setUpManagerForTest(hostsPath, "remove3")
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	defer manager.(*Manager).Shutdown()
+
+	mappings, err := manager.(*Manager).List()
+	c.Assert(err, IsNil)
+	c.Assert(mappings, DeepEquals, []*HostMapping{
+		{Host: "secretmanager.googleapis.local", IPs: []string{"172.18.0.22", "fd00::22"}},
+		{Host: "storage.googleapis.local", IPs: []string{"172.18.0.22", "fd00::22"}},
+	})
+}
+
+func (s *ManagerSuite) Test_apply_removals_and_additions_in_a_single_write(c *C) {
+	hostsPath := fmt.Sprintf("%s/apply-hosts", s.dir)
+	manager, err := s.setUpManagerForTest(hostsPath, "remove3")
+	if err != nil {
+		c.Error(err)
+		c.FailNow()
+	}
+	defer manager.(*Manager).Shutdown()
+	backupsBefore, err := manager.(*Manager).backups()
+	c.Assert(err, IsNil)
+
+	ips := "172.18.0.22,fd00::22"
+	removeHosts := "storage.googleapis.local"
+	ip := "172.18.0.24"
+	addHosts := "tasks.googleapis.local"
+	err = manager.(*Manager).Apply(
+		[]*Params{{IP: &ips, Hosts: &removeHosts}},
+		[]*Params{{IP: &ip, Hosts: &addHosts}},
+	)
+	c.Assert(err, IsNil)
+
+	mappings, err := manager.(*Manager).List()
+	c.Assert(err, IsNil)
+	c.Assert(mappings, DeepEquals, []*HostMapping{
+		{Host: "secretmanager.googleapis.local", IPs: []string{"172.18.0.22", "fd00::22"}},
+		{Host: "tasks.googleapis.local", IPs: []string{"172.18.0.24"}},
+	})
+	backups, err := manager.(*Manager).backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, len(backupsBefore)+1)
+}
+
+func (s *ManagerSuite) Test_plan_changes_without_writing_the_hosts_file(c *C) {
+	hostsPath := fmt.Sprintf("%s/plan-hosts", s.dir)
+	manager, _ := s.setUpReadOnlyManagerForTest(c, hostsPath, "remove3")
+	defer manager.Shutdown()
+
+	ips := "172.18.0.22,fd00::22"
+	removeHosts := "storage.googleapis.local"
+	ip := "172.18.0.24"
+	addHosts := "tasks.googleapis.local"
+	diff, err := manager.Plan(
+		[]*Params{{IP: &ips, Hosts: &removeHosts}},
+		[]*Params{{IP: &ip, Hosts: &addHosts}},
+	)
+	c.Assert(err, IsNil)
+	c.Assert(diff, Equals, fmt.Sprintf(`--- %[1]s
++++ %[1]s (planned)
+@@ -6,8 +6,9 @@
+ 127.0.0.1 local.example2.io api.local.example2.io player.local.example2.io
+ 
+ # Added by Cloud::1
+-172.18.0.22 secretmanager.googleapis.local storage.googleapis.local
+-fd00::22 secretmanager.googleapis.local storage.googleapis.local
++172.18.0.22 secretmanager.googleapis.local
++172.18.0.24 tasks.googleapis.local
++fd00::22 secretmanager.googleapis.local
+ # End of Cloud::1 section
+ 
+ # Added by Docker Desktop
+`, hostsPath))
+
+	persisted, err := ioutil.ReadFile(hostsPath)
+	c.Assert(err, IsNil)
+	c.Assert(string(persisted), Equals, s.fixtures["remove3"].input)
+
+	diff, err = manager.Plan(nil, []*Params{{IP: &ips, Hosts: &removeHosts}})
+	c.Assert(err, IsNil)
+	c.Assert(diff, Equals, "")
+}
+
+func (s *ManagerSuite) Test_read_only_mode_logs_changes_instead_of_writing_them(c *C) {
+	hostsPath := fmt.Sprintf("%s/read-only-hosts", s.dir)
+	manager, hook := s.setUpReadOnlyManagerForTest(c, hostsPath, "add1")
+	defer manager.Shutdown()
+	backupsBefore, err := manager.backups()
+	c.Assert(err, IsNil)
+
+	ip := "172.18.0.22"
+	hosts := "storage.googleapis.local"
+	c.Assert(manager.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+
+	persisted, err := ioutil.ReadFile(hostsPath)
+	c.Assert(err, IsNil)
+	c.Assert(string(persisted), Equals, s.fixtures["add1"].input)
+	backups, err := manager.backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, len(backupsBefore))
+	_, err = os.Stat(hostsPath + lockFileSuffix)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	entry := hook.LastEntry()
+	c.Assert(entry, NotNil)
+	c.Assert(entry.Message, Matches, "(?s)read-only mode, not writing the following changes.*\\+172\\.18\\.0\\.22 .*storage\\.googleapis\\.local.*")
+	mappings, err := manager.List()
+	c.Assert(err, IsNil)
+	for _, mapping := range mappings {
+		c.Assert(mapping.Host, Not(Equals), "storage.googleapis.local")
+	}
+}
+
+func (s *ManagerSuite) setUpReadOnlyManagerForTest(c *C, hostsPath string, fixtureName string) (*Manager, *test.Hook) {
+	err := ioutil.WriteFile(hostsPath, []byte(s.fixtures[fixtureName].input), 0644)
+	c.Assert(err, IsNil)
+	logger, hook := test.NewNullLogger()
+	readOnly := true
+	manager, err := NewManager(
+		&config.Config{
+			HostsPath:     &hostsPath,
+			HostsReadOnly: &readOnly,
+		},
+		logrus.NewEntry(logger),
+	)
+	c.Assert(err, IsNil)
+	return manager.(*Manager), hook
+}
+
 func (s *ManagerSuite) removeHostsTest(c *C, fixtureName string, ip string, hosts string) {
 	hostsPath := fmt.Sprintf("%s/%s-hosts", s.dir, fixtureName)
 	manager, err := s.setUpManagerForTest(hostsPath, fixtureName)
@@ -115,6 +325,7 @@ func (s *ManagerSuite) removeHostsTest(c *C, fixtureName string, ip string, host
 		c.Error(err)
 		c.FailNow()
 	}
+	defer manager.(*Manager).Shutdown()
 
 	err = manager.Remove(&Params{
 		IP:    &ip,
@@ -180,3 +391,103 @@ func normaliseHostsText(hostsText string) string {
 	}
 	return normalised
 }
+
+func (s *ManagerSuite) Test_stop_removes_only_the_hosts_the_manager_added(c *C) {
+	hostsPath := fmt.Sprintf("%s/stop-hosts", s.dir)
+	// The Cloud::1 section already holds hosts added by another
+	// Cloud::1 process sharing the hosts file.
+	manager, err := s.setUpManagerForTest(hostsPath, "add3")
+	c.Assert(err, IsNil)
+	ip := "172.18.0.24,fd00::24"
+	hosts := "somethingnew.googleapis.local,dual.googleapis.local"
+	c.Assert(manager.Add(&Params{IP: &ip, Hosts: &hosts}), IsNil)
+	removedIP := "fd00::24"
+	removedHosts := "dual.googleapis.local"
+	c.Assert(manager.Remove(&Params{IP: &removedIP, Hosts: &removedHosts}), IsNil)
+
+	err = manager.(*Manager).Stop(context.Background())
+	c.Assert(err, IsNil)
+	persisted, err := ioutil.ReadFile(hostsPath)
+	c.Assert(err, IsNil)
+	c.Assert(normaliseHostsText(string(persisted)), Equals, normaliseHostsText(s.fixtures["add3"].input))
+}
+
+func (s *ManagerSuite) Test_creates_loopback_alias_for_the_server_ip_and_removes_it_on_shutdown(c *C) {
+	aliases := &loopBackAliases{}
+	defer aliases.install()()
+	hostsPath := fmt.Sprintf("%s/alias-hosts", s.dir)
+	err := ioutil.WriteFile(hostsPath, []byte(s.fixtures["add1"].input), 0644)
+	c.Assert(err, IsNil)
+	serverIP := "172.18.0.30"
+	runOnHost := false
+
+	manager, err := NewManager(
+		&config.Config{HostsPath: &hostsPath, ServerIP: &serverIP, RunOnHost: &runOnHost},
+		logrus.New().WithFields(logrus.Fields{}),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(aliases.created, DeepEquals, []string{"172.18.0.30"})
+
+	err = manager.(*Manager).Shutdown()
+	c.Assert(err, IsNil)
+	c.Assert(aliases.removed, DeepEquals, []string{"172.18.0.30"})
+	// A second shutdown doesn't remove the alias again.
+	err = manager.(*Manager).Shutdown()
+	c.Assert(err, IsNil)
+	c.Assert(aliases.removed, DeepEquals, []string{"172.18.0.30"})
+}
+
+func (s *ManagerSuite) Test_leaves_an_existing_loopback_alias_in_place_on_shutdown(c *C) {
+	aliases := &loopBackAliases{existing: []string{netutils.DefaultContainerServerIP}}
+	defer aliases.install()()
+	hostsPath := fmt.Sprintf("%s/existing-alias-hosts", s.dir)
+	err := ioutil.WriteFile(hostsPath, []byte(s.fixtures["add1"].input), 0644)
+	c.Assert(err, IsNil)
+
+	manager, err := NewManager(&config.Config{HostsPath: &hostsPath}, logrus.New().WithFields(logrus.Fields{}))
+	c.Assert(err, IsNil)
+	err = manager.(*Manager).Shutdown()
+	c.Assert(err, IsNil)
+	c.Assert(aliases.created, IsNil)
+	c.Assert(aliases.removed, IsNil)
+}
+
+func (s *ManagerSuite) Test_creates_loopback_alias_for_the_metadata_ip_when_the_metadata_server_is_enabled(c *C) {
+	aliases := &loopBackAliases{}
+	defer aliases.install()()
+	hostsPath := fmt.Sprintf("%s/metadata-alias-hosts", s.dir)
+	err := ioutil.WriteFile(hostsPath, []byte(s.fixtures["add1"].input), 0644)
+	c.Assert(err, IsNil)
+	runOnHost := true
+	gcloudServices := "cloudstorage,metadata"
+
+	manager, err := NewManager(
+		&config.Config{HostsPath: &hostsPath, RunOnHost: &runOnHost, GCloudServices: &gcloudServices},
+		logrus.New().WithFields(logrus.Fields{}),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(aliases.created, DeepEquals, []string{netutils.MetadataIP})
+
+	err = manager.(*Manager).Shutdown()
+	c.Assert(err, IsNil)
+	c.Assert(aliases.removed, DeepEquals, []string{netutils.MetadataIP})
+}
+
+func (s *ManagerSuite) Test_does_not_create_a_loopback_alias_when_running_on_the_host(c *C) {
+	aliases := &loopBackAliases{}
+	defer aliases.install()()
+	hostsPath := fmt.Sprintf("%s/on-host-hosts", s.dir)
+	err := ioutil.WriteFile(hostsPath, []byte(s.fixtures["add1"].input), 0644)
+	c.Assert(err, IsNil)
+	runOnHost := true
+
+	manager, err := NewManager(
+		&config.Config{HostsPath: &hostsPath, RunOnHost: &runOnHost},
+		logrus.New().WithFields(logrus.Fields{}),
+	)
+	c.Assert(err, IsNil)
+	err = manager.(*Manager).Shutdown()
+	c.Assert(err, IsNil)
+	c.Assert(aliases.created, IsNil)
+	c.Assert(aliases.removed, IsNil)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Plan applies the removals and then the additions to a copy of the entries
+// in the hosts file and returns a unified diff of the hosts file that would be
+// written, nothing is written and the manager's entries are left as they are.
+func (m *Manager) Plan(removals []*Params, additions []*Params) (string, error) {
+	removalIPs, err := paramsIPs(removals)
+	if err != nil {
+		return "", err
+	}
+	additionIPs, err := paramsIPs(additions)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := ioutil.ReadFile(m.Path)
+	if err != nil {
+		return "", err
+	}
+	planned := &Manager{Path: m.Path, logger: m.logger}
+	err = planned.parse(current)
+	if err != nil {
+		return "", err
+	}
+	planned.applyChanges(removals, removalIPs, additions, additionIPs)
+	return unifiedDiff(m.Path, current, planned.render())
+}
+
+// dryRunLocked applies a change to the entries loaded from the hosts file
+// and logs the diff in place of writing it, the entries are then reset
+// to match the hosts file as it is.
+func (m *Manager) dryRunLocked(change func(current []byte) ([]byte, error)) error {
+	current, err := m.load()
+	if err != nil {
+		return err
+	}
+	updated, err := change(current)
+	if err != nil {
+		return err
+	}
+	diff, err := unifiedDiff(m.Path, current, updated)
+	if err != nil {
+		return err
+	}
+	if diff != "" {
+		m.logger.Infof("read-only mode, not writing the following changes to %s:\n%s", m.Path, diff)
+	}
+	return m.parse(current)
+}
+
+// unifiedDiff produces a unified diff between the current and planned contents
+// of a hosts file, ignoring line endings so only changes to entries show up.
+func unifiedDiff(path string, current []byte, planned []byte) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitHostsLines(current),
+		B:        splitHostsLines(planned),
+		FromFile: path,
+		ToFile:   path + " (planned)",
+		Context:  3,
+	})
+}
+
+func splitHostsLines(data []byte) []string {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	return difflib.SplitLines(strings.TrimSuffix(text, "\n"))
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/peer"
+)
+
+var (
+	// DefaultHostSuffixes provides the domain suffixes the host agent
+	// may add hosts for when none are configured, the suffixes Cloud::1
+	// emulators register hosts under. metadata.google.internal is the one
+	// host outside of the .local namespace, client libraries look up the
+	// metadata server by that exact name so it can't be moved under .local.
+	DefaultHostSuffixes = []string{"googleapis.local", "clouduno.local", "metadata.google.internal"}
+	// DefaultCIDRs provides the networks the host agent may point hosts at
+	// when none are configured, loopback and private network ranges.
+	DefaultCIDRs = []string{
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+	}
+	// ReservedHosts provides the hosts that are always denied
+	// as the os relies on them in the hosts file.
+	ReservedHosts = []string{
+		"localhost",
+		"localhost.localdomain",
+		"broadcasthost",
+		"ip6-localhost",
+		"ip6-loopback",
+	}
+	// ErrHostNotAllowed is returned when the host agent's policy
+	// doesn't allow a host to be pointed at an IP.
+	ErrHostNotAllowed = errors.New("not allowed by the host agent policy")
+)
+
+// Policy provides the hosts the host agent is allowed to add and the IPs it
+// can point them at, so the privileged host agent can't be used to redirect
+// hosts such as github.com. Requests that break the policy are audit logged.
+type Policy struct {
+	suffixes []string
+	networks []*net.IPNet
+	denied   []string
+	logger   *logrus.Entry
+}
+
+// NewPolicy creates the host agent policy from the host agent suffixes,
+// CIDRs and deny list, falling back to the defaults for the suffixes and CIDRs.
+func NewPolicy(cfg *config.Config, logger *logrus.Entry) (*Policy, error) {
+	suffixes := DefaultHostSuffixes
+	if cfg.HostAgentSuffixes != nil && *cfg.HostAgentSuffixes != "" {
+		suffixes = splitList(*cfg.HostAgentSuffixes)
+	}
+	cidrs := DefaultCIDRs
+	if cfg.HostAgentCIDRs != nil && *cfg.HostAgentCIDRs != "" {
+		cidrs = splitList(*cfg.HostAgentCIDRs)
+	}
+	denied := append([]string{}, ReservedHosts...)
+	if cfg.HostAgentDenyList != nil {
+		denied = append(denied, splitList(*cfg.HostAgentDenyList)...)
+	}
+
+	policy := &Policy{logger: logger}
+	for _, suffix := range suffixes {
+		policy.suffixes = append(policy.suffixes, normaliseHost(suffix))
+	}
+	for _, host := range denied {
+		policy.denied = append(policy.denied, normaliseHost(host))
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q is an invalid host agent CIDR: %w", cidr, err)
+		}
+		policy.networks = append(policy.networks, network)
+	}
+	return policy, nil
+}
+
+// Authorize checks the hosts can be pointed at the IPs, writing an audit log
+// entry for the client that made the request when they can't.
+func (p *Policy) Authorize(ctx context.Context, method string, owner string, ips []string, hosts []string) error {
+	err := p.check(ips, hosts)
+	if err == nil {
+		return nil
+	}
+	fields := logrus.Fields{
+		"audit":  true,
+		"method": method,
+		"owner":  owner,
+		"ips":    strings.Join(ips, ","),
+		"hosts":  strings.Join(hosts, ","),
+	}
+	if client, ok := peer.FromContext(ctx); ok {
+		fields["peer"] = client.Addr.String()
+	}
+	p.logger.WithFields(fields).Warnf("denied a request to the host agent: %s", err)
+	return err
+}
+
+// AllowsHost determines whether the host is one Cloud::1 emulators can register,
+// a host under one of the suffixes that isn't on the deny list.
+func (p *Policy) AllowsHost(host string) bool {
+	return p.check(nil, []string{host}) == nil
+}
+
+func (p *Policy) check(ips []string, hosts []string) error {
+	for _, ip := range ips {
+		if !p.allowedIP(net.ParseIP(ip)) {
+			return fmt.Errorf("IP %s is %w", ip, ErrHostNotAllowed)
+		}
+	}
+	for _, host := range hosts {
+		name := normaliseHost(host)
+		if matchesAny(name, p.denied) {
+			return fmt.Errorf("host %s is denied and is %w", host, ErrHostNotAllowed)
+		}
+		if !matchesAny(name, p.suffixes) {
+			return fmt.Errorf("host %s is %w", host, ErrHostNotAllowed)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) allowedIP(ip net.IP) bool {
+	for _, network := range p.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny determines whether a host is one of the given
+// domains or a subdomain of one of them.
+func matchesAny(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func normaliseHost(host string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(host), "."))
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) != "" {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	context "context"
+	"errors"
+	"net"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/peer"
+	. "gopkg.in/check.v1"
+)
+
+type PolicySuite struct {
+	logger *logrus.Logger
+	hook   *test.Hook
+}
+
+var _ = Suite(&PolicySuite{})
+
+func (s *PolicySuite) SetUpTest(c *C) {
+	s.logger, s.hook = test.NewNullLogger()
+}
+
+func (s *PolicySuite) policy(c *C, suffixes string, cidrs string, denyList string) *Policy {
+	policy, err := NewPolicy(&config.Config{
+		HostAgentSuffixes: &suffixes,
+		HostAgentCIDRs:    &cidrs,
+		HostAgentDenyList: &denyList,
+	}, logrus.NewEntry(s.logger))
+	c.Assert(err, IsNil)
+	return policy
+}
+
+func (s *PolicySuite) Test_allows_cloud_uno_hosts_on_private_networks_by_default(c *C) {
+	policy := s.policy(c, "", "", "")
+	ctx := context.Background()
+	allowed := []string{"storage.googleapis.local", "googleapis.local", "Console.CloudUno.Local.", "metadata.google.internal"}
+	for _, ip := range []string{"172.18.0.22", "127.0.0.1", "10.1.2.3", "192.168.1.5", "fd00::22", "::1"} {
+		c.Assert(policy.Authorize(ctx, "Add", "", []string{ip}, allowed), IsNil, Commentf("ip %s", ip))
+	}
+	c.Assert(s.hook.AllEntries(), HasLen, 0)
+}
+
+func (s *PolicySuite) Test_denies_other_hosts_and_public_ips_by_default(c *C) {
+	policy := s.policy(c, "", "", "")
+	ctx := context.Background()
+	denied := []string{"github.com", "evilgoogleapis.local", "googleapis.local.example.com", "localhost"}
+	for _, host := range denied {
+		err := policy.Authorize(ctx, "Add", "", []string{"172.18.0.22"}, []string{host})
+		c.Assert(errors.Is(err, ErrHostNotAllowed), Equals, true, Commentf("host %s", host))
+	}
+	for _, ip := range []string{"140.82.121.4", "2606:50c0:8000::153"} {
+		err := policy.Authorize(ctx, "Add", "", []string{ip}, []string{"storage.googleapis.local"})
+		c.Assert(errors.Is(err, ErrHostNotAllowed), Equals, true, Commentf("ip %s", ip))
+	}
+}
+
+func (s *PolicySuite) Test_uses_configured_suffixes_cidrs_and_deny_list(c *C) {
+	policy := s.policy(c, "example.internal,.googleapis.local", "172.18.0.0/16", "secret.example.internal")
+	ctx := context.Background()
+	c.Assert(policy.Authorize(ctx, "Add", "", []string{"172.18.0.22"}, []string{"api.example.internal"}), IsNil)
+	c.Assert(policy.Authorize(ctx, "Add", "", []string{"172.18.0.22"}, []string{"pubsub.googleapis.local"}), IsNil)
+
+	err := policy.Authorize(ctx, "Add", "", []string{"172.18.0.22"}, []string{"clouduno.local"})
+	c.Assert(errors.Is(err, ErrHostNotAllowed), Equals, true)
+	err = policy.Authorize(ctx, "Add", "", []string{"10.0.0.5"}, []string{"api.example.internal"})
+	c.Assert(errors.Is(err, ErrHostNotAllowed), Equals, true)
+	err = policy.Authorize(ctx, "Add", "", []string{"172.18.0.22"}, []string{"db.secret.example.internal"})
+	c.Assert(err, ErrorMatches, "host db.secret.example.internal is denied .*")
+}
+
+func (s *PolicySuite) Test_audit_logs_denied_requests(c *C) {
+	policy := s.policy(c, "", "", "")
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50123},
+	})
+	err := policy.Authorize(ctx, "Sync", "server-a", []string{"172.18.0.22"}, []string{"github.com"})
+	c.Assert(err, NotNil)
+
+	entry := s.hook.LastEntry()
+	c.Assert(entry, NotNil)
+	c.Assert(entry.Level, Equals, logrus.WarnLevel)
+	c.Assert(entry.Data["audit"], Equals, true)
+	c.Assert(entry.Data["method"], Equals, "Sync")
+	c.Assert(entry.Data["owner"], Equals, "server-a")
+	c.Assert(entry.Data["hosts"], Equals, "github.com")
+	c.Assert(entry.Data["peer"], Equals, "127.0.0.1:50123")
+}
+
+func (s *PolicySuite) Test_fails_for_invalid_cidrs(c *C) {
+	cidrs := "172.18.0.0"
+	_, err := NewPolicy(&config.Config{HostAgentCIDRs: &cidrs}, logrus.NewEntry(s.logger))
+	c.Assert(err, ErrorMatches, ".*invalid host agent CIDR.*")
+}
+
+func (s *PolicySuite) Test_allows_hosts_under_the_suffixes_that_are_not_denied(c *C) {
+	policy := s.policy(c, "", "", "secrets.googleapis.local")
+	c.Assert(policy.AllowsHost("storage.googleapis.local"), Equals, true)
+	c.Assert(policy.AllowsHost("console.clouduno.local"), Equals, true)
+	c.Assert(policy.AllowsHost("secrets.googleapis.local"), Equals, false)
+	c.Assert(policy.AllowsHost("github.com"), Equals, false)
+	c.Assert(policy.AllowsHost("localhost"), Equals, false)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ResolvedConfigPath provides the location of the systemd-resolved drop-in
+// that routes queries for emulator hosts to the embedded DNS server.
+const ResolvedConfigPath = "/etc/systemd/resolved.conf.d/cloud-uno.conf"
+
+// ResolvedConfig renders a systemd-resolved drop-in that sends queries for the
+// provided domains to the DNS server listening on addr, the domains are routing
+// only domains so queries for every other name are resolved as they were before.
+func ResolvedConfig(addr string, domains []string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		// systemd-resolved needs an address it can send queries to,
+		// a server listening on all interfaces can be reached on the loopback address.
+		host = "127.0.0.1"
+	}
+	routingDomains := []string{}
+	for _, domain := range domains {
+		routingDomains = append(routingDomains, "~"+strings.TrimSuffix(domain, "."))
+	}
+	return fmt.Sprintf(
+		"# %s\n[Resolve]\nDNS=%s\nDomains=%s\n",
+		cloudUnoOpenComment,
+		net.JoinHostPort(host, port),
+		strings.Join(routingDomains, " "),
+	), nil
+}
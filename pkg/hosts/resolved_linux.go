@@ -0,0 +1,45 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build linux
+
+package hosts
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ConfigureSystemdResolved deals with writing a systemd-resolved drop-in that sends
+// queries for the provided domains to the DNS server listening on addr.
+// systemd-resolved is only restarted when the drop-in has changed.
+func ConfigureSystemdResolved(path string, addr string, domains []string) error {
+	config, err := ResolvedConfig(addr, domains)
+	if err != nil {
+		return err
+	}
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(existing, []byte(config)) {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, []byte(config), 0644)
+	if err != nil {
+		return err
+	}
+	return exec.Command("systemctl", "restart", "systemd-resolved").Run()
+}
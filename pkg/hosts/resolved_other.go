@@ -0,0 +1,19 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build !linux
+
+package hosts
+
+import "errors"
+
+// ConfigureSystemdResolved is only supported on linux,
+// systemd-resolved isn't available anywhere else.
+func ConfigureSystemdResolved(path string, addr string, domains []string) error {
+	return errors.New("systemd-resolved can only be configured on linux")
+}
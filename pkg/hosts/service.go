@@ -10,6 +10,8 @@ package hosts
 
 // Params provides the parameters required
 // to add or remove a list of hosts to an IP.
+// IP can be a comma separated IPv4 and IPv6 address
+// to map the hosts to both at once. (e.g. "172.18.0.22,fd00::22")
 type Params struct {
 	IP    *string
 	Hosts *string
@@ -21,3 +23,63 @@ type Service interface {
 	Add(params *Params) error
 	Remove(params *Params) error
 }
+
+// Record provides a DNS record for a name in a zone, the data
+// is in the same presentation format as a zone file.
+// (e.g. "10 5 443 api.example.com." for an SRV record)
+type Record struct {
+	Name string
+	Type string
+	TTL  uint32
+	Data []string
+}
+
+// ZoneService provides a hosts service that can serve all the records
+// of a DNS zone, not just map hosts onto IPs. Emulators check whether
+// the hosts service in use supports zones and fall back to adding
+// hosts when it doesn't.
+type ZoneService interface {
+	Service
+	SetZone(name string, records []*Record) error
+	RemoveZone(name string) error
+}
+
+// BackupService provides a hosts service that keeps backups of the hosts
+// file before changing it and can roll the hosts file back to one of them.
+type BackupService interface {
+	Service
+	// Restore the hosts file from the backup with the given name,
+	// the most recent backup is restored when the name is empty.
+	Restore(backup string) error
+}
+
+// HostMapping provides the IPs a host is mapped to,
+// at most one IPv4 and one IPv6 address.
+type HostMapping struct {
+	Host string
+	IPs  []string
+}
+
+// ListService provides a hosts service that can list the hosts it manages.
+type ListService interface {
+	Service
+	// List the hosts managed by Cloud::1 sorted by host.
+	List() ([]*HostMapping, error)
+}
+
+// BatchService provides a hosts service that can apply several changes at once,
+// either all of the changes are applied or none of them are. Removals are applied
+// before additions.
+type BatchService interface {
+	Service
+	Apply(removals []*Params, additions []*Params) error
+}
+
+// PlanService provides a hosts service that can show the changes it would make
+// to the hosts file without making them.
+type PlanService interface {
+	Service
+	// Plan applies the removals and then the additions to a copy of the hosts file
+	// and returns a unified diff of the changes, the diff is empty when there are none.
+	Plan(removals []*Params, additions []*Params) (string, error)
+}
@@ -9,50 +9,43 @@
 package hosts
 
 import (
-	"errors"
-
 	"github.com/freshwebio/cloud-uno/pkg/config"
-	"github.com/freshwebio/cloud-uno/pkg/connect"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
 	"github.com/freshwebio/cloud-uno/pkg/types"
-	"github.com/freshwebio/cloud-uno/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	// ErrMissingOrInvalidHostsService provides the error to be used
-	// when the hosts service is not where it is expected to be in the service resolver.
-	ErrMissingOrInvalidHostsService = errors.New("hosts service missing in resolver container or is of an unexpected type")
+	// Key provides the key the hosts service is provided under in the service registry.
+	Key = types.NewKey[Service]("hosts")
 )
 
-// RegisterServices deals with registering host-specific
+// RegisterServices deals with registering the provider of host-specific
 // services to be used throughout the application.
-func RegisterServices(resolver types.Resolver) (err error) {
-	cfg, ok := resolver.Get("config").(*config.Config)
-	if !ok {
-		return config.ErrMissingOrInvalidConfigService
-	}
+func RegisterServices(r *types.Registry) {
+	types.Provide(r, Key, func(r *types.Registry) (Service, error) {
+		cfg := types.MustGet(r, config.Key)
+		logger := types.MustGet(r, logging.Key)
+		// If the cloud::1 server is running directly on the host machine then there
+		// is no need for communicating with a separate process with access to the os hosts file,
+		// with the right permissions it can interact with the os hosts file directly.
+		if *cfg.RunOnHost {
+			return NewService(cfg, logger)
+		}
+		return NewGRPCClient(cfg, logger)
+	}, types.Requires(config.Key, logging.Key))
+}
 
-	logger, ok := resolver.Get("logger").(*logrus.Entry)
-	if !ok {
-		return utils.ErrMissingOrInvalidLogger
+// NewService creates the service that resolves emulator hosts in-process,
+// an embedded DNS server when one is configured and otherwise a manager
+// for the os hosts file.
+func NewService(cfg *config.Config, logger *logrus.Entry) (Service, error) {
+	if *cfg.DNSServerAddr == "" {
+		return NewManager(cfg, logger)
 	}
-
-	var hostsService Service
-	// If the cloud::1 server is running directly on the host machine then there
-	// is no need for communicating with a separate process with access to the os hosts file,
-	// with the right permissions it can interact with the os hosts file directly.
-	if *cfg.RunOnHost {
-		hostsService, err = NewManager(cfg, logger)
-		if err != nil {
-			return
-		}
-	} else {
-		hostsService, err = NewGRPCClient(connect.DeriveHostAgentAddr())
-		if err != nil {
-			return
-		}
+	dnsServer, err := NewDNSServer(cfg, logger)
+	if err != nil {
+		return nil, err
 	}
-
-	resolver.Set("hosts", hostsService)
-	return
+	return dnsServer, nil
 }
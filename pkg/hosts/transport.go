@@ -0,0 +1,311 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	context "context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/certs"
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/connect"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	hostAgentTokenFile     = "token"
+	hostAgentCAFile        = "ca.pem"
+	hostAgentCAKeyFile     = "ca-key.pem"
+	hostAgentServerFile    = "server.pem"
+	hostAgentServerKeyFile = "server-key.pem"
+	hostAgentClientFile    = "client.pem"
+	hostAgentClientKeyFile = "client-key.pem"
+	// hostAgentServerName is the name clients verify the host agent's certificate
+	// against, a fixed name is used as the agent can be reached through any
+	// address and the certificate is only trusted through the host agent CA.
+	hostAgentServerName = "cloud-uno-host-agent"
+)
+
+var (
+	// ErrHostAgentUnauthenticated is returned to clients that don't
+	// send the host agent token with a request.
+	ErrHostAgentUnauthenticated = status.Error(codes.Unauthenticated, "a valid host agent token is required")
+)
+
+// Listen creates the listener the host agent serves gRPC on along with
+// the options for the gRPC server to authenticate clients.
+// By default the host agent listens on a unix socket that only the user running
+// the host agent can connect to, a tcp address requires clients to authenticate
+// with a shared secret token or a client certificate. The token and certificates
+// are created in the host agent credentials directory when they don't exist yet.
+func Listen(cfg *config.Config) (net.Listener, []grpc.ServerOption, error) {
+	network, addr := connect.HostAgentListenAddr(cfg)
+	if network == "unix" {
+		listener, err := listenUnix(addr)
+		return listener, nil, err
+	}
+
+	credsDir := connect.HostAgentCredsDir(cfg)
+	err := os.MkdirAll(credsDir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	var opts []grpc.ServerOption
+	switch *cfg.HostAgentAuth {
+	case config.HostAgentAuthToken:
+		token, err := loadOrCreateToken(filepath.Join(credsDir, hostAgentTokenFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		auth := &tokenAuth{token: token}
+		opts = []grpc.ServerOption{
+			grpc.UnaryInterceptor(auth.unary),
+			grpc.StreamInterceptor(auth.stream),
+		}
+	case config.HostAgentAuthMTLS:
+		tlsConfig, err := serverTLSConfig(credsDir, addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}
+	default:
+		return nil, nil, errors.New("host agent auth must be set to listen on a tcp address")
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, opts, nil
+}
+
+// dialOptions determines the target and options a client needs to connect
+// to the host agent with the credentials the host agent created.
+func dialOptions(cfg *config.Config) (string, []grpc.DialOption, error) {
+	network, addr := connect.DeriveHostAgentAddr(cfg)
+	if network == "unix" {
+		return "localhost", []grpc.DialOption{
+			// The unix socket is restricted to the user running the host agent,
+			// so there is no need for credentials on top.
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", addr)
+			}),
+		}, nil
+	}
+
+	credsDir := connect.HostAgentCredsDir(cfg)
+	switch *cfg.HostAgentAuth {
+	case config.HostAgentAuthToken:
+		tokenBytes, err := ioutil.ReadFile(filepath.Join(credsDir, hostAgentTokenFile))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read the host agent token, the host agent credentials directory must be shared with the server: %w", err)
+		}
+		return addr, []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithPerRPCCredentials(&tokenCredentials{token: strings.TrimSpace(string(tokenBytes))}),
+		}, nil
+	case config.HostAgentAuthMTLS:
+		tlsConfig, err := clientTLSConfig(credsDir)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to load the host agent certificates, the host agent credentials directory must be shared with the server: %w", err)
+		}
+		return addr, []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}, nil
+	}
+	return "", nil, errors.New("host agent auth must be set to connect to a tcp address")
+}
+
+// listenUnix listens on a unix socket that only the owner can connect to,
+// replacing a socket left behind by a host agent that is no longer running.
+func listenUnix(path string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a unix socket", path)
+		}
+		conn, dialErr := net.Dial("unix", path)
+		if dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a host agent is already listening on %s", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func loadOrCreateToken(path string) (string, error) {
+	tokenBytes, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(tokenBytes))) > 0 {
+		return strings.TrimSpace(string(tokenBytes)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+	return token, ioutil.WriteFile(path, []byte(token), 0600)
+}
+
+func serverTLSConfig(credsDir string, addr string) (*tls.Config, error) {
+	ca, err := certs.LoadOrCreateCA(
+		filepath.Join(credsDir, hostAgentCAFile),
+		filepath.Join(credsDir, hostAgentCAKeyFile),
+		"Cloud::1 Host Agent CA",
+	)
+	if err != nil {
+		return nil, err
+	}
+	serverHosts := []string{hostAgentServerName, "localhost", "127.0.0.1", "::1", "host.docker.internal"}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		serverHosts = append(serverHosts, host)
+	}
+	serverCert, err := ca.LoadOrIssue(
+		filepath.Join(credsDir, hostAgentServerFile),
+		filepath.Join(credsDir, hostAgentServerKeyFile),
+		hostAgentServerName,
+		serverHosts,
+		x509.ExtKeyUsageServerAuth,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Issue the client certificate up front so servers only need
+	// to read from the credentials directory.
+	_, err = ca.LoadOrIssue(
+		filepath.Join(credsDir, hostAgentClientFile),
+		filepath.Join(credsDir, hostAgentClientKeyFile),
+		"Cloud::1 Server",
+		nil,
+		x509.ExtKeyUsageClientAuth,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.CertPool(),
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func clientTLSConfig(credsDir string) (*tls.Config, error) {
+	pool, err := certs.LoadCAPool(filepath.Join(credsDir, hostAgentCAFile))
+	if err != nil {
+		return nil, err
+	}
+	clientCert, err := tls.LoadX509KeyPair(
+		filepath.Join(credsDir, hostAgentClientFile),
+		filepath.Join(credsDir, hostAgentClientKeyFile),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   hostAgentServerName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// tokenAuth checks every request to the host agent carries the shared secret token.
+type tokenAuth struct {
+	token string
+}
+
+func (a *tokenAuth) unary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if !a.authorized(ctx) {
+		return nil, ErrHostAgentUnauthenticated
+	}
+	return handler(ctx, req)
+}
+
+func (a *tokenAuth) stream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if !a.authorized(stream.Context()) {
+		return ErrHostAgentUnauthenticated
+	}
+	return handler(srv, stream)
+}
+
+func (a *tokenAuth) authorized(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	expected := []byte("Bearer " + a.token)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), expected) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenCredentials sends the shared secret token with every request to the host agent.
+type tokenCredentials struct {
+	token string
+}
+
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+// RequireTransportSecurity is false as the token is meant to keep other
+// processes and machines on a developer's network away from the host agent,
+// mtls should be used when requests to the host agent leave the machine.
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	context "context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+)
+
+type TransportSuite struct {
+	credsDir string
+	server   *grpc.Server
+}
+
+var _ = Suite(&TransportSuite{})
+
+func (s *TransportSuite) SetUpTest(c *C) {
+	s.credsDir = c.MkDir()
+	s.server = nil
+}
+
+func (s *TransportSuite) TearDownTest(c *C) {
+	if s.server != nil {
+		s.server.Stop()
+	}
+}
+
+func (s *TransportSuite) config(addr string, auth string) *config.Config {
+	credsDir := s.credsDir
+	return &config.Config{
+		HostAgentAddr:     &addr,
+		HostAgentAuth:     &auth,
+		HostAgentCredsDir: &credsDir,
+	}
+}
+
+// serve starts a host agent for the given config and returns
+// the address clients should connect to.
+func (s *TransportSuite) serve(c *C, cfg *config.Config) string {
+	listener, opts, err := Listen(cfg)
+	c.Assert(err, IsNil)
+	s.server = grpc.NewServer(opts...)
+	service := &recordingService{ipHosts: map[string]map[string]bool{}}
+	RegisterManagerServer(s.server, &GRPCServer{Impl: service})
+	go s.server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func (s *TransportSuite) list(c *C, cfg *config.Config) error {
+	target, opts, err := dialOptions(cfg)
+	c.Assert(err, IsNil)
+	conn, err := grpc.Dial(target, opts...)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = NewManagerClient(conn).List(ctx, &ListRequest{})
+	return err
+}
+
+func (s *TransportSuite) Test_serves_on_a_unix_socket_only_the_owner_can_use(c *C) {
+	cfg := s.config("", "")
+	s.serve(c, cfg)
+
+	socketPath := filepath.Join(s.credsDir, "hostagent.sock")
+	info, err := os.Stat(socketPath)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode()&os.ModeSocket, Not(Equals), os.FileMode(0))
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+	c.Assert(s.list(c, cfg), IsNil)
+
+	_, _, err = Listen(cfg)
+	c.Assert(err, ErrorMatches, "a host agent is already listening on .*")
+}
+
+func (s *TransportSuite) Test_replaces_a_stale_unix_socket(c *C) {
+	socketPath := filepath.Join(s.credsDir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	c.Assert(err, IsNil)
+	// Leave the socket file behind as a host agent that crashed would.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	cfg := s.config("unix://"+socketPath, "")
+	s.serve(c, cfg)
+	c.Assert(s.list(c, cfg), IsNil)
+}
+
+func (s *TransportSuite) Test_requires_a_token_over_tcp(c *C) {
+	addr := s.serve(c, s.config("127.0.0.1:0", config.HostAgentAuthToken))
+	cfg := s.config(addr, config.HostAgentAuthToken)
+	c.Assert(s.list(c, cfg), IsNil)
+
+	tokenPath := filepath.Join(s.credsDir, "token")
+	info, err := os.Stat(tokenPath)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	c.Assert(ioutil.WriteFile(tokenPath, []byte("not-the-token"), 0600), IsNil)
+	err = s.list(c, cfg)
+	c.Assert(status.Code(err), Equals, codes.Unauthenticated)
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = NewManagerClient(conn).List(context.Background(), &ListRequest{})
+	c.Assert(status.Code(err), Equals, codes.Unauthenticated)
+}
+
+func (s *TransportSuite) Test_requires_a_client_certificate_over_tcp(c *C) {
+	addr := s.serve(c, s.config("127.0.0.1:0", config.HostAgentAuthMTLS))
+	cfg := s.config(addr, config.HostAgentAuthMTLS)
+	c.Assert(s.list(c, cfg), IsNil)
+
+	for _, name := range []string{"ca-key.pem", "server-key.pem", "client-key.pem"} {
+		info, err := os.Stat(filepath.Join(s.credsDir, name))
+		c.Assert(err, IsNil)
+		c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+	}
+
+	c.Assert(os.Remove(filepath.Join(s.credsDir, "client.pem")), IsNil)
+	_, _, err := dialOptions(cfg)
+	c.Assert(err, ErrorMatches, "failed to load the host agent certificates.*")
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = NewManagerClient(conn).List(ctx, &ListRequest{})
+	c.Assert(status.Code(err), Equals, codes.Unavailable)
+}
@@ -10,6 +10,10 @@ package hosts
 
 import (
 	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 func itemInSlice(item string, list []string) bool {
@@ -39,3 +43,77 @@ func buildRawLine(ip string, hosts []string) string {
 
 	return output
 }
+
+// splitIPs parses a comma separated list of IP addresses that
+// a host can be mapped to, at most one IPv4 and one IPv6 address.
+func splitIPs(value string) ([]string, error) {
+	ips := []string{}
+	hasIPv4 := false
+	hasIPv6 := false
+	for _, ip := range strings.Split(value, ",") {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("%q is an invalid IP address", ip)
+		}
+		if (isIPv4(ip) && hasIPv4) || (!isIPv4(ip) && hasIPv6) {
+			return nil, fmt.Errorf("%q can only contain one IPv4 and one IPv6 address", value)
+		}
+		hasIPv4 = hasIPv4 || isIPv4(ip)
+		hasIPv6 = hasIPv6 || !isIPv4(ip)
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+var hostLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?$`)
+
+// validateHost checks a host is a valid DNS name so that it can't
+// break out of its line in the hosts file.
+func validateHost(host string) error {
+	name := strings.TrimSuffix(host, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("%q is an invalid host", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostLabelPattern.MatchString(label) {
+			return fmt.Errorf("%q is an invalid host", host)
+		}
+	}
+	return nil
+}
+
+func isIPv4(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() != nil
+}
+
+// paramsIPs parses the IPs for each of the provided parameters so a batch of
+// changes can be checked before any of them are applied.
+func paramsIPs(paramsList []*Params) ([][]string, error) {
+	ipsList := [][]string{}
+	for _, params := range paramsList {
+		ips, err := splitIPs(*params.IP)
+		if err != nil {
+			return nil, err
+		}
+		ipsList = append(ipsList, ips)
+	}
+	return ipsList, nil
+}
+
+// hostMappings sorts the IPs for hosts into a list of mappings sorted by host,
+// IPv4 addresses are listed before IPv6 addresses.
+func hostMappings(hostIPs map[string][]string) []*HostMapping {
+	mappings := []*HostMapping{}
+	for host, ips := range hostIPs {
+		sortedIPs := append([]string{}, ips...)
+		sort.SliceStable(sortedIPs, func(i, j int) bool {
+			return isIPv4(sortedIPs[i]) && !isIPv4(sortedIPs[j])
+		})
+		mappings = append(mappings, &HostMapping{Host: host, IPs: sortedIPs})
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Host < mappings[j].Host
+	})
+	return mappings
+}
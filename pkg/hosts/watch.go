@@ -0,0 +1,269 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package hosts
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// WatchDebounce is how long the hosts manager waits for changes to the hosts
+	// file to settle before reloading it, editors often save a file in several steps.
+	WatchDebounce = 100 * time.Millisecond
+)
+
+// watch starts watching the hosts file for changes made outside of the manager.
+// The directory is watched rather than the file itself as replacing the hosts
+// file with a rename, as the manager and many editors do, would end a watch
+// on the file.
+func (m *Manager) watch() error {
+	path, err := filepath.EvalSymlinks(m.Path)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	m.watcher = watcher
+	go m.handleWatchEvents(watcher, path, WatchDebounce)
+	return nil
+}
+
+func (m *Manager) handleWatchEvents(watcher *fsnotify.Watcher, path string, debounce time.Duration) {
+	var timer *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if filepath.Clean(event.Name) != path {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(debounce, m.reloadExternalChanges)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			m.logger.Warnf("failed to watch the hosts file for changes: %s", err)
+		}
+	}
+}
+
+func (m *Manager) reloadExternalChanges() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+
+	unlock, err := m.lock()
+	if err != nil {
+		m.logger.Errorf("failed to lock the hosts file to reload it: %s", err)
+		return
+	}
+	defer unlock()
+
+	current, err := m.load()
+	if err == nil {
+		_, err = m.reconcileLocked(current)
+	}
+	if err != nil {
+		m.logger.Errorf("failed to reload the hosts file after it was changed: %s", err)
+	}
+}
+
+// reconcileLocked merges edits made to the hosts file outside of the manager with the
+// Cloud::1 section the manager last wrote, the entries must already be loaded from
+// the current contents of the hosts file. Edits outside of the Cloud::1 section are kept
+// as they are and if the Cloud::1 section was removed it is added back.
+// When the Cloud::1 section itself was edited, the edit is kept and the section the
+// manager last wrote is saved as a backup so neither is lost. Changes to the section
+// made by other Cloud::1 processes sharing the hosts file are not edits, they are
+// taken on as they are without a backup.
+func (m *Manager) reconcileLocked(current []byte) ([]byte, error) {
+	if m.known == nil || bytes.Equal(current, m.known) {
+		m.remember(current)
+		return current, nil
+	}
+
+	section := m.sectionLines()
+	if m.isRecordedSectionLocked(section) {
+		m.remember(current)
+		return current, nil
+	}
+
+	if !m.hasCloudUnoSection && len(m.section) > 0 {
+		m.logger.Infof("adding back the Cloud::1 section removed from %s by an external edit", m.Path)
+		m.Entries = append(m.Entries, Entry{Raw: fmt.Sprintf("# %s", cloudUnoOpenComment)})
+		for _, line := range m.section {
+			entry := NewEntry(line)
+			entry.Mark(cloudUnoEntryMark)
+			m.Entries = append(m.Entries, entry)
+		}
+		m.Entries = append(m.Entries, Entry{Raw: fmt.Sprintf("# %s", cloudUnoCloseComment)})
+		m.hasCloudUnoSection = true
+		updated := m.render()
+		err := m.backupLocked(current)
+		if err != nil {
+			return nil, err
+		}
+		err = m.writeLocked(updated)
+		if err != nil {
+			return nil, err
+		}
+		m.remember(updated)
+		return updated, m.recordSectionLocked()
+	}
+
+	if !equalLines(section, m.section) {
+		m.logger.Warnf(
+			"conflict: the Cloud::1 section in %s was edited outside of Cloud::1, keeping the edit,"+
+				" the previous section is saved in a backup in %s\n-%s\n+%s",
+			m.Path,
+			m.backupDir,
+			strings.Join(m.section, "\n-"),
+			strings.Join(section, "\n+"),
+		)
+		err := m.backupLocked(m.known)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.remember(current)
+	return current, nil
+}
+
+// recordSectionLocked saves a digest of the Cloud::1 section the manager
+// last wrote to the lock file, the lock must be held.
+func (m *Manager) recordSectionLocked() error {
+	err := m.lockHandle.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = m.lockHandle.WriteAt([]byte(sectionDigest(m.section)), 0)
+	return err
+}
+
+// isRecordedSectionLocked determines whether the provided Cloud::1 section is the one
+// last written by a Cloud::1 process, the lock must be held.
+func (m *Manager) isRecordedSectionLocked(section []string) bool {
+	digest := sectionDigest(section)
+	recorded := make([]byte, len(digest)+1)
+	n, err := m.lockHandle.ReadAt(recorded, 0)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return string(recorded[:n]) == digest
+}
+
+// sectionDigest provides a digest of the lines in a Cloud::1 section.
+func sectionDigest(section []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(section, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// remember keeps track of the hosts file contents the manager knows about and the
+// Cloud::1 section in them so external edits can be told apart.
+func (m *Manager) remember(data []byte) {
+	m.known = data
+	m.section = m.sectionLines()
+}
+
+// sectionLines provides the entries in the Cloud::1 section
+// as they are written to the hosts file.
+func (m *Manager) sectionLines() []string {
+	lines := []string{}
+	for _, entry := range m.Entries {
+		isCloudUnoSectionComment := isOpenCommentEntry(entry) || isCloseCommentEntry(entry)
+		if entry.IsMarkedWith(cloudUnoEntryMark) && !isCloudUnoSectionComment {
+			lines = append(lines, entry.Export())
+		}
+	}
+	return lines
+}
+
+// Start does nothing as the manager starts watching the hosts file
+// when it is created, so changes made while other services register
+// their hosts are reconciled.
+func (m *Manager) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop deals with removing every host added through the manager with a single write
+// and then shutting down the manager. Hosts in the Cloud::1 section that were added
+// by other Cloud::1 processes sharing the hosts file are kept.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	byIP := m.owned.byIP()
+	m.mu.Unlock()
+	removals := []*Params{}
+	for _, ip := range sortedIPs(byIP) {
+		removals = append(removals, newParams(ip, byIP[ip]))
+	}
+	removeErr := m.Apply(removals, nil)
+	shutdownErr := m.Shutdown()
+	if removeErr != nil {
+		return removeErr
+	}
+	return shutdownErr
+}
+
+// Shutdown deals with stopping the watch on the hosts file
+// and removing the loopback aliases created by the manager.
+func (m *Manager) Shutdown() error {
+	m.mu.Lock()
+	m.closed = true
+	aliases := m.aliases
+	m.aliases = nil
+	m.mu.Unlock()
+	var watchErr error
+	if m.watcher != nil {
+		watchErr = m.watcher.Close()
+	}
+	aliasErr := removeServerIPAliases(aliases)
+	if watchErr != nil {
+		return watchErr
+	}
+	return aliasErr
+}
+
+func equalLines(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
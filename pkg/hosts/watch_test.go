@@ -0,0 +1,178 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package hosts
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/sirupsen/logrus"
+	. "gopkg.in/check.v1"
+)
+
+type WatchSuite struct {
+	hostsPath string
+	backupDir string
+	manager   *Manager
+}
+
+var _ = Suite(&WatchSuite{})
+
+func (s *WatchSuite) SetUpSuite(c *C) {
+	WatchDebounce = 10 * time.Millisecond
+}
+
+func (s *WatchSuite) SetUpTest(c *C) {
+	dir := c.MkDir()
+	s.hostsPath = filepath.Join(dir, "hosts")
+	s.backupDir = filepath.Join(dir, "backups")
+	err := ioutil.WriteFile(s.hostsPath, []byte("127.0.0.1 localhost\n"), 0644)
+	c.Assert(err, IsNil)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	backups := DefaultHostsBackups
+	service, err := NewManager(&config.Config{
+		HostsPath:      &s.hostsPath,
+		HostsBackupDir: &s.backupDir,
+		HostsBackups:   &backups,
+	}, logrus.NewEntry(logger))
+	c.Assert(err, IsNil)
+	s.manager = service.(*Manager)
+	c.Assert(s.manager.watcher, NotNil)
+
+	ip := "172.18.0.22"
+	hosts := "storage.googleapis.local"
+	err = s.manager.Add(&Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+}
+
+func (s *WatchSuite) TearDownTest(c *C) {
+	c.Assert(s.manager.Shutdown(), IsNil)
+}
+
+func (s *WatchSuite) readHosts(c *C) string {
+	data, err := ioutil.ReadFile(s.hostsPath)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *WatchSuite) writeHosts(c *C, hosts string) {
+	err := ioutil.WriteFile(s.hostsPath, []byte(hosts), 0644)
+	c.Assert(err, IsNil)
+}
+
+// waitFor checks a condition until it holds, the manager
+// reloads the hosts file in the background after it changes.
+func (s *WatchSuite) waitFor(c *C, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for the hosts file to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *WatchSuite) hasEntry(raw string) bool {
+	s.manager.mu.Lock()
+	defer s.manager.mu.Unlock()
+	for _, entry := range s.manager.Entries {
+		if entry.Raw == raw {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *WatchSuite) Test_reloads_edits_outside_of_the_cloud_uno_section(c *C) {
+	s.writeHosts(c, "10.0.0.1 printer.lan\n"+s.readHosts(c))
+	s.waitFor(c, func() bool { return s.hasEntry("10.0.0.1 printer.lan") })
+
+	ip := "172.18.0.23"
+	hosts := "pubsub.googleapis.local"
+	err := s.manager.Add(&Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+	c.Assert(s.readHosts(c), Equals, "10.0.0.1 printer.lan\n"+
+		"127.0.0.1 localhost\n"+
+		"# Added by Cloud::1\n"+
+		"172.18.0.22 storage.googleapis.local\n"+
+		"172.18.0.23 pubsub.googleapis.local\n"+
+		"# End of Cloud::1 section\n")
+}
+
+func (s *WatchSuite) Test_adds_back_a_removed_cloud_uno_section(c *C) {
+	s.writeHosts(c, "127.0.0.1 localhost\n10.0.0.1 printer.lan\n")
+	s.waitFor(c, func() bool { return strings.Contains(s.readHosts(c), "# End of Cloud::1 section") })
+
+	c.Assert(s.readHosts(c), Equals, "127.0.0.1 localhost\n"+
+		"10.0.0.1 printer.lan\n"+
+		"# Added by Cloud::1\n"+
+		"172.18.0.22 storage.googleapis.local\n"+
+		"# End of Cloud::1 section\n")
+}
+
+func (s *WatchSuite) Test_keeps_edits_to_the_cloud_uno_section_and_backs_up_the_previous_section(c *C) {
+	previous := s.readHosts(c)
+	edited := strings.Replace(previous, "172.18.0.22 storage.googleapis.local", "172.18.0.99 storage.googleapis.local", 1)
+	s.writeHosts(c, edited)
+	s.waitFor(c, func() bool { return s.hasEntry("172.18.0.99 storage.googleapis.local") })
+	c.Assert(s.readHosts(c), Equals, edited)
+
+	backups, err := s.manager.backups()
+	c.Assert(err, IsNil)
+	latest, err := ioutil.ReadFile(filepath.Join(s.backupDir, backups[len(backups)-1]))
+	c.Assert(err, IsNil)
+	c.Assert(string(latest), Equals, previous)
+
+	// The edited section is what later changes are made to.
+	ip := "172.18.0.23"
+	hosts := "pubsub.googleapis.local"
+	err = s.manager.Add(&Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+	c.Assert(s.readHosts(c), Matches, "(?s).*172.18.0.99 storage.googleapis.local\n172.18.0.23 pubsub.googleapis.local\n.*")
+}
+
+func (s *WatchSuite) Test_takes_on_changes_to_the_cloud_uno_section_made_by_other_cloud_uno_processes(c *C) {
+	backupsBefore, err := s.manager.backups()
+	c.Assert(err, IsNil)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	otherBackupDir := filepath.Join(filepath.Dir(s.backupDir), "other-backups")
+	backups := DefaultHostsBackups
+	other, err := NewManager(&config.Config{
+		HostsPath:      &s.hostsPath,
+		HostsBackupDir: &otherBackupDir,
+		HostsBackups:   &backups,
+	}, logrus.NewEntry(logger))
+	c.Assert(err, IsNil)
+	defer other.(*Manager).Shutdown()
+	ip := "172.18.0.23"
+	hosts := "pubsub.googleapis.local"
+	err = other.Add(&Params{IP: &ip, Hosts: &hosts})
+	c.Assert(err, IsNil)
+	s.waitFor(c, func() bool { return s.hasEntry("172.18.0.23 pubsub.googleapis.local") })
+
+	// The section written by the other process isn't a conflict,
+	// so the section the manager last wrote isn't backed up.
+	backupsAfter, err := s.manager.backups()
+	c.Assert(err, IsNil)
+	c.Assert(backupsAfter, DeepEquals, backupsBefore)
+	c.Assert(s.readHosts(c), Equals, "127.0.0.1 localhost\n"+
+		"# Added by Cloud::1\n"+
+		"172.18.0.22 storage.googleapis.local\n"+
+		"172.18.0.23 pubsub.googleapis.local\n"+
+		"# End of Cloud::1 section\n")
+}
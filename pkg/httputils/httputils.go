@@ -40,10 +40,10 @@ func HTTPErrorFromGRPC(w http.ResponseWriter, err error) {
 	if e, ok := status.FromError(err); ok {
 		switch e.Code() {
 		case codes.PermissionDenied:
-			message = "Permission denied"
+			message = fmt.Sprintf("Permission denied: %s", e.Message())
 			httpStatusCode = http.StatusForbidden
 		case codes.Unauthenticated:
-			message = "Unauthenticated"
+			message = fmt.Sprintf("Unauthenticated: %s", e.Message())
 			httpStatusCode = http.StatusUnauthorized
 		case codes.Unimplemented:
 			message = "Not implemented"
@@ -51,6 +51,15 @@ func HTTPErrorFromGRPC(w http.ResponseWriter, err error) {
 		case codes.InvalidArgument:
 			message = fmt.Sprintf("Invalid argument: %s", err.Error())
 			httpStatusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			message = fmt.Sprintf("Failed precondition: %s", e.Message())
+			httpStatusCode = http.StatusBadRequest
+		case codes.NotFound:
+			message = fmt.Sprintf("Not found: %s", e.Message())
+			httpStatusCode = http.StatusNotFound
+		case codes.AlreadyExists, codes.Aborted:
+			message = fmt.Sprintf("Conflict: %s", e.Message())
+			httpStatusCode = http.StatusConflict
 		}
 	}
 	HTTPError(
@@ -8,7 +8,15 @@
 
 package logging
 
-import "github.com/sirupsen/logrus"
+import (
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Key provides the key the logger is provided under in the service registry.
+	Key = types.NewKey[*logrus.Entry]("logger")
+)
 
 // CreateLogger deals with creating a logger to be used
 // throughout the application.
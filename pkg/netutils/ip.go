@@ -9,10 +9,10 @@
 package netutils
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"os/exec"
-	"runtime"
+	"os"
 
 	"github.com/freshwebio/cloud-uno/pkg/config"
 )
@@ -26,10 +26,15 @@ const DefaultContainerServerIP = "172.18.0.22"
 // on a host machine.
 const DefaultHostServerIP = "127.0.0.1"
 
+// MetadataIP provides the link-local address of the Compute Engine
+// metadata server, client libraries fall back to it when
+// metadata.google.internal can not be resolved.
+const MetadataIP = "169.254.169.254"
+
 // SelectServerIP deals with selecting the correct IP the Cloud::1
 // server is running on for the current environment.
 func SelectServerIP(cfg *config.Config) (string, error) {
-	if *cfg.ServerIP != DefaultContainerServerIP {
+	if cfg.ServerIP != nil && *cfg.ServerIP != DefaultContainerServerIP {
 		ip := *cfg.ServerIP
 		// Only validate IP when a custom IP has been provided.
 		if net.ParseIP(ip) == nil {
@@ -37,7 +42,7 @@ func SelectServerIP(cfg *config.Config) (string, error) {
 		}
 		return ip, nil
 	}
-	if *cfg.RunOnHost {
+	if cfg.RunOnHost != nil && *cfg.RunOnHost {
 		return DefaultHostServerIP, nil
 	}
 	return DefaultContainerServerIP, nil
@@ -50,22 +55,42 @@ func SelectServerIP(cfg *config.Config) (string, error) {
 // have running on port 80 on your local machine and allows us to channel
 // all cloud uno host names to a separate IP.
 // This is ONLY supported for linux and darwin platforms!
+// Creating an alias that already exists is not an error, the returned bool
+// reports whether the alias was added so only aliases created by the caller
+// are removed with RemoveLoopBackAlias.
 // Loop back aliases created by this function are not persistent, the program
 // that calls this function will need to run again on reboot.
-func CreateLoopBackAlias(ip string) error {
-	// Make sure the IP is safe to inject by making sure it's a valid IP.
-	if net.ParseIP(ip) == nil {
+func CreateLoopBackAlias(ip string) (bool, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, invalidIPError(ip)
+	}
+	return addLoopBackAddr(parsed)
+}
+
+// RemoveLoopBackAlias deals with removing an alias for the loopback
+// address created by CreateLoopBackAlias, removing an alias
+// that does not exist is not an error.
+func RemoveLoopBackAlias(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
 		return invalidIPError(ip)
 	}
+	return removeLoopBackAddr(parsed)
+}
 
-	if runtime.GOOS == "darwin" {
-		cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("sudo ifconfig lo0 alias %s", ip))
-		return cmd.Run()
-	} else if runtime.GOOS == "linux" {
-		cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("sudo ifconfig eth0:0 %s netmask 255.255.255.0 up", ip))
-		return cmd.Run()
+// loopBackError adds context to an error from changing the addresses
+// of the loopback interface, calling out missing privileges
+// as the most likely cause.
+func loopBackError(action string, ip net.IP, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf(
+			"permission denied trying to %s the loopback alias %s, "+
+				"run as root (or with the CAP_NET_ADMIN capability on linux): %w",
+			action, ip, err,
+		)
 	}
-	return nil
+	return fmt.Errorf("failed to %s the loopback alias %s: %w", action, ip, err)
 }
 
 func invalidIPError(ip string) error {
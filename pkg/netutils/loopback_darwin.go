@@ -0,0 +1,88 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package netutils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// loopBackInterface is the name of the loopback interface on darwin.
+const loopBackInterface = "lo0"
+
+func addLoopBackAddr(ip net.IP) (bool, error) {
+	exists, err := hasLoopBackAddr(ip)
+	if err != nil {
+		return false, loopBackError("add", ip, err)
+	}
+	if exists {
+		return false, nil
+	}
+	args := []string{loopBackInterface, "alias", ip.String()}
+	if ip.To4() == nil {
+		args = []string{loopBackInterface, "inet6", ip.String(), "prefixlen", "128", "alias"}
+	}
+	err = ifconfig(args...)
+	if err != nil {
+		return false, loopBackError("add", ip, err)
+	}
+	return true, nil
+}
+
+func removeLoopBackAddr(ip net.IP) error {
+	exists, err := hasLoopBackAddr(ip)
+	if err != nil {
+		return loopBackError("remove", ip, err)
+	}
+	if !exists {
+		return nil
+	}
+	args := []string{loopBackInterface, "-alias", ip.String()}
+	if ip.To4() == nil {
+		args = []string{loopBackInterface, "inet6", ip.String(), "-alias"}
+	}
+	err = ifconfig(args...)
+	if err != nil {
+		return loopBackError("remove", ip, err)
+	}
+	return nil
+}
+
+func hasLoopBackAddr(ip net.IP) (bool, error) {
+	iface, err := net.InterfaceByName(loopBackInterface)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func ifconfig(args ...string) error {
+	// ifconfig doesn't exit with a distinct status when privileges are missing.
+	if os.Geteuid() != 0 {
+		return os.ErrPermission
+	}
+	output, err := exec.Command("ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
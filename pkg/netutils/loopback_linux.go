@@ -0,0 +1,98 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package netutils
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// loopBackInterface is the name of the loopback interface on linux.
+const loopBackInterface = "lo"
+
+// loopBackLabel identifies aliases created by Cloud::1 in the
+// output of ip addr, labels must start with the interface name.
+const loopBackLabel = "lo:cloud-uno"
+
+func addLoopBackAddr(ip net.IP) (bool, error) {
+	link, err := netlink.LinkByName(loopBackInterface)
+	if err != nil {
+		return false, loopBackError("add", ip, err)
+	}
+	// The loopback interface starts out down in a new network namespace.
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		err = netlink.LinkSetUp(link)
+		if err != nil {
+			return false, loopBackError("add", ip, err)
+		}
+	}
+	exists, err := hasLoopBackAddr(link, ip)
+	if err != nil {
+		return false, loopBackError("add", ip, err)
+	}
+	if exists {
+		return false, nil
+	}
+	addr := &netlink.Addr{IPNet: hostIPNet(ip)}
+	if ip.To4() != nil {
+		addr.Label = loopBackLabel
+	}
+	err = netlink.AddrAdd(link, addr)
+	if errors.Is(err, syscall.EEXIST) {
+		return false, nil
+	}
+	if err != nil {
+		return false, loopBackError("add", ip, err)
+	}
+	return true, nil
+}
+
+func removeLoopBackAddr(ip net.IP) error {
+	link, err := netlink.LinkByName(loopBackInterface)
+	if err != nil {
+		return loopBackError("remove", ip, err)
+	}
+	exists, err := hasLoopBackAddr(link, ip)
+	if err != nil {
+		return loopBackError("remove", ip, err)
+	}
+	if !exists {
+		return nil
+	}
+	err = netlink.AddrDel(link, &netlink.Addr{IPNet: hostIPNet(ip)})
+	if err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return loopBackError("remove", ip, err)
+	}
+	return nil
+}
+
+func hasLoopBackAddr(link netlink.Link, ip net.IP) (bool, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hostIPNet provides a network with only the given IP in it, so the alias
+// doesn't route a whole subnet to the loopback interface.
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package netutils
+
+import (
+	"net"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type LoopBackSuite struct{}
+
+var _ = Suite(&LoopBackSuite{})
+
+// inNetworkNamespace runs the test in a new network namespace so the
+// loopback interface of the machine running the tests is never changed.
+func inNetworkNamespace(c *C, test func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	c.Assert(err, IsNil)
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		c.Skip("creating a network namespace requires root: " + err.Error())
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+	test()
+}
+
+func loopBackIPs(c *C) []string {
+	link, err := netlink.LinkByName("lo")
+	c.Assert(err, IsNil)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	c.Assert(err, IsNil)
+	ips := []string{}
+	for _, addr := range addrs {
+		ips = append(ips, addr.IPNet.String())
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func (s *LoopBackSuite) Test_creates_alias_on_the_loopback_interface(c *C) {
+	inNetworkNamespace(c, func() {
+		added, err := CreateLoopBackAlias("172.18.0.22")
+		c.Assert(err, IsNil)
+		c.Assert(added, Equals, true)
+
+		link, err := netlink.LinkByName("lo")
+		c.Assert(err, IsNil)
+		c.Assert(link.Attrs().Flags&net.FlagUp, Equals, net.FlagUp)
+		c.Assert(loopBackIPs(c), DeepEquals, []string{"127.0.0.1/8", "172.18.0.22/32", "::1/128"})
+	})
+}
+
+func (s *LoopBackSuite) Test_creating_an_existing_alias_is_a_no_op(c *C) {
+	inNetworkNamespace(c, func() {
+		added, err := CreateLoopBackAlias("172.18.0.22")
+		c.Assert(err, IsNil)
+		c.Assert(added, Equals, true)
+
+		added, err = CreateLoopBackAlias("172.18.0.22")
+		c.Assert(err, IsNil)
+		c.Assert(added, Equals, false)
+		c.Assert(loopBackIPs(c), DeepEquals, []string{"127.0.0.1/8", "172.18.0.22/32", "::1/128"})
+	})
+}
+
+func (s *LoopBackSuite) Test_does_not_report_an_ip_already_on_the_loopback_interface_as_added(c *C) {
+	inNetworkNamespace(c, func() {
+		added, err := CreateLoopBackAlias("127.0.0.1")
+		c.Assert(err, IsNil)
+		c.Assert(added, Equals, false)
+	})
+}
+
+func (s *LoopBackSuite) Test_creates_ipv6_alias_on_the_loopback_interface(c *C) {
+	inNetworkNamespace(c, func() {
+		added, err := CreateLoopBackAlias("fd00::22")
+		c.Assert(err, IsNil)
+		c.Assert(added, Equals, true)
+		c.Assert(loopBackIPs(c), DeepEquals, []string{"127.0.0.1/8", "::1/128", "fd00::22/128"})
+	})
+}
+
+func (s *LoopBackSuite) Test_removes_alias_from_the_loopback_interface(c *C) {
+	inNetworkNamespace(c, func() {
+		_, err := CreateLoopBackAlias("172.18.0.22")
+		c.Assert(err, IsNil)
+
+		err = RemoveLoopBackAlias("172.18.0.22")
+		c.Assert(err, IsNil)
+		c.Assert(loopBackIPs(c), DeepEquals, []string{"127.0.0.1/8", "::1/128"})
+
+		// Removing an alias that no longer exists is not an error.
+		err = RemoveLoopBackAlias("172.18.0.22")
+		c.Assert(err, IsNil)
+	})
+}
+
+func (s *LoopBackSuite) Test_fails_for_an_invalid_ip(c *C) {
+	_, err := CreateLoopBackAlias("172.18.0")
+	c.Assert(err, ErrorMatches, "invalid IP address 172.18.0 .*")
+	err = RemoveLoopBackAlias("sh -c reboot")
+	c.Assert(err, ErrorMatches, "invalid IP address sh -c reboot .*")
+}
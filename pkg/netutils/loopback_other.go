@@ -0,0 +1,24 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build !linux && !darwin
+
+package netutils
+
+import "net"
+
+// Loopback aliases are not supported on other platforms, the Cloud::1
+// server needs to be reachable from the host in some other way.
+
+func addLoopBackAddr(ip net.IP) (bool, error) {
+	return false, nil
+}
+
+func removeLoopBackAddr(ip net.IP) error {
+	return nil
+}
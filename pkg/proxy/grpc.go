@@ -0,0 +1,205 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// frame holds a gRPC message exactly as it was received
+// so it can be proxied without knowing its type.
+type frame struct {
+	payload []byte
+}
+
+// frameCodec passes frames through untouched and encodes every other message
+// with the proto codec, so the gRPC server can still serve its own services.
+type frameCodec struct{}
+
+func (frameCodec) Marshal(v interface{}) ([]byte, error) {
+	if f, ok := v.(*frame); ok {
+		return f.payload, nil
+	}
+	return encoding.GetCodec("proto").Marshal(v)
+}
+
+func (frameCodec) Unmarshal(data []byte, v interface{}) error {
+	if f, ok := v.(*frame); ok {
+		f.payload = append([]byte{}, data...)
+		return nil
+	}
+	return encoding.GetCodec("proto").Unmarshal(data, v)
+}
+
+func (frameCodec) Name() string {
+	return "proto"
+}
+
+// ServerOptions provides the options a gRPC server needs to proxy calls for
+// registered hosts, calls to services the server doesn't know about
+// are proxied based on the host they were made for.
+func (p *Proxy) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ForceServerCodec(frameCodec{}),
+		grpc.UnknownServiceHandler(p.handleStream),
+	}
+}
+
+// StreamServerInterceptor provides a gRPC interceptor, to be placed before any other
+// interceptor, that proxies calls for registered hosts straight away. Cloud::1 IAM
+// and project interceptors don't apply to emulators Cloud::1 doesn't implement.
+func (p *Proxy) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if p.proxies(authority(stream.Context())) {
+			return p.handleStream(srv, stream)
+		}
+		return handler(srv, stream)
+	}
+}
+
+func (p *Proxy) handleStream(srv interface{}, serverStream grpc.ServerStream) error {
+	fullMethod, _ := grpc.MethodFromServerStream(serverStream)
+	ctx := serverStream.Context()
+	u, proxied, err := p.pick(authority(ctx))
+	if !proxied {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", fullMethod)
+	}
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	conn, err := p.clientConn(u.addr)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	delete(md, ":authority")
+	clientCtx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	defer cancel()
+	clientStream, err := conn.NewStream(
+		clientCtx,
+		&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+		fullMethod,
+		grpc.ForceCodec(frameCodec{}),
+	)
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			p.setHealthy(u, false, err)
+		}
+		return err
+	}
+
+	requestErrs := forwardRequests(serverStream, clientStream)
+	responseErrs := forwardResponses(clientStream, serverStream)
+	for {
+		select {
+		case err := <-requestErrs:
+			if err == io.EOF {
+				// The caller has finished sending,
+				// the upstream can still respond.
+				clientStream.CloseSend()
+				requestErrs = nil
+				continue
+			}
+			return status.Errorf(codes.Internal, "failed to proxy the request: %s", err)
+		case err := <-responseErrs:
+			serverStream.SetTrailer(clientStream.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// forwardRequests sends the messages from the caller to the upstream until the
+// caller stops sending, the error the forwarding ended with is sent on the channel.
+func forwardRequests(src grpc.ServerStream, dst grpc.ClientStream) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			f := &frame{}
+			err := src.RecvMsg(f)
+			if err == nil {
+				err = dst.SendMsg(f)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+// forwardResponses sends the headers and messages from the upstream to the caller,
+// the error the upstream finished with (io.EOF for OK) is sent on the channel.
+func forwardResponses(src grpc.ClientStream, dst grpc.ServerStream) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; ; i += 1 {
+			f := &frame{}
+			err := src.RecvMsg(f)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if i == 0 {
+				// Headers are only available once the first message
+				// has been received and must be sent before it.
+				header, err := src.Header()
+				if err == nil {
+					err = dst.SendHeader(header)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			err = dst.SendMsg(f)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+// clientConn provides the connection used to proxy gRPC calls to an upstream,
+// gRPC multiplexes calls over the connection so one is kept for each upstream.
+func (p *Proxy) clientConn(addr string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+func authority(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(":authority"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// Handler provides a HTTP handler that proxies requests for registered hosts and
+// passes every other request on to the next handler. Websocket upgrades are
+// proxied as they are so both ends of the connection talk directly.
+func (p *Proxy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, proxied, err := p.pick(r.Host)
+		if !proxied {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			p.logger.Debug(err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		u.httpProxy.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) newUpstream(addr string) *upstream {
+	u := &upstream{addr: addr, healthy: true}
+	u.httpProxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// The host header is kept so emulators see
+			// the host the request was made for.
+			r.URL.Scheme = "http"
+			r.URL.Host = addr
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		},
+		// Responses are streamed as they are written, emulators such as
+		// Firestore hold responses open to push changes to listeners.
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Op == "dial" {
+				p.setHealthy(u, false, err)
+			}
+			p.logger.Errorf("failed to proxy a request for %s to %s: %s", r.Host, addr, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return u
+}
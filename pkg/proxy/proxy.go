@@ -0,0 +1,233 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+var (
+	// HealthCheckInterval provides how often the proxy checks
+	// whether upstreams are accepting connections.
+	HealthCheckInterval = 5 * time.Second
+	// HealthCheckTimeout provides how long the proxy waits
+	// to connect to an upstream before marking it unhealthy.
+	HealthCheckTimeout = time.Second
+	// ErrNoHealthyUpstream is returned when every upstream
+	// for a host has failed its health checks.
+	ErrNoHealthyUpstream = errors.New("no healthy upstream")
+)
+
+// Proxy routes requests for registered hosts to emulators that listen on their own
+// addresses, such as vendor emulators running in their own containers, so every
+// emulator is reachable through the Cloud::1 server.
+// HTTP/1.1, HTTP/2 and websocket requests are proxied by the HTTP handler
+// and gRPC calls by the gRPC server options.
+type Proxy struct {
+	mu           sync.RWMutex
+	routes       map[string]*route
+	conns        map[string]*grpc.ClientConn
+	hostsService hosts.Service
+	serverIP     string
+	logger       *logrus.Entry
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+// route provides the upstreams requests for a host are spread across.
+type route struct {
+	host      string
+	upstreams []*upstream
+	next      int
+}
+
+// upstream provides an address requests are proxied to, upstreams are healthy
+// until a health check or a proxied request fails to connect to them.
+type upstream struct {
+	addr      string
+	healthy   bool
+	httpProxy *httputil.ReverseProxy
+}
+
+// New creates a proxy that points registered hosts at the server IP with the
+// hosts service, the health of upstreams is checked until the proxy is shut down.
+func New(hostsService hosts.Service, serverIP string, logger *logrus.Entry) *Proxy {
+	p := &Proxy{
+		routes:       map[string]*route{},
+		conns:        map[string]*grpc.ClientConn{},
+		hostsService: hostsService,
+		serverIP:     serverIP,
+		logger:       logger,
+		stop:         make(chan struct{}),
+	}
+	go p.checkHealthPeriodically()
+	return p
+}
+
+// Register deals with routing requests for a host to one or more upstream
+// addresses (host:port), replacing any upstreams the host already has.
+func (p *Proxy) Register(host string, upstreams ...string) error {
+	host = normaliseHost(host)
+	if host == "" || len(upstreams) == 0 {
+		return fmt.Errorf("a host and at least one upstream are required to proxy requests")
+	}
+	r := &route{host: host}
+	for _, addr := range upstreams {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid upstream %q for %s, expected host:port: %w", addr, host, err)
+		}
+		r.upstreams = append(r.upstreams, p.newUpstream(addr))
+	}
+	err := p.hostsService.Add(&hosts.Params{IP: &p.serverIP, Hosts: &host})
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.routes[host] = r
+	p.mu.Unlock()
+	p.logger.Infof("proxying requests for %s to %s", host, strings.Join(upstreams, ", "))
+	return nil
+}
+
+// Deregister deals with no longer proxying requests for a host.
+func (p *Proxy) Deregister(host string) error {
+	host = normaliseHost(host)
+	p.mu.Lock()
+	_, ok := p.routes[host]
+	delete(p.routes, host)
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return p.hostsService.Remove(&hosts.Params{IP: &p.serverIP, Hosts: &host})
+}
+
+// Start does nothing as the proxy starts checking the health
+// of upstreams as soon as it is created.
+func (p *Proxy) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop deals with shutting down the proxy, the proxied hosts are
+// removed along with every other host when the hosts service is stopped.
+func (p *Proxy) Stop(ctx context.Context) error {
+	p.Shutdown()
+	return nil
+}
+
+// Shutdown deals with stopping the health checks and closing
+// connections to upstreams used for gRPC calls.
+func (p *Proxy) Shutdown() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// pick provides the next healthy upstream for a host, the bool is false
+// when requests for the host are not proxied.
+func (p *Proxy) pick(host string) (*upstream, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.routes[normaliseHost(host)]
+	if !ok {
+		return nil, false, nil
+	}
+	for i := 0; i < len(r.upstreams); i += 1 {
+		candidate := r.upstreams[r.next%len(r.upstreams)]
+		r.next = (r.next + 1) % len(r.upstreams)
+		if candidate.healthy {
+			return candidate, true, nil
+		}
+	}
+	return nil, true, fmt.Errorf("%s: %w", r.host, ErrNoHealthyUpstream)
+}
+
+// proxies determines whether requests for the host are proxied.
+func (p *Proxy) proxies(host string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.routes[normaliseHost(host)]
+	return ok
+}
+
+func (p *Proxy) checkHealthPeriodically() {
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// checkHealth marks upstreams that accept connections as healthy and the
+// rest as unhealthy, a connection is all that can be checked for every
+// emulator as they don't share a health endpoint.
+func (p *Proxy) checkHealth() {
+	p.mu.RLock()
+	upstreams := []*upstream{}
+	for _, r := range p.routes {
+		upstreams = append(upstreams, r.upstreams...)
+	}
+	p.mu.RUnlock()
+
+	for _, u := range upstreams {
+		conn, err := net.DialTimeout("tcp", u.addr, HealthCheckTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		p.setHealthy(u, err == nil, err)
+	}
+}
+
+func (p *Proxy) setHealthy(u *upstream, healthy bool, err error) {
+	p.mu.Lock()
+	changed := u.healthy != healthy
+	u.healthy = healthy
+	p.mu.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		p.logger.Infof("proxy upstream %s is healthy", u.addr)
+	} else {
+		p.logger.Warnf("proxy upstream %s is unhealthy: %s", u.addr, err)
+	}
+}
+
+// normaliseHost removes the port and any trailing dot from the host
+// of a request so it can be matched against registered hosts.
+func normaliseHost(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type ProxySuite struct {
+	hostsService *recordingHostsService
+	proxy        *Proxy
+	servers      []*httptest.Server
+}
+
+var _ = Suite(&ProxySuite{})
+
+func (s *ProxySuite) SetUpTest(c *C) {
+	logger, _ := test.NewNullLogger()
+	s.hostsService = &recordingHostsService{ips: map[string]string{}}
+	s.proxy = New(s.hostsService, "172.18.0.22", logrus.NewEntry(logger))
+	s.servers = nil
+}
+
+func (s *ProxySuite) TearDownTest(c *C) {
+	s.proxy.Shutdown()
+	for _, server := range s.servers {
+		server.Close()
+	}
+}
+
+// upstream starts a HTTP server that responds with its name
+// and the host and path of the request.
+func (s *ProxySuite) upstream(name string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s %s", name, r.Host, r.URL.Path, r.Header.Get("X-Forwarded-Host"))
+	}))
+	s.servers = append(s.servers, server)
+	return server.Listener.Addr().String()
+}
+
+func (s *ProxySuite) get(c *C, host string, path string) (int, string) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "cloud::1")
+	})
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	recorder := httptest.NewRecorder()
+	s.proxy.Handler(next).ServeHTTP(recorder, req)
+	body, err := ioutil.ReadAll(recorder.Result().Body)
+	c.Assert(err, IsNil)
+	return recorder.Code, string(body)
+}
+
+func closedAddr(c *C) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func (s *ProxySuite) Test_proxies_http_requests_for_registered_hosts(c *C) {
+	err := s.proxy.Register("Firestore.googleapis.local", s.upstream("firestore"))
+	c.Assert(err, IsNil)
+
+	code, body := s.get(c, "firestore.googleapis.local:5988", "/v1/projects/p/databases")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "firestore firestore.googleapis.local:5988 /v1/projects/p/databases firestore.googleapis.local:5988")
+
+	code, body = s.get(c, "secretmanager.googleapis.local", "/v1/projects/p/secrets")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "cloud::1")
+}
+
+func (s *ProxySuite) Test_points_registered_hosts_at_the_server_ip(c *C) {
+	err := s.proxy.Register("firestore.googleapis.local", s.upstream("firestore"))
+	c.Assert(err, IsNil)
+	c.Assert(s.hostsService.ips, DeepEquals, map[string]string{"firestore.googleapis.local": "172.18.0.22"})
+
+	err = s.proxy.Deregister("firestore.googleapis.local")
+	c.Assert(err, IsNil)
+	c.Assert(s.hostsService.ips, HasLen, 0)
+	code, body := s.get(c, "firestore.googleapis.local", "/")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "cloud::1")
+}
+
+func (s *ProxySuite) Test_fails_to_register_invalid_upstreams(c *C) {
+	err := s.proxy.Register("firestore.googleapis.local", "firestore")
+	c.Assert(err, ErrorMatches, `invalid upstream "firestore" for firestore.googleapis.local.*`)
+	err = s.proxy.Register("firestore.googleapis.local")
+	c.Assert(err, ErrorMatches, "a host and at least one upstream are required.*")
+	c.Assert(s.hostsService.ips, HasLen, 0)
+}
+
+func (s *ProxySuite) Test_spreads_requests_across_healthy_upstreams(c *C) {
+	down := closedAddr(c)
+	err := s.proxy.Register("spanner.googleapis.local", s.upstream("a"), down, s.upstream("b"))
+	c.Assert(err, IsNil)
+	s.proxy.checkHealth()
+
+	bodies := []string{}
+	for i := 0; i < 4; i += 1 {
+		code, body := s.get(c, "spanner.googleapis.local", "/")
+		c.Assert(code, Equals, http.StatusOK)
+		bodies = append(bodies, strings.Fields(body)[0])
+	}
+	c.Assert(bodies, DeepEquals, []string{"a", "b", "a", "b"})
+}
+
+func (s *ProxySuite) Test_responds_unavailable_when_no_upstream_is_healthy(c *C) {
+	err := s.proxy.Register("bigtable.googleapis.local", closedAddr(c))
+	c.Assert(err, IsNil)
+	s.proxy.checkHealth()
+
+	code, body := s.get(c, "bigtable.googleapis.local", "/")
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(body, Equals, "bigtable.googleapis.local: no healthy upstream\n")
+}
+
+func (s *ProxySuite) Test_marks_upstream_unhealthy_when_a_request_fails_to_connect(c *C) {
+	err := s.proxy.Register("bigtable.googleapis.local", closedAddr(c))
+	c.Assert(err, IsNil)
+
+	code, _ := s.get(c, "bigtable.googleapis.local", "/")
+	c.Assert(code, Equals, http.StatusBadGateway)
+	code, _ = s.get(c, "bigtable.googleapis.local", "/")
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *ProxySuite) Test_proxies_websocket_upgrades(c *C) {
+	// The upstream switches protocols and echoes everything
+	// written to the connection back in upper case.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		rw.WriteString(strings.ToUpper(line))
+		rw.Flush()
+	}))
+	s.servers = append(s.servers, upstream)
+	err := s.proxy.Register("firestore.googleapis.local", upstream.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	front := httptest.NewServer(s.proxy.Handler(http.NotFoundHandler()))
+	s.servers = append(s.servers, front)
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /listen HTTP/1.1\r\nHost: firestore.googleapis.local\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	fmt.Fprint(conn, "hello\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(echoed, Equals, "HELLO\n")
+}
+
+// serveGRPC serves a gRPC server on a local port until the test ends.
+func serveGRPC(c *C, server *grpc.Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+// frontServer creates a gRPC server that proxies calls
+// in the same way as the Cloud::1 gRPC server.
+func (s *ProxySuite) frontServer() *grpc.Server {
+	return grpc.NewServer(append(
+		s.proxy.ServerOptions(),
+		grpc.ChainStreamInterceptor(s.proxy.StreamServerInterceptor()),
+	)...)
+}
+
+func dialGRPC(c *C, addr string, authority string) *grpc.ClientConn {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithAuthority(authority))
+	c.Assert(err, IsNil)
+	return conn
+}
+
+func (s *ProxySuite) Test_proxies_grpc_calls_for_registered_hosts(c *C) {
+	received := metadata.MD{}
+	upstreamHealth := health.NewServer()
+	upstream := grpc.NewServer(grpc.UnaryInterceptor(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			received, _ = metadata.FromIncomingContext(ctx)
+			grpc.SetHeader(ctx, metadata.Pairs("x-upstream", "firestore"))
+			return handler(ctx, req)
+		},
+	))
+	healthpb.RegisterHealthServer(upstream, upstreamHealth)
+	defer upstream.Stop()
+	err := s.proxy.Register("firestore.googleapis.local", serveGRPC(c, upstream))
+	c.Assert(err, IsNil)
+	front := s.frontServer()
+	defer front.Stop()
+	conn := dialGRPC(c, serveGRPC(c, front), "firestore.googleapis.local:443")
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := metadata.MD{}
+	resp, err := client.Check(
+		metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer owner"),
+		&healthpb.HealthCheckRequest{},
+		grpc.Header(&header),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Status, Equals, healthpb.HealthCheckResponse_SERVING)
+	c.Assert(received.Get("authorization"), DeepEquals, []string{"Bearer owner"})
+	c.Assert(header.Get("x-upstream"), DeepEquals, []string{"firestore"})
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "spanner"})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "firestore"})
+	c.Assert(err, IsNil)
+	update, err := watch.Recv()
+	c.Assert(err, IsNil)
+	c.Assert(update.Status, Equals, healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+	upstreamHealth.SetServingStatus("firestore", healthpb.HealthCheckResponse_SERVING)
+	update, err = watch.Recv()
+	c.Assert(err, IsNil)
+	c.Assert(update.Status, Equals, healthpb.HealthCheckResponse_SERVING)
+}
+
+func (s *ProxySuite) Test_serves_grpc_calls_for_other_hosts_in_process(c *C) {
+	err := s.proxy.Register("firestore.googleapis.local", closedAddr(c))
+	c.Assert(err, IsNil)
+	frontHealth := health.NewServer()
+	frontHealth.SetServingStatus("secretmanager", healthpb.HealthCheckResponse_SERVING)
+	front := s.frontServer()
+	healthpb.RegisterHealthServer(front, frontHealth)
+	defer front.Stop()
+	addr := serveGRPC(c, front)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := dialGRPC(c, addr, "secretmanager.googleapis.local")
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "secretmanager"})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Status, Equals, healthpb.HealthCheckResponse_SERVING)
+
+	// Services the server doesn't know about are only proxied for registered hosts.
+	err = conn.Invoke(ctx, "/google.firestore.v1.Firestore/GetDocument", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	c.Assert(status.Code(err), Equals, codes.Unimplemented)
+
+	proxiedConn := dialGRPC(c, addr, "firestore.googleapis.local")
+	defer proxiedConn.Close()
+	err = proxiedConn.Invoke(ctx, "/google.firestore.v1.Firestore/GetDocument", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	c.Assert(status.Code(err), Equals, codes.Unavailable)
+}
+
+func (s *ProxySuite) Test_parses_upstreams(c *C) {
+	upstreams, hostOrder, err := ParseUpstreams(
+		"spanner.googleapis.local=spanner:9010, firestore.googleapis.local=firestore-a:8080,firestore.googleapis.local=firestore-b:8080",
+	)
+	c.Assert(err, IsNil)
+	c.Assert(hostOrder, DeepEquals, []string{"spanner.googleapis.local", "firestore.googleapis.local"})
+	c.Assert(upstreams, DeepEquals, map[string][]string{
+		"spanner.googleapis.local":   {"spanner:9010"},
+		"firestore.googleapis.local": {"firestore-a:8080", "firestore-b:8080"},
+	})
+
+	_, _, err = ParseUpstreams("firestore.googleapis.local")
+	c.Assert(err, ErrorMatches, `invalid proxy upstream "firestore.googleapis.local", expected host=host:port`)
+}
+
+// recordingHostsService keeps track of the IP each host is mapped to
+// in the same way as the hosts manager.
+type recordingHostsService struct {
+	ips map[string]string
+}
+
+func (m *recordingHostsService) Add(params *hosts.Params) error {
+	m.ips[*params.Hosts] = *params.IP
+	return nil
+}
+
+func (m *recordingHostsService) Remove(params *hosts.Params) error {
+	delete(m.ips, *params.Hosts)
+	return nil
+}
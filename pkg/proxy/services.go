@@ -0,0 +1,74 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/freshwebio/cloud-uno/pkg/logging"
+	"github.com/freshwebio/cloud-uno/pkg/netutils"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+)
+
+var (
+	// Key provides the key the proxy is provided under in the service registry.
+	Key = types.NewKey[*Proxy]("proxy")
+)
+
+// RegisterServices deals with registering the provider of the proxy so emulators can route
+// their hosts to the addresses they listen on, along with the routes in the proxy upstreams config.
+func RegisterServices(r *types.Registry) {
+	types.Provide(r, Key, func(r *types.Registry) (*Proxy, error) {
+		cfg := types.MustGet(r, config.Key)
+		serverIP, err := netutils.SelectServerIP(cfg)
+		if err != nil {
+			return nil, err
+		}
+		upstreams, hostOrder, err := ParseUpstreams(*cfg.ProxyUpstreams)
+		if err != nil {
+			return nil, err
+		}
+		proxy := New(types.MustGet(r, hosts.Key), serverIP, types.MustGet(r, logging.Key))
+		for _, host := range hostOrder {
+			err = proxy.Register(host, upstreams[host]...)
+			if err != nil {
+				proxy.Shutdown()
+				return nil, err
+			}
+		}
+		return proxy, nil
+	}, types.Requires(config.Key, logging.Key, hosts.Key))
+}
+
+// ParseUpstreams parses a comma separated list of host=host:port pairs into the upstreams
+// for each host, along with the hosts in the order they first appear in the list.
+// (e.g. "firestore.googleapis.local=firestore:8080,spanner.googleapis.local=spanner:9010")
+func ParseUpstreams(value string) (map[string][]string, []string, error) {
+	upstreams := map[string][]string{}
+	hostOrder := []string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		hostAndAddr := strings.SplitN(pair, "=", 2)
+		if len(hostAndAddr) != 2 || hostAndAddr[0] == "" || hostAndAddr[1] == "" {
+			return nil, nil, fmt.Errorf("invalid proxy upstream %q, expected host=host:port", pair)
+		}
+		host := normaliseHost(hostAndAddr[0])
+		if _, ok := upstreams[host]; !ok {
+			hostOrder = append(hostOrder, host)
+		}
+		upstreams[host] = append(upstreams[host], hostAndAddr[1])
+	}
+	return upstreams, hostOrder, nil
+}
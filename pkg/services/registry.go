@@ -0,0 +1,32 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package services
+
+import (
+	"github.com/freshwebio/cloud-uno/pkg/certs"
+	"github.com/freshwebio/cloud-uno/pkg/config"
+	"github.com/freshwebio/cloud-uno/pkg/gcloud"
+	"github.com/freshwebio/cloud-uno/pkg/hosts"
+	"github.com/freshwebio/cloud-uno/pkg/proxy"
+	"github.com/freshwebio/cloud-uno/pkg/types"
+)
+
+// NewDefaultRegistry produces a registry with the providers of the
+// built-in services along with the providers registered by the custom
+// register func, the registry still needs to be built.
+func NewDefaultRegistry(customRegisterFunc func(r *types.Registry)) *types.Registry {
+	r := types.NewRegistry()
+	config.RegisterServices(r)
+	customRegisterFunc(r)
+	certs.RegisterServices(r)
+	hosts.RegisterServices(r)
+	proxy.RegisterServices(r)
+	gcloud.RegisterServices(r)
+	return r
+}
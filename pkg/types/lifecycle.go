@@ -0,0 +1,25 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package types
+
+import "context"
+
+// Lifecycle provides an interface for services provided by a registry
+// that need to do work once every service has been provided or that
+// need to clean up after themselves when Cloud::1 shuts down.
+type Lifecycle interface {
+	// Start the service, the context is only used for starting up
+	// and is not tied to the lifetime of the service.
+	Start(ctx context.Context) error
+	// Stop the service, the context deadline is the time the service
+	// has to finish any work in progress and clean up. A service can be
+	// stopped without having been started, such as when another service
+	// fails to start, so it can undo what creating it did.
+	Stop(ctx context.Context) error
+}
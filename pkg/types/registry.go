@@ -0,0 +1,280 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+package types
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrDisabled is returned by providers of services that are disabled
+	// by config, services that depend on them optionally are provided without them.
+	ErrDisabled = errors.New("service is disabled")
+)
+
+// Key identifies a service in a registry along with the type of the service,
+// so services can be retrieved without type assertions.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey creates the key for a service of type T with a name
+// that is unique to the service in a registry.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name provides the name of the service the key identifies.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Dependency provides the name of a service a provider depends on,
+// every key is a dependency.
+type Dependency interface {
+	Name() string
+}
+
+// ProviderOption provides a way to declare the services a provider
+// depends on when it is registered.
+type ProviderOption func(p *provider)
+
+// Requires declares services the provider can't provide its service without,
+// the registry fails to build when one of them has no provider and the service
+// is disabled along with them when one of them is disabled.
+func Requires(deps ...Dependency) ProviderOption {
+	return func(p *provider) {
+		for _, dep := range deps {
+			p.requires = append(p.requires, dep.Name())
+		}
+	}
+}
+
+// Optional declares services the provider makes use of when they are provided,
+// when they are provided they are always provided first.
+func Optional(deps ...Dependency) ProviderOption {
+	return func(p *provider) {
+		for _, dep := range deps {
+			p.optional = append(p.optional, dep.Name())
+		}
+	}
+}
+
+type provider struct {
+	name     string
+	requires []string
+	optional []string
+	provide  func(r *Registry) (interface{}, error)
+}
+
+// Registry provides the services that make up a Cloud::1 server. Each service
+// is created by a provider that declares the services it depends on, so services
+// are created, started and stopped in dependency order. Services are retrieved
+// with the key they are provided under with Get and MustGet.
+type Registry struct {
+	providers map[string]*provider
+	// order holds the names of providers in the order they were first registered in,
+	// providers that don't depend on each other are called in this order.
+	order    []string
+	services map[string]interface{}
+	disabled map[string]bool
+	// built holds the names of the services that have been provided
+	// in the order they were provided in.
+	built   []string
+	stopped bool
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		providers: map[string]*provider{},
+		services:  map[string]interface{}{},
+		disabled:  map[string]bool{},
+	}
+}
+
+// Provide registers the provider of the service with the key, replacing the provider
+// already registered for the key. The provider is called when the registry is built,
+// after the services it depends on have been provided.
+func Provide[T any](r *Registry, key Key[T], provide func(r *Registry) (T, error), options ...ProviderOption) {
+	p := &provider{
+		name: key.Name(),
+		provide: func(r *Registry) (interface{}, error) {
+			return provide(r)
+		},
+	}
+	for _, option := range options {
+		option(p)
+	}
+	if _, exists := r.providers[p.name]; !exists {
+		r.order = append(r.order, p.name)
+	}
+	r.providers[p.name] = p
+}
+
+// Get retrieves the service for the key, false is returned when the service
+// is disabled or hasn't been provided.
+func Get[T any](r *Registry, key Key[T]) (T, bool) {
+	service, ok := r.services[key.Name()].(T)
+	return service, ok
+}
+
+// MustGet retrieves a service providers require, panicking when the service hasn't
+// been provided. Building a registry fails when a required service can't be provided,
+// so this only panics for services that are used without being declared as required.
+func MustGet[T any](r *Registry, key Key[T]) T {
+	service, ok := Get(r, key)
+	if !ok {
+		panic(fmt.Sprintf("service %s has not been provided, it must be declared as a required dependency", key.Name()))
+	}
+	return service
+}
+
+// Build deals with calling every provider after the providers of the services it depends on.
+// Missing providers and dependency cycles are reported before any provider is called.
+func (r *Registry) Build() error {
+	order, err := r.buildOrder()
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		p := r.providers[name]
+		if r.requiresDisabled(p) {
+			r.disabled[name] = true
+			continue
+		}
+		service, err := p.provide(r)
+		if errors.Is(err, ErrDisabled) {
+			r.disabled[name] = true
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to provide %s: %w", name, err)
+		}
+		r.services[name] = service
+		r.built = append(r.built, name)
+	}
+	return nil
+}
+
+func (r *Registry) requiresDisabled(p *provider) bool {
+	for _, dep := range p.requires {
+		if r.disabled[dep] {
+			return true
+		}
+	}
+	return false
+}
+
+// buildOrder sorts the providers so every provider comes after the providers
+// of the services it depends on, otherwise keeping the order they were registered in.
+func (r *Registry) buildOrder() ([]string, error) {
+	missing := []string{}
+	for _, name := range r.order {
+		for _, dep := range r.providers[name].requires {
+			if _, ok := r.providers[dep]; !ok {
+				missing = append(missing, fmt.Sprintf("%s requires %s, which has no provider", name, dep))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.New(strings.Join(missing, ", "))
+	}
+
+	order := []string{}
+	visited := map[string]bool{}
+	// path holds the providers being visited so a provider
+	// that is visited again is part of a cycle.
+	path := []string{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		for i, visiting := range path {
+			if visiting == name {
+				cycle := append(append([]string{}, path[i:]...), name)
+				return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		if visited[name] {
+			return nil
+		}
+		path = append(path, name)
+		p := r.providers[name]
+		for _, dep := range append(append([]string{}, p.requires...), p.optional...) {
+			if _, ok := r.providers[dep]; !ok {
+				continue
+			}
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		visited[name] = true
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range r.order {
+		err := visit(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Start deals with starting the services that implement Lifecycle in the order they
+// were provided in, so services are started after the services they depend on.
+func (r *Registry) Start(ctx context.Context) error {
+	for _, name := range r.built {
+		service, ok := r.services[name].(Lifecycle)
+		if !ok {
+			continue
+		}
+		err := service.Start(ctx)
+		if err != nil {
+			// Don't leave the services that have already started running
+			// as the caller won't stop services when starting fails.
+			r.Stop(ctx)
+			return fmt.Errorf("failed to start %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Stop deals with stopping the services that implement Lifecycle in the reverse order
+// they were provided in, so services are stopped before the services they depend on.
+// Services that haven't been started are stopped too as providing a service can have
+// side effects, such as adding hosts. Services are only stopped once.
+func (r *Registry) Stop(ctx context.Context) error {
+	if r.stopped {
+		return nil
+	}
+	r.stopped = true
+	failures := []string{}
+	for i := len(r.built) - 1; i >= 0; i-- {
+		name := r.built[i]
+		service, ok := r.services[name].(Lifecycle)
+		if !ok {
+			continue
+		}
+		// Every service is given the chance to stop as a service
+		// that fails to stop doesn't stop the others from cleaning up.
+		err := service.Stop(ctx)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("failed to stop %s: %s", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ", "))
+	}
+	return nil
+}
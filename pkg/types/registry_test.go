@@ -0,0 +1,229 @@
+// Copyright (c) 2022 FRESHWEB LTD.
+// Use of this software is governed by the Business Source License
+// included in the file LICENSE
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/LICENSE-Apache-2.0
+
+//go:build unit
+
+package types
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type RegistrySuite struct {
+	events []string
+}
+
+var _ = Suite(&RegistrySuite{})
+
+func (s *RegistrySuite) SetUpTest(c *C) {
+	s.events = nil
+}
+
+// lifecycleService records when it is provided, started and
+// stopped in the events of the suite.
+type lifecycleService struct {
+	name     string
+	events   *[]string
+	startErr error
+	stopErr  error
+}
+
+func (l *lifecycleService) Start(ctx context.Context) error {
+	*l.events = append(*l.events, "start "+l.name)
+	return l.startErr
+}
+
+func (l *lifecycleService) Stop(ctx context.Context) error {
+	*l.events = append(*l.events, "stop "+l.name)
+	return l.stopErr
+}
+
+var (
+	configKey  = NewKey[string]("config")
+	hostsKey   = NewKey[*lifecycleService]("hosts")
+	proxyKey   = NewKey[*lifecycleService]("proxy")
+	iamKey     = NewKey[*lifecycleService]("gcloud.iam")
+	oauth2Key  = NewKey[*lifecycleService]("gcloud.oauth2")
+	secretsKey = NewKey[*lifecycleService]("gcloud.secretmanager")
+)
+
+// provide registers the provider of a lifecycle service
+// that fails with the given error when it is provided.
+func (s *RegistrySuite) provide(
+	r *Registry,
+	key Key[*lifecycleService],
+	err error,
+	options ...ProviderOption,
+) *lifecycleService {
+	service := &lifecycleService{name: key.Name(), events: &s.events}
+	Provide(r, key, func(r *Registry) (*lifecycleService, error) {
+		s.events = append(s.events, "provide "+key.Name())
+		if err != nil {
+			return nil, err
+		}
+		return service, nil
+	}, options...)
+	return service
+}
+
+func (s *RegistrySuite) Test_provides_services_after_the_services_they_depend_on(c *C) {
+	r := NewRegistry()
+	s.provide(r, secretsKey, nil, Requires(configKey, hostsKey), Optional(iamKey))
+	s.provide(r, proxyKey, nil, Requires(configKey, hostsKey))
+	s.provide(r, iamKey, nil, Requires(hostsKey))
+	s.provide(r, hostsKey, nil, Requires(configKey))
+	Provide(r, configKey, func(r *Registry) (string, error) {
+		s.events = append(s.events, "provide config")
+		return "config", nil
+	})
+
+	c.Assert(r.Build(), IsNil)
+	c.Assert(s.events, DeepEquals, []string{
+		"provide config",
+		"provide hosts",
+		"provide gcloud.iam",
+		"provide gcloud.secretmanager",
+		"provide proxy",
+	})
+	cfg, ok := Get(r, configKey)
+	c.Assert(ok, Equals, true)
+	c.Assert(cfg, Equals, "config")
+	c.Assert(MustGet(r, secretsKey).name, Equals, "gcloud.secretmanager")
+}
+
+func (s *RegistrySuite) Test_reports_every_missing_provider_before_providing_any_service(c *C) {
+	r := NewRegistry()
+	s.provide(r, hostsKey, nil, Requires(configKey))
+	s.provide(r, proxyKey, nil, Requires(hostsKey, iamKey))
+
+	err := r.Build()
+	c.Assert(err, ErrorMatches, "hosts requires config, which has no provider, "+
+		"proxy requires gcloud.iam, which has no provider")
+	c.Assert(s.events, HasLen, 0)
+}
+
+func (s *RegistrySuite) Test_reports_dependency_cycles(c *C) {
+	r := NewRegistry()
+	s.provide(r, hostsKey, nil, Requires(proxyKey))
+	s.provide(r, proxyKey, nil, Requires(iamKey))
+	s.provide(r, iamKey, nil, Optional(hostsKey))
+
+	err := r.Build()
+	c.Assert(err, ErrorMatches, "dependency cycle: hosts -> proxy -> gcloud.iam -> hosts")
+	c.Assert(s.events, HasLen, 0)
+}
+
+func (s *RegistrySuite) Test_optional_dependencies_that_are_disabled_or_missing_are_left_out(c *C) {
+	r := NewRegistry()
+	s.provide(r, hostsKey, nil)
+	s.provide(r, iamKey, ErrDisabled, Requires(hostsKey))
+	s.provide(r, secretsKey, nil, Requires(hostsKey), Optional(iamKey, proxyKey))
+
+	c.Assert(r.Build(), IsNil)
+	_, ok := Get(r, iamKey)
+	c.Assert(ok, Equals, false)
+	_, ok = Get(r, secretsKey)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RegistrySuite) Test_services_that_require_a_disabled_service_are_disabled(c *C) {
+	r := NewRegistry()
+	s.provide(r, iamKey, ErrDisabled)
+	s.provide(r, oauth2Key, nil, Requires(iamKey))
+	s.provide(r, secretsKey, nil, Requires(oauth2Key))
+
+	c.Assert(r.Build(), IsNil)
+	c.Assert(s.events, DeepEquals, []string{"provide gcloud.iam"})
+	_, ok := Get(r, oauth2Key)
+	c.Assert(ok, Equals, false)
+	_, ok = Get(r, secretsKey)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RegistrySuite) Test_stops_the_services_provided_when_a_provider_fails(c *C) {
+	r := NewRegistry()
+	s.provide(r, hostsKey, nil)
+	s.provide(r, proxyKey, errors.New("invalid proxy upstream"), Requires(hostsKey))
+
+	err := r.Build()
+	c.Assert(err, ErrorMatches, "failed to provide proxy: invalid proxy upstream")
+	c.Assert(r.Stop(context.Background()), IsNil)
+	c.Assert(s.events, DeepEquals, []string{"provide hosts", "provide proxy", "stop hosts"})
+}
+
+func (s *RegistrySuite) Test_starts_services_in_dependency_order_and_stops_them_in_reverse(c *C) {
+	r := NewRegistry()
+	s.provide(r, proxyKey, nil, Requires(hostsKey))
+	s.provide(r, hostsKey, nil)
+	// Replacing a provider keeps the position it was first registered in.
+	s.provide(r, iamKey, errors.New("replaced"))
+	s.provide(r, iamKey, nil)
+	c.Assert(r.Build(), IsNil)
+	s.events = nil
+
+	c.Assert(r.Start(context.Background()), IsNil)
+	c.Assert(r.Stop(context.Background()), IsNil)
+	c.Assert(s.events, DeepEquals, []string{
+		"start hosts",
+		"start proxy",
+		"start gcloud.iam",
+		"stop gcloud.iam",
+		"stop proxy",
+		"stop hosts",
+	})
+}
+
+func (s *RegistrySuite) Test_stops_every_service_when_a_service_fails_to_start(c *C) {
+	r := NewRegistry()
+	s.provide(r, hostsKey, nil)
+	s.provide(r, proxyKey, nil)
+	iam := s.provide(r, iamKey, nil)
+	iam.startErr = errors.New("data directory is not writable")
+	s.provide(r, secretsKey, nil)
+	c.Assert(r.Build(), IsNil)
+	s.events = nil
+
+	err := r.Start(context.Background())
+	c.Assert(err, ErrorMatches, "failed to start gcloud.iam: data directory is not writable")
+	c.Assert(s.events, DeepEquals, []string{
+		"start hosts",
+		"start proxy",
+		"start gcloud.iam",
+		"stop gcloud.secretmanager",
+		"stop gcloud.iam",
+		"stop proxy",
+		"stop hosts",
+	})
+}
+
+func (s *RegistrySuite) Test_stops_every_service_when_some_fail_to_stop(c *C) {
+	r := NewRegistry()
+	hosts := s.provide(r, hostsKey, nil)
+	hosts.stopErr = errors.New("hosts file is locked")
+	proxy := s.provide(r, proxyKey, nil)
+	proxy.stopErr = context.DeadlineExceeded
+	s.provide(r, iamKey, nil)
+	c.Assert(r.Build(), IsNil)
+	s.events = nil
+
+	c.Assert(r.Start(context.Background()), IsNil)
+	err := r.Stop(context.Background())
+	c.Assert(err, ErrorMatches, "failed to stop proxy: context deadline exceeded, failed to stop hosts: hosts file is locked")
+	c.Assert(s.events[3:], DeepEquals, []string{"stop gcloud.iam", "stop proxy", "stop hosts"})
+	// Services are only stopped once.
+	c.Assert(r.Stop(context.Background()), IsNil)
+	c.Assert(s.events, HasLen, 6)
+}
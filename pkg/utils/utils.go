@@ -11,6 +11,15 @@ package utils
 import (
 	"os"
 	"strings"
+
+	"github.com/freshwebio/cloud-uno/pkg/types"
+	"github.com/spf13/afero"
+)
+
+var (
+	// FileSystemKey provides the key the file system services implemented
+	// directly in Cloud::1 use is provided under in the service registry.
+	FileSystemKey = types.NewKey[afero.Fs]("fs")
 )
 
 // CommaSeparatedListContains determines whether the provided